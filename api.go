@@ -16,10 +16,10 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -41,7 +41,7 @@ func hijackServer(w http.ResponseWriter) (io.ReadCloser, io.Writer, error) {
 	return conn, conn, nil
 }
 
-//If we don't do this, POST method without Content-type (even with empty body) will fail
+// If we don't do this, POST method without Content-type (even with empty body) will fail
 func parseForm(r *http.Request) error {
 	if r == nil {
 		return nil
@@ -69,6 +69,8 @@ func httpError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusConflict
 	} else if strings.HasPrefix(err.Error(), "Impossible") {
 		statusCode = http.StatusNotAcceptable
+	} else if strings.HasPrefix(err.Error(), "Forbidden") {
+		statusCode = http.StatusForbidden
 	} else if strings.HasPrefix(err.Error(), "Wrong login/password") {
 		statusCode = http.StatusUnauthorized
 	} else if strings.Contains(err.Error(), "hasn't been activated") {
@@ -106,6 +108,15 @@ func getBoolParam(value string) (bool, error) {
 	return ret, nil
 }
 
+// getEncodingParam parses the compression of the layers of a transfer,
+// encoding by default
+func getEncodingParam(value string, encoding archive.Encoding) (archive.Encoding, error) {
+	if value == "" {
+		return encoding, nil
+	}
+	return archive.ParseEncoding(value)
+}
+
 func matchesContentType(contentType, expectedType string) bool {
 	mimetype, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
@@ -146,13 +157,12 @@ func postContainersKill(srv *Server, version float64, w http.ResponseWriter, r *
 
 	signal := 0
 	if r != nil {
-		s := r.Form.Get("signal")
-		if s != "" {
-			if s, err := strconv.Atoi(s); err != nil {
+		if s := r.Form.Get("signal"); s != "" {
+			sig, err := utils.ParseSignal(s)
+			if err != nil {
 				return err
-			} else {
-				signal = s
 			}
+			signal = int(sig)
 		}
 	}
 	if err := srv.ContainerKill(name, signal); err != nil {
@@ -175,6 +185,81 @@ func getContainersExport(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func getImagesGet(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	encoding, err := getEncodingParam(r.Form.Get("compression"), archive.DefaultSaveEncoding)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	return srv.ImageSave(r.Form["names"], w, encoding)
+}
+
+func postGraphCheck(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	repair, err := getBoolParam(r.Form.Get("repair"))
+	if err != nil {
+		return err
+	}
+	outs, err := srv.GraphCheck(repair)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, outs)
+}
+
+func postImagesPrune(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	dryRun, err := getBoolParam(r.Form.Get("dryrun"))
+	if err != nil {
+		return err
+	}
+	out, err := srv.ImagesPrune(dryRun)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func postImagesLoad(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	w.Header().Set("Content-Type", "application/json")
+	sf := utils.NewStreamFormatter(true)
+	if err := srv.ImageLoad(r.Body, w, sf); err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func postStorageMigrate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	driver := r.Form.Get("driver")
+	if driver == "" {
+		return fmt.Errorf("Bad parameter driver: missing")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sf := utils.NewStreamFormatter(true)
+	if err := srv.StorageMigrate(driver, w, sf); err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
 func getImagesJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -184,9 +269,22 @@ func getImagesJSON(srv *Server, version float64, w http.ResponseWriter, r *http.
 	if err != nil {
 		return err
 	}
-	filter := r.Form.Get("filter")
+	// The repository names can't have a =, unlike the label filters
+	var filter string
+	var rawFilters []string
+	for _, value := range r.Form["filter"] {
+		if strings.Contains(value, "=") {
+			rawFilters = append(rawFilters, value)
+		} else {
+			filter = value
+		}
+	}
+	filters, err := parseFilters(rawFilters, "label")
+	if err != nil {
+		return err
+	}
 
-	outs, err := srv.Images(all, filter)
+	outs, err := srv.Images(all, filter, filters["label"])
 	if err != nil {
 		return err
 	}
@@ -219,6 +317,18 @@ func getInfo(srv *Server, version float64, w http.ResponseWriter, r *http.Reques
 	return writeJSON(w, http.StatusOK, srv.DockerInfo())
 }
 
+func getPlugins(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, srv.Plugins())
+}
+
+func getSystemDf(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	usage, err := srv.DiskUsage()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, usage)
+}
+
 func getEvents(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	sendEvent := func(wf *utils.WriteFlusher, event *utils.JSONMessage) error {
 		b, err := json.Marshal(event)
@@ -303,6 +413,94 @@ func getContainersChanges(srv *Server, version float64, w http.ResponseWriter, r
 	return writeJSON(w, http.StatusOK, changesStr)
 }
 
+func getContainersInitConfig(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	system := r.Form.Get("system")
+	if system == "" {
+		system = "systemd"
+	}
+	restart := r.Form.Get("restart")
+	if restart == "" {
+		restart = InitRestartAlways
+	}
+	config, err := srv.ContainerInitConfig(vars["name"], system, restart)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(config))
+	return err
+}
+
+func getContainersLogs(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+
+	stdout, err := getBoolParam(r.Form.Get("stdout"))
+	if err != nil {
+		return err
+	}
+	stderr, err := getBoolParam(r.Form.Get("stderr"))
+	if err != nil {
+		return err
+	}
+	timestamps, err := getBoolParam(r.Form.Get("timestamps"))
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if s := r.Form.Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad parameter since: %s", s)
+		}
+		since = time.Unix(n, 0)
+	}
+
+	tail := -1
+	if t := r.Form.Get("tail"); t != "" && t != "all" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Bad parameter tail: %s", t)
+		}
+		tail = n
+	}
+
+	c, err := srv.ContainerInspect(name)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	w.WriteHeader(http.StatusOK)
+
+	var outStream, errStream io.Writer
+	outStream = utils.NewWriteFlusher(w)
+	if !c.Config.Tty {
+		errStream = utils.NewStdWriter(outStream, utils.Stderr)
+		outStream = utils.NewStdWriter(outStream, utils.Stdout)
+	} else {
+		errStream = outStream
+	}
+
+	if err := srv.ContainerLogs(name, since, tail, timestamps, stdout, stderr, outStream, errStream); err != nil {
+		fmt.Fprintf(outStream, "Error: %s\n", err)
+	}
+	return nil
+}
+
 func getContainersTop(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if version < 1.4 {
 		return fmt.Errorf("top was improved a lot since 1.3, Please upgrade your docker client.")
@@ -323,6 +521,24 @@ func getContainersTop(srv *Server, version float64, w http.ResponseWriter, r *ht
 	return writeJSON(w, http.StatusOK, procsStr)
 }
 
+// getContainersNamespaces gives the namespaces of a container, which let
+// the caller run anything in it, to the callers of the unix socket only:
+// its permissions restrict it to root and the docker group, unlike TCP.
+func getContainersNamespaces(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	// The remote address of the clients of a unix socket is not host:port
+	if _, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return fmt.Errorf("Forbidden: the namespaces of a container are only given on the unix socket")
+	}
+	namespaces, err := srv.ContainerNamespaces(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, namespaces)
+}
+
 func getContainersJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -341,8 +557,12 @@ func getContainersJSON(srv *Server, version float64, w http.ResponseWriter, r *h
 	if err != nil {
 		n = -1
 	}
+	filters, err := parseFilters(r.Form["filter"], "label")
+	if err != nil {
+		return err
+	}
 
-	outs := srv.Containers(all, size, n, since, before)
+	outs := srv.Containers(all, size, n, since, before, filters)
 
 	if version < 1.5 {
 		outs2 := []APIContainersOld{}
@@ -391,7 +611,19 @@ func postCommit(srv *Server, version float64, w http.ResponseWriter, r *http.Req
 	container := r.Form.Get("container")
 	author := r.Form.Get("author")
 	comment := r.Form.Get("comment")
-	id, err := srv.ContainerCommit(container, repo, tag, author, comment, config)
+	// Running containers are paused unless told otherwise
+	pause := true
+	if r.Form.Get("pause") != "" {
+		var err error
+		if pause, err = getBoolParam(r.Form.Get("pause")); err != nil {
+			return err
+		}
+	}
+	squash, err := getBoolParam(r.Form.Get("squash"))
+	if err != nil {
+		return err
+	}
+	id, err := srv.ContainerCommit(container, repo, tag, author, comment, config, pause, squash)
 	if err != nil {
 		return err
 	}
@@ -439,7 +671,7 @@ func postImagesCreate(srv *Server, version float64, w http.ResponseWriter, r *ht
 			return err
 		}
 	} else { //import
-		if err := srv.ImageImport(src, repo, tag, r.Body, w, sf); err != nil {
+		if err := srv.ImageImport(src, repo, tag, r.Form.Get("checksum"), r.Body, w, sf); err != nil {
 			if sf.Used() {
 				w.Write(sf.FormatError(err))
 				return nil
@@ -450,6 +682,41 @@ func postImagesCreate(srv *Server, version float64, w http.ResponseWriter, r *ht
 	return nil
 }
 
+func postUpgrade(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	force, err := getBoolParam(r.Form.Get("force"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sf := utils.NewStreamFormatter(true)
+	if err := srv.SelfUpgrade(r.Form.Get("url"), force, w, sf); err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func postClock(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	seconds, err := strconv.Atoi(r.Form.Get("advance"))
+	if err != nil {
+		return fmt.Errorf("Bad parameter advance: %s", err)
+	}
+	if err := advanceTestClock(time.Duration(seconds) * time.Second); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func getImagesSearch(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -490,6 +757,21 @@ func postImagesInsert(srv *Server, version float64, w http.ResponseWriter, r *ht
 	return writeJSON(w, http.StatusOK, &APIID{ID: imgID})
 }
 
+func postImagesSign(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	sig := &ImageSignature{}
+	if err := json.NewDecoder(r.Body).Decode(sig); err != nil {
+		return fmt.Errorf("Bad parameter signature: %s", err)
+	}
+	if err := srv.ImageSign(vars["name"], sig); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
 func postImagesPush(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	metaHeaders := map[string][]string{}
 	for k, v := range r.Header {
@@ -522,11 +804,15 @@ func postImagesPush(srv *Server, version float64, w http.ResponseWriter, r *http
 		return fmt.Errorf("Missing parameter")
 	}
 	name := vars["name"]
+	encoding, err := getEncodingParam(r.Form.Get("compression"), archive.DefaultPushEncoding)
+	if err != nil {
+		return err
+	}
 	if version > 1.0 {
 		w.Header().Set("Content-Type", "application/json")
 	}
 	sf := utils.NewStreamFormatter(version > 1.0)
-	if err := srv.ImagePush(name, w, sf, authConfig, metaHeaders); err != nil {
+	if err := srv.ImagePush(name, w, sf, authConfig, metaHeaders, encoding); err != nil {
 		if sf.Used() {
 			w.Write(sf.FormatError(err))
 			return nil
@@ -621,10 +907,57 @@ func deleteContainers(srv *Server, version float64, w http.ResponseWriter, r *ht
 		return err
 	}
 
-	if err := srv.ContainerDestroy(name, removeVolume, removeLink); err != nil {
+	progress, err := getBoolParam(r.Form.Get("progress"))
+	if err != nil {
+		return err
+	}
+	async, err := getBoolParam(r.Form.Get("async"))
+	if err != nil {
+		return err
+	}
+	cancelRemoval, err := getBoolParam(r.Form.Get("cancel"))
+	if err != nil {
+		return err
+	}
+
+	if cancelRemoval {
+		if err := srv.ContainerDestroyCancel(name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if async {
+		if removeLink {
+			return fmt.Errorf("Bad parameter: a link can't be removed in the background")
+		}
+		if err := srv.ContainerDestroyAsync(name, removeVolume); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	if !progress {
+		if err := srv.ContainerDestroy(name, removeVolume, removeLink, nil, nil, nil); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	// The removal stops when the client disconnects
+	var cancel <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		cancel = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sf := utils.NewStreamFormatter(true)
+	if err := srv.ContainerDestroy(name, removeVolume, removeLink, utils.NewWriteFlusher(w), sf, cancel); err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
 		return err
 	}
-	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
@@ -679,6 +1012,31 @@ func postContainersStart(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func postContainersStandby(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var hostConfig *HostConfig
+	if r.Body != nil {
+		if matchesContentType(r.Header.Get("Content-Type"), "application/json") {
+			hostConfig = &HostConfig{}
+			if err := json.NewDecoder(r.Body).Decode(hostConfig); err != nil {
+				return err
+			}
+		}
+	}
+
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if err := srv.RegisterLinks(name, hostConfig); err != nil {
+		return err
+	}
+	if err := srv.ContainerStandby(name, hostConfig); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func postContainersStop(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -700,18 +1058,73 @@ func postContainersStop(srv *Server, version float64, w http.ResponseWriter, r *
 	return nil
 }
 
+func postContainersSwap(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	image := r.Form.Get("image")
+	if image == "" {
+		return fmt.Errorf("Bad parameter image: missing")
+	}
+	timeout := DefaultSwapTimeout
+	if t := r.Form.Get("t"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("Bad parameter t: %s", t)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	id, err := srv.ContainerSwap(vars["name"], image, timeout)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, &APIRun{ID: id})
+}
+
 func postContainersWait(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
+	if err := parseForm(r); err != nil {
+		return err
+	}
 	name := vars["name"]
 
-	status, err := srv.ContainerWait(name)
+	var (
+		timeout   time.Duration
+		condition string
+	)
+	if r != nil {
+		if t := r.Form.Get("timeout"); t != "" {
+			seconds, err := strconv.Atoi(t)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("Bad parameter timeout: %s", t)
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+		condition = r.Form.Get("condition")
+	}
+
+	// The headers are sent once the daemon waits, for the client to know
+	// it can't miss the condition anymore
+	var wf *utils.WriteFlusher
+	apiWait, err := srv.ContainerWait(name, condition, timeout, func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		wf = utils.NewWriteFlusher(w)
+		wf.Flush()
+	})
 	if err != nil {
+		if wf != nil {
+			return nil
+		}
 		return err
 	}
-
-	return writeJSON(w, http.StatusOK, &APIWait{StatusCode: status})
+	return json.NewEncoder(wf).Encode(apiWait)
 }
 
 func postContainersResize(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
@@ -719,23 +1132,231 @@ func postContainersResize(srv *Server, version float64, w http.ResponseWriter, r
 		return err
 	}
 	height, err := strconv.Atoi(r.Form.Get("h"))
+	if err != nil || height <= 0 {
+		return fmt.Errorf("Bad parameter h: %s", r.Form.Get("h"))
+	}
+	width, err := strconv.Atoi(r.Form.Get("w"))
+	if err != nil || width <= 0 {
+		return fmt.Errorf("Bad parameter w: %s", r.Form.Get("w"))
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if err := srv.ContainerResize(name, height, width); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func postContainersRename(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	newName := r.Form.Get("name")
+	if newName == "" {
+		return fmt.Errorf("Bad parameter name: missing")
+	}
+	if err := srv.ContainerRename(vars["name"], newName); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersUpdate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	// Nothing else can be updated yet
+	if r.Form.Get("priority") == "" {
+		return fmt.Errorf("Bad parameter: nothing to update, priority is missing")
+	}
+	priority, err := strconv.Atoi(r.Form.Get("priority"))
 	if err != nil {
+		return fmt.Errorf("Bad parameter priority: %s", r.Form.Get("priority"))
+	}
+	if err := srv.ContainerUpdate(vars["name"], priority); err != nil {
 		return err
 	}
-	width, err := strconv.Atoi(r.Form.Get("w"))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getContainersForwards(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	forwards, err := srv.ContainerForwards(vars["name"])
 	if err != nil {
 		return err
 	}
+	return writeJSON(w, http.StatusOK, forwards)
+}
+
+func getNetworksContainers(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
-	name := vars["name"]
-	if err := srv.ContainerResize(name, height, width); err != nil {
+	containers, err := srv.NetworkContainers(vars["name"])
+	if err != nil {
 		return err
 	}
+	return writeJSON(w, http.StatusOK, containers)
+}
+
+func postContainersForward(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	port := r.Form.Get("port")
+	if port == "" {
+		return fmt.Errorf("Bad parameter port: missing")
+	}
+	ttl := DefaultPortForwardTTL
+	if rawTTL := r.Form.Get("ttl"); rawTTL != "" {
+		seconds, err := strconv.Atoi(rawTTL)
+		if err != nil {
+			return fmt.Errorf("Bad parameter ttl: %s", rawTTL)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	forward, err := srv.ContainerForward(vars["name"], port, ttl)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, forward)
+}
+
+func postContainersUnforward(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	id := r.Form.Get("id")
+	if id == "" {
+		return fmt.Errorf("Bad parameter id: missing")
+	}
+	if err := srv.ContainerUnforward(vars["name"], id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersMirror(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	target := r.Form.Get("target")
+	if target == "" {
+		return fmt.Errorf("Bad parameter target: missing")
+	}
+	if err := srv.ContainerMirror(vars["name"], target); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersUnmirror(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerUnmirror(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersConnect(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	bridge := r.Form.Get("bridge")
+	if bridge == "" {
+		return fmt.Errorf("Bad parameter bridge: missing")
+	}
+	settings, err := srv.ContainerConnect(vars["name"], bridge, r.Form.Get("iface"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, settings)
+}
+
+func postContainersDisconnect(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	iface := r.Form.Get("iface")
+	if iface == "" {
+		return fmt.Errorf("Bad parameter iface: missing")
+	}
+	if err := srv.ContainerDisconnect(vars["name"], iface); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+func postContainersPublish(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	port := r.Form.Get("port")
+	if port == "" {
+		return fmt.Errorf("Bad parameter port: missing")
+	}
+	ports, err := srv.ContainerPublish(vars["name"], port)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ports)
+}
+
+func postContainersUnpublish(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	port := r.Form.Get("port")
+	if port == "" {
+		return fmt.Errorf("Bad parameter port: missing")
+	}
+	ports, err := srv.ContainerUnpublish(vars["name"], port)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ports)
+}
+
 func postContainersAttach(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -870,7 +1491,7 @@ func getContainersByName(srv *Server, version float64, w http.ResponseWriter, r
 		return fmt.Errorf("Conflict between containers and images")
 	}
 
-	return writeJSON(w, http.StatusOK, container)
+	return writeJSON(w, http.StatusOK, &APIInspect{container, srv.ContainerInspectNetwork(container)})
 }
 
 func getImagesByName(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
@@ -901,6 +1522,7 @@ func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	rawSuppressOutput := r.FormValue("q")
 	rawNoCache := r.FormValue("nocache")
 	rawRm := r.FormValue("rm")
+	rawSquash := r.FormValue("squash")
 	repoName, tag := utils.ParseRepositoryTag(repoName)
 
 	var context io.Reader
@@ -908,20 +1530,13 @@ func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	if remoteURL == "" {
 		context = r.Body
 	} else if utils.IsGIT(remoteURL) {
-		if !strings.HasPrefix(remoteURL, "git://") {
-			remoteURL = "https://" + remoteURL
-		}
 		root, err := ioutil.TempDir("", "docker-build-git")
 		if err != nil {
 			return err
 		}
 		defer os.RemoveAll(root)
 
-		if output, err := exec.Command("git", "clone", remoteURL, root).CombinedOutput(); err != nil {
-			return fmt.Errorf("Error trying to use git: %s (%s)", err, output)
-		}
-
-		c, err := archive.Tar(root, archive.Bzip2)
+		c, err := mkGitContext(remoteURL, root, r.FormValue("dockerfile"))
 		if err != nil {
 			return err
 		}
@@ -955,8 +1570,38 @@ func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	if err != nil {
 		return err
 	}
+	squash, err := getBoolParam(rawSquash)
+	if err != nil {
+		return err
+	}
+	buildArgs, err := ParseBuildArgs(r.Form["buildarg"])
+	if err != nil {
+		return err
+	}
+	var limits BuildLimits
+	for _, param := range []struct {
+		name  string
+		value *int64
+		min   int64
+	}{
+		{"memory", &limits.Memory, 0},
+		{"memswap", &limits.MemorySwap, -1},
+		{"cpushares", &limits.CpuShares, 0},
+	} {
+		if raw := r.FormValue(param.name); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || value < param.min {
+				return fmt.Errorf("Bad parameter %s: %s", param.name, raw)
+			}
+			*param.value = value
+		}
+	}
+	// As for the containers created with docker run
+	if limits.Memory != 0 && limits.Memory < 524288 {
+		return fmt.Errorf("Bad parameter memory: %d, the memory limit must be given in bytes (minimum 524288 bytes)", limits.Memory)
+	}
 
-	b := NewBuildFile(srv, utils.NewWriteFlusher(w), !suppressOutput, !noCache, rm)
+	b := NewBuildFile(srv, utils.NewWriteFlusher(w), !suppressOutput, !noCache, rm, squash, r.Form["cachefrom"], buildArgs, r.FormValue("dockerfile"), limits)
 	id, err := b.Build(context)
 	if err != nil {
 		return fmt.Errorf("Error build: %s", err)
@@ -997,6 +1642,36 @@ func postContainersCopy(srv *Server, version float64, w http.ResponseWriter, r *
 	return nil
 }
 
+func postContainersUpload(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	name := vars["name"]
+
+	resource := r.Form.Get("path")
+	if resource == "" {
+		return fmt.Errorf("Bad parameter path: it cannot be empty")
+	}
+	noOwner, err := getBoolParam(r.Form.Get("noowner"))
+	if err != nil {
+		return err
+	}
+	noPerms, err := getBoolParam(r.Form.Get("noperms"))
+	if err != nil {
+		return err
+	}
+
+	options := &archive.UntarOptions{NoSameOwner: noOwner, NoSamePermissions: noPerms}
+	if err := srv.ContainerCopyTo(name, resource, r.Body, options); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func optionsHandler(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	w.WriteHeader(http.StatusOK)
 	return nil
@@ -1035,6 +1710,12 @@ func makeHttpHandler(srv *Server, logging bool, localMethod string, localRoute s
 			return
 		}
 
+		if err := srv.authorizeRequest(r); err != nil {
+			utils.Errorf("Error: %s", err)
+			httpError(w, err)
+			return
+		}
+
 		if err := handlerFunc(srv, version, w, r, mux.Vars(r)); err != nil {
 			utils.Errorf("Error: %s", err)
 			httpError(w, err)
@@ -1047,39 +1728,68 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/events":                         getEvents,
-			"/info":                           getInfo,
-			"/version":                        getVersion,
-			"/images/json":                    getImagesJSON,
-			"/images/viz":                     getImagesViz,
-			"/images/search":                  getImagesSearch,
-			"/images/{name:.*}/history":       getImagesHistory,
-			"/images/{name:.*}/json":          getImagesByName,
-			"/containers/ps":                  getContainersJSON,
-			"/containers/json":                getContainersJSON,
-			"/containers/{name:.*}/export":    getContainersExport,
-			"/containers/{name:.*}/changes":   getContainersChanges,
-			"/containers/{name:.*}/json":      getContainersByName,
-			"/containers/{name:.*}/top":       getContainersTop,
-			"/containers/{name:.*}/attach/ws": wsContainersAttach,
+			"/events":                          getEvents,
+			"/info":                            getInfo,
+			"/plugins":                         getPlugins,
+			"/system/df":                       getSystemDf,
+			"/version":                         getVersion,
+			"/images/json":                     getImagesJSON,
+			"/images/get":                      getImagesGet,
+			"/images/viz":                      getImagesViz,
+			"/images/search":                   getImagesSearch,
+			"/images/{name:.*}/history":        getImagesHistory,
+			"/images/{name:.*}/json":           getImagesByName,
+			"/containers/ps":                   getContainersJSON,
+			"/containers/json":                 getContainersJSON,
+			"/containers/{name:.*}/export":     getContainersExport,
+			"/containers/{name:.*}/changes":    getContainersChanges,
+			"/containers/{name:.*}/json":       getContainersByName,
+			"/containers/{name:.*}/top":        getContainersTop,
+			"/containers/{name:.*}/initconfig": getContainersInitConfig,
+			"/containers/{name:.*}/forwards":   getContainersForwards,
+			"/containers/{name:.*}/namespaces": getContainersNamespaces,
+			"/containers/{name:.*}/logs":       getContainersLogs,
+			"/containers/{name:.*}/attach/ws":  wsContainersAttach,
+			"/networks/{name:.*}/containers":   getNetworksContainers,
 		},
 		"POST": {
-			"/auth":                         postAuth,
-			"/commit":                       postCommit,
-			"/build":                        postBuild,
-			"/images/create":                postImagesCreate,
-			"/images/{name:.*}/insert":      postImagesInsert,
-			"/images/{name:.*}/push":        postImagesPush,
-			"/images/{name:.*}/tag":         postImagesTag,
-			"/containers/create":            postContainersCreate,
-			"/containers/{name:.*}/kill":    postContainersKill,
-			"/containers/{name:.*}/restart": postContainersRestart,
-			"/containers/{name:.*}/start":   postContainersStart,
-			"/containers/{name:.*}/stop":    postContainersStop,
-			"/containers/{name:.*}/wait":    postContainersWait,
-			"/containers/{name:.*}/resize":  postContainersResize,
-			"/containers/{name:.*}/attach":  postContainersAttach,
-			"/containers/{name:.*}/copy":    postContainersCopy,
+			"/auth":                           postAuth,
+			"/commit":                         postCommit,
+			"/build":                          postBuild,
+			"/images/create":                  postImagesCreate,
+			"/images/load":                    postImagesLoad,
+			"/images/prune":                   postImagesPrune,
+			"/graph/check":                    postGraphCheck,
+			"/storage/migrate":                postStorageMigrate,
+			"/images/{name:.*}/insert":        postImagesInsert,
+			"/images/{name:.*}/push":          postImagesPush,
+			"/images/{name:.*}/sign":          postImagesSign,
+			"/images/{name:.*}/tag":           postImagesTag,
+			"/containers/create":              postContainersCreate,
+			"/containers/{name:.*}/kill":      postContainersKill,
+			"/containers/{name:.*}/restart":   postContainersRestart,
+			"/containers/{name:.*}/standby":   postContainersStandby,
+			"/containers/{name:.*}/start":     postContainersStart,
+			"/containers/{name:.*}/stop":      postContainersStop,
+			"/containers/{name:.*}/swap":      postContainersSwap,
+			"/containers/{name:.*}/wait":      postContainersWait,
+			"/containers/{name:.*}/resize":    postContainersResize,
+			"/containers/{name:.*}/attach":    postContainersAttach,
+			"/containers/{name:.*}/copy":      postContainersCopy,
+			"/containers/{name:.*}/upload":    postContainersUpload,
+			"/containers/{name:.*}/forward":   postContainersForward,
+			"/containers/{name:.*}/mirror":    postContainersMirror,
+			"/containers/{name:.*}/unforward": postContainersUnforward,
+			"/containers/{name:.*}/unmirror":  postContainersUnmirror,
+			"/containers/{name:.*}/publish":   postContainersPublish,
+			"/containers/{name:.*}/rename":    postContainersRename,
+			"/containers/{name:.*}/update":    postContainersUpdate,
+			"/containers/{name:.*}/unpublish": postContainersUnpublish,
+			"/upgrade":                        postUpgrade,
+			"/clock":                          postClock,
+
+			"/containers/{name:.*}/connect":    postContainersConnect,
+			"/containers/{name:.*}/disconnect": postContainersDisconnect,
 		},
 		"DELETE": {
 			"/containers/{name:.*}": deleteContainers,
@@ -1121,7 +1831,7 @@ func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
 	if err != nil {
 		return err
 	}
-	l, e := net.Listen(proto, addr)
+	l, e := srv.listen(proto, addr)
 	if e != nil {
 		return e
 	}
@@ -1,6 +1,9 @@
 package docker
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 type APIHistory struct {
 	ID        string   `json:"Id"`
@@ -8,6 +11,8 @@ type APIHistory struct {
 	Created   int64
 	CreatedBy string `json:",omitempty"`
 	Size      int64
+	// The size of the image with its ancestors
+	VirtualSize int64
 }
 
 type APIImages struct {
@@ -16,7 +21,8 @@ type APIImages struct {
 	Created     int64
 	Size        int64
 	VirtualSize int64
-	ParentId    string `json:",omitempty"`
+	ParentId    string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
 }
 
 type APIImagesOld struct {
@@ -52,15 +58,18 @@ type APIInfo struct {
 	Debug              bool
 	Containers         int
 	Images             int
-	NFd                int    `json:",omitempty"`
-	NGoroutines        int    `json:",omitempty"`
-	MemoryLimit        bool   `json:",omitempty"`
-	SwapLimit          bool   `json:",omitempty"`
-	IPv4Forwarding     bool   `json:",omitempty"`
-	LXCVersion         string `json:",omitempty"`
-	NEventsListener    int    `json:",omitempty"`
-	KernelVersion      string `json:",omitempty"`
-	IndexServerAddress string `json:",omitempty"`
+	NFd                int      `json:",omitempty"`
+	NGoroutines        int      `json:",omitempty"`
+	MemoryLimit        bool     `json:",omitempty"`
+	SwapLimit          bool     `json:",omitempty"`
+	IPv4Forwarding     bool     `json:",omitempty"`
+	LXCVersion         string   `json:",omitempty"`
+	NEventsListener    int      `json:",omitempty"`
+	KernelVersion      string   `json:",omitempty"`
+	IndexServerAddress string   `json:",omitempty"`
+	Driver             string   `json:",omitempty"`
+	RegistryMirrors    []string `json:",omitempty"`
+	InsecureRegistries []string `json:",omitempty"`
 }
 
 type APITop struct {
@@ -68,6 +77,20 @@ type APITop struct {
 	Processes [][]string
 }
 
+// APINamespaces holds what nsenter needs to enter a running container: the
+// pid of its first process, as seen from the host, its namespaces by kind
+// and its cgroup directories by subsystem
+type APINamespaces struct {
+	Pid        int
+	Namespaces map[string]APINamespace
+	Cgroups    map[string]string
+}
+
+type APINamespace struct {
+	Path  string
+	Inode string
+}
+
 type APIRmi struct {
 	Deleted  string `json:",omitempty"`
 	Untagged string `json:",omitempty"`
@@ -83,6 +106,7 @@ type APIContainers struct {
 	SizeRw     int64
 	SizeRootFs int64
 	Names      []string
+	Labels     map[string]string `json:",omitempty"`
 }
 
 func (self *APIContainers) ToLegacy() APIContainersOld {
@@ -123,6 +147,26 @@ type APIPort struct {
 	PublicPort  int64
 	Type        string
 	IP          string
+	Path        string `json:",omitempty"`
+}
+
+type APIPortForward struct {
+	ID          string `json:"Id"`
+	PrivatePort int64
+	PublicPort  int64
+	Type        string
+	IP          string
+	Expires     time.Time
+}
+
+type APINetworkContainer struct {
+	ID          string `json:"Id"`
+	Names       []string
+	Interface   string
+	IPAddress   string
+	IPPrefixLen int
+	HostVeth    string    `json:",omitempty"`
+	Ports       []APIPort `json:",omitempty"`
 }
 
 type APIVersion struct {
@@ -133,6 +177,8 @@ type APIVersion struct {
 
 type APIWait struct {
 	StatusCode int
+	FinishedAt time.Time
+	TimedOut   bool `json:",omitempty"`
 }
 
 type APIAuth struct {
@@ -144,7 +190,72 @@ type APIImageConfig struct {
 	*Config
 }
 
+// APIInspect is a container as inspect shows it
+type APIInspect struct {
+	*Container
+	NetworkSettings *NetworkSettings
+}
+
 type APICopy struct {
 	Resource string
 	HostPath string
 }
+
+type APIPlugin struct {
+	Name       string
+	Addr       string
+	Implements []string `json:",omitempty"`
+	Active     bool
+	Error      string `json:",omitempty"`
+	LastCheck  time.Time
+}
+
+type APIPrune struct {
+	Deleted        []string
+	SpaceReclaimed int64
+}
+
+type APIDiskUsage struct {
+	// The space the layers of the images take, each shared layer once
+	LayersSize int64
+	// The part of LayersSize no container uses
+	LayersReclaimable int64
+	Images            []APIImageUsage
+	Containers        []APIContainerUsage
+	Volumes           []APIVolumeUsage
+}
+
+type APIImageUsage struct {
+	ID       string   `json:"Id"`
+	RepoTags []string `json:",omitempty"`
+	Created  int64
+	// The layers of the image and its ancestors
+	Size int64
+	// The part of Size shared with other images, and the rest
+	SharedSize int64
+	UniqueSize int64
+	Containers int
+}
+
+type APIContainerUsage struct {
+	ID      string `json:"Id"`
+	Names   []string
+	Image   string
+	Running bool
+	SizeRw  int64
+}
+
+type APIVolumeUsage struct {
+	ID         string `json:"Id"`
+	Path       string
+	Size       int64
+	Containers int
+}
+
+type APIGraphProblem struct {
+	// image, layer or tag
+	Type     string
+	Name     string
+	Problem  string
+	Repaired bool
+}
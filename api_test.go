@@ -6,14 +6,17 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/dotcloud/docker/term"
 	"github.com/dotcloud/docker/utils"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -157,7 +160,7 @@ func TestGetImagesJSON(t *testing.T) {
 
 	// all=0
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -197,7 +200,7 @@ func TestGetImagesJSON(t *testing.T) {
 
 	// all=1
 
-	initialImages, err = srv.Images(true, "")
+	initialImages, err = srv.Images(true, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -449,6 +452,81 @@ func TestGetContainersChanges(t *testing.T) {
 	}
 }
 
+func TestGetContainersLogs(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"/bin/sh", "-c", "echo hello; echo world; echo oops >&2"},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/containers/"+container.ID+"/logs?stdout=1&tail=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := getContainersLogs(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if _, err := utils.StdCopy(stdout, stderr, r.Body); err != nil {
+		t.Fatal(err)
+	}
+	if output := stdout.String(); output != "world\n" {
+		t.Fatalf("Expected only the last stdout line, received %q", output)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("Expected no stderr output, received %q", stderr.String())
+	}
+
+	req, err = http.NewRequest("GET", "/containers/"+container.ID+"/logs?stderr=1&timestamps=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	if err := getContainersLogs(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	stderr.Reset()
+	if _, err := utils.StdCopy(stdout, stderr, r.Body); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(stderr.String(), " ", 2)
+	if len(parts) != 2 || parts[1] != "oops\n" {
+		t.Fatalf("Expected a timestamped stderr line, received %q", stderr.String())
+	}
+	if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/containers/%s/logs?stdout=1&since=%d", container.ID, time.Now().Add(time.Hour).Unix()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	if err := getContainersLogs(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Body.Len() != 0 {
+		t.Fatalf("Expected no logs in the future, received %q", r.Body.String())
+	}
+}
+
 func TestGetContainersTop(t *testing.T) {
 	t.Skip("Fixme. Skipping test for now. Reported error when testing using dind: 'api_test.go:527: Expected 2 processes, found 0.'")
 	runtime := mkRuntime(t)
@@ -897,6 +975,118 @@ func TestPostContainersWait(t *testing.T) {
 	}
 }
 
+func TestPostContainersWaitTimeout(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"/bin/sleep", "10"},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/wait?timeout=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "Wait did not time out", 3*time.Second, func() {
+		r := httptest.NewRecorder()
+		if err := postContainersWait(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+			t.Fatal(err)
+		}
+		apiWait := &APIWait{}
+		if err := json.Unmarshal(r.Body.Bytes(), apiWait); err != nil {
+			t.Fatal(err)
+		}
+		if !apiWait.TimedOut {
+			t.Fatalf("The wait should have timed out")
+		}
+	})
+
+	if !container.State.Running {
+		t.Fatalf("The container should still be running after a timed out wait")
+	}
+
+	req, err = http.NewRequest("POST", "/containers/"+container.ID+"/wait?condition=foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postContainersWait(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatalf("An unknown condition should be rejected")
+	}
+}
+
+func TestPostContainersResize(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image:     GetTestImage(runtime).ID,
+			Cmd:       []string{"/bin/cat"},
+			OpenStdin: true,
+			Tty:       true,
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/resize?h=40&w=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postContainersResize(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatalf("A resize with a null width should fail")
+	}
+
+	req, err = http.NewRequest("POST", "/containers/"+container.ID+"/resize?h=40&w=80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := postContainersResize(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusOK {
+		t.Fatalf("%d OK expected, received %d\n", http.StatusOK, r.Code)
+	}
+
+	pty, ok := container.ptyMaster.(*os.File)
+	if !ok {
+		t.Fatalf("Expected the container to have a pty")
+	}
+	ws, err := term.GetWinsize(pty.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Height != 40 || ws.Width != 80 {
+		t.Fatalf("Expected a 40x80 tty, got %dx%d", ws.Height, ws.Width)
+	}
+}
+
 func TestPostContainersAttach(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1187,7 +1377,7 @@ func TestDeleteImages(t *testing.T) {
 
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1196,7 +1386,7 @@ func TestDeleteImages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1235,7 +1425,7 @@ func TestDeleteImages(t *testing.T) {
 	if len(outs) != 1 {
 		t.Fatalf("Expected %d event (untagged), got %d", 1, len(outs))
 	}
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1330,6 +1520,88 @@ func TestPostContainersCopy(t *testing.T) {
 	}
 }
 
+func TestPostContainersUpload(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"true"},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	content := []byte("uploaded")
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "upload.txt", Mode: 0640, Uid: 1234, Gid: 4321, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/upload?path=/tmp", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-tar")
+	if err := postContainersUpload(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+
+	uploaded := path.Join(container.RootfsPath(), "tmp", "upload.txt")
+	data, err := ioutil.ReadFile(uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "uploaded" {
+		t.Fatalf("Expected %q, got %q", "uploaded", data)
+	}
+	stat, err := os.Stat(uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0640 || stat.Sys().(*syscall.Stat_t).Uid != 1234 {
+		t.Fatalf("Expected the mode and owner of the archive to be kept, got %v and %d", stat.Mode(), stat.Sys().(*syscall.Stat_t).Uid)
+	}
+
+	// The destination must be an existing directory of the container
+	req, err = http.NewRequest("POST", "/containers/"+container.ID+"/upload?path=/nonexistent", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postContainersUpload(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatal("Expected an error when uploading to a nonexistent directory")
+	}
+}
+
+func TestPostBuildBadLimits(t *testing.T) {
+	for _, query := range []string{"memory=-1", "memory=1024", "memswap=-2", "cpushares=abc"} {
+		r, err := http.NewRequest("POST", "/build?"+query, bytes.NewReader(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := postBuild(nil, APIVERSION, httptest.NewRecorder(), r, nil); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+			t.Errorf("Expected a bad parameter for %s, got %v", query, err)
+		}
+	}
+}
+
 // Mocked types for tests
 type NopConn struct {
 	io.ReadCloser
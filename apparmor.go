@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// DefaultAppArmorProfile is the AppArmor profile of the containers which
+// don't pick one, when AppArmor is enabled on the host
+const DefaultAppArmorProfile = "docker-default"
+
+const (
+	appArmorProfilesPath       = "/sys/kernel/security/apparmor/profiles"
+	defaultAppArmorProfilePath = "/etc/apparmor.d/docker-default"
+)
+
+// The default profile lets the processes of the container do what the
+// capabilities left to them allow, except writing to the kernel knobs of
+// /proc and /sys and mounting filesystems
+const defaultAppArmorProfileText = `#include <tunables/global>
+
+profile docker-default flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+
+  deny @{PROC}/sys/fs/** wklx,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/mem rwklx,
+  deny @{PROC}/kmem rwklx,
+  deny @{PROC}/sys/kernel/[^s][^h][^m]* wklx,
+  deny @{PROC}/sys/kernel/*/** wklx,
+
+  deny mount,
+
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/efi/efivars/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+}
+`
+
+// installDefaultAppArmorProfile writes the default profile to the AppArmor
+// directory of the host and loads it
+func installDefaultAppArmorProfile() error {
+	if err := os.MkdirAll(path.Dir(defaultAppArmorProfilePath), 0755); err != nil {
+		return err
+	}
+	changed, err := writeFileIfChanged(defaultAppArmorProfilePath, []byte(defaultAppArmorProfileText), 0644)
+	if err != nil {
+		return err
+	}
+	// The profile is only reloaded when it changed or the kernel lost it,
+	// e.g. after a reboot
+	if !changed {
+		if loaded, err := appArmorProfileLoaded(DefaultAppArmorProfile); err == nil && loaded {
+			return nil
+		}
+	}
+	if output, err := exec.Command("apparmor_parser", "-r", "-W", defaultAppArmorProfilePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to load the AppArmor profile %s: %s (%s)", DefaultAppArmorProfile, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// appArmorProfileLoaded reports whether the kernel has the profile name
+func appArmorProfileLoaded(name string) (bool, error) {
+	f, err := os.Open(appArmorProfilesPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is "name (mode)"
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 && fields[0] == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// parseSecurityOpts checks the KEY=VALUE options of -security-opt and
+// returns the values of each key, in order
+func parseSecurityOpts(opts []string) (map[string][]string, error) {
+	parsed := make(map[string][]string)
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Bad parameter security-opt: %s, expected KEY=VALUE", opt)
+		}
+		switch parts[0] {
+		case "apparmor":
+		case "label":
+			if _, _, err := selinuxLabels([]string{parts[1]}, "s0"); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Bad parameter security-opt: unknown option %s", parts[0])
+		}
+		parsed[parts[0]] = append(parsed[parts[0]], parts[1])
+	}
+	return parsed, nil
+}
+
+// appArmorProfile returns the AppArmor profile the container is to be
+// confined by, or "" to leave it to lxc
+func (container *Container) appArmorProfile() (string, error) {
+	opts, err := parseSecurityOpts(container.hostConfig.SecurityOpt)
+	if err != nil {
+		return "", err
+	}
+	capabilities := container.runtime.capabilities
+	profiles := opts["apparmor"]
+	if len(profiles) == 0 {
+		if !capabilities.AppArmor {
+			return "", nil
+		}
+		if container.hostConfig.Privileged {
+			return "unconfined", nil
+		}
+		if capabilities.AppArmorDefaultProfile {
+			return DefaultAppArmorProfile, nil
+		}
+		return "", nil
+	}
+	// The last one wins
+	profile := profiles[len(profiles)-1]
+	if !capabilities.AppArmor {
+		return "", fmt.Errorf("Impossible to confine the container with the AppArmor profile %s: AppArmor is not enabled on this host", profile)
+	}
+	if profile == "unconfined" {
+		return profile, nil
+	}
+	loaded, err := appArmorProfileLoaded(profile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to list the AppArmor profiles: %s", err)
+	}
+	if !loaded {
+		return "", fmt.Errorf("No such AppArmor profile: %s", profile)
+	}
+	return profile, nil
+}
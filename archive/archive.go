@@ -96,6 +96,16 @@ func TarFilter(path string, compression Compression, filter []string) (io.Reader
 	return CmdStream(exec.Command(args[0], args[1:]...))
 }
 
+// UntarOptions tweaks the unpacking of an archive
+type UntarOptions struct {
+	// NoSameOwner gives the files to the user unpacking them, instead of
+	// the owners recorded in the archive
+	NoSameOwner bool
+	// NoSamePermissions applies the umask to the modes recorded in the
+	// archive
+	NoSamePermissions bool
+}
+
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `path`.
 // The archive may be compressed with one of the following algorithms:
@@ -0,0 +1,144 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Encoding is how the layers are compressed to be transferred: the
+// compression and its level, 0 being the default level of the compression
+type Encoding struct {
+	Compression Compression
+	Level       int
+}
+
+// The layers are pushed with gzip, the compression the registries expect
+// by default, and saved uncompressed
+var (
+	DefaultPushEncoding = Encoding{Compression: Gzip}
+	DefaultSaveEncoding = Encoding{Compression: Uncompressed}
+)
+
+var compressionNames = map[string]Compression{
+	"none":  Uncompressed,
+	"gzip":  Gzip,
+	"bzip2": Bzip2,
+	"xz":    Xz,
+}
+
+// ParseEncoding parses an encoding given as compression[:level], e.g. none,
+// gzip:9 or xz. The levels go from 1, the fastest, to 9, the smallest.
+func ParseEncoding(spec string) (Encoding, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	compression, exists := compressionNames[parts[0]]
+	if !exists {
+		return Encoding{}, fmt.Errorf("Bad parameter compression: unknown compression %s, expected none, gzip, bzip2 or xz", parts[0])
+	}
+	encoding := Encoding{Compression: compression}
+	if len(parts) == 1 {
+		return encoding, nil
+	}
+	level, err := strconv.Atoi(parts[1])
+	if err != nil || compression == Uncompressed || level < 1 || level > 9 {
+		return Encoding{}, fmt.Errorf("Bad parameter compression: invalid level %s for %s", parts[1], parts[0])
+	}
+	encoding.Level = level
+	return encoding, nil
+}
+
+func (encoding Encoding) String() string {
+	name := "none"
+	for n, compression := range compressionNames {
+		if compression == encoding.Compression {
+			name = n
+		}
+	}
+	if encoding.Level > 0 {
+		return fmt.Sprintf("%s:%d", name, encoding.Level)
+	}
+	return name
+}
+
+// compressCmd returns the command compressing its input with encoding
+func (encoding Encoding) compressCmd(name string) *exec.Cmd {
+	args := []string{"-c"}
+	if encoding.Level > 0 {
+		args = append(args, fmt.Sprintf("-%d", encoding.Level))
+	}
+	return exec.Command(name, args...)
+}
+
+// CompressStream compresses source, an uncompressed archive, with encoding
+func CompressStream(source io.Reader, encoding Encoding) (io.Reader, error) {
+	switch encoding.Compression {
+	case Uncompressed:
+		return source, nil
+	case Gzip:
+		level := gzip.DefaultCompression
+		if encoding.Level > 0 {
+			level = encoding.Level
+		}
+		pipeR, pipeW := io.Pipe()
+		gz, err := gzip.NewWriterLevel(pipeW, level)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if _, err := io.Copy(gz, source); err != nil {
+				pipeW.CloseWithError(err)
+				return
+			}
+			pipeW.CloseWithError(gz.Close())
+		}()
+		return pipeR, nil
+	case Bzip2:
+		cmd := encoding.compressCmd("bzip2")
+		cmd.Stdin = source
+		return CmdStream(cmd)
+	case Xz:
+		cmd := encoding.compressCmd("xz")
+		cmd.Stdin = source
+		return CmdStream(cmd)
+	}
+	return nil, fmt.Errorf("Unsupported compression %d", encoding.Compression)
+}
+
+// DecompressStream returns source, an archive compressed with any of the
+// compressions Untar supports, uncompressed
+func DecompressStream(source io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(source)
+	magic, err := buf.Peek(10)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch DetectCompression(magic) {
+	case Gzip:
+		return gzip.NewReader(buf)
+	case Bzip2:
+		return bzip2.NewReader(buf), nil
+	case Xz:
+		cmd := exec.Command("xz", "-d", "-c")
+		cmd.Stdin = buf
+		return CmdStream(cmd)
+	}
+	return buf, nil
+}
+
+// IsArchive tells whether header, the first bytes of a stream, is the one
+// of a tar archive, compressed with any of the compressions Untar supports
+// or not
+func IsArchive(header []byte) bool {
+	if DetectCompression(header) != Uncompressed {
+		return true
+	}
+	// The magic of the ustar and GNU formats, in the header of the first
+	// entry
+	return len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar"))
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseEncoding(t *testing.T) {
+	for spec, expected := range map[string]Encoding{
+		"none":    {Compression: Uncompressed},
+		"gzip":    {Compression: Gzip},
+		"gzip:9":  {Compression: Gzip, Level: 9},
+		"bzip2:1": {Compression: Bzip2, Level: 1},
+		"xz":      {Compression: Xz},
+	} {
+		encoding, err := ParseEncoding(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != expected {
+			t.Fatalf("%s: expected %v, got %v", spec, expected, encoding)
+		}
+		if encoding.String() != spec {
+			t.Fatalf("Expected %s, got %s", spec, encoding)
+		}
+	}
+	for _, spec := range []string{"", "zip", "none:1", "gzip:0", "xz:10", "gzip:fast"} {
+		if _, err := ParseEncoding(spec); err == nil {
+			t.Fatalf("Expected %q to be refused", spec)
+		}
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	data := bytes.Repeat([]byte("docker layer\n"), 1000)
+	for _, encoding := range []Encoding{{Uncompressed, 0}, {Gzip, 1}, {Bzip2, 0}, {Xz, 9}} {
+		compressed, err := CompressStream(bytes.NewReader(data), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(compressed)
+		if err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		if detected := DetectCompression(raw); detected != encoding.Compression {
+			t.Fatalf("%s: detected compression %d", encoding, detected)
+		}
+		decompressed, err := DecompressStream(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, err = ioutil.ReadAll(decompressed); err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Fatalf("%s: the data changed once decompressed", encoding)
+		}
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	origin, err := ioutil.TempDir("", "docker-test-is-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	if err := ioutil.WriteFile(path.Join(origin, "Dockerfile"), []byte("from base\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []Compression{Uncompressed, Gzip, Bzip2, Xz} {
+		archive, err := Tar(origin, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			t.Fatalf("%s: %s", compression.Extension(), err)
+		}
+		if !IsArchive(data) {
+			t.Errorf("Expected a %s to be detected as an archive", compression.Extension())
+		}
+	}
+	if IsArchive([]byte("from base\nrun echo ustar\n")) {
+		t.Error("Expected a Dockerfile not to be detected as an archive")
+	}
+}
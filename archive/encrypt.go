@@ -0,0 +1,195 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An encrypted archive starts with encryptedMagic and a random nonce
+// prefix, followed by the archive in chunks of up to encryptedChunkSize
+// bytes, each sealed with AES-256-GCM and preceded by its sealed length on 4
+// bytes. The nonce of a chunk is the prefix, the index of the chunk and a
+// byte set on the last chunk only, so that chunks can be neither reordered
+// nor dropped, and a truncated archive is detected.
+const (
+	encryptedMagic     = "DOCKER-AES256GCM\n"
+	encryptedChunkSize = 64 * 1024
+	noncePrefixSize    = 7
+)
+
+var ErrInvalidEncryption = errors.New("The encrypted archive is corrupted or the key is wrong")
+
+// ParseEncryptionKey returns the AES-256 key written in data as 64
+// hexadecimal digits, e.g. the output of `openssl rand -hex 32`
+func ParseEncryptionKey(data []byte) ([]byte, error) {
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid encryption key: expected 64 hexadecimal digits")
+	}
+	return key, nil
+}
+
+// IsEncrypted reports whether the archive starting with source is encrypted
+func IsEncrypted(source []byte) bool {
+	return bytes.HasPrefix(source, []byte(encryptedMagic))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encrypter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// NewEncrypter returns a writer encrypting with key what is written to it
+// to w. Closing it writes the last chunk, without closing w.
+func NewEncrypter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		w:      w,
+		gcm:    gcm,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (e *encrypter) writeChunk(last bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.index, last), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data comes, as the last
+		// chunk is sealed differently
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptedChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encrypter) Close() error {
+	return e.writeChunk(true)
+}
+
+type decrypter struct {
+	r      *bufio.Reader
+	gcm    cipher.AEAD
+	prefix []byte
+	index  uint32
+	plain  []byte
+	done   bool
+}
+
+// NewDecrypter returns a reader of the archive r encrypted with key. Its
+// reads fail with ErrInvalidEncryption when the archive was modified or
+// truncated.
+func NewDecrypter(r io.Reader, key []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || !IsEncrypted(header) {
+		return nil, fmt.Errorf("Not an encrypted archive")
+	}
+	return &decrypter{
+		r:      bufio.NewReader(r),
+		gcm:    gcm,
+		prefix: header[len(encryptedMagic):],
+	}, nil
+}
+
+func (d *decrypter) readChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		// The last chunk is always there, even empty
+		return ErrInvalidEncryption
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > encryptedChunkSize+uint32(d.gcm.Overhead()) {
+		return ErrInvalidEncryption
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return ErrInvalidEncryption
+	}
+	// The last chunk is the one nothing follows
+	_, err := d.r.Peek(1)
+	last := err == io.EOF
+	plain, err := d.gcm.Open(nil, chunkNonce(d.prefix, d.index, last), sealed, nil)
+	if err != nil {
+		return ErrInvalidEncryption
+	}
+	d.index++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
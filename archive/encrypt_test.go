@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptForTest(t *testing.T, data, key []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewEncrypter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := ParseEncryptionKey([]byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, encryptedChunkSize, 3*encryptedChunkSize + 17} {
+		data := bytes.Repeat([]byte("docker"), size/6+1)[:size]
+		encrypted := encryptForTest(t, data, key)
+		if !IsEncrypted(encrypted) {
+			t.Fatalf("Expected the archive of %d bytes to be encrypted", size)
+		}
+		r, err := NewDecrypter(bytes.NewReader(encrypted), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unable to decrypt the archive of %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Fatalf("Expected the %d bytes to be decrypted as they were, got %d bytes", size, len(decrypted))
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	encrypted := encryptForTest(t, bytes.Repeat([]byte("x"), 2*encryptedChunkSize+5), key)
+
+	flipped := append([]byte(nil), encrypted...)
+	flipped[len(flipped)-1] ^= 1
+	// The last chunk: 4 bytes of length, 5 bytes and the tag
+	truncated := encrypted[:len(encrypted)-(4+5+16)]
+
+	for name, archive := range map[string][]byte{"modified": flipped, "truncated": truncated} {
+		r, err := NewDecrypter(bytes.NewReader(archive), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != ErrInvalidEncryption {
+			t.Errorf("Expected the %s archive to be rejected, got %v", name, err)
+		}
+	}
+
+	r, err := NewDecrypter(bytes.NewReader(encrypted), bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrInvalidEncryption {
+		t.Errorf("Expected a wrong key to be rejected, got %v", err)
+	}
+	if _, err := ParseEncryptionKey([]byte("0011")); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ParseExcludes parses exclude patterns, one by line, as in a
+// .dockerignore: the lines empty or starting with # are skipped, and a
+// pattern starting with ! includes back what it matches
+func ParseExcludes(data []byte) ([]string, error) {
+	var excludes []string
+	for _, line := range strings.Split(string(data), "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || pattern[0] == '#' {
+			continue
+		}
+		negated := pattern[0] == '!'
+		if negated {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		pattern = filepath.Clean(strings.TrimPrefix(filepath.Clean("/"+pattern), "/"))
+		if pattern == "." {
+			return nil, fmt.Errorf("Invalid exclude pattern %s: it matches the whole directory", line)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern %s: %s", line, err)
+		}
+		if negated {
+			pattern = "!" + pattern
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes, nil
+}
+
+// Excluded tells whether the excludes exclude the relative path: the last
+// pattern matching it, or one of its parent directories, decides
+func Excluded(relPath string, excludes []string) bool {
+	excluded := false
+	for _, pattern := range excludes {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		for p := relPath; p != "."; p = filepath.Dir(p) {
+			if matched, _ := filepath.Match(pattern, p); matched {
+				excluded = !negated
+				break
+			}
+		}
+	}
+	return excluded
+}
+
+// TarWithExcludes creates an archive from the directory at `path`, without
+// the files and directories the excludes match, see Excluded, but with the
+// ones listed in keep.
+func TarWithExcludes(path string, compression Compression, excludes []string, keep ...string) (io.Reader, error) {
+	if len(excludes) == 0 {
+		return Tar(path, compression)
+	}
+	negations := false
+	for _, pattern := range excludes {
+		negations = negations || strings.HasPrefix(pattern, "!")
+	}
+	kept := make(map[string]bool)
+	for _, name := range keep {
+		kept[filepath.Clean(name)] = true
+	}
+
+	// The list of the entries, with their parent directories, for tar not
+	// to recurse into the excluded ones
+	list := new(bytes.Buffer)
+	listed := make(map[string]bool)
+	add := func(relPath string) {
+		var parents []string
+		for p := relPath; p != "." && !listed[p]; p = filepath.Dir(p) {
+			parents = append(parents, p)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			listed[parents[i]] = true
+			list.WriteString("./" + parents[i] + "\x00")
+		}
+	}
+	list.WriteString(".\x00")
+	err := filepath.Walk(path, func(filePath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if Excluded(relPath, excludes) && !kept[relPath] {
+			// A negation, or keep, may include back a file below the
+			// directory
+			if f.IsDir() && !negations && !keepsBelow(kept, relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		add(relPath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("tar", "--numeric-owner", "--no-recursion", "-C", path, "--null", "-T", "-", "-f", "-", "-c"+compression.Flag())
+	cmd.Stdin = list
+	return CmdStream(cmd)
+}
+
+// keepsBelow tells whether a path kept is below the directory dir
+func keepsBelow(kept map[string]bool, dir string) bool {
+	for name := range kept {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	excludes, err := ParseExcludes([]byte(`
+# The dependencies
+node_modules
+!node_modules/keep
+/.git
+*.log
+!important.log
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, expected := range map[string]bool{
+		"Dockerfile":                  false,
+		".git":                        true,
+		".git/HEAD":                   true,
+		"node_modules/a/index.js":     true,
+		"node_modules/keep/index.js":  false,
+		"debug.log":                   true,
+		"important.log":               false,
+		"src/debug.log":               false,
+		"src/node_modules/a/index.js": false,
+	} {
+		if excluded := Excluded(relPath, excludes); excluded != expected {
+			t.Errorf("Expected %s excluded to be %t, got %t", relPath, expected, excluded)
+		}
+	}
+
+	if _, err := ParseExcludes([]byte("[")); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestTarWithExcludes(t *testing.T) {
+	origin, err := ioutil.TempDir("", "docker-test-tar-excludes-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	for _, name := range []string{"Dockerfile", "app.js", "node_modules/a/index.js", "node_modules/keep/index.js", ".git/HEAD", "docker/Dockerfile.dev", "docker/notes"} {
+		if err := os.MkdirAll(path.Join(origin, path.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(origin, name), []byte("hello world"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tarFiles := func(excludes []string, keep ...string) string {
+		archive, err := TarWithExcludes(origin, Uncompressed, excludes, keep...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp, err := ioutil.TempDir("", "docker-test-tar-excludes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		if err := Untar(archive, tmp); err != nil {
+			t.Fatal(err)
+		}
+
+		var files []string
+		err = filepath.Walk(tmp, func(filePath string, f os.FileInfo, err error) error {
+			if err == nil && !f.IsDir() {
+				files = append(files, filePath[len(tmp)+1:])
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(files)
+		return strings.Join(files, " ")
+	}
+
+	expected := "Dockerfile app.js node_modules/keep/index.js"
+	if files := tarFiles([]string{"node_modules", "!node_modules/keep", ".git", "Dockerfile", "docker"}, "Dockerfile"); files != expected {
+		t.Errorf("Expected the files %s, got %s", expected, files)
+	}
+	// Without negation, the excluded directories are skipped, but for the
+	// files kept
+	expected = "Dockerfile app.js docker/Dockerfile.dev"
+	if files := tarFiles([]string{"node_modules", ".git", "docker"}, "docker/Dockerfile.dev"); files != expected {
+		t.Errorf("Expected the files %s, got %s", expected, files)
+	}
+}
@@ -0,0 +1,195 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks is the number of symlinks FollowSymlinkInScope follows before
+// giving up, as the kernel does with ELOOP
+const maxSymlinks = 255
+
+// processUmask is the umask of the process, read once at startup: changing
+// it to read it again would race with the files created meanwhile
+var processUmask = func() os.FileMode {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return os.FileMode(umask)
+}()
+
+// FollowSymlinkInScope returns path, a path under root, with its symlinks
+// resolved the way a process chrooted in root would resolve them: the
+// absolute symlinks are relative to root and .. stops at root. The result
+// is always under root. The components missing are kept as they are.
+func FollowSymlinkInScope(path, root string) (string, error) {
+	root = filepath.Clean(root)
+	// The .. of path are resolved in scope too
+	if path != root && !strings.HasPrefix(path, root+"/") {
+		return "", fmt.Errorf("%s is not under %s", path, root)
+	}
+
+	resolved := "" // Relative to root
+	parts := strings.Split(strings.TrimPrefix(path, root), "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = filepath.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		stat, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("Too many symlinks in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// UntarInScope unpacks the tar archive into dest, a directory under root,
+// resolving the paths of its entries within root: neither the symlinks
+// already under root nor the ones of the archive can make an entry land out
+// of root. The entries whose names lead out of dest are refused.
+func UntarInScope(archive io.Reader, dest, root string, options *UntarOptions) error {
+	if options == nil {
+		options = &UntarOptions{}
+	}
+	decompressed, err := DecompressStream(archive)
+	if err != nil {
+		return err
+	}
+	dest, err = FollowSymlinkInScope(dest, root)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(decompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid archive entry %s: it leads out of the destination", hdr.Name)
+		}
+		if name == "." {
+			continue
+		}
+		parent, err := FollowSymlinkInScope(filepath.Join(dest, filepath.Dir(name)), root)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if err := untarEntry(tr, hdr, filepath.Join(parent, filepath.Base(name)), dest, root, options); err != nil {
+			return fmt.Errorf("Unable to unpack %s: %s", hdr.Name, err)
+		}
+	}
+}
+
+// untarEntry creates the file of the tar entry hdr at target, replacing
+// what is there but a directory. The symlinks are created as is, their
+// targets are only resolved in scope when they are followed, and the
+// targets of the hard links are resolved from dest.
+func untarEntry(tr *tar.Reader, hdr *tar.Header, target, dest, root string, options *UntarOptions) error {
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if options.NoSamePermissions {
+		mode &^= processUmask
+	}
+	if stat, err := os.Lstat(target); err == nil && !(stat.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return lchown(os.Symlink(hdr.Linkname, target), target, hdr, options)
+	case tar.TypeLink:
+		linked, err := FollowSymlinkInScope(filepath.Join(dest, filepath.Clean("/"+hdr.Linkname)), root)
+		if err != nil {
+			return err
+		}
+		return os.Link(linked, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := uint32(syscall.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			kind = syscall.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			kind = syscall.S_IFBLK
+		}
+		dev := int((hdr.Devmajor << 8) | (hdr.Devminor & 0xff) | ((hdr.Devminor & 0xfff00) << 12))
+		if err := syscall.Mknod(target, kind|uint32(mode.Perm()), dev); err != nil {
+			return err
+		}
+	default:
+		// Like the extended headers, which the reader handles
+		return nil
+	}
+
+	if err := lchown(nil, target, hdr, options); err != nil {
+		return err
+	}
+	// The mode is set again, regardless of the umask, and after the owner,
+	// whose change clears setuid
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	accessTime := hdr.AccessTime
+	if accessTime.IsZero() {
+		accessTime = hdr.ModTime
+	}
+	return os.Chtimes(target, accessTime, hdr.ModTime)
+}
+
+// lchown gives target to the owner of the entry hdr unless err is set or
+// the options keep the owner of the process
+func lchown(err error, target string, hdr *tar.Header, options *UntarOptions) error {
+	if err != nil || options.NoSameOwner {
+		return err
+	}
+	return os.Lchown(target, hdr.Uid, hdr.Gid)
+}
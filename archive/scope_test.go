@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollowSymlinkInScope(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "usr/lib"), 0755)
+	os.Symlink("/", filepath.Join(root, "abs"))
+	os.Symlink("../../../..", filepath.Join(root, "usr/up"))
+	os.Symlink("usr/lib", filepath.Join(root, "lib"))
+	os.Symlink("loop", filepath.Join(root, "loop"))
+
+	for path, expected := range map[string]string{
+		"abs/etc":      "etc",
+		"usr/up/etc":   "etc",
+		"lib/x":        "usr/lib/x",
+		"usr/../../..": "",
+		"missing/a":    "missing/a",
+	} {
+		resolved, err := FollowSymlinkInScope(root+"/"+path, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != filepath.Join(root, expected) {
+			t.Errorf("Expected %s to resolve to %s, got %s", path, filepath.Join(root, expected), resolved)
+		}
+	}
+	if _, err := FollowSymlinkInScope(filepath.Join(root, "loop"), root); err == nil {
+		t.Error("Expected an error for a symlink loop")
+	}
+	if _, err := FollowSymlinkInScope(filepath.Dir(root), root); err == nil {
+		t.Error("Expected an error for a path out of the root")
+	}
+}
+
+func tarEntries(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		}
+	}
+	tw.Close()
+	return buf
+}
+
+func TestUntarInScope(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root, outside := filepath.Join(tmp, "root"), filepath.Join(tmp, "outside")
+	os.MkdirAll(filepath.Join(root, "dest"), 0755)
+	os.MkdirAll(outside, 0755)
+	// A symlink of the container leading to the host
+	os.Symlink(outside, filepath.Join(root, "dest/host"))
+
+	archive := tarEntries(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		// A symlink of the archive, followed by the next entry
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../outside", Mode: 0777},
+		&tar.Header{Name: "escape/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "host/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+	)
+	if err := UntarInScope(archive, filepath.Join(root, "dest"), root, &UntarOptions{NoSameOwner: true}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(root, "dest/dir/file")); err != nil || string(content) != "xxx" {
+		t.Errorf("Expected dir/file to be unpacked, got %q (%v)", content, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(root, "dest/hardlink")); err != nil || string(content) != "xxx" {
+		t.Errorf("Expected the hard link to dir/file, got %q (%v)", content, err)
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("Expected nothing to be unpacked out of the root, got %d files", len(files))
+	}
+	// The symlinks are resolved within the root
+	if _, err := os.Stat(filepath.Join(root, "outside/file")); err != nil {
+		t.Errorf("Expected escape/file to be unpacked under the root: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, outside, "file")); err != nil {
+		t.Errorf("Expected host/file to be unpacked under the root: %s", err)
+	}
+
+	for _, name := range []string{"../file", "/../../file"} {
+		archive := tarEntries(t, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+		if err := UntarInScope(archive, filepath.Join(root, "dest"), root, nil); err == nil {
+			t.Errorf("Expected an error for the entry %s", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "file")); err == nil {
+			t.Errorf("Expected the entry %s not to be unpacked out of the destination", name)
+		}
+	}
+}
+
+func TestUntarInScopePermissions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, options := range []*UntarOptions{{NoSameOwner: true}, {NoSameOwner: true, NoSamePermissions: true}} {
+		dest, err := ioutil.TempDir(tmp, "dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := tarEntries(t, &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0777, Size: 3})
+		if err := UntarInScope(archive, dest, tmp, options); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(filepath.Join(dest, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := os.FileMode(0777)
+		if options.NoSamePermissions {
+			expected &^= processUmask
+		}
+		if stat.Mode().Perm() != expected {
+			t.Errorf("Expected mode %v with %+v, got %v", expected, options, stat.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"os"
+	"path/filepath"
+)
+
+// unionChanges returns the changes of the container in its rw layer to the
+// layers of its image. The lookups of its changed paths in the layers of
+// the image are kept in a journal, so that the next diffs only look up the
+// newly changed paths.
+func unionChanges(container *Container) ([]Change, error) {
+	image, err := container.GetImage()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := image.layers()
+	if err != nil {
+		return nil, err
+	}
+	journal := LoadChangeJournal(container.changeJournalPath())
+	changes, err := ChangesWithJournal(layers, container.rwPath(), journal)
+	if err != nil {
+		return nil, err
+	}
+	if err := journal.Save(container.changeJournalPath()); err != nil {
+		utils.Errorf("%s: Unable to save the change journal: %s", container.ID, err)
+	}
+	return changes, nil
+}
+
+// dirSize returns the size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if fileInfo != nil {
+			size += fileInfo.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// aufsDriver mounts the union of the layers of the image of a container
+// under its rw layer with AUFS
+type aufsDriver struct{}
+
+func (*aufsDriver) Mount(container *Container) error {
+	image, err := container.GetImage()
+	if err != nil {
+		return err
+	}
+	return image.Mount(container.RootfsPath(), container.rwPath(), container.MountLabel)
+}
+
+func (*aufsDriver) Unmount(container *Container) error {
+	return Unmount(container.RootfsPath())
+}
+
+func (*aufsDriver) Changes(container *Container) ([]Change, error) {
+	return unionChanges(container)
+}
+
+func (*aufsDriver) ExportChanges(container *Container) (archive.Archive, error) {
+	return archive.Tar(container.rwPath(), archive.Uncompressed)
+}
+
+func (*aufsDriver) ChangesSize(container *Container) int64 {
+	return dirSize(container.rwPath())
+}
+
+func (*aufsDriver) WritableDir(container *Container) (string, error) {
+	return container.rwPath(), nil
+}
+
+func (*aufsDriver) Remove(container *Container) error {
+	return nil
+}
+
+func (*aufsDriver) RemoveImage(id, root string) error {
+	return nil
+}
+
+func init() {
+	RegisterStorageDriver(DriverAUFS, 20,
+		func(root string) error {
+			if !filesystemSupported("aufs") {
+				return fmt.Errorf("the kernel doesn't support it")
+			}
+			return nil
+		},
+		nil,
+		func(runtime *Runtime) (StorageDriver, error) {
+			return &aufsDriver{}, nil
+		})
+}
@@ -8,9 +8,11 @@ import (
 	"github.com/dotcloud/docker/utils"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 // Where we store the config file
@@ -149,9 +151,24 @@ func SaveConfig(configFile *ConfigFile) error {
 	return nil
 }
 
+var (
+	proxy     = http.ProxyFromEnvironment
+	proxyLock sync.Mutex
+)
+
+// SetProxy replaces the function returning the proxy of the requests of
+// Login, see http.Transport. It applies to the logins started from then on.
+func SetProxy(p func(*http.Request) (*url.URL, error)) {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	proxy = p
+}
+
 // try to register/login to the registry server
 func Login(authConfig *AuthConfig, factory *utils.HTTPRequestFactory) (string, error) {
-	client := &http.Client{}
+	proxyLock.Lock()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxy}}
+	proxyLock.Unlock()
 	reqStatusCode := 0
 	var status string
 	var reqBody []byte
@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/plugins"
+	"net/http"
+)
+
+// authzRequest is what the authorization plugins are asked about an API
+// request, with AuthZPlugin.AuthZReq
+type authzRequest struct {
+	RequestMethod string
+	RequestURI    string
+}
+
+// authzResponse is the decision of an authorization plugin
+type authzResponse struct {
+	Allow bool
+	Msg   string
+}
+
+// authorizeRequest asks the -authorization-plugin of the daemon, in order,
+// whether the API request r is allowed. A plugin which is missing,
+// inactive or fails denies it.
+func (srv *Server) authorizeRequest(r *http.Request) error {
+	for _, name := range srv.runtime.config.AuthorizationPlugins {
+		client, err := srv.plugins.Get(name, plugins.Authorization)
+		if err != nil {
+			return fmt.Errorf("Forbidden, the authorization %s", err)
+		}
+		res := &authzResponse{}
+		if err := client.Call("AuthZPlugin.AuthZReq", &authzRequest{RequestMethod: r.Method, RequestURI: r.RequestURI}, res); err != nil {
+			return fmt.Errorf("Forbidden, the authorization plugin %s failed: %s", name, err)
+		}
+		if !res.Allow {
+			return fmt.Errorf("Forbidden, the authorization plugin %s denied the request: %s", name, res.Msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"encoding/json"
+	"github.com/dotcloud/docker/plugins"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", path.Join(dir, "readonly.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A plugin allowing the GET requests only
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"Implements": {plugins.Authorization}})
+	})
+	mux.HandleFunc("/AuthZPlugin.AuthZReq", func(w http.ResponseWriter, r *http.Request) {
+		req := &authzRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		json.NewEncoder(w).Encode(&authzResponse{Allow: req.RequestMethod == "GET", Msg: "read only"})
+	})
+	plugin := httptest.NewUnstartedServer(mux)
+	plugin.Listener.Close()
+	plugin.Listener = l
+	plugin.Start()
+	defer plugin.Close()
+
+	manager := plugins.NewManager(dir, nil)
+	srv := &Server{
+		runtime: &Runtime{config: &DaemonConfig{AuthorizationPlugins: []string{"readonly"}}},
+		plugins: manager,
+	}
+	get, _ := http.NewRequest("GET", "/containers/json", nil)
+	if err := srv.authorizeRequest(get); err == nil || !strings.HasPrefix(err.Error(), "Forbidden") {
+		t.Fatalf("Expected the request to be forbidden until the plugin is activated, got %v", err)
+	}
+
+	go manager.Watch(time.Hour)
+	for i := 0; i < 100; i++ {
+		if _, err := manager.Get("readonly", plugins.Authorization); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := srv.authorizeRequest(get); err != nil {
+		t.Fatalf("Expected the GET request to be allowed: %s", err)
+	}
+	post, _ := http.NewRequest("POST", "/containers/create", nil)
+	if err := srv.authorizeRequest(post); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Fatalf("Expected the POST request to be denied by the plugin, got %v", err)
+	}
+}
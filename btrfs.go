@@ -0,0 +1,219 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// btrfsCommand runs the btrfs tool with args
+func btrfsCommand(args ...string) error {
+	if output, err := exec.Command("btrfs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("btrfs %s: %s (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// btrfsSupported reports whether the btrfs driver can store the containers
+// under root: root must be on btrfs, and the btrfs tool installed
+func btrfsSupported(root string) bool {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return false
+	}
+	onBtrfs, err := isBtrfs(root)
+	return err == nil && onBtrfs
+}
+
+// deleteSubvolume deletes the btrfs subvolume at pth, if any
+func deleteSubvolume(pth string) error {
+	if _, err := os.Lstat(pth); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return btrfsCommand("subvolume", "delete", pth)
+}
+
+// btrfsLayer returns the read-only btrfs subvolume holding the filesystem
+// of the image: a snapshot of the one of its parent with its layer applied.
+// It is built next to the layer the first time the image is used.
+func (img *Image) btrfsLayer() (string, error) {
+	root, err := img.root()
+	if err != nil {
+		return "", err
+	}
+	subvolume := path.Join(root, "btrfs")
+	if _, err := os.Stat(subvolume); err == nil {
+		return subvolume, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	layer, err := img.layer()
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := img.GetParent()
+	if err != nil {
+		return "", err
+	}
+	tmp := subvolume + "-" + GenerateID()[:12]
+	if parent != nil {
+		parentSubvolume, err := parent.btrfsLayer()
+		if err != nil {
+			return "", err
+		}
+		if err := btrfsCommand("subvolume", "snapshot", parentSubvolume, tmp); err != nil {
+			return "", err
+		}
+	} else if err := btrfsCommand("subvolume", "create", tmp); err != nil {
+		return "", err
+	}
+	if err := applyAUFSLayer(layer, tmp); err != nil {
+		deleteSubvolume(tmp)
+		return "", fmt.Errorf("Unable to apply the layer of image %s: %s", img.ID, err)
+	}
+	if err := btrfsCommand("property", "set", "-ts", tmp, "ro", "true"); err != nil {
+		deleteSubvolume(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, subvolume); err != nil {
+		deleteSubvolume(tmp)
+		// Unless another container of the image built it meanwhile
+		if _, err := os.Stat(subvolume); err != nil {
+			return "", err
+		}
+	}
+	return subvolume, nil
+}
+
+// btrfsDriver gives each container a writable snapshot of the subvolume of
+// its image, kept until the container is destroyed
+type btrfsDriver struct{}
+
+func (*btrfsDriver) Mount(container *Container) error {
+	rootfs := container.RootfsPath()
+	if mounted, err := Mounted(rootfs); err != nil || mounted {
+		return err
+	}
+	image, err := container.GetImage()
+	if err != nil {
+		return err
+	}
+	subvolume, err := image.btrfsLayer()
+	if err != nil {
+		return err
+	}
+	dockerinitLayer, err := image.getDockerInitLayer()
+	if err != nil {
+		return err
+	}
+	// The mountpoint of the other drivers
+	if err := os.Remove(rootfs); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := btrfsCommand("subvolume", "snapshot", subvolume, rootfs); err != nil {
+		return err
+	}
+	return addMissingPaths(dockerinitLayer, rootfs)
+}
+
+// The snapshot is the filesystem of the container, not a mount
+func (*btrfsDriver) Unmount(container *Container) error {
+	return nil
+}
+
+// Relabel gives the files of the snapshot of the container its mount label.
+// Unlike a mount, a snapshot keeps the labels of its files.
+func (*btrfsDriver) Relabel(container *Container) error {
+	if container.MountLabel == "" {
+		return nil
+	}
+	if output, err := exec.Command("chcon", "-R", container.MountLabel, container.RootfsPath()).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to label the files of container %s: %s (%s)", container.ID, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Changes returns the changes of the container to the subvolume of its
+// image, without the mountpoints the container got from the dockerinit
+// layer
+func (*btrfsDriver) Changes(container *Container) ([]Change, error) {
+	image, err := container.GetImage()
+	if err != nil {
+		return nil, err
+	}
+	subvolume, err := image.btrfsLayer()
+	if err != nil {
+		return nil, err
+	}
+	dockerinitLayer, err := image.getDockerInitLayer()
+	if err != nil {
+		return nil, err
+	}
+	if err := container.EnsureMounted(); err != nil {
+		return nil, err
+	}
+	changes, err := changesBetween(subvolume, container.RootfsPath())
+	if err != nil {
+		return nil, err
+	}
+	return withoutDockerinitPaths(changes, dockerinitLayer), nil
+}
+
+func (driver *btrfsDriver) ExportChanges(container *Container) (archive.Archive, error) {
+	changes, err := driver.Changes(container)
+	if err != nil {
+		return nil, err
+	}
+	return exportChanges(container.RootfsPath(), changes, container.root)
+}
+
+func (driver *btrfsDriver) ChangesSize(container *Container) int64 {
+	changes, _ := driver.Changes(container)
+	return changedFilesSize(container.RootfsPath(), changes)
+}
+
+func (*btrfsDriver) WritableDir(container *Container) (string, error) {
+	if err := container.EnsureMounted(); err != nil {
+		return "", err
+	}
+	return container.RootfsPath(), nil
+}
+
+func (*btrfsDriver) Remove(container *Container) error {
+	return deleteSubvolume(container.RootfsPath())
+}
+
+func (*btrfsDriver) RemoveImage(id, root string) error {
+	return deleteSubvolume(path.Join(root, "btrfs"))
+}
+
+// SetDiskQuota limits the disk space of the snapshot of the container to
+// size bytes, with the quota groups of btrfs
+func (*btrfsDriver) SetDiskQuota(container *Container, size int64) error {
+	rootfs := container.RootfsPath()
+	if err := btrfsCommand("quota", "enable", rootfs); err != nil {
+		return err
+	}
+	return btrfsCommand("qgroup", "limit", strconv.FormatInt(size, 10), rootfs)
+}
+
+func init() {
+	RegisterStorageDriver(DriverBtrfs, 10,
+		func(root string) error {
+			if !btrfsSupported(root) {
+				return fmt.Errorf("%s is not on btrfs or the btrfs tool is missing", root)
+			}
+			return nil
+		},
+		btrfsSupported,
+		func(runtime *Runtime) (StorageDriver, error) {
+			return &btrfsDriver{}, nil
+		})
+}
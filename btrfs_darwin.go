@@ -0,0 +1,5 @@
+package docker
+
+func isBtrfs(pth string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,16 @@
+package docker
+
+import (
+	"syscall"
+)
+
+const btrfsSuperMagic = 0x9123683E
+
+// isBtrfs reports whether pth is on a btrfs filesystem
+func isBtrfs(pth string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(pth, &stat); err != nil {
+		return false, err
+	}
+	return uint32(stat.Type) == btrfsSuperMagic, nil
+}
@@ -1,6 +1,9 @@
 package docker
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/archive"
@@ -9,10 +12,15 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 type BuildFile interface {
@@ -21,6 +29,15 @@ type BuildFile interface {
 	CmdRun(string) error
 }
 
+// BuildLimits are the resource limits of the containers the RUN
+// instructions of a build run in, 0 for no limit. They are not part of the
+// images built, nor of their cache.
+type BuildLimits struct {
+	Memory     int64 // Memory limit (in bytes)
+	MemorySwap int64 // Total memory usage (memory + swap); set `-1' to disable swap
+	CpuShares  int64 // CPU shares (relative weight)
+}
+
 type buildFile struct {
 	runtime *Runtime
 	srv     *Server
@@ -32,6 +49,19 @@ type buildFile struct {
 	verbose      bool
 	utilizeCache bool
 	rm           bool
+	squash       bool
+	// The image of the last FROM, the one the build is squashed onto
+	fromImage string
+	// The images whose history is pulled for the cache, if missing
+	cacheFrom []string
+	// The values of the build arguments given to the build
+	buildArgs map[string]string
+	// The build arguments declared with ARG so far, with their value, the
+	// one given to the build or else the default of the Dockerfile
+	args map[string]string
+	// The path of the Dockerfile in the context
+	dockerfileName string
+	limits         BuildLimits
 
 	tmpContainers map[string]struct{}
 	tmpImages     map[string]struct{}
@@ -47,6 +77,22 @@ func (b *buildFile) clearTmp(containers map[string]struct{}) {
 	}
 }
 
+// importCache pulls the images of cacheFrom which are missing: the images
+// of their history become the cache of the steps they were built by
+func (b *buildFile) importCache() {
+	for _, name := range b.cacheFrom {
+		if _, err := b.runtime.repositories.LookupImage(name); err == nil {
+			continue
+		}
+		fmt.Fprintf(b.out, "Importing the build cache of %s\n", name)
+		remote, tag := utils.ParseRepositoryTag(name)
+		if err := b.srv.ImagePull(remote, tag, b.out, utils.NewStreamFormatter(false), nil, nil, true); err != nil {
+			// The build goes on, without this cache
+			fmt.Fprintf(b.out, "Unable to import the build cache of %s: %s\n", name, err)
+		}
+	}
+}
+
 func (b *buildFile) CmdFrom(name string) error {
 	image, err := b.runtime.repositories.LookupImage(name)
 	if err != nil {
@@ -64,6 +110,7 @@ func (b *buildFile) CmdFrom(name string) error {
 		}
 	}
 	b.image = image.ID
+	b.fromImage = image.ID
 	b.config = &Config{}
 	if image.Config != nil {
 		b.config = image.Config
@@ -71,14 +118,222 @@ func (b *buildFile) CmdFrom(name string) error {
 	if b.config.Env == nil || len(b.config.Env) == 0 {
 		b.config.Env = append(b.config.Env, "HOME=/", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 	}
+
+	// The triggers of the image run as if they followed FROM, and are not
+	// inherited by the image built
+	onBuild := b.config.OnBuild
+	b.config.OnBuild = nil
+	for _, trigger := range onBuild {
+		tmp := strings.SplitN(trigger, " ", 2)
+		if len(tmp) != 2 {
+			return fmt.Errorf("Invalid ONBUILD trigger %s of %s", trigger, name)
+		}
+		method, exists := b.instructionMethod(tmp[0])
+		if !exists {
+			return fmt.Errorf("Unknown ONBUILD trigger %s of %s", trigger, name)
+		}
+		fmt.Fprintf(b.out, "# Executing the ONBUILD trigger %s\n", trigger)
+		if err := b.call(method, tmp[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildArgName is the name of a build argument, the same as the one of an
+// environment variable
+var buildArgName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ParseBuildArgs parses the values of build arguments given as name=value
+func ParseBuildArgs(values []string) (map[string]string, error) {
+	buildArgs := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || !buildArgName.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Bad parameter build-arg %s: expected name=value", value)
+		}
+		buildArgs[parts[0]] = parts[1]
+	}
+	return buildArgs, nil
+}
+
+// CmdArg declares a build argument, ARG name or ARG name=default. Its value
+// is usable by the instructions which follow, and is in the environment of
+// their RUN, but not in the one of the image built.
+func (b *buildFile) CmdArg(args string) error {
+	name, value := args, ""
+	hasDefault := false
+	if parts := strings.SplitN(args, "=", 2); len(parts) == 2 {
+		name, value, hasDefault = parts[0], parts[1], true
+	}
+	if !buildArgName.MatchString(name) {
+		return fmt.Errorf("Invalid ARG format")
+	}
+	if given, exists := b.buildArgs[name]; exists {
+		b.args[name] = given
+	} else if hasDefault {
+		b.args[name] = value
+	}
 	return nil
 }
 
+// runEnv returns the environment of the RUN instructions: the one of the
+// image, and the build arguments it does not override, sorted by name for
+// the cache to match
+func (b *buildFile) runEnv() []string {
+	env := append([]string{}, b.config.Env...)
+	var names []string
+	for name := range b.args {
+		if b.FindEnvKey(name) < 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("%s=%s", name, b.args[name]))
+	}
+	return env
+}
+
+// CmdOnbuild records an instruction, the trigger, run by the builds FROM
+// the image built
+func (b *buildFile) CmdOnbuild(args string) error {
+	tmp := strings.SplitN(args, " ", 2)
+	if len(tmp) != 2 {
+		return fmt.Errorf("Invalid ONBUILD format")
+	}
+	instruction := strings.ToUpper(strings.Trim(tmp[0], " "))
+	switch instruction {
+	case "ONBUILD":
+		return fmt.Errorf("Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed")
+	case "FROM", "MAINTAINER":
+		return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", instruction)
+	}
+	if _, exists := b.instructionMethod(instruction); !exists {
+		return fmt.Errorf("Unknown ONBUILD trigger %s", instruction)
+	}
+	trigger := fmt.Sprintf("%s %s", instruction, strings.Trim(tmp[1], " "))
+	b.config.OnBuild = append(b.config.OnBuild, trigger)
+	return b.commit("", b.config.Cmd, fmt.Sprintf("ONBUILD %s", trigger))
+}
+
 func (b *buildFile) CmdMaintainer(name string) error {
 	b.maintainer = name
 	return b.commit("", b.config.Cmd, fmt.Sprintf("MAINTAINER %s", name))
 }
 
+// CmdLabel sets labels on the image, in a single layer: key=value pairs
+// separated by spaces, or one key followed by its value. The keys and
+// values may be quoted, and the variables of ENV and the build arguments
+// are expanded in them but in single quotes.
+func (b *buildFile) CmdLabel(args string) error {
+	words, err := splitWords(args)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("LABEL requires at least one key=value")
+	}
+	var pairs [][2]string
+	if !strings.Contains(words[0], "=") {
+		// The old form: LABEL key value
+		if len(words) < 2 {
+			return fmt.Errorf("Invalid LABEL format: expected key=value")
+		}
+		pairs = append(pairs, [2]string{words[0], strings.Join(words[1:], " ")})
+	} else {
+		for _, word := range words {
+			parts := strings.SplitN(word, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid LABEL %s: expected key=value", word)
+			}
+			pairs = append(pairs, [2]string{parts[0], parts[1]})
+		}
+	}
+
+	labels := make(map[string]string, len(pairs))
+	var comment []string
+	for _, pair := range pairs {
+		key, err := b.ReplaceEnvMatches(pair[0])
+		if err != nil {
+			return err
+		}
+		value, err := b.ReplaceEnvMatches(pair[1])
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("Invalid LABEL: the key can't be empty")
+		}
+		labels[key] = value
+		comment = append(comment, strconv.Quote(key)+"="+strconv.Quote(value))
+	}
+	b.config.Labels = mergeLabels(b.config.Labels, labels)
+	return b.commit("", b.config.Cmd, fmt.Sprintf("LABEL %s", strings.Join(comment, " ")))
+}
+
+// splitWords splits args in words separated by spaces, the way of the
+// shell: quotes group words and are removed, a backslash escapes the next
+// character but in single quotes. The $ of the single quotes are escaped
+// for ReplaceEnvMatches not to expand them.
+func splitWords(args string) ([]string, error) {
+	var (
+		words  []string
+		word   = new(bytes.Buffer)
+		inWord bool
+		quote  byte
+	)
+	for i := 0; i < len(args); i++ {
+		c := args[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else if c == '$' {
+				word.WriteString("\\$")
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(args):
+			i++
+			if args[i] == '$' {
+				word.WriteString("\\$")
+			} else if quote == '"' && args[i] != '"' && args[i] != '\\' {
+				word.WriteByte(c)
+				word.WriteByte(args[i])
+			} else {
+				word.WriteByte(args[i])
+			}
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Missing %c in %s", quote, args)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
 func (b *buildFile) CmdRun(args string) error {
 	if b.image == "" {
 		return fmt.Errorf("Please provide a source image with `from` prior to run")
@@ -94,6 +349,16 @@ func (b *buildFile) CmdRun(args string) error {
 
 	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
 
+	// The build arguments are in the environment of the command, and so
+	// part of the cache, but not in the one of the image
+	imageConfig := b.config
+	runConfig := *b.config
+	runConfig.Env = b.runEnv()
+	// The command is not probed while it runs
+	runConfig.Healthcheck = nil
+	b.config = &runConfig
+	defer func() { b.config = imageConfig }()
+
 	utils.Debugf("Command to be executed: %v", b.config.Cmd)
 
 	if b.utilizeCache {
@@ -113,6 +378,7 @@ func (b *buildFile) CmdRun(args string) error {
 	if err != nil {
 		return err
 	}
+	b.config = imageConfig
 	if err := b.commit(cid, cmd, "run"); err != nil {
 		return err
 	}
@@ -130,28 +396,98 @@ func (b *buildFile) FindEnvKey(key string) int {
 	return -1
 }
 
-func (b *buildFile) ReplaceEnvMatches(value string) (string, error) {
-	exp, err := regexp.Compile("(\\\\\\\\+|[^\\\\]|\\b|\\A)\\$({?)([[:alnum:]_]+)(}?)")
-	if err != nil {
-		return value, err
+// lookupEnv returns the value of a variable of the build: the one of ENV,
+// or else of a build argument
+func (b *buildFile) lookupEnv(name string) (string, bool) {
+	if k := b.FindEnvKey(name); k >= 0 {
+		return strings.SplitN(b.config.Env[k], "=", 2)[1], true
 	}
-	matches := exp.FindAllString(value, -1)
-	for _, match := range matches {
-		match = match[strings.Index(match, "$"):]
-		matchKey := strings.Trim(match, "${}")
+	value, exists := b.args[name]
+	return value, exists
+}
 
-		for _, envVar := range b.config.Env {
-			envParts := strings.SplitN(envVar, "=", 2)
-			envKey := envParts[0]
-			envValue := envParts[1]
+// ReplaceEnvMatches expands the variables of ENV and the build arguments in
+// value, see expandEnv
+func (b *buildFile) ReplaceEnvMatches(value string) (string, error) {
+	return expandEnv(value, b.lookupEnv)
+}
+
+// isNameChar tells whether c can be the character of a variable name, the
+// first one when first
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
 
-			if envKey == matchKey {
-				value = strings.Replace(value, match, envValue, -1)
-				break
+// expandEnv expands the variables of value the way of the builder, not the
+// one of the shell: $name and ${name} are the value of name, empty when
+// unset, ${name:-word} is word when name is unset or empty, and
+// ${name:+word} is word when name is set and not empty, word being
+// expanded too. \$ is a $ not expanded.
+func expandEnv(value string, lookup func(string) (string, bool)) (string, error) {
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value) && value[i+1] == '$':
+			buf.WriteByte('$')
+			i++
+		case c == '$' && i+1 < len(value) && value[i+1] == '{':
+			// The matching brace, the word may hold variables
+			end, depth := -1, 0
+			for j := i + 2; j < len(value) && end < 0; j++ {
+				switch value[j] {
+				case '{':
+					depth++
+				case '}':
+					if depth == 0 {
+						end = j
+					}
+					depth--
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("Missing } in %s", value)
+			}
+			inner := value[i+2 : end]
+			n := 0
+			for n < len(inner) && isNameChar(inner[n], n == 0) {
+				n++
+			}
+			if n == 0 {
+				return "", fmt.Errorf("Invalid variable ${%s} in %s", inner, value)
 			}
+			name, modifier := inner[:n], inner[n:]
+			v, _ := lookup(name)
+			switch {
+			case modifier == "":
+				buf.WriteString(v)
+			case strings.HasPrefix(modifier, ":-") || strings.HasPrefix(modifier, ":+"):
+				word, err := expandEnv(modifier[2:], lookup)
+				if err != nil {
+					return "", err
+				}
+				if (modifier[1] == '-') == (v == "") {
+					buf.WriteString(word)
+				} else {
+					buf.WriteString(v)
+				}
+			default:
+				return "", fmt.Errorf("Unsupported modifier %s of ${%s} in %s", modifier, name, value)
+			}
+			i = end
+		case c == '$' && i+1 < len(value) && isNameChar(value[i+1], true):
+			j := i + 1
+			for j < len(value) && isNameChar(value[j], j == i+1) {
+				j++
+			}
+			v, _ := lookup(value[i+1 : j])
+			buf.WriteString(v)
+			i = j - 1
+		default:
+			buf.WriteByte(c)
 		}
 	}
-	return value, nil
+	return buf.String(), nil
 }
 
 func (b *buildFile) CmdEnv(args string) error {
@@ -191,7 +527,11 @@ func (b *buildFile) CmdCmd(args string) error {
 }
 
 func (b *buildFile) CmdExpose(args string) error {
-	ports := strings.Split(args, " ")
+	args, err := b.ReplaceEnvMatches(args)
+	if err != nil {
+		return err
+	}
+	ports := strings.Fields(args)
 	b.config.PortSpecs = append(ports, b.config.PortSpecs...)
 	return b.commit("", b.config.Cmd, fmt.Sprintf("EXPOSE %v", ports))
 }
@@ -205,10 +545,6 @@ func (b *buildFile) CmdInsert(args string) error {
 	return fmt.Errorf("INSERT has been deprecated. Please use ADD instead")
 }
 
-func (b *buildFile) CmdCopy(args string) error {
-	return fmt.Errorf("COPY has been deprecated. Please use ADD instead")
-}
-
 func (b *buildFile) CmdEntrypoint(args string) error {
 	if args == "" {
 		return fmt.Errorf("Entrypoint cannot be empty")
@@ -227,10 +563,33 @@ func (b *buildFile) CmdEntrypoint(args string) error {
 }
 
 func (b *buildFile) CmdWorkdir(workdir string) error {
+	workdir, err := b.ReplaceEnvMatches(workdir)
+	if err != nil {
+		return err
+	}
 	b.config.WorkingDir = workdir
 	return b.commit("", b.config.Cmd, fmt.Sprintf("WORKDIR %v", workdir))
 }
 
+func (b *buildFile) CmdStopsignal(args string) error {
+	if _, err := utils.ParseSignal(args); err != nil {
+		return err
+	}
+	b.config.StopSignal = args
+	return b.commit("", b.config.Cmd, fmt.Sprintf("STOPSIGNAL %s", args))
+}
+
+// CmdHealthcheck sets the probe of the health of the containers of the
+// image, see parseHealthcheck
+func (b *buildFile) CmdHealthcheck(args string) error {
+	healthcheck, err := parseHealthcheck(args)
+	if err != nil {
+		return err
+	}
+	b.config.Healthcheck = healthcheck
+	return b.commit("", b.config.Cmd, fmt.Sprintf("HEALTHCHECK %s", args))
+}
+
 func (b *buildFile) CmdVolume(args string) error {
 	if args == "" {
 		return fmt.Errorf("Volume cannot be empty")
@@ -244,6 +603,10 @@ func (b *buildFile) CmdVolume(args string) error {
 		b.config.Volumes = NewPathOpts()
 	}
 	for _, v := range volume {
+		v, err := b.ReplaceEnvMatches(v)
+		if err != nil {
+			return err
+		}
 		b.config.Volumes[v] = struct{}{}
 	}
 	if err := b.commit("", b.config.Cmd, fmt.Sprintf("VOLUME %s", args)); err != nil {
@@ -252,12 +615,83 @@ func (b *buildFile) CmdVolume(args string) error {
 	return nil
 }
 
-func (b *buildFile) addRemote(container *Container, orig, dest string) error {
-	file, err := utils.Download(orig, ioutil.Discard)
+// hashPath returns the hash of the file or directory at root, the cache key
+// of ADD: the paths, modes, owners and sizes of the files in it, with the
+// contents of the regular files and the targets of the symlinks
+func hashPath(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(root, func(filePath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		var uid, gid uint32
+		if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+		var size int64
+		if f.Mode().IsRegular() {
+			size = f.Size()
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00%d\x00", relPath, f.Mode(), uid, gid, size)
+		switch {
+		case f.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			h.Write([]byte(target))
+		case f.Mode().IsRegular():
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		h.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadRemote downloads the file of the url orig to a temporary file,
+// and returns its path and the hash of its content
+func downloadRemote(orig string) (string, string, error) {
+	resp, err := utils.Download(orig, ioutil.Discard)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	tmp, err := ioutil.TempFile("", "docker-build-add")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addRemote adds the file of the url orig, downloaded to downloaded
+func (b *buildFile) addRemote(container *Container, orig, downloaded, dest string) error {
+	file, err := os.Open(downloaded)
 	if err != nil {
 		return err
 	}
-	defer file.Body.Close()
+	defer file.Close()
 
 	// If the destination is a directory, figure out the filename.
 	if strings.HasSuffix(dest, "/") {
@@ -277,10 +711,12 @@ func (b *buildFile) addRemote(container *Container, orig, dest string) error {
 		dest = dest + filename
 	}
 
-	return container.Inject(file.Body, dest)
+	return container.Inject(file, dest)
 }
 
-func (b *buildFile) addContext(container *Container, orig, dest string) error {
+// addContext adds the file or directory orig of the context at dest, a
+// local tar archive being unpacked with decompress
+func (b *buildFile) addContext(container *Container, orig, dest string, decompress bool) error {
 	origPath := path.Join(b.context, orig)
 	destPath := path.Join(container.RootfsPath(), dest)
 	// Preserve the trailing '/'
@@ -298,10 +734,19 @@ func (b *buildFile) addContext(container *Container, orig, dest string) error {
 		if err := archive.CopyWithTar(origPath, destPath); err != nil {
 			return err
 		}
+	} else if decompress {
 		// First try to unpack the source as an archive
-	} else if err := archive.UntarPath(origPath, destPath); err != nil {
-		utils.Debugf("Couldn't untar %s to %s: %s", origPath, destPath, err)
-		// If that fails, just copy it as a regular file
+		if err := archive.UntarPath(origPath, destPath); err != nil {
+			utils.Debugf("Couldn't untar %s to %s: %s", origPath, destPath, err)
+			// If that fails, just copy it as a regular file
+			if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+				return err
+			}
+			if err := archive.CopyWithTar(origPath, destPath); err != nil {
+				return err
+			}
+		}
+	} else {
 		if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
 			return err
 		}
@@ -313,12 +758,24 @@ func (b *buildFile) addContext(container *Container, orig, dest string) error {
 }
 
 func (b *buildFile) CmdAdd(args string) error {
+	return b.add("ADD", args, true)
+}
+
+// CmdCopy copies a file or directory of the context as is: unlike ADD, it
+// neither downloads urls nor unpacks archives
+func (b *buildFile) CmdCopy(args string) error {
+	return b.add("COPY", args, false)
+}
+
+// add runs ADD, with the downloads of urls and the unpacking of local
+// archives of magic, or else COPY
+func (b *buildFile) add(instruction, args string, magic bool) error {
 	if b.context == "" {
-		return fmt.Errorf("No context given. Impossible to use ADD")
+		return fmt.Errorf("No context given. Impossible to use %s", instruction)
 	}
 	tmp := strings.SplitN(args, " ", 2)
 	if len(tmp) != 2 {
-		return fmt.Errorf("Invalid ADD format")
+		return fmt.Errorf("Invalid %s format", instruction)
 	}
 
 	orig, err := b.ReplaceEnvMatches(strings.Trim(tmp[0], " \t"))
@@ -331,10 +788,47 @@ func (b *buildFile) CmdAdd(args string) error {
 		return err
 	}
 
+	// The step is cached by the hash of what it adds, so that it runs
+	// again when the files or their metadata change
+	var hash, downloaded string
+	if utils.IsURL(orig) && !magic {
+		return fmt.Errorf("%s doesn't download urls. Please use ADD instead", instruction)
+	} else if utils.IsURL(orig) {
+		if downloaded, hash, err = downloadRemote(orig); err != nil {
+			return err
+		}
+		defer os.Remove(downloaded)
+	} else {
+		origPath := path.Join(b.context, orig)
+		if !strings.HasPrefix(origPath, b.context) {
+			return fmt.Errorf("Forbidden path: %s", origPath)
+		}
+		if _, err := os.Stat(origPath); err != nil {
+			return fmt.Errorf("%s: no such file or directory", orig)
+		}
+		if hash, err = hashPath(origPath); err != nil {
+			return err
+		}
+	}
+
 	cmd := b.config.Cmd
-	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) ADD %s in %s", orig, dest)}
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) %s %s (sha256:%s) in %s", instruction, orig, hash, dest)}
 
 	b.config.Image = b.image
+	if b.utilizeCache {
+		if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
+			return err
+		} else if cache != nil {
+			fmt.Fprintf(b.out, " ---> Using cache\n")
+			utils.Debugf("[BUILDER] Use cached version")
+			b.image = cache.ID
+			b.config.Cmd = cmd
+			return nil
+		} else {
+			utils.Debugf("[BUILDER] Cache miss")
+		}
+	}
+
 	// Create the container and start it
 	container, _, err := b.runtime.Create(b.config, "")
 	if err != nil {
@@ -348,16 +842,16 @@ func (b *buildFile) CmdAdd(args string) error {
 	defer container.Unmount()
 
 	if utils.IsURL(orig) {
-		if err := b.addRemote(container, orig, dest); err != nil {
+		if err := b.addRemote(container, orig, downloaded, dest); err != nil {
 			return err
 		}
 	} else {
-		if err := b.addContext(container, orig, dest); err != nil {
+		if err := b.addContext(container, orig, dest, magic); err != nil {
 			return err
 		}
 	}
 
-	if err := b.commit(container.ID, cmd, fmt.Sprintf("ADD %s in %s", orig, dest)); err != nil {
+	if err := b.commit(container.ID, cmd, fmt.Sprintf("%s %s in %s", instruction, orig, dest)); err != nil {
 		return err
 	}
 	b.config.Cmd = cmd
@@ -378,6 +872,18 @@ func (b *buildFile) run() (string, error) {
 	b.tmpContainers[c.ID] = struct{}{}
 	fmt.Fprintf(b.out, " ---> Running in %s\n", utils.TruncateID(c.ID))
 
+	// The limits apply to the container while it runs, its config is then
+	// restored for the cache to match
+	if b.limits != (BuildLimits{}) {
+		config := c.Config
+		limited := *config
+		limited.Memory = b.limits.Memory
+		limited.MemorySwap = b.limits.MemorySwap
+		limited.CpuShares = b.limits.CpuShares
+		c.Config = &limited
+		defer func() { c.Config = config }()
+	}
+
 	// override the entry point that may have been picked up from the base image
 	c.Path = b.config.Cmd[0]
 	c.Args = b.config.Cmd[1:]
@@ -458,7 +964,7 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 	autoConfig := *b.config
 	autoConfig.Cmd = autoCmd
 	// Commit the container
-	image, err := b.runtime.Commit(container, "", "", "", b.maintainer, &autoConfig)
+	image, err := b.runtime.Commit(container, "", "", "", b.maintainer, &autoConfig, false)
 	if err != nil {
 		return err
 	}
@@ -467,6 +973,24 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 	return nil
 }
 
+// instructionMethod returns the method of the instruction, if any
+func (b *buildFile) instructionMethod(instruction string) (reflect.Method, bool) {
+	if instruction == "" {
+		return reflect.Method{}, false
+	}
+	instruction = strings.ToLower(instruction)
+	return reflect.TypeOf(b).MethodByName("Cmd" + strings.ToUpper(instruction[:1]) + instruction[1:])
+}
+
+// call runs the method of an instruction with its arguments
+func (b *buildFile) call(method reflect.Method, arguments string) error {
+	ret := method.Func.Call([]reflect.Value{reflect.ValueOf(b), reflect.ValueOf(arguments)})[0].Interface()
+	if ret != nil {
+		return ret.(error)
+	}
+	return nil
+}
+
 // Long lines can be split with a backslash
 var lineContinuation = regexp.MustCompile(`\s*\\\s*\n`)
 
@@ -481,8 +1005,11 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 	}
 	defer os.RemoveAll(name)
 	b.context = name
-	filename := path.Join(name, "Dockerfile")
+	filename := path.Join(name, path.Clean("/"+b.dockerfileName))
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if b.dockerfileName != "Dockerfile" {
+			return "", fmt.Errorf("Can't find the Dockerfile %s in the context", b.dockerfileName)
+		}
 		return "", fmt.Errorf("Can't build a directory with no Dockerfile")
 	}
 	fileBytes, err := ioutil.ReadFile(filename)
@@ -491,6 +1018,9 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 	}
 	dockerfile := string(fileBytes)
 	dockerfile = lineContinuation.ReplaceAllString(dockerfile, "")
+	if b.utilizeCache {
+		b.importCache()
+	}
 	stepN := 0
 	for _, line := range strings.Split(dockerfile, "\n") {
 		line = strings.Trim(strings.Replace(line, "\t", " ", -1), " \t\r\n")
@@ -505,7 +1035,7 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		instruction := strings.ToLower(strings.Trim(tmp[0], " "))
 		arguments := strings.Trim(tmp[1], " ")
 
-		method, exists := reflect.TypeOf(b).MethodByName("Cmd" + strings.ToUpper(instruction[:1]) + strings.ToLower(instruction[1:]))
+		method, exists := b.instructionMethod(instruction)
 		if !exists {
 			fmt.Fprintf(b.out, "# Skipping unknown instruction %s\n", strings.ToUpper(instruction))
 			continue
@@ -514,13 +1044,22 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		stepN += 1
 		fmt.Fprintf(b.out, "Step %d : %s %s\n", stepN, strings.ToUpper(instruction), arguments)
 
-		ret := method.Func.Call([]reflect.Value{reflect.ValueOf(b), reflect.ValueOf(arguments)})[0].Interface()
-		if ret != nil {
-			return "", ret.(error)
+		if err := b.call(method, arguments); err != nil {
+			return "", err
 		}
 
 		fmt.Fprintf(b.out, " ---> %v\n", utils.TruncateID(b.image))
 	}
+	for name := range b.buildArgs {
+		if _, declared := b.args[name]; !declared {
+			return "", fmt.Errorf("The build argument %s is not declared with ARG in the Dockerfile", name)
+		}
+	}
+	if b.image != "" && b.squash && b.image != b.fromImage {
+		if err := b.squashLayers(); err != nil {
+			return "", err
+		}
+	}
 	if b.image != "" {
 		fmt.Fprintf(b.out, "Successfully built %s\n", utils.TruncateID(b.image))
 		if b.rm {
@@ -531,16 +1070,103 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 	return "", fmt.Errorf("An error occurred during the build\n")
 }
 
-func NewBuildFile(srv *Server, out io.Writer, verbose, utilizeCache, rm bool) BuildFile {
+// squashLayers replaces the image built by one with a single layer holding
+// the changes of all the steps, on top of the FROM image. The images of the
+// steps are kept, for the cache of the next builds.
+func (b *buildFile) squashLayers() error {
+	img, err := b.runtime.graph.Get(b.image)
+	if err != nil {
+		return err
+	}
+	from, err := b.runtime.graph.Get(b.fromImage)
+	if err != nil {
+		return err
+	}
+	squashed, err := b.runtime.squashImage(img, from, "")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, "Squashed the layers onto %s\n ---> %v\n", utils.TruncateID(from.ID), utils.TruncateID(squashed.ID))
+	b.image = squashed.ID
+	return nil
+}
+
+// mkGitContext clones the git repository of remoteURL, see
+// utils.ParseGitURL, in root and returns the context of its subdirectory at
+// the ref, without the paths its .dockerignore matches but with the
+// Dockerfile
+func mkGitContext(remoteURL, root, dockerfileName string) (archive.Archive, error) {
+	repo, ref, subdir := utils.ParseGitURL(remoteURL)
+	if strings.HasPrefix(repo, "github.com/") {
+		repo = "https://" + repo
+	}
+	if strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("Invalid git ref %s", ref)
+	}
+	if output, err := exec.Command("git", "clone", "--recursive", repo, root).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("Error trying to use git: %s (%s)", err, output)
+	}
+	if ref != "" {
+		checkout := exec.Command("git", "checkout", ref, "--")
+		checkout.Dir = root
+		if output, err := checkout.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("Error checking out %s: %s (%s)", ref, err, output)
+		}
+		update := exec.Command("git", "submodule", "update", "--init", "--recursive")
+		update.Dir = root
+		if output, err := update.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("Error updating the submodules of %s: %s (%s)", ref, err, output)
+		}
+	}
+
+	dir := root
+	if subdir != "" {
+		// The symlinks of the repository can't lead out of it
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, err
+		}
+		dir, err = filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+subdir)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: no such directory in the git repository", subdir)
+		}
+		if dir != realRoot && !strings.HasPrefix(dir, realRoot+"/") {
+			return nil, fmt.Errorf("%s: the directory is out of the git repository", subdir)
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("%s: no such directory in the git repository", subdir)
+		}
+	}
+	ignore, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	excludes, err := archive.ParseExcludes(ignore)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading .dockerignore: %s", err)
+	}
+	return archive.TarWithExcludes(dir, archive.Uncompressed, excludes, "Dockerfile", ".dockerignore", dockerfileName)
+}
+
+func NewBuildFile(srv *Server, out io.Writer, verbose, utilizeCache, rm, squash bool, cacheFrom []string, buildArgs map[string]string, dockerfileName string, limits BuildLimits) BuildFile {
+	if dockerfileName == "" {
+		dockerfileName = "Dockerfile"
+	}
 	return &buildFile{
-		runtime:       srv.runtime,
-		srv:           srv,
-		config:        &Config{},
-		out:           out,
-		tmpContainers: make(map[string]struct{}),
-		tmpImages:     make(map[string]struct{}),
-		verbose:       verbose,
-		utilizeCache:  utilizeCache,
-		rm:            rm,
+		runtime:        srv.runtime,
+		srv:            srv,
+		config:         &Config{},
+		out:            out,
+		tmpContainers:  make(map[string]struct{}),
+		tmpImages:      make(map[string]struct{}),
+		verbose:        verbose,
+		utilizeCache:   utilizeCache,
+		rm:             rm,
+		squash:         squash,
+		cacheFrom:      cacheFrom,
+		buildArgs:      buildArgs,
+		args:           make(map[string]string),
+		dockerfileName: dockerfileName,
+		limits:         limits,
 	}
 }
@@ -1,14 +1,20 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"github.com/dotcloud/docker/archive"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 // mkTestContext generates a build context from the contents of the provided dockerfile.
@@ -255,7 +261,7 @@ func buildImage(context testContextTemplate, t *testing.T, srv *Server, useCache
 	ip := srv.runtime.networkManager.bridgeNetwork.IP
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := NewBuildFile(srv, ioutil.Discard, false, useCache, false)
+	buildfile := NewBuildFile(srv, ioutil.Discard, false, useCache, false, false, nil, nil, "", BuildLimits{})
 	id, err := buildfile.Build(mkTestContext(dockerfile, context.files, t))
 	if err != nil {
 		t.Fatal(err)
@@ -307,6 +313,17 @@ func TestBuildUser(t *testing.T) {
 	}
 }
 
+func TestBuildStopSignal(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        stopsignal SIGQUIT
+    `, nil, nil}, t, nil, true)
+
+	if img.Config.StopSignal != "SIGQUIT" {
+		t.Fatalf("Expected the stop signal SIGQUIT, got %q", img.Config.StopSignal)
+	}
+}
+
 func TestBuildEnv(t *testing.T) {
 	img := buildImage(testContextTemplate{`
         from {IMAGE}
@@ -484,7 +501,7 @@ func TestForbiddenContextPath(t *testing.T) {
 	ip := srv.runtime.networkManager.bridgeNetwork.IP
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false)
+	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, nil, "", BuildLimits{})
 	_, err = buildfile.Build(mkTestContext(dockerfile, context.files, t))
 
 	if err == nil {
@@ -529,7 +546,7 @@ func TestBuildADDFileNotFound(t *testing.T) {
 	ip := srv.runtime.networkManager.bridgeNetwork.IP
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false)
+	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, nil, "", BuildLimits{})
 	_, err = buildfile.Build(mkTestContext(dockerfile, context.files, t))
 
 	if err == nil {
@@ -578,3 +595,511 @@ func TestBuildInheritance(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestBuildArg(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	dockerfile := constructDockerfile(`
+        from {IMAGE}
+        arg version
+        arg dir=/tmp
+        run [ "$version" = "1.2" ] && [ "$dir" = "/tmp" ]
+        env dest $dir
+        `, nil, "")
+	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, map[string]string{"version": "1.2"}, "", BuildLimits{})
+	id, err := buildfile.Build(mkTestContext(dockerfile, nil, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := srv.ImageInspect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasEnv := false
+	for _, env := range img.Config.Env {
+		if env == "dest=/tmp" {
+			hasEnv = true
+		}
+		if strings.HasPrefix(env, "version=") || strings.HasPrefix(env, "dir=") {
+			t.Errorf("Expected the build arguments out of the environment of the image, got %s", env)
+		}
+	}
+	if !hasEnv {
+		t.Errorf("Expected the build argument expanded in ENV, got %v", img.Config.Env)
+	}
+
+	buildfile = NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, map[string]string{"undeclared": "1"}, "", BuildLimits{})
+	if _, err := buildfile.Build(mkTestContext(dockerfile, nil, t)); err == nil {
+		t.Fatal("Expected an error for a build argument not declared")
+	}
+}
+
+func TestBuildArgEnv(t *testing.T) {
+	b := &buildFile{
+		config:    &Config{Env: []string{"HOME=/", "dir=/home"}},
+		buildArgs: map[string]string{"version": "1.2", "dir": "/tmp"},
+		args:      make(map[string]string),
+	}
+	for _, arg := range []string{"version=1.0", "dir", "user=root", "unset"} {
+		if err := b.CmdArg(arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.CmdArg("1nvalid"); err == nil {
+		t.Error("Expected an error for an invalid ARG")
+	}
+
+	// The ENV of the image overrides the build argument
+	expected := []string{"HOME=/", "dir=/home", "user=root", "version=1.2"}
+	if env := b.runEnv(); !equalStrings(env, expected) {
+		t.Errorf("Expected the environment %v, got %v", expected, env)
+	}
+	value, err := b.ReplaceEnvMatches("$version:${dir}:$user:$unset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "1.2:/home:root:" {
+		t.Errorf("Expected 1.2:/home:root:, got %s", value)
+	}
+
+	if _, err := ParseBuildArgs([]string{"version"}); err == nil {
+		t.Error("Expected an error for a build argument without value")
+	}
+}
+
+func TestBuildOnBuild(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        onbuild run touch /triggered
+        onbuild env triggered yes
+        `,
+		nil, nil}, t, srv, true)
+	if len(img.Config.OnBuild) != 2 || img.Config.OnBuild[0] != "RUN touch /triggered" {
+		t.Fatalf("Expected the ONBUILD triggers to be recorded, got %v", img.Config.OnBuild)
+	}
+
+	img2 := buildImage(testContextTemplate{fmt.Sprintf(`
+        from %s
+        run [ -f /triggered ]
+        `, img.ID),
+		nil, nil}, t, srv, true)
+	if len(img2.Config.OnBuild) != 0 {
+		t.Errorf("Expected the ONBUILD triggers not to be inherited, got %v", img2.Config.OnBuild)
+	}
+	hasEnv := false
+	for _, env := range img2.Config.Env {
+		if env == "triggered=yes" {
+			hasEnv = true
+		}
+	}
+	if !hasEnv {
+		t.Errorf("Expected the ENV trigger to run, got %v", img2.Config.Env)
+	}
+}
+
+func TestBuildOnBuildInvalid(t *testing.T) {
+	b := &buildFile{config: &Config{}}
+	for _, args := range []string{"onbuild run true", "from base", "maintainer me", "unknown true", "run"} {
+		if err := b.CmdOnbuild(args); err == nil {
+			t.Errorf("Expected an error for ONBUILD %s", args)
+		}
+	}
+	if len(b.config.OnBuild) != 0 {
+		t.Errorf("Expected no trigger recorded, got %v", b.config.OnBuild)
+	}
+}
+
+func TestMkGitContext(t *testing.T) {
+	repo, err := ioutil.TempDir("", "docker-test-git-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s (%s)", args, err, output)
+		}
+	}
+	write := func(name, content string) {
+		if err := os.MkdirAll(path.Join(repo, path.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(repo, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("web/Dockerfile", "from base\n")
+	write("web/.dockerignore", "secret\n")
+	write("web/secret", "s3cr3t")
+	write("web/app.js", "v1")
+	git("add", ".")
+	git("commit", "-q", "-m", "v1")
+	git("tag", "v1")
+	write("web/app.js", "v2")
+	git("commit", "-q", "-a", "-m", "v2")
+
+	root, err := ioutil.TempDir("", "docker-test-git-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	context, err := mkGitContext(repo+"#v1:web", root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "docker-test-git-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := archive.Untar(context, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(tmp, "app.js")); err != nil || string(content) != "v1" {
+		t.Errorf("Expected app.js of v1 in the context, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(path.Join(tmp, "Dockerfile")); err != nil {
+		t.Errorf("Expected the Dockerfile in the context: %s", err)
+	}
+	if _, err := os.Stat(path.Join(tmp, "secret")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file .dockerignore matches out of the context")
+	}
+
+	missing, err := ioutil.TempDir("", "docker-test-git-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(missing)
+	if _, err := mkGitContext(repo+"#v1:missing", missing, ""); err == nil {
+		t.Error("Expected an error for a missing subdirectory")
+	}
+
+	// A symlink of the repository to a directory of the host
+	if err := os.Symlink(tmp, path.Join(repo, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "escape")
+	git("commit", "-q", "-m", "escape")
+	git("tag", "escape")
+	escape, err := ioutil.TempDir("", "docker-test-git-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(escape)
+	if _, err := mkGitContext(repo+"#escape:escape", escape, ""); err == nil {
+		t.Error("Expected an error for a subdirectory out of the repository")
+	}
+}
+
+func TestBuildDockerfileName(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	dockerfile := constructDockerfile("from {IMAGE}\nuser default\n", nil, "")
+	files := [][2]string{{"docker/Dockerfile.dev", constructDockerfile("from {IMAGE}\nuser dev\n", nil, "")}}
+	buildfile := NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, nil, "docker/Dockerfile.dev", BuildLimits{})
+	id, err := buildfile.Build(mkTestContext(dockerfile, files, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := srv.ImageInspect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Config.User != "dev" {
+		t.Errorf("Expected the image of docker/Dockerfile.dev, got the user %s", img.Config.User)
+	}
+
+	buildfile = NewBuildFile(srv, ioutil.Discard, false, true, false, false, nil, nil, "Dockerfile.missing", BuildLimits{})
+	if _, err := buildfile.Build(mkTestContext(dockerfile, files, t)); err == nil {
+		t.Fatal("Expected an error for a missing Dockerfile")
+	}
+}
+
+func TestBuildArgCache(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	dockerfile := constructDockerfile(`
+        from {IMAGE}
+        run echo before
+        arg cachebust
+        run echo after
+        `, nil, "")
+	build := func(utilizeCache bool, buildArgs map[string]string) *Image {
+		buildfile := NewBuildFile(srv, ioutil.Discard, false, utilizeCache, false, false, nil, buildArgs, "", BuildLimits{})
+		id, err := buildfile.Build(mkTestContext(dockerfile, nil, t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := srv.ImageInspect(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := build(true, map[string]string{"cachebust": "1"})
+	if img2 := build(true, map[string]string{"cachebust": "1"}); img2.ID != img.ID {
+		t.Errorf("Expected the same value to use the cache: %s != %s", img.ID, img2.ID)
+	}
+	img2 := build(true, map[string]string{"cachebust": "2"})
+	if img2.ID == img.ID {
+		t.Fatalf("Expected another value to run the steps after ARG again")
+	}
+	// The RUN before ARG keeps its cache
+	if img2.Parent != img.Parent {
+		t.Errorf("Expected the RUN before ARG to use the cache: %s != %s", img.Parent, img2.Parent)
+	}
+
+	if img3 := build(false, map[string]string{"cachebust": "1"}); img3.ID == img.ID {
+		t.Errorf("Expected the build without cache to run all the steps again")
+	}
+}
+
+func TestHashPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-hash-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(path.Join(root, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(root, "src", "app.js")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		h, err := hashPath(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h1 := hash()
+	// The modification time is not part of the hash
+	if err := os.Chtimes(file, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); h != h1 {
+		t.Errorf("Expected the hash to stay %s when the file is touched, got %s", h1, h)
+	}
+	if err := ioutil.WriteFile(file, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h2 := hash()
+	if h2 == h1 {
+		t.Errorf("Expected the hash to change with the content")
+	}
+	if err := os.Chmod(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); h == h2 {
+		t.Errorf("Expected the hash to change with the mode")
+	}
+	if err := os.Rename(file, path.Join(root, "src", "main.js")); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); h == h2 {
+		t.Errorf("Expected the hash to change with the path")
+	}
+}
+
+func TestBuildADDCache(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	template := testContextTemplate{`
+        from {IMAGE}
+        add foo /foo
+        `,
+		[][2]string{{"foo", "v1"}}, nil}
+	img := buildImage(template, t, srv, true)
+	if img2 := buildImage(template, t, srv, true); img2.ID != img.ID {
+		t.Errorf("Expected the same file to use the cache: %s != %s", img.ID, img2.ID)
+	}
+	template.files = [][2]string{{"foo", "v2"}}
+	if img2 := buildImage(template, t, srv, true); img2.ID == img.ID {
+		t.Errorf("Expected another content of the file to add it again")
+	}
+}
+
+func TestBuildCopy(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "inside", Size: 2, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ADD unpacks the archive, COPY copies it as is
+	buildImage(testContextTemplate{`
+        from {IMAGE}
+        add app.tar /added/
+        copy app.tar /copied/
+        run [ -f /added/inside ] && [ -f /copied/app.tar ] && [ ! -e /copied/inside ]
+        `,
+		[][2]string{{"app.tar", buf.String()}}, nil}, t, nil, true)
+
+	b := &buildFile{context: "/tmp", config: &Config{}}
+	if err := b.CmdCopy("http://example.com/app.tar /app.tar"); err == nil {
+		t.Error("Expected an error for COPY of a url")
+	}
+}
+
+func TestAddContextCopyFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-add-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	context := path.Join(tmp, "context")
+	if err := os.MkdirAll(context, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(context, "app.js"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	container := &Container{root: path.Join(tmp, "container")}
+	if err := os.MkdirAll(container.RootfsPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// COPY creates the missing directories of the destination, as ADD
+	// does, readable by all the users
+	b := &buildFile{context: context, config: &Config{}}
+	if err := b.addContext(container, "app.js", "/srv/www/app.js", false); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(container.RootfsPath(), "srv/www/app.js")); err != nil || string(content) != "app" {
+		t.Fatalf("Expected app.js to be copied to /srv/www, got %q (%v)", content, err)
+	}
+	for _, dir := range []string{"srv", "srv/www"} {
+		if fi, err := os.Stat(path.Join(container.RootfsPath(), dir)); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != 0755 {
+			t.Errorf("Expected /%s to be created with mode 0755, got %v", dir, fi.Mode())
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"name": "app", "dir": "/srv", "empty": ""}
+	lookup := func(name string) (string, bool) {
+		value, exists := env[name]
+		return value, exists
+	}
+	for value, expected := range map[string]string{
+		"$dir/$name":               "/srv/app",
+		"${dir}_${name}":           "/srv_app",
+		"$unset/x":                 "/x",
+		"${unset:-/opt}/$name":     "/opt/app",
+		"${empty:-default}":        "default",
+		"${dir:-/opt}":             "/srv",
+		"${name:+-v $name}":        "-v app",
+		"${unset:+set}":            "",
+		"${unset:-${dir}/default}": "/srv/default",
+		"\\$dir costs \\$5 or $ 5": "$dir costs $5 or $ 5",
+		"100%":                     "100%",
+	} {
+		expanded, err := expandEnv(value, lookup)
+		if err != nil {
+			t.Fatalf("%s: %s", value, err)
+		}
+		if expanded != expected {
+			t.Errorf("Expected %s to be expanded to %q, got %q", value, expected, expanded)
+		}
+	}
+	for _, value := range []string{"${dir", "${}", "${dir:?error}", "${1a}"} {
+		if _, err := expandEnv(value, lookup); err == nil {
+			t.Errorf("Expected an error expanding %s", value)
+		}
+	}
+}
+
+func TestBuildLabel(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        env version 1.2
+        label com.example.vendor=ACME "com.example.description"="The app, \
+              built with love" version=$version 'raw'='$version'
+        label maintainer me@example.com
+        `,
+		nil, nil}, t, nil, true)
+
+	expected := map[string]string{
+		"com.example.vendor":      "ACME",
+		"com.example.description": "The app, built with love",
+		"version":                 "1.2",
+		"raw":                     "$version",
+		"maintainer":              "me@example.com",
+	}
+	for key, value := range expected {
+		if v, exists := img.Config.Labels[key]; !exists || v != value {
+			t.Errorf("Expected the label %s=%s, got %v", key, value, img.Config.Labels)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	words, err := splitWords(`a=b  "c d"=e\ f 'g $h'="i \"j\" \$k" l\$m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a=b", "c d=e f", `g \$h=i "j" \$k`, `l\$m`}
+	if !equalStrings(words, expected) {
+		t.Errorf("Expected %q, got %q", expected, words)
+	}
+	if words, err := splitWords(`""`); err != nil || len(words) != 1 || words[0] != "" {
+		t.Errorf("Expected an empty word, got %q (%v)", words, err)
+	}
+	for _, args := range []string{`a="b`, `a='b`} {
+		if _, err := splitWords(args); err == nil {
+			t.Errorf("Expected an error for %s", args)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The cgroup subsystems a container is placed under its cgroup parent in,
+// when they are mounted
+var cgroupSubsystems = []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "memory", "perf_event"}
+
+// Moves the shell into the cgroups given as its first arguments, then
+// execs the rest of its arguments. lxc creates the cgroups of the
+// container under the ones of lxc-start.
+const cgroupParentWrapper = `n=$1; shift
+while [ $n -gt 0 ]; do echo $$ > "$1" || exit 1; shift; n=$((n-1)); done
+exec "$@"`
+
+func validateCgroupParent(parent string) error {
+	if parent == "" {
+		return nil
+	}
+	for _, part := range strings.Split(parent, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("Bad parameter cgroup parent: %s", parent)
+		}
+	}
+	return nil
+}
+
+// A rule of the devices cgroup: the type of the devices, b for block, c for
+// char or a for both, their major and minor numbers, * for any, and the
+// access to them, among read, write and mknod
+var deviceCgroupRulePattern = regexp.MustCompile(`^[abc] ([0-9]+|\*):([0-9]+|\*) [rwm]{1,3}$`)
+
+// validateDeviceCgroupRule checks a rule of -device-cgroup-rule, e.g.
+// "c 195:* rwm" for the NVIDIA GPUs
+func validateDeviceCgroupRule(rule string) error {
+	if !deviceCgroupRulePattern.MatchString(rule) {
+		return fmt.Errorf("Bad parameter device-cgroup-rule: %s, expected TYPE MAJOR:MINOR ACCESS (e.g. c 195:* rwm)", rule)
+	}
+	return nil
+}
+
+// createCgroupDir creates the cgroup dir, relative to the mountpoint of
+// its hierarchy. The cpuset of a new cgroup is empty and no task can join
+// it, so it is copied from its parent.
+func createCgroupDir(mountpoint, dir string) error {
+	current := mountpoint
+	for _, part := range strings.Split(strings.Trim(path.Clean(dir), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		parent := current
+		current = path.Join(current, part)
+		if err := os.Mkdir(current, 0755); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+			value, err := ioutil.ReadFile(path.Join(parent, file))
+			if err != nil {
+				// Not the cpuset hierarchy
+				break
+			}
+			if err := ioutil.WriteFile(path.Join(current, file), value, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cgroupParentTasks creates the cgroup parent of the container in every
+// mounted hierarchy, and returns the tasks files to join them
+func (container *Container) cgroupParentTasks() ([]string, error) {
+	var tasks []string
+	mountpoints := make(map[string]bool)
+	for _, subsystem := range cgroupSubsystems {
+		mountpoint, err := utils.FindCgroupMountpoint(subsystem)
+		if err != nil || mountpoints[mountpoint] {
+			continue
+		}
+		mountpoints[mountpoint] = true
+		if err := createCgroupDir(mountpoint, container.hostConfig.CgroupParent); err != nil {
+			return nil, fmt.Errorf("Unable to create the cgroup parent %s: %s", container.hostConfig.CgroupParent, err)
+		}
+		tasks = append(tasks, path.Join(mountpoint, container.hostConfig.CgroupParent, "tasks"))
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("Unable to create the cgroup parent %s: no cgroup hierarchy is mounted", container.hostConfig.CgroupParent)
+	}
+	return tasks, nil
+}
+
+// freeze suspends every process of the container through the freezer
+// cgroup, until unfreeze is called
+func (container *Container) freeze() error {
+	if output, err := exec.Command("lxc-freeze", "-n", container.ID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to freeze container %s: %s (%s)", container.ID, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (container *Container) unfreeze() error {
+	if output, err := exec.Command("lxc-unfreeze", "-n", container.ID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to unfreeze container %s: %s (%s)", container.ID, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
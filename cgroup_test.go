@@ -0,0 +1,75 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValidateCgroupParent(t *testing.T) {
+	for _, parent := range []string{"", "/system.slice/db", "docker-db", "/"} {
+		if err := validateCgroupParent(parent); err != nil {
+			t.Fatalf("Expected %s to be valid: %s", parent, err)
+		}
+	}
+	for _, parent := range []string{"../db", "/system.slice/../db", "./db"} {
+		if err := validateCgroupParent(parent); err == nil {
+			t.Fatalf("Expected %s to be invalid", parent)
+		}
+	}
+}
+
+func TestValidateDeviceCgroupRule(t *testing.T) {
+	for _, rule := range []string{"c 195:* rwm", "b 7:0 rw", "c *:* m", "a *:* rwm"} {
+		if err := validateDeviceCgroupRule(rule); err != nil {
+			t.Fatalf("Expected %s to be valid: %s", rule, err)
+		}
+	}
+	for _, rule := range []string{"", "c 195 rwm", "d 1:3 rwm", "c 1:3", "c 1:3 rwx", "c  1:3 rwm", "c 1:3 rwm\nlxc.cgroup.devices.allow = a"} {
+		if err := validateDeviceCgroupRule(rule); err == nil {
+			t.Fatalf("Expected %q to be invalid", rule)
+		}
+	}
+}
+
+func TestCreateCgroupDir(t *testing.T) {
+	mountpoint, err := ioutil.TempDir("", "docker-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountpoint)
+
+	if err := createCgroupDir(mountpoint, "/system.slice/db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(mountpoint, "system.slice", "db")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(mountpoint, "system.slice", "db", "cpuset.cpus")); err == nil {
+		t.Fatal("Expected no cpuset outside of the cpuset hierarchy")
+	}
+
+	// The cpuset is copied down the new cgroups
+	for file, value := range map[string]string{"cpuset.cpus": "0-3\n", "cpuset.mems": "0\n"} {
+		if err := ioutil.WriteFile(path.Join(mountpoint, "system.slice", file), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createCgroupDir(mountpoint, "system.slice/web/front"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"web", "web/front"} {
+		value, err := ioutil.ReadFile(path.Join(mountpoint, "system.slice", dir, "cpuset.cpus"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "0-3\n" {
+			t.Fatalf("Expected the cpuset of the parent in %s, got %q", dir, value)
+		}
+	}
+	// Existing cgroups are kept
+	if err := createCgroupDir(mountpoint, "system.slice/db"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,13 @@
 package docker
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type ChangeType int
@@ -33,7 +36,127 @@ func (change *Change) String() string {
 	return fmt.Sprintf("%s %s", kind, change.Path)
 }
 
+// layerStat is what the layers of an image hold at a path
+type layerStat struct {
+	Exists  bool
+	IsDir   bool
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// maxJournalPaths is the number of paths a change journal records at most,
+// the others are looked up on each diff
+const maxJournalPaths = 100000
+
+// ChangeJournal records the lookups of the paths of a rw layer in the layers
+// below it. These layers never change, so the next diffs of the rw layer
+// only look up its new paths, instead of every path in every layer. The
+// journal is compacted on save, keeping the paths the last diff looked up:
+// the ones still in the rw layer.
+type ChangeJournal struct {
+	Layers map[string]layerStat
+	dirty  bool
+	// The paths looked up since the journal was loaded
+	used map[string]bool
+}
+
+func NewChangeJournal() *ChangeJournal {
+	return &ChangeJournal{Layers: make(map[string]layerStat), used: make(map[string]bool)}
+}
+
+// LoadChangeJournal reads the journal saved at path. A missing or corrupted
+// journal is replaced by an empty one.
+func LoadChangeJournal(path string) *ChangeJournal {
+	journal := NewChangeJournal()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return journal
+	}
+	if err := json.Unmarshal(data, journal); err != nil || journal.Layers == nil {
+		return NewChangeJournal()
+	}
+	return journal
+}
+
+// Save writes the journal at path, without the paths not looked up since
+// it was loaded, if it changed. It is to be called after a complete diff.
+func (journal *ChangeJournal) Save(path string) error {
+	for p := range journal.Layers {
+		if !journal.used[p] {
+			delete(journal.Layers, p)
+			journal.dirty = true
+		}
+	}
+	if !journal.dirty {
+		return nil
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	// Each save writes a file of its own, the concurrent diffs of a
+	// container save their journals concurrently
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	journal.dirty = false
+	return nil
+}
+
+// lookup returns what the topmost of layers holding path holds. journal
+// may be nil.
+func (journal *ChangeJournal) lookup(layers []string, path string) (layerStat, error) {
+	if journal != nil {
+		if stat, exists := journal.Layers[path]; exists {
+			journal.used[path] = true
+			return stat, nil
+		}
+	}
+	var result layerStat
+	for _, layer := range layers {
+		stat, err := os.Stat(filepath.Join(layer, path))
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		if err == nil {
+			result = layerStat{
+				Exists:  true,
+				IsDir:   stat.IsDir(),
+				Size:    stat.Size(),
+				Mode:    stat.Mode(),
+				ModTime: stat.ModTime(),
+			}
+			break
+		}
+	}
+	if journal != nil && len(journal.Layers) < maxJournalPaths {
+		journal.Layers[path] = result
+		journal.used[path] = true
+		journal.dirty = true
+	}
+	return result, nil
+}
+
 func Changes(layers []string, rw string) ([]Change, error) {
+	return ChangesWithJournal(layers, rw, nil)
+}
+
+// ChangesWithJournal is Changes, looking up the paths of rw in layers
+// through journal
+func ChangesWithJournal(layers []string, rw string, journal *ChangeJournal) ([]Change, error) {
 	var changes []Change
 	err := filepath.Walk(rw, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
@@ -54,6 +177,9 @@ func Changes(layers []string, rw string) ([]Change, error) {
 
 		// Skip AUFS metadata
 		if matched, err := filepath.Match("/.wh..wh.*", path); err != nil || matched {
+			if err == nil && f.IsDir() {
+				return filepath.SkipDir
+			}
 			return err
 		}
 
@@ -68,30 +194,30 @@ func Changes(layers []string, rw string) ([]Change, error) {
 			originalFile := file[len(".wh."):]
 			change.Path = filepath.Join(filepath.Dir(path), originalFile)
 			change.Kind = ChangeDelete
+		} else if isOverlayWhiteout(f) {
+			// The whiteout of an overlay upper layer
+			change.Kind = ChangeDelete
 		} else {
 			// Otherwise, the file was added
 			change.Kind = ChangeAdd
 
 			// ...Unless it already existed in a top layer, in which case, it's a modification
-			for _, layer := range layers {
-				stat, err := os.Stat(filepath.Join(layer, path))
-				if err != nil && !os.IsNotExist(err) {
-					return err
-				}
-				if err == nil {
-					// The file existed in the top layer, so that's a modification
-
-					// However, if it's a directory, maybe it wasn't actually modified.
-					// If you modify /foo/bar/baz, then /foo will be part of the changed files only because it's the parent of bar
-					if stat.IsDir() && f.IsDir() {
-						if f.Size() == stat.Size() && f.Mode() == stat.Mode() && f.ModTime() == stat.ModTime() {
-							// Both directories are the same, don't record the change
-							return nil
-						}
+			stat, err := journal.lookup(layers, path)
+			if err != nil {
+				return err
+			}
+			if stat.Exists {
+				// The file existed in the top layer, so that's a modification
+
+				// However, if it's a directory, maybe it wasn't actually modified.
+				// If you modify /foo/bar/baz, then /foo will be part of the changed files only because it's the parent of bar
+				if stat.IsDir && f.IsDir() {
+					if f.Size() == stat.Size && f.Mode() == stat.Mode && f.ModTime().Equal(stat.ModTime) {
+						// Both directories are the same, don't record the change
+						return nil
 					}
-					change.Kind = ChangeModify
-					break
 				}
+				change.Kind = ChangeModify
 			}
 		}
 
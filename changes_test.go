@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func changesString(changes []Change) string {
+	var s []string
+	for _, change := range changes {
+		s = append(s, change.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestChangesWithJournal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layer, rw := path.Join(tmp, "layer"), path.Join(tmp, "rw")
+	for _, dir := range []string{path.Join(layer, "etc"), path.Join(rw, "etc")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		path.Join(layer, "etc", "hosts"): "127.0.0.1 localhost\n",
+		path.Join(layer, "etc", "motd"):  "hello\n",
+		path.Join(rw, "etc", "hosts"):    "127.0.0.1 localhost db\n",
+		path.Join(rw, "etc", "app.conf"): "debug=1\n",
+		path.Join(rw, "etc", ".wh.motd"): "",
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The directory holding the changes differs from the one of the layer
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path.Join(layer, "etc"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "A /etc/app.conf,C /etc,C /etc/hosts,D /etc/motd"
+	journal := NewChangeJournal()
+	changes, err := ChangesWithJournal([]string{layer}, rw, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changesString(changes) != expected {
+		t.Fatalf("Expected %s, got %s", expected, changesString(changes))
+	}
+
+	journalPath := path.Join(tmp, "changes.journal")
+	if err := journal.Save(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lookups of the known paths come from the journal, without the layer
+	if err := os.RemoveAll(layer); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = ChangesWithJournal([]string{layer}, rw, LoadChangeJournal(journalPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changesString(changes) != expected {
+		t.Fatalf("Expected %s from the journal, got %s", expected, changesString(changes))
+	}
+
+	// Without the journal, the files look new
+	changes, err = Changes([]string{layer}, rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changesString(changes) == expected {
+		t.Fatalf("Expected the diff without the journal to look up the removed layer")
+	}
+}
+
+func TestChangeJournalCompact(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layer, rw := path.Join(tmp, "layer"), path.Join(tmp, "rw")
+	os.MkdirAll(layer, 0755)
+	os.MkdirAll(rw, 0755)
+	for _, name := range []string{"kept", "removed"} {
+		if err := ioutil.WriteFile(path.Join(rw, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journalPath := path.Join(tmp, "changes.journal")
+	journal := NewChangeJournal()
+	if _, err := ChangesWithJournal([]string{layer}, rw, journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Save(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The paths gone from the rw layer are dropped on the next save
+	os.Remove(path.Join(rw, "removed"))
+	journal = LoadChangeJournal(journalPath)
+	if _, err := ChangesWithJournal([]string{layer}, rw, journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Save(journalPath); err != nil {
+		t.Fatal(err)
+	}
+	journal = LoadChangeJournal(journalPath)
+	if _, exists := journal.Layers["/removed"]; exists || len(journal.Layers) != 1 {
+		t.Errorf("Expected the journal to keep /kept only, got %v", journal.Layers)
+	}
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 3 {
+		t.Errorf("Expected no temporary file left, got %d files", len(files))
+	}
+}
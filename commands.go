@@ -31,6 +31,7 @@ import (
 	"strings"
 	"syscall"
 	"text/tabwriter"
+	"text/template"
 	"time"
 )
 
@@ -44,7 +45,13 @@ var (
 )
 
 func (cli *DockerCli) getMethod(name string) (func(...string) error, bool) {
-	methodName := "Cmd" + strings.ToUpper(name[:1]) + strings.ToLower(name[1:])
+	// self-upgrade is CmdSelfUpgrade
+	methodName := "Cmd"
+	for _, part := range strings.Split(name, "-") {
+		if part != "" {
+			methodName += strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		}
+	}
 	method := reflect.ValueOf(cli).MethodByName(methodName)
 	if !method.IsValid() {
 		return nil, false
@@ -81,32 +88,56 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"attach", "Attach to a running container"},
 		{"build", "Build a container from a Dockerfile"},
 		{"commit", "Create a new image from a container's changes"},
-		{"cp", "Copy files/folders from the containers filesystem to the host path"},
+		{"connect", "Connect a running container to another bridge"},
+		{"cp", "Copy files/folders between the containers filesystem and the host path"},
 		{"diff", "Inspect changes on a container's filesystem"},
+		{"disconnect", "Disconnect a running container from another bridge"},
 		{"events", "Get real time events from the server"},
 		{"export", "Stream the contents of a container as a tar archive"},
+		{"forward", "Forward a local port to a port of a running container"},
+		{"fsck", "Check the integrity of the images, and repair it"},
 		{"history", "Show the history of an image"},
 		{"images", "List images"},
 		{"import", "Create a new filesystem image from the contents of a tarball"},
 		{"info", "Display system-wide information"},
+		{"initconfig", "Generate a systemd unit or upstart job running a container"},
 		{"insert", "Insert a file in an image"},
 		{"inspect", "Return low-level information on a container"},
 		{"kill", "Kill a running container"},
+		{"load", "Load images and their tags from a tar archive"},
 		{"login", "Register or Login to the docker registry server"},
 		{"logs", "Fetch the logs of a container"},
+		{"migrate", "Move the filesystems of the stopped containers to another storage driver"},
+		{"mirror", "Mirror the traffic of a running container"},
+		{"namespaces", "Show the namespaces and cgroups of a running container"},
+		{"network", "List the running containers on a bridge"},
+		{"plugin", "Manage the plugins of the daemon"},
 		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
+		{"prune", "Remove the images neither tagged nor used by a container"},
 		{"ps", "List containers"},
+		{"publish", "Publish a port of a running container"},
 		{"pull", "Pull an image or a repository from the docker registry server"},
 		{"push", "Push an image or a repository to the docker registry server"},
+		{"rename", "Rename a container"},
 		{"restart", "Restart a running container"},
 		{"rm", "Remove one or more containers"},
 		{"rmi", "Remove one or more images"},
 		{"run", "Run a command in a new container"},
+		{"save", "Save images, their layers and tags to a tar archive"},
 		{"search", "Search for an image in the docker index"},
+		{"self-upgrade", "Upgrade the daemon to a signed release, keeping its containers running"},
+		{"sign", "Sign an image with a private key"},
+		{"standby", "Prepare a stopped container to start without starting it"},
 		{"start", "Start a stopped container"},
 		{"stop", "Stop a running container"},
+		{"swap", "Replace a running container by a copy running another image"},
+		{"system", "Show the disk usage of the daemon"},
 		{"tag", "Tag an image into a repository"},
 		{"top", "Lookup the running processes of a container"},
+		{"unforward", "Stop forwarding a local port to a container"},
+		{"unmirror", "Stop mirroring the traffic of a running container"},
+		{"unpublish", "Remove published ports from a running container"},
+		{"update", "Update the priority of one or more containers"},
 		{"version", "Show the docker version information"},
 		{"wait", "Block until a container stops, then print its exit code"},
 	} {
@@ -167,6 +198,15 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	suppressOutput := cmd.Bool("q", false, "Suppress verbose build output")
 	noCache := cmd.Bool("no-cache", false, "Do not use cache when building the image")
 	rm := cmd.Bool("rm", false, "Remove intermediate containers after a successful build")
+	squash := cmd.Bool("squash", false, "Squash the layers of the build into a single layer on top of the FROM image")
+	var cacheFrom utils.ListOpts
+	cmd.Var(&cacheFrom, "cache-from", "Image pulled, or archive of docker save loaded, whose history is used as cache (e.g. -cache-from app:latest)")
+	var buildArgs utils.ListOpts
+	cmd.Var(&buildArgs, "build-arg", "Value of a build argument declared with ARG in the Dockerfile (e.g. -build-arg version=1.2)")
+	dockerfileName := cmd.String("f", "", "Path of the Dockerfile, in the context (default PATH/Dockerfile)")
+	memory := cmd.Int64("m", 0, "Memory limit (in bytes) of the containers of the RUN instructions")
+	memorySwap := cmd.Int64("memory-swap", 0, "Total memory usage (memory + swap) of the containers of the RUN instructions; set -1 to disable swap")
+	cpuShares := cmd.Int64("c", 0, "CPU shares (relative weight) of the containers of the RUN instructions")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -174,6 +214,9 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	if _, err := ParseBuildArgs(buildArgs); err != nil {
+		return err
+	}
 
 	var (
 		context  archive.Archive
@@ -181,21 +224,78 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		err      error
 	)
 
+	// The archives are loaded beforehand, the images are pulled by the
+	// daemon if missing
+	var cacheImages []string
+	for _, name := range cacheFrom {
+		if f, err := os.Stat(name); err != nil || !f.Mode().IsRegular() {
+			cacheImages = append(cacheImages, name)
+			continue
+		}
+		if err := cli.CmdLoad("-i", name); err != nil {
+			return err
+		}
+	}
+
 	if cmd.Arg(0) == "-" {
-		// As a special case, 'docker build -' will build from an empty context with the
-		// contents of stdin as a Dockerfile
-		dockerfile, err := ioutil.ReadAll(cli.in)
-		if err != nil {
+		// As a special case, 'docker build -' will build from the tar
+		// archive on stdin, compressed or not, or else from an empty context
+		// with the contents of stdin as a Dockerfile
+		in := bufio.NewReader(cli.in)
+		header, err := in.Peek(512)
+		if err != nil && err != io.EOF {
 			return err
 		}
-		context, err = mkBuildContext(string(dockerfile), nil)
+		if archive.IsArchive(header) {
+			context = in
+		} else {
+			dockerfile, err := ioutil.ReadAll(in)
+			if err != nil {
+				return err
+			}
+			if context, err = mkBuildContext(string(dockerfile), nil); err != nil {
+				return err
+			}
+		}
 	} else if utils.IsURL(cmd.Arg(0)) || utils.IsGIT(cmd.Arg(0)) {
 		isRemote = true
 	} else {
 		if _, err := os.Stat(cmd.Arg(0)); err != nil {
 			return err
 		}
-		context, err = archive.Tar(cmd.Arg(0), archive.Uncompressed)
+		// The Dockerfile of -f is given from the current directory, and
+		// sent as its path in the context
+		if *dockerfileName != "" {
+			abs, err := filepath.Abs(*dockerfileName)
+			if err != nil {
+				return err
+			}
+			root, err := filepath.Abs(cmd.Arg(0))
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, abs)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return fmt.Errorf("The Dockerfile %s must be in the context %s", *dockerfileName, cmd.Arg(0))
+			}
+			if _, err := os.Stat(abs); err != nil {
+				return err
+			}
+			*dockerfileName = rel
+		}
+		// The paths .dockerignore matches are left out of the context, the
+		// Dockerfile and .dockerignore always sent
+		var excludes []string
+		ignore, err := ioutil.ReadFile(filepath.Join(cmd.Arg(0), ".dockerignore"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if excludes, err = archive.ParseExcludes(ignore); err != nil {
+			return fmt.Errorf("Error reading .dockerignore: %s", err)
+		}
+		if context, err = archive.TarWithExcludes(cmd.Arg(0), archive.Uncompressed, excludes, "Dockerfile", ".dockerignore", *dockerfileName); err != nil {
+			return err
+		}
 	}
 	var body io.Reader
 	// Setup an upload progress bar
@@ -220,6 +320,27 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	if *rm {
 		v.Set("rm", "1")
 	}
+	if *squash {
+		v.Set("squash", "1")
+	}
+	for _, name := range cacheImages {
+		v.Add("cachefrom", name)
+	}
+	for _, buildArg := range buildArgs {
+		v.Add("buildarg", buildArg)
+	}
+	if *dockerfileName != "" {
+		v.Set("dockerfile", *dockerfileName)
+	}
+	if *memory != 0 {
+		v.Set("memory", strconv.FormatInt(*memory, 10))
+	}
+	if *memorySwap != 0 {
+		v.Set("memswap", strconv.FormatInt(*memorySwap, 10))
+	}
+	if *cpuShares != 0 {
+		v.Set("cpushares", strconv.FormatInt(*cpuShares, 10))
+	}
 	req, err := http.NewRequest("POST", fmt.Sprintf("/v%g/build?%s", APIVERSION, v.Encode()), body)
 	if err != nil {
 		return err
@@ -368,7 +489,9 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 
 // 'docker wait': block until a container stops
 func (cli *DockerCli) CmdWait(args ...string) error {
-	cmd := Subcmd("wait", "CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
+	cmd := Subcmd("wait", "[OPTIONS] CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
+	timeout := cmd.Int("t", 0, "Number of seconds to wait before giving up (0 waits forever)")
+	condition := cmd.String("condition", WaitNotRunning, "Wait until the container is 'not-running', has exited again ('next-exit') or is 'removed'")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -376,13 +499,34 @@ func (cli *DockerCli) CmdWait(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+
+	v := url.Values{}
+	v.Set("condition", *condition)
+	if *timeout > 0 {
+		v.Set("timeout", strconv.Itoa(*timeout))
+	}
+
+	var timedOut bool
 	for _, name := range cmd.Args() {
-		status, err := waitForExit(cli, name)
+		body, _, err := cli.call("POST", "/containers/"+name+"/wait?"+v.Encode(), nil)
 		if err != nil {
-			fmt.Fprintf(cli.err, "%s", err)
-		} else {
-			fmt.Fprintf(cli.out, "%d\n", status)
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
 		}
+		var out APIWait
+		if err := json.Unmarshal(body, &out); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
+		}
+		if out.TimedOut {
+			fmt.Fprintf(cli.err, "Timed out waiting for %s\n", name)
+			timedOut = true
+			continue
+		}
+		fmt.Fprintf(cli.out, "%d\n", out.StatusCode)
+	}
+	if timedOut {
+		return &utils.StatusError{Status: 1}
 	}
 	return nil
 }
@@ -438,9 +582,34 @@ func (cli *DockerCli) CmdVersion(args ...string) error {
 	return nil
 }
 
+// 'docker initconfig': print the init system file of a container
+func (cli *DockerCli) CmdInitconfig(args ...string) error {
+	cmd := Subcmd("initconfig", "[OPTIONS] CONTAINER", "Generate a systemd unit or upstart job running a container")
+	system := cmd.String("system", "systemd", "Init system of the host: systemd or upstart")
+	restart := cmd.String("restart", InitRestartAlways, "Restart the container: no, on-failure or always")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	v := url.Values{}
+	v.Set("system", *system)
+	v.Set("restart", *restart)
+	body, _, err := cli.call("GET", "/containers/"+cmd.Arg(0)+"/initconfig?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = cli.out.Write(body)
+	return err
+}
+
 // 'docker info': display system-wide information.
 func (cli *DockerCli) CmdInfo(args ...string) error {
-	cmd := Subcmd("info", "", "Display system-wide information")
+	cmd := Subcmd("info", "[OPTIONS]", "Display system-wide information")
+	flFormat, flJSON := formatFlags(cmd)
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -448,6 +617,10 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
 
 	body, _, err := cli.call("GET", "/info", nil)
 	if err != nil {
@@ -458,9 +631,21 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 	if err := json.Unmarshal(body, &out); err != nil {
 		return err
 	}
+	if format != nil {
+		return format.write(cli.out, out)
+	}
 
 	fmt.Fprintf(cli.out, "Containers: %d\n", out.Containers)
 	fmt.Fprintf(cli.out, "Images: %d\n", out.Images)
+	if out.Driver != "" {
+		fmt.Fprintf(cli.out, "Storage Driver: %s\n", out.Driver)
+	}
+	if len(out.RegistryMirrors) > 0 {
+		fmt.Fprintf(cli.out, "Registry Mirrors: %s\n", strings.Join(out.RegistryMirrors, ", "))
+	}
+	if len(out.InsecureRegistries) > 0 {
+		fmt.Fprintf(cli.out, "Insecure Registries: %s\n", strings.Join(out.InsecureRegistries, ", "))
+	}
 	if out.Debug || os.Getenv("DEBUG") != "" {
 		fmt.Fprintf(cli.out, "Debug mode (server): %v\n", out.Debug)
 		fmt.Fprintf(cli.out, "Debug mode (client): %v\n", os.Getenv("DEBUG") != "")
@@ -492,7 +677,7 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 }
 
 func (cli *DockerCli) CmdStop(args ...string) error {
-	cmd := Subcmd("stop", "[OPTIONS] CONTAINER [CONTAINER...]", "Stop a running container (Send SIGTERM, and then SIGKILL after grace period)")
+	cmd := Subcmd("stop", "[OPTIONS] CONTAINER [CONTAINER...]", "Stop a running container (Send its stop signal, SIGTERM by default, and then SIGKILL after grace period)")
 	nSeconds := cmd.Int("t", 10, "Number of seconds to wait for the container to stop before killing it.")
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -546,7 +731,21 @@ func (cli *DockerCli) forwardAllSignals(cid string) chan os.Signal {
 	utils.CatchAll(sigc)
 	go func() {
 		for s := range sigc {
-			if _, _, err := cli.call("POST", fmt.Sprintf("/containers/%s/kill?signal=%d", cid, s), nil); err != nil {
+			// The terminal size is propagated through resize, and the
+			// client's own children, its broken pipes and the preemption
+			// of the Go runtime (SIGURG) are none of the container's
+			// business.
+			if s == syscall.SIGCHLD || s == syscall.SIGWINCH || s == syscall.SIGPIPE || s == syscall.SIGURG {
+				continue
+			}
+			// Send the signal by name: numbers differ between platforms
+			// and the container may not run on the same one as the client.
+			name := utils.SignalName(s)
+			if name == "" {
+				utils.Debugf("Unsupported signal: %s", s)
+				continue
+			}
+			if _, _, err := cli.call("POST", fmt.Sprintf("/containers/%s/kill?signal=%s", cid, name), nil); err != nil {
 				utils.Debugf("Error sending signal: %s", err)
 			}
 		}
@@ -554,6 +753,28 @@ func (cli *DockerCli) forwardAllSignals(cid string) chan os.Signal {
 	return sigc
 }
 
+func (cli *DockerCli) CmdStandby(args ...string) error {
+	cmd := Subcmd("standby", "CONTAINER [CONTAINER...]", "Prepare a stopped container to start without starting it, so that docker start is fast")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	var encounteredError error
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("POST", "/containers/"+name+"/standby", nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			encounteredError = fmt.Errorf("Error: failed to put one or more containers in standby")
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return encounteredError
+}
+
 func (cli *DockerCli) CmdStart(args ...string) error {
 	cmd := Subcmd("start", "CONTAINER [CONTAINER...]", "Restart a stopped container")
 	attach := cmd.Bool("a", false, "Attach container's stdout/stderr and forward all signals to the process")
@@ -720,8 +941,63 @@ func (cli *DockerCli) CmdTop(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdPlugin(args ...string) error {
+	cmd := Subcmd("plugin", "ls [OPTIONS]", "Manage the plugins of the daemon")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "ls":
+		return cli.pluginLs(cmd.Args()[1:]...)
+	default:
+		cmd.Usage()
+		return nil
+	}
+}
+
+func (cli *DockerCli) pluginLs(args ...string) error {
+	cmd := Subcmd("plugin ls", "[OPTIONS]", "List the plugins found by the daemon")
+	flFormat, flJSON := formatFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := cli.call("GET", "/plugins", nil)
+	if err != nil {
+		return err
+	}
+	var outs []APIPlugin
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+	if format != nil {
+		return format.write(cli.out, outs)
+	}
+
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tIMPLEMENTS\tSTATUS")
+	for _, out := range outs {
+		status := "active"
+		if !out.Active {
+			status = "inactive: " + out.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", out.Name, out.Addr, strings.Join(out.Implements, ", "), status)
+	}
+	w.Flush()
+	return nil
+}
+
 func (cli *DockerCli) CmdPort(args ...string) error {
-	cmd := Subcmd("port", "CONTAINER PRIVATE_PORT", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
+	cmd := Subcmd("port", "[OPTIONS] CONTAINER PRIVATE_PORT", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
+	flFormat, flJSON := formatFlags(cmd)
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -729,6 +1005,10 @@ func (cli *DockerCli) CmdPort(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
 
 	port := cmd.Arg(1)
 	proto := "tcp"
@@ -748,10 +1028,20 @@ func (cli *DockerCli) CmdPort(args ...string) error {
 	}
 
 	if frontends, exists := out.NetworkSettings.Ports[Port(port+"/"+proto)]; exists {
+		if format != nil {
+			if frontends == nil {
+				frontends = []PortBinding{}
+			}
+			return format.write(cli.out, frontends)
+		}
 		if frontends == nil {
 			fmt.Fprintf(cli.out, "%s\n", port)
 		} else {
 			for _, frontend := range frontends {
+				if frontend.HostPath != "" {
+					fmt.Fprintf(cli.out, "unix://%s\n", frontend.HostPath)
+					continue
+				}
 				fmt.Fprintf(cli.out, "%s:%s\n", frontend.HostIp, frontend.HostPort)
 			}
 		}
@@ -761,9 +1051,9 @@ func (cli *DockerCli) CmdPort(args ...string) error {
 	return nil
 }
 
-// 'docker rmi IMAGE' removes all images with the name IMAGE
-func (cli *DockerCli) CmdRmi(args ...string) error {
-	cmd := Subcmd("rmi", "IMAGE [IMAGE...]", "Remove one or more images")
+func (cli *DockerCli) CmdUpdate(args ...string) error {
+	cmd := Subcmd("update", "[OPTIONS] CONTAINER [CONTAINER...]", "Update the priority of one or more containers")
+	priority := cmd.Int("priority", 0, "Priority of the container: the highest ones are restarted first and stopped last under memory pressure")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -772,128 +1062,512 @@ func (cli *DockerCli) CmdRmi(args ...string) error {
 		return nil
 	}
 
+	// Only the options given are updated
+	v := url.Values{}
+	cmd.Visit(func(f *flag.Flag) {
+		if f.Name == "priority" {
+			v.Set("priority", strconv.Itoa(*priority))
+		}
+	})
+	if len(v) == 0 {
+		return fmt.Errorf("Error: nothing to update, give -priority")
+	}
+	var encounteredError error
 	for _, name := range cmd.Args() {
-		body, _, err := cli.call("DELETE", "/images/"+name, nil)
-		if err != nil {
-			fmt.Fprintf(cli.err, "%s", err)
+		if _, _, err := cli.call("POST", "/containers/"+name+"/update?"+v.Encode(), nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			encounteredError = fmt.Errorf("Error: failed to update one or more containers")
 		} else {
-			var outs []APIRmi
-			err = json.Unmarshal(body, &outs)
-			if err != nil {
-				return err
-			}
-			for _, out := range outs {
-				if out.Deleted != "" {
-					fmt.Fprintf(cli.out, "Deleted: %s\n", out.Deleted)
-				} else {
-					fmt.Fprintf(cli.out, "Untagged: %s\n", out.Untagged)
-				}
-			}
+			fmt.Fprintf(cli.out, "%s\n", name)
 		}
 	}
-	return nil
+	return encounteredError
 }
 
-func (cli *DockerCli) CmdHistory(args ...string) error {
-	cmd := Subcmd("history", "[OPTIONS] IMAGE", "Show the history of an image")
-	quiet := cmd.Bool("q", false, "only show numeric IDs")
-	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
-
+func (cli *DockerCli) CmdRename(args ...string) error {
+	cmd := Subcmd("rename", "CONTAINER NEW_NAME", "Rename a container, even while it is running")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if cmd.NArg() != 1 {
+	if cmd.NArg() != 2 {
 		cmd.Usage()
 		return nil
 	}
-
-	body, _, err := cli.call("GET", "/images/"+cmd.Arg(0)+"/history", nil)
-	if err != nil {
+	v := url.Values{}
+	v.Set("name", cmd.Arg(1))
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/rename?"+v.Encode(), nil); err != nil {
 		return err
 	}
+	return nil
+}
 
-	var outs []APIHistory
-	err = json.Unmarshal(body, &outs)
-	if err != nil {
-		return err
+func (cli *DockerCli) CmdForward(args ...string) error {
+	cmd := Subcmd("forward", "[OPTIONS] CONTAINER [PRIVATE_PORT[/PROTO]]", "Forward a port on the local interface to a port of a running container, published or not")
+	ttl := cmd.Int("ttl", int(DefaultPortForwardTTL/time.Second), "Number of seconds before the forward expires")
+	list := cmd.Bool("l", false, "List the port forwards of the container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
 	}
-
-	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
-	if !*quiet {
-		fmt.Fprintln(w, "IMAGE\tCREATED\tCREATED BY\tSIZE")
+	if *list {
+		if cmd.NArg() != 1 {
+			cmd.Usage()
+			return nil
+		}
+		body, _, err := cli.call("GET", "/containers/"+cmd.Arg(0)+"/forwards", nil)
+		if err != nil {
+			return err
+		}
+		var forwards []APIPortForward
+		if err := json.Unmarshal(body, &forwards); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(w, "ID\tPORT\tADDRESS\tEXPIRES")
+		for _, forward := range forwards {
+			fmt.Fprintf(w, "%s\t%d/%s\t%s:%d\tin %s\n", forward.ID, forward.PrivatePort, forward.Type, forward.IP, forward.PublicPort, utils.HumanDuration(forward.Expires.Sub(time.Now())))
+		}
+		w.Flush()
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
 	}
 
-	for _, out := range outs {
-		if !*quiet {
-			if *noTrunc {
-				fmt.Fprintf(w, "%s\t", out.ID)
-			} else {
-				fmt.Fprintf(w, "%s\t", utils.TruncateID(out.ID))
-			}
-
-			fmt.Fprintf(w, "%s ago\t", utils.HumanDuration(time.Now().Sub(time.Unix(out.Created, 0))))
-
-			if *noTrunc {
-				fmt.Fprintf(w, "%s\t", out.CreatedBy)
-			} else {
-				fmt.Fprintf(w, "%s\t", utils.Trunc(out.CreatedBy, 45))
-			}
-			fmt.Fprintf(w, "%s\n", utils.HumanSize(out.Size))
-		} else {
-			if *noTrunc {
-				fmt.Fprintln(w, out.ID)
-			} else {
-				fmt.Fprintln(w, utils.TruncateID(out.ID))
-			}
-		}
+	v := url.Values{}
+	v.Set("port", cmd.Arg(1))
+	v.Set("ttl", strconv.Itoa(*ttl))
+	body, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/forward?"+v.Encode(), nil)
+	if err != nil {
+		return err
 	}
-	w.Flush()
+	var forward APIPortForward
+	if err := json.Unmarshal(body, &forward); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\t%s:%d\n", forward.ID, forward.IP, forward.PublicPort)
 	return nil
 }
 
-func (cli *DockerCli) CmdRm(args ...string) error {
-	cmd := Subcmd("rm", "[OPTIONS] CONTAINER [CONTAINER...]", "Remove one or more containers")
-	v := cmd.Bool("v", false, "Remove the volumes associated to the container")
-	link := cmd.Bool("link", false, "Remove the specified link and not the underlying container")
-
+func (cli *DockerCli) CmdUnforward(args ...string) error {
+	cmd := Subcmd("unforward", "CONTAINER FORWARD_ID", "Stop forwarding a local port to a container")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if cmd.NArg() < 1 {
+	if cmd.NArg() != 2 {
 		cmd.Usage()
 		return nil
 	}
-	val := url.Values{}
-	if *v {
-		val.Set("v", "1")
-	}
-	if *link {
-		val.Set("link", "1")
-	}
-	for _, name := range cmd.Args() {
-		_, _, err := cli.call("DELETE", "/containers/"+name+"?"+val.Encode(), nil)
-		if err != nil {
-			fmt.Fprintf(cli.err, "%s\n", err)
-		} else {
-			fmt.Fprintf(cli.out, "%s\n", name)
-		}
+	v := url.Values{}
+	v.Set("id", cmd.Arg(1))
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/unforward?"+v.Encode(), nil); err != nil {
+		return err
 	}
 	return nil
 }
 
-// 'docker kill NAME' kills a running container
-func (cli *DockerCli) CmdKill(args ...string) error {
-	cmd := Subcmd("kill", "CONTAINER [CONTAINER...]", "Kill a running container (send SIGKILL)")
+func (cli *DockerCli) CmdMirror(args ...string) error {
+	cmd := Subcmd("mirror", "CONTAINER TARGET", "Mirror the traffic of a running container to another container or a host interface")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if cmd.NArg() < 1 {
+	if cmd.NArg() != 2 {
 		cmd.Usage()
 		return nil
 	}
-
-	for _, name := range args {
-		_, _, err := cli.call("POST", "/containers/"+name+"/kill", nil)
+	v := url.Values{}
+	v.Set("target", cmd.Arg(1))
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/mirror?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdUnmirror(args ...string) error {
+	cmd := Subcmd("unmirror", "CONTAINER", "Stop mirroring the traffic of a running container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/unmirror", nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdConnect(args ...string) error {
+	cmd := Subcmd("connect", "CONTAINER BRIDGE[:NAME]", "Connect a running container to another bridge, with an additional interface")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	bridge, iface, err := parseNetworkAttach(cmd.Arg(1))
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Set("bridge", bridge)
+	if iface != "" {
+		v.Set("iface", iface)
+	}
+	body, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/connect?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var settings InterfaceSettings
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s %s/%d\n", settings.Name, settings.IPAddress, settings.IPPrefixLen)
+	return nil
+}
+
+func (cli *DockerCli) CmdDisconnect(args ...string) error {
+	cmd := Subcmd("disconnect", "CONTAINER NAME", "Remove the interface NAME, on another bridge, from a running container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("iface", cmd.Arg(1))
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/disconnect?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdNetwork(args ...string) error {
+	cmd := Subcmd("network", "[OPTIONS] BRIDGE", "List the interfaces of the running containers on BRIDGE, with their published ports")
+	quiet := cmd.Bool("q", false, "Only display numeric IDs")
+	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	body, _, err := cli.call("GET", "/networks/"+cmd.Arg(0)+"/containers", nil)
+	if err != nil {
+		return err
+	}
+	var outs []APINetworkContainer
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(w, "CONTAINER ID\tINTERFACE\tIP ADDRESS\tPORTS\tNAMES")
+	}
+	for _, out := range outs {
+		if !*noTrunc {
+			out.ID = utils.TruncateID(out.ID)
+		}
+		if *quiet {
+			fmt.Fprintln(w, out.ID)
+			continue
+		}
+		for i := 0; i < len(out.Names); i++ {
+			out.Names[i] = out.Names[i][1:]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/%d\t%s\t%s\n", out.ID, out.Interface, out.IPAddress, out.IPPrefixLen, displayablePorts(out.Ports), strings.Join(out.Names, ","))
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) CmdNamespaces(args ...string) error {
+	cmd := Subcmd("namespaces", "[OPTIONS] CONTAINER", "Show the namespace files and the cgroups of a running container, to enter it with nsenter")
+	flFormat, flJSON := formatFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := cli.call("GET", "/containers/"+cmd.Arg(0)+"/namespaces", nil)
+	if err != nil {
+		return err
+	}
+	var out APINamespaces
+	if err := json.Unmarshal(body, &out); err != nil {
+		return err
+	}
+	if format != nil {
+		return format.write(cli.out, out)
+	}
+
+	var kinds, subsystems []string
+	for kind := range out.Namespaces {
+		kinds = append(kinds, kind)
+	}
+	for subsystem := range out.Cgroups {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(kinds)
+	sort.Strings(subsystems)
+
+	fmt.Fprintf(cli.out, "Pid: %d\n", out.Pid)
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tPATH\tINODE")
+	for _, kind := range kinds {
+		ns := out.Namespaces[kind]
+		fmt.Fprintf(w, "namespace\t%s\t%s\t%s\n", kind, ns.Path, ns.Inode)
+	}
+	for _, subsystem := range subsystems {
+		fmt.Fprintf(w, "cgroup\t%s\t%s\t\n", subsystem, out.Cgroups[subsystem])
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) CmdSwap(args ...string) error {
+	cmd := Subcmd("swap", "[OPTIONS] CONTAINER IMAGE", "Start a copy of a running container from IMAGE, and once it is healthy, move the published ports and the name of the container to it and stop the container")
+	nSeconds := cmd.Int("t", int(DefaultSwapTimeout/time.Second), "Number of seconds the copy has to become healthy")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+
+	v := url.Values{}
+	v.Set("image", cmd.Arg(1))
+	v.Set("t", strconv.Itoa(*nSeconds))
+	body, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/swap?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var out APIRun
+	if err := json.Unmarshal(body, &out); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.out, out.ID)
+	return nil
+}
+
+func (cli *DockerCli) CmdPublish(args ...string) error {
+	cmd := Subcmd("publish", "CONTAINER [[IP:]PUBLIC_PORT:]PRIVATE_PORT[/PROTO]", "Publish a port of a running container, without restarting it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	return cli.publish("publish", cmd.Arg(0), cmd.Arg(1))
+}
+
+func (cli *DockerCli) CmdUnpublish(args ...string) error {
+	cmd := Subcmd("unpublish", "CONTAINER [[IP:]PUBLIC_PORT:]PRIVATE_PORT[/PROTO]", "Remove the matching published ports from a running container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	return cli.publish("unpublish", cmd.Arg(0), cmd.Arg(1))
+}
+
+func (cli *DockerCli) publish(action, name, port string) error {
+	v := url.Values{}
+	v.Set("port", port)
+	body, _, err := cli.call("POST", "/containers/"+name+"/"+action+"?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var ports []APIPort
+	if err := json.Unmarshal(body, &ports); err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if p.Path != "" {
+			fmt.Fprintf(cli.out, "unix://%s\n", p.Path)
+			continue
+		}
+		fmt.Fprintf(cli.out, "%s:%d\n", p.IP, p.PublicPort)
+	}
+	return nil
+}
+
+// 'docker rmi IMAGE' removes all images with the name IMAGE
+func (cli *DockerCli) CmdRmi(args ...string) error {
+	cmd := Subcmd("rmi", "IMAGE [IMAGE...]", "Remove one or more images")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	for _, name := range cmd.Args() {
+		body, _, err := cli.call("DELETE", "/images/"+name, nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s", err)
+		} else {
+			var outs []APIRmi
+			err = json.Unmarshal(body, &outs)
+			if err != nil {
+				return err
+			}
+			for _, out := range outs {
+				if out.Deleted != "" {
+					fmt.Fprintf(cli.out, "Deleted: %s\n", out.Deleted)
+				} else {
+					fmt.Fprintf(cli.out, "Untagged: %s\n", out.Untagged)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdHistory(args ...string) error {
+	cmd := Subcmd("history", "[OPTIONS] IMAGE", "Show the history of an image")
+	quiet := cmd.Bool("q", false, "only show numeric IDs")
+	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
+
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	body, _, err := cli.call("GET", "/images/"+cmd.Arg(0)+"/history", nil)
+	if err != nil {
+		return err
+	}
+
+	var outs []APIHistory
+	err = json.Unmarshal(body, &outs)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\tVIRTUAL SIZE")
+	}
+
+	for _, out := range outs {
+		if !*quiet {
+			if *noTrunc {
+				fmt.Fprintf(w, "%s\t", out.ID)
+			} else {
+				fmt.Fprintf(w, "%s\t", utils.TruncateID(out.ID))
+			}
+
+			fmt.Fprintf(w, "%s ago\t", utils.HumanDuration(time.Now().Sub(time.Unix(out.Created, 0))))
+
+			if *noTrunc {
+				fmt.Fprintf(w, "%s\t", out.CreatedBy)
+			} else {
+				fmt.Fprintf(w, "%s\t", utils.Trunc(out.CreatedBy, 45))
+			}
+			fmt.Fprintf(w, "%s\t%s\n", utils.HumanSize(out.Size), utils.HumanSize(out.VirtualSize))
+		} else {
+			if *noTrunc {
+				fmt.Fprintln(w, out.ID)
+			} else {
+				fmt.Fprintln(w, utils.TruncateID(out.ID))
+			}
+		}
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) CmdRm(args ...string) error {
+	cmd := Subcmd("rm", "[OPTIONS] CONTAINER [CONTAINER...]", "Remove one or more containers")
+	v := cmd.Bool("v", false, "Remove the volumes associated to the container")
+	link := cmd.Bool("link", false, "Remove the specified link and not the underlying container")
+	async := cmd.Bool("d", false, "Detached mode: remove the containers in the background, see their progress with docker ps -a")
+	cancel := cmd.Bool("cancel", false, "Cancel the removals in the background of the containers")
+
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	val := url.Values{}
+	if *v {
+		val.Set("v", "1")
+	}
+	if *link {
+		val.Set("link", "1")
+	}
+	if *async {
+		val.Set("async", "1")
+	}
+	if *cancel {
+		val.Set("cancel", "1")
+	}
+	// Show the progress of the removals, which Ctrl-C cancels
+	if cli.isTerminal && !*link && !*async && !*cancel {
+		val.Set("progress", "1")
+	}
+	for _, name := range cmd.Args() {
+		var err error
+		if val.Get("progress") != "" {
+			err = cli.stream("DELETE", "/containers/"+name+"?"+val.Encode(), nil, cli.err, nil)
+		} else {
+			_, _, err = cli.call("DELETE", "/containers/"+name+"?"+val.Encode(), nil)
+		}
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+// 'docker kill NAME' kills a running container
+func (cli *DockerCli) CmdKill(args ...string) error {
+	cmd := Subcmd("kill", "[OPTIONS] CONTAINER [CONTAINER...]", "Kill a running container (send SIGKILL, or specified signal)")
+	signal := cmd.String("s", "", "Signal to send to the container, by name (e.g. TERM) or number")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	path := "/kill"
+	if *signal != "" {
+		if _, err := utils.ParseSignal(*signal); err != nil {
+			return err
+		}
+		path += "?signal=" + url.QueryEscape(*signal)
+	}
+
+	for _, name := range cmd.Args() {
+		_, _, err := cli.call("POST", "/containers/"+name+path, nil)
 		if err != nil {
 			fmt.Fprintf(cli.err, "%s\n", err)
 		} else {
@@ -905,6 +1579,8 @@ func (cli *DockerCli) CmdKill(args ...string) error {
 
 func (cli *DockerCli) CmdImport(args ...string) error {
 	cmd := Subcmd("import", "URL|- [REPOSITORY[:TAG]]", "Create a new filesystem image from the contents of a tarball(.tar, .tar.gz, .tgz, .bzip, .tar.xz, .txz).")
+	flKey := cmd.String("key", "", "Decrypt the tarball, encrypted by docker export -key, with the key in this file")
+	flChecksum := cmd.String("checksum", "", "Check the tarball against this checksum, sha256:hex, before creating the image")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -927,18 +1603,34 @@ func (cli *DockerCli) CmdImport(args ...string) error {
 	v.Set("repo", repository)
 	v.Set("tag", tag)
 	v.Set("fromSrc", src)
+	if *flChecksum != "" {
+		v.Set("checksum", *flChecksum)
+	}
 
 	var in io.Reader
 
 	if src == "-" {
 		in = cli.in
 	}
+	if *flKey != "" {
+		if src != "-" {
+			return fmt.Errorf("Bad parameter key: the encrypted tarball must be read from stdin, with -")
+		}
+		key, err := readEncryptionKey(*flKey)
+		if err != nil {
+			return err
+		}
+		if in, err = archive.NewDecrypter(cli.in, key); err != nil {
+			return err
+		}
+	}
 
 	return cli.stream("POST", "/images/create?"+v.Encode(), in, cli.out, nil)
 }
 
 func (cli *DockerCli) CmdPush(args ...string) error {
-	cmd := Subcmd("push", "NAME", "Push an image or a repository to the registry")
+	cmd := Subcmd("push", "[OPTIONS] NAME", "Push an image or a repository to the registry")
+	flCompression := cmd.String("compression", "", "Compress the layers with none, gzip, bzip2 or xz, and an optional level from 1 to 9, e.g. xz:6 (default gzip)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -971,6 +1663,12 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 	}
 
 	v := url.Values{}
+	if *flCompression != "" {
+		if _, err := archive.ParseEncoding(*flCompression); err != nil {
+			return err
+		}
+		v.Set("compression", *flCompression)
+	}
 	push := func(authConfig auth.AuthConfig) error {
 		buf, err := json.Marshal(authConfig)
 		if err != nil {
@@ -1000,7 +1698,7 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 }
 
 func (cli *DockerCli) CmdPull(args ...string) error {
-	cmd := Subcmd("pull", "NAME", "Pull an image or a repository from the registry")
+	cmd := Subcmd("pull", "NAME[:TAG|@DIGEST]", "Pull an image or a repository from the registry")
 	tag := cmd.String("t", "", "Download tagged image in repository")
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -1015,9 +1713,10 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 	if *tag == "" {
 		*tag = parsedTag
 	}
+	repos, _ := utils.ParseRepositoryDigest(remote)
 
 	// Resolve the Repository name from fqn to endpoint + name
-	endpoint, _, err := registry.ResolveRepositoryName(remote)
+	endpoint, _, err := registry.ResolveRepositoryName(repos)
 	if err != nil {
 		return err
 	}
@@ -1066,6 +1765,9 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
 	flViz := cmd.Bool("viz", false, "output graph in graphviz format")
 	flTree := cmd.Bool("tree", false, "output graph in tree format")
+	flFormat, flJSON := formatFlags(cmd)
+	var filters utils.ListOpts
+	cmd.Var(&filters, "filter", "Show only the images matching the filter (e.g. label=com.example.team=web)")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -1074,6 +1776,16 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
+	if format != nil && (*flViz || *flTree) {
+		return fmt.Errorf("-format and -json can't be used with -viz or -tree")
+	}
+	if len(filters) > 0 && (*flViz || *flTree) {
+		return fmt.Errorf("-filter can't be used with -viz or -tree")
+	}
 
 	if *flViz {
 		body, _, err := cli.call("GET", "/images/json?all=1", nil)
@@ -1152,6 +1864,9 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 		if cmd.NArg() == 1 {
 			v.Set("filter", cmd.Arg(0))
 		}
+		for _, filter := range filters {
+			v.Add("filter", filter)
+		}
 		if *all {
 			v.Set("all", "1")
 		}
@@ -1166,6 +1881,9 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 		if err != nil {
 			return err
 		}
+		if format != nil {
+			return format.write(cli.out, outs)
+		}
 
 		w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
 		if !*quiet {
@@ -1250,7 +1968,9 @@ func PrintTreeNode(cli *DockerCli, noTrunc *bool, image APIImages, prefix string
 func displayablePorts(ports []APIPort) string {
 	result := []string{}
 	for _, port := range ports {
-		if port.IP == "" {
+		if port.Path != "" {
+			result = append(result, fmt.Sprintf("unix://%s->%d/%s", port.Path, port.PrivatePort, port.Type))
+		} else if port.IP == "" {
 			result = append(result, fmt.Sprintf("%d/%s", port.PublicPort, port.Type))
 		} else {
 			result = append(result, fmt.Sprintf("%s:%d->%d/%s", port.IP, port.PublicPort, port.PrivatePort, port.Type))
@@ -1270,11 +1990,21 @@ func (cli *DockerCli) CmdPs(args ...string) error {
 	since := cmd.String("sinceId", "", "Show only containers created since Id, include non-running ones.")
 	before := cmd.String("beforeId", "", "Show only container created before Id, include non-running ones.")
 	last := cmd.Int("n", -1, "Show n last created containers, include non-running ones.")
+	var filters utils.ListOpts
+	cmd.Var(&filters, "filter", "Show only the containers matching the filter (e.g. label=com.example.role=db)")
+	flFormat, flJSON := formatFlags(cmd)
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
 	v := url.Values{}
+	for _, filter := range filters {
+		v.Add("filter", filter)
+	}
 	if *last == -1 && *nLatest {
 		*last = 1
 	}
@@ -1304,6 +2034,9 @@ func (cli *DockerCli) CmdPs(args ...string) error {
 	if err != nil {
 		return err
 	}
+	if format != nil {
+		return format.write(cli.out, outs)
+	}
 	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
 	if !*quiet {
 		fmt.Fprint(w, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tPORTS\tNAMES")
@@ -1354,6 +2087,10 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 	flComment := cmd.String("m", "", "Commit message")
 	flAuthor := cmd.String("author", "", "Author (eg. \"John Hannibal Smith <hannibal@a-team.com>\"")
 	flConfig := cmd.String("run", "", "Config automatically applied when the image is run. "+`(ex: {"Cmd": ["cat", "/world"], "PortSpecs": ["22"]}')`)
+	flPause := cmd.Bool("pause", true, "Freeze a running container while its changes are copied")
+	flSquash := cmd.Bool("squash", false, "Squash the changes and the layers of the image of the container into a single layer on top of its base image")
+	var flLabels utils.ListOpts
+	cmd.Var(&flLabels, "label", "Set a label on the image, besides the ones of the container (e.g. -label com.example.version=1.2)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1379,6 +2116,12 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 	v.Set("tag", tag)
 	v.Set("comment", *flComment)
 	v.Set("author", *flAuthor)
+	if !*flPause {
+		v.Set("pause", "0")
+	}
+	if *flSquash {
+		v.Set("squash", "1")
+	}
 	var config *Config
 	if *flConfig != "" {
 		config = &Config{}
@@ -1386,69 +2129,285 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 			return err
 		}
 	}
-	body, _, err := cli.call("POST", "/commit?"+v.Encode(), config)
-	if err != nil {
-		return err
+	if len(flLabels) > 0 {
+		labels, err := parseLabels(flLabels)
+		if err != nil {
+			return err
+		}
+		if config == nil {
+			config = &Config{}
+		}
+		config.Labels = mergeLabels(config.Labels, labels)
+	}
+	body, _, err := cli.call("POST", "/commit?"+v.Encode(), config)
+	if err != nil {
+		return err
+	}
+
+	apiID := &APIID{}
+	err = json.Unmarshal(body, apiID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "%s\n", apiID.ID)
+	return nil
+}
+
+func (cli *DockerCli) CmdEvents(args ...string) error {
+	cmd := Subcmd("events", "[OPTIONS]", "Get real time events from the server")
+	since := cmd.String("since", "", "Show previously created events and then stream.")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+
+	v := url.Values{}
+	if *since != "" {
+		loc := time.FixedZone(time.Now().Zone())
+		format := "2006-01-02 15:04:05 -0700 MST"
+		if len(*since) < len(format) {
+			format = format[:len(*since)]
+		}
+
+		if t, err := time.ParseInLocation(format, *since, loc); err == nil {
+			v.Set("since", strconv.FormatInt(t.Unix(), 10))
+		} else {
+			v.Set("since", *since)
+		}
+	}
+
+	if err := cli.stream("GET", "/events?"+v.Encode(), nil, cli.out, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdExport(args ...string) error {
+	cmd := Subcmd("export", "CONTAINER", "Export the contents of a filesystem as a tar archive")
+	flKey := cmd.String("key", "", "Encrypt the tar archive with AES-256-GCM and the key in this file, 64 hexadecimal digits")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	if *flKey == "" {
+		return cli.stream("GET", "/containers/"+cmd.Arg(0)+"/export", nil, cli.out, nil)
+	}
+	key, err := readEncryptionKey(*flKey)
+	if err != nil {
+		return err
+	}
+	// The archive is encrypted before it leaves the client
+	encrypter, err := archive.NewEncrypter(cli.out, key)
+	if err != nil {
+		return err
+	}
+	if err := cli.stream("GET", "/containers/"+cmd.Arg(0)+"/export", nil, encrypter, nil); err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
+func (cli *DockerCli) CmdFsck(args ...string) error {
+	cmd := Subcmd("fsck", "[OPTIONS]", "Check the integrity of the images, their layers and their tags, after an unclean shutdown")
+	flRepair := cmd.Bool("repair", false, "Remove the corrupt images, with their children, the orphan layers and the tags of the missing images")
+	flFormat, flJSON := formatFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	if *flRepair {
+		v.Set("repair", "1")
+	}
+	body, _, err := cli.call("POST", "/graph/check?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var outs []APIGraphProblem
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+	if format != nil {
+		return format.write(cli.out, outs)
+	}
+	if len(outs) == 0 {
+		fmt.Fprintln(cli.out, "No problem found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tPROBLEM\tREPAIRED")
+	for _, out := range outs {
+		name := out.Name
+		if out.Type == "image" {
+			name = utils.TruncateID(name)
+		}
+		repaired := "no"
+		if out.Repaired {
+			repaired = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", out.Type, name, out.Problem, repaired)
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) CmdMigrate(args ...string) error {
+	cmd := Subcmd("migrate", "DRIVER", "Move the filesystems of the stopped containers to the storage driver DRIVER")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("driver", cmd.Arg(0))
+	return cli.stream("POST", "/storage/migrate?"+v.Encode(), nil, cli.out, nil)
+}
+
+func (cli *DockerCli) CmdPrune(args ...string) error {
+	cmd := Subcmd("prune", "[OPTIONS]", "Remove the images neither tagged nor used by a container, nor the ancestor of one")
+	flDryRun := cmd.Bool("dry-run", false, "Only list the images which would be removed")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
 	}
 
-	apiID := &APIID{}
-	err = json.Unmarshal(body, apiID)
+	v := url.Values{}
+	if *flDryRun {
+		v.Set("dryrun", "1")
+	}
+	body, _, err := cli.call("POST", "/images/prune?"+v.Encode(), nil)
 	if err != nil {
 		return err
 	}
-
-	fmt.Fprintf(cli.out, "%s\n", apiID.ID)
+	var out APIPrune
+	if err := json.Unmarshal(body, &out); err != nil {
+		return err
+	}
+	action := "Deleted"
+	if *flDryRun {
+		action = "Would delete"
+	}
+	for _, id := range out.Deleted {
+		fmt.Fprintf(cli.out, "%s: %s\n", action, utils.TruncateID(id))
+	}
+	fmt.Fprintf(cli.out, "Total reclaimed space: %s\n", utils.HumanSize(out.SpaceReclaimed))
 	return nil
 }
 
-func (cli *DockerCli) CmdEvents(args ...string) error {
-	cmd := Subcmd("events", "[OPTIONS]", "Get real time events from the server")
-	since := cmd.String("since", "", "Show previously created events and then stream.")
+func (cli *DockerCli) CmdSave(args ...string) error {
+	cmd := Subcmd("save", "[OPTIONS] IMAGE [IMAGE...]", "Save images, their layers and tags to a tar archive, on stdout by default")
+	flOutput := cmd.String("o", "", "Write the archive to this file instead of stdout")
+	flKey := cmd.String("key", "", "Encrypt the tar archive with AES-256-GCM and the key in this file, 64 hexadecimal digits")
+	flCompression := cmd.String("compression", "", "Compress the layers with none, gzip, bzip2 or xz, and an optional level from 1 to 9, e.g. xz:6 (default none)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-
-	if cmd.NArg() != 0 {
+	if cmd.NArg() < 1 {
 		cmd.Usage()
 		return nil
 	}
 
 	v := url.Values{}
-	if *since != "" {
-		loc := time.FixedZone(time.Now().Zone())
-		format := "2006-01-02 15:04:05 -0700 MST"
-		if len(*since) < len(format) {
-			format = format[:len(*since)]
+	for _, name := range cmd.Args() {
+		v.Add("names", name)
+	}
+	if *flCompression != "" {
+		if _, err := archive.ParseEncoding(*flCompression); err != nil {
+			return err
 		}
-
-		if t, err := time.ParseInLocation(format, *since, loc); err == nil {
-			v.Set("since", strconv.FormatInt(t.Unix(), 10))
-		} else {
-			v.Set("since", *since)
+		v.Set("compression", *flCompression)
+	}
+	var out io.Writer = cli.out
+	if *flOutput != "" {
+		f, err := os.Create(*flOutput)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		out = f
 	}
-
-	if err := cli.stream("GET", "/events?"+v.Encode(), nil, cli.out, nil); err != nil {
+	if *flKey == "" {
+		return cli.stream("GET", "/images/get?"+v.Encode(), nil, out, nil)
+	}
+	key, err := readEncryptionKey(*flKey)
+	if err != nil {
 		return err
 	}
-	return nil
+	encrypter, err := archive.NewEncrypter(out, key)
+	if err != nil {
+		return err
+	}
+	if err := cli.stream("GET", "/images/get?"+v.Encode(), nil, encrypter, nil); err != nil {
+		return err
+	}
+	return encrypter.Close()
 }
 
-func (cli *DockerCli) CmdExport(args ...string) error {
-	cmd := Subcmd("export", "CONTAINER", "Export the contents of a filesystem as a tar archive")
+func (cli *DockerCli) CmdLoad(args ...string) error {
+	cmd := Subcmd("load", "[OPTIONS]", "Load images and their tags from a tar archive made by docker save, on stdin by default")
+	flInput := cmd.String("i", "", "Read the archive from this file instead of stdin")
+	flKey := cmd.String("key", "", "Decrypt the tar archive with AES-256-GCM and the key in this file, 64 hexadecimal digits")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-
-	if cmd.NArg() != 1 {
+	if cmd.NArg() != 0 {
 		cmd.Usage()
 		return nil
 	}
 
-	if err := cli.stream("GET", "/containers/"+cmd.Arg(0)+"/export", nil, cli.out, nil); err != nil {
-		return err
+	var in io.Reader = cli.in
+	if *flInput != "" {
+		f, err := os.Open(*flInput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
 	}
-	return nil
+	if *flKey != "" {
+		key, err := readEncryptionKey(*flKey)
+		if err != nil {
+			return err
+		}
+		if in, err = archive.NewDecrypter(in, key); err != nil {
+			return err
+		}
+	}
+	return cli.stream("POST", "/images/load", in, cli.out, nil)
+}
+
+// readEncryptionKey returns the key of the encrypted archives in the file
+// keyFile
+func readEncryptionKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return archive.ParseEncryptionKey(data)
 }
 
 func (cli *DockerCli) CmdDiff(args ...string) error {
@@ -1478,7 +2437,10 @@ func (cli *DockerCli) CmdDiff(args ...string) error {
 }
 
 func (cli *DockerCli) CmdLogs(args ...string) error {
-	cmd := Subcmd("logs", "CONTAINER", "Fetch the logs of a container")
+	cmd := Subcmd("logs", "[OPTIONS] CONTAINER", "Fetch the logs of a container")
+	since := cmd.Int64("since", 0, "Only show logs captured after this unix timestamp")
+	tail := cmd.String("tail", "all", "Output the specified number of lines at the end of logs")
+	timestamps := cmd.Bool("t", false, "Show timestamps")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1498,10 +2460,34 @@ func (cli *DockerCli) CmdLogs(args ...string) error {
 		return err
 	}
 
-	if err := cli.hijack("POST", "/containers/"+name+"/attach?logs=1&stdout=1&stderr=1", container.Config.Tty, nil, cli.out, cli.err, nil); err != nil {
+	v := url.Values{}
+	v.Set("stdout", "1")
+	v.Set("stderr", "1")
+	v.Set("tail", *tail)
+	if *since > 0 {
+		v.Set("since", strconv.FormatInt(*since, 10))
+	}
+	if *timestamps {
+		v.Set("timestamps", "1")
+	}
+
+	if container.Config.Tty {
+		return cli.stream("GET", "/containers/"+name+"/logs?"+v.Encode(), nil, cli.out, nil)
+	}
+
+	r, w := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := utils.StdCopy(cli.out, cli.err, r)
+		r.CloseWithError(err)
+		errc <- err
+	}()
+	err = cli.stream("GET", "/containers/"+name+"/logs?"+v.Encode(), nil, w, nil)
+	w.CloseWithError(err)
+	if err != nil {
 		return err
 	}
-	return nil
+	return <-errc
 }
 
 func (cli *DockerCli) CmdAttach(args ...string) error {
@@ -1559,6 +2545,28 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdSelfUpgrade(args ...string) error {
+	cmd := Subcmd("self-upgrade", "[OPTIONS]", "Upgrade the daemon to a signed release, keeping its containers running")
+	flURL := cmd.String("url", "", "URL of the release, instead of the -upgrade-url of the daemon")
+	flForce := cmd.Bool("f", false, "Install the release even if it is not newer than the daemon")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+
+	v := url.Values{}
+	if *flURL != "" {
+		v.Set("url", *flURL)
+	}
+	if *flForce {
+		v.Set("force", "1")
+	}
+	return cli.stream("POST", "/upgrade?"+v.Encode(), nil, cli.out, nil)
+}
+
 func (cli *DockerCli) CmdSearch(args ...string) error {
 	cmd := Subcmd("search", "TERM", "Search the docker index for images")
 	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
@@ -1671,6 +2679,157 @@ func (opts PathOpts) Set(val string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdSign(args ...string) error {
+	cmd := Subcmd("sign", "-key FILE IMAGE", "Sign an image with a private key, so that the daemons trusting the key pull and run it")
+	keyFile := cmd.String("key", "", "PEM file of the RSA or ECDSA private key")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 || *keyFile == "" {
+		cmd.Usage()
+		return nil
+	}
+	key, err := ReadPrivateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := cli.call("GET", "/images/"+cmd.Arg(0)+"/json", nil)
+	if err != nil {
+		return err
+	}
+	img := &Image{}
+	if err := json.Unmarshal(body, img); err != nil {
+		return err
+	}
+	// The key stays on the client, only the signature is sent
+	sig, err := SignImageID(img.ID, key)
+	if err != nil {
+		return err
+	}
+	if _, _, err := cli.call("POST", "/images/"+cmd.Arg(0)+"/sign", sig); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", img.ID)
+	return nil
+}
+
+func (cli *DockerCli) CmdSystem(args ...string) error {
+	cmd := Subcmd("system", "df [OPTIONS]", "Show the disk usage of the daemon")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "df":
+		return cli.systemDf(cmd.Args()[1:]...)
+	default:
+		cmd.Usage()
+		return nil
+	}
+}
+
+func (cli *DockerCli) systemDf(args ...string) error {
+	cmd := Subcmd("system df", "[OPTIONS]", "Show the space the images, the containers and the volumes take on disk")
+	verbose := cmd.Bool("v", false, "Show the space each image, container and volume takes")
+	flFormat, flJSON := formatFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newOutputFormat(*flFormat, *flJSON)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := cli.call("GET", "/system/df", nil)
+	if err != nil {
+		return err
+	}
+	usage := &APIDiskUsage{}
+	if err := json.Unmarshal(body, usage); err != nil {
+		return err
+	}
+	if format != nil {
+		return format.write(cli.out, usage)
+	}
+
+	var activeImages, runningContainers, activeVolumes int
+	var containersSize, containersReclaimable, volumesSize, volumesReclaimable int64
+	for _, image := range usage.Images {
+		if image.Containers > 0 {
+			activeImages++
+		}
+	}
+	for _, container := range usage.Containers {
+		containersSize += container.SizeRw
+		if container.Running {
+			runningContainers++
+		} else {
+			containersReclaimable += container.SizeRw
+		}
+	}
+	for _, volume := range usage.Volumes {
+		volumesSize += volume.Size
+		if volume.Containers > 0 {
+			activeVolumes++
+		} else {
+			volumesReclaimable += volume.Size
+		}
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE")
+	fmt.Fprintf(w, "Images\t%d\t%d\t%s\t%s\n", len(usage.Images), activeImages, utils.HumanSize(usage.LayersSize), utils.HumanSize(usage.LayersReclaimable))
+	fmt.Fprintf(w, "Containers\t%d\t%d\t%s\t%s\n", len(usage.Containers), runningContainers, utils.HumanSize(containersSize), utils.HumanSize(containersReclaimable))
+	fmt.Fprintf(w, "Volumes\t%d\t%d\t%s\t%s\n", len(usage.Volumes), activeVolumes, utils.HumanSize(volumesSize), utils.HumanSize(volumesReclaimable))
+	w.Flush()
+	if !*verbose {
+		return nil
+	}
+
+	fmt.Fprintln(cli.out, "\nImages:")
+	w = tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\tSHARED SIZE\tUNIQUE SIZE\tCONTAINERS")
+	for _, image := range usage.Images {
+		repoTags := image.RepoTags
+		if len(repoTags) == 0 {
+			repoTags = []string{"<none>:<none>"}
+		}
+		for _, repoTag := range repoTags {
+			repo, tag := utils.ParseRepositoryTag(repoTag)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\t%s\t%s\t%d\n", repo, tag, utils.TruncateID(image.ID), utils.HumanDuration(time.Now().Sub(time.Unix(image.Created, 0))), utils.HumanSize(image.Size), utils.HumanSize(image.SharedSize), utils.HumanSize(image.UniqueSize), image.Containers)
+		}
+	}
+	w.Flush()
+
+	fmt.Fprintln(cli.out, "\nContainers:")
+	w = tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tSIZE\tSTATUS\tNAMES")
+	for _, container := range usage.Containers {
+		status := "stopped"
+		if container.Running {
+			status = "running"
+		}
+		var names []string
+		for _, name := range container.Names {
+			names = append(names, strings.TrimPrefix(name, "/"))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", utils.TruncateID(container.ID), container.Image, utils.HumanSize(container.SizeRw), status, strings.Join(names, ","))
+	}
+	w.Flush()
+
+	fmt.Fprintln(cli.out, "\nVolumes:")
+	w = tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "VOLUME ID\tCONTAINERS\tSIZE")
+	for _, volume := range usage.Volumes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", utils.TruncateID(volume.ID), volume.Containers, utils.HumanSize(volume.Size))
+	}
+	w.Flush()
+	return nil
+}
+
 func (cli *DockerCli) CmdTag(args ...string) error {
 	cmd := Subcmd("tag", "[OPTIONS] IMAGE REPOSITORY[:TAG]", "Tag an image into a repository")
 	force := cmd.Bool("f", false, "Force")
@@ -1747,15 +2906,19 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 	//if image not found try to pull it
 	if statusCode == 404 {
 		_, tag := utils.ParseRepositoryTag(config.Image)
-		if tag == "" {
-			tag = DEFAULTTAG
+		repos, digest := utils.ParseRepositoryDigest(config.Image)
+		if digest != "" {
+			fmt.Fprintf(cli.err, "Unable to find image '%s' locally\n", config.Image)
+		} else {
+			if tag == "" {
+				tag = DEFAULTTAG
+			}
+			fmt.Fprintf(cli.err, "Unable to find image '%s' (tag: %s) locally\n", config.Image, tag)
 		}
 
-		fmt.Fprintf(cli.err, "Unable to find image '%s' (tag: %s) locally\n", config.Image, tag)
-
 		v := url.Values{}
-		repos, tag := utils.ParseRepositoryTag(config.Image)
-		v.Set("fromImage", repos)
+		remote, tag := utils.ParseRepositoryTag(config.Image)
+		v.Set("fromImage", remote)
 		v.Set("tag", tag)
 
 		// Resolve the Repository name from fqn to endpoint + name
@@ -1808,6 +2971,28 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		}
 	}
 
+	// The daemon removes the container as soon as it exits: wait for that
+	// before starting it, to get its exit status before it is gone
+	var (
+		removed       chan error
+		removedStatus int
+	)
+	if autoRemove {
+		body, err := cli.callHeaders("POST", "/containers/"+runResult.ID+"/wait?condition="+WaitRemoved)
+		if err != nil {
+			return err
+		}
+		removed = utils.Go(func() error {
+			defer body.Close()
+			var out APIWait
+			if err := json.NewDecoder(body).Decode(&out); err != nil {
+				return err
+			}
+			removedStatus = out.StatusCode
+			return nil
+		})
+	}
+
 	if sigProxy {
 		sigc := cli.forwardAllSignals(runResult.ID)
 		defer utils.StopCatch(sigc)
@@ -1892,19 +3077,18 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		// Detached mode
 		<-wait
 	} else {
-		running, status, err := getExitCode(cli, runResult.ID)
-		if err != nil {
-			return err
-		}
+		var status int
 		if autoRemove {
-			if running {
-				return fmt.Errorf("Impossible to auto-remove a detached container")
+			if running, _, err := getExitCode(cli, runResult.ID); err == nil && running {
+				// Detached from the container, the daemon removes it once it exits
+				return nil
 			}
-			// Wait for the process to
-			if _, _, err := cli.call("POST", "/containers/"+runResult.ID+"/wait", nil); err != nil {
+			if err := <-removed; err != nil {
 				return err
 			}
-			if _, _, err := cli.call("DELETE", "/containers/"+runResult.ID, nil); err != nil {
+			status = removedStatus
+		} else {
+			if _, status, err = getExitCode(cli, runResult.ID); err != nil {
 				return err
 			}
 		}
@@ -1917,7 +3101,9 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 }
 
 func (cli *DockerCli) CmdCp(args ...string) error {
-	cmd := Subcmd("cp", "CONTAINER:RESOURCE HOSTPATH", "Copy files/folders from the RESOURCE to the HOSTPATH")
+	cmd := Subcmd("cp", "CONTAINER:RESOURCE HOSTPATH | HOSTPATH CONTAINER:PATH", "Copy files/folders from the RESOURCE to the HOSTPATH, or from the HOSTPATH into the PATH directory of a container")
+	noOwner := cmd.Bool("no-owner", false, "When copying into a container, give the files to root instead of keeping their owners")
+	noPerms := cmd.Bool("no-perms", false, "When copying into a container, apply the umask of the daemon to the modes of the files")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1927,6 +3113,10 @@ func (cli *DockerCli) CmdCp(args ...string) error {
 		return nil
 	}
 
+	if !strings.Contains(cmd.Arg(0), ":") && strings.Contains(cmd.Arg(1), ":") {
+		return cli.copyToContainer(cmd.Arg(0), cmd.Arg(1), *noOwner, *noPerms)
+	}
+
 	var copyData APICopy
 	info := strings.Split(cmd.Arg(0), ":")
 
@@ -1951,6 +3141,33 @@ func (cli *DockerCli) CmdCp(args ...string) error {
 	return nil
 }
 
+// copyToContainer streams hostPath, as a tar archive, into the directory
+// given as CONTAINER:PATH by dest
+func (cli *DockerCli) copyToContainer(hostPath, dest string, noOwner, noPerms bool) error {
+	info := strings.SplitN(dest, ":", 2)
+	if info[1] == "" {
+		return fmt.Errorf("Error: Path not specified")
+	}
+	hostPath = filepath.Clean(hostPath)
+	if _, err := os.Stat(hostPath); err != nil {
+		return err
+	}
+	context, err := archive.TarFilter(filepath.Dir(hostPath), archive.Uncompressed, []string{filepath.Base(hostPath)})
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("path", info[1])
+	if noOwner {
+		v.Set("noowner", "1")
+	}
+	if noPerms {
+		v.Set("noperms", "1")
+	}
+	return cli.stream("POST", "/containers/"+info[0]+"/upload?"+v.Encode(), context, cli.out, map[string][]string{"Content-Type": {"application/x-tar"}})
+}
+
 func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int, error) {
 	var params io.Reader
 	if data != nil {
@@ -2007,6 +3224,51 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 	return body, resp.StatusCode, nil
 }
 
+// callHeaders sends a request without body, and returns the body of the
+// response as soon as its headers are received
+func (cli *DockerCli) callHeaders(method, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", APIVERSION, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Docker-Client/"+VERSION)
+	req.Host = cli.addr
+	dial, err := net.Dial(cli.proto, cli.addr)
+	if err != nil {
+		if strings.Contains(err.Error(), "connection refused") {
+			return nil, ErrConnectionRefused
+		}
+		return nil, err
+	}
+	clientconn := httputil.NewClientConn(dial, nil)
+	resp, err := clientconn.Do(req)
+	if err != nil {
+		clientconn.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		clientconn.Close()
+		if len(body) == 0 {
+			return nil, fmt.Errorf("Error: %s", http.StatusText(resp.StatusCode))
+		}
+		return nil, fmt.Errorf("Error: %s", body)
+	}
+	return &connBody{resp.Body, clientconn}, nil
+}
+
+// connBody is the body of a response, closing its connection with it
+type connBody struct {
+	io.ReadCloser
+	conn *httputil.ClientConn
+}
+
+func (body *connBody) Close() error {
+	body.ReadCloser.Close()
+	return body.conn.Close()
+}
+
 func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer, headers map[string][]string) error {
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader([]byte{})
@@ -2212,6 +3474,69 @@ func Subcmd(name, signature, description string) *flag.FlagSet {
 	return flags
 }
 
+// outputFormat renders the structured response of a command with a Go
+// template, or as json, instead of as text columns
+type outputFormat struct {
+	json bool
+	tmpl *template.Template
+}
+
+var formatFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// formatFlags adds the -format and -json flags to cmd
+func formatFlags(cmd *flag.FlagSet) (format *string, asJSON *bool) {
+	format = cmd.String("format", "", "Format the output with a Go template, once per item (e.g. '{{.ID}}')")
+	asJSON = cmd.Bool("json", false, "Output the raw json of the response")
+	return
+}
+
+// newOutputFormat returns the format asked with the -format and -json
+// flags, or nil when the output is text columns
+func newOutputFormat(format string, asJSON bool) (*outputFormat, error) {
+	if format != "" && asJSON {
+		return nil, fmt.Errorf("-format and -json can't be used together")
+	}
+	if asJSON {
+		return &outputFormat{json: true}, nil
+	}
+	if format == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("format").Funcs(formatFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid format: %s", err)
+	}
+	return &outputFormat{tmpl: tmpl}, nil
+}
+
+// write renders v to out. The template is executed once per element of a
+// slice, each output on its own line.
+func (f *outputFormat) write(out io.Writer, v interface{}) error {
+	if f.json {
+		return json.NewEncoder(out).Encode(v)
+	}
+	items := []interface{}{v}
+	if value := reflect.ValueOf(v); value.Kind() == reflect.Slice {
+		items = make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = value.Index(i).Interface()
+		}
+	}
+	for _, item := range items {
+		if err := f.tmpl.Execute(out, item); err != nil {
+			return err
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
 func (cli *DockerCli) LoadConfigFile() (err error) {
 	cli.configFile, err = auth.LoadConfig(os.Getenv("HOME"))
 	if err != nil {
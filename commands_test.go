@@ -2,6 +2,7 @@ package docker
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
@@ -825,3 +826,48 @@ run    [ "$(ls -d /var/run/sshd)" = "/var/run/sshd" ]
 
 	return image
 }
+
+func TestImagesFormat(t *testing.T) {
+	defer cleanup(globalRuntime)
+
+	srv := &Server{runtime: globalRuntime}
+	image := buildTestImages(t, srv)
+
+	output := func(args ...string) string {
+		stdout, stdoutPipe := io.Pipe()
+		cli := NewDockerCli(nil, stdoutPipe, ioutil.Discard, testDaemonProto, testDaemonAddr)
+		go func() {
+			if err := cli.CmdImages(args...); err != nil {
+				t.Error(err)
+			}
+			stdoutPipe.Close()
+		}()
+		var cmdOutput []byte
+		setTimeout(t, "Reading command output time out", 2*time.Second, func() {
+			var err error
+			if cmdOutput, err = ioutil.ReadAll(stdout); err != nil {
+				t.Fatal(err)
+			}
+		})
+		return string(cmdOutput)
+	}
+
+	expected := fmt.Sprintf("%s test:latest\n", image.ID)
+	if out := output("-format", `{{.ID}} {{join .RepoTags ","}}`); !strings.Contains(out, expected) {
+		t.Fatalf("Expected images -format to output %q, got %q", expected, out)
+	}
+
+	var images []APIImages
+	if err := json.Unmarshal([]byte(output("-json")), &images); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, img := range images {
+		if img.ID == image.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected images -json to list %s", image.ID)
+	}
+}
@@ -1,8 +1,13 @@
 package docker
 
 import (
+	"fmt"
 	"github.com/dotcloud/docker/engine"
+	"github.com/dotcloud/docker/utils"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // FIXME: separate runtime configuration from http api configuration
@@ -17,6 +22,39 @@ type DaemonConfig struct {
 	BridgeIface                 string
 	DefaultIp                   net.IP
 	InterContainerCommunication bool
+	StopContainers              bool
+	ShutdownTimeout             int
+	BridgeRouteMetric           int
+	BridgeRpFilter              string
+	BridgeArpFilter             string
+	FirewallManager             string
+	NatExclude                  []string
+	DefaultUlimits              []string
+	GatewayAddr                 string
+	GatewayAuthFile             string
+	TestSeed                    string
+	HostnameTemplate            string
+	EvictMemory                 int64
+	EvictPressure               int
+	EvictPriorityFloor          int
+	CoreDir                     string
+	CoreSize                    int64
+	DependencyTimeout           int
+	StorageDriver               string
+	RegistryConfigFile          string
+	RegistryMirrors             []string
+	InsecureRegistries          []string
+	DmDataDev                   string
+	DmMetadataDev               string
+	DmBaseSize                  int64
+	MaxConcurrentDownloads      int
+	AuthorizationPlugins        []string
+	UpgradeKeyFile              string
+	UpgradeURL                  string
+	GCMaxAge                    int
+	GCMaxCount                  int
+	GCMinFree                   int64
+	GCKeepLabels                []string
 }
 
 // ConfigFromJob creates and returns a new DaemonConfig object
@@ -39,5 +77,239 @@ func ConfigFromJob(job *engine.Job) *DaemonConfig {
 	config.ProtoAddresses = job.GetenvList("ProtoAddresses")
 	config.DefaultIp = net.ParseIP(job.Getenv("DefaultIp"))
 	config.InterContainerCommunication = job.GetenvBool("InterContainerCommunication")
+	config.StopContainers = job.GetenvBool("StopContainers")
+	config.ShutdownTimeout = int(job.GetenvInt("ShutdownTimeout"))
+	config.BridgeRouteMetric = int(job.GetenvInt("BridgeRouteMetric"))
+	config.BridgeRpFilter = job.Getenv("BridgeRpFilter")
+	config.BridgeArpFilter = job.Getenv("BridgeArpFilter")
+	config.FirewallManager = job.Getenv("FirewallManager")
+	config.NatExclude = job.GetenvList("NatExclude")
+	config.DefaultUlimits = job.GetenvList("DefaultUlimits")
+	config.GatewayAddr = job.Getenv("GatewayAddr")
+	config.GatewayAuthFile = job.Getenv("GatewayAuthFile")
+	config.TestSeed = job.Getenv("TestSeed")
+	config.HostnameTemplate = job.Getenv("HostnameTemplate")
+	config.EvictMemory = job.GetenvInt("EvictMemory")
+	config.EvictPressure = int(job.GetenvInt("EvictPressure"))
+	config.EvictPriorityFloor = int(job.GetenvInt("EvictPriorityFloor"))
+	config.CoreDir = job.Getenv("CoreDir")
+	config.CoreSize = job.GetenvInt("CoreSize")
+	config.DependencyTimeout = int(job.GetenvInt("DependencyTimeout"))
+	config.StorageDriver = job.Getenv("StorageDriver")
+	config.RegistryConfigFile = job.Getenv("RegistryConfigFile")
+	config.RegistryMirrors = job.GetenvList("RegistryMirrors")
+	config.InsecureRegistries = job.GetenvList("InsecureRegistries")
+	config.AuthorizationPlugins = job.GetenvList("AuthorizationPlugins")
+	config.DmDataDev = job.Getenv("DmDataDev")
+	config.DmMetadataDev = job.Getenv("DmMetadataDev")
+	config.DmBaseSize = job.GetenvInt("DmBaseSize")
+	config.MaxConcurrentDownloads = int(job.GetenvInt("MaxConcurrentDownloads"))
+	config.UpgradeKeyFile = job.Getenv("UpgradeKeyFile")
+	config.UpgradeURL = job.Getenv("UpgradeURL")
+	config.GCMaxAge = int(job.GetenvInt("GCMaxAge"))
+	config.GCMaxCount = int(job.GetenvInt("GCMaxCount"))
+	config.GCMinFree = job.GetenvInt("GCMinFree")
+	config.GCKeepLabels = job.GetenvList("GCKeepLabels")
 	return &config
 }
+
+// validPort checks a tcp port given as text
+func validPort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("the port must be between 1 and 65535")
+	}
+	return nil
+}
+
+// Validate checks the whole configuration before the daemon sets anything
+// up, and reports every problem at once, one per line, instead of the first
+// one the daemon would run into midway
+func (config *DaemonConfig) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, addr := range config.ProtoAddresses {
+		parts := strings.SplitN(addr, "://", 2)
+		if len(parts) != 2 {
+			problem("-H %s: expected tcp://host:port or unix://path", addr)
+			continue
+		}
+		switch parts[0] {
+		case "unix":
+			if parts[1] == "" {
+				problem("-H %s: the path of the socket is empty", addr)
+			}
+		case "tcp":
+			if _, port, err := net.SplitHostPort(parts[1]); err != nil {
+				problem("-H %s: %s", addr, err)
+			} else if err := validPort(port); err != nil {
+				problem("-H %s: %s", addr, err)
+			}
+		default:
+			problem("-H %s: unknown protocol %s, expected tcp or unix", addr, parts[0])
+		}
+	}
+	if config.DefaultIp == nil {
+		problem("-ip: not an ip address")
+	}
+	for _, dns := range config.Dns {
+		if net.ParseIP(dns) == nil {
+			problem("-dns %s: not an ip address", dns)
+		}
+	}
+
+	if config.BridgeIface == DisableNetworkBridge {
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"-bridge-route-metric", config.BridgeRouteMetric != 0},
+			{"-bridge-rp-filter", config.BridgeRpFilter != ""},
+			{"-bridge-arp-filter", config.BridgeArpFilter != ""},
+			{"-nat-exclude", len(config.NatExclude) > 0},
+			{"-gateway", config.GatewayAddr != ""},
+			{"-icc=false", !config.InterContainerCommunication},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				problem("-b none and %s conflict: the containers have no network", conflict.flag)
+			}
+		}
+	}
+	if config.BridgeRouteMetric < 0 {
+		problem("-bridge-route-metric %d: the metric can't be negative", config.BridgeRouteMetric)
+	}
+	for _, sysctl := range []struct {
+		flag  string
+		value string
+		valid []string
+	}{
+		{"-bridge-rp-filter", config.BridgeRpFilter, []string{"0", "1", "2"}},
+		{"-bridge-arp-filter", config.BridgeArpFilter, []string{"0", "1"}},
+	} {
+		valid := sysctl.value == ""
+		for _, v := range sysctl.valid {
+			valid = valid || v == sysctl.value
+		}
+		if !valid {
+			problem("%s %s: expected one of %s", sysctl.flag, sysctl.value, strings.Join(sysctl.valid, ", "))
+		}
+	}
+	for _, cidr := range config.NatExclude {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problem("-nat-exclude %s: not a network in CIDR notation, e.g. 10.0.0.0/8", cidr)
+		}
+	}
+	if len(config.NatExclude) > 0 && !config.EnableIptables {
+		problem("-nat-exclude and -iptables=false conflict: the exclusions are iptables rules")
+	}
+
+	if config.GatewayAddr != "" {
+		if _, port, err := net.SplitHostPort(config.GatewayAddr); err != nil {
+			problem("-gateway %s: %s", config.GatewayAddr, err)
+		} else if err := validPort(port); err != nil {
+			problem("-gateway %s: %s", config.GatewayAddr, err)
+		}
+		if config.GatewayAuthFile == "" {
+			problem("-gateway requires -gateway-auth: the clients of the gateway must authenticate")
+		}
+	} else if config.GatewayAuthFile != "" {
+		problem("-gateway-auth requires -gateway")
+	}
+
+	for _, rawUlimit := range config.DefaultUlimits {
+		if _, err := utils.ParseUlimit(rawUlimit); err != nil {
+			problem("-default-ulimit %s: %s", rawUlimit, err)
+		}
+	}
+	if config.HostnameTemplate != "" {
+		if _, err := parseHostnameTemplate(config.HostnameTemplate); err != nil {
+			problem("-hostname-template %s: %s", config.HostnameTemplate, err)
+		}
+	}
+	if config.ShutdownTimeout < 0 {
+		problem("-shutdown-timeout %d: the timeout can't be negative", config.ShutdownTimeout)
+	}
+	if config.MaxConcurrentDownloads < 0 {
+		problem("-max-concurrent-downloads %d: the number of downloads can't be negative", config.MaxConcurrentDownloads)
+	}
+	if config.DependencyTimeout < 0 {
+		problem("-dependency-timeout %d: the timeout can't be negative", config.DependencyTimeout)
+	}
+	if config.EvictMemory < 0 {
+		problem("-evict-memory %d: the threshold can't be negative", config.EvictMemory)
+	}
+	if config.EvictPressure < 0 || config.EvictPressure > 100 {
+		problem("-evict-pressure %d: expected a percentage, between 0 and 100", config.EvictPressure)
+	}
+	if config.GCMaxAge < 0 {
+		problem("-gc-max-age %d: the age can't be negative", config.GCMaxAge)
+	}
+	if config.GCMaxCount < 0 {
+		problem("-gc-max-count %d: the count can't be negative", config.GCMaxCount)
+	}
+	if config.GCMinFree < 0 {
+		problem("-gc-min-free %d: the size can't be negative", config.GCMinFree)
+	}
+	for _, label := range config.GCKeepLabels {
+		if label == "" || label[0] == '=' {
+			problem("-gc-keep-label %s: expected key or key=value", label)
+		}
+	}
+	if len(config.GCKeepLabels) > 0 && gcPolicyFromConfig(config) == nil {
+		problem("-gc-keep-label requires -gc-max-age, -gc-max-count or -gc-min-free")
+	}
+	if config.CoreSize != 0 && config.CoreDir == "" {
+		problem("-core-size requires -core-dir")
+	}
+	if config.StorageDriver != "" && lookupStorageDriver(config.StorageDriver) == nil {
+		problem("-storage-driver %s: expected one of %s", config.StorageDriver, strings.Join(storageDriverNames(), ", "))
+	}
+	for _, dev := range []struct {
+		flag string
+		path string
+	}{
+		{"-dm-data-dev", config.DmDataDev},
+		{"-dm-metadata-dev", config.DmMetadataDev},
+	} {
+		if dev.path == "" {
+			continue
+		}
+		if f, err := os.Stat(dev.path); err != nil {
+			problem("%s %s: %s", dev.flag, dev.path, err)
+		} else if f.Mode()&os.ModeDevice == 0 {
+			problem("%s %s: not a block device", dev.flag, dev.path)
+		}
+	}
+	if config.DmBaseSize < 0 {
+		problem("-dm-base-size %d: the size can't be negative", config.DmBaseSize)
+	}
+	if config.RegistryConfigFile != "" {
+		if _, err := LoadRegistryConfig(config.RegistryConfigFile); err != nil {
+			problem("-registry-config %s: %s", config.RegistryConfigFile, err)
+		}
+	}
+	for _, mirror := range config.RegistryMirrors {
+		if _, err := expandMirror(mirror); err != nil {
+			problem("-registry-mirror %s: %s", mirror, err)
+		}
+	}
+	for _, host := range config.InsecureRegistries {
+		if err := validRegistryHost(host); err != nil {
+			problem("-insecure-registry %s: %s", host, err)
+		}
+	}
+	if config.UpgradeKeyFile != "" {
+		if _, err := loadUpgradeKey(config.UpgradeKeyFile); err != nil {
+			problem("-upgrade-key %s: %s", config.UpgradeKeyFile, err)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid daemon configuration:\n  %s", strings.Join(problems, "\n  "))
+}
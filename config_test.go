@@ -0,0 +1,55 @@
+package docker
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func validDaemonConfig() *DaemonConfig {
+	return &DaemonConfig{
+		ProtoAddresses:              []string{"unix:///var/run/docker.sock", "tcp://127.0.0.1:4243"},
+		BridgeIface:                 DefaultNetworkBridge,
+		DefaultIp:                   net.ParseIP("0.0.0.0"),
+		InterContainerCommunication: true,
+		EnableIptables:              true,
+		NatExclude:                  []string{"10.0.0.0/8"},
+		DependencyTimeout:           30,
+	}
+}
+
+func TestDaemonConfigValidate(t *testing.T) {
+	if err := validDaemonConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := validDaemonConfig()
+	config.ProtoAddresses = append(config.ProtoAddresses, "tcp://127.0.0.1:99999")
+	config.Dns = []string{"8.8.8"}
+	config.BridgeRpFilter = "3"
+	config.EvictPressure = 150
+	config.GCMaxCount = -1
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid configuration")
+	}
+	for _, flag := range []string{"-H tcp://127.0.0.1:99999", "-dns 8.8.8", "-bridge-rp-filter 3", "-evict-pressure 150", "-gc-max-count -1"} {
+		if !strings.Contains(err.Error(), flag) {
+			t.Errorf("Expected a problem with %s in %q", flag, err)
+		}
+	}
+
+	config = validDaemonConfig()
+	config.BridgeIface = DisableNetworkBridge
+	config.GatewayAddr = "127.0.0.1:1080"
+	config.GatewayAuthFile = "/etc/docker/gateway"
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("Expected -b none to conflict with -nat-exclude and -gateway")
+	}
+	for _, flag := range []string{"-nat-exclude", "-gateway"} {
+		if !strings.Contains(err.Error(), "-b none and "+flag+" conflict") {
+			t.Errorf("Expected a conflict with %s in %q", flag, err)
+		}
+	}
+}
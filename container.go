@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -39,6 +40,7 @@ type Container struct {
 	Image  string
 
 	network         *NetworkInterface
+	attachedNetwork []*NetworkInterface // on other bridges, in the order of hostConfig.NetworkAttach
 	NetworkSettings *NetworkSettings
 
 	SysInitPath    string
@@ -46,6 +48,19 @@ type Container struct {
 	HostnamePath   string
 	HostsPath      string
 	Name           string
+	// The AppArmor profile the container was last started with
+	AppArmorProfile string
+	// The SELinux contexts of the processes and of the files of the
+	// container, empty when it isn't labeled
+	ProcessLabel string
+	MountLabel   string
+	// The directory bind mounted on the /dev/shm of the container
+	ShmPath string
+	// The storage driver the container was created with, AUFS when empty
+	Driver string
+	// The inodes of the unix sockets the container was started with, by
+	// path: they are the only files the next start replaces
+	ListenSocketInodes map[string]uint64
 
 	cmd       *exec.Cmd
 	stdout    *utils.WriteBroadcaster
@@ -55,6 +70,13 @@ type Container struct {
 	ptyMaster io.Closer
 
 	runtime *Runtime
+	// The pids seen in the container while it ran
+	seenPids *pidSet
+	// Closed to stop probing the health of the container
+	healthStop chan struct{}
+	// Notices the OOM kills in the container while it runs
+	oomLock sync.Mutex
+	oom     *oomNotifier
 
 	waitLock chan struct{}
 	Volumes  map[string]string
@@ -88,21 +110,46 @@ type Config struct {
 	Cmd             []string
 	Dns             []string
 	Image           string // Name of the image as it was passed by the operator (eg. could be symbolic)
+	ImageDigest     string // Digest the image was pinned with, as in repository@sha256:hex, if any
 	Volumes         map[string]struct{}
 	VolumesFrom     string
 	WorkingDir      string
 	Entrypoint      []string
 	NetworkDisabled bool
+	Labels          map[string]string
+	// The signal docker stop sends first, SIGTERM when empty
+	StopSignal string
+	// The instructions run by the builds FROM the image, see ONBUILD
+	OnBuild []string
+	// The probe of the health of the container, see HEALTHCHECK
+	Healthcheck *HealthConfig `json:",omitempty"`
 }
 
 type HostConfig struct {
-	Binds           []string
-	ContainerIDFile string
-	LxcConf         []KeyValuePair
-	Privileged      bool
-	PortBindings    map[Port][]PortBinding
-	Links           []string
-	PublishAllPorts bool
+	Binds             []string
+	ContainerIDFile   string
+	LxcConf           []KeyValuePair
+	Privileged        bool
+	PortBindings      map[Port][]PortBinding
+	Links             []string
+	PublishAllPorts   bool
+	ListenSockets     []string
+	AutoRemove        bool
+	Init              bool
+	Ulimits           []string
+	CgroupParent      string
+	Interface         string
+	NetworkAttach     []string
+	SecurityOpt       []string
+	PidMode           string
+	IpcMode           string
+	ShmSize           int64
+	CoreSize          int64
+	DeviceCgroupRules []string
+	DiskQuota         int64
+	// The containers with the highest priority are restarted first and
+	// evicted last
+	Priority int
 }
 
 type BindMap struct {
@@ -127,6 +174,13 @@ type KeyValuePair struct {
 type PortBinding struct {
 	HostIp   string
 	HostPort string
+	// HostPath is set when the port is published as a unix socket
+	HostPath string `json:",omitempty"`
+	// Mode restricts the host addresses the port is published on. When it
+	// is set HostIp is resolved from it, and Interface names the host
+	// interface of the interface mode.
+	Mode      string `json:",omitempty"`
+	Interface string `json:",omitempty"`
 }
 
 // 80/tcp
@@ -164,6 +218,7 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	}
 
 	flHostname := cmd.String("h", "", "Container host name")
+	flDomainname := cmd.String("domainname", "", "Container domain name")
 	flWorkingDir := cmd.String("w", "", "Working directory inside the container")
 	flUser := cmd.String("u", "", "Username or UID")
 	flDetach := cmd.Bool("d", false, "Detached mode: Run container in the background, print new container id")
@@ -176,6 +231,7 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	flNetwork := cmd.Bool("n", true, "Enable networking for this container")
 	flPrivileged := cmd.Bool("privileged", false, "Give extended privileges to this container")
 	flAutoRemove := cmd.Bool("rm", false, "Automatically remove the container when it exits (incompatible with -d)")
+	flInit := cmd.Bool("init", false, "Run the command under a minimal init which reaps zombies and forwards signals")
 	cmd.Bool("sig-proxy", true, "Proxify all received signal to the process (even in non-tty mode)")
 	cmd.String("name", "", "Assign a name to the container")
 	flPublishAll := cmd.Bool("P", false, "Publish all exposed ports to the host interfaces")
@@ -196,6 +252,16 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	var flEnv utils.ListOpts
 	cmd.Var(&flEnv, "e", "Set environment variables")
 
+	var flEnvFile utils.ListOpts
+	cmd.Var(&flEnvFile, "env-file", "Read in a file of KEY=VALUE lines of environment variables")
+
+	var flLabels utils.ListOpts
+	cmd.Var(&flLabels, "label", "Set a label on the container (e.g. -label com.example.role=db)")
+
+	flPriority := cmd.Int("priority", 0, "Priority of the container: the highest ones are restarted first and stopped last under memory pressure")
+	flCoreSize := cmd.Int64("core-size", 0, "Maximum size in bytes of the core dumps of the container collected by the daemon, -1 to drop them (default: the one of the daemon)")
+	flStopSignal := cmd.String("stop-signal", "", "Signal docker stop sends first to the container (default SIGTERM)")
+
 	var flDns utils.ListOpts
 	cmd.Var(&flDns, "dns", "Set custom dns servers")
 
@@ -213,6 +279,30 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	var flLinks utils.ListOpts
 	cmd.Var(&flLinks, "link", "Add link to another container (name:alias)")
 
+	flCgroupParent := cmd.String("cgroup-parent", "", "Create the cgroups of the container under this cgroup (e.g. /system.slice/db)")
+
+	var flUlimits utils.ListOpts
+	cmd.Var(&flUlimits, "ulimit", "Set a ulimit on the processes of the container (e.g. -ulimit nofile=1024:65536)")
+
+	flInterface := cmd.String("iface", "", "Name of the interface of the container on the bridge of the daemon (default eth0)")
+
+	var flNetworkAttach utils.ListOpts
+	cmd.Var(&flNetworkAttach, "net-attach", "Attach the container to another bridge with an additional interface (bridge[:name])")
+
+	var flSecurityOpt utils.ListOpts
+	cmd.Var(&flSecurityOpt, "security-opt", "Set a security option of the container (e.g. -security-opt apparmor=my-profile, -security-opt label=type:my_t)")
+
+	flPidMode := cmd.String("pid", "", "Run the container in the PID namespace of the host or of another container (host, container:NAME)")
+	flIpcMode := cmd.String("ipc", "", "Run the container in the IPC namespace of the host or of another container, sharing its /dev/shm (host, container:NAME)")
+	flShmSize := cmd.Int64("shm-size", 0, "Size of the /dev/shm of the container, in bytes (default 64MB)")
+	flDiskQuota := cmd.Int64("disk-quota", 0, "Limit of the disk space of the changes of the container, in bytes, with the btrfs storage driver")
+
+	var flDeviceCgroupRules utils.ListOpts
+	cmd.Var(&flDeviceCgroupRules, "device-cgroup-rule", "Allow the container to access devices, even created after it started (e.g. -device-cgroup-rule 'c 195:* rwm')")
+
+	var flListen utils.ListOpts
+	cmd.Var(&flListen, "listen", "Bind a socket on the host and pass it to the container as an inherited file descriptor (e.g. tcp://0.0.0.0:80, unix:///run/app.sock)")
+
 	if err := cmd.Parse(args); err != nil {
 		return nil, nil, cmd, err
 	}
@@ -239,6 +329,15 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 
 	envs := []string{}
 
+	// The env files are read in order, the -e flags come last and win
+	for _, filename := range flEnvFile {
+		fileEnvs, err := parseEnvFile(filename)
+		if err != nil {
+			return nil, nil, cmd, err
+		}
+		envs = append(envs, fileEnvs...)
+	}
+
 	for _, env := range flEnv {
 		arr := strings.Split(env, "=")
 		if len(arr) > 1 {
@@ -248,6 +347,7 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 			envs = append(envs, env+"="+v)
 		}
 	}
+	envs = mergeEnv(envs)
 
 	var binds []string
 
@@ -293,12 +393,67 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		hostname = parts[0]
 		domainname = parts[1]
 	}
+	if *flDomainname != "" {
+		domainname = *flDomainname
+	}
 
 	ports, portBindings, err := parsePortSpecs(flPublish)
 	if err != nil {
 		return nil, nil, cmd, err
 	}
 
+	for _, rawAddr := range flListen {
+		if _, _, err := parseListenSocket(rawAddr); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
+
+	if err := validateCgroupParent(*flCgroupParent); err != nil {
+		return nil, nil, cmd, err
+	}
+
+	for _, rule := range flDeviceCgroupRules {
+		if err := validateDeviceCgroupRule(rule); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
+
+	if _, err := interfaceNames(&HostConfig{Interface: *flInterface, NetworkAttach: flNetworkAttach}); err != nil {
+		return nil, nil, cmd, err
+	}
+
+	for _, rawUlimit := range flUlimits {
+		if _, err := utils.ParseUlimit(rawUlimit); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
+
+	if _, err := parseSecurityOpts(flSecurityOpt); err != nil {
+		return nil, nil, cmd, err
+	}
+
+	if *flStopSignal != "" {
+		if _, err := utils.ParseSignal(*flStopSignal); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
+
+	if err := validateNamespaceMode("pid", *flPidMode); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateNamespaceMode("ipc", *flIpcMode); err != nil {
+		return nil, nil, cmd, err
+	}
+	if *flShmSize < 0 {
+		return nil, nil, cmd, fmt.Errorf("Bad parameter shm-size: %d", *flShmSize)
+	}
+	if *flDiskQuota < 0 {
+		return nil, nil, cmd, fmt.Errorf("Bad parameter disk-quota: %d", *flDiskQuota)
+	}
+	if *flShmSize > 0 && *flIpcMode != "" {
+		return nil, nil, cmd, fmt.Errorf("Conflicting options: -shm-size and -ipc")
+	}
+
 	// Merge in exposed ports to the map of published ports
 	for _, e := range flExpose {
 		if strings.Contains(e, ":") {
@@ -310,6 +465,11 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		}
 	}
 
+	labels, err := parseLabels(flLabels)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+
 	config := &Config{
 		Hostname:        hostname,
 		Domainname:      domainname,
@@ -332,16 +492,33 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		VolumesFrom:     strings.Join(flVolumesFrom, ","),
 		Entrypoint:      entrypoint,
 		WorkingDir:      *flWorkingDir,
+		Labels:          labels,
+		StopSignal:      *flStopSignal,
 	}
 
 	hostConfig := &HostConfig{
-		Binds:           binds,
-		ContainerIDFile: *flContainerIDFile,
-		LxcConf:         lxcConf,
-		Privileged:      *flPrivileged,
-		PortBindings:    portBindings,
-		Links:           flLinks,
-		PublishAllPorts: *flPublishAll,
+		Binds:             binds,
+		ContainerIDFile:   *flContainerIDFile,
+		LxcConf:           lxcConf,
+		Privileged:        *flPrivileged,
+		PortBindings:      portBindings,
+		Links:             flLinks,
+		PublishAllPorts:   *flPublishAll,
+		ListenSockets:     flListen,
+		AutoRemove:        *flAutoRemove,
+		Init:              *flInit,
+		Ulimits:           flUlimits,
+		CgroupParent:      *flCgroupParent,
+		Interface:         *flInterface,
+		NetworkAttach:     flNetworkAttach,
+		SecurityOpt:       flSecurityOpt,
+		PidMode:           *flPidMode,
+		IpcMode:           *flIpcMode,
+		ShmSize:           *flShmSize,
+		CoreSize:          *flCoreSize,
+		DeviceCgroupRules: flDeviceCgroupRules,
+		DiskQuota:         *flDiskQuota,
+		Priority:          *flPriority,
 	}
 
 	if capabilities != nil && *flMemory > 0 && !capabilities.SwapLimit {
@@ -365,6 +542,25 @@ type NetworkSettings struct {
 	Bridge      string
 	PortMapping map[string]PortMapping // Deprecated
 	Ports       map[Port][]PortBinding
+	Aliases     []NetworkAlias
+	HostVeth    string
+	Mirror      string
+	Interfaces  []InterfaceSettings
+}
+
+// Kinds of network aliases
+const (
+	AliasHostname = "hostname"
+	AliasName     = "name"
+	AliasLink     = "link"
+)
+
+// NetworkAlias is a name under which a container is reachable
+type NetworkAlias struct {
+	Name string
+	Kind string
+	// Container is the name of the container which reaches a link alias
+	Container string `json:",omitempty"`
 }
 
 func (settings *NetworkSettings) PortMappingAPI() []APIPort {
@@ -380,6 +576,14 @@ func (settings *NetworkSettings) PortMappingAPI() []APIPort {
 		}
 		for _, binding := range bindings {
 			p, _ := parsePort(port.Port())
+			if binding.HostPath != "" {
+				mapping = append(mapping, APIPort{
+					PrivatePort: int64(p),
+					Type:        port.Proto(),
+					Path:        binding.HostPath,
+				})
+				continue
+			}
 			h, _ := parsePort(binding.HostPort)
 			mapping = append(mapping, APIPort{
 				PrivatePort: int64(p),
@@ -394,8 +598,16 @@ func (settings *NetworkSettings) PortMappingAPI() []APIPort {
 
 // Inject the io.Reader at the given path. Note: do not close the reader
 func (container *Container) Inject(file io.Reader, pth string) error {
+	driver, err := container.storageDriver()
+	if err != nil {
+		return err
+	}
+	rw, err := driver.WritableDir(container)
+	if err != nil {
+		return err
+	}
 	// Return error if path exists
-	if _, err := os.Stat(path.Join(container.rwPath(), pth)); err == nil {
+	if _, err := os.Stat(path.Join(rw, pth)); err == nil {
 		// Since err is nil, the path could be stat'd and it exists
 		return fmt.Errorf("%s exists", pth)
 	} else if !os.IsNotExist(err) {
@@ -406,11 +618,11 @@ func (container *Container) Inject(file io.Reader, pth string) error {
 	}
 
 	// Make sure the directory exists
-	if err := os.MkdirAll(path.Join(container.rwPath(), path.Dir(pth)), 0755); err != nil {
+	if err := os.MkdirAll(path.Join(rw, path.Dir(pth)), 0755); err != nil {
 		return err
 	}
 
-	dest, err := os.Create(path.Join(container.rwPath(), pth))
+	dest, err := os.Create(path.Join(rw, pth))
 	if err != nil {
 		return err
 	}
@@ -424,6 +636,15 @@ func (container *Container) Cmd() *exec.Cmd {
 	return container.cmd
 }
 
+// priority returns the priority of the container, 0 before its host config
+// is loaded
+func (container *Container) priority() int {
+	if container.hostConfig == nil {
+		return 0
+	}
+	return container.hostConfig.Priority
+}
+
 func (container *Container) When() time.Time {
 	return container.Created
 }
@@ -450,6 +671,9 @@ func (container *Container) ToDisk() (err error) {
 	if err != nil {
 		return
 	}
+	if container.runtime != nil {
+		container.runtime.index.update(container)
+	}
 	return container.writeHostConfig()
 }
 
@@ -687,27 +911,58 @@ func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, s
 	})
 }
 
-func (container *Container) Start() (err error) {
-	container.State.Lock()
-	defer container.State.Unlock()
-	defer func() {
-		if err != nil {
-			container.cleanup()
+// prepare does what the start of the container needs before its lxc
+// config is generated: mounting its filesystem, allocating its network and
+// setting up its volumes and security labels. A container in standby is
+// already prepared.
+func (container *Container) prepare() error {
+	if container.State.Standby {
+		return nil
+	}
+	relabeled, err := container.setupSELinuxLabels()
+	if err != nil {
+		return err
+	}
+	if mounted, err := container.Mounted(); err != nil {
+		return err
+	} else if mounted && relabeled {
+		// The mount label is given at mount time
+		if err := container.Unmount(); err != nil {
+			return err
 		}
-	}()
-
-	if container.State.Running {
-		return fmt.Errorf("The container %s is already running.", container.ID)
 	}
 	if err := container.EnsureMounted(); err != nil {
 		return err
 	}
+	driver, err := container.storageDriver()
+	if err != nil {
+		return err
+	}
+	if relabeler, ok := driver.(relabelingDriver); ok && relabeled {
+		// The filesystem isn't a mount, its files get the label instead
+		if err := relabeler.Relabel(container); err != nil {
+			return err
+		}
+	}
+	if container.hostConfig.DiskQuota > 0 {
+		quota, ok := driver.(quotaDriver)
+		if !ok {
+			return fmt.Errorf("Impossible to limit the disk space of container %s: the %s storage driver doesn't support it", container.ID, container.storageDriverName())
+		}
+		if err := quota.SetDiskQuota(container, container.hostConfig.DiskQuota); err != nil {
+			return err
+		}
+	}
 	if container.runtime.networkManager.disabled {
 		container.Config.NetworkDisabled = true
 	} else {
 		if err := container.allocateNetwork(); err != nil {
 			return err
 		}
+		// Now that the ip is known, map the hostname to it
+		if err := container.buildHostnameAndHostsFiles(); err != nil {
+			return err
+		}
 	}
 
 	// Make sure the config is compatible with the current kernel
@@ -877,6 +1132,49 @@ func (container *Container) Start() (err error) {
 		}
 	}
 
+	if err := container.relabelVolumes(); err != nil {
+		return err
+	}
+
+	if container.AppArmorProfile, err = container.appArmorProfile(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (container *Container) Start() (err error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+	defer func() {
+		if err != nil {
+			container.cleanup()
+		}
+	}()
+
+	if container.State.Running {
+		return fmt.Errorf("The container %s is already running.", container.ID)
+	}
+	if err := container.prepare(); err != nil {
+		return err
+	}
+
+	pidNamespace, err := container.sharedNamespace("pid", container.hostConfig.PidMode)
+	if err != nil {
+		return err
+	}
+	ipcNamespace, err := container.sharedNamespace("ipc", container.hostConfig.IpcMode)
+	if err != nil {
+		return err
+	}
+	if err := container.setupShm(); err != nil {
+		return err
+	}
+	for _, rule := range container.hostConfig.DeviceCgroupRules {
+		if err := validateDeviceCgroupRule(rule); err != nil {
+			return err
+		}
+	}
+
 	if err := container.generateLXCConfig(); err != nil {
 		return err
 	}
@@ -884,9 +1182,17 @@ func (container *Container) Start() (err error) {
 	params := []string{
 		"-n", container.ID,
 		"-f", container.lxcConfigPath(),
-		"--",
-		"/.dockerinit",
 	}
+	// Join the PID namespace instead of creating one. The proc filesystem,
+	// mounted by the init of the container once it joined it, lists its
+	// processes.
+	if pidNamespace != "" {
+		params = append(params, "--share-pid", pidNamespace)
+	}
+	if ipcNamespace != "" {
+		params = append(params, "--share-ipc", ipcNamespace)
+	}
+	params = append(params, "--", "/.dockerinit")
 
 	// Networking
 	if !container.Config.NetworkDisabled {
@@ -898,6 +1204,18 @@ func (container *Container) Start() (err error) {
 		params = append(params, "-u", container.Config.User)
 	}
 
+	if container.hostConfig.Init {
+		params = append(params, "-init")
+	}
+
+	ulimits, err := container.ulimits()
+	if err != nil {
+		return err
+	}
+	for _, ulimit := range ulimits {
+		params = append(params, "-ulimit", ulimit.String())
+	}
+
 	// Setup environment
 	env := []string{
 		"HOME=/",
@@ -953,10 +1271,29 @@ func (container *Container) Start() (err error) {
 		env = append(env, elem)
 	}
 
+	// The child gets its own copy of the sockets, ours are closed once started
+	listenFiles, err := container.openListenSockets()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(listenFiles)
+	if len(listenFiles) > 0 {
+		env = append(env, fmt.Sprintf("LISTEN_FDS=%d", len(listenFiles)))
+	}
+
 	if err := container.generateEnvConfig(env); err != nil {
 		return err
 	}
 
+	// The files of the container bind mounted into it
+	files := []string{container.HostnamePath, container.HostsPath, container.EnvConfigPath()}
+	if strings.HasPrefix(container.ResolvConfPath, container.root) {
+		files = append(files, container.ResolvConfPath)
+	}
+	if err := container.relabel(files...); err != nil {
+		return err
+	}
+
 	if container.Config.WorkingDir != "" {
 		workingDir := path.Clean(container.Config.WorkingDir)
 		utils.Debugf("[working dir] working dir is %s", workingDir)
@@ -978,7 +1315,20 @@ func (container *Container) Start() (err error) {
 	if container.hostConfig.Privileged && container.runtime.capabilities.AppArmor {
 		lxcStart = path.Join(container.runtime.config.Root, "lxc-start-unconfined")
 	}
+	if container.hostConfig.CgroupParent != "" {
+		if err := validateCgroupParent(container.hostConfig.CgroupParent); err != nil {
+			return err
+		}
+		tasks, err := container.cgroupParentTasks()
+		if err != nil {
+			return err
+		}
+		wrapper := append([]string{"-c", cgroupParentWrapper, "sh", strconv.Itoa(len(tasks))}, tasks...)
+		params = append(append(wrapper, lxcStart), params...)
+		lxcStart = "sh"
+	}
 	container.cmd = exec.Command(lxcStart, params...)
+	container.cmd.ExtraFiles = listenFiles
 	// Setup logging of stdout and stderr to disk
 	if err := container.runtime.LogToDisk(container.stdout, container.logPath("json"), "stdout"); err != nil {
 		return err
@@ -989,17 +1339,26 @@ func (container *Container) Start() (err error) {
 
 	container.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
+	// Dockerinit can't raise its hard limits, lxc drops sys_resource: the
+	// ones of the daemon are raised for lxc-start to inherit them, and
+	// restored once it started
+	restoreLimits, err := utils.RaiseHardLimits(ulimits)
+	if err != nil {
+		return err
+	}
 	if container.Config.Tty {
 		err = container.startPty()
 	} else {
 		err = container.start()
 	}
+	restoreLimits()
 	if err != nil {
 		return err
 	}
 	// FIXME: save state on disk *first*, then converge
 	// this way disk state is used as a journal, eg. we can restore after crash etc.
 	container.State.setRunning(container.cmd.Process.Pid)
+	container.startHealthMonitor()
 
 	// Init the lock
 	container.waitLock = make(chan struct{})
@@ -1029,6 +1388,8 @@ func (container *Container) Start() (err error) {
 
 		}
 		if strings.Contains(string(output), "RUNNING") {
+			container.watchOOM()
+			container.watchPids()
 			return nil
 		}
 		utils.Debugf("Waiting for the container to start (running: %v): %s", container.State.Running, bytes.TrimSpace(output))
@@ -1087,6 +1448,80 @@ func (container *Container) StderrPipe() (io.ReadCloser, error) {
 	return utils.NewBufReader(reader), nil
 }
 
+// The ulimits of the container: the defaults of the daemon, overridden by
+// the ones of the container
+func (container *Container) ulimits() ([]*utils.Ulimit, error) {
+	var ulimits []*utils.Ulimit
+	index := make(map[string]int)
+	for _, raw := range append(container.runtime.config.DefaultUlimits, container.hostConfig.Ulimits...) {
+		ulimit, err := utils.ParseUlimit(raw)
+		if err != nil {
+			return nil, err
+		}
+		if i, exists := index[ulimit.Name]; exists {
+			ulimits[i] = ulimit
+			continue
+		}
+		index[ulimit.Name] = len(ulimits)
+		ulimits = append(ulimits, ulimit)
+	}
+	return ulimits, nil
+}
+
+// Write the /etc/hostname and /etc/hosts files of the container. The
+// hostname resolves to the loopback addresses and, once the container has
+// one, to its ip. The hosts file is written in full when the container
+// starts for the first time. It is kept after, with the edits of the user,
+// but for the lines of the hostname, updated when its ips change.
+func (container *Container) buildHostnameAndHostsFiles() error {
+	container.HostnamePath = path.Join(container.root, "hostname")
+	if _, err := writeFileIfChanged(container.HostnamePath, []byte(container.Config.Hostname+"\n"), 0644); err != nil {
+		return err
+	}
+
+	names := container.Config.Hostname
+	if container.Config.Domainname != "" {
+		names = fmt.Sprintf("%s.%s %s", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)
+	}
+
+	hostnameLines := fmt.Sprintf("127.0.0.1\t%s\n::1\t\t%s\n", names, names)
+	if container.NetworkSettings != nil && container.NetworkSettings.IPAddress != "" {
+		hostnameLines += fmt.Sprintf("%s\t%s\n", container.NetworkSettings.IPAddress, names)
+		// The interfaces on other bridges follow the one on the bridge of the daemon
+		for i := 1; i < len(container.NetworkSettings.Interfaces); i++ {
+			hostnameLines += fmt.Sprintf("%s\t%s\n", container.NetworkSettings.Interfaces[i].IPAddress, names)
+		}
+	}
+
+	container.HostsPath = path.Join(container.root, "hosts")
+	current, err := ioutil.ReadFile(container.HostsPath)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(container.HostsPath, []byte(hostnameLines+defaultHostsLines), 0644)
+	} else if err != nil {
+		return err
+	}
+	// The lines of the user follow the ones of the hostname
+	var userLines []string
+	for _, line := range strings.SplitAfter(string(current), "\n") {
+		if fields := strings.Fields(line); len(fields) < 2 || strings.Join(fields[1:], " ") != names {
+			userLines = append(userLines, line)
+		}
+	}
+	_, err = writeFileIfChanged(container.HostsPath, []byte(hostnameLines+strings.Join(userLines, "")), 0644)
+	return err
+}
+
+// defaultHostsLines are the lines of the /etc/hosts of the containers after
+// the ones of their hostname
+const defaultHostsLines = `
+127.0.0.1	localhost
+::1		localhost ip6-localhost ip6-loopback
+fe00::0		ip6-localnet
+ff00::0		ip6-mcastprefix
+ff02::1		ip6-allnodes
+ff02::2		ip6-allrouters
+`
+
 func (container *Container) allocateNetwork() error {
 	if container.Config.NetworkDisabled {
 		return nil
@@ -1172,23 +1607,152 @@ func (container *Container) allocateNetwork() error {
 	}
 	container.writeHostConfig()
 
+	names, err := interfaceNames(container.hostConfig)
+	if err != nil {
+		iface.Release()
+		return err
+	}
+	attached, err := container.allocateAttachedNetworks()
+	if err != nil {
+		iface.Release()
+		return err
+	}
+
 	container.NetworkSettings.Ports = bindings
+	iface.Veth = hostVethName(container.ID, 0)
 	container.network = iface
+	container.attachedNetwork = attached
 
 	container.NetworkSettings.Bridge = container.runtime.networkManager.bridgeIface
 	container.NetworkSettings.IPAddress = iface.IPNet.IP.String()
 	container.NetworkSettings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
 	container.NetworkSettings.Gateway = iface.Gateway.String()
+	container.NetworkSettings.HostVeth = iface.Veth
+
+	container.NetworkSettings.Interfaces = []InterfaceSettings{newInterfaceSettings(names[0], iface)}
+	for i, attachedIface := range attached {
+		container.NetworkSettings.Interfaces = append(container.NetworkSettings.Interfaces, newInterfaceSettings(names[i+1], attachedIface))
+	}
 
 	return nil
 }
 
+// PublishPort maps port on the host while the container is running. The
+// mapping is also recorded in the host config, so it survives a restart.
+func (container *Container) PublishPort(port Port, binding PortBinding) (PortBinding, error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if !container.State.Running {
+		return PortBinding{}, fmt.Errorf("Impossible to publish port %s of container %s: it is not running", port, container.ID)
+	}
+	if container.network == nil {
+		return PortBinding{}, fmt.Errorf("Impossible to publish port %s of container %s: its network is disabled", port, container.ID)
+	}
+	nat, err := container.network.AllocatePort(port, binding)
+	if err != nil {
+		return PortBinding{}, err
+	}
+	utils.Debugf("Allocate port: %s:%s->%s", nat.Binding.HostIp, port, nat.Binding.HostPort)
+
+	if container.Config.ExposedPorts == nil {
+		container.Config.ExposedPorts = make(map[Port]struct{})
+	}
+	container.Config.ExposedPorts[port] = struct{}{}
+	if container.hostConfig.PortBindings == nil {
+		container.hostConfig.PortBindings = make(map[Port][]PortBinding)
+	}
+	container.hostConfig.PortBindings[port] = append(container.hostConfig.PortBindings[port], nat.Binding)
+	if container.NetworkSettings.Ports == nil {
+		container.NetworkSettings.Ports = make(map[Port][]PortBinding)
+	}
+	container.NetworkSettings.Ports[port] = append(container.NetworkSettings.Ports[port], nat.Binding)
+
+	if err := container.writeHostConfig(); err != nil {
+		return PortBinding{}, err
+	}
+	return nat.Binding, container.ToDisk()
+}
+
+// MirrorTraffic copies the traffic of a running container to the host
+// interface dev
+func (container *Container) MirrorTraffic(dev string) error {
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to mirror the traffic of container %s: it is not running", container.ID)
+	}
+	if container.network == nil {
+		return fmt.Errorf("Impossible to mirror the traffic of container %s: its network is disabled", container.ID)
+	}
+	return container.network.Mirror(dev)
+}
+
+// UnmirrorTraffic stops mirroring the traffic of a running container
+func (container *Container) UnmirrorTraffic() error {
+	if !container.State.Running || container.network == nil {
+		return fmt.Errorf("No such mirror: the traffic of container %s is not mirrored", container.ID)
+	}
+	return container.network.Unmirror()
+}
+
+// UnpublishPort removes the mappings of port matching binding, whose empty
+// fields match anything, from a running container. The port stays exposed.
+func (container *Container) UnpublishPort(port Port, binding PortBinding) ([]PortBinding, error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to unpublish port %s of container %s: it is not running", port, container.ID)
+	}
+	if container.network == nil {
+		return nil, fmt.Errorf("No such port mapping: %s", port)
+	}
+	released, err := container.network.ReleasePort(port, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	removeBindings := func(bindings map[Port][]PortBinding) {
+		if bindings == nil {
+			return
+		}
+		var kept []PortBinding
+		for _, b := range bindings[port] {
+			nat := &Nat{Port: port, Binding: b, Mode: b.Mode}
+			if b.HostPath == "" {
+				defaultIp := container.runtime.networkManager.portMapper.defaultIp
+				if b.HostIp == "" {
+					// Bindings on the default ip are stored without it
+					nat.Binding.HostIp = defaultIp.String()
+				}
+				if b.Mode == "" {
+					_, nat.Mode, _ = resolvePublishMode(b, defaultIp)
+				}
+			}
+			if !nat.matches(binding) {
+				kept = append(kept, b)
+			}
+		}
+		bindings[port] = kept
+	}
+	removeBindings(container.hostConfig.PortBindings)
+	removeBindings(container.NetworkSettings.Ports)
+
+	if err := container.writeHostConfig(); err != nil {
+		return nil, err
+	}
+	return released, container.ToDisk()
+}
+
 func (container *Container) releaseNetwork() {
 	if container.Config.NetworkDisabled || container.network == nil {
 		return
 	}
 	container.network.Release()
 	container.network = nil
+	for _, iface := range container.attachedNetwork {
+		iface.Release()
+	}
+	container.attachedNetwork = nil
 	container.NetworkSettings = &NetworkSettings{}
 }
 
@@ -1206,15 +1770,91 @@ func (container *Container) waitLxc() error {
 	}
 }
 
+// waitGhost waits for a container started by a previous daemon to exit.
+// Watching its pid notices the exit as soon as it happens, whereas
+// waitLxc, used as a fallback, has to poll lxc-info.
+func (container *Container) waitGhost() error {
+	if pid := container.State.Pid; pid > 0 {
+		err := waitPid(pid)
+		if err == nil {
+			return nil
+		}
+		utils.Debugf("waitGhost: cannot watch pid %d of container %s, falling back to waitLxc: %s", pid, container.ID, err)
+	}
+	return container.waitLxc()
+}
+
+// memoryCgroupDir returns the memory cgroup lxc created for the container
+func (container *Container) memoryCgroupDir() (string, error) {
+	mountpoint, err := utils.FindCgroupMountpoint("memory")
+	if err != nil {
+		return "", err
+	}
+	dirs := []string{path.Join(mountpoint, "lxc", container.ID)}
+	if container.hostConfig != nil && container.hostConfig.CgroupParent != "" {
+		dirs = append(dirs, path.Join(mountpoint, container.hostConfig.CgroupParent, "lxc", container.ID))
+	}
+	if parent, err := utils.GetThisCgroupDir("memory"); err == nil {
+		dirs = append(dirs, path.Join(mountpoint, parent, "lxc", container.ID))
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("No memory cgroup found for container %s", container.ID)
+}
+
+// watchOOM records the kills of the OOM killer in the container, until its
+// cgroup is removed.
+func (container *Container) watchOOM() {
+	dir, err := container.memoryCgroupDir()
+	if err != nil {
+		utils.Debugf("watchOOM: %s", err)
+		return
+	}
+	oom, err := notifyOOM(dir, func() {
+		utils.Debugf("watchOOM: OOM kill in container %s", container.ID)
+		container.State.OOMKilled = true
+		if container.runtime != nil && container.runtime.srv != nil {
+			container.runtime.srv.LogEvent("oom", container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+		}
+		if err := container.ToDisk(); err != nil {
+			utils.Debugf("watchOOM: %s", err)
+		}
+	})
+	if err != nil {
+		utils.Debugf("watchOOM: cannot watch the cgroup %s: %s", dir, err)
+		return
+	}
+	container.oomLock.Lock()
+	container.oom = oom
+	container.oomLock.Unlock()
+}
+
+// drainOOM records the OOM kills in the container not noticed yet by
+// watchOOM, which notices them in the background. Once the container
+// exited, it is called before the exit is recorded, for the exit to tell
+// whether the OOM killer caused it.
+func (container *Container) drainOOM() {
+	container.oomLock.Lock()
+	oom := container.oom
+	container.oom = nil
+	container.oomLock.Unlock()
+	if oom != nil {
+		oom.drain()
+	}
+}
+
 func (container *Container) monitor() {
 	// Wait for the program to exit
 
-	// If the command does not exist, try to wait via lxc
+	// If the command does not exist, watch its pid or wait via lxc
 	// (This probably happens only for ghost containers, i.e. containers that were running when Docker started)
 	if container.cmd == nil {
-		utils.Debugf("monitor: waiting for container %s using waitLxc", container.ID)
-		if err := container.waitLxc(); err != nil {
-			utils.Errorf("monitor: while waiting for container %s, waitLxc had a problem: %s", container.ID, err)
+		utils.Debugf("monitor: waiting for container %s using waitGhost", container.ID)
+		if err := container.waitGhost(); err != nil {
+			utils.Errorf("monitor: while waiting for container %s, waitGhost had a problem: %s", container.ID, err)
 		}
 	} else {
 		utils.Debugf("monitor: waiting for container %s using cmd.Wait", container.ID)
@@ -1231,12 +1871,17 @@ func (container *Container) monitor() {
 		exitCode = container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
 	}
 
-	// Report status back
+	// Report status back, with what the kernel logged about the container
+	kernelMessages := container.kernelMessages()
+	container.stopHealthMonitor()
+	container.drainOOM()
 	container.State.setStopped(exitCode)
+	container.State.LastExit.KernelMessages = kernelMessages
 
 	if container.runtime != nil && container.runtime.srv != nil {
 		container.runtime.srv.LogEvent("die", container.ShortID(), container.runtime.repositories.ImageName(container.Image))
 	}
+	container.logKernelEvents(kernelMessages)
 
 	// Cleanup
 	container.cleanup()
@@ -1258,9 +1903,18 @@ func (container *Container) monitor() {
 		// FIXME: why are we serializing running state to disk in the first place?
 		//log.Printf("%s: Failed to dump configuration to the disk: %s", container.ID, err)
 	}
+
+	// Remove the container from here rather than from the client, which
+	// may have disconnected by now
+	if container.hostConfig != nil && container.hostConfig.AutoRemove && container.runtime != nil && container.runtime.srv != nil {
+		if err := container.runtime.srv.ContainerDestroy(container.ID, true, false, nil, nil, nil); err != nil {
+			utils.Errorf("monitor: cannot auto-remove container %s: %s", container.ID, err)
+		}
+	}
 }
 
 func (container *Container) cleanup() {
+	container.State.Standby = false
 	container.releaseNetwork()
 
 	// Disable all active links
@@ -1288,6 +1942,10 @@ func (container *Container) cleanup() {
 		}
 	}
 
+	if err := container.releaseShm(); err != nil {
+		log.Printf("%v: Failed to umount /dev/shm: %v", container.ID, err)
+	}
+
 	if err := container.Unmount(); err != nil {
 		log.Printf("%v: Failed to umount filesystem: %v", container.ID, err)
 	}
@@ -1311,7 +1969,7 @@ func (container *Container) kill(sig int) error {
 
 func (container *Container) Kill() error {
 	if !container.State.Running {
-		return nil
+		return container.releaseStandby()
 	}
 
 	// 1. Send SIGKILL
@@ -1334,15 +1992,27 @@ func (container *Container) Kill() error {
 	return nil
 }
 
+// stopSignal returns the signal Stop sends first to the container
+func (container *Container) stopSignal() syscall.Signal {
+	if container.Config.StopSignal != "" {
+		if sig, err := utils.ParseSignal(container.Config.StopSignal); err == nil {
+			return sig
+		}
+		utils.Errorf("Invalid stop signal %s of container %s, sending SIGTERM", container.Config.StopSignal, container.ShortID())
+	}
+	return syscall.SIGTERM
+}
+
 func (container *Container) Stop(seconds int) error {
 	if !container.State.Running {
-		return nil
+		return container.releaseStandby()
 	}
 
-	// 1. Send a SIGTERM
-	if err := container.kill(15); err != nil {
-		utils.Debugf("Error sending kill SIGTERM: %s", err)
-		log.Print("Failed to send SIGTERM to the process, force killing")
+	// 1. Send the stop signal, SIGTERM unless the container has another one
+	sig := container.stopSignal()
+	if err := container.kill(int(sig)); err != nil {
+		utils.Debugf("Error sending kill %s: %s", sig, err)
+		log.Printf("Failed to send %s to the process, force killing", sig)
 		if err := container.kill(9); err != nil {
 			return err
 		}
@@ -1350,7 +2020,7 @@ func (container *Container) Stop(seconds int) error {
 
 	// 2. Wait for the process to exit on its own
 	if err := container.WaitTimeout(time.Duration(seconds) * time.Second); err != nil {
-		log.Printf("Container %v failed to exit within %d seconds of SIGTERM - using the force", container.ID, seconds)
+		log.Printf("Container %v failed to exit within %d seconds of %s - using the force", container.ID, seconds, sig)
 		// 3. If it doesn't, then send SIGKILL
 		if err := container.Kill(); err != nil {
 			return err
@@ -1366,6 +2036,71 @@ func (container *Container) Restart(seconds int) error {
 	return container.Start()
 }
 
+// openListenSockets binds the sockets requested with -listen. They are
+// inherited by the container from file descriptor 3 onwards, like with
+// systemd socket activation, so the container can serve on privileged
+// ports without any capability.
+func (container *Container) openListenSockets() ([]*os.File, error) {
+	var files []*os.File
+	inodes := make(map[string]uint64)
+	for _, rawAddr := range container.hostConfig.ListenSockets {
+		f, err := listenSocketFile(rawAddr, container.ListenSocketInodes, inodes)
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("Unable to bind %s: %s", rawAddr, err)
+		}
+		files = append(files, f)
+	}
+	container.ListenSocketInodes = inodes
+	return files, nil
+}
+
+// listenSocketFile binds the socket rawAddr. An existing unix socket is
+// only replaced when its inode is the one in previous, i.e. the daemon
+// created it, and the inode of the new one is added to created.
+func listenSocketFile(rawAddr string, previous, created map[string]uint64) (*os.File, error) {
+	proto, addr, err := parseListenSocket(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "unix" {
+		if fi, err := os.Lstat(addr); err == nil {
+			stat, ok := fi.Sys().(*syscall.Stat_t)
+			if fi.Mode()&os.ModeSocket == 0 || !ok || previous[addr] == 0 || stat.Ino != previous[addr] {
+				return nil, fmt.Errorf("%s already exists and was not created by the container", addr)
+			}
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	l, err := net.Listen(proto, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// The socket must outlive our copy of the listener
+		l.SetUnlinkOnClose(false)
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(addr, &stat); err != nil {
+			return nil, err
+		}
+		created[addr] = stat.Ino
+		return l.File()
+	}
+	return nil, fmt.Errorf("Unsupported listener: %T", l)
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
 // Wait blocks until the container stops running, then returns its exit code.
 func (container *Container) Wait() int {
 	<-container.waitLock
@@ -1373,6 +2108,12 @@ func (container *Container) Wait() int {
 }
 
 func (container *Container) Resize(h, w int) error {
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to resize the tty of container %s: it is not running", container.ID)
+	}
+	if !container.Config.Tty {
+		return fmt.Errorf("Impossible to resize the tty of container %s: it was not started with a tty", container.ID)
+	}
 	pty, ok := container.ptyMaster.(*os.File)
 	if !ok {
 		return fmt.Errorf("ptyMaster does not have Fd() method")
@@ -1380,8 +2121,14 @@ func (container *Container) Resize(h, w int) error {
 	return term.SetWinsize(pty.Fd(), &term.Winsize{Height: uint16(h), Width: uint16(w)})
 }
 
+// ExportRw returns a tar archive of the rw layer of the container, with the
+// whiteouts of AUFS whatever its driver
 func (container *Container) ExportRw() (archive.Archive, error) {
-	return archive.Tar(container.rwPath(), archive.Uncompressed)
+	driver, err := container.storageDriver()
+	if err != nil {
+		return nil, err
+	}
+	return driver.ExportChanges(container)
 }
 
 func (container *Container) RwChecksum() (string, error) {
@@ -1424,19 +2171,23 @@ func (container *Container) EnsureMounted() error {
 }
 
 func (container *Container) Mount() error {
-	image, err := container.GetImage()
+	if container.State.Dead {
+		return fmt.Errorf("Impossible to mount container %s: it is being removed, remove it again to complete its removal", container.ID)
+	}
+	driver, err := container.storageDriver()
 	if err != nil {
 		return err
 	}
-	return image.Mount(container.RootfsPath(), container.rwPath())
+	return driver.Mount(container)
 }
 
+// Changes returns the changes of the container to its image
 func (container *Container) Changes() ([]Change, error) {
-	image, err := container.GetImage()
+	driver, err := container.storageDriver()
 	if err != nil {
 		return nil, err
 	}
-	return image.Changes(container.rwPath())
+	return driver.Changes(container)
 }
 
 func (container *Container) GetImage() (*Image, error) {
@@ -1446,6 +2197,24 @@ func (container *Container) GetImage() (*Image, error) {
 	return container.runtime.graph.Get(container.Image)
 }
 
+// storageDriverName returns the name of the storage driver of the
+// container, AUFS for the containers created before the drivers were
+func (container *Container) storageDriverName() string {
+	if container.Driver == "" {
+		return DriverAUFS
+	}
+	return container.Driver
+}
+
+// storageDriver returns the storage driver the filesystem of the container
+// is stored with
+func (container *Container) storageDriver() (StorageDriver, error) {
+	if container.runtime == nil {
+		return nil, fmt.Errorf("Can't get the storage driver of unregistered container")
+	}
+	return container.runtime.storageDriver(container.Driver)
+}
+
 func (container *Container) Mounted() (bool, error) {
 	return Mounted(container.RootfsPath())
 }
@@ -1457,7 +2226,11 @@ func (container *Container) Unmount() error {
 		}
 		return err
 	}
-	return Unmount(container.RootfsPath())
+	driver, err := container.storageDriver()
+	if err != nil {
+		return err
+	}
+	return driver.Unmount(container)
 }
 
 // ShortID returns a shorthand version of the container's id for convenience.
@@ -1488,6 +2261,10 @@ func (container *Container) EnvConfigPath() string {
 	return path.Join(container.root, "config.env")
 }
 
+func (container *Container) changeJournalPath() string {
+	return path.Join(container.root, "changes.journal")
+}
+
 func (container *Container) lxcConfigPath() string {
 	return path.Join(container.root, "config.lxc")
 }
@@ -1512,12 +2289,9 @@ func validateID(id string) error {
 func (container *Container) GetSize() (int64, int64) {
 	var sizeRw, sizeRootfs int64
 
-	filepath.Walk(container.rwPath(), func(path string, fileInfo os.FileInfo, err error) error {
-		if fileInfo != nil {
-			sizeRw += fileInfo.Size()
-		}
-		return nil
-	})
+	if driver, err := container.storageDriver(); err == nil {
+		sizeRw = driver.ChangesSize(container)
+	}
 
 	_, err := os.Stat(container.RootfsPath())
 	if err == nil {
@@ -1552,6 +2326,41 @@ func (container *Container) Copy(resource string) (archive.Archive, error) {
 	return archive.TarFilter(basePath, archive.Uncompressed, filter)
 }
 
+// CopyTo unpacks the tar archive data into the directory resource of the
+// container, which may be running. A resource in a volume is unpacked into
+// the volume.
+func (container *Container) CopyTo(resource string, data io.Reader, options *archive.UntarOptions) error {
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	resource = path.Clean("/" + resource)
+
+	// Find the filesystem the resource lives in: the deepest volume
+	// containing it, or the rootfs
+	basePath, relPath := container.RootfsPath(), resource
+	volume := ""
+	for volPath, srcPath := range container.Volumes {
+		if (resource == volPath || strings.HasPrefix(resource, volPath+"/")) && len(volPath) > len(volume) {
+			volume = volPath
+			basePath, relPath = srcPath, strings.TrimPrefix(resource, volPath)
+		}
+	}
+	if volume != "" && !container.VolumesRW[volume] {
+		return fmt.Errorf("Impossible to copy to %s: the volume %s is read-only", resource, volume)
+	}
+
+	// The symlinks of the container are resolved within its filesystem, for
+	// the copy not to land on the host
+	destPath, err := archive.FollowSymlinkInScope(path.Join(basePath, relPath), basePath)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Lstat(destPath); err != nil || !stat.IsDir() {
+		return fmt.Errorf("No such directory in container %s: %s", container.ID, resource)
+	}
+	return archive.UntarInScope(data, destPath, basePath, options)
+}
+
 // Returns true if the container exposes a certain port
 func (container *Container) Exposes(p Port) bool {
 	_, exists := container.Config.ExposedPorts[p]
@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/gograph"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// containerIndex summarizes what docker ps lists of each container, so that
+// listing thousands of containers neither reads their state nor walks the
+// name graph. The summary of a container is updated when its state changes,
+// see Container.ToDisk, and the names when the name graph changes.
+type containerIndex struct {
+	sync.RWMutex
+	summaries map[string]*containerSummary
+	// The names of the containers by id, nil until the name graph is walked
+	// again
+	names map[string][]string
+}
+
+// containerSummary is what docker ps lists of a container, but its size
+type containerSummary struct {
+	ID      string
+	Image   string // The id of the image
+	Command string
+	Created time.Time
+	Ports   []APIPort
+	Labels  map[string]string
+	// A copy of the state of the container when it was summarized
+	State *State
+}
+
+func newContainerIndex() *containerIndex {
+	return &containerIndex{summaries: make(map[string]*containerSummary)}
+}
+
+// update summarizes the container again
+func (index *containerIndex) update(container *Container) {
+	if index == nil {
+		return
+	}
+	summary := &containerSummary{
+		ID:      container.ID,
+		Image:   container.Image,
+		Command: container.Path + " " + strings.Join(container.Args, " "),
+		Created: container.Created,
+		State:   container.State.summary(),
+	}
+	if container.NetworkSettings != nil {
+		summary.Ports = container.NetworkSettings.PortMappingAPI()
+	}
+	if container.Config != nil {
+		summary.Labels = container.Config.Labels
+	}
+	index.Lock()
+	index.summaries[container.ID] = summary
+	index.Unlock()
+}
+
+// remove forgets the container, which was destroyed
+func (index *containerIndex) remove(id string) {
+	if index == nil {
+		return
+	}
+	index.Lock()
+	delete(index.summaries, id)
+	index.names = nil
+	index.Unlock()
+}
+
+// namesChanged makes the next listing walk the name graph again
+func (index *containerIndex) namesChanged() {
+	if index == nil {
+		return
+	}
+	index.Lock()
+	index.names = nil
+	index.Unlock()
+}
+
+// list returns the summaries of the containers, the most recently created
+// first, and their names, walking the name graph if it changed since the
+// last listing
+func (index *containerIndex) list(containerGraph *gograph.Database) ([]*containerSummary, map[string][]string) {
+	index.Lock()
+	defer index.Unlock()
+	if index.names == nil {
+		index.names = make(map[string][]string)
+		containerGraph.Walk("/", func(p string, e *gograph.Entity) error {
+			index.names[e.ID()] = append(index.names[e.ID()], p)
+			return nil
+		}, -1)
+	}
+	summaries := make([]*containerSummary, 0, len(index.summaries))
+	for _, summary := range index.summaries {
+		summaries = append(summaries, summary)
+	}
+	sort.Sort(summariesByCreated(summaries))
+	return summaries, index.names
+}
+
+// summariesByCreated sorts the newest first, then by id: the containers
+// created at the same time, as under the clock of the test mode, keep their
+// order
+type summariesByCreated []*containerSummary
+
+func (s summariesByCreated) Len() int      { return len(s) }
+func (s summariesByCreated) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s summariesByCreated) Less(i, j int) bool {
+	if !s[i].Created.Equal(s[j].Created) {
+		return s[j].Created.Before(s[i].Created)
+	}
+	return s[i].ID < s[j].ID
+}
@@ -0,0 +1,75 @@
+package docker
+
+import (
+	"database/sql"
+	"github.com/dotcloud/docker/gograph"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestContainerIndex(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	conn, err := sql.Open("sqlite3", path.Join(tmp, "linkgraph.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := gograph.NewDatabase(conn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+
+	index := newContainerIndex()
+	first := &Container{ID: "first", Path: "echo", Args: []string{"hi"}, Created: time.Now().Add(-time.Minute)}
+	second := &Container{ID: "second", Path: "true", Created: time.Now()}
+	index.update(first)
+	index.update(second)
+	if _, err := graph.Set("/one", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, names := index.list(graph)
+	if len(summaries) != 2 || summaries[0].ID != "second" || summaries[1].ID != "first" {
+		t.Fatalf("Expected the most recently created container first, got %v", summaries)
+	}
+	if summaries[1].Command != "echo hi" || summaries[1].State.Running {
+		t.Errorf("Unexpected summary %+v", summaries[1])
+	}
+	if len(names["first"]) != 1 || names["first"][0] != "/one" {
+		t.Errorf("Expected the names [/one], got %v", names["first"])
+	}
+
+	// The summary is a copy, updated on demand
+	first.State.Running = true
+	if summaries, _ = index.list(graph); summaries[1].State.Running {
+		t.Error("Expected the summary not to change before the update")
+	}
+	index.update(first)
+	if summaries, _ = index.list(graph); !summaries[1].State.Running {
+		t.Error("Expected the summary to be updated")
+	}
+
+	// The names are kept until they change
+	if _, err := graph.Set("/two", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, names = index.list(graph); len(names["second"]) != 0 {
+		t.Errorf("Expected the names to be kept, got %v", names["second"])
+	}
+	index.namesChanged()
+	if _, names = index.list(graph); len(names["second"]) != 1 {
+		t.Errorf("Expected the names to be walked again, got %v", names["second"])
+	}
+
+	index.remove("first")
+	if summaries, _ = index.list(graph); len(summaries) != 1 {
+		t.Errorf("Expected 1 container left, got %d", len(summaries))
+	}
+}
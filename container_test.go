@@ -2,15 +2,21 @@ package docker
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
+	"github.com/dotcloud/docker/proxy"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"os/exec"
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -618,6 +624,90 @@ func TestRestart(t *testing.T) {
 	}
 }
 
+func TestRestartCount(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, _, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "exit 3"},
+	},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if container.State.RestartCount != 0 || container.State.LastExit != nil {
+		t.Fatalf("Expected a fresh state, got %d restarts and %v", container.State.RestartCount, container.State.LastExit)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := container.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if container.State.RestartCount != 1 {
+		t.Errorf("Expected 1 restart, got %d", container.State.RestartCount)
+	}
+	lastExit := container.State.LastExit
+	if lastExit == nil {
+		t.Fatal("Expected the last exit to be recorded")
+	}
+	if lastExit.ExitCode != 3 || lastExit.OOMKilled {
+		t.Errorf("Expected exit code 3, got %v", lastExit)
+	}
+	if !lastExit.FinishedAt.Equal(container.State.FinishedAt) || lastExit.StartedAt.After(lastExit.FinishedAt) {
+		t.Errorf("Unexpected timestamps: %v", lastExit)
+	}
+
+	// The last exit is persisted along with the container
+	if err := container.ToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := runtime.load(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.State.RestartCount != 1 || reloaded.State.LastExit == nil || reloaded.State.LastExit.ExitCode != 3 {
+		t.Errorf("Expected the restart count and last exit to be persisted, got %d and %v", reloaded.State.RestartCount, reloaded.State.LastExit)
+	}
+}
+
+func TestLastExitOOMKilled(t *testing.T) {
+	cgroup, err := ioutil.TempDir("", "docker-test-oom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cgroup)
+
+	for i := 0; i < 100; i++ {
+		fd, err := newEventfd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		container := &Container{ID: "oom"}
+		oom, err := newOOMNotifier(cgroup, fd, func() { container.State.OOMKilled = true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		container.oom = oom
+		container.State.setRunning(1)
+		// The OOM killer kills the process, which exits right away, before
+		// the kill is noticed in the background
+		event := make([]byte, 8)
+		binary.LittleEndian.PutUint64(event, 1)
+		if _, err := syscall.Write(fd, event); err != nil {
+			t.Fatal(err)
+		}
+		container.drainOOM()
+		container.State.setStopped(137)
+		if !container.State.LastExit.OOMKilled {
+			t.Fatalf("Expected the exit to record the OOM kill signaled before it, got %v", container.State.LastExit)
+		}
+		oom.close()
+	}
+}
+
 func TestRestartStdin(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1155,6 +1245,100 @@ func TestCustomLxcConfig(t *testing.T) {
 	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.cpuset.cpus = 0,1")
 }
 
+func TestInterfacesLxcConfig(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, _, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"/bin/true"},
+	},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	container.NetworkSettings.Interfaces = []InterfaceSettings{
+		{Name: "front", Bridge: "docker0", IPAddress: "172.17.0.2", IPPrefixLen: 16},
+		{Name: "back", Bridge: "br-back", IPAddress: "10.1.0.2", IPPrefixLen: 24, HostVeth: "veth0123456789.1"},
+	}
+
+	container.generateLXCConfig()
+	grepFile(t, container.lxcConfigPath(), "lxc.network.name = front")
+	grepFile(t, container.lxcConfigPath(), "lxc.network.ipv4 = 172.17.0.2/16")
+	grepFile(t, container.lxcConfigPath(), "lxc.network.link = br-back")
+	grepFile(t, container.lxcConfigPath(), "lxc.network.name = back")
+	grepFile(t, container.lxcConfigPath(), "lxc.network.veth.pair = veth0123456789.1")
+	grepFile(t, container.lxcConfigPath(), "lxc.network.ipv4 = 10.1.0.2/24")
+}
+
+func TestAttachNetwork(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	container, _, err := runtime.Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+	},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	defer container.stdin.Close()
+
+	bridge := runtime.networkManager.bridgeIface
+	if _, err := container.AttachNetwork(bridge, ""); err == nil {
+		t.Fatal("Expected an error when connecting a stopped container")
+	}
+
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+	setTimeout(t, "Waiting for the container to be started timed out", 2*time.Second, func() {
+		for !container.State.Running {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// The interface on the bridge of the daemon can't be removed
+	if err := container.DetachNetwork(DefaultInterfaceName); err == nil {
+		t.Fatal("Expected an error when disconnecting the interface on the bridge of the daemon")
+	}
+
+	settings, err := container.AttachNetwork(bridge, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Name != "eth1" || settings.Bridge != bridge || settings.IPAddress == container.NetworkSettings.IPAddress {
+		t.Fatalf("Unexpected interface %v", settings)
+	}
+	if _, err := net.InterfaceByName(settings.HostVeth); err != nil {
+		t.Fatalf("Expected the host side of the veth pair to exist: %s", err)
+	}
+	if len(container.NetworkSettings.Interfaces) != 2 || len(container.hostConfig.NetworkAttach) != 1 {
+		t.Fatalf("Expected the interface to be recorded, got %v and %v", container.NetworkSettings.Interfaces, container.hostConfig.NetworkAttach)
+	}
+	grepFile(t, container.HostsPath, settings.IPAddress)
+
+	if _, err := container.AttachNetwork(bridge, "eth1"); err == nil {
+		t.Fatal("Expected an error when reusing an interface name")
+	}
+
+	if err := container.DetachNetwork("eth1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName(settings.HostVeth); err == nil {
+		t.Fatal("Expected the veth pair to be removed")
+	}
+	if len(container.NetworkSettings.Interfaces) != 1 || len(container.hostConfig.NetworkAttach) != 0 {
+		t.Fatalf("Expected the interface to be forgotten, got %v and %v", container.NetworkSettings.Interfaces, container.hostConfig.NetworkAttach)
+	}
+}
+
 func BenchmarkRunSequencial(b *testing.B) {
 	runtime := mkRuntime(b)
 	defer nuke(runtime)
@@ -1741,3 +1925,230 @@ func TestRestartGhost(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWaitPid(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	done := make(chan error)
+	go func() {
+		done <- waitPid(cmd.Process.Pid)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("waitPid returned before the process exited")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "waitPid did not notice the process exit", time.Second, func() {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRunInit(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	if output, _ := runContainer(runtime, []string{"_", "sh", "-c", "echo $$"}, t); output != "1\n" {
+		t.Fatalf("Expected the command to be pid 1 without -init, got %s", output)
+	}
+
+	// The orphaned sleep is reparented to the init, which must reap it
+	container, err := mkContainer(runtime, []string{"-init", "_", "sh", "-c", "sh -c 'sleep 0.1 &'; sleep 0.5; ps; echo $$; exit 3"}, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	stdout, err := container.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	output, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasSuffix(string(output), "\n1\n") {
+		t.Fatalf("Expected the command not to be pid 1 with -init, got %s", output)
+	}
+	if strings.Contains(string(output), "defunct") || strings.Contains(string(output), " Z ") {
+		t.Fatalf("Expected the zombies to be reaped, got %s", output)
+	}
+	if container.State.ExitCode != 3 {
+		t.Fatalf("Expected the exit code of the command, got %d", container.State.ExitCode)
+	}
+}
+
+func TestUlimits(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	runtime.config.DefaultUlimits = []string{"nofile=512:1024", "core=0"}
+	if output, _ := runContainer(runtime, []string{"_", "sh", "-c", "ulimit -n; ulimit -c"}, t); output != "512\n0\n" {
+		t.Fatalf("Expected the default ulimits, got %s", output)
+	}
+	if output, _ := runContainer(runtime, []string{"-ulimit", "nofile=2048:4096", "_", "sh", "-c", "ulimit -n; ulimit -c"}, t); output != "2048\n0\n" {
+		t.Fatalf("Expected the ulimit of the container to override the default, got %s", output)
+	}
+	if _, _, _, err := ParseRun([]string{"-ulimit", "nofile=4096:2048", "_", "true"}, nil); err == nil {
+		t.Fatal("Expected a soft limit above the hard limit to be refused")
+	}
+}
+
+func TestAppArmorProfile(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, _, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"/bin/true"},
+	},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	container.hostConfig.SecurityOpt = []string{"apparmor=unconfined"}
+	if !runtime.capabilities.AppArmor {
+		if _, err := container.appArmorProfile(); err == nil {
+			t.Fatal("Expected an AppArmor profile to be refused without AppArmor")
+		}
+		return
+	}
+	if container.AppArmorProfile, err = container.appArmorProfile(); err != nil {
+		t.Fatal(err)
+	}
+	container.generateLXCConfig()
+	grepFile(t, container.lxcConfigPath(), "lxc.aa_profile = unconfined")
+
+	container.hostConfig.SecurityOpt = []string{"apparmor=docker-no-such-profile"}
+	if _, err := container.appArmorProfile(); err == nil {
+		t.Fatal("Expected an unknown AppArmor profile to be refused")
+	}
+}
+
+func TestBuildHostsFileKeepsEdits(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{
+		root:            root,
+		Config:          &Config{Hostname: "web"},
+		NetworkSettings: &NetworkSettings{IPAddress: "172.17.0.2"},
+	}
+	if err := container.buildHostnameAndHostsFiles(); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := os.OpenFile(container.HostsPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts.WriteString("10.0.0.1\tdb\n")
+	hosts.Close()
+
+	// The ip changes on the next start
+	container.NetworkSettings.IPAddress = "172.17.0.3"
+	if err := container.buildHostnameAndHostsFiles(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(container.HostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "10.0.0.1\tdb\n") {
+		t.Errorf("Expected the edit of the user to be kept, got %q", content)
+	}
+	if !strings.Contains(string(content), "172.17.0.3\tweb\n") || strings.Contains(string(content), "172.17.0.2") {
+		t.Errorf("Expected the hostname to map to the new ip only, got %q", content)
+	}
+	if strings.Count(string(content), "\tlocalhost\n") != 1 {
+		t.Errorf("Expected the default lines once, got %q", content)
+	}
+}
+
+func TestPublishUnpublishPort(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	tcpPorts, err := newPortAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpPorts, err := newPortAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without firewall, the ports are only mapped by the proxies
+	manager := &NetworkManager{
+		tcpPortAllocator: tcpPorts,
+		udpPortAllocator: udpPorts,
+		portMapper: &PortMapper{
+			tcpMapping:  make(map[int]*net.TCPAddr),
+			tcpProxies:  make(map[int]proxy.Proxy),
+			udpMapping:  make(map[int]*net.UDPAddr),
+			udpProxies:  make(map[int]proxy.Proxy),
+			unixProxies: make(map[string]proxy.Proxy),
+			defaultIp:   net.IPv4(127, 0, 0, 1),
+		},
+	}
+	container := &Container{
+		ID:              "publish",
+		root:            root,
+		Config:          &Config{},
+		hostConfig:      &HostConfig{},
+		NetworkSettings: &NetworkSettings{},
+		runtime:         &Runtime{networkManager: manager},
+		network:         &NetworkInterface{IPNet: net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)}, manager: manager},
+	}
+	container.State.setRunning(1)
+
+	port := NewPort("tcp", "80")
+	published, err := container.PublishPort(port, PortBinding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.network.ReleasePort(port, PortBinding{})
+	mapping := container.NetworkSettings.PortMappingAPI()
+	if len(mapping) != 1 || mapping[0].PrivatePort != 80 || strconv.FormatInt(mapping[0].PublicPort, 10) != published.HostPort || mapping[0].IP != "127.0.0.1" {
+		t.Fatalf("Expected port 80 to be published on 127.0.0.1:%s, got %v", published.HostPort, mapping)
+	}
+	if bindings := container.hostConfig.PortBindings[port]; len(bindings) != 1 || bindings[0] != published {
+		t.Fatalf("Expected the binding to be recorded in the host config, got %v", bindings)
+	}
+
+	released, err := container.UnpublishPort(port, PortBinding{HostPort: published.HostPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0] != published {
+		t.Fatalf("Expected %v to be released, got %v", published, released)
+	}
+	// The port stays exposed, without mapping
+	mapping = container.NetworkSettings.PortMappingAPI()
+	if len(mapping) != 1 || mapping[0].PrivatePort != 0 || mapping[0].PublicPort != 80 {
+		t.Fatalf("Expected port 80 to be exposed only, got %v", mapping)
+	}
+	if bindings := container.hostConfig.PortBindings[port]; len(bindings) != 0 {
+		t.Fatalf("Expected the binding to be removed from the host config, got %v", bindings)
+	}
+	if _, err := container.UnpublishPort(port, PortBinding{}); err == nil {
+		t.Fatal("Expected an error unpublishing a port twice")
+	}
+}
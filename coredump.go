@@ -0,0 +1,343 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	corePatternPath = "/proc/sys/kernel/core_pattern"
+	corePidPath     = "/proc/sys/kernel/core_uses_pid"
+	// The kernel keeps the first 127 bytes of the core pattern
+	corePatternMax = 127
+	// The file of the root of the daemon the core dump handler reads its
+	// settings from
+	coreDumpConfigName = "coredump.json"
+)
+
+var containerIDPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// coreDumpConfig is what the daemon tells the core dump handler, which the
+// kernel runs in its stead
+type coreDumpConfig struct {
+	Dir             string
+	Size            int64
+	PreviousPattern string
+}
+
+// installCoreDumpHandler makes the kernel pipe the core dumps to
+// `docker -coredump`, which collects the ones of the containers in
+// config.CoreDir and forwards the others to the previous core pattern. The
+// previous core pattern is restored on Close. The name of the process comes
+// last: older kernels split the pattern on the spaces it expands to.
+func (runtime *Runtime) installCoreDumpHandler() error {
+	pattern := fmt.Sprintf("|%s -coredump -g %s %%P %%u %%g %%s %%t %%d %%h %%e", utils.SelfPath(), runtime.config.Root)
+	if len(pattern) > corePatternMax {
+		return fmt.Errorf("Unable to collect the core dumps: the core pattern %s is longer than %d bytes", pattern, corePatternMax)
+	}
+	previous, err := ioutil.ReadFile(corePatternPath)
+	if err != nil {
+		return err
+	}
+	config := coreDumpConfig{
+		Dir:             runtime.config.CoreDir,
+		Size:            runtime.config.CoreSize,
+		PreviousPattern: strings.TrimSpace(string(previous)),
+	}
+	// A daemon which didn't exit cleanly left its own pattern behind
+	if strings.HasPrefix(config.PreviousPattern, "|") && strings.Contains(config.PreviousPattern, " -coredump ") {
+		if old, err := readCoreDumpConfig(runtime.config.Root); err == nil {
+			config.PreviousPattern = old.PreviousPattern
+		}
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(runtime.config.Root, coreDumpConfigName), data, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(corePatternPath, []byte(pattern), 0644)
+}
+
+// restoreCorePattern gives the kernel back the core pattern it had before
+// installCoreDumpHandler
+func (runtime *Runtime) restoreCorePattern() error {
+	config, err := readCoreDumpConfig(runtime.config.Root)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(corePatternPath, []byte(config.PreviousPattern), 0644)
+}
+
+func readCoreDumpConfig(root string) (*coreDumpConfig, error) {
+	data, err := ioutil.ReadFile(path.Join(root, coreDumpConfigName))
+	if err != nil {
+		return nil, err
+	}
+	config := &coreDumpConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// containerOfCgroups returns the id of the container a process belongs to
+// according to its /proc/PID/cgroup file, or "" when it doesn't belong to a
+// container
+func containerOfCgroups(cgroupFile string) (string, error) {
+	f, err := os.Open(cgroupFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "4:memory:/lxc/<id>", under the -cgroup-parent if any
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, dir := range strings.Split(parts[2], "/") {
+			if containerIDPattern.MatchString(dir) {
+				return dir, nil
+			}
+		}
+	}
+	return "", scanner.Err()
+}
+
+// coreDumpProcess describes the process the kernel runs the core dump
+// handler for
+type coreDumpProcess struct {
+	Pid    string
+	UID    string
+	GID    string
+	Signal string
+	Time   string
+	// The dump mode of the process, 2 for a core of a setuid process
+	// dumped as root, see suid_dumpable in proc(5)
+	Dumpable string
+	Hostname string
+	Name     string
+}
+
+// expandCorePattern expands the specifiers of the core pattern of the
+// kernel for the process, e.g. /var/crash/core.%e.%p. The specifiers the
+// kernel knows but the handler isn't given are expanded from /proc, and the
+// unknown ones are dropped, as the kernel does.
+func expandCorePattern(pattern string, process *coreDumpProcess) string {
+	var expanded bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			expanded.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			expanded.WriteByte('%')
+		case 'p', 'P', 'i', 'I':
+			expanded.WriteString(process.Pid)
+		case 'u':
+			expanded.WriteString(process.UID)
+		case 'g':
+			expanded.WriteString(process.GID)
+		case 's':
+			expanded.WriteString(process.Signal)
+		case 't':
+			expanded.WriteString(process.Time)
+		case 'h':
+			expanded.WriteString(process.Hostname)
+		case 'e':
+			expanded.WriteString(process.Name)
+		case 'd':
+			expanded.WriteString(process.Dumpable)
+		case 'E':
+			if exe, err := os.Readlink(path.Join("/proc", process.Pid, "exe")); err == nil {
+				expanded.WriteString(strings.Replace(exe, "/", "!", -1))
+			}
+		case 'c':
+			if limit, err := coreLimit(process.Pid); err == nil {
+				if limit < 0 {
+					expanded.WriteString(strconv.FormatUint(utils.RlimInfinity, 10))
+				} else {
+					expanded.WriteString(strconv.FormatInt(limit, 10))
+				}
+			}
+		}
+	}
+	return expanded.String()
+}
+
+// coreLimit returns the soft limit of the size of the cores of the process,
+// -1 when unlimited
+func coreLimit(pid string) (int64, error) {
+	f, err := os.Open(path.Join("/proc", pid, "limits"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "Max core file size        0                    unlimited            bytes"
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Max core file size") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max core file size"))
+		if len(fields) == 0 {
+			break
+		}
+		if fields[0] == "unlimited" {
+			return -1, nil
+		}
+		return strconv.ParseInt(fields[0], 10, 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("No core file size in the limits of process %s", pid)
+}
+
+// forwardCoreDump hands the core of a process of the host to the core
+// pattern the kernel had before the daemon, either a handler to pipe it to
+// or a file, "core" by default, relative to the working directory of the
+// process. As with the kernel, the core of a process with the dump mode 2
+// is only written to an absolute path, and owned by root.
+func forwardCoreDump(pattern string, process *coreDumpProcess, core io.Reader) error {
+	if pattern == "" {
+		pattern = "core"
+	}
+	if strings.HasPrefix(pattern, "|") {
+		// The kernel splits the pattern before expanding each argument
+		args := strings.Fields(pattern[1:])
+		if len(args) == 0 {
+			return nil
+		}
+		for i := range args {
+			args[i] = expandCorePattern(args[i], process)
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = core
+		return cmd.Run()
+	}
+
+	// The pipe bypasses the core limit of the process, which applies to
+	// the files
+	limit, err := coreLimit(process.Pid)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return nil
+	}
+	filename := expandCorePattern(pattern, process)
+	if !strings.Contains(pattern, "%p") {
+		if usesPid, err := ioutil.ReadFile(corePidPath); err == nil && strings.TrimSpace(string(usesPid)) != "0" {
+			filename += "." + process.Pid
+		}
+	}
+	suidSafe := process.Dumpable == "2"
+	if !path.IsAbs(filename) {
+		if suidSafe {
+			return nil
+		}
+		filename = path.Join("/proc", process.Pid, "cwd", filename)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !suidSafe {
+		uid, _ := strconv.Atoi(process.UID)
+		gid, _ := strconv.Atoi(process.GID)
+		if err := f.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if limit > 0 {
+		core = io.LimitReader(core, limit)
+	}
+	_, err = io.Copy(f, core)
+	return err
+}
+
+// CoreDump is the core dump handler the kernel runs, with the core on
+// stdin, when the daemon collects the core dumps. args are the pid, the uid,
+// the gid, the signal and the time of the dump, the dump mode, the hostname
+// and the name of the process, which may have been split on its spaces. The cores of the
+// containers are written to the directory of the daemon, in a directory
+// per container, up to the size limit of the container or else of the
+// daemon. The cores of the processes of the host are forwarded to the core
+// pattern the kernel had before the daemon.
+func CoreDump(root string, args []string, core io.Reader) error {
+	// The kernel waits for the whole core to be read
+	defer io.Copy(ioutil.Discard, core)
+
+	if len(args) < 8 {
+		return fmt.Errorf("Usage: docker -coredump -g ROOT PID UID GID SIGNAL TIME DUMPABLE HOSTNAME NAME")
+	}
+	process := &coreDumpProcess{
+		Pid:      args[0],
+		UID:      args[1],
+		GID:      args[2],
+		Signal:   args[3],
+		Time:     args[4],
+		Dumpable: args[5],
+		Hostname: args[6],
+		Name:     strings.Join(args[7:], " "),
+	}
+	config, err := readCoreDumpConfig(root)
+	if err != nil {
+		return err
+	}
+	id, err := containerOfCgroups(path.Join("/proc", process.Pid, "cgroup"))
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return forwardCoreDump(config.PreviousPattern, process, core)
+	}
+
+	size := config.Size
+	container := &Container{root: path.Join(root, "containers", id)}
+	if err := container.readHostConfig(); err == nil && container.hostConfig.CoreSize != 0 {
+		size = container.hostConfig.CoreSize
+	}
+	if size < 0 {
+		return nil
+	}
+
+	dir := path.Join(config.Dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("core.%s.%s.%s", strings.Replace(process.Name, "/", "_", -1), process.Pid, process.Time)
+	f, err := os.OpenFile(path.Join(dir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if size > 0 {
+		core = io.LimitReader(core, size)
+	}
+	_, err = io.Copy(f, core)
+	return err
+}
@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestContainerOfCgroups(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-coredump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	id := "8a3ba7c3e51b2f9cd7e66a2e5b1a3a8e4da0cb1e0e1e0e0e3e0d1dcae8e4e9f0"
+	for content, expected := range map[string]string{
+		"4:memory:/lxc/" + id + "\n3:cpu:/lxc/" + id + "\n": id,
+		"4:memory:/system.slice/db/lxc/" + id + "\n":        id,
+		"4:memory:/user/1000.user/1.session\n":              "",
+		"":                                                  "",
+	} {
+		cgroupFile := path.Join(tmp, "cgroup")
+		if err := ioutil.WriteFile(cgroupFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		container, err := containerOfCgroups(cgroupFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if container != expected {
+			t.Errorf("Expected the container %q for %q, got %q", expected, content, container)
+		}
+	}
+}
+
+func TestExpandCorePattern(t *testing.T) {
+	process := &coreDumpProcess{Pid: "42", UID: "1000", GID: "100", Signal: "11", Time: "1380000000", Dumpable: "1", Hostname: "host", Name: "my app"}
+	for pattern, expected := range map[string]string{
+		"core":                        "core",
+		"/var/crash/core.%e.%p.%t":    "/var/crash/core.my app.42.1380000000",
+		"%u:%g:%s:%h:%P 100%%":        "1000:100:11:host:42 100%",
+		"core.%z%":                    "core.%",
+		"/usr/share/apport/apport %d": "/usr/share/apport/apport 1",
+	} {
+		if actual := expandCorePattern(pattern, process); actual != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", pattern, expected, actual)
+		}
+	}
+}
+
+func TestForwardCoreDump(t *testing.T) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if limit.Max == 0 {
+		t.Skip("The cores are disabled")
+	}
+	restore := limit
+	limit.Cur = limit.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_CORE, &restore)
+
+	tmp, err := ioutil.TempDir("", "docker-coredump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pid := strconv.Itoa(os.Getpid())
+	process := &coreDumpProcess{Pid: pid, UID: strconv.Itoa(os.Getuid()), GID: strconv.Itoa(os.Getgid()), Name: "app"}
+	for _, pattern := range []string{
+		path.Join(tmp, "core.%e.%p"),
+		"|/usr/bin/tee " + path.Join(tmp, "piped.%e.%p"),
+	} {
+		if err := forwardCoreDump(pattern, process, strings.NewReader("core")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filename := range []string{"core.app." + pid, "piped.app." + pid} {
+		if content, err := ioutil.ReadFile(path.Join(tmp, filename)); err != nil || string(content) != "core" {
+			t.Errorf("Expected the core in %s, got %q (%v)", filename, content, err)
+		}
+	}
+
+	// The core of a setuid process is not written where its user chooses
+	process.Dumpable = "2"
+	if err := forwardCoreDump("core.suid", process, strings.NewReader("core")); err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	if _, err := os.Stat(path.Join(cwd, "core.suid")); err == nil {
+		os.Remove(path.Join(cwd, "core.suid"))
+		t.Error("Expected no core relative to the working directory of a setuid process")
+	}
+}
@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dependencies returns the containers the container needs: the ones it
+// links to, the ones it mounts the volumes of and the ones whose namespaces
+// it joins
+func (runtime *Runtime) dependencies(container *Container) ([]*Container, error) {
+	var dependencies []*Container
+	seen := make(map[string]bool)
+	add := func(dependency *Container) {
+		if !seen[dependency.ID] {
+			seen[dependency.ID] = true
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	children, err := runtime.Children(container.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		add(child)
+	}
+	if container.Config.VolumesFrom != "" {
+		for _, spec := range strings.Split(container.Config.VolumesFrom, ",") {
+			from := runtime.Get(strings.SplitN(spec, ":", 2)[0])
+			if from == nil {
+				return nil, fmt.Errorf("No such container: %s", spec)
+			}
+			add(from)
+		}
+	}
+	if container.hostConfig != nil {
+		for _, mode := range []string{container.hostConfig.PidMode, container.hostConfig.IpcMode} {
+			if name := namespaceModeContainer(mode); name != "" {
+				from := runtime.Get(name)
+				if from == nil {
+					return nil, fmt.Errorf("No such container: %s", name)
+				}
+				add(from)
+			}
+		}
+	}
+	return dependencies, nil
+}
+
+// startOrder returns the containers in an order starting each one after the
+// ones it depends on among them, as given by dependencies: a topological
+// order, where the containers come in the order given, e.g. by priority,
+// unless they are needed first. A dependency cycle is broken where it is
+// found.
+func startOrder(containers []*Container, dependencies func(*Container) []*Container) []*Container {
+	toStart := make(map[string]bool)
+	for _, container := range containers {
+		toStart[container.ID] = true
+	}
+	var order []*Container
+	ordered := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(container *Container, path []string)
+	visit = func(container *Container, path []string) {
+		if ordered[container.ID] {
+			return
+		}
+		path = append(path, container.Name)
+		visiting[container.ID] = true
+		for _, dependency := range dependencies(container) {
+			if !toStart[dependency.ID] {
+				continue
+			}
+			if visiting[dependency.ID] {
+				utils.Errorf("Dependency cycle %s -> %s: starting %s without waiting for %s", strings.Join(path, " -> "), dependency.Name, container.Name, dependency.Name)
+				continue
+			}
+			visit(dependency, path)
+		}
+		visiting[container.ID] = false
+		ordered[container.ID] = true
+		order = append(order, container)
+	}
+	for _, container := range containers {
+		visit(container, nil)
+	}
+	return order
+}
+
+// startInOrder starts the containers one at a time, each one after the ones
+// it depends on among them, the highest priority first among the ones
+// which don't depend on each other. A start taking longer than timeout, 0
+// for no limit, is left to go on while the next containers start.
+// startInOrder returns once all the starts are over or timed out, logging
+// the failed ones.
+func (runtime *Runtime) startInOrder(containers []*Container, timeout time.Duration) {
+	dependencies := make(map[string][]*Container)
+	order := startOrder(containers, func(container *Container) []*Container {
+		found, err := runtime.dependencies(container)
+		if err != nil {
+			utils.Errorf("Unable to find the dependencies of container %s: %s", container.ID, err)
+		}
+		sort.Stable(byPriority(found))
+		dependencies[container.ID] = found
+		return found
+	})
+
+	failed := make(map[string]bool)
+	for _, container := range order {
+		for _, dependency := range dependencies[container.ID] {
+			if failed[dependency.ID] {
+				utils.Errorf("Starting container %s although its dependency %s failed to start", container.ID, dependency.ID)
+			}
+		}
+		done := make(chan error, 1)
+		go func(container *Container) {
+			done <- container.Start()
+		}(container)
+		// A nil channel never fires: no timeout
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = time.After(timeout)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				utils.Errorf("Failed to restart container %s: %s", container.ID, err)
+				failed[container.ID] = true
+			}
+		case <-expired:
+			utils.Errorf("Container %s didn't start within %s, starting the next containers anyway", container.ID, timeout)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// The size of the sparse files backing the thin pool when the daemon
+	// isn't given devices for it
+	defaultDmDataSize     = 100 << 30
+	defaultDmMetadataSize = 2 << 30
+	// The size of the filesystem of the images and containers
+	defaultDmBaseSize = 10 << 30
+	// The name of the empty filesystem every image device is a snapshot of
+	dmBaseDevice = "base"
+)
+
+// dmsetup runs the device-mapper tool with args
+func dmsetup(args ...string) error {
+	if output, err := exec.Command("dmsetup", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("dmsetup %s: %s (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// devmapperSupported reports whether the kernel has thin provisioning and
+// the device-mapper tools are installed
+func devmapperSupported() bool {
+	for _, tool := range []string{"dmsetup", "losetup", "mkfs.ext4"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	if err := exec.Command("modprobe", "dm_thin_pool").Run(); err != nil {
+		return false
+	}
+	return exec.Command("dmsetup", "targets").Run() == nil
+}
+
+// blockDeviceSize returns the size in bytes of the block device dev
+func blockDeviceSize(dev string) (int64, error) {
+	output, err := exec.Command("blockdev", "--getsize64", dev).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get the size of %s: %s", dev, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
+
+// attachLoopback returns a loop device reading and writing the file pth,
+// created sparse with size bytes when it doesn't exist
+func attachLoopback(pth string, size int64) (string, error) {
+	if _, err := os.Stat(pth); os.IsNotExist(err) {
+		f, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", err
+		}
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	output, err := exec.Command("losetup", "-f", "--show", pth).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Unable to attach %s to a loop device: %s (%s)", pth, err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// thinDevice is a thin device of the pool, the filesystem of an image or a
+// container
+type thinDevice struct {
+	ID int
+	// Set once the filesystem of the device is complete
+	Initialized bool
+}
+
+// DeviceSet is the thin pool of the devicemapper driver and its devices,
+// the filesystem of each image being a snapshot of the one of its parent
+// with its layer applied, and the filesystem of each container a snapshot
+// of the one of its image. The list of the devices is kept in devices.json.
+type DeviceSet struct {
+	sync.Mutex
+	root     string
+	pool     string
+	baseSize int64
+
+	NextID  int
+	Devices map[string]*thinDevice
+
+	// Held while the filesystem of an image device is built
+	building sync.Mutex
+}
+
+// NewDeviceSet sets up the thin pool of the devicemapper driver under root,
+// on the devices dataDev and metadataDev, or on sparse files under root for
+// the ones which are empty. baseSize is the size of the filesystems.
+func NewDeviceSet(root, dataDev, metadataDev string, baseSize int64) (*DeviceSet, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	if baseSize == 0 {
+		baseSize = defaultDmBaseSize
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Stat(root, &stat); err != nil {
+		return nil, err
+	}
+	devices := &DeviceSet{
+		root:     root,
+		pool:     fmt.Sprintf("docker-%d-%d-pool", stat.Dev, stat.Ino),
+		baseSize: baseSize,
+		NextID:   1,
+		Devices:  make(map[string]*thinDevice),
+	}
+	if data, err := ioutil.ReadFile(devices.jsonPath()); err == nil {
+		if err := json.Unmarshal(data, devices); err != nil {
+			return nil, fmt.Errorf("Unable to read the devices of the devicemapper driver: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := devices.setupPool(dataDev, metadataDev); err != nil {
+		return nil, err
+	}
+	if err := devices.setupBase(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (devices *DeviceSet) jsonPath() string {
+	return path.Join(devices.root, "devices.json")
+}
+
+// save writes the list of the devices. It is called with the lock held.
+func (devices *DeviceSet) save() error {
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	tmp := devices.jsonPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, devices.jsonPath())
+}
+
+func (devices *DeviceSet) poolPath() string {
+	return path.Join("/dev/mapper", devices.pool)
+}
+
+// dmName returns the name of the device-mapper device of the thin device
+// name
+func (devices *DeviceSet) dmName(name string) string {
+	return strings.TrimSuffix(devices.pool, "pool") + name
+}
+
+// DevicePath returns the path of the block device of the thin device name,
+// once activated
+func (devices *DeviceSet) DevicePath(name string) string {
+	return path.Join("/dev/mapper", devices.dmName(name))
+}
+
+func (devices *DeviceSet) setupPool(dataDev, metadataDev string) error {
+	if _, err := os.Stat(devices.poolPath()); err == nil {
+		return nil
+	}
+	var err error
+	if dataDev == "" {
+		if dataDev, err = attachLoopback(path.Join(devices.root, "data"), defaultDmDataSize); err != nil {
+			return err
+		}
+	}
+	if metadataDev == "" {
+		if metadataDev, err = attachLoopback(path.Join(devices.root, "metadata"), defaultDmMetadataSize); err != nil {
+			return err
+		}
+	}
+	size, err := blockDeviceSize(dataDev)
+	if err != nil {
+		return err
+	}
+	// Blocks of 64KB, and a low water mark of 32768 blocks
+	table := fmt.Sprintf("0 %d thin-pool %s %s 128 32768 1 skip_block_zeroing", size/512, metadataDev, dataDev)
+	if err := dmsetup("create", devices.pool, "--table", table); err != nil {
+		return fmt.Errorf("Unable to create the thin pool of the devicemapper driver: %s", err)
+	}
+	return nil
+}
+
+// setupBase creates the empty filesystem the first image devices are
+// snapshots of
+func (devices *DeviceSet) setupBase() error {
+	if devices.HasDevice(dmBaseDevice) {
+		return nil
+	}
+	// What remains of a setup interrupted
+	if err := devices.DeleteDevice(dmBaseDevice); err != nil {
+		return err
+	}
+	if err := devices.createDevice(dmBaseDevice, ""); err != nil {
+		return err
+	}
+	if err := devices.Activate(dmBaseDevice); err != nil {
+		return err
+	}
+	defer devices.Deactivate(dmBaseDevice)
+	if output, err := exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0", devices.DevicePath(dmBaseDevice)).CombinedOutput(); err != nil {
+		devices.DeleteDevice(dmBaseDevice)
+		return fmt.Errorf("Unable to create the filesystem of the devicemapper driver: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return devices.setInitialized(dmBaseDevice)
+}
+
+// HasDevice reports whether the filesystem of the thin device name is
+// complete
+func (devices *DeviceSet) HasDevice(name string) bool {
+	devices.Lock()
+	defer devices.Unlock()
+	device, exists := devices.Devices[name]
+	return exists && device.Initialized
+}
+
+func (devices *DeviceSet) setInitialized(name string) error {
+	devices.Lock()
+	defer devices.Unlock()
+	device, exists := devices.Devices[name]
+	if !exists {
+		return fmt.Errorf("No such device: %s", name)
+	}
+	device.Initialized = true
+	return devices.save()
+}
+
+func (devices *DeviceSet) activated(name string) bool {
+	_, err := os.Stat(devices.DevicePath(name))
+	return err == nil
+}
+
+// createDevice creates the thin device name, a snapshot of the device
+// origin or an empty device when origin is empty
+func (devices *DeviceSet) createDevice(name, origin string) error {
+	devices.Lock()
+	defer devices.Unlock()
+	if _, exists := devices.Devices[name]; exists {
+		return fmt.Errorf("Conflict: the device %s already exists", name)
+	}
+	id := devices.NextID
+	if origin == "" {
+		if err := dmsetup("message", devices.poolPath(), "0", fmt.Sprintf("create_thin %d", id)); err != nil {
+			return err
+		}
+	} else {
+		originDevice, exists := devices.Devices[origin]
+		if !exists {
+			return fmt.Errorf("No such device: %s", origin)
+		}
+		// An active origin must not change while it is snapshotted
+		if devices.activated(origin) {
+			if err := dmsetup("suspend", devices.dmName(origin)); err != nil {
+				return err
+			}
+			defer dmsetup("resume", devices.dmName(origin))
+		}
+		if err := dmsetup("message", devices.poolPath(), "0", fmt.Sprintf("create_snap %d %d", id, originDevice.ID)); err != nil {
+			return err
+		}
+	}
+	devices.NextID++
+	devices.Devices[name] = &thinDevice{ID: id}
+	return devices.save()
+}
+
+// Activate makes the block device of the thin device name available
+func (devices *DeviceSet) Activate(name string) error {
+	devices.Lock()
+	defer devices.Unlock()
+	device, exists := devices.Devices[name]
+	if !exists {
+		return fmt.Errorf("No such device: %s", name)
+	}
+	if devices.activated(name) {
+		return nil
+	}
+	table := fmt.Sprintf("0 %d thin %s %d", devices.baseSize/512, devices.poolPath(), device.ID)
+	return dmsetup("create", devices.dmName(name), "--table", table)
+}
+
+// Deactivate removes the block device of the thin device name
+func (devices *DeviceSet) Deactivate(name string) error {
+	if !devices.activated(name) {
+		return nil
+	}
+	return dmsetup("remove", devices.dmName(name))
+}
+
+// DeleteDevice deletes the thin device name and frees its blocks, if it
+// exists
+func (devices *DeviceSet) DeleteDevice(name string) error {
+	if err := devices.Deactivate(name); err != nil {
+		return err
+	}
+	devices.Lock()
+	defer devices.Unlock()
+	device, exists := devices.Devices[name]
+	if !exists {
+		return nil
+	}
+	if err := dmsetup("message", devices.poolPath(), "0", fmt.Sprintf("delete %d", device.ID)); err != nil {
+		return err
+	}
+	delete(devices.Devices, name)
+	return devices.save()
+}
+
+// mountDevice mounts the filesystem of the active thin device name on
+// target
+func (devices *DeviceSet) mountDevice(name, target string, flags uintptr, mountLabel string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	var data string
+	if mountLabel != "" {
+		data = fmt.Sprintf("context=\"%s\"", mountLabel)
+	}
+	if err := mount(devices.DevicePath(name), target, "ext4", flags, data); err != nil {
+		return fmt.Errorf("Unable to mount the device %s: %s", name, err)
+	}
+	return nil
+}
+
+// devmapperDevice returns the thin device holding the filesystem of the
+// image, a snapshot of the one of its parent with its layer applied. It is
+// built the first time the image is used.
+func (img *Image) devmapperDevice(devices *DeviceSet) (string, error) {
+	if devices.HasDevice(img.ID) {
+		return img.ID, nil
+	}
+	origin := dmBaseDevice
+	parent, err := img.GetParent()
+	if err != nil {
+		return "", err
+	}
+	if parent != nil {
+		if origin, err = parent.devmapperDevice(devices); err != nil {
+			return "", err
+		}
+	}
+	root, err := img.root()
+	if err != nil {
+		return "", err
+	}
+	layer, err := img.layer()
+	if err != nil {
+		return "", err
+	}
+
+	devices.building.Lock()
+	defer devices.building.Unlock()
+	// Unless another container of the image built it meanwhile
+	if devices.HasDevice(img.ID) {
+		return img.ID, nil
+	}
+	// What remains of a build interrupted
+	if err := devices.DeleteDevice(img.ID); err != nil {
+		return "", err
+	}
+	if err := devices.createDevice(img.ID, origin); err != nil {
+		return "", err
+	}
+	if err := devices.Activate(img.ID); err != nil {
+		return "", err
+	}
+	defer devices.Deactivate(img.ID)
+	mnt := path.Join(root, "devicemapper-mnt")
+	if err := devices.mountDevice(img.ID, mnt, 0, ""); err != nil {
+		return "", err
+	}
+	err = applyAUFSLayer(layer, mnt)
+	if err := unmountAndRemove(mnt); err != nil {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to apply the layer of image %s: %s", img.ID, err)
+	}
+	return img.ID, devices.setInitialized(img.ID)
+}
+
+// devmapperDriver gives each container a snapshot of the thin device of its
+// image, kept until the container is destroyed
+type devmapperDriver struct {
+	devices *DeviceSet
+}
+
+func (driver *devmapperDriver) Mount(container *Container) error {
+	devices := driver.devices
+	image, err := container.GetImage()
+	if err != nil {
+		return err
+	}
+	imageDevice, err := image.devmapperDevice(devices)
+	if err != nil {
+		return err
+	}
+	dockerinitLayer, err := image.getDockerInitLayer()
+	if err != nil {
+		return err
+	}
+	if !devices.HasDevice(container.ID) {
+		if err := devices.DeleteDevice(container.ID); err != nil {
+			return err
+		}
+		if err := devices.createDevice(container.ID, imageDevice); err != nil {
+			return err
+		}
+		if err := devices.setInitialized(container.ID); err != nil {
+			return err
+		}
+	}
+	if err := devices.Activate(container.ID); err != nil {
+		return err
+	}
+	if err := devices.mountDevice(container.ID, container.RootfsPath(), 0, container.MountLabel); err != nil {
+		return err
+	}
+	return addMissingPaths(dockerinitLayer, container.RootfsPath())
+}
+
+// Unmount unmounts the filesystem of the container and removes the block
+// device of its thin device
+func (driver *devmapperDriver) Unmount(container *Container) error {
+	if err := unmountAndRemove(container.RootfsPath()); err != nil {
+		return err
+	}
+	return driver.devices.Deactivate(container.ID)
+}
+
+// Changes returns the changes of the container to the filesystem of its
+// image, without the mountpoints the container got from the dockerinit
+// layer
+func (driver *devmapperDriver) Changes(container *Container) ([]Change, error) {
+	devices := driver.devices
+	image, err := container.GetImage()
+	if err != nil {
+		return nil, err
+	}
+	imageDevice, err := image.devmapperDevice(devices)
+	if err != nil {
+		return nil, err
+	}
+	dockerinitLayer, err := image.getDockerInitLayer()
+	if err != nil {
+		return nil, err
+	}
+	if err := container.EnsureMounted(); err != nil {
+		return nil, err
+	}
+
+	if err := devices.Activate(imageDevice); err != nil {
+		return nil, err
+	}
+	mnt, err := ioutil.TempDir(container.root, "image-")
+	if err != nil {
+		return nil, err
+	}
+	if err := devices.mountDevice(imageDevice, mnt, readOnlyMountFlags, ""); err != nil {
+		os.Remove(mnt)
+		return nil, err
+	}
+	changes, err := changesBetween(mnt, container.RootfsPath())
+	if err := unmountAndRemove(mnt); err != nil {
+		utils.Errorf("Unable to unmount the image of container %s: %s", container.ID, err)
+	}
+	// Other containers of the image may compare with it meanwhile
+	if err := devices.Deactivate(imageDevice); err != nil {
+		utils.Debugf("Image %s still in use: %s", imageDevice, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withoutDockerinitPaths(changes, dockerinitLayer), nil
+}
+
+func (driver *devmapperDriver) ExportChanges(container *Container) (archive.Archive, error) {
+	changes, err := driver.Changes(container)
+	if err != nil {
+		return nil, err
+	}
+	return exportChanges(container.RootfsPath(), changes, container.root)
+}
+
+func (driver *devmapperDriver) ChangesSize(container *Container) int64 {
+	changes, _ := driver.Changes(container)
+	return changedFilesSize(container.RootfsPath(), changes)
+}
+
+func (*devmapperDriver) WritableDir(container *Container) (string, error) {
+	if err := container.EnsureMounted(); err != nil {
+		return "", err
+	}
+	return container.RootfsPath(), nil
+}
+
+func (driver *devmapperDriver) Remove(container *Container) error {
+	return driver.devices.DeleteDevice(container.ID)
+}
+
+func (driver *devmapperDriver) RemoveImage(id, root string) error {
+	return driver.devices.DeleteDevice(id)
+}
+
+func init() {
+	RegisterStorageDriver(DriverDevmapper, 40,
+		func(root string) error {
+			if !devmapperSupported() {
+				return fmt.Errorf("the kernel doesn't support thin provisioning or dmsetup is missing")
+			}
+			return nil
+		},
+		func(root string) bool {
+			_, err := os.Stat(path.Join(root, "devicemapper"))
+			return err == nil
+		},
+		func(runtime *Runtime) (StorageDriver, error) {
+			config := runtime.config
+			devices, err := NewDeviceSet(path.Join(config.Root, "devicemapper"), config.DmDataDev, config.DmMetadataDev, config.DmBaseSize)
+			if err != nil {
+				return nil, err
+			}
+			return &devmapperDriver{devices: devices}, nil
+		})
+}
@@ -0,0 +1,239 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const digestPrefix = "sha256:"
+
+// layerDigest returns the digest of the filesystem layer at layer: the
+// sha256 of its paths, in order, with their type, mode, owner, device
+// numbers, link target and content. The modification times are left out,
+// so that the layers unpacked from different archives of the same files,
+// such as the layers built again from the same Dockerfile, have the same
+// digest.
+func layerDigest(layer string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(layer, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, pth)
+		if err != nil {
+			return err
+		}
+		stat, ok := f.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("Unable to get the owner of %s", pth)
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00%d\x00", rel, uint32(f.Mode()), stat.Uid, stat.Gid, stat.Rdev)
+		switch {
+		case f.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case f.Mode().IsRegular():
+			file, err := os.Open(pth)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			fmt.Fprintf(h, "%d\x00", f.Size())
+			if _, err := io.Copy(h, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentID returns the id derived from the content of the image described
+// by jsonData: the sha256 of its description but its id, size and
+// signatures, with its keys sorted. The description has the digest of the
+// layer of the image and the id of its parent, so that the id covers the
+// whole filesystem of the image.
+func contentID(jsonData []byte) (string, error) {
+	var description map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	// Keep the numbers as they are written
+	decoder.UseNumber()
+	if err := decoder.Decode(&description); err != nil {
+		return "", err
+	}
+	delete(description, "id")
+	delete(description, "Size")
+	// Signing the image doesn't change it
+	delete(description, "signatures")
+	data, err := json.Marshal(description)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// digestID returns the id of the image with digest, sha256:hex, the id
+// derived from its content
+func digestID(digest string) (string, error) {
+	id := strings.TrimPrefix(digest, digestPrefix)
+	if id == digest || len(id) != 64 {
+		return "", fmt.Errorf("Bad parameter %s: a digest is %s and 64 hexadecimal digits", digest, digestPrefix)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", fmt.Errorf("Bad parameter %s: a digest is %s and 64 hexadecimal digits", digest, digestPrefix)
+	}
+	return id, nil
+}
+
+// checkContentIDs checks that the image id and each of its ancestors are
+// described with the digest of their layer, and that their ids are derived
+// from their descriptions: the id of the image then covers all its layers.
+func (graph *Graph) checkContentIDs(id string) error {
+	for id != "" {
+		jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(id)))
+		if err != nil {
+			return err
+		}
+		img, err := NewImgJSON(jsonData)
+		if err != nil {
+			return err
+		}
+		if img.LayerDigest == "" {
+			return fmt.Errorf("the image %s isn't described with the digest of its layer", utils.TruncateID(id))
+		}
+		if derived, err := contentID(jsonData); err != nil {
+			return err
+		} else if derived != id {
+			return fmt.Errorf("the id of the image %s isn't derived from its content", utils.TruncateID(id))
+		}
+		id = img.Parent
+	}
+	return nil
+}
+
+// sharedLayerPath returns where the layer with digest is kept for the
+// images sharing it
+func (graph *Graph) sharedLayerPath(digest string) string {
+	return filepath.Join(graph.Root, "_layers", strings.TrimPrefix(digest, digestPrefix))
+}
+
+// shareLayer replaces the layer of the image stored at root by a link to
+// the identical layer of the other images, or makes it the layer the next
+// images with the same digest link to. It is called with layersLock held.
+func (graph *Graph) shareLayer(root, digest string) error {
+	shared := graph.sharedLayerPath(digest)
+	if _, err := os.Stat(shared); err == nil {
+		if err := os.RemoveAll(layerPath(root)); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(shared), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(layerPath(root), shared); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+	return os.Symlink(shared, layerPath(root))
+}
+
+// RegisterSharedLayer registers img, described with the digest of its
+// layer, with a link to the identical layer the graph already shares
+// instead of unpacking its layer again. It returns false, having
+// registered nothing, when the graph doesn't share such a layer.
+func (graph *Graph) RegisterSharedLayer(jsonData []byte, img *Image) (bool, error) {
+	if !graph.shareLayers || img.LayerDigest == "" {
+		return false, nil
+	}
+	if err := ValidateID(img.ID); err != nil {
+		return false, err
+	}
+	if graph.Exists(img.ID) {
+		return false, fmt.Errorf("Image %s already exists", img.ID)
+	}
+	// The json must be the one of img, whose id depends on the digest of
+	// its layer, for the layer to be trusted without unpacking it
+	if id, err := contentID(jsonData); err != nil {
+		return false, err
+	} else if id != img.ID {
+		return false, fmt.Errorf("Image %s is corrupted: its content is the one of image %s", img.ID, id)
+	}
+
+	graph.layersLock.Lock()
+	defer graph.layersLock.Unlock()
+	shared := graph.sharedLayerPath(img.LayerDigest)
+	if _, err := os.Stat(shared); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	tmp, err := graph.Mktemp("")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return false, err
+	}
+	if err := os.Symlink(shared, layerPath(tmp)); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(layerDigestPath(tmp), []byte(img.LayerDigest), 0600); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(jsonPath(tmp), jsonData, 0600); err != nil {
+		return false, err
+	}
+	if err := StoreSize(img, tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, graph.imageRoot(img.ID)); err != nil {
+		return false, err
+	}
+	img.graph = graph
+	graph.idIndex.Add(img.ID)
+	return true, nil
+}
+
+// releaseLayer removes the shared layer with digest once no image uses it.
+// It is called with layersLock held.
+func (graph *Graph) releaseLayer(digest string) error {
+	shared := graph.sharedLayerPath(digest)
+	if _, err := os.Stat(shared); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	inUse := false
+	if err := graph.walkAll(func(img *Image) {
+		if img.LayerDigest == digest {
+			inUse = true
+		}
+	}); err != nil {
+		return err
+	}
+	if inUse {
+		return nil
+	}
+	return os.RemoveAll(shared)
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"sort"
+)
+
+// layerKey identifies the layer of the image on disk: the images described
+// with the same layer digest share their layer
+func layerKey(img *Image) string {
+	if img.LayerDigest != "" {
+		return img.LayerDigest
+	}
+	return img.ID
+}
+
+// imagesUsage returns the disk usage of the images listed, out of the
+// images of the graph: the size of each with its ancestors, the part of it
+// shared with the other images listed, and the number of containers of
+// each, given by image id in containers. It also returns the space the
+// layers of all the images take, each shared layer counted once, and the
+// part of it no container uses.
+func imagesUsage(images map[string]*Image, listed []string, containers map[string]int) (usages []APIImageUsage, layersSize, reclaimable int64) {
+	sizes := make(map[string]int64)
+	for _, img := range images {
+		sizes[layerKey(img)] = img.Size
+	}
+	// The layers of the image and its ancestors, each once
+	layers := func(id string) map[string]bool {
+		keys := make(map[string]bool)
+		for img := images[id]; img != nil; img = images[img.Parent] {
+			if keys[layerKey(img)] {
+				break
+			}
+			keys[layerKey(img)] = true
+		}
+		return keys
+	}
+
+	users := make(map[string]int)
+	chains := make(map[string]map[string]bool)
+	for _, id := range listed {
+		chains[id] = layers(id)
+		for key := range chains[id] {
+			users[key]++
+		}
+	}
+	used := make(map[string]bool)
+	for id := range containers {
+		for key := range layers(id) {
+			used[key] = true
+		}
+	}
+	for key, size := range sizes {
+		layersSize += size
+		if !used[key] {
+			reclaimable += size
+		}
+	}
+
+	usages = []APIImageUsage{}
+	for _, id := range listed {
+		usage := APIImageUsage{
+			ID:         id,
+			Created:    images[id].Created.Unix(),
+			Containers: containers[id],
+		}
+		for key := range chains[id] {
+			usage.Size += sizes[key]
+			if users[key] > 1 {
+				usage.SharedSize += sizes[key]
+			}
+		}
+		usage.UniqueSize = usage.Size - usage.SharedSize
+		usages = append(usages, usage)
+	}
+	return usages, layersSize, reclaimable
+}
+
+// DiskUsage returns the space the images, the writable layers of the
+// containers and the volumes take on disk. The images are the ones docker
+// images lists: the tagged ones and the ones without children.
+func (srv *Server) DiskUsage() (*APIDiskUsage, error) {
+	runtime := srv.runtime
+	images, err := runtime.graph.Map()
+	if err != nil {
+		return nil, err
+	}
+	heads, err := runtime.graph.Heads()
+	if err != nil {
+		return nil, err
+	}
+	byID := runtime.repositories.ByID()
+	var listed []string
+	for id := range images {
+		if _, head := heads[id]; head || len(byID[id]) > 0 {
+			listed = append(listed, id)
+		}
+	}
+	sort.Strings(listed)
+
+	out := &APIDiskUsage{Containers: []APIContainerUsage{}, Volumes: []APIVolumeUsage{}}
+	containers := make(map[string]int)
+	volumeUsers := make(map[string]int)
+	names := runtime.containerNames()
+	for _, container := range runtime.List() {
+		containers[container.Image]++
+		for _, volume := range container.Volumes {
+			volumeUsers[volume]++
+		}
+		sizeRw, _ := container.GetSize()
+		usage := APIContainerUsage{
+			ID:      container.ID,
+			Names:   names[container.ID],
+			Image:   runtime.repositories.ImageName(container.Image),
+			Running: container.State.Running,
+			SizeRw:  sizeRw,
+		}
+		if usage.Names == nil {
+			usage.Names = []string{}
+		}
+		out.Containers = append(out.Containers, usage)
+	}
+
+	out.Images, out.LayersSize, out.LayersReclaimable = imagesUsage(images, listed, containers)
+	for i := range out.Images {
+		out.Images[i].RepoTags = byID[out.Images[i].ID]
+	}
+
+	volumes, err := runtime.volumes.Map()
+	if err != nil {
+		return nil, err
+	}
+	for id, volume := range volumes {
+		layer, err := volume.layer()
+		if err != nil {
+			return nil, err
+		}
+		out.Volumes = append(out.Volumes, APIVolumeUsage{
+			ID:         id,
+			Path:       layer,
+			Size:       dirSize(layer),
+			Containers: volumeUsers[layer],
+		})
+	}
+	sort.Sort(volumesByID(out.Volumes))
+	return out, nil
+}
+
+type volumesByID []APIVolumeUsage
+
+func (s volumesByID) Len() int           { return len(s) }
+func (s volumesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s volumesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestImagesUsage(t *testing.T) {
+	images := map[string]*Image{
+		"base": {ID: "base", Size: 10},
+		"a":    {ID: "a", Parent: "base", Size: 5},
+		"a2":   {ID: "a2", Parent: "a", Size: 3},
+		"b":    {ID: "b", Parent: "base", LayerDigest: "sha256:bb", Size: 7},
+		// Shares its layer with b
+		"c": {ID: "c", LayerDigest: "sha256:bb", Size: 7},
+	}
+	usages, layersSize, reclaimable := imagesUsage(images, []string{"a2", "b", "c"}, map[string]int{"b": 2})
+	if layersSize != 25 {
+		t.Errorf("Expected the layers to take 25 bytes, the one shared counted once, got %d", layersSize)
+	}
+	if reclaimable != 8 {
+		t.Errorf("Expected the layers of a and a2 to be reclaimable, 8 bytes, got %d", reclaimable)
+	}
+
+	expected := []APIImageUsage{
+		{ID: "a2", Size: 18, SharedSize: 10, UniqueSize: 8},
+		{ID: "b", Size: 17, SharedSize: 17, UniqueSize: 0, Containers: 2},
+		{ID: "c", Size: 7, SharedSize: 7, UniqueSize: 0},
+	}
+	if len(usages) != len(expected) {
+		t.Fatalf("Expected %d images, got %d", len(expected), len(usages))
+	}
+	for i, usage := range usages {
+		if usage.ID != expected[i].ID || usage.Size != expected[i].Size || usage.SharedSize != expected[i].SharedSize || usage.UniqueSize != expected[i].UniqueSize || usage.Containers != expected[i].Containers {
+			t.Errorf("Expected %+v, got %+v", expected[i], usage)
+		}
+	}
+}
@@ -38,13 +38,59 @@ func main() {
 	flEnableIptables := flag.Bool("iptables", true, "Disable iptables within docker")
 	flDefaultIp := flag.String("ip", "0.0.0.0", "Default ip address to use when binding a containers ports")
 	flInterContainerComm := flag.Bool("icc", true, "Enable inter-container communication")
+	flStopContainers := flag.Bool("stop-containers", false, "Stop running containers when the daemon exits")
+	flShutdownTimeout := flag.Int("shutdown-timeout", 10, "Number of seconds to wait for containers to stop when the daemon exits before killing them")
+	flBridgeRouteMetric := flag.Int("bridge-route-metric", 0, "Metric of the route to the bridge network, 0 to keep the kernel's")
+	flBridgeRpFilter := flag.String("bridge-rp-filter", "", "Reverse path filtering of the bridge (0, 1 or 2), empty to keep the system's")
+	flFirewallManager := flag.String("firewall-manager", "", "Hand the port mappings to an external firewall manager instead of iptables: an executable or unix:///path/to/socket")
+	flBridgeArpFilter := flag.String("bridge-arp-filter", "", "ARP filtering of the bridge (0 or 1), empty to keep the system's")
+	var flNatExclude utils.ListOpts
+	flag.Var(&flNatExclude, "nat-exclude", "Destination network (CIDR) the containers reach without NAT, e.g. where their ips are routed")
+	var flDefaultUlimits utils.ListOpts
+	flag.Var(&flDefaultUlimits, "default-ulimit", "Default ulimit of the containers (e.g. -default-ulimit nofile=1024:65536)")
+	var flRegistryMirrors utils.ListOpts
+	flag.Var(&flRegistryMirrors, "registry-mirror", "Mirror tried first for the images of the index, before the ones of -registry-config (e.g. -registry-mirror http://mirror.lan:5000)")
+	var flInsecureRegistries utils.ListOpts
+	flag.Var(&flInsecureRegistries, "insecure-registry", "Registry, host or host:port, used in plain HTTP or without verifying its TLS certificate, besides the ones of -registry-config")
+	var flAuthorizationPlugins utils.ListOpts
+	flag.Var(&flAuthorizationPlugins, "authorization-plugin", "Plugin allowing or denying each API request, in order with the other ones")
+	flGatewayAddr := flag.String("gateway", "", "Address of a SOCKS5 and HTTP CONNECT proxy to reach the containers at their ip or name, e.g. 127.0.0.1:1080")
+	flGatewayAuthFile := flag.String("gateway-auth", "", "File of user:password lines authenticating the clients of the gateway")
 
+	flTestSeed := flag.String("test-seed", "", "Test mode only: derive the ids from this seed and stamp with a mock clock, moved by POST /clock, for reproducible test runs")
+	flHostnameTemplate := flag.String("hostname-template", "", "Go template of the hostname of the containers created without one, e.g. '{{.Name}}.containers.example.com'")
+	flEvictMemory := flag.Int64("evict-memory", 0, "Stop the containers with the lowest priority while the available memory of the host is below this many bytes, 0 to disable")
+	flEvictPressure := flag.Int("evict-pressure", 0, "Stop the containers with the lowest priority while tasks stall on memory more than this percentage of the time (needs /proc/pressure/memory), 0 to disable")
+	flEvictPriorityFloor := flag.Int("evict-priority-floor", 0, "Never stop the containers with at least this priority under memory pressure, 0 for no floor")
+	flCoreDir := flag.String("core-dir", "", "Collect the core dumps of the containers in this directory, in a directory per container")
+	flCoreSize := flag.Int64("core-size", 0, "Maximum size in bytes of the core dumps collected in -core-dir, 0 for no limit")
+	flDependencyTimeout := flag.Int("dependency-timeout", 30, "Number of seconds the daemon waits for each container it restarts to start before starting the next ones, 0 for no limit")
+	flStorageDriver := flag.String("storage-driver", "", "Storage driver of the new containers, aufs, overlay, btrfs or devicemapper (default: btrfs when the root is on btrfs, else aufs when the kernel supports it, else overlay, else devicemapper)")
+	flDmDataDev := flag.String("dm-data-dev", "", "Block device of the data of the thin pool of the devicemapper driver (default: a sparse file under the root)")
+	flDmMetadataDev := flag.String("dm-metadata-dev", "", "Block device of the metadata of the thin pool of the devicemapper driver (default: a sparse file under the root)")
+	flDmBaseSize := flag.Int64("dm-base-size", 0, "Size in bytes of the filesystem of each image and container with the devicemapper driver (default 10GB)")
+	flRegistryConfig := flag.String("registry-config", "", "JSON file of the registry mirrors and insecure registries of the daemon, read again on SIGHUP")
+	flMaxConcurrentDownloads := flag.Int("max-concurrent-downloads", 3, "Number of layers the daemon downloads at the same time, all pulls included")
+	flUpgradeKey := flag.String("upgrade-key", "", "PEM file of the ECDSA public key the releases installed by self-upgrade must be signed with")
+	flUpgradeURL := flag.String("upgrade-url", "https://get.docker.io/builds/Linux/x86_64/docker-latest", "Default URL of the release installed by self-upgrade")
+	flGCMaxAge := flag.Int("gc-max-age", 0, "Remove the containers stopped and the unused images pulled, built or loaded more than this many hours ago, 0 to disable")
+	flGCMaxCount := flag.Int("gc-max-count", 0, "Remove the oldest stopped containers and unused images beyond this many of each, 0 to disable")
+	flGCMinFree := flag.Int64("gc-min-free", 0, "Remove the oldest stopped containers, then unused images, while the disk of the root has less free bytes, 0 to disable")
+	var flGCKeepLabels utils.ListOpts
+	flag.Var(&flGCKeepLabels, "gc-keep-label", "Never remove the containers and images with this label, key or key=value, with -gc-max-age, -gc-max-count or -gc-min-free")
+	flCoreDump := flag.Bool("coredump", false, "Run as the core dump handler of the kernel set up by -core-dir, reading the core on stdin")
 	flag.Parse()
 
 	if *flVersion {
 		showVersion()
 		return
 	}
+	if *flCoreDump {
+		if err := docker.CoreDump(*flRoot, flag.Args(), os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if len(flHosts) > 1 {
 		flHosts = flHosts[1:] //trick to display a nice default value in the usage
 	}
@@ -82,6 +128,39 @@ func main() {
 		job.SetenvList("ProtoAddresses", flHosts)
 		job.Setenv("DefaultIp", *flDefaultIp)
 		job.SetenvBool("InterContainerCommunication", *flInterContainerComm)
+		job.SetenvBool("StopContainers", *flStopContainers)
+		job.SetenvInt("ShutdownTimeout", int64(*flShutdownTimeout))
+		job.SetenvInt("BridgeRouteMetric", int64(*flBridgeRouteMetric))
+		job.Setenv("BridgeRpFilter", *flBridgeRpFilter)
+		job.Setenv("BridgeArpFilter", *flBridgeArpFilter)
+		job.Setenv("FirewallManager", *flFirewallManager)
+		job.SetenvList("NatExclude", flNatExclude)
+		job.SetenvList("DefaultUlimits", flDefaultUlimits)
+		job.Setenv("GatewayAddr", *flGatewayAddr)
+		job.Setenv("GatewayAuthFile", *flGatewayAuthFile)
+		job.Setenv("TestSeed", *flTestSeed)
+		job.Setenv("HostnameTemplate", *flHostnameTemplate)
+		job.SetenvInt("EvictMemory", *flEvictMemory)
+		job.SetenvInt("EvictPressure", int64(*flEvictPressure))
+		job.SetenvInt("EvictPriorityFloor", int64(*flEvictPriorityFloor))
+		job.Setenv("CoreDir", *flCoreDir)
+		job.SetenvInt("CoreSize", *flCoreSize)
+		job.SetenvInt("DependencyTimeout", int64(*flDependencyTimeout))
+		job.Setenv("StorageDriver", *flStorageDriver)
+		job.Setenv("RegistryConfigFile", *flRegistryConfig)
+		job.SetenvList("RegistryMirrors", flRegistryMirrors)
+		job.SetenvList("InsecureRegistries", flInsecureRegistries)
+		job.SetenvList("AuthorizationPlugins", flAuthorizationPlugins)
+		job.Setenv("DmDataDev", *flDmDataDev)
+		job.Setenv("DmMetadataDev", *flDmMetadataDev)
+		job.SetenvInt("DmBaseSize", *flDmBaseSize)
+		job.SetenvInt("MaxConcurrentDownloads", int64(*flMaxConcurrentDownloads))
+		job.Setenv("UpgradeKeyFile", *flUpgradeKey)
+		job.Setenv("UpgradeURL", *flUpgradeURL)
+		job.SetenvInt("GCMaxAge", int64(*flGCMaxAge))
+		job.SetenvInt("GCMaxCount", int64(*flGCMaxCount))
+		job.SetenvInt("GCMinFree", *flGCMinFree)
+		job.SetenvList("GCKeepLabels", flGCKeepLabels)
 		if err := job.Run(); err != nil {
 			log.Fatal(err)
 		}
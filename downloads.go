@@ -0,0 +1,373 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxConcurrentDownloads is the number of layers the daemon
+// downloads at the same time, all pulls included, without
+// -max-concurrent-downloads
+const defaultMaxConcurrentDownloads = 3
+
+// downloadScheduler shares the download slots among the images being
+// pulled, round-robin: when a slot frees, it goes to the next image with a
+// layer waiting, and that image goes back to the end of the line. The pull
+// of a big image then doesn't hold up the pulls of the small ones started
+// after it until it completes. A nil scheduler doesn't limit anything.
+type downloadScheduler struct {
+	sync.Mutex
+	free int
+	// The waiting downloads of each image, first come first served
+	waiting map[string][]chan struct{}
+	// The images with waiting downloads, the next one to serve first
+	images []string
+}
+
+// newDownloadScheduler returns a scheduler of slots downloads at the same
+// time, or of the default number when slots isn't positive
+func newDownloadScheduler(slots int) *downloadScheduler {
+	if slots <= 0 {
+		slots = defaultMaxConcurrentDownloads
+	}
+	return &downloadScheduler{
+		free:    slots,
+		waiting: make(map[string][]chan struct{}),
+	}
+}
+
+// acquire asks for a slot to download a layer of the image, and returns a
+// channel closed once the slot is given
+func (s *downloadScheduler) acquire(image string) <-chan struct{} {
+	ready := make(chan struct{})
+	if s == nil {
+		close(ready)
+		return ready
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.free > 0 && len(s.images) == 0 {
+		s.free--
+		close(ready)
+		return ready
+	}
+	if len(s.waiting[image]) == 0 {
+		s.images = append(s.images, image)
+	}
+	s.waiting[image] = append(s.waiting[image], ready)
+	return ready
+}
+
+// release gives the slot of a completed download to the next image
+func (s *downloadScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.images) == 0 {
+		s.free++
+		return
+	}
+	image := s.images[0]
+	s.images = s.images[1:]
+	waiting := s.waiting[image]
+	close(waiting[0])
+	if len(waiting) > 1 {
+		s.waiting[image] = waiting[1:]
+		s.images = append(s.images, image)
+	} else {
+		delete(s.waiting, image)
+	}
+}
+
+// maxDownloadAttempts is how many times the download of a layer is tried,
+// resuming where the previous attempt stopped, before the pull fails
+const maxDownloadAttempts = 5
+
+// partialLayerPath returns where the layer of the image id is kept while it
+// downloads, so that a pull interrupted resumes where it stopped
+func (graph *Graph) partialLayerPath(id string) string {
+	return path.Join(graph.Root, "_downloads", id+".layer")
+}
+
+// downloadLayer downloads the layer of the image id, of size bytes when
+// known, resuming the download the previous pulls left over if any, and
+// resuming it again when the connection drops. The returned file is to be
+// checked with checkLayer, and removed once the layer is registered.
+func (srv *Server) downloadLayer(r *registry.Registry, out io.Writer, id, endpoint string, token []string, size int, sf *utils.StreamFormatter) (*os.File, error) {
+	partialPath := srv.runtime.graph.partialLayerPath(id)
+	if err := os.MkdirAll(path.Dir(partialPath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		offset, err := f.Seek(0, os.SEEK_END)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if size > 0 && offset == int64(size) {
+			break
+		}
+		if offset > 0 {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Resuming", fmt.Sprintf("from %s", utils.HumanSize(offset))))
+		}
+		layer, err := r.GetRemoteImageLayerFrom(id, endpoint, token, offset)
+		if err == nil {
+			if layer.Offset != offset {
+				// The registry sent the whole layer
+				if err := f.Truncate(layer.Offset); err != nil {
+					layer.Close()
+					f.Close()
+					return nil, err
+				}
+				if _, err := f.Seek(layer.Offset, os.SEEK_SET); err != nil {
+					layer.Close()
+					f.Close()
+					return nil, err
+				}
+			}
+			_, err = io.Copy(f, utils.ProgressReader(layer, size-int(layer.Offset), out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false))
+			layer.Close()
+			if err == nil {
+				break
+			}
+		}
+		// Only a network error is worth another attempt. The partial layer
+		// is kept for the next pull either way.
+		if _, ok := err.(net.Error); (!ok && err != io.ErrUnexpectedEOF) || attempt == maxDownloadAttempts {
+			f.Close()
+			return nil, err
+		}
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Retrying", fmt.Sprintf("in %ds after %s", attempt, err)))
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// checkLayer checks the layer downloaded for the image id against
+// checksum, when known, and rewinds it. It is done once the download slot
+// of the layer is released, the bytes being on disk already.
+func checkLayer(out io.Writer, layer io.ReadSeeker, id string, imgJSON []byte, checksum string, sf *utils.StreamFormatter) error {
+	// The older registries know the images by other checksums
+	if !strings.HasPrefix(checksum, "tarsum+") {
+		return nil
+	}
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Verifying", "checksum"))
+	sum, err := layerChecksum(layer, imgJSON)
+	if err != nil {
+		return err
+	}
+	if sum != "" && sum != checksum {
+		return fmt.Errorf("Image %s is corrupted: the checksum of its layer is %s, expected %s", id, sum, checksum)
+	}
+	_, err = layer.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// layerChecksum returns the tarsum of the layer, whatever its compression,
+// with the json of its image, the checksum the registries know images by
+func layerChecksum(layer io.Reader, imgJSON []byte) (string, error) {
+	tarLayer, err := archive.DecompressStream(layer)
+	if err != nil {
+		return "", err
+	}
+	ts := &utils.TarSum{Reader: tarLayer, DisableCompression: true}
+	if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+		return "", err
+	}
+	return ts.Sum(imgJSON), nil
+}
+
+// partialImportPath returns where the tarball imported from src is kept
+// while it downloads, so that an import interrupted resumes where it
+// stopped. The validator of the tarball, see remoteTarball, is kept next to
+// it.
+func (graph *Graph) partialImportPath(src string) string {
+	h := sha256.New()
+	h.Write([]byte(src))
+	return path.Join(graph.Root, "_downloads", "import-"+hex.EncodeToString(h.Sum(nil))+".tar")
+}
+
+// remoteTarball is the tarball of an import, downloaded from Offset on
+type remoteTarball struct {
+	io.ReadCloser
+	Offset int64
+	// The size of the whole tarball, -1 when the server doesn't tell it
+	Size int64
+	// The ETag or the Last-Modified of the tarball, which tells whether it
+	// changed since a download was interrupted, "" when the server gives
+	// neither
+	Validator string
+}
+
+// getRemoteTarball downloads the tarball at src from offset on, if it is
+// still the one of validator. The server sends the whole tarball when it
+// changed or when it doesn't support ranges.
+func getRemoteTarball(src string, offset int64, validator string) (*remoteTarball, error) {
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	tarball := &remoteTarball{ReadCloser: res.Body, Size: res.ContentLength}
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		tarball.Validator = etag
+	} else {
+		tarball.Validator = res.Header.Get("Last-Modified")
+	}
+	switch {
+	case res.StatusCode == 200:
+		return tarball, nil
+	case res.StatusCode == 206 && offset > 0:
+		var start, end int64
+		var total string
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err != nil || start != offset {
+			res.Body.Close()
+			return nil, fmt.Errorf("Invalid Content-Range %q from %s", res.Header.Get("Content-Range"), src)
+		}
+		tarball.Offset = offset
+		tarball.Size = -1
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			tarball.Size = size
+		}
+		return tarball, nil
+	case res.StatusCode == 416 && offset > 0:
+		// Nothing left after offset, or offset is past the tarball: start over
+		res.Body.Close()
+		return getRemoteTarball(src, 0, "")
+	}
+	res.Body.Close()
+	return nil, fmt.Errorf("Got HTTP status code %d while downloading %s", res.StatusCode, src)
+}
+
+// downloadImport downloads the tarball to import from src, resuming the
+// download an interrupted import left over if the tarball didn't change
+// since, and resuming it again when the connection drops. Once complete,
+// the tarball is checked against checksum, sha256:hex, when given. The
+// returned file is to be removed with removePartialImport once imported.
+func (srv *Server) downloadImport(src, checksum string, out io.Writer, sf *utils.StreamFormatter) (*os.File, error) {
+	partialPath := srv.runtime.graph.partialImportPath(src)
+	if err := os.MkdirAll(path.Dir(partialPath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	validator, _ := ioutil.ReadFile(partialPath + ".validator")
+	size := int64(-1)
+	for attempt := 1; ; attempt++ {
+		offset, err := f.Seek(0, os.SEEK_END)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if size >= 0 && offset == size {
+			break
+		}
+		if offset > 0 && len(validator) == 0 {
+			// Without a validator, the tarball may have changed
+			offset = 0
+		}
+		if offset > 0 {
+			out.Write(sf.FormatProgress("", "Resuming", fmt.Sprintf("from %s", utils.HumanSize(offset))))
+		}
+		tarball, err := getRemoteTarball(src, offset, string(validator))
+		if err == nil {
+			if err := f.Truncate(tarball.Offset); err != nil {
+				tarball.Close()
+				f.Close()
+				return nil, err
+			}
+			if _, err := f.Seek(tarball.Offset, os.SEEK_SET); err != nil {
+				tarball.Close()
+				f.Close()
+				return nil, err
+			}
+			size, validator = tarball.Size, []byte(tarball.Validator)
+			if err := ioutil.WriteFile(partialPath+".validator", validator, 0600); err != nil {
+				tarball.Close()
+				f.Close()
+				return nil, err
+			}
+			left := -1
+			if size >= 0 {
+				left = int(size - tarball.Offset)
+			}
+			_, err = io.Copy(f, utils.ProgressReader(tarball, left, out, sf.FormatProgress("", "Downloading", "%8v/%v (%v)"), sf, false))
+			tarball.Close()
+			if err == nil {
+				break
+			}
+		}
+		// Only a network error is worth another attempt. The partial
+		// tarball is kept for the next import either way.
+		if _, ok := err.(net.Error); (!ok && err != io.ErrUnexpectedEOF) || attempt == maxDownloadAttempts {
+			f.Close()
+			return nil, err
+		}
+		out.Write(sf.FormatProgress("", "Retrying", fmt.Sprintf("in %ds after %s", attempt, err)))
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if checksum != "" {
+		out.Write(sf.FormatProgress("", "Verifying", "checksum"))
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if sum := digestPrefix + hex.EncodeToString(h.Sum(nil)); sum != checksum {
+			removePartialImport(f)
+			return nil, fmt.Errorf("The tarball %s is corrupted: its checksum is %s, expected %s", src, sum, checksum)
+		}
+		if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// removePartialImport closes and removes the tarball downloaded for an
+// import, and its validator
+func removePartialImport(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+	os.Remove(f.Name() + ".validator")
+}
@@ -0,0 +1,200 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadSchedulerRoundRobin(t *testing.T) {
+	s := newDownloadScheduler(1)
+
+	select {
+	case <-s.acquire("big"):
+	default:
+		t.Fatal("Expected the free slot to be given at once")
+	}
+	big2, big3 := s.acquire("big"), s.acquire("big")
+	small := s.acquire("small")
+
+	for _, next := range []struct {
+		name  string
+		ready <-chan struct{}
+	}{
+		{"the second layer of big", big2},
+		{"the layer of small", small},
+		{"the third layer of big", big3},
+	} {
+		s.release()
+		select {
+		case <-next.ready:
+		default:
+			t.Fatalf("Expected the slot to go to %s", next.name)
+		}
+	}
+	s.release()
+	if s.free != 1 || len(s.images) != 0 || len(s.waiting) != 0 {
+		t.Fatalf("Expected the slot to be free once the downloads complete, got %d free slots and %v waiting", s.free, s.images)
+	}
+}
+
+func TestLayerChecksum(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	content := []byte("hello world")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	imgJSON := []byte(`{"id":"abc"}`)
+
+	// What a push uploads and the checksum it sends
+	ts := &utils.TarSum{Reader: bytes.NewReader(buf.Bytes())}
+	uploaded, err := ioutil.ReadAll(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ts.Sum(imgJSON)
+
+	for _, layer := range [][]byte{uploaded, buf.Bytes()} {
+		sum, err := layerChecksum(bytes.NewReader(layer), imgJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Fatalf("Expected the checksum %s, got %s", expected, sum)
+		}
+	}
+	if sum, _ := layerChecksum(bytes.NewReader(buf.Bytes()), []byte(`{"id":"def"}`)); sum == expected {
+		t.Fatal("The checksum should depend on the json of the image")
+	}
+}
+
+func TestDownloadImportResume(t *testing.T) {
+	srv := tempSaveServer(t)
+	defer os.RemoveAll(srv.runtime.graph.Root)
+
+	tarball := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "rootfs.tar", time.Time{}, bytes.NewReader(tarball))
+	}))
+	defer ts.Close()
+	src := ts.URL + "/rootfs.tar"
+	h := sha256.New()
+	h.Write(tarball)
+	checksum := digestPrefix + hex.EncodeToString(h.Sum(nil))
+
+	// An import interrupted half way
+	partialPath := srv.runtime.graph.partialImportPath(src)
+	if err := os.MkdirAll(path.Dir(partialPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partialPath, tarball[:4000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partialPath+".validator", []byte(`"v1"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sf := utils.NewStreamFormatter(true)
+	f, err := srv.downloadImport(src, checksum, new(bytes.Buffer), sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	removePartialImport(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tarball) {
+		t.Fatalf("Expected the resumed tarball to be whole, got %d bytes", len(data))
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=4000-" {
+		t.Fatalf("Expected the download to resume at 4000, got ranges %v", ranges)
+	}
+
+	// The tarball changed since the import was interrupted
+	if err := ioutil.WriteFile(partialPath, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partialPath+".validator", []byte(`"v0"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = srv.downloadImport(src, checksum, new(bytes.Buffer), sf); err != nil {
+		t.Fatal(err)
+	}
+	removePartialImport(f)
+
+	if _, err := srv.downloadImport(src, digestPrefix+strings.Repeat("0", 64), new(bytes.Buffer), sf); err == nil {
+		t.Fatal("Expected a tarball with another checksum to be refused")
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the corrupted tarball to be removed, got %v", err)
+	}
+}
+
+func TestImageImportSameURL(t *testing.T) {
+	srv := tempSaveServer(t)
+	defer os.RemoveAll(srv.runtime.graph.Root)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+	tarball := buf.Bytes()
+
+	var lock sync.Mutex
+	downloading, concurrent := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if downloading++; downloading > concurrent {
+			concurrent = downloading
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		w.Write(tarball)
+		lock.Lock()
+		downloading--
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	errs := make(chan error)
+	for _, tag := range []string{"first", "second"} {
+		go func(tag string) {
+			errs <- srv.ImageImport(ts.URL+"/rootfs.tar", "imported", tag, "", nil, new(bytes.Buffer), utils.NewStreamFormatter(true))
+		}(tag)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if concurrent != 1 {
+		t.Fatalf("Expected the imports of the same tarball to download it in turn, got %d downloads at once", concurrent)
+	}
+	for _, tag := range []string{"first", "second"} {
+		if img, err := srv.runtime.repositories.GetImage("imported", tag); err != nil || img == nil {
+			t.Fatalf("Expected imported:%s to be imported, got %v, %v", tag, img, err)
+		}
+	}
+}
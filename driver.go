@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The storage drivers of the filesystem of the containers: AUFS and overlay
+// mount the union of the layers of their image under their rw layer, and
+// btrfs and devicemapper snapshot the filesystem of their image
+const (
+	DriverAUFS      = "aufs"
+	DriverOverlay   = "overlay"
+	DriverBtrfs     = "btrfs"
+	DriverDevmapper = "devicemapper"
+)
+
+// The layers are stored the way AUFS reads them, whatever the driver: a
+// deleted file is a ".wh." file next to where it was, and a directory
+// hiding the content of the layers below holds an ".wh..wh..opq" file.
+const (
+	aufsWhiteoutPrefix = ".wh."
+	aufsMetaPrefix     = ".wh..wh."
+	aufsOpaque         = ".wh..wh..opq"
+)
+
+const filesystemsPath = "/proc/filesystems"
+
+// filesystemListed reports whether the filesystem type fstype is in the
+// list of the filesystems of the kernel at procFile
+func filesystemListed(procFile, fstype string) (bool, error) {
+	f, err := os.Open(procFile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "nodev	overlay"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// filesystemSupported reports whether the kernel can mount fstype, loading
+// its module when it isn't loaded yet
+func filesystemSupported(fstype string) bool {
+	if listed, err := filesystemListed(filesystemsPath, fstype); err == nil && listed {
+		return true
+	}
+	if err := exec.Command("modprobe", fstype).Run(); err != nil {
+		return false
+	}
+	listed, err := filesystemListed(filesystemsPath, fstype)
+	return err == nil && listed
+}
+
+// A StorageDriver gives the containers their filesystem, made from the
+// layers of their image, and keeps track of their changes to it. The
+// drivers register themselves with RegisterStorageDriver.
+type StorageDriver interface {
+	// Mount gives the container its filesystem, at its RootfsPath
+	Mount(container *Container) error
+	// Unmount takes the filesystem of the container away, keeping its
+	// changes
+	Unmount(container *Container) error
+	// Changes returns the changes of the container to its image
+	Changes(container *Container) ([]Change, error)
+	// ExportChanges returns a tar archive of the changes of the container,
+	// with the whiteouts of AUFS, the format of the layers of the images
+	ExportChanges(container *Container) (archive.Archive, error)
+	// ChangesSize returns the size of the files the container changed
+	ChangesSize(container *Container) int64
+	// WritableDir returns the directory the files added to the container
+	// from outside are written to
+	WritableDir(container *Container) (string, error)
+	// Remove frees the filesystem of a destroyed container
+	Remove(container *Container) error
+	// RemoveImage frees what the driver made of the image id, deleted,
+	// whose directory is now root
+	RemoveImage(id, root string) error
+}
+
+// A relabelingDriver keeps the SELinux labels of the files of the
+// containers instead of giving them their mount label at mount time
+type relabelingDriver interface {
+	Relabel(container *Container) error
+}
+
+// A quotaDriver can limit the disk space of the changes of a container
+type quotaDriver interface {
+	SetDiskQuota(container *Container, size int64) error
+}
+
+// storageDriverInfo is what the daemon knows of a registered storage driver
+type storageDriverInfo struct {
+	name     string
+	priority int
+	check    func(root string) error
+	inUse    func(root string) bool
+	init     func(runtime *Runtime) (StorageDriver, error)
+}
+
+// The registered storage drivers, by priority
+var storageDrivers []*storageDriverInfo
+
+// RegisterStorageDriver makes the storage driver name available. check
+// returns why the driver can't store the containers under root on this
+// host, or nil, and init sets the driver up for the runtime. Without
+// -storage-driver, the daemon picks the supported driver with the lowest
+// priority. inUse, which may be nil, reports whether the driver has data
+// under root, to be managed even when the new containers use another
+// driver.
+func RegisterStorageDriver(name string, priority int, check func(root string) error, inUse func(root string) bool, init func(runtime *Runtime) (StorageDriver, error)) {
+	if lookupStorageDriver(name) != nil {
+		panic("Storage driver registered twice: " + name)
+	}
+	info := &storageDriverInfo{name: name, priority: priority, check: check, inUse: inUse, init: init}
+	i := 0
+	for i < len(storageDrivers) && storageDrivers[i].priority <= priority {
+		i++
+	}
+	storageDrivers = append(storageDrivers[:i], append([]*storageDriverInfo{info}, storageDrivers[i:]...)...)
+}
+
+func lookupStorageDriver(name string) *storageDriverInfo {
+	for _, info := range storageDrivers {
+		if info.name == name {
+			return info
+		}
+	}
+	return nil
+}
+
+// storageDriverNames returns the names of the registered storage drivers,
+// by priority
+func storageDriverNames() []string {
+	var names []string
+	for _, info := range storageDrivers {
+		names = append(names, info.name)
+	}
+	return names
+}
+
+// chooseStorageDriver returns the driver the new containers are to be
+// stored with under root: requested, or else the supported driver with the
+// lowest priority. The containers keep the driver they were created with,
+// as their changes are stored differently.
+func chooseStorageDriver(requested, root string) (string, error) {
+	if requested != "" {
+		info := lookupStorageDriver(requested)
+		if info == nil {
+			return "", fmt.Errorf("Bad parameter storage driver: %s, expected one of %s", requested, strings.Join(storageDriverNames(), ", "))
+		}
+		if err := info.check(root); err != nil {
+			return "", fmt.Errorf("Impossible to use the %s storage driver: %s", requested, err)
+		}
+		return requested, nil
+	}
+	for _, info := range storageDrivers {
+		err := info.check(root)
+		if err == nil {
+			return info.name, nil
+		}
+		utils.Debugf("Not using the %s storage driver: %s", info.name, err)
+	}
+	log.Printf("WARNING: none of the storage drivers %s is supported on this host, the containers won't start", strings.Join(storageDriverNames(), ", "))
+	return DriverAUFS, nil
+}
@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChooseStorageDriver(t *testing.T) {
+	registered := storageDrivers
+	defer func() { storageDrivers = registered }()
+	storageDrivers = nil
+
+	supported := func(root string) error { return nil }
+	unsupported := func(root string) error { return fmt.Errorf("unsupported") }
+	RegisterStorageDriver("slow", 30, supported, nil, nil)
+	RegisterStorageDriver("missing", 10, unsupported, nil, nil)
+	RegisterStorageDriver("fast", 20, supported, nil, nil)
+
+	if names := strings.Join(storageDriverNames(), ","); names != "missing,fast,slow" {
+		t.Fatalf("Expected the drivers by priority, got %s", names)
+	}
+	for requested, expected := range map[string]string{"": "fast", "slow": "slow"} {
+		if driver, err := chooseStorageDriver(requested, "/"); err != nil {
+			t.Fatal(err)
+		} else if driver != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, requested, driver)
+		}
+	}
+	for _, requested := range []string{"missing", "unknown"} {
+		if _, err := chooseStorageDriver(requested, "/"); err == nil {
+			t.Errorf("Expected an error for %s", requested)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic registering a driver twice")
+		}
+	}()
+	RegisterStorageDriver("fast", 40, supported, nil, nil)
+}
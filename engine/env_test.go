@@ -27,3 +27,14 @@ func TestSetenv(t *testing.T) {
 		t.Fatalf("Getenv returns incorrect value: %s", val)
 	}
 }
+
+func TestSetenvInt(t *testing.T) {
+	job := mkJob(t, "dummy")
+	job.SetenvInt("foo", 42)
+	if val := job.GetenvInt("foo"); val != 42 {
+		t.Fatalf("GetenvInt returns incorrect value: %d", val)
+	}
+	if val := job.GetenvInt("nonexistent"); val != -1 {
+		t.Fatalf("GetenvInt returns incorrect value: %d", val)
+	}
+}
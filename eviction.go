@@ -0,0 +1,168 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	meminfoPath        = "/proc/meminfo"
+	memoryPressurePath = "/proc/pressure/memory"
+	evictionInterval   = 5 * time.Second
+	evictionStopTime   = 10 // seconds to stop an evicted container
+	// The memory freed by an eviction takes time to show, in the averages
+	// of the pressure stall information especially: the next eviction waits
+	// for the memory to be checked again after this long
+	evictionCooldown = 30 * time.Second
+)
+
+// readMemAvailable returns the memory available to new processes without
+// swapping, in bytes. Kernels older than 3.14 don't report it, and the free
+// memory and the page cache are counted instead.
+func readMemAvailable(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemAvailable:    1234567 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if available, exists := values["MemAvailable"]; exists {
+		return available, nil
+	}
+	if _, exists := values["MemFree"]; !exists {
+		return 0, fmt.Errorf("No MemFree in %s", path)
+	}
+	return values["MemFree"] + values["Buffers"] + values["Cached"], nil
+}
+
+// readMemoryPressure returns the share of the last 10 seconds, in percent,
+// some tasks were stalled on memory, from the pressure stall information
+// of the kernel
+func readMemoryPressure(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "some avg10=1.53 avg60=0.87 avg300=0.22 total=12345"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				return strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("No avg10 of some in %s", path)
+}
+
+// memoryPressure returns why the host is under memory pressure according
+// to the thresholds of the daemon, or "" when it isn't
+func (runtime *Runtime) memoryPressure() (string, error) {
+	if threshold := runtime.config.EvictMemory; threshold > 0 {
+		available, err := readMemAvailable(meminfoPath)
+		if err != nil {
+			return "", err
+		}
+		if available < threshold {
+			return fmt.Sprintf("%s available, below %s", utils.HumanSize(available), utils.HumanSize(threshold)), nil
+		}
+	}
+	if threshold := runtime.config.EvictPressure; threshold > 0 {
+		pressure, err := readMemoryPressure(memoryPressurePath)
+		if err != nil {
+			return "", err
+		}
+		if pressure > float64(threshold) {
+			return fmt.Sprintf("tasks stalled on memory %.2f%% of the time, above %d%%", pressure, threshold), nil
+		}
+	}
+	return "", nil
+}
+
+// evictionCandidate returns the running container to stop first under
+// memory pressure: the one with the lowest priority, the last started one
+// among equals. The containers with a priority of at least floor are never
+// stopped, unless floor is 0. It returns nil when no container can be
+// stopped.
+func evictionCandidate(containers []*Container, floor int) *Container {
+	var candidate *Container
+	for _, container := range containers {
+		if !container.State.Running || container.State.Ghost {
+			continue
+		}
+		priority := container.priority()
+		if floor != 0 && priority >= floor {
+			continue
+		}
+		if candidate == nil {
+			candidate = container
+			continue
+		}
+		candidatePriority := candidate.priority()
+		if priority < candidatePriority || (priority == candidatePriority && container.State.StartedAt.After(candidate.State.StartedAt)) {
+			candidate = container
+		}
+	}
+	return candidate
+}
+
+// watchMemoryPressure checks the memory of the host every evictionInterval
+// and, while it is under pressure, stops one container at a time before the
+// OOM killer picks processes arbitrarily. After each eviction it waits
+// evictionCooldown before checking again.
+func (srv *Server) watchMemoryPressure() {
+	for {
+		time.Sleep(evictionInterval)
+		reason, err := srv.runtime.memoryPressure()
+		if err != nil {
+			utils.Errorf("Unable to check the memory pressure: %s", err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		container := evictionCandidate(srv.runtime.List(), srv.runtime.config.EvictPriorityFloor)
+		if container == nil {
+			continue
+		}
+		log.Printf("Memory pressure (%s): stopping container %s", reason, container.ShortID())
+		if err := container.Stop(evictionStopTime); err != nil {
+			utils.Errorf("Unable to evict container %s: %s", container.ShortID(), err)
+			continue
+		}
+		srv.LogEvent("evict", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+		time.Sleep(evictionCooldown)
+	}
+}
@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReadMemAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meminfo := path.Join(dir, "meminfo")
+	if err := ioutil.WriteFile(meminfo, []byte("MemTotal:        2048 kB\nMemFree:          100 kB\nMemAvailable:     500 kB\nBuffers:           10 kB\nCached:            20 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if available, err := readMemAvailable(meminfo); err != nil || available != 500*1024 {
+		t.Fatalf("Expected 512000 bytes available, got %d (%v)", available, err)
+	}
+
+	// Kernels before 3.14
+	if err := ioutil.WriteFile(meminfo, []byte("MemTotal:        2048 kB\nMemFree:          100 kB\nBuffers:           10 kB\nCached:            20 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if available, err := readMemAvailable(meminfo); err != nil || available != 130*1024 {
+		t.Fatalf("Expected 133120 bytes available, got %d (%v)", available, err)
+	}
+}
+
+func TestReadMemoryPressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-pressure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pressure := path.Join(dir, "memory")
+	if err := ioutil.WriteFile(pressure, []byte("some avg10=12.50 avg60=3.00 avg300=1.00 total=123\nfull avg10=2.00 avg60=1.00 avg300=0.50 total=45\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := readMemoryPressure(pressure); err != nil || value != 12.5 {
+		t.Fatalf("Expected a pressure of 12.5, got %f (%v)", value, err)
+	}
+
+	if err := ioutil.WriteFile(pressure, []byte("full avg10=2.00 avg60=1.00 avg300=0.50 total=45\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMemoryPressure(pressure); err == nil {
+		t.Fatal("Expected an error without the some line")
+	}
+}
+
+func TestEvictionCandidate(t *testing.T) {
+	started := time.Now()
+	newContainer := func(id string, priority int, running bool, startedAt time.Time) *Container {
+		container := &Container{ID: id, hostConfig: &HostConfig{Priority: priority}}
+		container.State.Running = running
+		container.State.StartedAt = startedAt
+		return container
+	}
+	containers := []*Container{
+		newContainer("db", 100, true, started),
+		newContainer("web", 0, true, started),
+		newContainer("worker", 0, true, started.Add(time.Second)),
+		newContainer("stopped", -10, false, started),
+	}
+
+	if candidate := evictionCandidate(containers, 0); candidate == nil || candidate.ID != "worker" {
+		t.Fatalf("Expected the last started container of the lowest priority, got %v", candidate)
+	}
+	if candidate := evictionCandidate(containers[:1], 100); candidate != nil {
+		t.Fatalf("Expected no candidate at or above the priority floor, got %s", candidate.ID)
+	}
+	if candidate := evictionCandidate(containers[:1], 0); candidate == nil || candidate.ID != "db" {
+		t.Fatalf("Expected db without a priority floor, got %v", candidate)
+	}
+}
@@ -0,0 +1,115 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/iptables"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A firewall programs the NAT rules forwarding the published ports to the
+// containers. iptables.Chain is the default one.
+type firewall interface {
+	Forward(action iptables.Action, ip net.IP, port int, proto, destAddr string, destPort int) error
+}
+
+// FirewallRule is a port mapping handed to an external firewall manager
+type FirewallRule struct {
+	Action        string // "add" or "delete"
+	Proto         string
+	HostIp        string
+	HostPort      int
+	ContainerIp   string
+	ContainerPort int
+}
+
+// externalFirewall hands the port mappings to a firewall managed outside of
+// docker, for sites where the firewall is centrally managed. The manager is
+// either an executable, run with the arguments "add" or "delete", PROTO,
+// HOST_IP, HOST_PORT, CONTAINER_IP and CONTAINER_PORT, or a unix socket.
+// Each rule is sent to the socket as a JSON line, and the manager answers
+// with a JSON line holding the Error, if any.
+type externalFirewall struct {
+	manager string
+}
+
+func newExternalFirewall(manager string) (*externalFirewall, error) {
+	if strings.HasPrefix(manager, "unix://") {
+		if !path.IsAbs(strings.TrimPrefix(manager, "unix://")) {
+			return nil, fmt.Errorf("Invalid firewall manager socket: %s", manager)
+		}
+		return &externalFirewall{manager: manager}, nil
+	}
+	if !path.IsAbs(manager) {
+		return nil, fmt.Errorf("Invalid firewall manager, expected an absolute path: %s", manager)
+	}
+	if fi, err := os.Stat(manager); err != nil {
+		return nil, err
+	} else if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("Firewall manager %s is not executable", manager)
+	}
+	return &externalFirewall{manager: manager}, nil
+}
+
+func (fw *externalFirewall) Forward(action iptables.Action, ip net.IP, port int, proto, destAddr string, destPort int) error {
+	rule := &FirewallRule{
+		Action:        "add",
+		Proto:         proto,
+		HostIp:        ip.String(),
+		HostPort:      port,
+		ContainerIp:   destAddr,
+		ContainerPort: destPort,
+	}
+	if action == iptables.Delete {
+		rule.Action = "delete"
+	}
+	if strings.HasPrefix(fw.manager, "unix://") {
+		return fw.send(strings.TrimPrefix(fw.manager, "unix://"), rule)
+	}
+	return fw.run(rule)
+}
+
+func (fw *externalFirewall) run(rule *FirewallRule) error {
+	output, err := exec.Command(fw.manager, rule.Action, rule.Proto,
+		rule.HostIp, strconv.Itoa(rule.HostPort),
+		rule.ContainerIp, strconv.Itoa(rule.ContainerPort)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Firewall manager %s failed to %s %s: %s (%s)", fw.manager, rule.Action, rule, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (fw *externalFirewall) send(socket string, rule *FirewallRule) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(rule); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("Firewall manager %s did not answer to %s %s: %s", socket, rule.Action, rule, err)
+	}
+	var response struct {
+		Error string
+	}
+	if err := json.Unmarshal(line, &response); err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return fmt.Errorf("Firewall manager %s failed to %s %s: %s", socket, rule.Action, rule, response.Error)
+	}
+	return nil
+}
+
+func (rule *FirewallRule) String() string {
+	return fmt.Sprintf("%s/%s -> %s", net.JoinHostPort(rule.HostIp, strconv.Itoa(rule.HostPort)), rule.Proto, net.JoinHostPort(rule.ContainerIp, strconv.Itoa(rule.ContainerPort)))
+}
@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/dotcloud/docker/iptables"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestExternalFirewallScript(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	script := path.Join(tmp, "firewall")
+	rules := path.Join(tmp, "rules")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+rules+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := newExternalFirewall(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Forward(iptables.Add, net.IPv4zero, 49153, "tcp", "172.17.0.2", 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Forward(iptables.Delete, net.IPv4zero, 49153, "tcp", "172.17.0.2", 80); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "add tcp 0.0.0.0 49153 172.17.0.2 80\ndelete tcp 0.0.0.0 49153 172.17.0.2 80\n"
+	if string(output) != expected {
+		t.Fatalf("Expected %q got %q", expected, output)
+	}
+
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho denied\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Forward(iptables.Add, net.IPv4zero, 49153, "tcp", "172.17.0.2", 80); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("Expected the failure of the manager to be reported, got %v", err)
+	}
+
+	for _, manager := range []string{"firewall", tmp, "unix://firewall.sock"} {
+		if _, err := newExternalFirewall(manager); err == nil {
+			t.Fatalf("Expected an error for the manager %s", manager)
+		}
+	}
+}
+
+func TestExternalFirewallSocket(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	socket := path.Join(tmp, "firewall.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan FirewallRule, 2)
+	go func() {
+		for _, answer := range []string{"{}\n", "{\"Error\":\"port not allowed\"}\n"} {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var rule FirewallRule
+			line, _ := bufio.NewReader(conn).ReadBytes('\n')
+			json.Unmarshal(line, &rule)
+			received <- rule
+			conn.Write([]byte(answer))
+			conn.Close()
+		}
+	}()
+
+	fw, err := newExternalFirewall("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Forward(iptables.Add, net.IPv4(127, 0, 0, 1), 8080, "udp", "172.17.0.3", 53); err != nil {
+		t.Fatal(err)
+	}
+	expected := FirewallRule{Action: "add", Proto: "udp", HostIp: "127.0.0.1", HostPort: 8080, ContainerIp: "172.17.0.3", ContainerPort: 53}
+	if rule := <-received; rule != expected {
+		t.Fatalf("Expected %v got %v", expected, rule)
+	}
+	if err := fw.Forward(iptables.Delete, net.IPv4(127, 0, 0, 1), 8080, "udp", "172.17.0.3", 53); err == nil || !strings.Contains(err.Error(), "port not allowed") {
+		t.Fatalf("Expected the error of the manager, got %v", err)
+	}
+	if rule := <-received; rule.Action != "delete" {
+		t.Fatalf("Expected a delete, got %v", rule)
+	}
+}
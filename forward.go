@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/proxy"
+	"github.com/dotcloud/docker/utils"
+	"net"
+	"time"
+)
+
+const (
+	DefaultPortForwardTTL = 5 * time.Minute
+	MaxPortForwardTTL     = 24 * time.Hour
+)
+
+// A PortForward forwards an ephemeral port on the loopback of the host to a
+// port of a container, published or not, until it expires, it is stopped,
+// or the container stops. It is not recorded in the container config.
+type PortForward struct {
+	ID       string
+	Port     Port
+	HostIp   string
+	HostPort int
+	Expires  time.Time
+
+	proxy proxy.Proxy
+	timer *time.Timer
+}
+
+// Forward starts forwarding a loopback port of the host to port of the
+// interface, for ttl
+func (iface *NetworkInterface) Forward(port Port, ttl time.Duration) (*PortForward, error) {
+	if iface.disabled {
+		return nil, fmt.Errorf("Trying to forward port for interface %v, which is disabled", iface) // FIXME
+	}
+	containerPort, err := parsePort(port.Port())
+	if err != nil {
+		return nil, err
+	}
+
+	var frontend, backend net.Addr
+	if port.Proto() == "udp" {
+		frontend = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		backend = &net.UDPAddr{IP: iface.IPNet.IP, Port: containerPort}
+	} else {
+		frontend = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		backend = &net.TCPAddr{IP: iface.IPNet.IP, Port: containerPort}
+	}
+	p, err := proxy.NewProxy(frontend, backend)
+	if err != nil {
+		return nil, err
+	}
+	go p.Run()
+
+	forward := &PortForward{
+		ID:      utils.TruncateID(GenerateID()),
+		Port:    port,
+		HostIp:  "127.0.0.1",
+		Expires: time.Now().Add(ttl),
+		proxy:   p,
+	}
+	switch addr := p.FrontendAddr().(type) {
+	case *net.TCPAddr:
+		forward.HostPort = addr.Port
+	case *net.UDPAddr:
+		forward.HostPort = addr.Port
+	}
+
+	iface.forwardsLock.Lock()
+	defer iface.forwardsLock.Unlock()
+	iface.forwards = append(iface.forwards, forward)
+	forward.timer = time.AfterFunc(ttl, func() {
+		utils.Debugf("Port forward %s of %s expired", forward.ID, port)
+		iface.StopForward(forward.ID)
+	})
+	return forward, nil
+}
+
+// StopForward stops the port forward with the given id
+func (iface *NetworkInterface) StopForward(id string) error {
+	iface.forwardsLock.Lock()
+	defer iface.forwardsLock.Unlock()
+	for i, forward := range iface.forwards {
+		if forward.ID != id {
+			continue
+		}
+		forward.timer.Stop()
+		forward.proxy.Close()
+		iface.forwards = append(iface.forwards[:i], iface.forwards[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("No such port forward: %s", id)
+}
+
+// Forwards returns the current port forwards of the interface, oldest first
+func (iface *NetworkInterface) Forwards() []*PortForward {
+	iface.forwardsLock.Lock()
+	defer iface.forwardsLock.Unlock()
+	return append([]*PortForward{}, iface.forwards...)
+}
+
+func (iface *NetworkInterface) releaseForwards() {
+	for _, forward := range iface.Forwards() {
+		iface.StopForward(forward.ID)
+	}
+}
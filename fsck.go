@@ -0,0 +1,212 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkImages returns the problem of each image of the graph which is
+// corrupt: its json or its layer can't be loaded, the digest of its layer
+// isn't the one it is described with, or its parent is missing or corrupt.
+// The images are keyed by the name of their directory.
+func (graph *Graph) checkImages() (map[string]string, error) {
+	files, err := ioutil.ReadDir(graph.Root)
+	if err != nil {
+		return nil, err
+	}
+	problems := make(map[string]string)
+	images := make(map[string]*Image)
+	// The digests of the shared layers, computed once for all their images
+	digests := make(map[string]string)
+	for _, f := range files {
+		id := f.Name()
+		// _tmp, _layers, _downloads...
+		if !f.IsDir() || strings.HasPrefix(id, "_") {
+			continue
+		}
+		root := graph.imageRoot(id)
+		img, err := LoadImage(root)
+		if err != nil {
+			problems[id] = fmt.Sprintf("unable to load the image: %s", err)
+			continue
+		}
+		if img.ID != id {
+			problems[id] = fmt.Sprintf("the image stored there has id %s", img.ID)
+			continue
+		}
+		if img.LayerDigest == "" {
+			images[id] = img
+			continue
+		}
+		layer, err := filepath.EvalSymlinks(layerPath(root))
+		if err != nil {
+			problems[id] = fmt.Sprintf("unable to read the layer: %s", err)
+			continue
+		}
+		digest, exists := digests[layer]
+		if !exists {
+			if digest, err = layerDigest(layer); err != nil {
+				problems[id] = fmt.Sprintf("unable to read the layer: %s", err)
+				continue
+			}
+			digests[layer] = digest
+		}
+		if digest != img.LayerDigest {
+			problems[id] = fmt.Sprintf("the digest of the layer is %s, expected %s", digest, img.LayerDigest)
+			continue
+		}
+		images[id] = img
+	}
+
+	// The images whose parent is missing, until none is left
+	for found := true; found; {
+		found = false
+		for id, img := range images {
+			if img.Parent == "" {
+				continue
+			}
+			if _, exists := images[img.Parent]; exists {
+				continue
+			}
+			if _, corrupt := problems[img.Parent]; corrupt {
+				problems[id] = fmt.Sprintf("its parent %s is corrupt", utils.TruncateID(img.Parent))
+			} else {
+				problems[id] = fmt.Sprintf("its parent %s is missing", utils.TruncateID(img.Parent))
+			}
+			delete(images, id)
+			found = true
+		}
+	}
+	return problems, nil
+}
+
+// orphanLayers returns the digests of the shared layers no image uses. It
+// is called with layersLock held.
+func (graph *Graph) orphanLayers() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(graph.Root, "_layers"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	if err := graph.walkAll(func(img *Image) {
+		used[img.LayerDigest] = true
+	}); err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, f := range files {
+		if digest := digestPrefix + f.Name(); !used[digest] {
+			orphans = append(orphans, digest)
+		}
+	}
+	return orphans, nil
+}
+
+// GraphCheck checks the integrity of the graph, after an unclean shutdown:
+// the images, their parents and their layers, the shared layers and the
+// tags. With repair, the corrupt images and their children, the orphan
+// shared layers and the tags of missing images are removed. The corrupt
+// images containers use, and their ancestors and tags, are only reported:
+// the containers have to be removed first.
+func (srv *Server) GraphCheck(repair bool) ([]APIGraphProblem, error) {
+	graph := srv.runtime.graph
+	problems, err := graph.checkImages()
+	if err != nil {
+		return nil, err
+	}
+	outs := []APIGraphProblem{}
+
+	// The container using each image, directly or through a child
+	usedBy := make(map[string]string)
+	for _, container := range srv.runtime.List() {
+		for id := container.Image; id != ""; {
+			if _, exists := usedBy[id]; exists {
+				break
+			}
+			usedBy[id] = container.ID
+			img, err := LoadImage(graph.imageRoot(id))
+			if err != nil {
+				break
+			}
+			id = img.Parent
+		}
+	}
+
+	ids := make([]string, 0, len(problems))
+	for id := range problems {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		out := APIGraphProblem{Type: "image", Name: id, Problem: problems[id]}
+		if containerID, used := usedBy[id]; repair && used {
+			out.Problem += fmt.Sprintf(" (not removed, the container %s uses it)", utils.TruncateID(containerID))
+		} else if repair {
+			if err := graph.Delete(id); err != nil {
+				out.Problem += fmt.Sprintf(" (unable to remove the image: %s)", err)
+			} else {
+				out.Repaired = true
+				srv.LogEvent("delete", utils.TruncateID(id), "")
+			}
+		}
+		outs = append(outs, out)
+	}
+
+	graph.layersLock.Lock()
+	orphans, err := graph.orphanLayers()
+	if err != nil {
+		graph.layersLock.Unlock()
+		return nil, err
+	}
+	for _, digest := range orphans {
+		out := APIGraphProblem{Type: "layer", Name: digest, Problem: "no image uses the shared layer"}
+		if repair {
+			if err := os.RemoveAll(graph.sharedLayerPath(digest)); err != nil {
+				out.Problem += fmt.Sprintf(" (unable to remove the layer: %s)", err)
+			} else {
+				out.Repaired = true
+			}
+		}
+		outs = append(outs, out)
+	}
+	graph.layersLock.Unlock()
+
+	byID := srv.runtime.repositories.ByID()
+	var tagged []string
+	for id := range byID {
+		tagged = append(tagged, id)
+	}
+	sort.Strings(tagged)
+	for _, id := range tagged {
+		_, corrupt := problems[id]
+		if !corrupt && graph.Exists(id) {
+			continue
+		}
+		for _, name := range byID[id] {
+			out := APIGraphProblem{Type: "tag", Name: name, Problem: fmt.Sprintf("the image %s is missing", utils.TruncateID(id))}
+			if corrupt {
+				out.Problem = fmt.Sprintf("the image %s is corrupt", utils.TruncateID(id))
+			}
+			if containerID, used := usedBy[id]; repair && corrupt && used {
+				out.Problem += fmt.Sprintf(" (not removed, the container %s uses the image)", utils.TruncateID(containerID))
+			} else if repair {
+				repoName, tag := utils.ParseRepositoryTag(name)
+				if _, err := srv.runtime.repositories.Delete(repoName, tag); err != nil {
+					out.Problem += fmt.Sprintf(" (unable to remove the tag: %s)", err)
+				} else {
+					out.Repaired = true
+					srv.LogEvent("untag", utils.TruncateID(id), "")
+				}
+			}
+			outs = append(outs, out)
+		}
+	}
+	return outs, nil
+}
@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestGraphCheck(t *testing.T) {
+	srv := tempSaveServer(t)
+	graph := srv.runtime.graph
+	defer os.RemoveAll(graph.Root)
+	graph.shareLayers = true
+
+	base, err := graph.Create(testArchive(t), nil, "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &Image{Parent: base.ID, Comment: "child", Created: time.Now()}
+	if err := graph.Register(nil, testArchive(t), child); err != nil {
+		t.Fatal(err)
+	}
+	other, err := graph.Create(nil, nil, "other", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.runtime.repositories.Set("app", "latest", child.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.runtime.repositories.Set("other", "latest", other.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if outs, err := srv.GraphCheck(false); err != nil {
+		t.Fatal(err)
+	} else if len(outs) != 0 {
+		t.Fatalf("Expected no problem in a sound graph, got %v", outs)
+	}
+
+	// A file of the layer of base changed, and a shared layer left behind
+	baseLayer, err := base.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(baseLayer, "corrupt"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphan := graph.sharedLayerPath(digestPrefix + "0123456789abcdef")
+	if err := os.MkdirAll(orphan, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	outs, err := srv.GraphCheck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]APIGraphProblem)
+	for _, out := range outs {
+		if out.Repaired {
+			t.Fatalf("Nothing should be repaired without repair, got %v", out)
+		}
+		found[out.Type+" "+out.Name] = out
+	}
+	for _, name := range []string{"image " + base.ID, "image " + child.ID, "layer " + digestPrefix + "0123456789abcdef", "tag app:latest"} {
+		if _, exists := found[name]; !exists {
+			t.Fatalf("Expected problem %s, got %v", name, outs)
+		}
+	}
+	if len(outs) != 4 {
+		t.Fatalf("Expected 4 problems, got %v", outs)
+	}
+
+	// The images a container uses are kept
+	container := &Container{ID: GenerateID(), Image: child.ID}
+	element := srv.runtime.containers.PushBack(container)
+	if outs, err := srv.GraphCheck(true); err != nil {
+		t.Fatal(err)
+	} else if len(outs) != 4 || outs[0].Type != "image" || outs[0].Repaired || outs[1].Repaired {
+		t.Fatalf("Expected the images of the container not to be repaired, got %v", outs)
+	}
+	if !graph.Exists(base.ID) || !graph.Exists(child.ID) {
+		t.Fatal("The corrupt images of the container should be kept")
+	}
+	if repository, err := srv.runtime.repositories.Get("app"); err != nil || repository == nil {
+		t.Fatalf("The tags of the corrupt images of the container should be kept, got %v, %v", repository, err)
+	}
+	srv.runtime.containers.Remove(element)
+
+	if _, err := srv.GraphCheck(true); err != nil {
+		t.Fatal(err)
+	}
+	if graph.Exists(base.ID) || graph.Exists(child.ID) {
+		t.Fatal("The corrupt images should be removed")
+	}
+	if !graph.Exists(other.ID) {
+		t.Fatal("The sound images should be kept")
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("The orphan layer should be removed")
+	}
+	if repository, err := srv.runtime.repositories.Get("app"); err != nil {
+		t.Fatal(err)
+	} else if repository != nil {
+		t.Fatalf("The tags of the corrupt images should be removed, got %v", repository)
+	}
+	if outs, err := srv.GraphCheck(false); err != nil {
+		t.Fatal(err)
+	} else if len(outs) != 0 {
+		t.Fatalf("Expected no problem once repaired, got %v", outs)
+	}
+}
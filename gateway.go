@@ -0,0 +1,328 @@
+package docker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS5 constants, from RFC 1928 and RFC 1929
+const (
+	socksVersion          = 0x05
+	socksAuthVersion      = 0x01
+	socksMethodPassword   = 0x02
+	socksMethodNone       = 0xff
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksSucceeded        = 0x00
+	socksNotAllowed       = 0x02
+	socksHostUnreachable  = 0x04
+	socksRefused          = 0x05
+	socksCmdNotSupported  = 0x07
+	socksAtypNotSupported = 0x08
+)
+
+// gatewayHandshakeTimeout is how long a client has to authenticate and ask
+// for a container, and the gateway to connect to the container
+var gatewayHandshakeTimeout = 10 * time.Second
+
+// Gateway lets authenticated clients reach the containers directly, at
+// their ip or name, through a SOCKS5 or HTTP CONNECT proxy, e.g. to debug
+// services which are not published. Only the containers are reachable.
+type Gateway struct {
+	listener net.Listener
+	users    map[string]string
+	resolve  func(host string) (net.IP, error)
+}
+
+// NewGateway listens on addr for the clients authenticated by the
+// user:password lines of authFile. resolve returns the ip of a running
+// container from its ip, name or id.
+func NewGateway(addr, authFile string, resolve func(host string) (net.IP, error)) (*Gateway, error) {
+	users, err := readGatewayUsers(authFile)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{listener: listener, users: users, resolve: resolve}, nil
+}
+
+func readGatewayUsers(authFile string) (map[string]string, error) {
+	if authFile == "" {
+		return nil, fmt.Errorf("The gateway requires a file of user:password lines to authenticate its clients")
+	}
+	f, err := os.Open(authFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid line in gateway auth file %s, expected user:password", authFile)
+		}
+		users[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("No user in gateway auth file %s", authFile)
+	}
+	return users, nil
+}
+
+func (gw *Gateway) Addr() net.Addr {
+	return gw.listener.Addr()
+}
+
+func (gw *Gateway) Close() error {
+	return gw.listener.Close()
+}
+
+// Serve accepts the clients until the gateway is closed
+func (gw *Gateway) Serve() error {
+	for {
+		conn, err := gw.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go gw.handle(conn)
+	}
+}
+
+func (gw *Gateway) authenticate(user, password string) bool {
+	expected, exists := gw.users[user]
+	return exists && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+func (gw *Gateway) handle(conn net.Conn) {
+	defer conn.Close()
+	// A silent client doesn't hold the connection, splice lifts the deadline
+	conn.SetDeadline(time.Now().Add(gatewayHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if version[0] == socksVersion {
+		err = gw.handleSocks(conn, reader)
+	} else {
+		err = gw.handleHTTP(conn, reader)
+	}
+	if err != nil {
+		utils.Debugf("Gateway: %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (gw *Gateway) handleSocks(conn net.Conn, reader *bufio.Reader) error {
+	// Method selection: only username/password is accepted
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	method := byte(socksMethodNone)
+	for _, m := range methods {
+		if m == socksMethodPassword {
+			method = socksMethodPassword
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksMethodNone {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	// Username/password authentication
+	user, password, err := readSocksCredentials(reader)
+	if err != nil {
+		conn.Write([]byte{socksAuthVersion, 0x01})
+		return err
+	}
+	if !gw.authenticate(user, password) {
+		conn.Write([]byte{socksAuthVersion, 0x01})
+		return fmt.Errorf("authentication failed for %s", user)
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return err
+	}
+
+	// Request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return err
+	}
+	if request[1] != socksCmdConnect {
+		writeSocksReply(conn, socksCmdNotSupported)
+		return fmt.Errorf("unsupported command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksAtypNotSupported)
+		return fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port uint16
+	if err := binary.Read(reader, binary.BigEndian, &port); err != nil {
+		return err
+	}
+
+	ip, err := gw.resolve(host)
+	if err != nil {
+		writeSocksReply(conn, socksNotAllowed)
+		return err
+	}
+	backend, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), gatewayHandshakeTimeout)
+	if err != nil {
+		writeSocksReply(conn, socksRefused)
+		return err
+	}
+	defer backend.Close()
+	if err := writeSocksReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+	splice(conn, reader, backend)
+	return nil
+}
+
+func readSocksCredentials(reader *bufio.Reader) (string, string, error) {
+	var fields [2]string
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != socksAuthVersion {
+		return "", "", fmt.Errorf("unsupported authentication version %d", version)
+	}
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], nil
+}
+
+// The bound address is not meaningful to the clients, it is left empty
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (gw *Gateway) handleHTTP(conn net.Conn, reader *bufio.Reader) error {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	if req.Method != "CONNECT" {
+		fmt.Fprintf(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\n\r\n")
+		return fmt.Errorf("unsupported method %s", req.Method)
+	}
+	user, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+	if !ok || !gw.authenticate(user, password) {
+		fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"docker\"\r\n\r\n")
+		return fmt.Errorf("authentication failed for %s", user)
+	}
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+		return err
+	}
+	ip, err := gw.resolve(host)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\n\r\n%s\n", err)
+		return err
+	}
+	backend, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), gatewayHandshakeTimeout)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n%s\n", err)
+		return err
+	}
+	defer backend.Close()
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+	splice(conn, reader, backend)
+	return nil
+}
+
+func parseProxyAuthorization(header string) (string, string, bool) {
+	if !strings.HasPrefix(header, "Basic ") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// splice copies the traffic between the client, whose buffered data is
+// read from reader, and the backend until either side is done
+func splice(client net.Conn, reader io.Reader, backend net.Conn) {
+	client.SetDeadline(time.Time{})
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,211 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGateway(t *testing.T) (*Gateway, int, func()) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	tmp, err := ioutil.TempDir("", "docker-gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authFile := path.Join(tmp, "users")
+	if err := ioutil.WriteFile(authFile, []byte("# debug users\nalice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(host string) (net.IP, error) {
+		if host == "db" || host == "127.0.0.1" {
+			return net.IPv4(127, 0, 0, 1), nil
+		}
+		return nil, fmt.Errorf("No running container %s", host)
+	}
+	gw, err := NewGateway("127.0.0.1:0", authFile, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gw.Serve()
+	return gw, backend.Addr().(*net.TCPAddr).Port, func() {
+		gw.Close()
+		backend.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+func socksConnect(t *testing.T, gw *Gateway, user, password, host string, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 2 {
+		t.Fatalf("Expected the password method to be selected, got %v (%v)", reply, err)
+	}
+	auth := append([]byte{1, byte(len(user))}, user...)
+	auth = append(append(auth, byte(len(password))), password...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 {
+		return conn, 0xff
+	}
+	request := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	conn.Write(append(request, byte(port>>8), byte(port)))
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[1]
+}
+
+func TestGatewaySocks(t *testing.T) {
+	gw, port, cleanup := newTestGateway(t)
+	defer cleanup()
+
+	conn, reply := socksConnect(t, gw, "alice", "secret", "db", port)
+	if reply != 0 {
+		t.Fatalf("Expected the connection to succeed, got %d", reply)
+	}
+	conn.Write([]byte("ping\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected the traffic to reach the container, got %q (%v)", line, err)
+	}
+	conn.Close()
+
+	if conn, reply := socksConnect(t, gw, "alice", "wrong", "db", port); reply != 0xff {
+		t.Fatalf("Expected a wrong password to be refused")
+	} else {
+		conn.Close()
+	}
+	if conn, reply := socksConnect(t, gw, "alice", "secret", "example.com", port); reply != socksNotAllowed {
+		t.Fatalf("Expected a host which is not a container to be refused, got %d", reply)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestGatewayHTTPConnect(t *testing.T) {
+	gw, port, cleanup := newTestGateway(t)
+	defer cleanup()
+
+	connect := func(host, auth string) (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", gw.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\n", host, port, host, port)
+		if auth != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		fmt.Fprintf(conn, "\r\n")
+		reader := bufio.NewReader(conn)
+		status, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, reader, status
+	}
+
+	conn, reader, status := connect("db", "alice:secret")
+	if !strings.Contains(status, " 200 ") {
+		t.Fatalf("Expected the connection to succeed, got %s", status)
+	}
+	if line, _ := reader.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("Expected the end of the response, got %q", line)
+	}
+	conn.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected the traffic to reach the container, got %q (%v)", line, err)
+	}
+	conn.Close()
+
+	for auth, expected := range map[string]string{"": " 407 ", "alice:wrong": " 407 "} {
+		conn, _, status := connect("db", auth)
+		if !strings.Contains(status, expected) {
+			t.Fatalf("Expected %s for %q, got %s", expected, auth, status)
+		}
+		conn.Close()
+	}
+	conn, _, status = connect("example.com", "alice:secret")
+	if !strings.Contains(status, " 403 ") {
+		t.Fatalf("Expected a host which is not a container to be refused, got %s", status)
+	}
+	conn.Close()
+}
+
+func TestGatewayRequiresUsers(t *testing.T) {
+	if _, err := NewGateway("127.0.0.1:0", "", nil); err == nil {
+		t.Fatal("Expected the gateway to require an auth file")
+	}
+}
+
+func TestGatewaySocksHandshake(t *testing.T) {
+	defer func(timeout time.Duration) { gatewayHandshakeTimeout = timeout }(gatewayHandshakeTimeout)
+	gatewayHandshakeTimeout = 100 * time.Millisecond
+	gw, port, cleanup := newTestGateway(t)
+	defer cleanup()
+
+	// Another version of the username/password authentication
+	conn, err := net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] == 0 {
+		t.Fatalf("Expected the authentication to fail, got %v (%v)", reply, err)
+	}
+	conn.Close()
+
+	// A silent client is disconnected
+	conn, err = net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(reply); err != io.EOF {
+		t.Fatalf("Expected the gateway to close the connection, got %v", err)
+	}
+
+	// The deadline doesn't apply once connected
+	conn, reply[1] = socksConnect(t, gw, "alice", "secret", "db", port)
+	defer conn.Close()
+	time.Sleep(2 * gatewayHandshakeTimeout)
+	conn.Write([]byte("ping\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected the traffic to reach the container, got %q (%v)", line, err)
+	}
+}
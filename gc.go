@@ -0,0 +1,310 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// gcInterval is how often the daemon applies its cleanup policy
+const gcInterval = 5 * time.Minute
+
+// gcPolicy is when the daemon removes the stopped containers and the
+// images no container uses, the containers first
+type gcPolicy struct {
+	// The containers stopped and the images pulled, built or loaded longer
+	// ago are removed, 0 for no limit
+	MaxAge time.Duration
+	// The oldest containers and images beyond this many are removed, 0 for
+	// no limit
+	MaxCount int
+	// While the disk of the root has less free bytes, the oldest ones are
+	// removed, 0 for no limit
+	MinFree int64
+	// The containers and images with any of these labels, key or
+	// key=value, are kept
+	KeepLabels []string
+}
+
+// gcPolicyFromConfig returns the cleanup policy of the daemon, nil when it
+// has none
+func gcPolicyFromConfig(config *DaemonConfig) *gcPolicy {
+	if config.GCMaxAge == 0 && config.GCMaxCount == 0 && config.GCMinFree == 0 {
+		return nil
+	}
+	return &gcPolicy{
+		MaxAge:     time.Duration(config.GCMaxAge) * time.Hour,
+		MaxCount:   config.GCMaxCount,
+		MinFree:    config.GCMinFree,
+		KeepLabels: config.GCKeepLabels,
+	}
+}
+
+// keeps tells whether the labels exclude their container or image from
+// the cleanup
+func (policy *gcPolicy) keeps(labels map[string]string) bool {
+	for _, label := range policy.KeepLabels {
+		if matchLabels(labels, []string{label}) {
+			return true
+		}
+	}
+	return false
+}
+
+// gcCandidate is a container or an image the policy may remove, since the
+// time it stopped or was registered
+type gcCandidate struct {
+	ID    string
+	Since time.Time
+}
+
+type gcCandidatesByAge []gcCandidate
+
+func (s gcCandidatesByAge) Len() int      { return len(s) }
+func (s gcCandidatesByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// The oldest first, then by id for a stable order
+func (s gcCandidatesByAge) Less(i, j int) bool {
+	if !s[i].Since.Equal(s[j].Since) {
+		return s[i].Since.Before(s[j].Since)
+	}
+	return s[i].ID < s[j].ID
+}
+
+// expired splits the candidates in the ones the age and the count of the
+// policy remove, and the others, the oldest first in both
+func (policy *gcPolicy) expired(candidates []gcCandidate, now time.Time) (expired, kept []gcCandidate) {
+	sorted := append([]gcCandidate{}, candidates...)
+	sort.Sort(gcCandidatesByAge(sorted))
+	for i, candidate := range sorted {
+		tooOld := policy.MaxAge > 0 && now.Sub(candidate.Since) > policy.MaxAge
+		tooMany := policy.MaxCount > 0 && len(sorted)-i > policy.MaxCount
+		if tooOld || tooMany {
+			expired = append(expired, candidate)
+		} else {
+			kept = append(kept, candidate)
+		}
+	}
+	return expired, kept
+}
+
+// freeSpace returns the bytes available to the daemon on the disk of path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// gcContainers returns the containers the policy may remove: the stopped
+// ones, neither in standby nor excluded by their labels, since they stopped
+// or, never started, since they were created
+func (srv *Server) gcContainers(policy *gcPolicy) []gcCandidate {
+	var candidates []gcCandidate
+	for _, container := range srv.runtime.List() {
+		state := &container.State
+		state.Lock()
+		stopped := !(state.Running || state.Ghost || state.Standby || state.Dead)
+		since := state.FinishedAt
+		if state.StartedAt.IsZero() {
+			since = container.Created
+		}
+		state.Unlock()
+		if !stopped {
+			continue
+		}
+		if container.Config != nil && policy.keeps(container.Config.Labels) {
+			continue
+		}
+		candidates = append(candidates, gcCandidate{ID: container.ID, Since: since})
+	}
+	return candidates
+}
+
+// gcImages returns the images the policy may remove: the ones without
+// children no container uses, not excluded by their labels, since they
+// were pulled, built or loaded. The ancestors left unused by their removal
+// go with them.
+func (srv *Server) gcImages(policy *gcPolicy) ([]gcCandidate, error) {
+	heads, err := srv.runtime.graph.Heads()
+	if err != nil {
+		return nil, err
+	}
+	used := srv.usedImages()
+	var candidates []gcCandidate
+	for id, img := range heads {
+		if used[id] || policy.keeps(img.labels()) {
+			continue
+		}
+		since, err := srv.runtime.graph.registeredAt(id)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, gcCandidate{ID: id, Since: since})
+	}
+	return candidates, nil
+}
+
+// registeredAt returns when the image id was registered: when the digest
+// of its layer was stored, unlike its json, which its signatures rewrite.
+// The images registered without it fall back to their directory.
+func (graph *Graph) registeredAt(id string) (time.Time, error) {
+	root := graph.imageRoot(id)
+	f, err := os.Stat(layerDigestPath(root))
+	if os.IsNotExist(err) {
+		f, err = os.Stat(root)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return f.ModTime(), nil
+}
+
+// usedImages returns the images of the containers and their ancestors
+func (srv *Server) usedImages() map[string]bool {
+	used := make(map[string]bool)
+	for _, container := range srv.runtime.List() {
+		img, err := srv.runtime.graph.Get(container.Image)
+		if err != nil {
+			continue
+		}
+		img.WalkHistory(func(img *Image) error {
+			used[img.ID] = true
+			return nil
+		})
+	}
+	return used
+}
+
+// gcContainer removes the container, leaving its volumes
+func (srv *Server) gcContainer(id string) error {
+	if err := srv.ContainerDestroy(id, false, false, nil, nil, nil); err != nil {
+		return err
+	}
+	log.Printf("Cleanup: removed container %s", utils.TruncateID(id))
+	return nil
+}
+
+// gcImage untags and removes the image, and its ancestors left without
+// children, tags or containers. No container is created meanwhile, and the
+// image is kept if one uses it or it has children since it was chosen.
+func (srv *Server) gcImage(policy *gcPolicy, id string) error {
+	srv.runtime.imagesLock.Lock()
+	defer srv.runtime.imagesLock.Unlock()
+	store := srv.runtime.repositories
+	used := srv.usedImages()
+	if used[id] {
+		return fmt.Errorf("Conflict, a container uses the image %s now", utils.TruncateID(id))
+	}
+	if byParent, err := srv.runtime.graph.ByParent(); err != nil {
+		return err
+	} else if len(byParent[id]) > 0 {
+		return fmt.Errorf("Conflict, the image %s has children now", utils.TruncateID(id))
+	}
+	for id != "" {
+		img, err := srv.runtime.graph.Get(id)
+		if err != nil {
+			return err
+		}
+		for _, name := range store.ByID()[id] {
+			repoName, tag := utils.ParseRepositoryTag(name)
+			if _, err := store.Delete(repoName, tag); err != nil {
+				return err
+			}
+			srv.LogEvent("untag", utils.TruncateID(id), "")
+		}
+		if err := srv.runtime.graph.Delete(id); err != nil {
+			return err
+		}
+		srv.LogEvent("delete", utils.TruncateID(id), "")
+		log.Printf("Cleanup: removed image %s", utils.TruncateID(id))
+
+		parent := img.Parent
+		if parent == "" {
+			break
+		}
+		byParent, err := srv.runtime.graph.ByParent()
+		if err != nil {
+			return err
+		}
+		parentImg, err := srv.runtime.graph.Get(parent)
+		if err != nil {
+			return err
+		}
+		if len(byParent[parent]) > 0 || len(store.ByID()[parent]) > 0 || used[parent] || policy.keeps(parentImg.labels()) {
+			break
+		}
+		id = parent
+	}
+	return nil
+}
+
+// collectGarbage applies the policy once: the expired containers then the
+// expired images are removed, then the oldest remaining ones, the
+// containers first, while the disk lacks free space
+func (srv *Server) collectGarbage(policy *gcPolicy, now time.Time) error {
+	expired, containers := policy.expired(srv.gcContainers(policy), now)
+	for _, candidate := range expired {
+		if err := srv.gcContainer(candidate.ID); err != nil {
+			utils.Errorf("Cleanup: unable to remove container %s: %s", utils.TruncateID(candidate.ID), err)
+		}
+	}
+	candidates, err := srv.gcImages(policy)
+	if err != nil {
+		return err
+	}
+	expired, _ = policy.expired(candidates, now)
+	for _, candidate := range expired {
+		if err := srv.gcImage(policy, candidate.ID); err != nil {
+			utils.Errorf("Cleanup: unable to remove image %s: %s", utils.TruncateID(candidate.ID), err)
+		}
+	}
+
+	if policy.MinFree == 0 {
+		return nil
+	}
+	for {
+		free, err := freeSpace(srv.runtime.config.Root)
+		if err != nil {
+			return err
+		}
+		if free >= policy.MinFree {
+			return nil
+		}
+		if len(containers) > 0 {
+			if err := srv.gcContainer(containers[0].ID); err != nil {
+				utils.Errorf("Cleanup: unable to remove container %s: %s", utils.TruncateID(containers[0].ID), err)
+			}
+			containers = containers[1:]
+			continue
+		}
+		// The images the containers removed left unused count too
+		candidates, err := srv.gcImages(policy)
+		if err != nil {
+			return err
+		}
+		if len(candidates) == 0 {
+			log.Printf("Cleanup: %s free on %s, below %s, and nothing left to remove", utils.HumanSize(free), srv.runtime.config.Root, utils.HumanSize(policy.MinFree))
+			return nil
+		}
+		sort.Sort(gcCandidatesByAge(candidates))
+		if err := srv.gcImage(policy, candidates[0].ID); err != nil {
+			return err
+		}
+	}
+}
+
+// watchGarbage applies the cleanup policy every gcInterval
+func (srv *Server) watchGarbage(policy *gcPolicy) {
+	for {
+		time.Sleep(gcInterval)
+		if err := srv.collectGarbage(policy, time.Now()); err != nil {
+			utils.Errorf("Cleanup: %s", err)
+		}
+	}
+}
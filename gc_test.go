@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGCPolicyExpired(t *testing.T) {
+	now := time.Date(2013, 11, 5, 12, 0, 0, 0, time.UTC)
+	candidates := []gcCandidate{
+		{ID: "recent", Since: now.Add(-time.Hour)},
+		{ID: "old", Since: now.Add(-72 * time.Hour)},
+		{ID: "newest", Since: now.Add(-time.Minute)},
+		{ID: "older", Since: now.Add(-48 * time.Hour)},
+	}
+	ids := func(candidates []gcCandidate) []string {
+		var ids []string
+		for _, candidate := range candidates {
+			ids = append(ids, candidate.ID)
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		policy          gcPolicy
+		expired, others []string
+	}{
+		{gcPolicy{MaxAge: 24 * time.Hour}, []string{"old", "older"}, []string{"recent", "newest"}},
+		{gcPolicy{MaxCount: 3}, []string{"old"}, []string{"older", "recent", "newest"}},
+		{gcPolicy{MaxAge: 2 * time.Hour, MaxCount: 3}, []string{"old", "older"}, []string{"recent", "newest"}},
+		{gcPolicy{MinFree: 1 << 30}, nil, []string{"old", "older", "recent", "newest"}},
+	} {
+		expired, others := test.policy.expired(candidates, now)
+		if got := ids(expired); !equalStrings(got, test.expired) {
+			t.Errorf("%+v: expected %v to expire, got %v", test.policy, test.expired, got)
+		}
+		if got := ids(others); !equalStrings(got, test.others) {
+			t.Errorf("%+v: expected %v to be kept, oldest first, got %v", test.policy, test.others, got)
+		}
+	}
+}
+
+func TestGCPolicyKeeps(t *testing.T) {
+	policy := &gcPolicy{KeepLabels: []string{"keep", "env=prod"}}
+	for _, test := range []struct {
+		labels map[string]string
+		keeps  bool
+	}{
+		{map[string]string{"keep": ""}, true},
+		{map[string]string{"env": "prod", "tier": "db"}, true},
+		{map[string]string{"env": "staging"}, false},
+		{nil, false},
+	} {
+		if policy.keeps(test.labels) != test.keeps {
+			t.Errorf("Expected the labels %v to be kept: %v", test.labels, test.keeps)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGCContainers(t *testing.T) {
+	srv := tempSaveServer(t)
+	defer os.RemoveAll(srv.runtime.graph.Root)
+	created := time.Now().Add(-time.Minute)
+	stopped := time.Now().Add(-48 * time.Hour)
+	fresh := &Container{ID: GenerateID(), Created: created}
+	old := &Container{ID: GenerateID(), Created: stopped.Add(-time.Hour)}
+	old.State.StartedAt = stopped.Add(-time.Hour)
+	old.State.FinishedAt = stopped
+	srv.runtime.containers.PushBack(fresh)
+	srv.runtime.containers.PushBack(old)
+
+	since := make(map[string]time.Time)
+	for _, candidate := range srv.gcContainers(&gcPolicy{}) {
+		since[candidate.ID] = candidate.Since
+	}
+	if !since[fresh.ID].Equal(created) {
+		t.Errorf("Expected the container never started to age from its creation, got %s", since[fresh.ID])
+	}
+	if !since[old.ID].Equal(stopped) {
+		t.Errorf("Expected the stopped container to age from its exit, got %s", since[old.ID])
+	}
+	expired, _ := (&gcPolicy{MaxAge: 24 * time.Hour}).expired(srv.gcContainers(&gcPolicy{}), time.Now())
+	if len(expired) != 1 || expired[0].ID != old.ID {
+		t.Errorf("Expected only the old container to expire, got %v", expired)
+	}
+}
+
+func TestGCImage(t *testing.T) {
+	srv := tempSaveServer(t)
+	defer os.RemoveAll(srv.runtime.graph.Root)
+	img, err := srv.runtime.graph.Create(testArchive(t), nil, "gc", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signing the image doesn't make it recent
+	pulled := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(layerDigestPath(srv.runtime.graph.imageRoot(img.ID)), pulled, pulled); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.runtime.graph.setSignatures(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := srv.gcImages(&gcPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || !candidates[0].Since.Equal(pulled) {
+		t.Fatalf("Expected the image registered at %s, got %v", pulled, candidates)
+	}
+
+	// A container created from the image since it was chosen keeps it
+	element := srv.runtime.containers.PushBack(&Container{ID: GenerateID(), Image: img.ID})
+	if err := srv.gcImage(&gcPolicy{}, img.ID); err == nil {
+		t.Fatal("Expected an error removing an image a container uses")
+	}
+	if !srv.runtime.graph.Exists(img.ID) {
+		t.Fatal("Expected the image of the container to be kept")
+	}
+	srv.runtime.containers.Remove(element)
+	if err := srv.gcImage(&gcPolicy{}, img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if srv.runtime.graph.Exists(img.ID) {
+		t.Fatal("Expected the unused image to be removed")
+	}
+}
@@ -365,6 +365,32 @@ func (db *Database) Rename(currentName, newName string) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
+	return db.rename(currentName, newName)
+}
+
+// RenameAll renames several edges in one transaction, in order: either all
+// of them are renamed or none is. Each rename is a pair of the current
+// and the new name.
+func (db *Database) RenameAll(renames [][2]string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, err := db.conn.Exec("BEGIN"); err != nil {
+		return err
+	}
+	for _, rename := range renames {
+		if err := db.rename(rename[0], rename[1]); err != nil {
+			db.conn.Exec("ROLLBACK")
+			return err
+		}
+	}
+	if _, err := db.conn.Exec("COMMIT"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *Database) rename(currentName, newName string) error {
 	parentPath, name := splitPath(currentName)
 	newParentPath, newEdgeName := splitPath(newName)
 
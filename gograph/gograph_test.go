@@ -438,6 +438,32 @@ func TestRename(t *testing.T) {
 
 }
 
+func TestRenameAll(t *testing.T) {
+	db, dbpath := newTestDb(t)
+	defer destroyTestDb(dbpath)
+
+	db.Set("/webapp", "1")
+	db.Set("/webapp2", "2")
+
+	if err := db.RenameAll([][2]string{{"/webapp", "/webapp-old"}, {"/webapp2", "/webapp"}}); err != nil {
+		t.Fatal(err)
+	}
+	if e := db.Get("/webapp"); e == nil || e.ID() != "2" {
+		t.Fatal("Expected /webapp to be entity 2")
+	}
+	if e := db.Get("/webapp-old"); e == nil || e.ID() != "1" {
+		t.Fatal("Expected /webapp-old to be entity 1")
+	}
+
+	// The second rename fails, the first is rolled back
+	if err := db.RenameAll([][2]string{{"/webapp", "/webapp3"}, {"/missing", "/other"}}); err == nil {
+		t.Fatal("Expected an error renaming a missing edge")
+	}
+	if e := db.Get("/webapp"); e == nil || e.ID() != "2" {
+		t.Fatal("Expected the renames to be rolled back")
+	}
+}
+
 func TestCreateMultipleNames(t *testing.T) {
 	db, dbpath := newTestDb(t)
 	defer destroyTestDb(dbpath)
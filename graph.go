@@ -10,13 +10,20 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 )
 
 // A Graph is a store for versioned filesystem images and the relationship between them.
 type Graph struct {
 	Root    string
 	idIndex *utils.TruncIndex
+	// Frees what the storage drivers made of a deleted image, given its id
+	// and its directory, if set
+	removeImageStorage func(id, root string) error
+	// Whether the images with identical layers share them. The volumes,
+	// whose layers are written to, don't.
+	shareLayers bool
+	layersLock  sync.Mutex
 }
 
 // NewGraph instantiates a new graph at the given root path in the filesystem.
@@ -94,12 +101,12 @@ func (graph *Graph) Get(name string) (*Image, error) {
 	return img, nil
 }
 
-// Create creates a new image and registers it in the graph.
+// Create creates a new image and registers it in the graph. Its id is
+// derived from its content, see contentID.
 func (graph *Graph) Create(layerData archive.Archive, container *Container, comment, author string, config *Config) (*Image, error) {
 	img := &Image{
-		ID:            GenerateID(),
 		Comment:       comment,
-		Created:       time.Now(),
+		Created:       now(),
 		DockerVersion: VERSION,
 		Author:        author,
 		Config:        config,
@@ -116,15 +123,22 @@ func (graph *Graph) Create(layerData archive.Archive, container *Container, comm
 	return img, nil
 }
 
-// Register imports a pre-existing image into the graph.
+// Register imports a pre-existing image into the graph. An image without
+// id gets the one derived from its content once its layer is stored.
 // FIXME: pass img as first argument
 func (graph *Graph) Register(jsonData []byte, layerData archive.Archive, img *Image) error {
-	if err := ValidateID(img.ID); err != nil {
-		return err
+	if img.ID != "" {
+		if err := ValidateID(img.ID); err != nil {
+			return err
+		}
+		// (This is a convenience to save time. Race conditions are taken care of by os.Rename)
+		if graph.Exists(img.ID) {
+			return fmt.Errorf("Image %s already exists", img.ID)
+		}
 	}
-	// (This is a convenience to save time. Race conditions are taken care of by os.Rename)
-	if graph.Exists(img.ID) {
-		return fmt.Errorf("Image %s already exists", img.ID)
+	// The layers of the image are stacked on the ones of its parent
+	if img.Parent != "" && !graph.Exists(img.Parent) {
+		return fmt.Errorf("Unable to register %s: its parent %s is not registered", img.ID, img.Parent)
 	}
 	tmp, err := graph.Mktemp("")
 	defer os.RemoveAll(tmp)
@@ -134,6 +148,16 @@ func (graph *Graph) Register(jsonData []byte, layerData archive.Archive, img *Im
 	if err := StoreImage(img, jsonData, layerData, tmp); err != nil {
 		return err
 	}
+	if graph.Exists(img.ID) {
+		return fmt.Errorf("Image %s already exists", img.ID)
+	}
+	graph.layersLock.Lock()
+	defer graph.layersLock.Unlock()
+	if graph.shareLayers {
+		if err := graph.shareLayer(tmp, img.LayerDigest); err != nil {
+			return err
+		}
+	}
 	// Commit
 	if err := os.Rename(tmp, graph.imageRoot(img.ID)); err != nil {
 		return err
@@ -271,7 +295,21 @@ func (graph *Graph) Delete(name string) error {
 	if err != nil {
 		return err
 	}
-	return os.RemoveAll(tmp)
+	if graph.removeImageStorage != nil {
+		if err := graph.removeImageStorage(id, tmp); err != nil {
+			return err
+		}
+	}
+	img, err := LoadImage(tmp)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err != nil || img.LayerDigest == "" {
+		return nil
+	}
+	graph.layersLock.Lock()
+	defer graph.layersLock.Unlock()
+	return graph.releaseLayer(img.LayerDigest)
 }
 
 // Map returns a list of all images in the graph, addressable by ID.
@@ -3,6 +3,7 @@ package docker
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/utils"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -121,6 +123,26 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestRegisterMissingParent(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := &Image{
+		ID:      GenerateID(),
+		Parent:  GenerateID(),
+		Created: time.Now(),
+	}
+	if err := graph.Register(nil, archive, image); err == nil {
+		t.Fatal("Expected an error registering an image without its parent")
+	}
+	if graph.Exists(image.ID) {
+		t.Fatal("Expected the image not to be registered")
+	}
+}
+
 func TestMount(t *testing.T) {
 	graph := tempGraph(t)
 	defer os.RemoveAll(graph.Root)
@@ -145,7 +167,7 @@ func TestMount(t *testing.T) {
 	if err := os.MkdirAll(rw, 0700); err != nil {
 		t.Fatal(err)
 	}
-	if err := image.Mount(rootfs, rw); err != nil {
+	if err := image.Mount(rootfs, rw, ""); err != nil {
 		t.Fatal(err)
 	}
 	// FIXME: test for mount contents
@@ -239,6 +261,162 @@ func TestDelete(t *testing.T) {
 	assertNImages(graph, t, 1)
 }
 
+func TestContentAddressableID(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(img.LayerDigest, "sha256:") {
+		t.Fatalf("Expected the digest of the layer, got %s", img.LayerDigest)
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(img.ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := contentID(jsonData); err != nil {
+		t.Fatal(err)
+	} else if id != img.ID {
+		t.Fatalf("Expected the id %s derived from the content, got %s", id, img.ID)
+	}
+
+	// Pulled from another graph, the image is checked against its content
+	other := tempGraph(t)
+	defer os.RemoveAll(other.Root)
+	pulled, err := NewImgJSON(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ = fakeTar()
+	if err := other.Register(jsonData, archive, pulled); err != nil {
+		t.Fatal(err)
+	}
+	tampered := &Image{ID: GenerateID(), LayerDigest: img.LayerDigest, Comment: "Testing"}
+	tamperedJSON, err := json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ = fakeTar()
+	if err := other.Register(tamperedJSON, archive, tampered); err == nil {
+		t.Fatal("Expected an error registering an image whose id isn't derived from its content")
+	}
+	tampered.ID, err = contentID(tamperedJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamperedJSON, err = json.Marshal(tampered); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "/etc/passwd", Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("evil\n"))
+	tw.Close()
+	if err := other.Register(tamperedJSON, buf, tampered); err == nil {
+		t.Fatal("Expected an error registering an image whose layer doesn't match its digest")
+	}
+
+	if err := graph.checkContentIDs(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	archive, _ = fakeTar()
+	legacy := &Image{ID: GenerateID(), Comment: "legacy", Created: time.Now()}
+	if err := graph.Register(nil, archive, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := graph.checkContentIDs(legacy.ID); err == nil {
+		t.Fatal("Expected an error checking an image whose id isn't derived from its content")
+	}
+}
+
+func TestSharedLayers(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	graph.shareLayers = true
+	var images []*Image
+	for _, comment := range []string{"first", "second"} {
+		archive, err := fakeTar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := graph.Create(archive, nil, comment, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, img)
+	}
+	if images[0].ID == images[1].ID {
+		t.Fatal("Expected the images to have different ids")
+	}
+	if images[0].LayerDigest != images[1].LayerDigest {
+		t.Fatalf("Expected identical layers to have the same digest, got %s and %s", images[0].LayerDigest, images[1].LayerDigest)
+	}
+	shared := graph.sharedLayerPath(images[0].LayerDigest)
+	for _, img := range images {
+		if layer, err := img.layer(); err != nil {
+			t.Fatal(err)
+		} else if layer != shared {
+			t.Fatalf("Expected the layer of %s to be %s, got %s", img.ID, shared, layer)
+		}
+	}
+	if err := graph.Delete(images[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(shared, "etc", "passwd")); err != nil {
+		t.Fatalf("Expected the layer to be kept for the other image: %s", err)
+	}
+	if err := graph.Delete(images[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Fatalf("Expected the layer to be removed with its last image: %v", err)
+	}
+}
+
+func TestSharedEmptyLayers(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	graph.shareLayers = true
+	base, err := graph.Create(testArchive(t), nil, "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two metadata-only steps on top of it, with the same empty layer
+	parent := base
+	for _, comment := range []string{"env", "cmd"} {
+		empty := new(bytes.Buffer)
+		tar.NewWriter(empty).Close()
+		img, err := graph.Create(empty, &Container{ID: GenerateID(), Image: parent.ID, Config: &Config{}}, comment, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = img
+	}
+
+	layers, err := parent.layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dockerinit layer, the empty layer once and the base layer
+	if len(layers) != 3 {
+		t.Fatalf("Expected 3 branches, got %d: %v", len(layers), layers)
+	}
+	emptyLayer, err := parent.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers[1] != emptyLayer {
+		t.Errorf("Expected the empty layer to be kept above the base layer, got %v", layers)
+	}
+}
+
 func TestByParent(t *testing.T) {
 	archive1, _ := fakeTar()
 	archive2, _ := fakeTar()
@@ -326,3 +504,45 @@ func fakeTar() (io.Reader, error) {
 	tw.Close()
 	return buf, nil
 }
+
+func TestLayerSize(t *testing.T) {
+	layer, err := ioutil.TempDir("", "docker-layer-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layer)
+	if err := ioutil.WriteFile(path.Join(layer, "file"), make([]byte, 100000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := layerSize(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 100000 {
+		t.Fatalf("Expected the size of the layer to be at least the size of its file, got %d", size)
+	}
+
+	if err := os.Link(path.Join(layer, "file"), path.Join(layer, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if linked, err := layerSize(layer); err != nil {
+		t.Fatal(err)
+	} else if linked != size {
+		t.Fatalf("Expected the hard link not to be counted, got %d instead of %d", linked, size)
+	}
+
+	// A sparse file takes the blocks written only
+	f, err := os.Create(path.Join(layer, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if sparse, err := layerSize(layer); err != nil {
+		t.Fatal(err)
+	} else if sparse >= 1<<30 {
+		t.Fatalf("Expected the sparse file to take no space, got %d", sparse)
+	}
+}
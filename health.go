@@ -0,0 +1,337 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The probe of a HEALTHCHECK runs every 30 seconds, fails after 30
+// seconds, and the container is unhealthy after 3 failures in a row,
+// unless it sets its own
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// The health of a container keeps the results of its last 5 probes, with
+// the first 4KB of their output
+const (
+	healthLogSize     = 5
+	healthOutputLimit = 4096
+)
+
+// The health statuses of a running container with a probe
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthConfig is how the health of the containers is probed, see the
+// HEALTHCHECK instruction
+type HealthConfig struct {
+	// The command probing the health, which exits 0 when healthy:
+	// ["CMD", args...] run as is, ["CMD-SHELL", command] run with
+	// /bin/sh -c, or ["NONE"] for no probe, not even the one of the image
+	Test []string
+	// 0 for the defaults
+	Interval time.Duration `json:",omitempty"`
+	Timeout  time.Duration `json:",omitempty"`
+	Retries  int           `json:",omitempty"`
+}
+
+// Health is the health of a running container with a probe
+type Health struct {
+	Status string
+	// The number of the last probes which failed in a row
+	FailingStreak int
+	// The last probes, the oldest first
+	Log []*HealthResult
+}
+
+// HealthResult is the result of a probe
+type HealthResult struct {
+	Start    time.Time
+	End      time.Time
+	ExitCode int
+	Output   string
+}
+
+// parseHealthcheck parses the arguments of HEALTHCHECK: NONE, or the
+// options -interval=DURATION, -timeout=DURATION and -retries=N followed by
+// CMD and the command, given as a JSON array or for /bin/sh -c
+func parseHealthcheck(args string) (*HealthConfig, error) {
+	config := &HealthConfig{}
+	rest := strings.TrimSpace(args)
+	for strings.HasPrefix(rest, "-") {
+		parts := strings.SplitN(rest, " ", 2)
+		option := strings.SplitN(strings.TrimLeft(parts[0], "-"), "=", 2)
+		if len(option) != 2 {
+			return nil, fmt.Errorf("Invalid HEALTHCHECK option %s: expected -name=value", parts[0])
+		}
+		var err error
+		switch option[0] {
+		case "interval":
+			config.Interval, err = time.ParseDuration(option[1])
+			if err == nil && config.Interval <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+		case "timeout":
+			config.Timeout, err = time.ParseDuration(option[1])
+			if err == nil && config.Timeout <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+		case "retries":
+			config.Retries, err = strconv.Atoi(option[1])
+			if err == nil && config.Retries <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown HEALTHCHECK option %s", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid HEALTHCHECK option %s: %s", parts[0], err)
+		}
+		rest = ""
+		if len(parts) == 2 {
+			rest = strings.TrimSpace(parts[1])
+		}
+	}
+
+	parts := strings.SplitN(rest, " ", 2)
+	switch strings.ToUpper(parts[0]) {
+	case "NONE":
+		if len(parts) == 2 || config.Interval != 0 || config.Timeout != 0 || config.Retries != 0 {
+			return nil, fmt.Errorf("HEALTHCHECK NONE takes no option nor command")
+		}
+		config.Test = []string{"NONE"}
+	case "CMD":
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("HEALTHCHECK CMD requires a command")
+		}
+		command := strings.TrimSpace(parts[1])
+		var cmd []string
+		if err := json.Unmarshal([]byte(command), &cmd); err == nil && len(cmd) > 0 {
+			config.Test = append([]string{"CMD"}, cmd...)
+		} else {
+			config.Test = []string{"CMD-SHELL", command}
+		}
+	default:
+		return nil, fmt.Errorf("Invalid HEALTHCHECK format: expected NONE or [OPTIONS] CMD command")
+	}
+	return config, nil
+}
+
+// probe returns the command of the probe, nil for none
+func (config *HealthConfig) probe() []string {
+	if config == nil || len(config.Test) == 0 {
+		return nil
+	}
+	switch config.Test[0] {
+	case "CMD":
+		return config.Test[1:]
+	case "CMD-SHELL":
+		return []string{"/bin/sh", "-c", strings.Join(config.Test[1:], " ")}
+	}
+	return nil
+}
+
+// record adds the result of a probe to the health: the container is
+// healthy once a probe succeeds, and unhealthy once retries probes fail in
+// a row
+func (health *Health) record(result *HealthResult, retries int) {
+	health.Log = append(health.Log, result)
+	if len(health.Log) > healthLogSize {
+		health.Log = health.Log[len(health.Log)-healthLogSize:]
+	}
+	if result.ExitCode == 0 {
+		health.FailingStreak = 0
+		health.Status = HealthHealthy
+		return
+	}
+	health.FailingStreak++
+	if health.FailingStreak >= retries {
+		health.Status = HealthUnhealthy
+	}
+}
+
+// probeUser returns the uid and gid of the user of the container, resolved
+// in its /etc/passwd as dockerinit does, "" for root
+func (container *Container) probeUser() (uid, gid string, err error) {
+	if container.Config.User == "" {
+		return "", "", nil
+	}
+	passwd, err := archive.FollowSymlinkInScope(path.Join(container.RootfsPath(), "etc/passwd"), container.RootfsPath())
+	if err != nil {
+		return "", "", err
+	}
+	user, err := utils.UserLookupFile(passwd, container.Config.User)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to find user %s: %s", container.Config.User, err)
+	}
+	return user.Uid, user.Gid, nil
+}
+
+// probeCommand returns the command running the probe of the container with
+// the init process pid: a shell of the host joins the cgroups of the
+// container, so that the probe is accounted and limited with it, then runs
+// nsenter, which enters the namespaces and becomes the user of the
+// container.
+func (container *Container) probeCommand(pid int, probe []string) (*exec.Cmd, error) {
+	nsenter, err := exec.LookPath("nsenter")
+	if err != nil {
+		return nil, err
+	}
+	cgroups, err := cgroupDirs(pid)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the cgroups of container %s: %s", container.ID, err)
+	}
+	uid, gid, err := container.probeUser()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-c", `until [ "$1" = -- ]; do echo $$ > "$1" || exit 126; shift; done; shift; exec "$@"`, "probe"}
+	for _, dir := range cgroups {
+		args = append(args, path.Join(dir, "tasks"))
+	}
+	args = append(args, "--", nsenter, "--target", strconv.Itoa(pid), "--mount", "--uts", "--ipc", "--net", "--pid")
+	if uid != "" {
+		args = append(args, "--setuid", uid, "--setgid", gid)
+	}
+	args = append(args, "--")
+	cmd := exec.Command("/bin/sh", append(args, probe...)...)
+	cmd.Env = container.Config.Env
+	return cmd, nil
+}
+
+// probeHealth runs the command in the namespaces and the cgroups of the
+// running container, as its user and with its environment, killing it
+// after timeout
+func (container *Container) probeHealth(command []string, timeout time.Duration) *HealthResult {
+	result := &HealthResult{Start: time.Now(), ExitCode: -1}
+	defer func() { result.End = time.Now() }()
+
+	pid, err := container.initPid()
+	if err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	cmd, err := container.probeCommand(pid, command)
+	if err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// The probe and its children are killed together
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			result.ExitCode = 0
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		result.Output = output.String()
+		if len(result.Output) > healthOutputLimit {
+			result.Output = result.Output[:healthOutputLimit]
+		}
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		result.Output = fmt.Sprintf("Health check exceeded timeout (%s)", timeout)
+	}
+	return result
+}
+
+// monitorHealth probes the health of the running container until stop is
+// closed, logging a health_status event when its status changes
+func (container *Container) monitorHealth(config *HealthConfig, stop chan struct{}) {
+	interval, timeout, retries := config.Interval, config.Timeout, config.Retries
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	if retries == 0 {
+		retries = defaultHealthRetries
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		result := container.probeHealth(config.probe(), timeout)
+
+		container.State.Lock()
+		health := container.State.Health
+		if health == nil || !container.State.Running {
+			container.State.Unlock()
+			return
+		}
+		previous := health.Status
+		health.record(result, retries)
+		status := health.Status
+		container.State.Unlock()
+
+		if status == previous || container.runtime == nil {
+			continue
+		}
+		container.runtime.index.update(container)
+		if container.runtime.srv != nil {
+			container.runtime.srv.LogEvent("health_status: "+status, container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+		}
+	}
+}
+
+// startHealthMonitor starts probing the health of the container which just
+// started, if it has a probe
+func (container *Container) startHealthMonitor() {
+	container.State.Health = nil
+	container.resumeHealthMonitor()
+}
+
+// resumeHealthMonitor probes the health of the running container again
+// once the daemon restored it, keeping its health so far
+func (container *Container) resumeHealthMonitor() {
+	config := container.Config.Healthcheck
+	if config.probe() == nil {
+		container.State.Health = nil
+		return
+	}
+	if container.State.Health == nil {
+		container.State.Health = &Health{Status: HealthStarting}
+	}
+	container.healthStop = make(chan struct{})
+	go container.monitorHealth(config, container.healthStop)
+}
+
+// stopHealthMonitor stops probing the health of the container, which
+// stopped
+func (container *Container) stopHealthMonitor() {
+	if container.healthStop != nil {
+		close(container.healthStop)
+		container.healthStop = nil
+	}
+}
@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHealthcheck(t *testing.T) {
+	config, err := parseHealthcheck("-interval=5s --timeout=2s -retries=4 CMD curl -f http://localhost/ || exit 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != 5*time.Second || config.Timeout != 2*time.Second || config.Retries != 4 {
+		t.Errorf("Expected the options 5s, 2s and 4, got %s, %s and %d", config.Interval, config.Timeout, config.Retries)
+	}
+	if probe := strings.Join(config.probe(), " "); probe != "/bin/sh -c curl -f http://localhost/ || exit 1" {
+		t.Errorf("Expected the command run with /bin/sh -c, got %s", probe)
+	}
+
+	config, err = parseHealthcheck(`cmd ["/bin/check", "-v"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test := strings.Join(config.Test, " "); test != "CMD /bin/check -v" {
+		t.Errorf("Expected the command run as is, got %s", test)
+	}
+	if config.Interval != 0 || config.Retries != 0 {
+		t.Errorf("Expected the default options, got %+v", config)
+	}
+
+	config, err = parseHealthcheck("NONE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.probe() != nil {
+		t.Errorf("Expected no probe for NONE, got %v", config.probe())
+	}
+
+	for _, args := range []string{"", "CMD", "curl localhost", "NONE true", "-interval=5s NONE", "-interval=0s CMD true", "-retries=x CMD true", "-user=root CMD true", "-interval CMD true"} {
+		if _, err := parseHealthcheck(args); err == nil {
+			t.Errorf("Expected an error for HEALTHCHECK %s", args)
+		}
+	}
+}
+
+func TestHealthRecord(t *testing.T) {
+	health := &Health{Status: HealthStarting}
+	fail := &HealthResult{ExitCode: 1}
+	pass := &HealthResult{ExitCode: 0}
+
+	health.record(fail, 2)
+	if health.Status != HealthStarting || health.FailingStreak != 1 {
+		t.Fatalf("Expected the container still starting after a failure, got %s (%d)", health.Status, health.FailingStreak)
+	}
+	health.record(pass, 2)
+	if health.Status != HealthHealthy || health.FailingStreak != 0 {
+		t.Fatalf("Expected the container healthy after a success, got %s (%d)", health.Status, health.FailingStreak)
+	}
+	health.record(fail, 2)
+	if health.Status != HealthHealthy {
+		t.Fatalf("Expected the container healthy until the retries fail, got %s", health.Status)
+	}
+	health.record(fail, 2)
+	if health.Status != HealthUnhealthy {
+		t.Fatalf("Expected the container unhealthy after 2 failures in a row, got %s", health.Status)
+	}
+	for i := 0; i < healthLogSize; i++ {
+		health.record(pass, 2)
+	}
+	if len(health.Log) != healthLogSize || health.Log[0] != pass {
+		t.Errorf("Expected the last %d results to be kept, got %d", healthLogSize, len(health.Log))
+	}
+
+	state := &State{Running: true, StartedAt: time.Now(), Health: health}
+	if status := state.String(); !strings.HasSuffix(status, "(healthy)") {
+		t.Errorf("Expected the health in the status, got %s", status)
+	}
+}
+
+func TestProbeUser(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(path.Join(root, "rootfs/etc"), 0755)
+	ioutil.WriteFile(path.Join(root, "rootfs/etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"), 0644)
+
+	container := &Container{root: root, Config: &Config{}}
+	if uid, gid, err := container.probeUser(); err != nil || uid != "" || gid != "" {
+		t.Errorf("Expected no user for root, got %q:%q (%v)", uid, gid, err)
+	}
+	for _, user := range []string{"app", "1000"} {
+		container.Config.User = user
+		uid, gid, err := container.probeUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != "1000" || gid != "1001" {
+			t.Errorf("Expected the user %s to be 1000:1001, got %s:%s", user, uid, gid)
+		}
+	}
+	container.Config.User = "nobody"
+	if _, _, err := container.probeUser(); err == nil {
+		t.Error("Expected an error for a user missing from the container")
+	}
+}
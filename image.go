@@ -1,7 +1,6 @@
 package docker
 
 import (
-	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -16,6 +15,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -30,8 +30,12 @@ type Image struct {
 	Author          string    `json:"author,omitempty"`
 	Config          *Config   `json:"config,omitempty"`
 	Architecture    string    `json:"architecture,omitempty"`
-	graph           *Graph
-	Size            int64
+	// The digest of the filesystem layer, see layerDigest
+	LayerDigest string `json:"layer_digest,omitempty"`
+	// The signatures of the id, out of it, see ImageSignature
+	Signatures []ImageSignature `json:"signatures,omitempty"`
+	graph      *Graph
+	Size       int64
 }
 
 func LoadImage(root string) (*Image, error) {
@@ -61,6 +65,15 @@ func LoadImage(root string) (*Image, error) {
 		}
 	}
 
+	// The images described without the digest of their layer
+	if img.LayerDigest == "" {
+		if buf, err := ioutil.ReadFile(layerDigestPath(root)); err == nil {
+			img.LayerDigest = string(buf)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
 	// Check that the filesystem layer exists
 	if stat, err := os.Stat(layerPath(root)); err != nil {
 		if os.IsNotExist(err) {
@@ -96,10 +109,44 @@ func StoreImage(img *Image, jsonData []byte, layerData archive.Archive, root str
 		utils.Debugf("Untar time: %vs", time.Now().Sub(start).Seconds())
 	}
 
+	// Check the layer against the digest the image is described with
+	digest, err := layerDigest(layer)
+	if err != nil {
+		return err
+	}
+	described := img.LayerDigest != ""
+	if described && img.LayerDigest != digest {
+		return fmt.Errorf("Image %s is corrupted: the digest of its layer is %s, expected %s", img.ID, digest, img.LayerDigest)
+	}
+	img.LayerDigest = digest
+	if err := ioutil.WriteFile(layerDigestPath(root), []byte(digest), 0600); err != nil {
+		return err
+	}
+
 	// If raw json is provided, then use it
 	if jsonData != nil {
-		return ioutil.WriteFile(jsonPath(root), jsonData, 0600)
+		// The images described with the digest of their layer have an id
+		// derived from their content
+		if described {
+			if id, err := contentID(jsonData); err != nil {
+				return err
+			} else if id != img.ID {
+				return fmt.Errorf("Image %s is corrupted: its content is the one of image %s", img.ID, id)
+			}
+		}
+		if err := ioutil.WriteFile(jsonPath(root), jsonData, 0600); err != nil {
+			return err
+		}
 	} else { // Otherwise, unmarshal the image
+		if img.ID == "" {
+			jsonData, err := json.Marshal(img)
+			if err != nil {
+				return err
+			}
+			if img.ID, err = contentID(jsonData); err != nil {
+				return err
+			}
+		}
 		jsonData, err := json.Marshal(img)
 		if err != nil {
 			return err
@@ -113,13 +160,16 @@ func StoreImage(img *Image, jsonData []byte, layerData archive.Archive, root str
 }
 
 func StoreSize(img *Image, root string) error {
-	layer := layerPath(root)
+	// The layer may be shared with other images
+	layer, err := filepath.EvalSymlinks(layerPath(root))
+	if err != nil {
+		return err
+	}
 
-	var totalSize int64 = 0
-	filepath.Walk(layer, func(path string, fileInfo os.FileInfo, err error) error {
-		totalSize += fileInfo.Size()
-		return nil
-	})
+	totalSize, err := layerSize(layer)
+	if err != nil {
+		return err
+	}
 	img.Size = totalSize
 
 	if err := ioutil.WriteFile(path.Join(root, "layersize"), []byte(strconv.Itoa(int(totalSize))), 0600); err != nil {
@@ -129,6 +179,36 @@ func StoreSize(img *Image, root string) error {
 	return nil
 }
 
+// layerSize returns the space the files of the layer at layer take on disk,
+// as du counts it: the blocks of each file, once for the hard links to the
+// same file
+func layerSize(layer string) (int64, error) {
+	var size int64
+	inodes := make(map[uint64]bool)
+	err := filepath.Walk(layer, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if pth == layer {
+			return nil
+		}
+		stat, ok := f.Sys().(*syscall.Stat_t)
+		if !ok {
+			size += f.Size()
+			return nil
+		}
+		if stat.Nlink > 1 {
+			if inodes[uint64(stat.Ino)] {
+				return nil
+			}
+			inodes[uint64(stat.Ino)] = true
+		}
+		size += int64(stat.Blocks) * 512
+		return nil
+	})
+	return size, err
+}
+
 func layerPath(root string) string {
 	return path.Join(root, "layer")
 }
@@ -137,7 +217,13 @@ func jsonPath(root string) string {
 	return path.Join(root, "json")
 }
 
-func MountAUFS(ro []string, rw string, target string) error {
+func layerDigestPath(root string) string {
+	return path.Join(root, "layerdigest")
+}
+
+// MountAUFS mounts the union of the layers on target. A non empty
+// mountLabel is the SELinux context of all the files of the mount.
+func MountAUFS(ro []string, rw string, target string, mountLabel string) error {
 	// FIXME: Now mount the layers
 	rwBranch := fmt.Sprintf("%v=rw", rw)
 	roBranches := ""
@@ -147,6 +233,9 @@ func MountAUFS(ro []string, rw string, target string) error {
 	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
 
 	branches += ",xino=/dev/shm/aufs.xino"
+	if mountLabel != "" {
+		branches += fmt.Sprintf(",context=\"%s\"", mountLabel)
+	}
 
 	//if error, try to load aufs kernel module
 	if err := mount("none", target, "aufs", 0, branches); err != nil {
@@ -171,7 +260,7 @@ func (image *Image) TarLayer(compression archive.Compression) (archive.Archive,
 	return archive.Tar(layerPath, compression)
 }
 
-func (image *Image) Mount(root, rw string) error {
+func (image *Image) Mount(root, rw, mountLabel string) error {
 	if mounted, err := Mounted(root); err != nil {
 		return err
 	} else if mounted {
@@ -188,7 +277,7 @@ func (image *Image) Mount(root, rw string) error {
 	if err := os.Mkdir(rw, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
-	if err := MountAUFS(layers, rw, root); err != nil {
+	if err := MountAUFS(layers, rw, root, mountLabel); err != nil {
 		return err
 	}
 	return nil
@@ -218,7 +307,7 @@ func ValidateID(id string) error {
 
 func GenerateID() string {
 	id := make([]byte, 32)
-	_, err := io.ReadFull(rand.Reader, id)
+	_, err := io.ReadFull(idEntropy, id)
 	if err != nil {
 		panic(err) // This shouldn't happen
 	}
@@ -247,11 +336,16 @@ func (img *Image) History() ([]*Image, error) {
 func (img *Image) layers() ([]string, error) {
 	var list []string
 	var e error
+	// The shared layers, e.g. the empty ones of the ENV or CMD steps of a
+	// build, can appear several times in the history: a branch can only be
+	// mounted once, and its topmost occurrence hides the others anyway
+	seen := make(map[string]bool)
 	if err := img.WalkHistory(
 		func(img *Image) (err error) {
 			if layer, err := img.layer(); err != nil {
 				e = err
-			} else if layer != "" {
+			} else if layer != "" && !seen[layer] {
+				seen[layer] = true
 				list = append(list, layer)
 			}
 			return err
@@ -314,13 +408,21 @@ func (img *Image) root() (string, error) {
 	return img.graph.imageRoot(img.ID), nil
 }
 
-// Return the path of an image's layer
+// Return the path of an image's layer, possibly shared with other images
 func (img *Image) layer() (string, error) {
 	root, err := img.root()
 	if err != nil {
 		return "", err
 	}
-	return layerPath(root), nil
+	return filepath.EvalSymlinks(layerPath(root))
+}
+
+// labels returns the labels of the image, set by its config
+func (img *Image) labels() map[string]string {
+	if img.Config == nil {
+		return nil
+	}
+	return img.Config.Labels
 }
 
 func (img *Image) getParentsSize(size int64) int64 {
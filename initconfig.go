@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// The restart policies of the init files. The containers don't have one
+// of their own: the init system restarts them.
+const (
+	InitRestartNo        = "no"
+	InitRestartOnFailure = "on-failure"
+	InitRestartAlways    = "always"
+)
+
+const systemdUnitTemplate = `[Unit]
+Description=Docker container {{.Name}}
+Requires=docker.service{{range .Dependencies}} {{.}}.service{{end}}
+After=docker.service{{range .Dependencies}} {{.}}.service{{end}}
+
+[Service]
+{{if eq .Restart "no"}}Restart=no{{else}}Restart={{.Restart}}
+RestartSec=1{{end}}
+ExecStart={{.Docker}} start -a {{.Name}}
+ExecStop={{.Docker}} stop -t 10 {{.Name}}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const upstartJobTemplate = `description "Docker container {{.Name}}"
+
+start on started docker{{range .Dependencies}} and started {{.}}{{end}}
+stop on stopping docker{{range .Dependencies}} or stopping {{.}}{{end}}
+{{if ne .Restart "no"}}
+respawn{{if eq .Restart "on-failure"}}
+normal exit 0{{end}}
+{{end}}
+script
+	{{.Docker}} start -a {{.Name}}
+end script
+
+pre-stop exec {{.Docker}} stop -t 10 {{.Name}}
+`
+
+var initTemplates = map[string]*template.Template{
+	"systemd": template.Must(template.New("systemd").Parse(systemdUnitTemplate)),
+	"upstart": template.Must(template.New("upstart").Parse(upstartJobTemplate)),
+}
+
+// initServiceName is the name of the systemd unit or upstart job of the
+// container named name
+func initServiceName(name string) string {
+	return "docker-" + strings.TrimPrefix(name, "/")
+}
+
+// initDependencies returns the names of the containers the container
+// needs, sorted
+func (runtime *Runtime) initDependencies(container *Container) ([]string, error) {
+	containers, err := runtime.dependencies(container)
+	if err != nil {
+		return nil, err
+	}
+	var dependencies []string
+	for _, dependency := range containers {
+		dependencies = append(dependencies, dependency.Name)
+	}
+	sort.Strings(dependencies)
+	return dependencies, nil
+}
+
+// initConfig returns the systemd unit or the upstart job, depending on
+// system, which starts the container with the init system of the host and
+// restarts it according to restart
+func (runtime *Runtime) initConfig(container *Container, system, restart string) (string, error) {
+	tmpl, exists := initTemplates[system]
+	if !exists {
+		return "", fmt.Errorf("Bad parameter system: %s, expected systemd or upstart", system)
+	}
+	switch restart {
+	case InitRestartNo, InitRestartOnFailure, InitRestartAlways:
+	default:
+		return "", fmt.Errorf("Bad parameter restart: %s, expected %s, %s or %s", restart, InitRestartNo, InitRestartOnFailure, InitRestartAlways)
+	}
+	dependencies, err := runtime.initDependencies(container)
+	if err != nil {
+		return "", err
+	}
+	for i, name := range dependencies {
+		dependencies[i] = initServiceName(name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Name         string
+		Docker       string
+		Restart      string
+		Dependencies []string
+	}{
+		Name:         strings.TrimPrefix(container.Name, "/"),
+		Docker:       utils.SelfPath(),
+		Restart:      restart,
+		Dependencies: dependencies,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
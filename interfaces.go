@@ -0,0 +1,374 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The name of the interface of a container on the bridge of the daemon,
+// when none is given
+const DefaultInterfaceName = "eth0"
+
+// A container has at most maxInterfaces interfaces, so that the host side
+// of their veth pairs fits in the 15 characters of an interface name
+const maxInterfaces = 10
+
+var validInterfaceName = regexp.MustCompile(`^[^\s/:]{1,15}$`)
+
+// InterfaceSettings describes one of the network interfaces of a container
+type InterfaceSettings struct {
+	Name        string
+	Bridge      string
+	IPAddress   string
+	IPPrefixLen int
+	Gateway     string
+	HostVeth    string
+}
+
+// parseNetworkAttach parses the bridge[:name] format of -net-attach. The
+// name is empty when not given.
+func parseNetworkAttach(rawAttach string) (string, string, error) {
+	parts := strings.SplitN(rawAttach, ":", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid network attachment: %s, expected bridge[:name]", rawAttach)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// interfaceNames returns the names of the interfaces of a container, the one
+// on the bridge of the daemon first, then the ones of hostConfig.NetworkAttach.
+// Interfaces attached without a name are named ethN, after their position.
+func interfaceNames(hostConfig *HostConfig) ([]string, error) {
+	primary := DefaultInterfaceName
+	if hostConfig != nil && hostConfig.Interface != "" {
+		primary = hostConfig.Interface
+	}
+	names := []string{primary}
+	if hostConfig != nil {
+		for _, rawAttach := range hostConfig.NetworkAttach {
+			_, name, err := parseNetworkAttach(rawAttach)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				name = fmt.Sprintf("eth%d", len(names))
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) > maxInterfaces {
+		return nil, fmt.Errorf("Too many network interfaces: %d, the maximum is %d", len(names), maxInterfaces)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !validInterfaceName.MatchString(name) || name == "lo" || name == "." || name == ".." {
+			return nil, fmt.Errorf("Invalid interface name: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Conflict, the interface name %s is used twice", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
+
+// bridgeManager returns the manager of the interfaces on the given bridge.
+// The bridges other than the one of the daemon must already exist: their
+// manager only allocates the ips of their network, the ports are still
+// published from the interface on the bridge of the daemon.
+func (manager *NetworkManager) bridgeManager(bridge string) (*NetworkManager, error) {
+	if bridge == manager.bridgeIface {
+		return manager, nil
+	}
+
+	manager.bridgesLock.Lock()
+	defer manager.bridgesLock.Unlock()
+
+	if m, exists := manager.bridges[bridge]; exists {
+		return m, nil
+	}
+	addr, err := getIfaceAddr(bridge)
+	if err != nil {
+		return nil, fmt.Errorf("No such bridge: %s", bridge)
+	}
+	network := addr.(*net.IPNet)
+	m := &NetworkManager{
+		bridgeIface:      bridge,
+		bridgeNetwork:    network,
+		ipAllocator:      newIPAllocator(network),
+		tcpPortAllocator: manager.tcpPortAllocator,
+		udpPortAllocator: manager.udpPortAllocator,
+		portMapper:       manager.portMapper,
+		mirrors:          make(map[*NetworkInterface]string),
+	}
+	if manager.bridges == nil {
+		manager.bridges = make(map[string]*NetworkManager)
+	}
+	manager.bridges[bridge] = m
+	return m, nil
+}
+
+// allocateAttachedNetworks allocates the interfaces of hostConfig.NetworkAttach.
+// For a ghost container, the ips recorded in its network settings are
+// reserved again.
+func (container *Container) allocateAttachedNetworks() ([]*NetworkInterface, error) {
+	var ifaces []*NetworkInterface
+	release := func() {
+		for _, iface := range ifaces {
+			iface.Release()
+		}
+	}
+
+	for i, rawAttach := range container.hostConfig.NetworkAttach {
+		bridge, _, err := parseNetworkAttach(rawAttach)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		manager, err := container.runtime.networkManager.bridgeManager(bridge)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		var iface *NetworkInterface
+		if container.State.Ghost && i+1 < len(container.NetworkSettings.Interfaces) {
+			if ip := net.ParseIP(container.NetworkSettings.Interfaces[i+1].IPAddress); ip != nil {
+				iface = &NetworkInterface{
+					IPNet:   net.IPNet{IP: ip, Mask: manager.bridgeNetwork.Mask},
+					Gateway: manager.bridgeNetwork.IP,
+					manager: manager,
+				}
+				manager.ipAllocator.inUse[ipToInt(ip)] = struct{}{}
+			}
+		}
+		if iface == nil {
+			if iface, err = manager.Allocate(); err != nil {
+				release()
+				return nil, err
+			}
+		}
+		iface.Veth = hostVethName(container.ID, i+1)
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+func newInterfaceSettings(name string, iface *NetworkInterface) InterfaceSettings {
+	prefixLen, _ := iface.IPNet.Mask.Size()
+	return InterfaceSettings{
+		Name:        name,
+		Bridge:      iface.manager.bridgeIface,
+		IPAddress:   iface.IPNet.IP.String(),
+		IPPrefixLen: prefixLen,
+		Gateway:     iface.Gateway.String(),
+		HostVeth:    iface.Veth,
+	}
+}
+
+// AttachNetwork connects the running container to bridge with an additional
+// interface, named name or, when empty, the first free ethN. The attachment
+// is also recorded in the host config, so it survives a restart.
+func (container *Container) AttachNetwork(bridge, name string) (*InterfaceSettings, error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to connect container %s to %s: it is not running", container.ID, bridge)
+	}
+	if container.network == nil {
+		return nil, fmt.Errorf("Impossible to connect container %s to %s: its network is disabled", container.ID, bridge)
+	}
+
+	used := make(map[string]bool)
+	for _, settings := range container.NetworkSettings.Interfaces {
+		used[settings.Name] = true
+	}
+	for i := 1; name == ""; i++ {
+		if !used[fmt.Sprintf("eth%d", i)] {
+			name = fmt.Sprintf("eth%d", i)
+		}
+	}
+	attach := append(append([]string{}, container.hostConfig.NetworkAttach...), bridge+":"+name)
+	if _, err := interfaceNames(&HostConfig{Interface: container.hostConfig.Interface, NetworkAttach: attach}); err != nil {
+		return nil, err
+	}
+
+	manager, err := container.runtime.networkManager.bridgeManager(bridge)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := manager.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	iface.Veth = container.freeHostVethName()
+	pid, err := container.initPid()
+	if err != nil {
+		iface.Release()
+		return nil, err
+	}
+	if err := plugInterface(iface, name, pid); err != nil {
+		iface.Release()
+		return nil, err
+	}
+
+	settings := newInterfaceSettings(name, iface)
+	container.attachedNetwork = append(container.attachedNetwork, iface)
+	container.NetworkSettings.Interfaces = append(container.NetworkSettings.Interfaces, settings)
+	container.hostConfig.NetworkAttach = attach
+	if err := container.updateNetworkAttach(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// DetachNetwork removes the interface name, connected to another bridge than
+// the one of the daemon, from the running container
+func (container *Container) DetachNetwork(name string) error {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to disconnect %s from container %s: it is not running", name, container.ID)
+	}
+	index := -1
+	for i, settings := range container.NetworkSettings.Interfaces {
+		if settings.Name == name {
+			index = i
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("No such interface in container %s: %s", container.ID, name)
+	}
+	if index == 0 {
+		return fmt.Errorf("Impossible to disconnect %s from container %s: it is on the bridge of the daemon", name, container.ID)
+	}
+
+	iface := container.attachedNetwork[index-1]
+	// Removing the host side of the veth pair removes both sides
+	if err := ipCommand("link", "del", iface.Veth); err != nil {
+		return err
+	}
+	iface.Release()
+
+	container.attachedNetwork = append(container.attachedNetwork[:index-1], container.attachedNetwork[index:]...)
+	container.NetworkSettings.Interfaces = append(container.NetworkSettings.Interfaces[:index], container.NetworkSettings.Interfaces[index+1:]...)
+	container.hostConfig.NetworkAttach = append(container.hostConfig.NetworkAttach[:index-1], container.hostConfig.NetworkAttach[index:]...)
+	return container.updateNetworkAttach()
+}
+
+// updateNetworkAttach saves the interfaces of the container after they
+// changed, and maps its hostname to their ips
+func (container *Container) updateNetworkAttach() error {
+	if err := container.writeHostConfig(); err != nil {
+		return err
+	}
+	if err := container.buildHostnameAndHostsFiles(); err != nil {
+		return err
+	}
+	return container.ToDisk()
+}
+
+// freeHostVethName returns a name for the host side of the veth pair of a
+// new interface, unused by the other interfaces of the container
+func (container *Container) freeHostVethName() string {
+	used := make(map[string]bool)
+	for _, iface := range container.attachedNetwork {
+		used[iface.Veth] = true
+	}
+	for i := 1; i < maxInterfaces; i++ {
+		if name := hostVethName(container.ID, i); !used[name] {
+			return name
+		}
+	}
+	// interfaceNames already limits the number of interfaces
+	return hostVethName(container.ID, maxInterfaces-1)
+}
+
+// initPid returns the pid of the first process of the container, as seen
+// from the host
+func (container *Container) initPid() (int, error) {
+	output, err := exec.Command("lxc-info", "-p", "-n", container.ID).CombinedOutput()
+	if err != nil {
+		return -1, fmt.Errorf("Unable to get the pid of container %s: %s (%s)", container.ID, strings.TrimSpace(string(output)), err)
+	}
+	// lxc-info prints "pid: N"
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return -1, fmt.Errorf("Unable to get the pid of container %s: empty lxc-info output", container.ID)
+	}
+	return strconv.Atoi(fields[len(fields)-1])
+}
+
+// plugInterface creates the veth pair of iface, connects its host side to
+// the bridge of iface and moves the other side, as name, in the network
+// namespace of the process pid
+func plugInterface(iface *NetworkInterface, name string, pid int) error {
+	// The temporary name of the container side must not clash on the host
+	peer := "ns" + strings.TrimPrefix(iface.Veth, "veth")
+	if err := ipCommand("link", "add", iface.Veth, "type", "veth", "peer", "name", peer); err != nil {
+		return err
+	}
+	prefixLen, _ := iface.IPNet.Mask.Size()
+	steps := [][]string{
+		{"link", "set", iface.Veth, "master", iface.manager.bridgeIface},
+		{"link", "set", iface.Veth, "up"},
+		{"link", "set", peer, "netns", strconv.Itoa(pid)},
+	}
+	for _, step := range steps {
+		if err := ipCommand(step...); err != nil {
+			ipCommand("link", "del", iface.Veth)
+			return err
+		}
+	}
+	steps = [][]string{
+		{"link", "set", peer, "name", name},
+		{"addr", "add", fmt.Sprintf("%s/%d", iface.IPNet.IP, prefixLen), "dev", name},
+		{"link", "set", name, "mtu", "1500", "up"},
+	}
+	for _, step := range steps {
+		if err := ipInNetns(pid, step...); err != nil {
+			ipCommand("link", "del", iface.Veth)
+			return err
+		}
+	}
+	return nil
+}
+
+func ipCommand(args ...string) error {
+	path, err := exec.LookPath("ip")
+	if err != nil {
+		return fmt.Errorf("Unable to configure the network: ip not found")
+	}
+	if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip failed: ip %s: %s (%s)", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// ipInNetns runs the ip command in the network namespace of the process pid.
+// ip netns only knows the namespaces linked from /var/run/netns, so the one
+// of pid is linked there for the time of the command.
+func ipInNetns(pid int, args ...string) error {
+	if err := os.MkdirAll("/var/run/netns", 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("docker-%d-%d", pid, time.Now().UnixNano())
+	if err := os.Symlink(fmt.Sprintf("/proc/%d/ns/net", pid), path.Join("/var/run/netns", name)); err != nil {
+		return err
+	}
+	defer os.Remove(path.Join("/var/run/netns", name))
+	return ipCommand(append([]string{"netns", "exec", name, "ip"}, args...)...)
+}
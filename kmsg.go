@@ -0,0 +1,222 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	kmsgPath          = "/dev/kmsg"
+	maxKernelMessages = 20
+	maxTrackedPids    = 4096
+	pidSampleInterval = time.Second
+)
+
+// The pids the kernel messages about OOM kills, segfaults and AppArmor
+// denials mention
+var kernelMessagePids = []*regexp.Regexp{
+	regexp.MustCompile(`[Kk]ill(?:ed)? process (\d+)`),
+	regexp.MustCompile(`\[(\d+)\]:? (?:segfault|general protection|trap)`),
+	regexp.MustCompile(`\bpid=(\d+)`),
+}
+
+// kernelMessage is a record of the kernel log
+type kernelMessage struct {
+	// Since the boot of the host
+	Time time.Duration
+	Text string
+}
+
+// pidSet is the set of the pids seen in a container while it ran
+type pidSet struct {
+	sync.Mutex
+	pids map[int]bool
+}
+
+// watchPids records the pids of the processes of the container every
+// pidSampleInterval while it runs, so that the kernel messages about them
+// can be found once it exits. The short-lived processes may be missed.
+func (container *Container) watchPids() {
+	dir, err := container.memoryCgroupDir()
+	if err != nil {
+		utils.Debugf("watchPids: %s", err)
+		return
+	}
+	seen := &pidSet{pids: make(map[int]bool)}
+	container.seenPids = seen
+	go func() {
+		for {
+			data, err := ioutil.ReadFile(path.Join(dir, "tasks"))
+			if err != nil {
+				// The cgroup is removed once the container exits
+				return
+			}
+			seen.Lock()
+			for _, field := range strings.Fields(string(data)) {
+				if pid, err := strconv.Atoi(field); err == nil && len(seen.pids) < maxTrackedPids {
+					seen.pids[pid] = true
+				}
+			}
+			seen.Unlock()
+			time.Sleep(pidSampleInterval)
+		}
+	}()
+}
+
+// readKernelMessages returns the records of the kernel log
+func readKernelMessages() ([]kernelMessage, error) {
+	// os.File would wait for more records once they are all read
+	fd, err := syscall.Open(kmsgPath, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	var messages []kernelMessage
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EPIPE {
+			// The record was overwritten while being read
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		if message, ok := parseKernelMessage(string(buf[:n])); ok {
+			messages = append(messages, message)
+		}
+	}
+}
+
+// parseKernelMessage parses a record of /dev/kmsg, e.g.
+// "6,1234,5678901234,-;cat[42]: segfault at 0 ip ..."
+func parseKernelMessage(record string) (kernelMessage, bool) {
+	parts := strings.SplitN(record, ";", 2)
+	if len(parts) != 2 {
+		return kernelMessage{}, false
+	}
+	fields := strings.Split(parts[0], ",")
+	if len(fields) < 3 {
+		return kernelMessage{}, false
+	}
+	usec, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return kernelMessage{}, false
+	}
+	// The continuation lines start with a space
+	text := strings.SplitN(parts[1], "\n", 2)[0]
+	return kernelMessage{Time: time.Duration(usec) * time.Microsecond, Text: text}, true
+}
+
+// matchKernelMessages returns the texts of the messages logged since since
+// which mention the container id or one of pids
+func matchKernelMessages(messages []kernelMessage, since time.Duration, id string, pids map[int]bool) []string {
+	var matches []string
+	for _, message := range messages {
+		if message.Time < since {
+			continue
+		}
+		matched := strings.Contains(message.Text, id)
+		for _, pattern := range kernelMessagePids {
+			if matched {
+				break
+			}
+			for _, match := range pattern.FindAllStringSubmatch(message.Text, -1) {
+				if pid, err := strconv.Atoi(match[1]); err == nil && pids[pid] {
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			matches = append(matches, message.Text)
+		}
+	}
+	// The last ones explain the exit best
+	if len(matches) > maxKernelMessages {
+		matches = matches[len(matches)-maxKernelMessages:]
+	}
+	return matches
+}
+
+// kernelMessageKind returns what a kernel message reports: "oom",
+// "segfault", "apparmor" or "" for something else
+func kernelMessageKind(text string) string {
+	switch {
+	case strings.Contains(text, `apparmor="DENIED"`):
+		return "apparmor"
+	case strings.Contains(text, "segfault") || strings.Contains(text, "general protection") || strings.Contains(text, "traps:"):
+		return "segfault"
+	case strings.Contains(text, "out of memory") || strings.Contains(text, "killed as a result of limit") || strings.Contains(text, "Kill process") || strings.Contains(text, "Killed process"):
+		return "oom"
+	}
+	return ""
+}
+
+// bootTime returns when the host booted, from /proc/uptime
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/uptime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	var uptime float64
+	if _, err := fmt.Fscan(bufio.NewReader(f), &uptime); err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-time.Duration(uptime * float64(time.Second))), nil
+}
+
+// kernelMessages returns the messages the kernel logged about the container
+// since it started: its OOM kills, segfaults and AppArmor denials
+func (container *Container) kernelMessages() []string {
+	boot, err := bootTime()
+	if err != nil {
+		utils.Debugf("kernelMessages: %s", err)
+		return nil
+	}
+	messages, err := readKernelMessages()
+	if err != nil {
+		utils.Debugf("kernelMessages: cannot read the kernel log: %s", err)
+	}
+	pids := make(map[int]bool)
+	if seen := container.seenPids; seen != nil {
+		seen.Lock()
+		for pid := range seen.pids {
+			pids[pid] = true
+		}
+		seen.Unlock()
+	}
+	return matchKernelMessages(messages, container.State.StartedAt.Sub(boot), container.ID, pids)
+}
+
+// logKernelEvents logs a "segfault" or "apparmor" event for the kernel
+// messages about the container. Its OOM kills have their own events.
+func (container *Container) logKernelEvents(messages []string) {
+	if container.runtime == nil || container.runtime.srv == nil {
+		return
+	}
+	logged := make(map[string]bool)
+	for _, text := range messages {
+		kind := kernelMessageKind(text)
+		if kind == "" || kind == "oom" || logged[kind] {
+			continue
+		}
+		logged[kind] = true
+		container.runtime.srv.LogEvent(kind, container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+	}
+}
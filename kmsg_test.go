@@ -0,0 +1,43 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKernelMessage(t *testing.T) {
+	message, ok := parseKernelMessage("6,1234,5000000,-;cat[42]: segfault at 0 ip 00007f sp 00007ffe error 4 in libc.so\n SUBSYSTEM=x\n")
+	if !ok {
+		t.Fatal("Expected the record to be parsed")
+	}
+	if message.Time != 5*time.Second || message.Text != "cat[42]: segfault at 0 ip 00007f sp 00007ffe error 4 in libc.so" {
+		t.Fatalf("Unexpected message %v", message)
+	}
+	if _, ok := parseKernelMessage("not a record"); ok {
+		t.Fatal("Expected an invalid record to be rejected")
+	}
+}
+
+func TestMatchKernelMessages(t *testing.T) {
+	id := "8a3ba7c3e51b2f9cd7e66a2e5b1a3a8e4da0cb1e0e1e0e0e3e0d1dcae8e4e9f0"
+	messages := []kernelMessage{
+		{1 * time.Second, "sh[42]: segfault at 0 ip 00007f sp 00007ffe error 4"},
+		{3 * time.Second, "Task in /lxc/" + id + " killed as a result of limit of /lxc/" + id},
+		{3 * time.Second, "Memory cgroup out of memory: Kill process 43 (java) score 1000"},
+		{4 * time.Second, `audit: type=1400 apparmor="DENIED" operation="open" profile="docker-default" name="/proc/sysrq-trigger" pid=44 comm="sh"`},
+		{5 * time.Second, "other[99]: segfault at 0 ip 00007f sp 00007ffe error 4"},
+		{6 * time.Second, "eth0: link up"},
+	}
+	matches := matchKernelMessages(messages, 2*time.Second, id, map[int]bool{42: true, 43: true, 44: true})
+	if len(matches) != 3 {
+		t.Fatalf("Expected 3 messages about the container, got %v", matches)
+	}
+	for i, kind := range []string{"oom", "oom", "apparmor"} {
+		if k := kernelMessageKind(matches[i]); k != kind {
+			t.Errorf("Expected the kind %s for %q, got %s", kind, matches[i], k)
+		}
+	}
+	if kind := kernelMessageKind(messages[0].Text); kind != "segfault" {
+		t.Errorf("Expected a segfault, got %s", kind)
+	}
+}
@@ -17,12 +17,17 @@ lxc.utsname = {{.Id}}
 lxc.network.type = empty
 {{else}}
 # network configuration
+{{range .NetworkSettings.Interfaces}}
 lxc.network.type = veth
 lxc.network.flags = up
-lxc.network.link = {{.NetworkSettings.Bridge}}
-lxc.network.name = eth0
+lxc.network.link = {{.Bridge}}
+lxc.network.name = {{.Name}}
+{{if .HostVeth}}
+lxc.network.veth.pair = {{.HostVeth}}
+{{end}}
 lxc.network.mtu = 1500
-lxc.network.ipv4 = {{.NetworkSettings.IPAddress}}/{{.NetworkSettings.IPPrefixLen}}
+lxc.network.ipv4 = {{.IPAddress}}/{{.IPPrefixLen}}
+{{end}}
 {{end}}
 
 # root filesystem
@@ -77,6 +82,9 @@ lxc.cgroup.devices.allow = c 10:200 rwm
 
 # rtc
 #lxc.cgroup.devices.allow = c 254:0 rwm
+{{range $rule := (getHostConfig .).DeviceCgroupRules}}
+lxc.cgroup.devices.allow = {{$rule}}
+{{end}}
 {{end}}
 
 # standard mount point
@@ -91,7 +99,11 @@ lxc.mount.entry = sysfs {{$ROOTFS}}/sys sysfs nosuid,nodev,noexec 0 0
 lxc.mount.entry = devpts {{$ROOTFS}}/dev/pts devpts newinstance,ptmxmode=0666,nosuid,noexec 0 0
 #lxc.mount.entry = varrun {{$ROOTFS}}/var/run tmpfs mode=755,size=4096k,nosuid,nodev,noexec 0 0
 #lxc.mount.entry = varlock {{$ROOTFS}}/var/lock tmpfs size=1024k,nosuid,nodev,noexec 0 0
+{{if .ShmPath}}
+lxc.mount.entry = {{.ShmPath}} {{$ROOTFS}}/dev/shm none bind,rw 0 0
+{{else}}
 lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs size=65536k,nosuid,nodev,noexec 0 0
+{{end}}
 
 # Inject dockerinit
 lxc.mount.entry = {{.SysInitPath}} {{$ROOTFS}}/.dockerinit none bind,ro 0 0
@@ -108,13 +120,15 @@ lxc.mount.entry = {{$realPath}} {{$ROOTFS}}/{{$virtualPath}} none bind,{{ if ind
 {{end}}
 {{end}}
 
+{{if .AppArmorProfile}}
+lxc.aa_profile = {{.AppArmorProfile}}
+{{end}}
+{{if .ProcessLabel}}
+lxc.se_context = {{.ProcessLabel}}
+{{end}}
+
 {{if (getHostConfig .).Privileged}}
 # retain all capabilities; no lxc.cap.drop line
-{{if (getCapabilities .).AppArmor}}
-lxc.aa_profile = unconfined
-{{else}}
-#lxc.aa_profile = unconfined
-{{end}}
 {{else}}
 # drop linux capabilities (apply mainly to the user root in the container)
 #  (Note: 'lxc.cap.keep' is coming soon and should replace this under the
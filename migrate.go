@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The paths of the directory of a container where the storage drivers
+// keep its filesystem: the mountpoint, or the snapshot of btrfs, the rw
+// layer of AUFS and overlay, and the work directory of overlay
+var containerStoragePaths = []string{"rootfs", "rw", "work"}
+
+// moveStorage moves the storage paths of the container found in the
+// directory src to the directory dst
+func moveStorage(src, dst string) error {
+	for _, name := range containerStoragePaths {
+		if _, err := os.Lstat(path.Join(src, name)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.Rename(path.Join(src, name), path.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStorage frees the filesystem of the container id the storage
+// driver kept under the directory root. The driver only needs the id and
+// the directory of the container to find it.
+func removeStorage(driver StorageDriver, id, root string) error {
+	if err := driver.Remove(&Container{ID: id, root: root}); err != nil {
+		return err
+	}
+	for _, name := range containerStoragePaths {
+		if err := os.RemoveAll(path.Join(root, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateContainer moves the filesystem of the stopped container to the
+// storage driver target: its changes, exported with the whiteouts of AUFS,
+// are applied to a new filesystem of target. The filesystem of the former
+// driver is kept aside until the container is migrated, and put back when
+// the migration fails. The state of the container is locked meanwhile, for
+// it not to start.
+func migrateContainer(container *Container, target string) (err error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if container.State.Running || container.State.Standby {
+		return fmt.Errorf("Conflict, the container %s started, stop it first", utils.TruncateID(container.ID))
+	}
+	source, err := container.storageDriver()
+	if err != nil {
+		return err
+	}
+	targetDriver, err := container.runtime.storageDriver(target)
+	if err != nil {
+		return err
+	}
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	changes, err := source.ExportChanges(container)
+	if err != nil {
+		return err
+	}
+	changesDir, err := ioutil.TempDir(container.root, "migrate-changes-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(changesDir)
+	if err := archive.Untar(changes, changesDir); err != nil {
+		return err
+	}
+	if err := container.Unmount(); err != nil {
+		return err
+	}
+
+	backup, err := ioutil.TempDir(container.root, "migrate-backup-")
+	if err != nil {
+		return err
+	}
+	if err := moveStorage(container.root, backup); err != nil {
+		// Put back what was moved already
+		if err := moveStorage(backup, container.root); err != nil {
+			utils.Errorf("Unable to restore the filesystem of container %s, kept in %s: %s", container.ID, backup, err)
+			return err
+		}
+		os.RemoveAll(backup)
+		return err
+	}
+	sourceName := container.Driver
+	container.Driver = target
+	defer func() {
+		if err == nil {
+			return
+		}
+		container.Driver = sourceName
+		targetDriver.Unmount(container)
+		if err := removeStorage(targetDriver, container.ID, container.root); err != nil {
+			utils.Errorf("Unable to remove the %s filesystem of container %s: %s", target, container.ID, err)
+		}
+		if err := moveStorage(backup, container.root); err != nil {
+			utils.Errorf("Unable to restore the filesystem of container %s, kept in %s: %s", container.ID, backup, err)
+			return
+		}
+		os.RemoveAll(backup)
+	}()
+
+	if err := os.MkdirAll(container.RootfsPath(), 0755); err != nil {
+		return err
+	}
+	if err := targetDriver.Mount(container); err != nil {
+		return err
+	}
+	if err := applyAUFSLayer(changesDir, container.RootfsPath()); err != nil {
+		return err
+	}
+	if err := targetDriver.Unmount(container); err != nil {
+		return err
+	}
+	if err := container.ToDisk(); err != nil {
+		return err
+	}
+	if err := removeStorage(source, container.ID, backup); err != nil {
+		utils.Errorf("Unable to remove the %s filesystem of container %s, kept in %s: %s", sourceName, container.ID, backup, err)
+		return nil
+	}
+	return os.RemoveAll(backup)
+}
+
+// StorageMigrate moves the filesystems of the containers stored with
+// another storage driver to target, one container at a time, and frees
+// what the former drivers made of the images once no container uses them.
+// The containers must be stopped, and can't start while they migrate. A
+// container whose migration fails is left with its former driver, and the
+// migration stops there: the containers migrated before it are kept with
+// target, and the images with the former drivers, for StorageMigrate to
+// resume the migration when run again.
+func (srv *Server) StorageMigrate(target string, out io.Writer, sf *utils.StreamFormatter) error {
+	runtime := srv.runtime
+	if _, err := chooseStorageDriver(target, runtime.config.Root); err != nil {
+		return err
+	}
+	var containers, running []*Container
+	for _, container := range runtime.List() {
+		if container.storageDriverName() == target {
+			continue
+		}
+		containers = append(containers, container)
+		if container.State.Running {
+			running = append(running, container)
+		}
+	}
+	if len(running) > 0 {
+		var names []string
+		for _, container := range running {
+			names = append(names, utils.TruncateID(container.ID))
+		}
+		return fmt.Errorf("Conflict, stop the containers before migrating their storage: %s", strings.Join(names, ", "))
+	}
+
+	sources := make(map[string]bool)
+	for i, container := range containers {
+		sources[container.storageDriverName()] = true
+		out.Write(sf.FormatProgress(utils.TruncateID(container.ID), "Migrating", fmt.Sprintf("from %s to %s (%d/%d)", container.storageDriverName(), target, i+1, len(containers))))
+		if err := migrateContainer(container, target); err != nil {
+			return fmt.Errorf("Unable to migrate container %s, left with the %s storage driver, after migrating %d containers to %s: %s", utils.TruncateID(container.ID), container.storageDriverName(), i, target, err)
+		}
+		out.Write(sf.FormatProgress(utils.TruncateID(container.ID), "Migrated", ""))
+	}
+
+	images, err := runtime.graph.Map()
+	if err != nil {
+		return err
+	}
+	for name := range sources {
+		driver, err := runtime.storageDriver(name)
+		if err != nil {
+			return err
+		}
+		out.Write(sf.FormatStatus("", "Freeing the images of the %s storage driver", name))
+		for id, img := range images {
+			root, err := img.root()
+			if err != nil {
+				return err
+			}
+			if err := driver.RemoveImage(id, root); err != nil {
+				return err
+			}
+		}
+	}
+	out.Write(sf.FormatStatus("", "Migrated %d containers to the %s storage driver", len(containers), target))
+	return nil
+}
@@ -0,0 +1,47 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMoveStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	backup := path.Join(root, "backup")
+	for _, dir := range []string{"rootfs", "rw/etc", "backup"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(root, "config.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveStorage(root, backup); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rootfs", "rw/etc"} {
+		if _, err := os.Stat(path.Join(backup, name)); err != nil {
+			t.Fatalf("Expected %s to be moved aside: %s", name, err)
+		}
+		if _, err := os.Stat(path.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be moved away, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "config.json")); err != nil {
+		t.Fatalf("Expected the config of the container to stay: %s", err)
+	}
+
+	if err := moveStorage(backup, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "rw/etc")); err != nil {
+		t.Fatalf("Expected the rw layer to be put back: %s", err)
+	}
+}
@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"os/exec"
+	"strings"
+)
+
+// The host side of the veth pair of a container is named after its id, so
+// that its traffic can be mirrored. index is the position of the interface
+// in the container, 0 for the one on the bridge of the daemon.
+func hostVethName(id string, index int) string {
+	if index == 0 {
+		return "veth" + id[:11]
+	}
+	return fmt.Sprintf("veth%s.%d", id[:9], index)
+}
+
+func tc(args ...string) error {
+	path, err := exec.LookPath("tc")
+	if err != nil {
+		return fmt.Errorf("Unable to mirror traffic: tc not found")
+	}
+	if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc failed: tc %s: %s (%s)", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// Mirror copies the traffic of the interface, in both directions, to the
+// host interface dev, with the mirred action of tc. The ingress qdisc of
+// the host side of the veth pair sees the traffic sent by the container,
+// its root qdisc the traffic sent to it. A previous mirror is replaced.
+func (iface *NetworkInterface) Mirror(dev string) error {
+	if iface.disabled || iface.Veth == "" {
+		return fmt.Errorf("Impossible to mirror the traffic of interface %v: its network is disabled", iface)
+	}
+	if dev == iface.Veth {
+		return fmt.Errorf("Impossible to mirror the traffic of %s to itself", dev)
+	}
+	iface.Unmirror()
+
+	mirred := []string{"protocol", "all", "u32", "match", "u32", "0", "0", "action", "mirred", "egress", "mirror", "dev", dev}
+	for _, args := range [][]string{
+		{"qdisc", "add", "dev", iface.Veth, "ingress"},
+		append([]string{"filter", "add", "dev", iface.Veth, "parent", "ffff:"}, mirred...),
+		{"qdisc", "add", "dev", iface.Veth, "root", "handle", "1:", "prio"},
+		append([]string{"filter", "add", "dev", iface.Veth, "parent", "1:"}, mirred...),
+	} {
+		if err := tc(args...); err != nil {
+			iface.removeQdiscs()
+			return err
+		}
+	}
+
+	iface.manager.mirrorsLock.Lock()
+	defer iface.manager.mirrorsLock.Unlock()
+	iface.manager.mirrors[iface] = dev
+	return nil
+}
+
+// Unmirror stops mirroring the traffic of the interface
+func (iface *NetworkInterface) Unmirror() error {
+	if iface.disabled {
+		return nil
+	}
+	iface.manager.mirrorsLock.Lock()
+	_, exists := iface.manager.mirrors[iface]
+	delete(iface.manager.mirrors, iface)
+	iface.manager.mirrorsLock.Unlock()
+	if !exists {
+		return fmt.Errorf("No such mirror: the traffic of %s is not mirrored", iface.Veth)
+	}
+	return iface.removeQdiscs()
+}
+
+// MirrorTarget returns the interface the traffic is mirrored to, if any
+func (iface *NetworkInterface) MirrorTarget() string {
+	if iface.disabled {
+		return ""
+	}
+	iface.manager.mirrorsLock.Lock()
+	defer iface.manager.mirrorsLock.Unlock()
+	return iface.manager.mirrors[iface]
+}
+
+// Deleting the qdiscs deletes their filters
+func (iface *NetworkInterface) removeQdiscs() error {
+	errIngress := tc("qdisc", "del", "dev", iface.Veth, "ingress")
+	errRoot := tc("qdisc", "del", "dev", iface.Veth, "root")
+	if errIngress != nil {
+		return errIngress
+	}
+	return errRoot
+}
+
+// releaseMirrors stops the mirrors of the interface, and the mirrors to it,
+// whose target is about to vanish
+func (iface *NetworkInterface) releaseMirrors() {
+	iface.manager.mirrorsLock.Lock()
+	var sources []*NetworkInterface
+	for source, dev := range iface.manager.mirrors {
+		if source == iface || (iface.Veth != "" && dev == iface.Veth) {
+			sources = append(sources, source)
+		}
+	}
+	iface.manager.mirrorsLock.Unlock()
+
+	for _, source := range sources {
+		if err := source.Unmirror(); err != nil && source != iface {
+			// The qdiscs of the interface go away with it
+			utils.Debugf("Unable to stop mirroring %s to %s: %s", source.Veth, iface.Veth, err)
+		}
+	}
+}
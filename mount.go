@@ -14,6 +14,11 @@ func Unmount(target string) error {
 	if err := exec.Command("auplink", target, "flush").Run(); err != nil {
 		utils.Errorf("[warning]: couldn't run auplink before unmount: %s", err)
 	}
+	return unmountAndRemove(target)
+}
+
+// unmountAndRemove unmounts target and removes the mountpoint
+func unmountAndRemove(target string) error {
 	if err := syscall.Unmount(target, 0); err != nil {
 		return err
 	}
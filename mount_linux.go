@@ -5,3 +5,9 @@ import "syscall"
 func mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
 	return syscall.Mount(source, target, fstype, flags, data)
 }
+
+// The flags of the tmpfs of the /dev/shm of the containers
+const shmMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+// The flags of the read-only mounts
+const readOnlyMountFlags = syscall.MS_RDONLY
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// defaultShmSize is the size of the /dev/shm of the containers which have
+// an IPC namespace of their own and don't set one
+const defaultShmSize = 64 * 1024 * 1024
+
+// validateNamespaceMode checks the -pid or -ipc option of a container, kind
+// being the option: "" for a namespace of its own, "host" to run in the one
+// of the host, or "container:NAME" to join the one of another container
+func validateNamespaceMode(kind, mode string) error {
+	if mode == "" || mode == "host" {
+		return nil
+	}
+	if parts := strings.SplitN(mode, ":", 2); len(parts) == 2 && parts[0] == "container" && parts[1] != "" {
+		return nil
+	}
+	return fmt.Errorf("Bad parameter %s: %s, expected host or container:NAME", kind, mode)
+}
+
+// namespaceModeContainer returns the name of the container whose namespace
+// the mode joins, or "" when it doesn't join a container's
+func namespaceModeContainer(mode string) string {
+	if strings.HasPrefix(mode, "container:") {
+		return strings.TrimPrefix(mode, "container:")
+	}
+	return ""
+}
+
+// sharedNamespace returns what lxc-start is to take the namespace of,
+// instead of creating one for the container: pid 1 for the host, the id
+// of the running container for another container, or "" for none
+func (container *Container) sharedNamespace(kind, mode string) (string, error) {
+	if err := validateNamespaceMode(kind, mode); err != nil {
+		return "", err
+	}
+	if mode == "host" {
+		return "1", nil
+	}
+	name := namespaceModeContainer(mode)
+	if name == "" {
+		return "", nil
+	}
+	target := container.runtime.Get(name)
+	if target == nil {
+		return "", fmt.Errorf("No such container: %s", name)
+	}
+	if target.ID == container.ID {
+		return "", fmt.Errorf("Bad parameter %s: the container can't join its own namespace", kind)
+	}
+	if !target.State.Running || target.State.Ghost {
+		return "", fmt.Errorf("Impossible to join the %s namespace of container %s: it is not running", kind, name)
+	}
+	return target.ID, nil
+}
+
+func (container *Container) shmPath() string {
+	return path.Join(container.root, "shm")
+}
+
+// setupShm sets the directory bind mounted on the /dev/shm of the
+// container. POSIX shared memory lives there rather than in the IPC
+// namespace, so the containers sharing the IPC namespace of the host or of
+// another container share its /dev/shm too. The others get a tmpfs of
+// their own, of ShmSize bytes, mounted by the daemon.
+func (container *Container) setupShm() error {
+	mode := container.hostConfig.IpcMode
+	if mode == "host" {
+		container.ShmPath = "/dev/shm"
+		return nil
+	}
+	if name := namespaceModeContainer(mode); name != "" {
+		target := container.runtime.Get(name)
+		if target == nil {
+			return fmt.Errorf("No such container: %s", name)
+		}
+		container.ShmPath = target.ShmPath
+		return nil
+	}
+
+	shmPath := container.shmPath()
+	if mounted, err := Mounted(shmPath); err != nil {
+		return err
+	} else if mounted {
+		container.ShmPath = shmPath
+		return nil
+	}
+	if err := os.MkdirAll(shmPath, 0755); err != nil {
+		return err
+	}
+	size := container.hostConfig.ShmSize
+	if size == 0 {
+		size = defaultShmSize
+	}
+	data := fmt.Sprintf("mode=1777,size=%d", size)
+	if container.MountLabel != "" {
+		data += fmt.Sprintf(",context=%q", container.MountLabel)
+	}
+	if err := mount("shm", shmPath, "tmpfs", shmMountFlags, data); err != nil {
+		return fmt.Errorf("Unable to mount the /dev/shm of container %s: %s", container.ID, err)
+	}
+	container.ShmPath = shmPath
+	return nil
+}
+
+// releaseShm unmounts the tmpfs of the /dev/shm of the container. The
+// containers sharing it keep it until they stop.
+func (container *Container) releaseShm() error {
+	shmPath := container.shmPath()
+	if mounted, err := Mounted(shmPath); err != nil || !mounted {
+		return err
+	}
+	return syscall.Unmount(shmPath, 0)
+}
+
+// The namespaces of a process listed in /proc/PID/ns, when the kernel has
+// them
+var namespaceKinds = []string{"ipc", "mnt", "net", "pid", "user", "uts"}
+
+// readProcCgroups returns the cgroup of each subsystem of a process,
+// relative to the mountpoint of its hierarchy, from its /proc/PID/cgroup
+// file. The subsystems mounted together share a line.
+func readProcCgroups(cgroupFile string) (map[string]string, error) {
+	f, err := os.Open(cgroupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cgroups := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "3:cpu,cpuacct:/lxc/<id>"
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, subsystem := range strings.Split(parts[1], ",") {
+			if subsystem != "" {
+				cgroups[subsystem] = parts[2]
+			}
+		}
+	}
+	return cgroups, scanner.Err()
+}
+
+// namespaces returns the namespace files and the cgroup directories of the
+// running container, for the tools of the host to enter it with nsenter.
+// The namespaces are those of its first process: its pid is given with
+// them, and each namespace with its inode, so that a reused pid can be
+// told apart.
+func (container *Container) namespaces() (*APINamespaces, error) {
+	if !container.State.Running || container.State.Ghost {
+		return nil, fmt.Errorf("Impossible to enter container %s: it is not running", container.ID)
+	}
+	pid, err := container.initPid()
+	if err != nil {
+		return nil, err
+	}
+	out := &APINamespaces{
+		Pid:        pid,
+		Namespaces: make(map[string]APINamespace),
+	}
+	for _, kind := range namespaceKinds {
+		nsPath := fmt.Sprintf("/proc/%d/ns/%s", pid, kind)
+		// e.g. "net:[4026531956]"
+		inode, err := os.Readlink(nsPath)
+		if err != nil {
+			// Not supported by the kernel
+			continue
+		}
+		out.Namespaces[kind] = APINamespace{Path: nsPath, Inode: inode}
+	}
+	if out.Cgroups, err = cgroupDirs(pid); err != nil {
+		return nil, fmt.Errorf("Unable to get the cgroups of container %s: %s", container.ID, err)
+	}
+	return out, nil
+}
+
+// cgroupDirs returns the cgroup directories of the process pid on the host,
+// by subsystem. The hierarchies which are not mounted are left out.
+func cgroupDirs(pid int) (map[string]string, error) {
+	cgroups, err := readProcCgroups(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string)
+	for subsystem, dir := range cgroups {
+		mountpoint, err := utils.FindCgroupMountpoint(subsystem)
+		if err != nil {
+			// e.g. a named hierarchy such as name=systemd
+			continue
+		}
+		dirs[subsystem] = path.Join(mountpoint, dir)
+	}
+	return dirs, nil
+}
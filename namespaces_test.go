@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadProcCgroups(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cgroupFile := path.Join(tmp, "cgroup")
+	content := "4:memory:/lxc/abc\n3:cpu,cpuacct:/db/lxc/abc\n1:name=systemd:/system.slice\n"
+	if err := ioutil.WriteFile(cgroupFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cgroups, err := readProcCgroups(cgroupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"memory":       "/lxc/abc",
+		"cpu":          "/db/lxc/abc",
+		"cpuacct":      "/db/lxc/abc",
+		"name=systemd": "/system.slice",
+	}
+	if len(cgroups) != len(expected) {
+		t.Fatalf("Expected %d cgroups, got %v", len(expected), cgroups)
+	}
+	for subsystem, dir := range expected {
+		if cgroups[subsystem] != dir {
+			t.Errorf("Expected the %s cgroup %q, got %q", subsystem, dir, cgroups[subsystem])
+		}
+	}
+}
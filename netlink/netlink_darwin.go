@@ -21,6 +21,14 @@ func NetworkLinkAddIp(iface *net.Interface, ip net.IP, ipNet *net.IPNet) error {
 	return fmt.Errorf("Not implemented")
 }
 
+func NetworkRouteAdd(iface *net.Interface, ipNet *net.IPNet, src net.IP, metric int) error {
+	return fmt.Errorf("Not implemented")
+}
+
+func NetworkRouteDel(iface *net.Interface, ipNet *net.IPNet, metric int) error {
+	return fmt.Errorf("Not implemented")
+}
+
 func AddDefaultGw(ip net.IP) error {
 	return fmt.Errorf("Not implemented")
 
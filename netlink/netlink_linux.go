@@ -331,6 +331,71 @@ func AddDefaultGw(ip net.IP) error {
 
 }
 
+// Add a route to the network ipNet through iface, with the given metric.
+// This is identical to:
+// ip route add $ipNet dev $iface src $src metric $metric
+func NetworkRouteAdd(iface *net.Interface, ipNet *net.IPNet, src net.IP, metric int) error {
+	return networkRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK, iface, ipNet, src, metric)
+}
+
+// Delete the route to the network ipNet through iface with the given metric,
+// whoever added it. This is identical to:
+// ip route del $ipNet dev $iface metric $metric
+func NetworkRouteDel(iface *net.Interface, ipNet *net.IPNet, metric int) error {
+	return networkRoute(syscall.RTM_DELROUTE, syscall.NLM_F_ACK, iface, ipNet, nil, metric)
+}
+
+func networkRoute(proto, flags int, iface *net.Interface, ipNet *net.IPNet, src net.IP, metric int) error {
+	s, err := getNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	family := getIpFamily(ipNet.IP)
+	native := nativeEndian()
+
+	wb := newNetlinkRequest(proto, flags)
+
+	msg := newRtMsg(family)
+	if proto == syscall.RTM_DELROUTE {
+		// Match the route whatever its origin and scope
+		msg.Protocol = syscall.RTPROT_UNSPEC
+		msg.Scope = syscall.RT_SCOPE_NOWHERE
+	} else {
+		msg.Scope = syscall.RT_SCOPE_LINK
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+	msg.Dst_len = uint8(prefixLen)
+	wb.AddData(msg)
+
+	ipData := func(ip net.IP) []byte {
+		if family == syscall.AF_INET {
+			return ip.To4()
+		}
+		return ip.To16()
+	}
+
+	wb.AddData(newRtAttr(syscall.RTA_DST, ipData(ipNet.IP.Mask(ipNet.Mask))))
+	if src != nil {
+		wb.AddData(newRtAttr(syscall.RTA_PREFSRC, ipData(src)))
+	}
+
+	oif := make([]byte, 4)
+	native.PutUint32(oif, uint32(iface.Index))
+	wb.AddData(newRtAttr(syscall.RTA_OIF, oif))
+
+	priority := make([]byte, 4)
+	native.PutUint32(priority, uint32(metric))
+	wb.AddData(newRtAttr(syscall.RTA_PRIORITY, priority))
+
+	if err := s.Send(wb); err != nil {
+		return err
+	}
+
+	return s.HandleAck(wb.Seq)
+}
+
 // Bring up a particular network interface
 func NetworkLinkUp(iface *net.Interface) error {
 	s, err := getNetlinkSocket()
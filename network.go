@@ -8,10 +8,14 @@ import (
 	"github.com/dotcloud/docker/netlink"
 	"github.com/dotcloud/docker/proxy"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
 	"log"
 	"net"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 )
 
 const (
@@ -214,7 +218,9 @@ type PortMapper struct {
 	udpMapping map[int]*net.UDPAddr
 	udpProxies map[int]proxy.Proxy
 
-	iptables  *iptables.Chain
+	unixProxies map[string]proxy.Proxy
+
+	firewall  firewall
 	defaultIp net.IP
 }
 
@@ -222,8 +228,8 @@ func (mapper *PortMapper) Map(ip net.IP, port int, backendAddr net.Addr) error {
 	if _, isTCP := backendAddr.(*net.TCPAddr); isTCP {
 		backendPort := backendAddr.(*net.TCPAddr).Port
 		backendIP := backendAddr.(*net.TCPAddr).IP
-		if mapper.iptables != nil {
-			if err := mapper.iptables.Forward(iptables.Add, ip, port, "tcp", backendIP.String(), backendPort); err != nil {
+		if mapper.firewall != nil {
+			if err := mapper.firewall.Forward(iptables.Add, ip, port, "tcp", backendIP.String(), backendPort); err != nil {
 				return err
 			}
 		}
@@ -238,8 +244,8 @@ func (mapper *PortMapper) Map(ip net.IP, port int, backendAddr net.Addr) error {
 	} else {
 		backendPort := backendAddr.(*net.UDPAddr).Port
 		backendIP := backendAddr.(*net.UDPAddr).IP
-		if mapper.iptables != nil {
-			if err := mapper.iptables.Forward(iptables.Add, ip, port, "udp", backendIP.String(), backendPort); err != nil {
+		if mapper.firewall != nil {
+			if err := mapper.firewall.Forward(iptables.Add, ip, port, "udp", backendIP.String(), backendPort); err != nil {
 				return err
 			}
 		}
@@ -265,8 +271,8 @@ func (mapper *PortMapper) Unmap(ip net.IP, port int, proto string) error {
 			proxy.Close()
 			delete(mapper.tcpProxies, port)
 		}
-		if mapper.iptables != nil {
-			if err := mapper.iptables.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
+		if mapper.firewall != nil {
+			if err := mapper.firewall.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
 				return err
 			}
 		}
@@ -280,8 +286,8 @@ func (mapper *PortMapper) Unmap(ip net.IP, port int, proto string) error {
 			proxy.Close()
 			delete(mapper.udpProxies, port)
 		}
-		if mapper.iptables != nil {
-			if err := mapper.iptables.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
+		if mapper.firewall != nil {
+			if err := mapper.firewall.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
 				return err
 			}
 		}
@@ -290,27 +296,117 @@ func (mapper *PortMapper) Unmap(ip net.IP, port int, proto string) error {
 	return nil
 }
 
+// Retarget forwards a mapped port to backendAddr instead of its current
+// backend, without unmapping it: the new firewall rule is added before the
+// old one is deleted, and the proxy forwards the new connections to
+// backendAddr.
+func (mapper *PortMapper) Retarget(ip net.IP, port int, backendAddr net.Addr) error {
+	var (
+		proto            string
+		oldIP, newIP     net.IP
+		oldPort, newPort int
+		proxy            proxy.Proxy
+	)
+	switch addr := backendAddr.(type) {
+	case *net.TCPAddr:
+		old, ok := mapper.tcpMapping[port]
+		if !ok {
+			return fmt.Errorf("Port tcp/%v is not mapped", port)
+		}
+		proto, oldIP, oldPort, newIP, newPort = "tcp", old.IP, old.Port, addr.IP, addr.Port
+		proxy = mapper.tcpProxies[port]
+	case *net.UDPAddr:
+		old, ok := mapper.udpMapping[port]
+		if !ok {
+			return fmt.Errorf("Port udp/%v is not mapped", port)
+		}
+		proto, oldIP, oldPort, newIP, newPort = "udp", old.IP, old.Port, addr.IP, addr.Port
+		proxy = mapper.udpProxies[port]
+	}
+	if mapper.firewall != nil {
+		if err := mapper.firewall.Forward(iptables.Add, ip, port, proto, newIP.String(), newPort); err != nil {
+			return err
+		}
+		if err := mapper.firewall.Forward(iptables.Delete, ip, port, proto, oldIP.String(), oldPort); err != nil {
+			mapper.firewall.Forward(iptables.Delete, ip, port, proto, newIP.String(), newPort)
+			return err
+		}
+	}
+	if proxy != nil {
+		proxy.SetBackendAddr(backendAddr)
+	}
+	if proto == "tcp" {
+		mapper.tcpMapping[port] = backendAddr.(*net.TCPAddr)
+	} else {
+		mapper.udpMapping[port] = backendAddr.(*net.UDPAddr)
+	}
+	return nil
+}
+
+// MapUnix publishes backendAddr as the unix socket at path. No
+// firewall rule is needed: all the traffic goes through the proxy.
+func (mapper *PortMapper) MapUnix(path string, backendAddr *net.TCPAddr) error {
+	if _, exists := mapper.unixProxies[path]; exists {
+		return fmt.Errorf("Socket %s is already mapped", path)
+	}
+	proxy, err := proxy.NewProxy(&net.UnixAddr{Name: path, Net: "unix"}, backendAddr)
+	if err != nil {
+		return err
+	}
+	mapper.unixProxies[path] = proxy
+	go proxy.Run()
+	return nil
+}
+
+func (mapper *PortMapper) UnmapUnix(path string) error {
+	proxy, exists := mapper.unixProxies[path]
+	if !exists {
+		return fmt.Errorf("Socket %s is not mapped", path)
+	}
+	proxy.Close()
+	delete(mapper.unixProxies, path)
+	return nil
+}
+
+// RetargetUnix forwards the new connections made on the socket at path to
+// backendAddr.
+func (mapper *PortMapper) RetargetUnix(path string, backendAddr *net.TCPAddr) error {
+	proxy, exists := mapper.unixProxies[path]
+	if !exists {
+		return fmt.Errorf("Socket %s is not mapped", path)
+	}
+	proxy.SetBackendAddr(backendAddr)
+	return nil
+}
+
 func newPortMapper(config *DaemonConfig) (*PortMapper, error) {
 	// We can always try removing the iptables
 	if err := iptables.RemoveExistingChain("DOCKER"); err != nil {
 		return nil, err
 	}
-	var chain *iptables.Chain
-	if config.EnableIptables {
-		var err error
-		chain, err = iptables.NewChain("DOCKER", config.BridgeIface)
+	var fw firewall
+	if config.FirewallManager != "" {
+		external, err := newExternalFirewall(config.FirewallManager)
+		if err != nil {
+			return nil, err
+		}
+		fw = external
+	} else if config.EnableIptables {
+		chain, err := iptables.NewChain("DOCKER", config.BridgeIface)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to create DOCKER chain: %s", err)
 		}
+		fw = chain
 	}
 
 	mapper := &PortMapper{
-		tcpMapping: make(map[int]*net.TCPAddr),
-		tcpProxies: make(map[int]proxy.Proxy),
-		udpMapping: make(map[int]*net.UDPAddr),
-		udpProxies: make(map[int]proxy.Proxy),
-		iptables:   chain,
-		defaultIp:  config.DefaultIp,
+		tcpMapping:  make(map[int]*net.TCPAddr),
+		tcpProxies:  make(map[int]proxy.Proxy),
+		udpMapping:  make(map[int]*net.UDPAddr),
+		udpProxies:  make(map[int]proxy.Proxy),
+		unixProxies: make(map[string]proxy.Proxy),
+		firewall:    fw,
+		defaultIp:   config.DefaultIp,
 	}
 	return mapper, nil
 }
@@ -496,10 +592,14 @@ func newIPAllocator(network *net.IPNet) *IPAllocator {
 type NetworkInterface struct {
 	IPNet   net.IPNet
 	Gateway net.IP
+	Veth    string // The host side of the veth pair
 
 	manager  *NetworkManager
 	extPorts []*Nat
 	disabled bool
+
+	forwards     []*PortForward
+	forwardsLock sync.Mutex
 }
 
 // Allocate an external port and map it to the interface
@@ -509,17 +609,20 @@ func (iface *NetworkInterface) AllocatePort(port Port, binding PortBinding) (*Na
 		return nil, fmt.Errorf("Trying to allocate port for interface %v, which is disabled", iface) // FIXME
 	}
 
-	ip := iface.manager.portMapper.defaultIp
+	if binding.HostPath != "" {
+		return iface.allocateUnixPort(port, binding)
+	}
 
-	if binding.HostIp != "" {
-		ip = net.ParseIP(binding.HostIp)
-	} else {
-		binding.HostIp = ip.String()
+	ip, mode, err := resolvePublishMode(binding, iface.manager.portMapper.defaultIp)
+	if err != nil {
+		return nil, err
 	}
+	binding.HostIp = ip.String()
 
 	nat := &Nat{
 		Port:    port,
 		Binding: binding,
+		Mode:    mode,
 	}
 
 	containerPort, err := parsePort(port.Port())
@@ -558,9 +661,87 @@ func (iface *NetworkInterface) AllocatePort(port Port, binding PortBinding) (*Na
 	return nat, nil
 }
 
+func (iface *NetworkInterface) allocateUnixPort(port Port, binding PortBinding) (*Nat, error) {
+	if port.Proto() != "tcp" {
+		return nil, fmt.Errorf("Only tcp ports can be published as a unix socket: %s", port)
+	}
+	containerPort, err := parsePort(port.Port())
+	if err != nil {
+		return nil, err
+	}
+	backend := &net.TCPAddr{IP: iface.IPNet.IP, Port: containerPort}
+	if err := iface.manager.portMapper.MapUnix(binding.HostPath, backend); err != nil {
+		return nil, err
+	}
+	nat := &Nat{
+		Port:    port,
+		Binding: PortBinding{HostPath: binding.HostPath},
+	}
+	iface.extPorts = append(iface.extPorts, nat)
+	return nat, nil
+}
+
+// Publish modes of a port
+const (
+	PublishAll       = "all"       // on all the host addresses
+	PublishLocalhost = "localhost" // on 127.0.0.1 only
+	PublishInterface = "interface" // on the address of a host interface only
+	PublishAddress   = "address"   // on the address given as the host ip
+)
+
+// resolvePublishMode returns the host address a binding is published on,
+// and its publish mode. Bindings without a mode nor a host ip are published
+// on defaultIp.
+func resolvePublishMode(binding PortBinding, defaultIp net.IP) (net.IP, string, error) {
+	switch binding.Mode {
+	case "":
+		if binding.HostIp == "" {
+			if defaultIp.Equal(net.IPv4zero) {
+				return defaultIp, PublishAll, nil
+			}
+			return defaultIp, PublishAddress, nil
+		}
+		ip := net.ParseIP(binding.HostIp)
+		if ip == nil {
+			return nil, "", fmt.Errorf("Invalid host ip: %s", binding.HostIp)
+		}
+		if ip.Equal(net.IPv4zero) {
+			return ip, PublishAll, nil
+		}
+		return ip, PublishAddress, nil
+	case PublishAll:
+		return net.IPv4zero, PublishAll, nil
+	case PublishLocalhost:
+		return net.IPv4(127, 0, 0, 1), PublishLocalhost, nil
+	case PublishInterface:
+		addr, err := getIfaceAddr(binding.Interface)
+		if err != nil {
+			return nil, "", err
+		}
+		return addr.(*net.IPNet).IP, PublishInterface, nil
+	}
+	return nil, "", fmt.Errorf("Invalid publish mode: %s", binding.Mode)
+}
+
 type Nat struct {
 	Port    Port
 	Binding PortBinding
+	Mode    string
+}
+
+// matches returns whether the nat is bound as described by binding,
+// empty fields matching anything
+func (n *Nat) matches(binding PortBinding) bool {
+	if binding.HostPath != "" || n.Binding.HostPath != "" {
+		return binding.HostPath == n.Binding.HostPath || (binding.HostPath == "" && binding.HostIp == "" && binding.HostPort == "")
+	}
+	if binding.Mode != "" && (binding.Mode != n.Mode || binding.Interface != n.Binding.Interface) {
+		return false
+	}
+	if binding.HostIp != "" && !net.ParseIP(binding.HostIp).Equal(net.ParseIP(n.Binding.HostIp)) {
+		return false
+	}
+	return binding.HostPort == "" || binding.HostPort == n.Binding.HostPort
 }
 
 func (n *Nat) String() string {
@@ -574,26 +755,111 @@ func (iface *NetworkInterface) Release() {
 	}
 
 	for _, nat := range iface.extPorts {
-		hostPort, err := parsePort(nat.Binding.HostPort)
-		if err != nil {
-			log.Printf("Unable to get host port: %s", err)
+		iface.releaseNat(nat)
+	}
+
+	iface.releaseMirrors()
+	iface.releaseForwards()
+
+	iface.manager.ipAllocator.Release(iface.IPNet.IP)
+}
+
+// ReleasePort unmaps the given port of a running interface. Empty fields of
+// binding match any mapping, so all the mappings of the port are released
+// when it is empty. The released bindings are returned.
+func (iface *NetworkInterface) ReleasePort(port Port, binding PortBinding) ([]PortBinding, error) {
+	if iface.disabled {
+		return nil, fmt.Errorf("Trying to release port for interface %v, which is disabled", iface) // FIXME
+	}
+
+	var (
+		released []PortBinding
+		extPorts []*Nat
+	)
+	for _, nat := range iface.extPorts {
+		if nat.Port != port || !nat.matches(binding) {
+			extPorts = append(extPorts, nat)
 			continue
 		}
-		ip := net.ParseIP(nat.Binding.HostIp)
-		utils.Debugf("Unmaping %s/%s", nat.Port.Proto, nat.Binding.HostPort)
-		if err := iface.manager.portMapper.Unmap(ip, hostPort, nat.Port.Proto()); err != nil {
-			log.Printf("Unable to unmap port %s: %s", nat, err)
-		}
-		if nat.Port.Proto() == "tcp" {
-			if err := iface.manager.tcpPortAllocator.Release(hostPort); err != nil {
-				log.Printf("Unable to release port %s", nat)
+		iface.releaseNat(nat)
+		released = append(released, nat.Binding)
+	}
+	if len(released) == 0 {
+		return nil, fmt.Errorf("No such port mapping: %s", port)
+	}
+	iface.extPorts = extPorts
+	return released, nil
+}
+
+// MovePorts forwards all the mapped ports of the interface to the interface
+// to instead, on the same host addresses and ports: they stay mapped all
+// along, the host ports are not released. On failure, the ports already
+// moved are given back. The moved mappings are returned.
+func (iface *NetworkInterface) MovePorts(to *NetworkInterface) ([]*Nat, error) {
+	if iface.disabled || to.disabled {
+		return nil, fmt.Errorf("Trying to move ports between interfaces %v and %v, one of which is disabled", iface, to) // FIXME
+	}
+	var moved []*Nat
+	for _, nat := range iface.extPorts {
+		if err := to.retargetNat(nat); err != nil {
+			for _, nat := range moved {
+				if err := iface.retargetNat(nat); err != nil {
+					log.Printf("Unable to give port %s back: %s", nat, err)
+				}
 			}
-		} else if err := iface.manager.udpPortAllocator.Release(hostPort); err != nil {
-			log.Printf("Unable to release port %s: %s", nat, err)
+			return nil, err
 		}
+		moved = append(moved, nat)
 	}
+	to.extPorts = append(to.extPorts, moved...)
+	iface.extPorts = nil
+	return moved, nil
+}
 
-	iface.manager.ipAllocator.Release(iface.IPNet.IP)
+// retargetNat forwards the mapping nat to the interface
+func (iface *NetworkInterface) retargetNat(nat *Nat) error {
+	containerPort, err := parsePort(nat.Port.Port())
+	if err != nil {
+		return err
+	}
+	if nat.Binding.HostPath != "" {
+		return iface.manager.portMapper.RetargetUnix(nat.Binding.HostPath, &net.TCPAddr{IP: iface.IPNet.IP, Port: containerPort})
+	}
+	hostPort, err := parsePort(nat.Binding.HostPort)
+	if err != nil {
+		return err
+	}
+	var backend net.Addr = &net.TCPAddr{IP: iface.IPNet.IP, Port: containerPort}
+	if nat.Port.Proto() == "udp" {
+		backend = &net.UDPAddr{IP: iface.IPNet.IP, Port: containerPort}
+	}
+	return iface.manager.portMapper.Retarget(net.ParseIP(nat.Binding.HostIp), hostPort, backend)
+}
+
+func (iface *NetworkInterface) releaseNat(nat *Nat) {
+	if nat.Binding.HostPath != "" {
+		if err := iface.manager.portMapper.UnmapUnix(nat.Binding.HostPath); err != nil {
+			log.Printf("Unable to unmap socket %s: %s", nat.Binding.HostPath, err)
+		}
+		return
+	}
+	hostPort, err := parsePort(nat.Binding.HostPort)
+	if err != nil {
+		log.Printf("Unable to get host port: %s", err)
+		return
+	}
+	ip := net.ParseIP(nat.Binding.HostIp)
+	utils.Debugf("Unmaping %s/%s", nat.Port.Proto, nat.Binding.HostPort)
+	if err := iface.manager.portMapper.Unmap(ip, hostPort, nat.Port.Proto()); err != nil {
+		log.Printf("Unable to unmap port %s: %s", nat, err)
+	}
+	if nat.Port.Proto() == "tcp" {
+		if err := iface.manager.tcpPortAllocator.Release(hostPort); err != nil {
+			log.Printf("Unable to release port %s", nat)
+		}
+	} else if err := iface.manager.udpPortAllocator.Release(hostPort); err != nil {
+		log.Printf("Unable to release port %s: %s", nat, err)
+	}
 }
 
 // Network Manager manages a set of network interfaces
@@ -607,6 +873,13 @@ type NetworkManager struct {
 	udpPortAllocator *PortAllocator
 	portMapper       *PortMapper
 
+	mirrors     map[*NetworkInterface]string
+	mirrorsLock sync.Mutex
+
+	// The managers of the other bridges containers are attached to
+	bridges     map[string]*NetworkManager
+	bridgesLock sync.Mutex
+
 	disabled bool
 }
 
@@ -648,6 +921,13 @@ func (manager *NetworkManager) Close() error {
 	err1 := manager.tcpPortAllocator.Close()
 	err2 := manager.udpPortAllocator.Close()
 	err3 := manager.ipAllocator.Close()
+	manager.bridgesLock.Lock()
+	for _, m := range manager.bridges {
+		if err := m.ipAllocator.Close(); err != nil && err3 == nil {
+			err3 = err
+		}
+	}
+	manager.bridgesLock.Unlock()
 	if err1 != nil {
 		return err1
 	}
@@ -657,6 +937,87 @@ func (manager *NetworkManager) Close() error {
 	return err3
 }
 
+// configureBridgeRouting applies the route metric and the reverse path and
+// ARP filtering requested for the bridge. On hosts with several bridges,
+// these keep the replies to a bridge network from leaving through another
+// one, where they would be silently dropped.
+func configureBridgeRouting(config *DaemonConfig, network *net.IPNet) error {
+	sysctls := []struct {
+		name  string
+		value string
+		valid []string
+	}{
+		{"rp_filter", config.BridgeRpFilter, []string{"0", "1", "2"}},
+		{"arp_filter", config.BridgeArpFilter, []string{"0", "1"}},
+	}
+	for _, sysctl := range sysctls {
+		if sysctl.value == "" {
+			continue
+		}
+		valid := false
+		for _, v := range sysctl.valid {
+			valid = valid || v == sysctl.value
+		}
+		if !valid {
+			return fmt.Errorf("Invalid %s for bridge %s: %s, expected one of %s", sysctl.name, config.BridgeIface, sysctl.value, strings.Join(sysctl.valid, ", "))
+		}
+		p := path.Join("/proc/sys/net/ipv4/conf", config.BridgeIface, sysctl.name)
+		if err := ioutil.WriteFile(p, []byte(sysctl.value+"\n"), 0644); err != nil {
+			return fmt.Errorf("Unable to set %s of bridge %s: %s", sysctl.name, config.BridgeIface, err)
+		}
+	}
+
+	if config.BridgeRouteMetric < 0 {
+		return fmt.Errorf("Invalid route metric for bridge %s: %d", config.BridgeIface, config.BridgeRouteMetric)
+	}
+	if config.BridgeRouteMetric == 0 {
+		return nil
+	}
+	iface, err := net.InterfaceByName(config.BridgeIface)
+	if err != nil {
+		return err
+	}
+	subnet := &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}
+	// Replace the route the kernel added along with the address of the bridge
+	if err := netlink.NetworkRouteAdd(iface, subnet, network.IP, config.BridgeRouteMetric); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("Unable to add the route to %s with metric %d: %s", subnet, config.BridgeRouteMetric, err)
+	}
+	if err := netlink.NetworkRouteDel(iface, subnet, 0); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("Unable to remove the default route to %s: %s", subnet, err)
+	}
+	return nil
+}
+
+// configureNatExclusions lets the traffic of the containers to the networks
+// of config.NatExclude bypass the MASQUERADE of the bridge network, for
+// networks where the container ips are routed. The RETURN rules are
+// inserted ahead of the MASQUERADE rule.
+func configureNatExclusions(config *DaemonConfig, network *net.IPNet) error {
+	subnet := &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}
+	var rules [][]string
+	for _, cidr := range config.NatExclude {
+		_, dest, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid NAT exclusion %s: %s", cidr, err)
+		}
+		rules = append(rules, []string{"POSTROUTING", "-t", "nat", "-s", subnet.String(), "-d", dest.String(), "-j", "RETURN"})
+	}
+	if !config.EnableIptables {
+		return nil
+	}
+	for _, rule := range rules {
+		if iptables.Exists(rule...) {
+			continue
+		}
+		if output, err := iptables.Raw(append([]string{"-I"}, rule...)...); err != nil {
+			return fmt.Errorf("Unable to exclude %s from NAT: %s", rule[6], err)
+		} else if len(output) != 0 {
+			return fmt.Errorf("Error iptables postrouting: %s", output)
+		}
+	}
+	return nil
+}
+
 func newNetworkManager(config *DaemonConfig) (*NetworkManager, error) {
 	if config.BridgeIface == DisableNetworkBridge {
 		manager := &NetworkManager{
@@ -678,6 +1039,14 @@ func newNetworkManager(config *DaemonConfig) (*NetworkManager, error) {
 	}
 	network := addr.(*net.IPNet)
 
+	if err := configureBridgeRouting(config, network); err != nil {
+		return nil, err
+	}
+
+	if err := configureNatExclusions(config, network); err != nil {
+		return nil, err
+	}
+
 	// Configure iptables for link support
 	if config.EnableIptables {
 		args := []string{"FORWARD", "-i", config.BridgeIface, "-o", config.BridgeIface, "-j", "DROP"}
@@ -720,6 +1089,7 @@ func newNetworkManager(config *DaemonConfig) (*NetworkManager, error) {
 		tcpPortAllocator: tcpPortAllocator,
 		udpPortAllocator: udpPortAllocator,
 		portMapper:       portMapper,
+		mirrors:          make(map[*NetworkInterface]string),
 	}
 
 	return manager, nil
@@ -1,8 +1,13 @@
 package docker
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestPortAllocation(t *testing.T) {
@@ -311,3 +316,206 @@ func TestCheckNameserverOverlaps(t *testing.T) {
 		t.Fatalf("%s should not overlap %v but it does", netX, nameservers)
 	}
 }
+
+func TestNatMatches(t *testing.T) {
+	nat := &Nat{Port: Port("80/tcp"), Binding: PortBinding{HostIp: "0.0.0.0", HostPort: "49153"}}
+	for _, binding := range []PortBinding{
+		{},
+		{HostPort: "49153"},
+		{HostIp: "0.0.0.0", HostPort: "49153"},
+	} {
+		if !nat.matches(binding) {
+			t.Errorf("%v should match %v", nat, binding)
+		}
+	}
+	for _, binding := range []PortBinding{
+		{HostPort: "49154"},
+		{HostIp: "127.0.0.1"},
+		{HostPath: "/var/run/app.sock"},
+	} {
+		if nat.matches(binding) {
+			t.Errorf("%v should not match %v", nat, binding)
+		}
+	}
+
+	nat.Mode = PublishAll
+	if !nat.matches(PortBinding{Mode: PublishAll}) || nat.matches(PortBinding{Mode: PublishLocalhost}) {
+		t.Errorf("%v should only match its mode", nat)
+	}
+
+	nat = &Nat{Port: Port("80/tcp"), Binding: PortBinding{HostPath: "/var/run/app.sock"}}
+	if !nat.matches(PortBinding{}) || !nat.matches(PortBinding{HostPath: "/var/run/app.sock"}) {
+		t.Errorf("%v should match its path", nat)
+	}
+	if nat.matches(PortBinding{HostPort: "80"}) {
+		t.Errorf("%v should not match a host port", nat)
+	}
+}
+
+func TestResolvePublishMode(t *testing.T) {
+	for _, test := range []struct {
+		binding PortBinding
+		ip      string
+		mode    string
+	}{
+		{PortBinding{}, "0.0.0.0", PublishAll},
+		{PortBinding{HostIp: "0.0.0.0"}, "0.0.0.0", PublishAll},
+		{PortBinding{HostIp: "10.0.0.1"}, "10.0.0.1", PublishAddress},
+		{PortBinding{HostIp: "10.0.0.1", Mode: PublishLocalhost}, "127.0.0.1", PublishLocalhost},
+		{PortBinding{Mode: PublishAll}, "0.0.0.0", PublishAll},
+		{PortBinding{Mode: PublishInterface, Interface: "lo"}, "127.0.0.1", PublishInterface},
+	} {
+		ip, mode, err := resolvePublishMode(test.binding, net.IPv4zero)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != test.ip || mode != test.mode {
+			t.Errorf("Expected %s %s for %v, got %s %s", test.ip, test.mode, test.binding, ip, mode)
+		}
+	}
+
+	ip, mode, err := resolvePublishMode(PortBinding{}, net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.1" || mode != PublishAddress {
+		t.Errorf("Expected the default ip as an address, got %s %s", ip, mode)
+	}
+
+	for _, binding := range []PortBinding{
+		{HostIp: "not-an-ip"},
+		{Mode: "everywhere"},
+		{Mode: PublishInterface, Interface: "nosuchiface0"},
+	} {
+		if _, _, err := resolvePublishMode(binding, net.IPv4zero); err == nil {
+			t.Errorf("Expected an error resolving %v", binding)
+		}
+	}
+}
+
+func TestConfigureBridgeRoutingInvalid(t *testing.T) {
+	network := &net.IPNet{IP: net.IPv4(172, 17, 42, 1), Mask: net.CIDRMask(16, 32)}
+	for _, config := range []*DaemonConfig{
+		{BridgeIface: "docker0", BridgeRpFilter: "3"},
+		{BridgeIface: "docker0", BridgeArpFilter: "2"},
+		{BridgeIface: "docker0", BridgeArpFilter: "on"},
+		{BridgeIface: "docker0", BridgeRouteMetric: -1},
+	} {
+		if err := configureBridgeRouting(config, network); err == nil {
+			t.Errorf("Expected an error configuring %v", config)
+		}
+	}
+	if err := configureBridgeRouting(&DaemonConfig{BridgeIface: "docker0"}, network); err != nil {
+		t.Errorf("Nothing to configure should not fail: %s", err)
+	}
+}
+
+func TestConfigureNatExclusionsInvalid(t *testing.T) {
+	network := &net.IPNet{IP: net.IPv4(172, 17, 42, 1), Mask: net.CIDRMask(16, 32)}
+	for _, exclude := range [][]string{
+		{"10.0.0.0"},
+		{"10.0.0.0/8", "corp"},
+		{"10.0.0.0/33"},
+	} {
+		if err := configureNatExclusions(&DaemonConfig{NatExclude: exclude}, network); err == nil {
+			t.Errorf("Expected an error excluding %v", exclude)
+		}
+	}
+	if err := configureNatExclusions(&DaemonConfig{NatExclude: []string{"10.0.0.0/8", "192.168.1.0/24"}}, network); err != nil {
+		t.Errorf("Valid exclusions without iptables should not fail: %s", err)
+	}
+}
+
+func TestReleaseMirrors(t *testing.T) {
+	manager := &NetworkManager{mirrors: make(map[*NetworkInterface]string)}
+	web := &NetworkInterface{Veth: "vethweb", manager: manager}
+	db := &NetworkInterface{Veth: "vethdb", manager: manager}
+	ids := &NetworkInterface{Veth: "vethids", manager: manager}
+	manager.mirrors[web] = ids.Veth
+	manager.mirrors[db] = ids.Veth
+	manager.mirrors[ids] = "eth1"
+
+	if err := web.Mirror(web.Veth); err == nil {
+		t.Fatal("Mirroring an interface to itself should fail")
+	}
+	if err := (&NetworkInterface{disabled: true}).Mirror("eth1"); err == nil {
+		t.Fatal("Mirroring a disabled interface should fail")
+	}
+
+	db.releaseMirrors()
+	if _, exists := manager.mirrors[db]; exists {
+		t.Fatal("Releasing an interface should stop its mirror")
+	}
+	if web.MirrorTarget() != ids.Veth {
+		t.Fatalf("Expected the other mirrors to be kept, got %v", manager.mirrors)
+	}
+
+	ids.releaseMirrors()
+	if len(manager.mirrors) != 0 {
+		t.Fatalf("Releasing an interface should stop the mirrors to it, got %v", manager.mirrors)
+	}
+	if err := web.Unmirror(); err == nil {
+		t.Fatal("Expected an error stopping a missing mirror")
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	backendPort := backend.Addr().(*net.TCPAddr).Port
+
+	iface := &NetworkInterface{IPNet: net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}
+	forward, err := iface.Forward(NewPort("tcp", strconv.Itoa(backendPort)), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward.HostIp != "127.0.0.1" || forward.HostPort == 0 || forward.HostPort == backendPort {
+		t.Fatalf("Expected an ephemeral port on the loopback, got %s:%d", forward.HostIp, forward.HostPort)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", forward.HostPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected the traffic to be forwarded, got %q (%v)", line, err)
+	}
+	conn.Close()
+
+	if forwards := iface.Forwards(); len(forwards) != 1 || forwards[0] != forward {
+		t.Fatalf("Expected the forward to be listed, got %v", forwards)
+	}
+	if err := iface.StopForward(forward.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := iface.StopForward(forward.ID); err == nil {
+		t.Fatal("Expected an error stopping a forward twice")
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", forward.HostPort)); err == nil {
+		t.Fatal("Expected the port to be closed once the forward is stopped")
+	}
+
+	if _, err := iface.Forward(NewPort("tcp", strconv.Itoa(backendPort)), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if forwards := iface.Forwards(); len(forwards) != 0 {
+		t.Fatalf("Expected the forward to expire, got %v", forwards)
+	}
+}
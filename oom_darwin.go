@@ -0,0 +1,11 @@
+package docker
+
+import "errors"
+
+type oomNotifier struct{}
+
+func notifyOOM(dir string, killed func()) (*oomNotifier, error) {
+	return nil, errors.New("notifyOOM is not implemented on darwin")
+}
+
+func (n *oomNotifier) drain() {}
@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// oomNotifier calls killed each time the OOM killer kills a process of a
+// memory cgroup, until the cgroup is removed. The kills are noticed in the
+// background, or right away with drain.
+type oomNotifier struct {
+	sync.Mutex
+	dir     string
+	eventfd *os.File
+	// The descriptor of eventfd, whose Fd would make it blocking
+	fd int
+	// The files to close with the eventfd
+	files     []*os.File
+	killed    func()
+	closed    bool
+	closeOnce sync.Once
+}
+
+// notifyOOM returns a notifier calling killed each time the OOM killer
+// kills a process of the memory cgroup dir
+func notifyOOM(dir string, killed func()) (*oomNotifier, error) {
+	oomControl, err := os.Open(path.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	fd, err := newEventfd()
+	if err != nil {
+		oomControl.Close()
+		return nil, err
+	}
+
+	data := fmt.Sprintf("%d %d", fd, oomControl.Fd())
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.event_control"), []byte(data), 0700); err != nil {
+		syscall.Close(fd)
+		oomControl.Close()
+		return nil, err
+	}
+	return newOOMNotifier(dir, fd, killed, oomControl)
+}
+
+// newEventfd returns the descriptor of a new non blocking eventfd
+func newEventfd() (int, error) {
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// newOOMNotifier returns a notifier of the events of the non blocking
+// eventfd fd, registered for the memory cgroup dir, and starts waiting for
+// them in the background
+func newOOMNotifier(dir string, fd int, killed func(), files ...*os.File) (*oomNotifier, error) {
+	n := &oomNotifier{dir: dir, eventfd: os.NewFile(uintptr(fd), "eventfd"), fd: fd, files: files, killed: killed}
+	conn, err := n.eventfd.SyscallConn()
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+	go func() {
+		// The events are read under the lock, for drain to know the
+		// kills noticed in the background are recorded
+		for !n.isClosed() {
+			if err := conn.Read(func(uintptr) bool { return n.read() }); err != nil {
+				break
+			}
+		}
+		n.close()
+	}()
+	return n, nil
+}
+
+// drain calls killed for the OOM kills signaled and not noticed yet. Once
+// it returns, killed was called for every kill signaled before, whether
+// drain or the background noticed it.
+func (n *oomNotifier) drain() {
+	n.read()
+	if n.isClosed() {
+		// The background may wait for the events drain read
+		n.close()
+	}
+}
+
+// read reads the events of the eventfd, calling killed for the kills, and
+// returns false when there is none
+func (n *oomNotifier) read() bool {
+	n.Lock()
+	defer n.Unlock()
+	if n.closed {
+		return true
+	}
+	buf := make([]byte, 8)
+	if _, err := syscall.Read(n.fd, buf); err == syscall.EAGAIN {
+		return false
+	} else if err != nil {
+		n.closed = true
+		return true
+	}
+	events := binary.LittleEndian.Uint64(buf)
+	// The eventfd is also signaled once when the cgroup is removed
+	if _, err := os.Lstat(n.dir); err != nil {
+		events--
+		n.closed = true
+	}
+	if events > 0 {
+		n.killed()
+	}
+	return true
+}
+
+func (n *oomNotifier) isClosed() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.closed
+}
+
+// close closes the files of the notifier, once it is closed. It isn't
+// called with the lock held, closing the eventfd waits for the background
+// to return from read.
+func (n *oomNotifier) close() {
+	n.closeOnce.Do(func() {
+		n.Lock()
+		n.closed = true
+		n.Unlock()
+		n.eventfd.Close()
+		for _, f := range n.files {
+			f.Close()
+		}
+	})
+}
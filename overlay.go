@@ -0,0 +1,253 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// MountOverlay mounts the union of the layers on target with overlayfs, rw
+// being the upper layer and work the work directory overlayfs needs on the
+// same filesystem. The layers are listed from the top, and a non empty
+// mountLabel is the SELinux context of all the files of the mount.
+func MountOverlay(ro []string, rw, work, target, mountLabel string) error {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(ro, ":"), rw, work)
+	if mountLabel != "" {
+		data += fmt.Sprintf(",context=\"%s\"", mountLabel)
+	}
+	// The kernel reads a single page of options
+	if len(data) >= os.Getpagesize() {
+		return fmt.Errorf("Unable to mount using overlay: the %d layers don't fit in the mount options", len(ro))
+	}
+	if err := mount("overlay", target, "overlay", 0, data); err != nil {
+		return fmt.Errorf("Unable to mount using overlay: %s", err)
+	}
+	return nil
+}
+
+// aufsToOverlay fills dst with the content of the layer src, its files being
+// hard links to the ones of src, and its whiteouts turned into the ones of
+// overlayfs: a 0:0 char device for a deleted file, and the opaque extended
+// attribute for a directory hiding the layers below.
+func aufsToOverlay(src, dst string) error {
+	return filepath.Walk(src, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, pth)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		name := f.Name()
+		switch {
+		case rel == ".":
+			return copyDirAttributes(f, dst)
+		case name == aufsOpaque:
+			return setOpaque(filepath.Dir(target))
+		case strings.HasPrefix(name, aufsMetaPrefix):
+			// The metadata of AUFS
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(name, aufsWhiteoutPrefix):
+			return mknodWhiteout(filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, aufsWhiteoutPrefix)))
+		case f.IsDir():
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+			return copyDirAttributes(f, target)
+		}
+		return os.Link(pth, target)
+	})
+}
+
+// overlayToAUFS fills dst with the content of the upper layer src, its
+// files being hard links to the ones of src, and its whiteouts turned into
+// the ones of AUFS
+func overlayToAUFS(src, dst string) error {
+	return filepath.Walk(src, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, pth)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case rel == ".":
+			return copyDirAttributes(f, dst)
+		case isOverlayWhiteout(f):
+			return ioutil.WriteFile(filepath.Join(filepath.Dir(target), aufsWhiteoutPrefix+f.Name()), nil, 0600)
+		case f.IsDir():
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+			if isOpaque(pth) {
+				if err := ioutil.WriteFile(filepath.Join(target, aufsOpaque), nil, 0600); err != nil {
+					return err
+				}
+			}
+			return copyDirAttributes(f, target)
+		}
+		return os.Link(pth, target)
+	})
+}
+
+// copyDirAttributes gives the directory dst the owner and the mode of the
+// directory described by f
+func copyDirAttributes(f os.FileInfo, dst string) error {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(dst, f.Mode())
+}
+
+// overlayLayer returns the layer of the image the way overlayfs reads it.
+// It is built next to the layer the first time the image is mounted, and
+// overlayfs never writes to the files it shares with the layer.
+func (img *Image) overlayLayer() (string, error) {
+	root, err := img.root()
+	if err != nil {
+		return "", err
+	}
+	layer := path.Join(root, "overlay")
+	if _, err := os.Stat(layer); err == nil {
+		return layer, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	aufsLayer, err := img.layer()
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(root, "overlay-")
+	if err != nil {
+		return "", err
+	}
+	if err := aufsToOverlay(aufsLayer, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("Unable to convert the layer of image %s for overlay: %s", img.ID, err)
+	}
+	if err := os.Rename(tmp, layer); err != nil {
+		os.RemoveAll(tmp)
+		// Unless another mount of the image built it meanwhile
+		if _, err := os.Stat(layer); err != nil {
+			return "", err
+		}
+	}
+	return layer, nil
+}
+
+// MountOverlay mounts the image on root with overlayfs, rw being the upper
+// layer and work the work directory of overlayfs
+func (img *Image) MountOverlay(root, rw, work, mountLabel string) error {
+	if mounted, err := Mounted(root); err != nil {
+		return err
+	} else if mounted {
+		return fmt.Errorf("%s is already mounted", root)
+	}
+	dockerinitLayer, err := img.getDockerInitLayer()
+	if err != nil {
+		return err
+	}
+	layers := []string{dockerinitLayer}
+	if err := img.WalkHistory(func(img *Image) error {
+		layer, err := img.overlayLayer()
+		if err != nil {
+			return err
+		}
+		layers = append(layers, layer)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, dir := range []string{root, rw, work} {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return MountOverlay(layers, rw, work, root, mountLabel)
+}
+
+// exportOverlayUpper returns a tar archive of the upper layer rw with the
+// whiteouts of AUFS, the format of the layers of the images. The archive is
+// made in tmpDir.
+func exportOverlayUpper(rw, tmpDir string) (archive.Archive, error) {
+	tmp, err := ioutil.TempDir(tmpDir, "rw-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := overlayToAUFS(rw, tmp); err != nil {
+		return nil, err
+	}
+	data, err := archive.Tar(tmp, archive.Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	return archive.NewTempArchive(data, tmpDir)
+}
+
+// overlayDriver mounts the union of the layers of the image of a container
+// under its rw layer with overlayfs
+type overlayDriver struct{}
+
+func (*overlayDriver) Mount(container *Container) error {
+	image, err := container.GetImage()
+	if err != nil {
+		return err
+	}
+	return image.MountOverlay(container.RootfsPath(), container.rwPath(), path.Join(container.root, "work"), container.MountLabel)
+}
+
+func (*overlayDriver) Unmount(container *Container) error {
+	return unmountAndRemove(container.RootfsPath())
+}
+
+func (*overlayDriver) Changes(container *Container) ([]Change, error) {
+	return unionChanges(container)
+}
+
+func (*overlayDriver) ExportChanges(container *Container) (archive.Archive, error) {
+	return exportOverlayUpper(container.rwPath(), container.root)
+}
+
+func (*overlayDriver) ChangesSize(container *Container) int64 {
+	return dirSize(container.rwPath())
+}
+
+func (*overlayDriver) WritableDir(container *Container) (string, error) {
+	return container.rwPath(), nil
+}
+
+func (*overlayDriver) Remove(container *Container) error {
+	return nil
+}
+
+func (*overlayDriver) RemoveImage(id, root string) error {
+	return nil
+}
+
+func init() {
+	RegisterStorageDriver(DriverOverlay, 30,
+		func(root string) error {
+			if !filesystemSupported("overlay") {
+				return fmt.Errorf("the kernel doesn't support it")
+			}
+			return nil
+		},
+		nil,
+		func(runtime *Runtime) (StorageDriver, error) {
+			return &overlayDriver{}, nil
+		})
+}
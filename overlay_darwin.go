@@ -0,0 +1,22 @@
+package docker
+
+import (
+	"errors"
+	"os"
+)
+
+func setOpaque(dir string) error {
+	return errors.New("overlay is not implemented on darwin")
+}
+
+func isOpaque(dir string) bool {
+	return false
+}
+
+func mknodWhiteout(pth string) error {
+	return errors.New("overlay is not implemented on darwin")
+}
+
+func isOverlayWhiteout(f os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,32 @@
+package docker
+
+import (
+	"os"
+	"syscall"
+)
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// setOpaque makes overlayfs hide the content of the layers below dir
+func setOpaque(dir string) error {
+	return syscall.Setxattr(dir, overlayOpaqueXattr, []byte("y"), 0)
+}
+
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(dir, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// mknodWhiteout makes overlayfs hide pth in the layers below
+func mknodWhiteout(pth string) error {
+	return syscall.Mknod(pth, syscall.S_IFCHR, 0)
+}
+
+func isOverlayWhiteout(f os.FileInfo) bool {
+	if f.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := f.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFilesystemListed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	procFile := path.Join(tmp, "filesystems")
+	if err := ioutil.WriteFile(procFile, []byte("nodev\tsysfs\n\text4\nnodev\toverlay\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for fstype, expected := range map[string]bool{"overlay": true, "ext4": true, "aufs": false, "nodev": false} {
+		listed, err := filesystemListed(procFile, fstype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if listed != expected {
+			t.Errorf("Expected %s to be listed: %v, got %v", fstype, expected, listed)
+		}
+	}
+}
+
+func TestOverlayWhiteouts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layer := path.Join(tmp, "layer")
+	for _, dir := range []string{"etc", "opt", "var/lib"} {
+		if err := os.MkdirAll(path.Join(layer, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/hosts", "etc/.wh.motd", "opt/.wh..wh..opq", ".wh..wh.aufs"} {
+		if err := ioutil.WriteFile(path.Join(layer, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	overlay := path.Join(tmp, "overlay")
+	if err := os.Mkdir(overlay, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := aufsToOverlay(layer, overlay); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Lstat(path.Join(overlay, "etc", "motd")); err != nil || !isOverlayWhiteout(f) {
+		t.Fatalf("Expected /etc/motd to be an overlay whiteout (%v)", err)
+	}
+	if !isOpaque(path.Join(overlay, "opt")) {
+		t.Fatal("Expected /opt to be opaque")
+	}
+	for _, file := range []string{"etc/.wh.motd", "opt/.wh..wh..opq", ".wh..wh.aufs"} {
+		if _, err := os.Lstat(path.Join(overlay, file)); !os.IsNotExist(err) {
+			t.Fatalf("Expected no %s in the overlay layer", file)
+		}
+	}
+	if stat, err := os.Stat(overlay); err != nil || stat.Mode().Perm() != 0755 {
+		t.Fatalf("Expected the overlay layer to get the mode of the layer (%v)", err)
+	}
+
+	// Back to the format of the layers
+	aufs := path.Join(tmp, "aufs")
+	if err := os.Mkdir(aufs, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlayToAUFS(overlay, aufs); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"etc/hosts", "etc/.wh.motd", "opt/.wh..wh..opq", "var/lib"} {
+		if _, err := os.Lstat(path.Join(aufs, file)); err != nil {
+			t.Fatalf("Expected %s in the AUFS layer: %s", file, err)
+		}
+	}
+	if _, err := os.Lstat(path.Join(aufs, "etc", "motd")); !os.IsNotExist(err) {
+		t.Fatal("Expected no /etc/motd in the AUFS layer")
+	}
+}
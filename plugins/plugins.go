@@ -0,0 +1,321 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The capabilities a plugin implements, the interfaces of the daemon it
+// plugs into
+const (
+	NetworkDriver = "NetworkDriver"
+	VolumeDriver  = "VolumeDriver"
+	Authorization = "AuthZPlugin"
+)
+
+// MediaType is the content type of the requests to the plugins and of their
+// responses
+const MediaType = "application/vnd.docker.plugins.v1+json"
+
+var (
+	// DefaultSocketsPath is where the plugins running on the host put
+	// their unix socket, NAME.sock
+	DefaultSocketsPath = "/run/docker/plugins"
+	// DefaultSpecsPaths are where the spec files of the other plugins
+	// are, NAME.spec holding the address of the plugin, unix:///path or
+	// tcp://host:port
+	DefaultSpecsPaths = []string{"/etc/docker/plugins", "/usr/lib/docker/plugins"}
+)
+
+// callTimeout bounds each call to a plugin, so that a plugin which hangs
+// doesn't hang the daemon: the connection of each call expires after it
+const callTimeout = 30 * time.Second
+
+// Client calls the methods of a plugin, POST /Method with the arguments and
+// the result in JSON
+type Client struct {
+	addr string
+	http *http.Client
+}
+
+// NewClient returns a client of the plugin listening on addr, unix:///path
+// or tcp://host:port
+func NewClient(addr string) (*Client, error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "unix" && parts[0] != "tcp") {
+		return nil, fmt.Errorf("Invalid plugin address %s, expected unix:///path or tcp://host:port", addr)
+	}
+	proto, host := parts[0], parts[1]
+	return &Client{
+		addr: addr,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(string, string) (net.Conn, error) {
+					conn, err := net.DialTimeout(proto, host, callTimeout)
+					if err != nil {
+						return nil, err
+					}
+					return conn, conn.SetDeadline(time.Now().Add(callTimeout))
+				},
+				ResponseHeaderTimeout: callTimeout,
+				// Each call dials, for its deadline to hold
+				DisableKeepAlives: true,
+			},
+		},
+	}, nil
+}
+
+// Call calls method with args, and decodes its result in ret unless ret is
+// nil
+func (c *Client) Call(method string, args, ret interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	// The host doesn't matter, the transport dials the plugin
+	req, err := http.NewRequest("POST", "http://plugin/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", MediaType)
+	req.Header.Set("Content-Type", MediaType)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s (%s)", method, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if ret == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return fmt.Errorf("%s: invalid response: %s", method, err)
+	}
+	return nil
+}
+
+// Plugin is a plugin found by the manager. Its fields are only changed by
+// the manager, under its lock: use the copies of Manager.List to read them.
+type Plugin struct {
+	Name string
+	Addr string
+	// The capabilities the plugin reported on the handshake
+	Implements []string
+	Active     bool
+	// Why the plugin isn't active, if it isn't
+	Error     string
+	LastCheck time.Time
+
+	client *Client
+}
+
+// Client returns the client of the plugin
+func (p *Plugin) Client() *Client {
+	return p.client
+}
+
+// handshake is the response of the plugins to Plugin.Activate
+type handshake struct {
+	Implements []string
+}
+
+// setHandshake records the handshake h with the plugin, or why it failed
+func (p *Plugin) setHandshake(h *handshake, err error) {
+	p.LastCheck = time.Now()
+	if err != nil {
+		p.Active = false
+		p.Error = err.Error()
+		return
+	}
+	p.Implements = h.Implements
+	p.Active = true
+	p.Error = ""
+}
+
+// Manager discovers the plugins, activates them and checks their health in
+// the background, with Watch. The interfaces of the daemon plugins
+// implement find their clients with Get, and List reports the plugins as
+// last checked, without calling them.
+type Manager struct {
+	sync.Mutex
+	socketsPath string
+	specsPaths  []string
+	plugins     map[string]*Plugin
+}
+
+// NewManager returns a manager of the plugins with a socket in socketsPath
+// or a spec file in one of specsPaths
+func NewManager(socketsPath string, specsPaths []string) *Manager {
+	return &Manager{
+		socketsPath: socketsPath,
+		specsPaths:  specsPaths,
+		plugins:     make(map[string]*Plugin),
+	}
+}
+
+// discover returns the address of each plugin found, by name. A socket
+// wins over a spec file, and a spec file over the ones of the same name
+// in the next directories.
+func (m *Manager) discover() map[string]string {
+	found := make(map[string]string)
+	if files, err := ioutil.ReadDir(m.socketsPath); err == nil {
+		for _, f := range files {
+			if f.Mode()&os.ModeSocket == 0 || !strings.HasSuffix(f.Name(), ".sock") {
+				continue
+			}
+			found[strings.TrimSuffix(f.Name(), ".sock")] = "unix://" + path.Join(m.socketsPath, f.Name())
+		}
+	}
+	for _, dir := range m.specsPaths {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			name := strings.TrimSuffix(f.Name(), ".spec")
+			if f.IsDir() || name == f.Name() {
+				continue
+			}
+			if _, exists := found[name]; exists {
+				continue
+			}
+			spec, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+			if err != nil {
+				utils.Errorf("Unable to read the spec of plugin %s: %s", name, err)
+				continue
+			}
+			found[name] = strings.TrimSpace(string(spec))
+		}
+	}
+	return found
+}
+
+// refresh updates the plugins with the ones found, keeping the state of
+// the ones whose address didn't change, and activates the inactive ones
+func (m *Manager) refresh() {
+	found := m.discover()
+	m.Lock()
+	for name, p := range m.plugins {
+		if addr, exists := found[name]; !exists || addr != p.Addr {
+			delete(m.plugins, name)
+		}
+	}
+	var inactive []*Plugin
+	for name, addr := range found {
+		p, exists := m.plugins[name]
+		if !exists {
+			p = &Plugin{Name: name, Addr: addr}
+			client, err := NewClient(addr)
+			if err != nil {
+				p.Error = err.Error()
+			} else {
+				p.client = client
+			}
+			m.plugins[name] = p
+		}
+		if !p.Active && p.client != nil {
+			inactive = append(inactive, p)
+		}
+	}
+	m.Unlock()
+	m.activate(inactive)
+}
+
+// activate shakes hands with the plugins, which report their capabilities.
+// The plugins are called without the lock, which must not be held, and a
+// plugin replaced meanwhile is left as it is.
+func (m *Manager) activate(plugins []*Plugin) {
+	for _, p := range plugins {
+		h := &handshake{}
+		err := p.client.Call("Plugin.Activate", struct{}{}, h)
+		m.Lock()
+		if m.plugins[p.Name] == p {
+			p.setHandshake(h, err)
+		}
+		m.Unlock()
+	}
+}
+
+// List returns a copy of the plugins found, active or not, by name
+func (m *Manager) List() []Plugin {
+	m.Lock()
+	defer m.Unlock()
+	var plugins []Plugin
+	for _, name := range m.names() {
+		plugins = append(plugins, *m.plugins[name])
+	}
+	return plugins
+}
+
+// Get returns the client of the active plugin name implementing capability
+func (m *Manager) Get(name, capability string) (*Client, error) {
+	m.Lock()
+	defer m.Unlock()
+	p, exists := m.plugins[name]
+	if !exists {
+		return nil, fmt.Errorf("plugin %s not found", name)
+	}
+	if !p.Active {
+		return nil, fmt.Errorf("plugin %s is not active: %s", name, p.Error)
+	}
+	for _, implemented := range p.Implements {
+		if implemented == capability {
+			return p.client, nil
+		}
+	}
+	return nil, fmt.Errorf("plugin %s does not implement %s", name, capability)
+}
+
+func (m *Manager) names() []string {
+	names := make([]string, 0, len(m.plugins))
+	for name := range m.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckHealth shakes hands again with the active plugins: the ones which
+// don't answer are deactivated, and activated again on the next refresh
+func (m *Manager) CheckHealth() {
+	m.Lock()
+	var active []*Plugin
+	for _, p := range m.plugins {
+		if p.Active {
+			active = append(active, p)
+		}
+	}
+	m.Unlock()
+	m.activate(active)
+	m.Lock()
+	defer m.Unlock()
+	for _, p := range active {
+		if !p.Active {
+			utils.Errorf("Plugin %s is unhealthy, deactivating it: %s", p.Name, p.Error)
+		}
+	}
+}
+
+// Watch discovers and activates the plugins, then every interval checks
+// the health of the active ones and discovers and activates the others
+func (m *Manager) Watch(interval time.Duration) {
+	m.refresh()
+	for _ = range time.Tick(interval) {
+		m.CheckHealth()
+		m.refresh()
+	}
+}
@@ -0,0 +1,112 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// servePlugin serves a plugin implementing capabilities on l
+func servePlugin(l net.Listener, capabilities ...string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MediaType)
+		json.NewEncoder(w).Encode(handshake{Implements: capabilities})
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	return srv
+}
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketsPath := path.Join(dir, "sockets")
+	specsPath := path.Join(dir, "specs")
+	for _, d := range []string{socketsPath, specsPath} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := net.Listen("unix", path.Join(socketsPath, "weave.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	weave := servePlugin(l, NetworkDriver)
+	defer weave.Close()
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flocker := servePlugin(l, VolumeDriver, Authorization)
+	if err := ioutil.WriteFile(path.Join(specsPath, "flocker.spec"), []byte("tcp://"+l.Addr().String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(specsPath, "broken.spec"), []byte("http://nowhere"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(socketsPath, []string{specsPath})
+	if plugins := m.List(); len(plugins) != 0 {
+		t.Fatalf("Expected no plugin before the first refresh, found %v", plugins)
+	}
+	m.refresh()
+	plugins := m.List()
+	if len(plugins) != 3 {
+		t.Fatalf("Expected 3 plugins, found %v", plugins)
+	}
+	if p := plugins[0]; p.Name != "broken" || p.Active || p.Error == "" {
+		t.Fatalf("The plugin with an invalid address should be inactive with an error, got %v", p)
+	}
+	if p := plugins[1]; p.Name != "flocker" || !p.Active || len(p.Implements) != 2 {
+		t.Fatalf("The plugin of the spec file should be active with its 2 capabilities, got %v", p)
+	}
+	if p := plugins[2]; p.Name != "weave" || !p.Active || p.Addr != "unix://"+path.Join(socketsPath, "weave.sock") {
+		t.Fatalf("The plugin of the socket should be active, got %v", p)
+	}
+
+	if _, err := m.Get("weave", VolumeDriver); err == nil {
+		t.Fatal("Expected no client for a capability the plugin does not implement")
+	}
+	if _, err := m.Get("missing", NetworkDriver); err == nil {
+		t.Fatal("Expected no client for a missing plugin")
+	}
+	if client, err := m.Get("weave", NetworkDriver); err != nil || client != plugins[2].Client() {
+		t.Fatalf("Expected the client of the active plugin, got %v (%v)", client, err)
+	}
+
+	if client := plugins[2].Client(); client == nil {
+		t.Fatal("Expected a client for the active plugin")
+	} else if err := client.Call("Plugin.Activate", struct{}{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plugin which stops answering is deactivated
+	flocker.Close()
+	m.CheckHealth()
+	m.Lock()
+	p := *m.plugins["flocker"]
+	m.Unlock()
+	if p.Active || p.Error == "" {
+		t.Fatalf("The plugin which stopped should be inactive with an error, got %v", p)
+	}
+	if _, err := m.Get("flocker", VolumeDriver); err == nil {
+		t.Fatal("Expected no client for the inactive plugin")
+	}
+	m.refresh()
+	if plugins := m.List(); plugins[1].Active || !plugins[2].Active {
+		t.Fatalf("Expected the plugin which stopped to stay inactive and the other one active, got %v", plugins)
+	}
+}
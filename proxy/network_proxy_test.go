@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -138,6 +141,22 @@ func TestTCP6Proxy(t *testing.T) {
 	testProxy(t, "tcp", proxy)
 }
 
+func TestTCPProxySetBackendAddr(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	backend.Run()
+	newBackend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer newBackend.Close()
+	newBackend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetBackendAddr(newBackend.LocalAddr())
+	backend.Close()
+	testProxy(t, "tcp", proxy)
+}
+
 func TestTCPDualStackProxy(t *testing.T) {
 	// If I understand `godoc -src net favoriteAddrFamily` (used by the
 	// net.Listen* functions) correctly this should work, but it doesn't.
@@ -157,6 +176,34 @@ func TestTCPDualStackProxy(t *testing.T) {
 	testProxyAt(t, "tcp", proxy, ipv4ProxyAddr.String())
 }
 
+func TestUnixProxy(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	dir, err := ioutil.TempDir("", "docker-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	frontendAddr := &net.UnixAddr{Name: filepath.Join(dir, "proxy.sock"), Net: "unix"}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "unix", proxy)
+
+	// The socket was removed with the proxy, another file is left as is
+	if err := ioutil.WriteFile(frontendAddr.Name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProxy(frontendAddr, backend.LocalAddr()); err == nil {
+		t.Fatal("Expected an error listening on an existing file")
+	}
+	if _, err := os.Stat(frontendAddr.Name); err != nil {
+		t.Errorf("Expected the existing file to be kept: %s", err)
+	}
+}
+
 func TestUDP4Proxy(t *testing.T) {
 	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
 	defer backend.Close()
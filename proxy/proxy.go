@@ -15,6 +15,9 @@ type Proxy interface {
 	FrontendAddr() net.Addr
 	// Return the proxied address.
 	BackendAddr() net.Addr
+	// Forward the new connections to another address, of the same
+	// protocol as the current one.
+	SetBackendAddr(net.Addr)
 }
 
 func NewProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
@@ -23,6 +26,8 @@ func NewProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
 		return NewUDPProxy(frontendAddr.(*net.UDPAddr), backendAddr.(*net.UDPAddr))
 	case *net.TCPAddr:
 		return NewTCPProxy(frontendAddr.(*net.TCPAddr), backendAddr.(*net.TCPAddr))
+	case *net.UnixAddr:
+		return NewUnixProxy(frontendAddr.(*net.UnixAddr), backendAddr.(*net.TCPAddr))
 	default:
 		panic(fmt.Errorf("Unsupported protocol"))
 	}
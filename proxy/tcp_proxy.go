@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"syscall"
 )
 
@@ -12,6 +13,7 @@ type TCPProxy struct {
 	listener     *net.TCPListener
 	frontendAddr *net.TCPAddr
 	backendAddr  *net.TCPAddr
+	backendLock  sync.Mutex
 }
 
 func NewTCPProxy(frontendAddr, backendAddr *net.TCPAddr) (*TCPProxy, error) {
@@ -29,9 +31,10 @@ func NewTCPProxy(frontendAddr, backendAddr *net.TCPAddr) (*TCPProxy, error) {
 }
 
 func (proxy *TCPProxy) clientLoop(client *net.TCPConn, quit chan bool) {
-	backend, err := net.DialTCP("tcp", nil, proxy.backendAddr)
+	backendAddr := proxy.BackendAddr().(*net.TCPAddr)
+	backend, err := net.DialTCP("tcp", nil, backendAddr)
 	if err != nil {
-		log.Printf("Can't forward traffic to backend tcp/%v: %v\n", proxy.backendAddr, err.Error())
+		log.Printf("Can't forward traffic to backend tcp/%v: %v\n", backendAddr, err.Error())
 		client.Close()
 		return
 	}
@@ -77,11 +80,11 @@ done:
 func (proxy *TCPProxy) Run() {
 	quit := make(chan bool)
 	defer close(quit)
-	utils.Debugf("Starting proxy on tcp/%v for tcp/%v", proxy.frontendAddr, proxy.backendAddr)
+	utils.Debugf("Starting proxy on tcp/%v for tcp/%v", proxy.frontendAddr, proxy.BackendAddr())
 	for {
 		client, err := proxy.listener.Accept()
 		if err != nil {
-			utils.Debugf("Stopping proxy on tcp/%v for tcp/%v (%v)", proxy.frontendAddr, proxy.backendAddr, err.Error())
+			utils.Debugf("Stopping proxy on tcp/%v for tcp/%v (%v)", proxy.frontendAddr, proxy.BackendAddr(), err.Error())
 			return
 		}
 		go proxy.clientLoop(client.(*net.TCPConn), quit)
@@ -90,4 +93,17 @@ func (proxy *TCPProxy) Run() {
 
 func (proxy *TCPProxy) Close()                 { proxy.listener.Close() }
 func (proxy *TCPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
-func (proxy *TCPProxy) BackendAddr() net.Addr  { return proxy.backendAddr }
+
+func (proxy *TCPProxy) BackendAddr() net.Addr {
+	proxy.backendLock.Lock()
+	defer proxy.backendLock.Unlock()
+	return proxy.backendAddr
+}
+
+// SetBackendAddr forwards the new connections to backendAddr, the
+// connections already open are kept.
+func (proxy *TCPProxy) SetBackendAddr(backendAddr net.Addr) {
+	proxy.backendLock.Lock()
+	proxy.backendAddr = backendAddr.(*net.TCPAddr)
+	proxy.backendLock.Unlock()
+}
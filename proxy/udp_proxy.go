@@ -64,9 +64,12 @@ func NewUDPProxy(frontendAddr, backendAddr *net.UDPAddr) (*UDPProxy, error) {
 func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr, clientKey *connTrackKey) {
 	defer func() {
 		proxy.connTrackLock.Lock()
-		delete(proxy.connTrackTable, *clientKey)
+		// The entry is replaced when the backend changes
+		if proxy.connTrackTable[*clientKey] == proxyConn {
+			delete(proxy.connTrackTable, *clientKey)
+		}
 		proxy.connTrackLock.Unlock()
-		utils.Debugf("Done proxying between udp/%v and udp/%v", clientAddr.String(), proxy.backendAddr.String())
+		utils.Debugf("Done proxying between udp/%v and udp/%v", clientAddr.String(), proxyConn.RemoteAddr())
 		proxyConn.Close()
 	}()
 
@@ -99,7 +102,7 @@ func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr
 
 func (proxy *UDPProxy) Run() {
 	readBuf := make([]byte, UDPBufSize)
-	utils.Debugf("Starting proxy on udp/%v for udp/%v", proxy.frontendAddr, proxy.backendAddr)
+	utils.Debugf("Starting proxy on udp/%v for udp/%v", proxy.frontendAddr, proxy.BackendAddr())
 	for {
 		read, from, err := proxy.listener.ReadFromUDP(readBuf)
 		if err != nil {
@@ -107,9 +110,9 @@ func (proxy *UDPProxy) Run() {
 			// ECONNREFUSED like Read do (see comment in
 			// UDPProxy.replyLoop)
 			if utils.IsClosedError(err) {
-				utils.Debugf("Stopping proxy on udp/%v for udp/%v (socket was closed)", proxy.frontendAddr, proxy.backendAddr)
+				utils.Debugf("Stopping proxy on udp/%v for udp/%v (socket was closed)", proxy.frontendAddr, proxy.BackendAddr())
 			} else {
-				utils.Errorf("Stopping proxy on udp/%v for udp/%v (%v)", proxy.frontendAddr, proxy.backendAddr, err.Error())
+				utils.Errorf("Stopping proxy on udp/%v for udp/%v (%v)", proxy.frontendAddr, proxy.BackendAddr(), err.Error())
 			}
 			break
 		}
@@ -121,6 +124,7 @@ func (proxy *UDPProxy) Run() {
 			proxyConn, err = net.DialUDP("udp", nil, proxy.backendAddr)
 			if err != nil {
 				log.Printf("Can't proxy a datagram to udp/%s: %v\n", proxy.backendAddr.String(), err)
+				proxy.connTrackLock.Unlock()
 				continue
 			}
 			proxy.connTrackTable[*fromKey] = proxyConn
@@ -130,11 +134,11 @@ func (proxy *UDPProxy) Run() {
 		for i := 0; i != read; {
 			written, err := proxyConn.Write(readBuf[i:read])
 			if err != nil {
-				log.Printf("Can't proxy a datagram to udp/%s: %v\n", proxy.backendAddr.String(), err)
+				log.Printf("Can't proxy a datagram to udp/%s: %v\n", proxyConn.RemoteAddr(), err)
 				break
 			}
 			i += written
-			utils.Debugf("Forwarded %v/%v bytes to udp/%v", i, read, proxy.backendAddr.String())
+			utils.Debugf("Forwarded %v/%v bytes to udp/%v", i, read, proxyConn.RemoteAddr())
 		}
 	}
 }
@@ -149,4 +153,22 @@ func (proxy *UDPProxy) Close() {
 }
 
 func (proxy *UDPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
-func (proxy *UDPProxy) BackendAddr() net.Addr  { return proxy.backendAddr }
+
+func (proxy *UDPProxy) BackendAddr() net.Addr {
+	proxy.connTrackLock.Lock()
+	defer proxy.connTrackLock.Unlock()
+	return proxy.backendAddr
+}
+
+// SetBackendAddr forwards the datagrams to backendAddr. The tracked
+// connections are closed, the next datagrams of their clients open new ones
+// to backendAddr.
+func (proxy *UDPProxy) SetBackendAddr(backendAddr net.Addr) {
+	proxy.connTrackLock.Lock()
+	defer proxy.connTrackLock.Unlock()
+	proxy.backendAddr = backendAddr.(*net.UDPAddr)
+	for key, conn := range proxy.connTrackTable {
+		conn.Close()
+		delete(proxy.connTrackTable, key)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// halfCloser is implemented by both *net.UnixConn and *net.TCPConn.
+type halfCloser interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// UnixProxy forwards the connections made on a unix socket to a TCP
+// backend.
+type UnixProxy struct {
+	listener     *net.UnixListener
+	frontendAddr *net.UnixAddr
+	backendAddr  *net.TCPAddr
+	backendLock  sync.Mutex
+}
+
+func NewUnixProxy(frontendAddr *net.UnixAddr, backendAddr *net.TCPAddr) (*UnixProxy, error) {
+	// Whatever is at the path is not ours to replace, e.g. the socket of
+	// another daemon: closing the listener removes the socket it creates
+	if _, err := os.Lstat(frontendAddr.Name); err == nil {
+		return nil, fmt.Errorf("Unable to listen on %s: the file already exists", frontendAddr.Name)
+	}
+	listener, err := net.ListenUnix("unix", frontendAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UnixProxy{
+		listener:     listener,
+		frontendAddr: frontendAddr,
+		backendAddr:  backendAddr,
+	}, nil
+}
+
+func (proxy *UnixProxy) clientLoop(client *net.UnixConn, quit chan bool) {
+	backendAddr := proxy.BackendAddr().(*net.TCPAddr)
+	backend, err := net.DialTCP("tcp", nil, backendAddr)
+	if err != nil {
+		log.Printf("Can't forward traffic to backend tcp/%v: %v\n", backendAddr, err.Error())
+		client.Close()
+		return
+	}
+
+	event := make(chan int64)
+	var broker = func(to, from halfCloser) {
+		written, err := io.Copy(to, from)
+		if err != nil {
+			// If the socket we are writing to is shutdown with
+			// SHUT_WR, forward it to the other end of the pipe:
+			if err, ok := err.(*net.OpError); ok && err.Err == syscall.EPIPE {
+				from.CloseWrite()
+			}
+		}
+		to.CloseRead()
+		event <- written
+	}
+	utils.Debugf("Forwarding traffic between unix/%v and tcp/%v", proxy.frontendAddr, backend.RemoteAddr())
+	go broker(client, backend)
+	go broker(backend, client)
+
+	var transferred int64 = 0
+	for i := 0; i < 2; i++ {
+		select {
+		case written := <-event:
+			transferred += written
+		case <-quit:
+			// Interrupt the two brokers and "join" them.
+			client.Close()
+			backend.Close()
+			for ; i < 2; i++ {
+				transferred += <-event
+			}
+			goto done
+		}
+	}
+	client.Close()
+	backend.Close()
+done:
+	utils.Debugf("%v bytes transferred between unix/%v and tcp/%v", transferred, proxy.frontendAddr, backend.RemoteAddr())
+}
+
+func (proxy *UnixProxy) Run() {
+	quit := make(chan bool)
+	defer close(quit)
+	utils.Debugf("Starting proxy on unix/%v for tcp/%v", proxy.frontendAddr, proxy.BackendAddr())
+	for {
+		client, err := proxy.listener.AcceptUnix()
+		if err != nil {
+			utils.Debugf("Stopping proxy on unix/%v for tcp/%v (%v)", proxy.frontendAddr, proxy.BackendAddr(), err.Error())
+			return
+		}
+		go proxy.clientLoop(client, quit)
+	}
+}
+
+// Close stops the proxy; closing the listener also removes the socket.
+func (proxy *UnixProxy) Close()                 { proxy.listener.Close() }
+func (proxy *UnixProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
+
+func (proxy *UnixProxy) BackendAddr() net.Addr {
+	proxy.backendLock.Lock()
+	defer proxy.backendLock.Unlock()
+	return proxy.backendAddr
+}
+
+// SetBackendAddr forwards the new connections to backendAddr, the
+// connections already open are kept.
+func (proxy *UnixProxy) SetBackendAddr(backendAddr net.Addr) {
+	proxy.backendLock.Lock()
+	proxy.backendAddr = backendAddr.(*net.TCPAddr)
+	proxy.backendLock.Unlock()
+}
@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/utils"
+	"sort"
+)
+
+// danglingImages returns the images of the graph left behind, e.g. by the
+// rebuilds of a tag: the ones neither tagged, nor used by a container, nor
+// the ancestor of such an image. The children come before their parent.
+func danglingImages(images map[string]*Image, tagged map[string][]string, used map[string]bool) []*Image {
+	kept := make(map[string]bool)
+	for id, img := range images {
+		if len(tagged[id]) == 0 && !used[id] {
+			continue
+		}
+		for img != nil && !kept[img.ID] {
+			kept[img.ID] = true
+			img = images[img.Parent]
+		}
+	}
+
+	depths := make(map[string]int)
+	var depth func(img *Image) int
+	depth = func(img *Image) int {
+		if d, exists := depths[img.ID]; exists {
+			return d
+		}
+		d := 0
+		if parent, exists := images[img.Parent]; exists {
+			d = depth(parent) + 1
+		}
+		depths[img.ID] = d
+		return d
+	}
+	var dangling []*Image
+	for id, img := range images {
+		if !kept[id] {
+			dangling = append(dangling, img)
+			depth(img)
+		}
+	}
+	sort.Sort(imagesByDepth{dangling, depths})
+	return dangling
+}
+
+type imagesByDepth struct {
+	images []*Image
+	depths map[string]int
+}
+
+func (s imagesByDepth) Len() int      { return len(s.images) }
+func (s imagesByDepth) Swap(i, j int) { s.images[i], s.images[j] = s.images[j], s.images[i] }
+
+// The deepest first, then by id for a stable order
+func (s imagesByDepth) Less(i, j int) bool {
+	di, dj := s.depths[s.images[i].ID], s.depths[s.images[j].ID]
+	if di != dj {
+		return di > dj
+	}
+	return s.images[i].ID < s.images[j].ID
+}
+
+// ImagesPrune removes the dangling images, see danglingImages, or only lists
+// them with dryRun. The space reclaimed doesn't count the layers still
+// shared with the images kept.
+func (srv *Server) ImagesPrune(dryRun bool) (*APIPrune, error) {
+	images, err := srv.runtime.graph.Map()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, container := range srv.runtime.List() {
+		used[container.Image] = true
+	}
+	dangling := danglingImages(images, srv.runtime.repositories.ByID(), used)
+
+	pruned := make(map[string]bool)
+	for _, img := range dangling {
+		pruned[img.ID] = true
+	}
+	sharedDigests := make(map[string]bool)
+	for id, img := range images {
+		if !pruned[id] && img.LayerDigest != "" {
+			sharedDigests[img.LayerDigest] = true
+		}
+	}
+
+	out := &APIPrune{Deleted: []string{}}
+	for _, img := range dangling {
+		if !dryRun {
+			if err := srv.runtime.graph.Delete(img.ID); err != nil {
+				return out, err
+			}
+			srv.LogEvent("delete", utils.TruncateID(img.ID), "")
+		}
+		out.Deleted = append(out.Deleted, img.ID)
+		if img.LayerDigest != "" {
+			if sharedDigests[img.LayerDigest] {
+				continue
+			}
+			sharedDigests[img.LayerDigest] = true
+		}
+		out.SpaceReclaimed += img.Size
+	}
+	return out, nil
+}
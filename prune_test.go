@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestDanglingImages(t *testing.T) {
+	images := make(map[string]*Image)
+	for id, parent := range map[string]string{
+		"base":      "",
+		"tagged":    "base",
+		"old":       "base",
+		"oldchild":  "old",
+		"used":      "old",
+		"orphan":    "",
+		"orphanTop": "orphan",
+	} {
+		images[id] = &Image{ID: id, Parent: parent}
+	}
+	tagged := map[string][]string{"tagged": {"repo:latest"}}
+	used := map[string]bool{"used": true}
+
+	dangling := danglingImages(images, tagged, used)
+	var ids []string
+	for _, img := range dangling {
+		ids = append(ids, img.ID)
+	}
+	expected := []string{"oldchild", "orphanTop", "orphan"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Expected dangling images %v, got %v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("Expected dangling images %v, got %v", expected, ids)
+		}
+	}
+}
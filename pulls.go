@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"io"
+	"sync"
+)
+
+// pullBroadcast is a pull in progress, a repository, an image or a layer:
+// its output is kept for the requests of the same pull, made while it is in
+// progress, to follow it from the start instead of pulling again
+type pullBroadcast struct {
+	sync.Mutex
+	cond   *sync.Cond
+	output []byte
+	done   bool
+	err    error
+}
+
+func newPullBroadcast() *pullBroadcast {
+	b := &pullBroadcast{}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+func (b *pullBroadcast) Write(p []byte) (int, error) {
+	b.Lock()
+	b.output = append(b.output, p...)
+	b.cond.Broadcast()
+	b.Unlock()
+	return len(p), nil
+}
+
+// finish ends the pull with its error, once its output is complete
+func (b *pullBroadcast) finish(err error) {
+	b.Lock()
+	b.done = true
+	b.err = err
+	b.cond.Broadcast()
+	b.Unlock()
+}
+
+// follow writes the output of the pull to out, from the start, until the
+// pull ends, and returns the error of the pull. It stops following when out
+// fails, without stopping the pull.
+func (b *pullBroadcast) follow(out io.Writer) error {
+	offset := 0
+	for {
+		b.Lock()
+		for offset == len(b.output) && !b.done {
+			b.cond.Wait()
+		}
+		chunk := b.output[offset:]
+		done, err := b.done, b.err
+		b.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := out.Write(chunk); err != nil {
+				return err
+			}
+			offset += len(chunk)
+		}
+		if done && offset == len(b.output) {
+			return err
+		}
+	}
+}
+
+// teeWriter writes to the broadcast of a pull, then to the output of the
+// request which started the pull. The pull goes on when the latter fails,
+// for the other requests following it.
+type teeWriter struct {
+	broadcast *pullBroadcast
+	out       io.Writer
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	w.broadcast.Write(p)
+	return w.out.Write(p)
+}
+
+// joinPull returns the broadcast of the pull key in progress, or starts it.
+// The request which starts it, the leader, pulls and writes its output to
+// the broadcast, then ends it with endPull; the others follow it.
+func (srv *Server) joinPull(key string) (b *pullBroadcast, leader bool) {
+	srv.Lock()
+	defer srv.Unlock()
+	if b, exists := srv.pulls[key]; exists {
+		return b, false
+	}
+	if srv.pulls == nil {
+		srv.pulls = make(map[string]*pullBroadcast)
+	}
+	b = newPullBroadcast()
+	srv.pulls[key] = b
+	return b, true
+}
+
+// endPull ends the pull key with its error: the requests made from then on
+// pull again
+func (srv *Server) endPull(key string, b *pullBroadcast, err error) {
+	srv.Lock()
+	if srv.pulls[key] == b {
+		delete(srv.pulls, key)
+	}
+	srv.Unlock()
+	b.finish(err)
+}
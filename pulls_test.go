@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestJoinPull(t *testing.T) {
+	srv := &Server{}
+	b, leader := srv.joinPull("busybox:latest")
+	if !leader {
+		t.Fatal("Expected the first request of the pull to lead it")
+	}
+	b.Write([]byte("Pulling repository busybox\n"))
+
+	followed := make(chan error)
+	outs := make([]*bytes.Buffer, 2)
+	for i := range outs {
+		other, leader := srv.joinPull("busybox:latest")
+		if leader || other != b {
+			t.Fatal("Expected the requests of the pull in progress to follow it")
+		}
+		outs[i] = &bytes.Buffer{}
+		go func(out *bytes.Buffer) {
+			followed <- other.follow(out)
+		}(outs[i])
+	}
+	if _, leader := srv.joinPull("busybox:ubuntu"); !leader {
+		t.Fatal("Expected another pull to be started")
+	}
+
+	b.Write([]byte("Download complete\n"))
+	srv.endPull("busybox:latest", b, fmt.Errorf("Could not find repository"))
+	for range outs {
+		if err := <-followed; err == nil || err.Error() != "Could not find repository" {
+			t.Errorf("Expected the error of the pull, got %v", err)
+		}
+	}
+	for _, out := range outs {
+		if expected := "Pulling repository busybox\nDownload complete\n"; out.String() != expected {
+			t.Errorf("Expected the output %q, got %q", expected, out.String())
+		}
+	}
+
+	if _, leader := srv.joinPull("busybox:latest"); !leader {
+		t.Error("Expected the pull to be started again once ended")
+	}
+}
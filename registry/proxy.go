@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DirectProxy is the proxy of the registries reached without proxy
+const DirectProxy = "direct"
+
+// ProxyConfig is how the requests to the registries go through HTTP
+// proxies. The proxies are given as http://[user:password@]host:port, the
+// credentials being sent to the proxies with basic auth. Without proxy for
+// a registry, the environment of the daemon applies: HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY.
+type ProxyConfig struct {
+	// The proxy of all the registries
+	Default string
+	// The proxies of registries, host or host:port, instead of Default, or
+	// DirectProxy
+	Registries map[string]string
+	// The registries reached without proxy: host, host:port, .domain for
+	// the hosts of the domain, or * for all
+	NoProxy []string
+}
+
+var (
+	proxyConfig     ProxyConfig
+	proxyConfigLock sync.Mutex
+)
+
+// ParseProxy parses the url of a proxy, DirectProxy giving nil
+func ParseProxy(rawurl string) (*url.URL, error) {
+	if rawurl == DirectProxy {
+		return nil, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("expected http://[user:password@]host:port")
+	}
+	return u, nil
+}
+
+// Validate checks the proxies of the configuration
+func (config *ProxyConfig) Validate() error {
+	if config.Default != "" {
+		if _, err := ParseProxy(config.Default); err != nil {
+			return fmt.Errorf("Invalid proxy %s: %s", redactProxy(config.Default), err)
+		}
+	}
+	for host, proxy := range config.Registries {
+		if host == "" || strings.ContainsAny(host, "/@") {
+			return fmt.Errorf("Invalid proxy of registry %s: expected host or host:port", host)
+		}
+		if _, err := ParseProxy(proxy); err != nil {
+			return fmt.Errorf("Invalid proxy %s of registry %s: %s", redactProxy(proxy), host, err)
+		}
+	}
+	for _, host := range config.NoProxy {
+		if host == "" || strings.ContainsAny(host, "/@") {
+			return fmt.Errorf("Invalid registry without proxy %s: expected host, host:port, .domain or *", host)
+		}
+	}
+	return nil
+}
+
+// redactProxy returns the url of the proxy without its password, to be
+// shown in the errors
+func redactProxy(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// SetProxyConfig replaces the proxies of the registries, login included.
+// It applies to the requests made from then on.
+func SetProxyConfig(config ProxyConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	proxyConfigLock.Lock()
+	proxyConfig = config
+	proxyConfigLock.Unlock()
+	auth.SetProxy(ProxyForRequest)
+	return nil
+}
+
+// matchesNoProxy tells whether the registry at host, host or host:port, is
+// reached without proxy according to noProxy
+func matchesNoProxy(host string, noProxy []string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, entry := range noProxy {
+		switch {
+		case entry == "*", entry == host, entry == hostname:
+			return true
+		case strings.HasPrefix(entry, ".") && (strings.HasSuffix(hostname, entry) || hostname == entry[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyForRequest returns the proxy of a request to a registry, nil when
+// the request goes direct, see http.Transport
+func ProxyForRequest(req *http.Request) (*url.URL, error) {
+	proxyConfigLock.Lock()
+	config := proxyConfig
+	proxyConfigLock.Unlock()
+
+	host := req.URL.Host
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, name := range []string{host, hostname} {
+		if proxy, exists := config.Registries[name]; exists {
+			return ParseProxy(proxy)
+		}
+	}
+	if matchesNoProxy(host, config.NoProxy) {
+		return nil, nil
+	}
+	if config.Default != "" {
+		return ParseProxy(config.Default)
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -2,9 +2,11 @@ package registry
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/utils"
 	"io"
@@ -16,6 +18,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,6 +28,92 @@ var (
 	ErrLoginRequired         = errors.New("Authentication is required.")
 )
 
+var (
+	insecureRegistries     []string
+	insecureRegistriesLock sync.Mutex
+)
+
+// SetInsecureRegistries replaces the list of the registries, host or
+// host:port, whose TLS certificates aren't verified. It applies to the
+// requests made from then on.
+func SetInsecureRegistries(hosts []string) {
+	insecureRegistriesLock.Lock()
+	defer insecureRegistriesLock.Unlock()
+	insecureRegistries = append([]string(nil), hosts...)
+}
+
+// IsInsecureRegistry reports whether the TLS certificate of the registry at
+// host, host or host:port, isn't verified
+func IsInsecureRegistry(host string) bool {
+	insecureRegistriesLock.Lock()
+	defer insecureRegistriesLock.Unlock()
+	for _, insecure := range insecureRegistries {
+		if insecure == host || insecure+":443" == host {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckEndpoint refuses the endpoint of a registry which only serves plain
+// HTTP, unless it is one of the insecure registries. The registries whose
+// TLS certificate doesn't verify fail on their own.
+func CheckEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "http" && !IsInsecureRegistry(u.Host) {
+		return fmt.Errorf("Forbidden, the registry %s doesn't serve HTTPS: it can only be used as an insecure registry", u.Host)
+	}
+	return nil
+}
+
+// parseEndpoints returns the endpoints of the registries the index at
+// indexEp sends in the X-Docker-Endpoints header. They are checked like the
+// endpoint of the index with CheckEndpoint.
+func parseEndpoints(indexEp string, header http.Header) ([]string, error) {
+	if header.Get("X-Docker-Endpoints") == "" {
+		return nil, fmt.Errorf("Index response didn't contain any endpoints")
+	}
+	var endpoints []string
+	// The Registry's URL scheme has to match the Index'
+	urlScheme := indexEp[:strings.Index(indexEp, ":")]
+	for _, ep := range header["X-Docker-Endpoints"] {
+		endpoint := fmt.Sprintf("%s://%s/v1/", urlScheme, ep)
+		if err := CheckEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// registryTransport sends the requests to the insecure registries without
+// verifying their TLS certificates
+type registryTransport struct {
+	secure   *http.Transport
+	insecure *http.Transport
+}
+
+// newRegistryTransport returns a registry transport from the two transports
+// newTransport returns
+func newRegistryTransport(newTransport func() *http.Transport) *registryTransport {
+	insecure := newTransport()
+	insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &registryTransport{
+		secure:   newTransport(),
+		insecure: insecure,
+	}
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && IsInsecureRegistry(req.URL.Host) {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
 func pingRegistryEndpoint(endpoint string) error {
 	if endpoint == auth.IndexServerAddress() {
 		// Skip the check, we now this one is valid
@@ -41,7 +130,9 @@ func pingRegistryEndpoint(endpoint string) error {
 		conn.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
 		return conn, nil
 	}
-	httpTransport := &http.Transport{Dial: httpDial}
+	httpTransport := newRegistryTransport(func() *http.Transport {
+		return &http.Transport{Dial: httpDial, Proxy: ProxyForRequest}
+	})
 	client := &http.Client{Transport: httpTransport}
 	resp, err := client.Get(endpoint + "_ping")
 	if err != nil {
@@ -186,18 +277,28 @@ func (r *Registry) GetRemoteHistory(imgID, registry string, token []string) ([]s
 
 // Check if an image exists in the Registry
 func (r *Registry) LookupRemoteImage(imgID, registry string, token []string) bool {
+	exists, _ := r.LookupRemoteImageChecksum(imgID, registry, token)
+	return exists
+}
 
+// LookupRemoteImageChecksum reports whether the image imgID was pushed to
+// the registry, whatever the repository it was pushed to, and returns the
+// checksum of its layer when the registry tells it
+func (r *Registry) LookupRemoteImageChecksum(imgID, registry string, token []string) (bool, string) {
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/json", nil)
 	if err != nil {
-		return false
+		return false, ""
 	}
 	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
-		return false
+		return false, ""
 	}
 	res.Body.Close()
-	return res.StatusCode == 200
+	if res.StatusCode != 200 {
+		return false, ""
+	}
+	return true, res.Header.Get("X-Docker-Checksum")
 }
 
 // Retrieve an image from the Registry.
@@ -230,21 +331,50 @@ func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([
 }
 
 func (r *Registry) GetRemoteImageLayer(imgID, registry string, token []string) (io.ReadCloser, error) {
+	layer, err := r.GetRemoteImageLayerFrom(imgID, registry, token, 0)
+	if err != nil {
+		return nil, err
+	}
+	return layer.ReadCloser, nil
+}
+
+// RemoteLayer is the layer of an image being downloaded from a registry
+type RemoteLayer struct {
+	io.ReadCloser
+	// Where the download starts in the layer: the offset asked, or 0 when
+	// the registry doesn't support ranges
+	Offset int64
+}
+
+// GetRemoteImageLayerFrom downloads the layer of an image from offset on,
+// to resume an interrupted download. The registry may send the whole
+// layer instead, see RemoteLayer.Offset.
+func (r *Registry) GetRemoteImageLayerFrom(imgID, registry string, token []string, offset int64) (*RemoteLayer, error) {
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/layer", nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error while getting from the server: %s\n", err)
 	}
 	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	switch {
+	case res.StatusCode == 200:
+		return &RemoteLayer{ReadCloser: res.Body}, nil
+	case res.StatusCode == 206 && offset > 0:
+		return &RemoteLayer{ReadCloser: res.Body, Offset: offset}, nil
+	case res.StatusCode == 416 && offset > 0:
+		// Nothing left after offset, or offset is past the layer: start over
 		res.Body.Close()
-		return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
-			res.StatusCode, imgID)
+		return r.GetRemoteImageLayerFrom(imgID, registry, token, 0)
 	}
-	return res.Body, nil
+	res.Body.Close()
+	return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
+		res.StatusCode, imgID)
 }
 
 func (r *Registry) GetRemoteTags(registries []string, repository string, token []string) (map[string]string, error) {
@@ -321,15 +451,9 @@ func (r *Registry) GetRepositoryData(indexEp, remote string) (*RepositoryData, e
 		tokens = res.Header["X-Docker-Token"]
 	}
 
-	var endpoints []string
-	var urlScheme = indexEp[:strings.Index(indexEp, ":")]
-	if res.Header.Get("X-Docker-Endpoints") != "" {
-		// The Registry's URL scheme has to match the Index'
-		for _, ep := range res.Header["X-Docker-Endpoints"] {
-			endpoints = append(endpoints, fmt.Sprintf("%s://%s/v1/", urlScheme, ep))
-		}
-	} else {
-		return nil, fmt.Errorf("Index response didn't contain any endpoints")
+	endpoints, err := parseEndpoints(indexEp, res.Header)
+	if err != nil {
+		return nil, err
 	}
 
 	checksumsJSON, err := ioutil.ReadAll(res.Body)
@@ -422,13 +546,19 @@ func (r *Registry) PushImageJSONRegistry(imgData *ImgData, jsonRaw []byte, regis
 	return nil
 }
 
-func (r *Registry) PushImageLayerRegistry(imgID string, layer io.Reader, registry string, token []string, jsonRaw []byte) (checksum string, err error) {
+// PushImageLayerRegistry uploads layer, an uncompressed archive, compressed
+// with encoding, and returns its checksum
+func (r *Registry) PushImageLayerRegistry(imgID string, layer io.Reader, registry string, token []string, jsonRaw []byte, encoding archive.Encoding) (checksum string, err error) {
 
 	utils.Debugf("[registry] Calling PUT %s", registry+"images/"+imgID+"/layer")
 
-	tarsumLayer := &utils.TarSum{Reader: layer}
+	tarsumLayer := &utils.TarSum{Reader: layer, DisableCompression: true}
+	compressedLayer, err := archive.CompressStream(tarsumLayer, encoding)
+	if err != nil {
+		return "", err
+	}
 
-	req, err := r.reqFactory.NewRequest("PUT", registry+"images/"+imgID+"/layer", tarsumLayer)
+	req, err := r.reqFactory.NewRequest("PUT", registry+"images/"+imgID+"/layer", compressedLayer)
 	if err != nil {
 		return "", err
 	}
@@ -539,7 +669,6 @@ func (r *Registry) PushImageJSONIndex(indexEp, remote string, imgList []*ImgData
 	}
 
 	var tokens, endpoints []string
-	var urlScheme = indexEp[:strings.Index(indexEp, ":")]
 	if !validate {
 		if res.StatusCode != 200 && res.StatusCode != 201 {
 			errBody, err := ioutil.ReadAll(res.Body)
@@ -555,13 +684,8 @@ func (r *Registry) PushImageJSONIndex(indexEp, remote string, imgList []*ImgData
 			return nil, fmt.Errorf("Index response didn't contain an access token")
 		}
 
-		if res.Header.Get("X-Docker-Endpoints") != "" {
-			// The Registry's URL scheme has to match the Index'
-			for _, ep := range res.Header["X-Docker-Endpoints"] {
-				endpoints = append(endpoints, fmt.Sprintf("%s://%s/v1/", urlScheme, ep))
-			}
-		} else {
-			return nil, fmt.Errorf("Index response didn't contain any endpoints")
+		if endpoints, err = parseEndpoints(indexEp, res.Header); err != nil {
+			return nil, err
 		}
 	}
 	if validate {
@@ -648,10 +772,12 @@ type Registry struct {
 }
 
 func NewRegistry(root string, authConfig *auth.AuthConfig, factory *utils.HTTPRequestFactory) (r *Registry, err error) {
-	httpTransport := &http.Transport{
-		DisableKeepAlives: true,
-		Proxy:             http.ProxyFromEnvironment,
-	}
+	httpTransport := newRegistryTransport(func() *http.Transport {
+		return &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             ProxyForRequest,
+		}
+	})
 
 	r = &Registry{
 		authConfig: authConfig,
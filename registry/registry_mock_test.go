@@ -192,6 +192,14 @@ func handlerGetImage(w http.ResponseWriter, r *http.Request) {
 	writeHeaders(w)
 	layer_size := len(layer["layer"])
 	w.Header().Add("X-Docker-Size", strconv.Itoa(layer_size))
+	if checksum := layer["checksum_tarsum"]; checksum != "" && vars["action"] == "json" {
+		w.Header().Add("X-Docker-Checksum", checksum)
+	}
+	if vars["action"] == "layer" {
+		// Supports the ranges of the resumed downloads
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(layer["layer"]))
+		return
+	}
 	io.WriteString(w, layer[vars["action"]])
 }
 
@@ -0,0 +1,220 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// RegistryConfig is the configuration of the daemon about the registries.
+// It is read from the file of -registry-config, and read again when the
+// daemon receives SIGHUP: the pulls started from then on use it.
+type RegistryConfig struct {
+	// The endpoints tried first, in order, for the images of the index
+	Mirrors []string
+	// The registries, host or host:port, whose TLS certificates aren't
+	// verified
+	InsecureRegistries []string
+	// The files of the PEM public keys, by registry host or host:port, the
+	// images pulled from the registry and run must be signed with
+	TrustedKeys map[string][]string
+	// The DER-encoded keys of TrustedKeys
+	trustedKeys map[string][][]byte
+	// The HTTP proxy of the registries, http://[user:password@]host:port,
+	// instead of the HTTPS_PROXY and HTTP_PROXY of the daemon
+	Proxy string
+	// The proxies of registries, host or host:port, instead of Proxy, or
+	// direct
+	RegistryProxies map[string]string
+	// The registries reached without proxy, instead of the NO_PROXY of the
+	// daemon: host, host:port, .domain or *
+	NoProxy []string
+}
+
+// proxyConfig returns the proxies of the registries of the configuration
+func (config *RegistryConfig) proxyConfig() registry.ProxyConfig {
+	return registry.ProxyConfig{
+		Default:    config.Proxy,
+		Registries: config.RegistryProxies,
+		NoProxy:    config.NoProxy,
+	}
+}
+
+// expandMirror returns the endpoint of the mirror at rawurl, with the path
+// of the version of the registry api when it has none
+func expandMirror(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("expected http://host[:port] or https://host[:port]")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/"
+	} else if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+// validRegistryHost checks a registry given as host or host:port
+func validRegistryHost(host string) error {
+	if host == "" || strings.ContainsAny(host, "/@") {
+		return fmt.Errorf("expected host or host:port")
+	}
+	if strings.Contains(host, ":") {
+		if _, port, err := net.SplitHostPort(host); err != nil {
+			return err
+		} else if err := validPort(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadRegistryConfig reads the registry configuration in the JSON file
+// path, and checks it
+func LoadRegistryConfig(path string) (*RegistryConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RegistryConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid registry configuration %s: %s", path, err)
+	}
+	for i, mirror := range config.Mirrors {
+		endpoint, err := expandMirror(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid registry mirror %s: %s", mirror, err)
+		}
+		config.Mirrors[i] = endpoint
+	}
+	for _, host := range config.InsecureRegistries {
+		if err := validRegistryHost(host); err != nil {
+			return nil, fmt.Errorf("Invalid insecure registry %s: %s", host, err)
+		}
+	}
+	proxies := config.proxyConfig()
+	if err := proxies.Validate(); err != nil {
+		return nil, err
+	}
+	config.trustedKeys = make(map[string][][]byte)
+	for host, files := range config.TrustedKeys {
+		if err := validRegistryHost(host); err != nil {
+			return nil, fmt.Errorf("Invalid trusted registry %s: %s", host, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("Invalid trusted registry %s: no key", host)
+		}
+		for _, file := range files {
+			key, err := readPublicKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid trusted key %s for %s: %s", file, host, err)
+			}
+			config.trustedKeys[host] = append(config.trustedKeys[host], key)
+		}
+	}
+	return config, nil
+}
+
+// withFlags returns the configuration with the mirrors and the insecure
+// registries given to the daemon: the mirrors, expanded, come before the
+// ones of the configuration which aren't among them
+func (config *RegistryConfig) withFlags(mirrors, insecureRegistries []string) (*RegistryConfig, error) {
+	merged := *config
+	merged.Mirrors = nil
+	merged.InsecureRegistries = nil
+	seen := make(map[string]bool)
+	for _, mirror := range mirrors {
+		endpoint, err := expandMirror(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid registry mirror %s: %s", mirror, err)
+		}
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			merged.Mirrors = append(merged.Mirrors, endpoint)
+		}
+	}
+	for _, endpoint := range config.Mirrors {
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			merged.Mirrors = append(merged.Mirrors, endpoint)
+		}
+	}
+	for _, host := range insecureRegistries {
+		if err := validRegistryHost(host); err != nil {
+			return nil, fmt.Errorf("Invalid insecure registry %s: %s", host, err)
+		}
+		if !seen[host] {
+			seen[host] = true
+			merged.InsecureRegistries = append(merged.InsecureRegistries, host)
+		}
+	}
+	for _, host := range config.InsecureRegistries {
+		if !seen[host] {
+			seen[host] = true
+			merged.InsecureRegistries = append(merged.InsecureRegistries, host)
+		}
+	}
+	return &merged, nil
+}
+
+// ReloadRegistryConfig reads the registry configuration of the daemon
+// again, with the mirrors of -registry-mirror first and the registries of
+// -insecure-registry. The previous one is kept when the new one doesn't
+// load.
+func (srv *Server) ReloadRegistryConfig() error {
+	config := &RegistryConfig{}
+	if file := srv.runtime.config.RegistryConfigFile; file != "" {
+		loaded, err := LoadRegistryConfig(file)
+		if err != nil {
+			return err
+		}
+		config = loaded
+	}
+	config, err := config.withFlags(srv.runtime.config.RegistryMirrors, srv.runtime.config.InsecureRegistries)
+	if err != nil {
+		return err
+	}
+	if err := registry.SetProxyConfig(config.proxyConfig()); err != nil {
+		return err
+	}
+	srv.Lock()
+	srv.registryConfig = config
+	srv.Unlock()
+	registry.SetInsecureRegistries(config.InsecureRegistries)
+	return nil
+}
+
+// RegistryConfig returns the registry configuration in use
+func (srv *Server) RegistryConfig() RegistryConfig {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.registryConfig == nil {
+		return RegistryConfig{}
+	}
+	return *srv.registryConfig
+}
+
+// watchRegistryConfig reloads the registry configuration each time the
+// daemon receives SIGHUP
+func (srv *Server) watchRegistryConfig() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for _ = range c {
+		if err := srv.ReloadRegistryConfig(); err != nil {
+			utils.Errorf("Unable to reload the registry configuration, keeping the previous one: %s", err)
+			continue
+		}
+		config := srv.RegistryConfig()
+		log.Printf("Reloaded the registry configuration from %s: %d mirrors, %d insecure registries", srv.runtime.config.RegistryConfigFile, len(config.Mirrors), len(config.InsecureRegistries))
+	}
+}
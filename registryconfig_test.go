@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadRegistryConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-registry-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	file := path.Join(tmp, "registry.json")
+	if err := ioutil.WriteFile(file, []byte(`{"Mirrors": ["http://mirror.lan:5000", "https://mirror.example.com/cache"], "InsecureRegistries": ["registry.lan:5000"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadRegistryConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http://mirror.lan:5000/v1/", "https://mirror.example.com/cache/"}
+	if len(config.Mirrors) != len(expected) || config.Mirrors[0] != expected[0] || config.Mirrors[1] != expected[1] {
+		t.Errorf("Expected the mirrors %v, got %v", expected, config.Mirrors)
+	}
+	if len(config.InsecureRegistries) != 1 || config.InsecureRegistries[0] != "registry.lan:5000" {
+		t.Errorf("Expected the insecure registry registry.lan:5000, got %v", config.InsecureRegistries)
+	}
+
+	for _, invalid := range []string{
+		`{"Mirrors": ["mirror.lan:5000"]}`,
+		`{"Mirrors": ["ftp://mirror.lan"]}`,
+		`{"InsecureRegistries": ["https://registry.lan"]}`,
+		`{"InsecureRegistries": ["registry.lan:99999"]}`,
+		`{"Mirrors": "http://mirror.lan"}`,
+		`{"Proxy": "proxy.corp:3128"}`,
+		`{"RegistryProxies": {"registry.lan": "ftp://proxy.corp"}}`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRegistryConfig(file); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestRegistryConfigWithFlags(t *testing.T) {
+	config := &RegistryConfig{
+		Mirrors:            []string{"http://mirror.lan:5000/v1/", "https://mirror.example.com/v1/"},
+		InsecureRegistries: []string{"registry.lan:5000"},
+	}
+	merged, err := config.withFlags([]string{"https://mirror.example.com", "http://local:5000"}, []string{"registry.local", "registry.lan:5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://mirror.example.com/v1/", "http://local:5000/v1/", "http://mirror.lan:5000/v1/"}
+	if len(merged.Mirrors) != len(expected) {
+		t.Fatalf("Expected the mirrors %v, got %v", expected, merged.Mirrors)
+	}
+	for i := range expected {
+		if merged.Mirrors[i] != expected[i] {
+			t.Fatalf("Expected the mirrors %v, got %v", expected, merged.Mirrors)
+		}
+	}
+	if len(merged.InsecureRegistries) != 2 || merged.InsecureRegistries[0] != "registry.local" || merged.InsecureRegistries[1] != "registry.lan:5000" {
+		t.Errorf("Expected the insecure registries [registry.local registry.lan:5000], got %v", merged.InsecureRegistries)
+	}
+	if len(config.Mirrors) != 2 || len(config.InsecureRegistries) != 1 {
+		t.Errorf("The configuration merged shouldn't change, got %v", config)
+	}
+	if _, err := config.withFlags([]string{"mirror.lan"}, nil); err == nil {
+		t.Error("Expected a mirror without scheme to be rejected")
+	}
+	if _, err := config.withFlags(nil, []string{"https://registry.lan"}); err == nil {
+		t.Error("Expected an insecure registry with a scheme to be rejected")
+	}
+}
@@ -0,0 +1,134 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"os"
+	"path/filepath"
+)
+
+var errRemovalCancelled = errors.New("Removal cancelled")
+
+// removalCancelled reports whether cancel, which may be nil, was closed or
+// sent a value, as the channels of http.CloseNotifier do
+func removalCancelled(cancel <-chan bool) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// removeTree removes dir and its content, the files before their
+// directories, calling progress, if not nil, with the size removed so far
+// and the total size, at most once per percent removed. It stops with
+// errRemovalCancelled once cancel is closed or sends a value, leaving the
+// rest of the files.
+func removeTree(dir string, progress func(removed, total int64), cancel <-chan bool) error {
+	type entry struct {
+		path string
+		size int64
+	}
+	var (
+		entries []entry
+		total   int64
+	)
+	if err := filepath.Walk(dir, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		entries = append(entries, entry{pth, f.Size()})
+		total += f.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var removed, reported int64
+	// The walk lists the directories before their content
+	for i := len(entries) - 1; i >= 0; i-- {
+		if removalCancelled(cancel) {
+			return errRemovalCancelled
+		}
+		if err := os.Remove(entries[i].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed += entries[i].size
+		if progress != nil && (removed-reported >= total/100 || i == 0) {
+			progress(removed, total)
+			reported = removed
+		}
+	}
+	return nil
+}
+
+// ContainerDestroyAsync starts removing the container, and with removeVolume
+// its volumes, in the background, as ContainerDestroy does. The progress of
+// the removal is shown by State.Removal until it ends, and
+// ContainerDestroyCancel stops it.
+func (srv *Server) ContainerDestroyAsync(name string, removeVolume bool) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if container.State.Running {
+		return fmt.Errorf("Impossible to remove a running container, please stop it first")
+	}
+	cancel := make(chan bool)
+	srv.Lock()
+	if srv.removals == nil {
+		srv.removals = make(map[string]chan bool)
+	}
+	if _, exists := srv.removals[container.ID]; exists {
+		srv.Unlock()
+		return fmt.Errorf("Conflict, the container %s is already being removed", name)
+	}
+	srv.removals[container.ID] = cancel
+	srv.Unlock()
+
+	container.State.Removal = "Removing"
+	go func() {
+		defer func() {
+			srv.Lock()
+			if srv.removals[container.ID] == cancel {
+				delete(srv.removals, container.ID)
+			}
+			srv.Unlock()
+		}()
+		progress := func(removed, total int64) {
+			container.State.Removal = fmt.Sprintf("Removing %v/%v", utils.HumanSize(removed), utils.HumanSize(total))
+		}
+		volumeProgress := func(volumeId string) {
+			container.State.Removal = fmt.Sprintf("Removing volume %s", utils.TruncateID(volumeId))
+		}
+		if err := srv.destroyContainer(container, name, removeVolume, progress, volumeProgress, cancel); err != nil {
+			container.State.Removal = ""
+			utils.Errorf("%s", err)
+		}
+	}()
+	return nil
+}
+
+// ContainerDestroyCancel stops the removal of the container started by
+// ContainerDestroyAsync. The container is left dead, removing it again
+// completes the removal.
+func (srv *Server) ContainerDestroyCancel(name string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	srv.Lock()
+	cancel, exists := srv.removals[container.ID]
+	delete(srv.removals, container.ID)
+	srv.Unlock()
+	if !exists {
+		return fmt.Errorf("No such removal: the container %s is not being removed", name)
+	}
+	close(cancel)
+	return nil
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRemoveTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-removal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "rw")
+	for _, name := range []string{"a/b/c", "a/d", "e"} {
+		if err := os.MkdirAll(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name, "file"), make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cancelled, the removal leaves the files
+	cancel := make(chan bool)
+	close(cancel)
+	if err := removeTree(dir, nil, cancel); err != errRemovalCancelled {
+		t.Fatalf("Expected the removal to be cancelled, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "a/b/c/file")); err != nil {
+		t.Fatal(err)
+	}
+
+	var last, total int64
+	calls := 0
+	if err := removeTree(dir, func(removed, size int64) {
+		if removed < last {
+			t.Errorf("Expected the removed size to grow, got %d after %d", removed, last)
+		}
+		last, total = removed, size
+		calls++
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed: %v", dir, err)
+	}
+	if calls == 0 || last != total || total < 3000 {
+		t.Fatalf("Expected the progress up to the total size, got %d/%d in %d calls", last, total, calls)
+	}
+
+	// Nothing to remove
+	if err := removeTree(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateRemoval(t *testing.T) {
+	state := &State{Dead: true, Removal: "Removing 512 MB/1.2 GB"}
+	if s := state.String(); s != "Removing 512 MB/1.2 GB" {
+		t.Errorf("Expected the progress of the removal, got %s", s)
+	}
+	if s := state.summary().String(); s != "Removing 512 MB/1.2 GB" {
+		t.Errorf("Expected the summary to keep the progress of the removal, got %s", s)
+	}
+	state.Removal = ""
+	if s := state.String(); s != "Dead" {
+		t.Errorf("Expected Dead once the removal ended, got %s", s)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"container/list"
 	"database/sql"
 	"fmt"
+	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/gograph"
 	"github.com/dotcloud/docker/utils"
 	"io"
@@ -15,6 +16,8 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -25,6 +28,8 @@ type Capabilities struct {
 	SwapLimit              bool
 	IPv4ForwardingDisabled bool
 	AppArmor               bool
+	AppArmorDefaultProfile bool
+	SELinux                bool
 }
 
 type Runtime struct {
@@ -39,15 +44,44 @@ type Runtime struct {
 	srv            *Server
 	config         *DaemonConfig
 	containerGraph *gograph.Database
+	// The summaries of the containers listed by docker ps
+	index *containerIndex
+	// The hostname of the containers created without one, nil for their
+	// short id
+	hostnameTemplate *template.Template
+	mcsLevels        *mcsAllocator
+	// The storage driver of the new containers
+	driver string
+	// The storage drivers set up, by name
+	drivers     map[string]StorageDriver
+	driversLock sync.Mutex
+	// Held for reading while a container is created from an image, and
+	// for writing while the garbage collector removes the images no
+	// container uses, for an image not to go under a new container
+	imagesLock sync.RWMutex
 }
 
 // List returns an array of all containers registered in the runtime.
 func (runtime *Runtime) List() []*Container {
-	containers := new(History)
+	containers := make(History, 0, runtime.containers.Len())
 	for e := runtime.containers.Front(); e != nil; e = e.Next() {
-		containers.Add(e.Value.(*Container))
+		containers = append(containers, e.Value.(*Container))
 	}
-	return *containers
+	// Sort once rather than on every insertion: listing is on the hot
+	// path of `docker ps` and there can be thousands of containers.
+	sort.Sort(&containers)
+	return containers
+}
+
+// containerNames walks the name graph once and returns every name
+// registered for each container, indexed by container ID.
+func (runtime *Runtime) containerNames() map[string][]string {
+	names := make(map[string][]string)
+	runtime.containerGraph.Walk("/", func(p string, e *gograph.Entity) error {
+		names[e.ID()] = append(names[e.ID()], p)
+		return nil
+	}, -1)
+	return names
 }
 
 func (runtime *Runtime) getContainerElement(id string) *list.Element {
@@ -79,6 +113,20 @@ func (runtime *Runtime) Get(name string) *Container {
 	return e.Value.(*Container)
 }
 
+// getByHostname returns the running container with the hostname host,
+// fully qualified or not, or nil
+func (runtime *Runtime) getByHostname(host string) *Container {
+	for _, container := range runtime.List() {
+		if !container.State.Running {
+			continue
+		}
+		if container.Config.Hostname == host || container.Config.Hostname+"."+container.Config.Domainname == host {
+			return container
+		}
+	}
+	return nil
+}
+
 // Exists returns a true if a container of the specified ID or name exists,
 // false otherwise.
 func (runtime *Runtime) Exists(id string) bool {
@@ -107,6 +155,13 @@ func (runtime *Runtime) load(id string) (*Container, error) {
 
 // Register makes a container object usable by the runtime as <container.ID>
 func (runtime *Runtime) Register(container *Container) error {
+	return runtime.register(container, nil)
+}
+
+// register makes the container usable by the runtime. The containers to
+// restart are appended to restarts when it isn't nil, to be started in the
+// order of their priorities, and are started right away otherwise.
+func (runtime *Runtime) register(container *Container, restarts *[]*Container) error {
 	if container.runtime != nil || runtime.Exists(container.ID) {
 		return fmt.Errorf("Container is already loaded")
 	}
@@ -117,6 +172,10 @@ func (runtime *Runtime) Register(container *Container) error {
 		return err
 	}
 
+	if level := contextLevel(container.ProcessLabel); level != "" {
+		runtime.mcsLevels.reserve(level)
+	}
+
 	// init the wait lock
 	container.waitLock = make(chan struct{})
 
@@ -134,6 +193,8 @@ func (runtime *Runtime) Register(container *Container) error {
 	// done
 	runtime.containers.PushBack(container)
 	runtime.idIndex.Add(container.ID)
+	runtime.index.update(container)
+	runtime.index.namesChanged()
 
 	// When we actually restart, Start() do the monitoring.
 	// However, when we simply 'reattach', we have to restart a monitor
@@ -153,10 +214,14 @@ func (runtime *Runtime) Register(container *Container) error {
 				utils.Debugf("Restarting")
 				container.State.Ghost = false
 				container.State.setStopped(0)
-				if err := container.Start(); err != nil {
-					return err
+				if restarts != nil {
+					*restarts = append(*restarts, container)
+				} else {
+					if err := container.Start(); err != nil {
+						return err
+					}
+					nomonitor = true
 				}
-				nomonitor = true
 			} else {
 				utils.Debugf("Marking as stopped")
 				container.State.setStopped(-127)
@@ -167,11 +232,27 @@ func (runtime *Runtime) Register(container *Container) error {
 		}
 	}
 
+	// Containers stopped by the daemon exiting come back with it
+	if !container.State.Running && container.State.StoppedOnShutdown && runtime.config.AutoRestart {
+		utils.Debugf("Restarting container %s stopped on shutdown", container.ID)
+		if restarts != nil {
+			*restarts = append(*restarts, container)
+		} else {
+			if err := container.Start(); err != nil {
+				return err
+			}
+			nomonitor = true
+		}
+	}
+
 	// If the container is not running or just has been flagged not running
 	// then close the wait lock chan (will be reset upon start)
 	if !container.State.Running {
 		close(container.waitLock)
 	} else if !nomonitor {
+		container.watchOOM()
+		container.watchPids()
+		container.resumeHealthMonitor()
 		go container.monitor()
 	}
 	return nil
@@ -208,6 +289,14 @@ func (runtime *Runtime) LogToDisk(src *utils.WriteBroadcaster, dst, stream strin
 
 // Destroy unregisters a container from the runtime and cleanly removes its contents from the filesystem.
 func (runtime *Runtime) Destroy(container *Container) error {
+	return runtime.destroy(container, nil, nil)
+}
+
+// destroy removes the container, calling progress, if not nil, as the files
+// of its rw layer are removed. Once cancel is closed or sends a value, the
+// removal stops, leaving the container dead: it can't start anymore, and
+// removing it again completes its removal.
+func (runtime *Runtime) destroy(container *Container, progress func(removed, total int64), cancel <-chan bool) error {
 	if container == nil {
 		return fmt.Errorf("The given container is <nil>")
 	}
@@ -229,13 +318,38 @@ func (runtime *Runtime) Destroy(container *Container) error {
 		}
 	}
 
+	// From now on the container can't be mounted again
+	if !container.State.Dead {
+		container.State.Dead = true
+		if err := container.ToDisk(); err != nil {
+			return err
+		}
+	}
+	driver, err := container.storageDriver()
+	if err != nil {
+		return err
+	}
+	if err := driver.Remove(container); err != nil {
+		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.ID, err)
+	}
+	if err := removeTree(container.rwPath(), progress, cancel); err == errRemovalCancelled {
+		return fmt.Errorf("Removal of container %s cancelled, remove it again to complete it", container.ID)
+	} else if err != nil {
+		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.ID, err)
+	}
+
 	if _, err := runtime.containerGraph.Purge(container.ID); err != nil {
 		utils.Debugf("Unable to remove container from link graph: %s", err)
 	}
 
+	if level := contextLevel(container.ProcessLabel); level != "" {
+		runtime.mcsLevels.release(level)
+	}
+
 	// Deregister the container before removing its directory, to avoid race conditions
 	runtime.idIndex.Delete(container.ID)
 	runtime.containers.Remove(element)
+	runtime.index.remove(container.ID)
 	if err := os.RemoveAll(container.root); err != nil {
 		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.ID, err)
 	}
@@ -267,8 +381,9 @@ func (runtime *Runtime) restore() error {
 		containers[container.ID] = container
 	}
 
+	var restarts []*Container
 	register := func(container *Container) {
-		if err := runtime.Register(container); err != nil {
+		if err := runtime.register(container, &restarts); err != nil {
 			utils.Debugf("Failed to register container %s: %s", container.ID, err)
 		}
 	}
@@ -297,6 +412,21 @@ func (runtime *Runtime) restore() error {
 		register(container)
 	}
 
+	// The network of the containers in standby was lost with the daemon
+	for _, container := range runtime.List() {
+		if container.State.Standby && !container.State.Running {
+			container.State.Standby = false
+			if err := container.Standby(); err != nil {
+				utils.Errorf("Failed to put container %s back in standby: %s", container.ID, err)
+			}
+		}
+	}
+
+	// The containers with the highest priority come back first, after the
+	// containers they depend on
+	sort.Stable(byPriority(restarts))
+	runtime.startInOrder(restarts, time.Duration(runtime.config.DependencyTimeout)*time.Second)
+
 	if os.Getenv("DEBUG") == "" && os.Getenv("TEST") == "" {
 		fmt.Printf("\bdone.\n")
 	}
@@ -339,15 +469,20 @@ func (runtime *Runtime) UpdateCapabilities(quiet bool) {
 		utils.Debugf("/sys/kernel/security/apparmor found; assuming AppArmor is enabled.")
 		runtime.capabilities.AppArmor = true
 	}
+
+	runtime.capabilities.SELinux = selinuxEnabled()
 }
 
 // Create creates a new container from the given configuration with a given name.
 func (runtime *Runtime) Create(config *Config, name string) (*Container, []string, error) {
+	runtime.imagesLock.RLock()
+	defer runtime.imagesLock.RUnlock()
 	// Lookup image
 	img, err := runtime.repositories.LookupImage(config.Image)
 	if err != nil {
 		return nil, nil, err
 	}
+	_, config.ImageDigest = utils.ParseRepositoryDigest(config.Image)
 
 	checkDeprecatedExpose := func(config *Config) bool {
 		if config != nil {
@@ -379,6 +514,14 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 		return nil, nil, fmt.Errorf("No command specified")
 	}
 
+	// Accept a fully qualified hostname, as the -h flag does
+	if parts := strings.SplitN(config.Hostname, ".", 2); len(parts) > 1 && config.Domainname == "" {
+		config.Hostname, config.Domainname = parts[0], parts[1]
+	}
+	if err := validateHostname(config.Hostname, config.Domainname); err != nil {
+		return nil, nil, err
+	}
+
 	sysInitPath := utils.DockerInitPath()
 	if sysInitPath == "" {
 		return nil, nil, fmt.Errorf("Could not locate dockerinit: This usually means docker was built incorrectly. See http://docs.docker.io/en/latest/contributing/devenvironment for official build instructions.")
@@ -388,8 +531,10 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 	id := GenerateID()
 
 	if name == "" {
-		name, err = generateRandomName(runtime)
-		if err != nil {
+		if testMode() {
+			// The generated names are random
+			name = utils.TruncateID(id)
+		} else if name, err = generateRandomName(runtime); err != nil {
 			name = utils.TruncateID(id)
 		}
 	}
@@ -397,6 +542,18 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 		name = "/" + name
 	}
 
+	// Generate the hostname from the template of the daemon, if any
+	if config.Hostname == "" && runtime.hostnameTemplate != nil {
+		hostname, domainname, err := executeHostnameTemplate(runtime.hostnameTemplate, id, name, config.Image)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Hostname = hostname
+		if config.Domainname == "" {
+			config.Domainname = domainname
+		}
+	}
+
 	// Set the enitity in the graph using the default name specified
 	if _, err := runtime.containerGraph.Set(name, id); err != nil {
 		if strings.HasSuffix(err.Error(), "name are not unique") {
@@ -425,7 +582,7 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 	container := &Container{
 		// FIXME: we should generate the ID here instead of receiving it as an argument
 		ID:              id,
-		Created:         time.Now(),
+		Created:         now(),
 		Path:            entrypoint,
 		Args:            args, //FIXME: de-duplicate from config
 		Config:          config,
@@ -435,6 +592,7 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 		// FIXME: do we need to store this in the container?
 		SysInitPath: sysInitPath,
 		Name:        name,
+		Driver:      runtime.driver,
 	}
 	container.root = runtime.containerRoot(container.ID)
 	// Step 1: create the container directory.
@@ -482,30 +640,10 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 	}
 
 	// Step 3: if hostname, build hostname and hosts files
-	container.HostnamePath = path.Join(container.root, "hostname")
-	ioutil.WriteFile(container.HostnamePath, []byte(container.Config.Hostname+"\n"), 0644)
-
-	hostsContent := []byte(`
-127.0.0.1	localhost
-::1		localhost ip6-localhost ip6-loopback
-fe00::0		ip6-localnet
-ff00::0		ip6-mcastprefix
-ff02::1		ip6-allnodes
-ff02::2		ip6-allrouters
-`)
-
-	container.HostsPath = path.Join(container.root, "hosts")
-
-	if container.Config.Domainname != "" {
-		hostsContent = append([]byte(fmt.Sprintf("::1\t\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)), hostsContent...)
-		hostsContent = append([]byte(fmt.Sprintf("127.0.0.1\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)), hostsContent...)
-	} else {
-		hostsContent = append([]byte(fmt.Sprintf("::1\t\t%s\n", container.Config.Hostname)), hostsContent...)
-		hostsContent = append([]byte(fmt.Sprintf("127.0.0.1\t%s\n", container.Config.Hostname)), hostsContent...)
+	if err := container.buildHostnameAndHostsFiles(); err != nil {
+		return nil, nil, err
 	}
 
-	ioutil.WriteFile(container.HostsPath, hostsContent, 0644)
-
 	// Step 4: register the container
 	if err := runtime.Register(container); err != nil {
 		return nil, nil, err
@@ -514,18 +652,45 @@ ff02::2		ip6-allrouters
 }
 
 // Commit creates a new filesystem image from the current state of a container.
-// The image can optionally be tagged into a repository
-func (runtime *Runtime) Commit(container *Container, repository, tag, comment, author string, config *Config) (*Image, error) {
-	// FIXME: freeze the container before copying it to avoid data corruption?
+// The image can optionally be tagged into a repository. With pause, a running
+// container is frozen until its changes are copied to a temporary archive,
+// so that the image gets consistent files, and runs again while the image
+// is created from the archive.
+func (runtime *Runtime) Commit(container *Container, repository, tag, comment, author string, config *Config, pause bool) (*Image, error) {
 	// FIXME: this shouldn't be in commands.
 	if err := container.EnsureMounted(); err != nil {
 		return nil, err
 	}
 
+	paused := pause && container.State.Running
+	if paused {
+		if err := container.freeze(); err != nil {
+			return nil, err
+		}
+	}
 	rwTar, err := container.ExportRw()
+	if err == nil && paused {
+		// The archive of some drivers is already a copy
+		if _, ok := rwTar.(*archive.TempArchive); !ok {
+			rwTar, err = archive.NewTempArchive(rwTar, container.root)
+		}
+	}
+	if paused {
+		if err := container.unfreeze(); err != nil {
+			utils.Errorf("%s", err)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	// The image keeps the labels of the container, which has the ones of
+	// its image, under the labels of config
+	if len(container.Config.Labels) > 0 {
+		if config == nil {
+			config = &Config{}
+		}
+		config.Labels = mergeLabels(container.Config.Labels, config.Labels)
+	}
 	// Create a new image from the container's base layers + a new layer from container changes
 	img, err := runtime.graph.Create(rwTar, container, comment, author, config)
 	if err != nil {
@@ -588,10 +753,104 @@ func (runtime *Runtime) Children(name string) (map[string]*Container, error) {
 	return children, nil
 }
 
+// networkAliases returns the names under which container is reachable: its
+// hostname, its names and the aliases other containers link it as.
+func (runtime *Runtime) networkAliases(container *Container) []NetworkAlias {
+	aliases := []NetworkAlias{}
+	if container.Config.Hostname != "" {
+		aliases = append(aliases, NetworkAlias{Name: container.Config.Hostname, Kind: AliasHostname})
+	}
+	var names, links []NetworkAlias
+	for _, edge := range runtime.containerGraph.RefPaths(container.ID) {
+		if edge.ParentID == "0" {
+			names = append(names, NetworkAlias{Name: edge.Name, Kind: AliasName})
+			continue
+		}
+		parent := runtime.Get(edge.ParentID)
+		if parent == nil {
+			continue
+		}
+		links = append(links, NetworkAlias{Name: edge.Name, Kind: AliasLink, Container: parent.Name})
+	}
+	byName := func(i, j NetworkAlias) bool {
+		if i.Container != j.Container {
+			return i.Container < j.Container
+		}
+		return i.Name < j.Name
+	}
+	sortNetworkAliases(names, byName)
+	sortNetworkAliases(links, byName)
+	return append(append(aliases, names...), links...)
+}
+
+// Rename changes the name of container. The links of the container hang
+// off its entity in the graph, so they follow it.
+func (runtime *Runtime) Rename(container *Container, newName string) error {
+	newName, err := runtime.getFullName(newName)
+	if err != nil {
+		return fmt.Errorf("Bad parameter name: %s", err)
+	}
+	if newName == "/" || strings.Contains(newName[1:], "/") {
+		return fmt.Errorf("Bad parameter name: %s", newName)
+	}
+	if runtime.containerGraph.Exists(newName) {
+		return fmt.Errorf("Conflict, %s already exists.", newName)
+	}
+
+	oldName := container.Name
+	if err := runtime.containerGraph.Rename(oldName, newName); err != nil {
+		return err
+	}
+	defer runtime.index.namesChanged()
+	container.Name = newName
+	if err := container.ToDisk(); err != nil {
+		container.Name = oldName
+		if err := runtime.containerGraph.Rename(newName, oldName); err != nil {
+			utils.Errorf("Cannot restore the name %s of container %s: %s", oldName, container.ID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// TakeName gives the name of container old to container, in the same step
+// as old is renamed to oldNewName: the name always designates one of them.
+func (runtime *Runtime) TakeName(container, old *Container, oldNewName string) error {
+	oldNewName, err := runtime.getFullName(oldNewName)
+	if err != nil {
+		return fmt.Errorf("Bad parameter name: %s", err)
+	}
+	if strings.Contains(oldNewName[1:], "/") {
+		return fmt.Errorf("Bad parameter name: %s", oldNewName)
+	}
+	if runtime.containerGraph.Exists(oldNewName) {
+		return fmt.Errorf("Conflict, %s already exists.", oldNewName)
+	}
+
+	name, oldName := container.Name, old.Name
+	if err := runtime.containerGraph.RenameAll([][2]string{{oldName, oldNewName}, {name, oldName}}); err != nil {
+		return err
+	}
+	defer runtime.index.namesChanged()
+	old.Name, container.Name = oldNewName, oldName
+	if err = old.ToDisk(); err == nil {
+		if err = container.ToDisk(); err == nil {
+			return nil
+		}
+	}
+	old.Name, container.Name = oldName, name
+	if err := runtime.containerGraph.RenameAll([][2]string{{oldName, name}, {oldNewName, oldName}}); err != nil {
+		utils.Errorf("Cannot restore the names %s and %s: %s", oldName, name, err)
+	}
+	old.ToDisk()
+	return err
+}
+
 func (runtime *Runtime) RegisterLink(parent, child *Container, alias string) error {
 	fullName := path.Join(parent.Name, alias)
 	if !runtime.containerGraph.Exists(fullName) {
 		_, err := runtime.containerGraph.Set(fullName, child.ID)
+		runtime.index.namesChanged()
 		return err
 	}
 	return nil
@@ -604,6 +863,18 @@ func NewRuntime(config *DaemonConfig) (*Runtime, error) {
 		return nil, err
 	}
 	runtime.UpdateCapabilities(false)
+	if runtime.capabilities.AppArmor {
+		if err := installDefaultAppArmorProfile(); err != nil {
+			log.Printf("WARNING: %s, the containers are not confined by default", err)
+		} else {
+			runtime.capabilities.AppArmorDefaultProfile = true
+		}
+	}
+	if config.CoreDir != "" {
+		if err := runtime.installCoreDumpHandler(); err != nil {
+			return nil, err
+		}
+	}
 	return runtime, nil
 }
 
@@ -617,6 +888,27 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 	if err := linkLxcStart(config.Root); err != nil {
 		return nil, err
 	}
+	if config.TestSeed != "" {
+		log.Printf("WARNING: test mode, the ids and times of containers, images and events are not random nor real")
+		enableTestMode(config.TestSeed)
+	}
+	for _, rawUlimit := range config.DefaultUlimits {
+		if _, err := utils.ParseUlimit(rawUlimit); err != nil {
+			return nil, err
+		}
+	}
+	var hostnameTemplate *template.Template
+	if config.HostnameTemplate != "" {
+		tmpl, err := parseHostnameTemplate(config.HostnameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		hostnameTemplate = tmpl
+	}
+	driver, err := chooseStorageDriver(config.StorageDriver, config.Root)
+	if err != nil {
+		return nil, err
+	}
 	g, err := NewGraph(path.Join(config.Root, "graph"))
 	if err != nil {
 		return nil, err
@@ -656,16 +948,33 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 	}
 
 	runtime := &Runtime{
-		repository:     runtimeRepo,
-		containers:     list.New(),
-		networkManager: netManager,
-		graph:          g,
-		repositories:   repositories,
-		idIndex:        utils.NewTruncIndex(),
-		capabilities:   &Capabilities{},
-		volumes:        volumes,
-		config:         config,
-		containerGraph: graph,
+		repository:       runtimeRepo,
+		containers:       list.New(),
+		networkManager:   netManager,
+		graph:            g,
+		repositories:     repositories,
+		idIndex:          utils.NewTruncIndex(),
+		capabilities:     &Capabilities{},
+		volumes:          volumes,
+		config:           config,
+		containerGraph:   graph,
+		index:            newContainerIndex(),
+		hostnameTemplate: hostnameTemplate,
+		mcsLevels:        newMCSAllocator(),
+		driver:           driver,
+		drivers:          make(map[string]StorageDriver),
+	}
+	g.removeImageStorage = runtime.removeImageStorage
+	g.shareLayers = true
+
+	// The images and containers of a driver may outlive its use for the
+	// new containers
+	for _, info := range storageDrivers {
+		if info.name == driver || (info.inUse != nil && info.inUse(config.Root)) {
+			if _, err := runtime.storageDriver(info.name); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if err := runtime.restore(); err != nil {
@@ -674,7 +983,134 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 	return runtime, nil
 }
 
+// storageDriver returns the storage driver name, set up the first time. The
+// containers created before the drivers were, without one, use AUFS.
+func (runtime *Runtime) storageDriver(name string) (StorageDriver, error) {
+	if name == "" {
+		name = DriverAUFS
+	}
+	runtime.driversLock.Lock()
+	defer runtime.driversLock.Unlock()
+	if driver, exists := runtime.drivers[name]; exists {
+		return driver, nil
+	}
+	info := lookupStorageDriver(name)
+	if info == nil {
+		return nil, fmt.Errorf("No such storage driver: %s", name)
+	}
+	driver, err := info.init(runtime)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up the %s storage driver: %s", name, err)
+	}
+	runtime.drivers[name] = driver
+	return driver, nil
+}
+
+// removeImageStorage frees what the storage drivers set up made of the
+// deleted image id, whose directory is now root
+func (runtime *Runtime) removeImageStorage(id, root string) error {
+	runtime.driversLock.Lock()
+	defer runtime.driversLock.Unlock()
+	for _, driver := range runtime.drivers {
+		if err := driver.RemoveImage(id, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops all the running containers, giving them up to timeout
+// to exit before they are killed. A container is only stopped once all the
+// containers linking to it have been, and independent containers are
+// stopped in parallel.
+func (runtime *Runtime) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, batch := range runtime.shutdownBatches() {
+		seconds := int(deadline.Sub(time.Now()).Seconds())
+		if seconds < 0 {
+			seconds = 0
+		}
+
+		var wg sync.WaitGroup
+		for _, container := range batch {
+			wg.Add(1)
+			go func(container *Container) {
+				defer wg.Done()
+				utils.Debugf("Stopping container %s on shutdown", container.ID)
+				if err := container.Stop(seconds); err != nil {
+					utils.Errorf("Error stopping container %s on shutdown: %s", container.ID, err)
+					return
+				}
+				container.State.StoppedOnShutdown = true
+				if err := container.ToDisk(); err != nil {
+					utils.Errorf("Error saving container %s: %s", container.ID, err)
+				}
+			}(container)
+		}
+		wg.Wait()
+	}
+}
+
+// shutdownBatches groups the running containers in batches which can be
+// stopped in parallel: a container comes after every container linking to it.
+func (runtime *Runtime) shutdownBatches() [][]*Container {
+	running := make(map[string]*Container)
+	for _, container := range runtime.List() {
+		if container.State.Running {
+			running[container.ID] = container
+		}
+	}
+
+	// dependencies[id] lists the running containers linked by id
+	dependencies := make(map[string][]string)
+	for id, container := range running {
+		children, err := runtime.Children(container.Name)
+		if err != nil {
+			utils.Errorf("Error getting the links of container %s: %s", id, err)
+			continue
+		}
+		for _, child := range children {
+			if _, exists := running[child.ID]; exists && child.ID != id {
+				dependencies[id] = append(dependencies[id], child.ID)
+			}
+		}
+	}
+
+	var batches [][]*Container
+	for len(running) > 0 {
+		linked := make(map[string]bool)
+		for id := range running {
+			for _, child := range dependencies[id] {
+				linked[child] = true
+			}
+		}
+
+		var batch []*Container
+		for id, container := range running {
+			if !linked[id] {
+				batch = append(batch, container)
+			}
+		}
+		// Links form a cycle: stop everything left at once
+		if len(batch) == 0 {
+			for _, container := range running {
+				batch = append(batch, container)
+			}
+		}
+		for _, container := range batch {
+			delete(running, container.ID)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
 func (runtime *Runtime) Close() error {
+	if runtime.config.CoreDir != "" {
+		if err := runtime.restoreCorePattern(); err != nil {
+			utils.Errorf("Unable to restore the core pattern: %s", err)
+		}
+	}
 	runtime.networkManager.Close()
 	return runtime.containerGraph.Close()
 }
@@ -720,3 +1156,18 @@ func (history *History) Add(container *Container) {
 	*history = append(*history, container)
 	sort.Sort(history)
 }
+
+// byPriority orders containers by decreasing priority
+type byPriority []*Container
+
+func (containers byPriority) Len() int {
+	return len(containers)
+}
+
+func (containers byPriority) Less(i, j int) bool {
+	return containers[i].priority() > containers[j].priority()
+}
+
+func (containers byPriority) Swap(i, j int) {
+	containers[i], containers[j] = containers[j], containers[i]
+}
@@ -6,11 +6,14 @@ import (
 	"github.com/dotcloud/docker/sysinit"
 	"github.com/dotcloud/docker/utils"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -257,7 +260,7 @@ func TestRuntimeCreate(t *testing.T) {
 	}
 	container, _, err = runtime.Create(config, "")
 
-	_, err = runtime.Commit(container, "testrepo", "testtag", "", "", config)
+	_, err = runtime.Commit(container, "testrepo", "testtag", "", "", config, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -642,6 +645,99 @@ func TestReloadContainerLinks(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	child, _ := mkContainer(runtime, []string{"-i", "_", "/bin/cat"}, t)
+	defer runtime.Destroy(child)
+	parent, _ := mkContainer(runtime, []string{"-i", "_", "/bin/cat"}, t)
+	defer runtime.Destroy(parent)
+
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	parent.hostConfig.Links = []string{child.Name + ":child"}
+	if err := runtime.RegisterLink(parent, child, "child"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The linking container must be stopped before the linked one
+	batches := runtime.shutdownBatches()
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches, %d found", len(batches))
+	}
+	if len(batches[0]) != 1 || batches[0][0].ID != parent.ID {
+		t.Fatalf("Expected %s to be stopped first", parent.ID)
+	}
+	if len(batches[1]) != 1 || batches[1][0].ID != child.ID {
+		t.Fatalf("Expected %s to be stopped last", child.ID)
+	}
+
+	runtime.Shutdown(2 * time.Second)
+	for _, container := range []*Container{parent, child} {
+		if container.State.Running {
+			t.Fatalf("Container %s should be stopped", container.ID)
+		}
+		if !container.State.StoppedOnShutdown {
+			t.Fatalf("Container %s should be flagged as stopped on shutdown", container.ID)
+		}
+	}
+}
+
+func TestStartInOrder(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	child, _ := mkContainer(runtime, []string{"-i", "_", "/bin/cat"}, t)
+	defer runtime.Destroy(child)
+	parent, _ := mkContainer(runtime, []string{"-i", "_", "/bin/cat"}, t)
+	defer runtime.Destroy(parent)
+
+	parent.hostConfig.Links = []string{child.Name + ":child"}
+	if err := runtime.RegisterLink(parent, child, "child"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The linked container starts first even though it comes last
+	runtime.startInOrder([]*Container{parent, child}, 10*time.Second)
+	for _, container := range []*Container{parent, child} {
+		if !container.State.Running {
+			t.Fatalf("Container %s should be running", container.ID)
+		}
+	}
+	if !child.State.StartedAt.Before(parent.State.StartedAt) {
+		t.Fatalf("Expected %s to start before %s", child.ID, parent.ID)
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	newContainer := func(name string) *Container {
+		return &Container{ID: name, Name: "/" + name}
+	}
+	web, db, cache, worker := newContainer("web"), newContainer("db"), newContainer("cache"), newContainer("worker")
+	dependencies := map[string][]*Container{
+		"web":   {db, cache},
+		"cache": {worker},
+		// A cycle, broken where it is found
+		"worker": {web},
+	}
+	// In the order of their priorities
+	order := startOrder([]*Container{web, cache, db, worker}, func(container *Container) []*Container {
+		return dependencies[container.ID]
+	})
+	var ids []string
+	for _, container := range order {
+		ids = append(ids, container.ID)
+	}
+	if strings.Join(ids, " ") != "db worker cache web" {
+		t.Fatalf("Expected the order db worker cache web, got %v", ids)
+	}
+}
+
 func TestDefaultContainerName(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -845,3 +941,181 @@ func TestGetFullName(t *testing.T) {
 		t.Fatal("Error should not be nil")
 	}
 }
+
+func TestRenameContainer(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "echo test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webappID, _, err := srv.ContainerCreate(config, "/webapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbID, _, err := srv.ContainerCreate(config, "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webapp := runtime.Get(webappID)
+	if err := runtime.RegisterLink(webapp, runtime.Get(dbID), "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.ContainerRename("webapp", "frontend"); err != nil {
+		t.Fatal(err)
+	}
+	if webapp.Name != "/frontend" {
+		t.Fatalf("Expected name /frontend got %s", webapp.Name)
+	}
+	if c := runtime.Get("frontend"); c == nil || c.ID != webapp.ID {
+		t.Fatalf("The container should be found by its new name")
+	}
+	if c, _ := runtime.GetByName("webapp"); c != nil {
+		t.Fatalf("The old name should not be found anymore")
+	}
+	children, err := runtime.Children("/frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := children["/frontend/db"]; c == nil || c.ID != runtime.Get(dbID).ID {
+		t.Fatalf("The link should follow the renamed container, got %v", children)
+	}
+
+	if err := srv.ContainerRename("frontend", "db"); err == nil || !strings.HasPrefix(err.Error(), "Conflict") {
+		t.Fatalf("Renaming to a used name should conflict, got %v", err)
+	}
+	if err := srv.ContainerRename("frontend", "frontend/db"); err == nil {
+		t.Fatalf("Renaming to a link path should fail")
+	}
+	if err := srv.ContainerRename("nosuchcontainer", "foo"); err == nil {
+		t.Fatalf("Renaming a missing container should fail")
+	}
+}
+
+func TestNetworkAliases(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	config, _, _, err := ParseRun([]string{"-h", "dbhost", GetTestImage(runtime).ID, "echo test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbID, _, err := srv.ContainerCreate(config, "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := runtime.Get(dbID)
+	for _, name := range []string{"/webapp", "/admin"} {
+		config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "echo test"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _, err := srv.ContainerCreate(config, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runtime.RegisterLink(runtime.Get(id), db, "database"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	container, err := srv.ContainerInspect("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NetworkAlias{
+		{Name: "dbhost", Kind: AliasHostname},
+		{Name: "db", Kind: AliasName},
+		{Name: "database", Kind: AliasLink, Container: "/admin"},
+		{Name: "database", Kind: AliasLink, Container: "/webapp"},
+	}
+	aliases := srv.ContainerInspectNetwork(container).Aliases
+	if container.NetworkSettings.Aliases != nil {
+		t.Errorf("Expected the aliases to be left out of the settings of the container, got %v", container.NetworkSettings.Aliases)
+	}
+	if len(aliases) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, aliases)
+	}
+	for i := range expected {
+		if aliases[i] != expected[i] {
+			t.Fatalf("Expected %v got %v", expected, aliases)
+		}
+	}
+}
+
+func TestHostnameAndDomainname(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	container, _, err := runtime.Create(&Config{
+		Image:      GetTestImage(runtime).ID,
+		Cmd:        []string{"cat", "/etc/hosts"},
+		Hostname:   "db",
+		Domainname: "example.com",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	hostname, err := ioutil.ReadFile(container.HostnamePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hostname) != "db\n" {
+		t.Fatalf("Expected the hostname db, got %s", hostname)
+	}
+
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "127.0.0.1\tdb.example.com db\n") {
+		t.Fatalf("Expected the hostname to resolve to the loopback, got %s", output)
+	}
+	// The loopback and the ip of the container
+	if matches := regexp.MustCompile(`(?m)^[0-9.]+\tdb\.example\.com db$`).FindAll(output, -1); len(matches) != 2 {
+		t.Fatalf("Expected the hostname to resolve to the ip of the container, got %s", output)
+	}
+
+	// The fully qualified hostname is split as with -h
+	container2, _, err := runtime.Create(&Config{
+		Image:    GetTestImage(runtime).ID,
+		Cmd:      []string{"true"},
+		Hostname: "web.example.com",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container2)
+	if container2.Config.Hostname != "web" || container2.Config.Domainname != "example.com" {
+		t.Fatalf("Expected web and example.com, got %s and %s", container2.Config.Hostname, container2.Config.Domainname)
+	}
+
+	if _, _, err := runtime.Create(&Config{
+		Image:    GetTestImage(runtime).ID,
+		Cmd:      []string{"true"},
+		Hostname: "under_score",
+	}, ""); err == nil {
+		t.Fatal("Expected an invalid hostname to be refused")
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	containers := []*Container{
+		{ID: "low", hostConfig: &HostConfig{Priority: -1}},
+		{ID: "default1", hostConfig: &HostConfig{}},
+		{ID: "high", hostConfig: &HostConfig{Priority: 10}},
+		{ID: "default2"},
+	}
+	sort.Stable(byPriority(containers))
+	for i, expected := range []string{"high", "default1", "default2", "low"} {
+		if containers[i].ID != expected {
+			t.Fatalf("Expected %s at position %d, got %s", expected, i, containers[i].ID)
+		}
+	}
+}
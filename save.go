@@ -0,0 +1,236 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// The archives of docker save hold each image saved and each of their
+// ancestors once, as ID/VERSION, ID/json and ID/layer.tar, and the tags
+// saved in repositories, {"repo": {"tag": "id"}}, like the repositories
+// file of the daemon. The layers the images share are then stored once.
+const saveArchiveVersion = "1.0"
+
+// ImageSave writes to out the archive of the images names, each an image
+// id, a repository, for all its tags, or a repository:tag, with their
+// layers compressed with encoding
+func (srv *Server) ImageSave(names []string, out io.Writer, encoding archive.Encoding) error {
+	if len(names) == 0 {
+		return fmt.Errorf("Bad parameter names: no image to save")
+	}
+	tmp, err := srv.runtime.graph.Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return err
+	}
+
+	repositories := make(map[string]Repository)
+	saved := make(map[string]bool)
+	for _, name := range names {
+		var images []*Image
+		if repository, err := srv.runtime.repositories.Get(name); err != nil {
+			return err
+		} else if repository != nil {
+			for tag, id := range repository {
+				img, err := srv.runtime.graph.Get(id)
+				if err != nil {
+					return err
+				}
+				addSavedTag(repositories, name, tag, id)
+				images = append(images, img)
+			}
+		} else {
+			img, err := srv.runtime.repositories.LookupImage(name)
+			if err != nil {
+				return fmt.Errorf("No such image: %s", name)
+			}
+			if repoName, tag := utils.ParseRepositoryTag(name); tag != "" {
+				addSavedTag(repositories, repoName, tag, img.ID)
+			}
+			images = append(images, img)
+		}
+		for _, img := range images {
+			if err := img.WalkHistory(func(img *Image) error {
+				if saved[img.ID] {
+					return nil
+				}
+				saved[img.ID] = true
+				return saveImage(img, path.Join(tmp, img.ID), encoding)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(repositories) > 0 {
+		data, err := json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(tmp, "repositories"), data, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := archive.Tar(tmp, archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, data); err != nil {
+		return err
+	}
+	for _, name := range names {
+		srv.LogEvent("save", name, "")
+	}
+	return nil
+}
+
+func addSavedTag(repositories map[string]Repository, repoName, tag, id string) {
+	if repositories[repoName] == nil {
+		repositories[repoName] = make(Repository)
+	}
+	repositories[repoName][tag] = id
+}
+
+// saveImage writes the files of img in the archive of docker save to dir.
+// The layer keeps its name, layer.tar, whatever its compression, which
+// ImageLoad detects.
+func saveImage(img *Image, dir string, encoding archive.Encoding) error {
+	root, err := img.root()
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "VERSION"), []byte(saveArchiveVersion), 0644); err != nil {
+		return err
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(root))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "json"), jsonData, 0644); err != nil {
+		return err
+	}
+	layer, err := img.TarLayer(archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	if layer, err = archive.CompressStream(layer, encoding); err != nil {
+		return err
+	}
+	f, err := os.Create(path.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, layer)
+	return err
+}
+
+// ImageLoad loads the images and the tags in the archive of docker save in,
+// the images already there being skipped
+func (srv *Server) ImageLoad(in io.Reader, out io.Writer, sf *utils.StreamFormatter) error {
+	tmp, err := srv.runtime.graph.Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return err
+	}
+	if err := archive.Untar(in, tmp); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			if err := srv.loadImage(tmp, f.Name(), make(map[string]bool), out, sf); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tmp, "repositories"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	repositories := make(map[string]Repository)
+	if err := json.Unmarshal(data, &repositories); err != nil {
+		return fmt.Errorf("Invalid repositories in the archive: %s", err)
+	}
+	for repoName, repository := range repositories {
+		for tag, id := range repository {
+			if err := srv.runtime.repositories.Set(repoName, tag, id, true); err != nil {
+				return err
+			}
+			out.Write(sf.FormatStatus("", "Tagged %s as %s:%s", utils.TruncateID(id), repoName, tag))
+		}
+	}
+	return nil
+}
+
+// loadImage registers the image id of the archive unpacked in dir, after
+// its parent. children are the images being loaded which descend from id,
+// an image can't descend from itself.
+func (srv *Server) loadImage(dir, id string, children map[string]bool, out io.Writer, sf *utils.StreamFormatter) error {
+	if srv.runtime.graph.Exists(id) {
+		return nil
+	}
+	if children[id] {
+		return fmt.Errorf("Invalid image %s in the archive: it is its own ancestor", id)
+	}
+	children[id] = true
+	jsonData, err := ioutil.ReadFile(path.Join(dir, id, "json"))
+	if err != nil {
+		return fmt.Errorf("Invalid image %s in the archive: %s", id, err)
+	}
+	img, err := NewImgJSON(jsonData)
+	if err != nil {
+		return fmt.Errorf("Invalid image %s in the archive: %s", id, err)
+	}
+	if img.ID != id {
+		return fmt.Errorf("Invalid image %s in the archive: its json is the one of %s", id, img.ID)
+	}
+	if img.Parent != "" {
+		if err := ValidateID(img.Parent); err != nil {
+			return fmt.Errorf("Invalid image %s in the archive: %s", id, err)
+		}
+		if err := srv.loadImage(dir, img.Parent, children, out, sf); err != nil {
+			return err
+		}
+	}
+	// The layers of the images already loaded are shared
+	if shared, err := srv.runtime.graph.RegisterSharedLayer(jsonData, img); err != nil {
+		return err
+	} else if shared {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Layer already loaded", "skipping"))
+		return nil
+	}
+	layer, err := os.Open(path.Join(dir, id, "layer.tar"))
+	if err != nil {
+		return fmt.Errorf("Invalid image %s in the archive: %s", id, err)
+	}
+	defer layer.Close()
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Loading", "fs layer"))
+	if err := srv.runtime.graph.Register(jsonData, layer, img); err != nil {
+		return err
+	}
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Load", "complete"))
+	return nil
+}
@@ -0,0 +1,195 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"container/list"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempSaveServer(t *testing.T) *Server {
+	graph := tempGraph(t)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{runtime: &Runtime{graph: graph, repositories: store, containers: list.New()}}
+}
+
+func TestImageSaveLoad(t *testing.T) {
+	src := tempSaveServer(t)
+	defer os.RemoveAll(src.runtime.graph.Root)
+	base, err := src.runtime.graph.Create(testArchive(t), nil, "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var children []*Image
+	for _, comment := range []string{"first", "second"} {
+		child := &Image{Parent: base.ID, Comment: comment, Created: time.Now()}
+		if err := src.runtime.graph.Register(nil, testArchive(t), child); err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, child)
+	}
+	if err := src.runtime.repositories.Set("app", "first", children[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.runtime.repositories.Set("app", "second", children[1].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.runtime.repositories.Set("base", "latest", base.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := src.ImageSave([]string{"app", base.ID}, buf, archive.DefaultSaveEncoding); err != nil {
+		t.Fatal(err)
+	}
+	layers := 0
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(hdr.Name, "/layer.tar") {
+			layers++
+		}
+	}
+	if layers != 3 {
+		t.Fatalf("Expected the layer shared by the images to be saved once, 3 layers in all, got %d", layers)
+	}
+
+	dst := tempSaveServer(t)
+	defer os.RemoveAll(dst.runtime.graph.Root)
+	for i := 0; i < 2; i++ {
+		// Loading again skips the images already there
+		if err := dst.ImageLoad(bytes.NewReader(buf.Bytes()), new(bytes.Buffer), utils.NewStreamFormatter(true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, img := range append(children, base) {
+		if !dst.runtime.graph.Exists(img.ID) {
+			t.Fatalf("Expected image %s to be loaded", img.ID)
+		}
+	}
+	for tag, child := range map[string]*Image{"first": children[0], "second": children[1]} {
+		img, err := dst.runtime.repositories.GetImage("app", tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img == nil || img.ID != child.ID {
+			t.Fatalf("Expected app:%s to be loaded as %s, got %v", tag, child.ID, img)
+		}
+	}
+	// Saved by its id, the base image isn't tagged
+	if repository, _ := dst.runtime.repositories.Get("base"); repository != nil {
+		t.Fatalf("Expected no base repository, got %v", repository)
+	}
+
+	if err := src.ImageSave([]string{"nothing"}, new(bytes.Buffer), archive.DefaultSaveEncoding); err == nil {
+		t.Fatal("Saving an image which doesn't exist should fail")
+	}
+}
+
+func TestImageSaveLoadCompressed(t *testing.T) {
+	src := tempSaveServer(t)
+	defer os.RemoveAll(src.runtime.graph.Root)
+	img, err := src.runtime.graph.Create(testArchive(t), nil, "compressed", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"gzip:1", "bzip2", "xz:9"} {
+		encoding, err := archive.ParseEncoding(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := src.ImageSave([]string{img.ID}, buf, encoding); err != nil {
+			t.Fatal(err)
+		}
+		dst := tempSaveServer(t)
+		defer os.RemoveAll(dst.runtime.graph.Root)
+		if err := dst.ImageLoad(buf, new(bytes.Buffer), utils.NewStreamFormatter(true)); err != nil {
+			t.Fatalf("%s: %s", spec, err)
+		}
+		if !dst.runtime.graph.Exists(img.ID) {
+			t.Fatalf("%s: expected image %s to be loaded", spec, img.ID)
+		}
+	}
+}
+
+func TestImageLoadSharedLayer(t *testing.T) {
+	src := tempSaveServer(t)
+	defer os.RemoveAll(src.runtime.graph.Root)
+	img, err := src.runtime.graph.Create(testArchive(t), nil, "app", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := src.ImageSave([]string{img.ID}, buf, archive.DefaultSaveEncoding); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := tempSaveServer(t)
+	defer os.RemoveAll(dst.runtime.graph.Root)
+	dst.runtime.graph.shareLayers = true
+	// Another image of the same files
+	other, err := dst.runtime.graph.Create(testArchive(t), nil, "other", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.LayerDigest != img.LayerDigest {
+		t.Fatalf("Expected the images to have the same layer, got %s and %s", other.LayerDigest, img.LayerDigest)
+	}
+	out := new(bytes.Buffer)
+	if err := dst.ImageLoad(buf, out, utils.NewStreamFormatter(true)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Layer already loaded") {
+		t.Fatalf("Expected the layer not to be unpacked again, got %s", out)
+	}
+	loaded, err := dst.runtime.graph.Get(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.LayerDigest != img.LayerDigest || loaded.Size != img.Size {
+		t.Fatalf("Expected the loaded image to have the layer %s of %d bytes, got %s of %d bytes", img.LayerDigest, img.Size, loaded.LayerDigest, loaded.Size)
+	}
+	root, err := loaded.root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(layerPath(root)); err != nil || target != dst.runtime.graph.sharedLayerPath(img.LayerDigest) {
+		t.Fatalf("Expected the layer to link to the shared one, got %s, %v", target, err)
+	}
+}
+
+func TestImageLoadCycle(t *testing.T) {
+	dst := tempSaveServer(t)
+	defer os.RemoveAll(dst.runtime.graph.Root)
+	first, second := GenerateID(), GenerateID()
+
+	// Two images, each one the parent of the other
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for id, parent := range map[string]string{first: second, second: first} {
+		json := []byte(`{"id":"` + id + `","parent":"` + parent + `"}`)
+		tw.WriteHeader(&tar.Header{Name: id + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: id + "/json", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(json))})
+		tw.Write(json)
+	}
+	tw.Close()
+	if err := dst.ImageLoad(buf, new(bytes.Buffer), utils.NewStreamFormatter(true)); err == nil || !strings.Contains(err.Error(), "its own ancestor") {
+		t.Fatalf("Expected an error for the images which are their own ancestors, got %v", err)
+	}
+}
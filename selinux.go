@@ -0,0 +1,239 @@
+package docker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The SELinux contexts of the processes and the files of the containers,
+// before the MCS level which isolates the containers from each other
+const (
+	selinuxProcessContext = "system_u:system_r:svirt_lxc_net_t"
+	selinuxFileContext    = "system_u:object_r:svirt_sandbox_file_t"
+	mcsCategories         = 1024
+)
+
+// selinuxEnabled reports whether SELinux is enabled on the host
+func selinuxEnabled() bool {
+	for _, path := range []string{"/sys/fs/selinux/enforce", "/selinux/enforce"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mcsAllocator gives each container a distinct MCS level, two categories
+// out of mcsCategories, so that the containers can't access each other's
+// processes and files
+type mcsAllocator struct {
+	sync.Mutex
+	used map[string]bool
+}
+
+func newMCSAllocator() *mcsAllocator {
+	return &mcsAllocator{used: make(map[string]bool)}
+}
+
+func (a *mcsAllocator) allocate() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.used) >= mcsCategories*(mcsCategories-1)/2 {
+		return "", fmt.Errorf("Impossible to allocate an MCS level: all are in use")
+	}
+	for {
+		var random [4]byte
+		if _, err := io.ReadFull(idEntropy, random[:]); err != nil {
+			return "", err
+		}
+		c1 := int(binary.BigEndian.Uint16(random[:2])) % mcsCategories
+		c2 := int(binary.BigEndian.Uint16(random[2:])) % mcsCategories
+		if c1 == c2 {
+			continue
+		}
+		if c1 > c2 {
+			c1, c2 = c2, c1
+		}
+		level := fmt.Sprintf("s0:c%d,c%d", c1, c2)
+		if !a.used[level] {
+			a.used[level] = true
+			return level, nil
+		}
+	}
+}
+
+// reserve marks the level of a container loaded from disk as used
+func (a *mcsAllocator) reserve(level string) {
+	a.Lock()
+	defer a.Unlock()
+	a.used[level] = true
+}
+
+func (a *mcsAllocator) release(level string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.used, level)
+}
+
+// contextLevel returns the level of the SELinux context, after its user,
+// role and type
+func contextLevel(context string) string {
+	if parts := strings.SplitN(context, ":", 4); len(parts) == 4 {
+		return parts[3]
+	}
+	return ""
+}
+
+// selinuxLabels returns the process and the file contexts given by the
+// label options of -security-opt, starting from the defaults at level.
+// "disable" turns the labeling off, and "user:", "role:", "type:" and
+// "level:" override a part of the process context, the level also applying
+// to the files.
+func selinuxLabels(opts []string, level string) (string, string, error) {
+	process := strings.Split(selinuxProcessContext+":"+level, ":")
+	file := strings.Split(selinuxFileContext+":"+level, ":")
+	for _, opt := range opts {
+		if opt == "disable" {
+			return "", "", nil
+		}
+		parts := strings.SplitN(opt, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", "", fmt.Errorf("Bad parameter security-opt: label=%s", opt)
+		}
+		switch parts[0] {
+		case "user":
+			process[0] = parts[1]
+		case "role":
+			process[1] = parts[1]
+		case "type":
+			process[2] = parts[1]
+		case "level":
+			process = append(process[:3], parts[1])
+			file = append(file[:3], parts[1])
+		default:
+			return "", "", fmt.Errorf("Bad parameter security-opt: label=%s", opt)
+		}
+	}
+	return strings.Join(process, ":"), strings.Join(file, ":"), nil
+}
+
+// setupSELinuxLabels sets the process and the mount labels of the container
+// before it starts, keeping its MCS level across restarts. It returns
+// whether the mount label changed.
+func (container *Container) setupSELinuxLabels() (bool, error) {
+	opts, err := parseSecurityOpts(container.hostConfig.SecurityOpt)
+	if err != nil {
+		return false, err
+	}
+	if !container.runtime.capabilities.SELinux {
+		if len(opts["label"]) > 0 {
+			return false, fmt.Errorf("Impossible to label the container: SELinux is not enabled on this host")
+		}
+		return false, nil
+	}
+
+	allocator := container.runtime.mcsLevels
+	level := contextLevel(container.ProcessLabel)
+	allocated := false
+	if level == "" {
+		if level, err = allocator.allocate(); err != nil {
+			return false, err
+		}
+		allocated = true
+	}
+	processLabel, mountLabel, err := selinuxLabels(opts["label"], level)
+	if err != nil {
+		if allocated {
+			allocator.release(level)
+		}
+		return false, err
+	}
+	if previous := contextLevel(container.ProcessLabel); previous != "" && previous != contextLevel(processLabel) {
+		allocator.release(previous)
+	}
+	if allocated && contextLevel(processLabel) != level {
+		// Overridden by a level option
+		allocator.release(level)
+	}
+	changed := mountLabel != container.MountLabel
+	container.ProcessLabel, container.MountLabel = processLabel, mountLabel
+	return changed, nil
+}
+
+// relabel gives the files of the container the bind mounts into it, such as
+// its hosts file, its mount label
+func (container *Container) relabel(paths ...string) error {
+	if container.MountLabel == "" {
+		return nil
+	}
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	if output, err := exec.Command("chcon", append([]string{container.MountLabel}, existing...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to label the files of container %s: %s (%s)", container.ID, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// selinuxHostDirs are the directories of the host which a volume can't be
+// relabeled at, the host relying on their labels. The ones ending with /
+// can't have a volume under them either.
+var selinuxHostDirs = []string{"/", "/bin/", "/boot/", "/dev/", "/etc/", "/home", "/lib/", "/lib64/", "/proc/", "/root", "/run", "/sbin/", "/sys/", "/tmp", "/usr/", "/var"}
+
+// sharedLabel returns the label of the files shared by containers, label at
+// the level without categories, which all the containers can access
+func sharedLabel(label string) string {
+	if level := contextLevel(label); level != "" {
+		return strings.TrimSuffix(label, level) + strings.SplitN(level, ":", 2)[0]
+	}
+	return label
+}
+
+// relabelVolumes gives the volumes of the container, the data volumes as
+// well as the directories bind mounted from the host, the label shared by
+// the containers: a volume can be used by several with -volumes-from. The
+// volumes labeled already are skipped.
+func (container *Container) relabelVolumes() error {
+	if container.MountLabel == "" {
+		return nil
+	}
+	label := sharedLabel(container.MountLabel)
+	for volPath, srcPath := range container.Volumes {
+		srcPath = path.Clean(srcPath)
+		for _, dir := range selinuxHostDirs {
+			if srcPath == strings.TrimSuffix(dir, "/") || (dir != "/" && strings.HasSuffix(dir, "/") && strings.HasPrefix(srcPath, dir)) {
+				return fmt.Errorf("Impossible to label volume %s of container %s: %s is a directory of the host, whose label it relies on", volPath, container.ID, srcPath)
+			}
+		}
+		if current, err := fileLabel(srcPath); err == nil && current == label {
+			continue
+		}
+		if output, err := exec.Command("chcon", "-R", label, srcPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("Unable to label volume %s of container %s: %s (%s)", volPath, container.ID, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// fileLabel returns the SELinux label of the file at path
+func fileLabel(path string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path, "security.selinux", buf)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf[:n]), "\x00"), nil
+}
@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestSELinuxLabels(t *testing.T) {
+	process, file, err := selinuxLabels(nil, "s0:c1,c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if process != "system_u:system_r:svirt_lxc_net_t:s0:c1,c2" || file != "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2" {
+		t.Fatalf("Unexpected default labels %s and %s", process, file)
+	}
+
+	process, file, err = selinuxLabels([]string{"type:my_container_t", "level:s0:c100,c200"}, "s0:c1,c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if process != "system_u:system_r:my_container_t:s0:c100,c200" || file != "system_u:object_r:svirt_sandbox_file_t:s0:c100,c200" {
+		t.Fatalf("Unexpected overridden labels %s and %s", process, file)
+	}
+	if level := contextLevel(process); level != "s0:c100,c200" {
+		t.Fatalf("Expected the level s0:c100,c200, got %s", level)
+	}
+
+	if process, file, err = selinuxLabels([]string{"disable"}, "s0:c1,c2"); err != nil || process != "" || file != "" {
+		t.Fatalf("Expected no labels once disabled, got %s and %s (%v)", process, file, err)
+	}
+	for _, invalid := range []string{"type", "type:", "unknown:value"} {
+		if _, _, err := selinuxLabels([]string{invalid}, "s0:c1,c2"); err == nil {
+			t.Errorf("Expected the label option %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestMCSAllocator(t *testing.T) {
+	allocator := newMCSAllocator()
+	allocator.reserve("s0:c1,c2")
+	seen := map[string]bool{"s0:c1,c2": true}
+	for i := 0; i < 100; i++ {
+		level, err := allocator.allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[level] {
+			t.Fatalf("The level %s was allocated twice", level)
+		}
+		seen[level] = true
+	}
+	allocator.release("s0:c1,c2")
+	if allocator.used["s0:c1,c2"] {
+		t.Fatal("Expected s0:c1,c2 to be released")
+	}
+}
+
+func TestRelabelVolumes(t *testing.T) {
+	if label := sharedLabel("system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"); label != "system_u:object_r:svirt_sandbox_file_t:s0" {
+		t.Fatalf("Expected the shared label at s0, got %s", label)
+	}
+
+	for _, src := range []string{"/", "/etc", "/etc/ssl", "/usr/share", "/home", "/var/"} {
+		container := &Container{ID: "volumes", MountLabel: "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2", Volumes: map[string]string{"/data": src}}
+		if err := container.relabelVolumes(); err == nil {
+			t.Errorf("Expected the host directory %s not to be relabeled", src)
+		}
+	}
+	container := &Container{ID: "volumes", Volumes: map[string]string{"/data": "/etc"}}
+	if err := container.relabelVolumes(); err != nil {
+		t.Errorf("Expected nothing to be relabeled without mount label, got %s", err)
+	}
+}
@@ -2,19 +2,22 @@ package docker
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/engine"
-	"github.com/dotcloud/docker/gograph"
+	"github.com/dotcloud/docker/plugins"
 	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/utils"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
@@ -28,7 +31,14 @@ import (
 	"time"
 )
 
+// pluginsHealthInterval is how often the daemon checks that the active
+// plugins still answer
+const pluginsHealthInterval = 30 * time.Second
+
 func (srv *Server) Close() error {
+	if srv.runtime.config.StopContainers {
+		srv.runtime.Shutdown(time.Duration(srv.runtime.config.ShutdownTimeout) * time.Second)
+	}
 	return srv.runtime.Close()
 }
 
@@ -37,7 +47,11 @@ func init() {
 }
 
 func JobServeApi(job *engine.Job) string {
-	srv, err := NewServer(ConfigFromJob(job))
+	config := ConfigFromJob(job)
+	if err := config.Validate(); err != nil {
+		return err.Error()
+	}
+	srv, err := NewServer(config)
 	if err != nil {
 		return err.Error()
 	}
@@ -67,12 +81,39 @@ func (srv *Server) Daemon() error {
 		os.Exit(0)
 	}()
 
+	if srv.runtime.config.GatewayAddr != "" {
+		gateway, err := NewGateway(srv.runtime.config.GatewayAddr, srv.runtime.config.GatewayAuthFile, srv.resolveContainerIP)
+		if err != nil {
+			return fmt.Errorf("Unable to start the gateway: %s", err)
+		}
+		defer gateway.Close()
+		go gateway.Serve()
+	}
+
+	if srv.runtime.config.EvictMemory > 0 || srv.runtime.config.EvictPressure > 0 {
+		go srv.watchMemoryPressure()
+	}
+
+	if srv.runtime.config.RegistryConfigFile != "" {
+		go srv.watchRegistryConfig()
+	}
+
+	if policy := gcPolicyFromConfig(srv.runtime.config); policy != nil {
+		go srv.watchGarbage(policy)
+	}
+
+	go srv.plugins.Watch(pluginsHealthInterval)
+
 	protoAddrs := srv.runtime.config.ProtoAddresses
 	chErrors := make(chan error, len(protoAddrs))
 	for _, protoAddr := range protoAddrs {
 		protoAddrParts := strings.SplitN(protoAddr, "://", 2)
 		switch protoAddrParts[0] {
 		case "unix":
+			// The socket handed over by the daemon this one was upgraded from
+			if inheritedListener(protoAddr) != nil {
+				break
+			}
 			if err := syscall.Unlink(protoAddrParts[1]); err != nil && !os.IsNotExist(err) {
 				log.Fatal(err)
 			}
@@ -225,7 +266,7 @@ func (srv *Server) ImageInsert(name, url, path string, out io.Writer, sf *utils.
 		return "", err
 	}
 	// FIXME: Handle custom repo, tag comment, author
-	img, err = srv.runtime.Commit(c, "", "", img.Comment, img.Author, nil)
+	img, err = srv.runtime.Commit(c, "", "", img.Comment, img.Author, nil, false)
 	if err != nil {
 		return "", err
 	}
@@ -271,7 +312,10 @@ func (srv *Server) ImagesViz(out io.Writer) error {
 	return nil
 }
 
-func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
+// Images lists the images, the tagged ones in the repositories matching
+// filter, a pattern, if given, and the others too without filter. Only the
+// images with the labels matching all of labels are listed.
+func (srv *Server) Images(all bool, filter string, labels []string) ([]APIImages, error) {
 	var (
 		allImages map[string]*Image
 		err       error
@@ -297,6 +341,10 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 				log.Printf("Warning: couldn't load %s from %s/%s: %s", id, name, tag, err)
 				continue
 			}
+			if !matchLabels(image.labels(), labels) {
+				delete(allImages, id)
+				continue
+			}
 
 			if out, exists := lookup[id]; exists {
 				out.RepoTags = append(out.RepoTags, fmt.Sprintf("%s:%s", name, tag))
@@ -313,6 +361,7 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 				out.Created = image.Created.Unix()
 				out.Size = image.Size
 				out.VirtualSize = image.getParentsSize(0) + image.Size
+				out.Labels = image.labels()
 
 				lookup[id] = out
 			}
@@ -328,6 +377,9 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 	// Display images which aren't part of a repository/tag
 	if filter == "" {
 		for _, image := range allImages {
+			if !matchLabels(image.labels(), labels) {
+				continue
+			}
 			var out APIImages
 			out.ID = image.ID
 			out.ParentId = image.Parent
@@ -335,6 +387,7 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 			out.Created = image.Created.Unix()
 			out.Size = image.Size
 			out.VirtualSize = image.getParentsSize(0) + image.Size
+			out.Labels = image.labels()
 			outs = append(outs, out)
 		}
 	}
@@ -343,6 +396,23 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 	return outs, nil
 }
 
+// Plugins returns the plugins found on the host, as last checked in the
+// background
+func (srv *Server) Plugins() []APIPlugin {
+	outs := []APIPlugin{}
+	for _, p := range srv.plugins.List() {
+		outs = append(outs, APIPlugin{
+			Name:       p.Name,
+			Addr:       p.Addr,
+			Implements: p.Implements,
+			Active:     p.Active,
+			Error:      p.Error,
+			LastCheck:  p.LastCheck,
+		})
+	}
+	return outs
+}
+
 func (srv *Server) DockerInfo() *APIInfo {
 	images, _ := srv.runtime.graph.Map()
 	var imgcount int
@@ -362,6 +432,7 @@ func (srv *Server) DockerInfo() *APIInfo {
 	if kv, err := utils.GetKernelVersion(); err == nil {
 		kernelVersion = kv.String()
 	}
+	registryConfig := srv.RegistryConfig()
 
 	return &APIInfo{
 		Containers:         len(srv.runtime.List()),
@@ -376,6 +447,9 @@ func (srv *Server) DockerInfo() *APIInfo {
 		NEventsListener:    len(srv.events),
 		KernelVersion:      kernelVersion,
 		IndexServerAddress: auth.IndexServerAddress(),
+		Driver:             srv.runtime.driver,
+		RegistryMirrors:    registryConfig.Mirrors,
+		InsecureRegistries: registryConfig.InsecureRegistries,
 	}
 }
 
@@ -397,7 +471,7 @@ func (srv *Server) ImageHistory(name string) ([]APIHistory, error) {
 	}
 
 	outs := []APIHistory{} //produce [] when empty instead of 'null'
-	err = image.WalkHistory(func(img *Image) error {
+	if err := image.WalkHistory(func(img *Image) error {
 		var out APIHistory
 		out.ID = img.ID
 		out.Created = img.Created.Unix()
@@ -406,7 +480,15 @@ func (srv *Server) ImageHistory(name string) ([]APIHistory, error) {
 		out.Size = img.Size
 		outs = append(outs, out)
 		return nil
-	})
+	}); err != nil {
+		return nil, err
+	}
+	// The sizes add up from the oldest image
+	var virtualSize int64
+	for i := len(outs) - 1; i >= 0; i-- {
+		virtualSize += outs[i].Size
+		outs[i].VirtualSize = virtualSize
+	}
 	return outs, nil
 
 }
@@ -455,17 +537,45 @@ func (srv *Server) ContainerChanges(name string) ([]Change, error) {
 	return nil, fmt.Errorf("No such container: %s", name)
 }
 
-func (srv *Server) Containers(all, size bool, n int, since, before string) []APIContainers {
+// ContainerInitConfig returns the systemd unit or upstart job, depending on
+// system, running the container under the init system of the host, with
+// the restart policy restart
+func (srv *Server) ContainerInitConfig(name, system, restart string) (string, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return "", fmt.Errorf("No such container: %s", name)
+	}
+	return srv.runtime.initConfig(container, system, restart)
+}
+
+// ContainerNamespaces returns the namespaces and the cgroups of the running
+// container name
+func (srv *Server) ContainerNamespaces(name string) (*APINamespaces, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	return container.namespaces()
+}
+
+// Containers lists the containers. filters holds the values of the list
+// filters, a container must match them all to be listed: "label" filters
+// are a label key alone or key=value.
+func (srv *Server) Containers(all, size bool, n int, since, before string, filters map[string][]string) []APIContainers {
 	var foundBefore bool
 	var displayed int
 	out := []APIContainers{}
+	summaries, names := srv.runtime.index.list(srv.runtime.containerGraph)
+	// The repositories are walked once per image
+	imageNames := make(map[string]string)
 
-	for _, container := range srv.runtime.List() {
-		if !container.State.Running && !all && n == -1 && since == "" && before == "" {
+	for _, summary := range summaries {
+		if !summary.State.Running && !all && n == -1 && since == "" && before == "" {
 			continue
 		}
+		id := utils.TruncateID(summary.ID)
 		if before != "" {
-			if container.ShortID() == before {
+			if id == before {
 				foundBefore = true
 				continue
 			}
@@ -476,49 +586,126 @@ func (srv *Server) Containers(all, size bool, n int, since, before string) []API
 		if displayed == n {
 			break
 		}
-		if container.ShortID() == since {
+		if id == since {
 			break
 		}
+		if !matchLabels(summary.Labels, filters["label"]) {
+			continue
+		}
 		displayed++
-		c := createAPIContainer(container, size, srv.runtime)
+		if _, exists := imageNames[summary.Image]; !exists {
+			imageNames[summary.Image] = srv.runtime.repositories.ImageName(summary.Image)
+		}
+		c := APIContainers{
+			ID:      summary.ID,
+			Names:   names[summary.ID],
+			Image:   imageNames[summary.Image],
+			Command: summary.Command,
+			Created: summary.Created.Unix(),
+			Status:  summary.State.String(),
+			Ports:   summary.Ports,
+			Labels:  summary.Labels,
+		}
+		if c.Names == nil {
+			c.Names = []string{}
+		}
+		if size {
+			if container := srv.runtime.Get(summary.ID); container != nil {
+				c.SizeRw, c.SizeRootFs = container.GetSize()
+			}
+		}
 		out = append(out, c)
 	}
 	return out
 }
 
-func createAPIContainer(container *Container, size bool, runtime *Runtime) APIContainers {
-	c := APIContainers{
-		ID: container.ID,
-	}
-	names := []string{}
-	runtime.containerGraph.Walk("/", func(p string, e *gograph.Entity) error {
-		if e.ID() == container.ID {
-			names = append(names, p)
+// NetworkContainers lists the interfaces of the running containers on
+// bridge, with the ports published through them
+func (srv *Server) NetworkContainers(bridge string) ([]APINetworkContainer, error) {
+	if bridge != srv.runtime.networkManager.bridgeIface {
+		if _, err := net.InterfaceByName(bridge); err != nil {
+			return nil, fmt.Errorf("No such bridge: %s", bridge)
 		}
-		return nil
-	}, -1)
-	c.Names = names
+	}
 
-	c.Image = runtime.repositories.ImageName(container.Image)
-	c.Command = fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " "))
-	c.Created = container.Created.Unix()
-	c.Status = container.State.String()
-	c.Ports = container.NetworkSettings.PortMappingAPI()
-	if size {
-		c.SizeRw, c.SizeRootFs = container.GetSize()
+	out := []APINetworkContainer{}
+	names := srv.runtime.containerNames()
+	for _, container := range srv.runtime.List() {
+		if !container.State.Running || container.NetworkSettings == nil {
+			continue
+		}
+		interfaces := container.NetworkSettings.Interfaces
+		if len(interfaces) == 0 && container.NetworkSettings.IPAddress != "" {
+			// Started before the interfaces were recorded
+			interfaces = []InterfaceSettings{{
+				Name:        DefaultInterfaceName,
+				Bridge:      container.NetworkSettings.Bridge,
+				IPAddress:   container.NetworkSettings.IPAddress,
+				IPPrefixLen: container.NetworkSettings.IPPrefixLen,
+				HostVeth:    container.NetworkSettings.HostVeth,
+			}}
+		}
+		for i, iface := range interfaces {
+			if iface.Bridge != bridge {
+				continue
+			}
+			c := APINetworkContainer{
+				ID:          container.ID,
+				Names:       names[container.ID],
+				Interface:   iface.Name,
+				IPAddress:   iface.IPAddress,
+				IPPrefixLen: iface.IPPrefixLen,
+				HostVeth:    iface.HostVeth,
+			}
+			// The ports are published through the interface on the
+			// bridge of the daemon
+			if i == 0 {
+				c.Ports = container.NetworkSettings.PortMappingAPI()
+			}
+			out = append(out, c)
+		}
 	}
-	return c
+	return out, nil
 }
-func (srv *Server) ContainerCommit(name, repo, tag, author, comment string, config *Config) (string, error) {
+
+// ContainerCommit commits the changes of the container name. With squash,
+// the new image has a single layer holding the changes and the layers of
+// the image of the container, on top of the base image of its history.
+func (srv *Server) ContainerCommit(name, repo, tag, author, comment string, config *Config, pause, squash bool) (string, error) {
 	container := srv.runtime.Get(name)
 	if container == nil {
 		return "", fmt.Errorf("No such container: %s", name)
 	}
-	img, err := srv.runtime.Commit(container, repo, tag, comment, author, config)
+	if !squash {
+		img, err := srv.runtime.Commit(container, repo, tag, comment, author, config, pause)
+		if err != nil {
+			return "", err
+		}
+		return img.ShortID(), err
+	}
+
+	img, err := srv.runtime.Commit(container, "", "", comment, author, config, pause)
+	if err != nil {
+		return "", err
+	}
+	history, err := img.History()
 	if err != nil {
 		return "", err
 	}
-	return img.ShortID(), err
+	squashed, err := srv.runtime.squashImage(img, history[len(history)-1], comment)
+	// Only the squashed image is kept
+	if err := srv.runtime.graph.Delete(img.ID); err != nil {
+		utils.Errorf("Unable to delete the image %s squashed: %s", img.ID, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	if repo != "" {
+		if err := srv.runtime.repositories.Set(repo, tag, squashed.ID, true); err != nil {
+			return "", err
+		}
+	}
+	return squashed.ShortID(), nil
 }
 
 func (srv *Server) ContainerTag(name, repo, tag string, force bool) error {
@@ -528,58 +715,145 @@ func (srv *Server) ContainerTag(name, repo, tag string, force bool) error {
 	return nil
 }
 
-func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoint string, token []string, sf *utils.StreamFormatter) error {
+// pullImage pulls the image imgID and its ancestors. checksums are the
+// checksums of their layers the index knows, by image id. With keys, the
+// trusted keys of the registry, imgID must be signed with one of them.
+func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoint string, token []string, checksums map[string]string, keys [][]byte, sf *utils.StreamFormatter) error {
+	if keys != nil {
+		out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Verifying", "signature"))
+		if err := srv.pullSignatures(r, imgID, endpoint, token, keys); err != nil {
+			return err
+		}
+	}
 	history, err := r.GetRemoteHistory(imgID, endpoint, token)
 	if err != nil {
 		return err
 	}
 	out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Pulling", "dependend layers"))
 	// FIXME: Try to stream the images?
-	// FIXME: Launch the getRemoteImage() in goroutines
 
-	for _, id := range history {
-
-		// ensure no two downloads of the same layer happen at the same time
-		if err := srv.poolAdd("pull", "layer:"+id); err != nil {
-			utils.Errorf("Image (id: %s) pull is already running, skipping: %v", id, err)
-			return nil
-		}
-		defer srv.poolRemove("pull", "layer:"+id)
-
-		if !srv.runtime.graph.Exists(id) {
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
-			imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				// FIXME: Keep going in case of error?
-				return err
+	// The layers are downloaded at the same time, as many as the download
+	// scheduler allows, but registered in the order of the history, each
+	// image once its parent is. registered[i] is closed once history[i] is
+	// registered or failed to be, errs[i] telling which.
+	var (
+		wg         sync.WaitGroup
+		registered = make([]chan struct{}, len(history))
+		errs       = make([]error, len(history))
+	)
+	for i := range history {
+		registered[i] = make(chan struct{})
+	}
+	for i, id := range history {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer close(registered[i])
+			// The history lists the images from imgID to its base image
+			waitParent := func() error {
+				if i+1 == len(history) {
+					return nil
+				}
+				<-registered[i+1]
+				if errs[i+1] != nil {
+					return fmt.Errorf("Unable to register %s, its parent %s failed to be pulled", utils.TruncateID(id), utils.TruncateID(history[i+1]))
+				}
+				return nil
 			}
-			img, err := NewImgJSON(imgJSON)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				return fmt.Errorf("Failed to parse json: %s", err)
+			// The layer pulled by another pull already is waited for, no
+			// two downloads of the same layer happen at the same time
+			key := "layer:" + id
+			if b, leader := srv.joinPull(key); leader {
+				errs[i] = srv.pullLayer(r, &teeWriter{b, out}, imgID, id, endpoint, token, checksums[id], keys != nil, waitParent, sf)
+				srv.endPull(key, b, errs[i])
+			} else {
+				out.Write(sf.FormatProgress(utils.TruncateID(id), "Waiting", "for the pull of the layer in progress"))
+				errs[i] = b.follow(out)
 			}
+		}(i, id)
+	}
+	wg.Wait()
+	// The error of the base image first, the others follow from it
+	for i := len(errs) - 1; i >= 0; i-- {
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+	return nil
+}
 
-			// Get the layer
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
-			layer, err := r.GetRemoteImageLayer(img.ID, endpoint, token)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				return err
-			}
-			defer layer.Close()
-			if err := srv.runtime.graph.Register(imgJSON, utils.ProgressReader(layer, imgSize, out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false), img); err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "downloading dependend layers"))
-				return err
+// pullLayer downloads and registers the image id, an ancestor of imgID,
+// unless it is there already. With trusted, its content must be described
+// with the digest of its layer, for the signature of imgID to cover it.
+// waitParent is called once the layer is downloaded, and the image is only
+// registered if it returns nil, once the parent of the image is registered.
+func (srv *Server) pullLayer(r *registry.Registry, out io.Writer, imgID, id, endpoint string, token []string, checksum string, trusted bool, waitParent func() error, sf *utils.StreamFormatter) error {
+	if !srv.runtime.graph.Exists(id) {
+		// Get the image, in turn with the other images being pulled
+		ready := srv.downloads.acquire(imgID)
+		select {
+		case <-ready:
+		default:
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Waiting", "for the other downloads"))
+			<-ready
+		}
+		downloading := true
+		defer func() {
+			if downloading {
+				srv.downloads.release()
 			}
+		}()
+
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
+		imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
+		if err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
+			// FIXME: Keep going in case of error?
+			return err
+		}
+		img, err := NewImgJSON(imgJSON)
+		if err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
+			return fmt.Errorf("Failed to parse json: %s", err)
+		}
+		if trusted && img.LayerDigest == "" {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "verifying dependend layers"))
+			return fmt.Errorf("Forbidden, the image %s isn't described with the digest of its layer, its content can't be trusted", utils.TruncateID(id))
 		}
-		out.Write(sf.FormatProgress(utils.TruncateID(id), "Download", "complete"))
 
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
+		layer, err := srv.downloadLayer(r, out, img.ID, endpoint, token, imgSize, sf)
+		if err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "downloading dependend layers"))
+			return err
+		}
+		defer layer.Close()
+		// Complete, the layer doesn't need to be kept anymore
+		defer os.Remove(layer.Name())
+		// The bytes are on disk: the other downloads go on while the layer
+		// is checked, waits for its parent and is extracted
+		downloading = false
+		srv.downloads.release()
+		if err := checkLayer(out, layer, img.ID, imgJSON, checksum, sf); err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "verifying dependend layers"))
+			return err
+		}
+		if err := waitParent(); err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "registering dependend layers"))
+			return err
+		}
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Extracting", "fs layer"))
+		if err := srv.runtime.graph.Register(imgJSON, layer, img); err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "registering dependend layers"))
+			return err
+		}
 	}
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Download", "complete"))
 	return nil
 }
 
 func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName, remoteName, askedTag, indexEp string, sf *utils.StreamFormatter, parallel bool) error {
+	keys := srv.trustedKeys(indexEp)
 	out.Write(sf.FormatStatus("", "Pulling repository %s", localName))
 
 	repoData, err := r.GetRepositoryData(indexEp, remoteName)
@@ -594,6 +868,14 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 		return err
 	}
 
+	// The checksums the index knows, to check the layers with
+	checksums := make(map[string]string)
+	for id, imgData := range repoData.ImgList {
+		if imgData.Checksum != "" {
+			checksums[id] = imgData.Checksum
+		}
+	}
+
 	for tag, id := range tagsList {
 		repoData.ImgList[id] = &registry.ImgData{
 			ID:       id,
@@ -617,6 +899,8 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 		repoData.ImgList[id].Tag = askedTag
 	}
 
+	endpoints, mirrors := srv.pullEndpoints(repoData, indexEp)
+
 	errors := make(chan error)
 	for _, image := range repoData.ImgList {
 		downloadImage := func(img *registry.ImgData) {
@@ -636,22 +920,32 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 				return
 			}
 
-			// ensure no two downloads of the same image happen at the same time
-			if err := srv.poolAdd("pull", "img:"+img.ID); err != nil {
-				utils.Errorf("Image (id: %s) pull is already running, skipping: %v", img.ID, err)
+			// The image pulled by another pull already is followed, no two
+			// downloads of the same image happen at the same time
+			key := "img:" + img.ID
+			b, leader := srv.joinPull(key)
+			if !leader {
+				out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Waiting", "for the pull of the image in progress"))
+				err := b.follow(out)
 				if parallel {
-					errors <- nil
+					errors <- err
 				}
 				return
 			}
-			defer srv.poolRemove("pull", "img:"+img.ID)
+			var pullErr error
+			defer func() { srv.endPull(key, b, pullErr) }()
+			out := &teeWriter{b, out}
 
 			out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Pulling", fmt.Sprintf("image (%s) from %s", img.Tag, localName)))
 			success := false
 			var lastErr error
-			for _, ep := range repoData.Endpoints {
+			for i, ep := range endpoints {
+				token := repoData.Tokens
+				if i < len(mirrors) {
+					token = nil
+				}
 				out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Pulling", fmt.Sprintf("image (%s) from %s, endpoint: %s", img.Tag, localName, ep)))
-				if err := srv.pullImage(r, out, img.ID, ep, repoData.Tokens, sf); err != nil {
+				if err := srv.pullImage(r, out, img.ID, ep, token, checksums, keys, sf); err != nil {
 					// Its not ideal that only the last error  is returned, it would be better to concatenate the errors.
 					// As the error is also given to the output stream the user will see the error.
 					lastErr = err
@@ -663,8 +957,9 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 			}
 			if !success {
 				out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Error pulling", fmt.Sprintf("image (%s) from %s, %s", img.Tag, localName, lastErr)))
+				pullErr = fmt.Errorf("Could not find repository on any of the indexed registries.")
 				if parallel {
-					errors <- fmt.Errorf("Could not find repository on any of the indexed registries.")
+					errors <- pullErr
 					return
 				}
 			}
@@ -708,6 +1003,81 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
+// pullEndpoints returns the endpoints to pull the images of repoData from,
+// and the mirrors among them. The mirrors are tried first for the images of
+// the index, without the tokens of the index.
+func (srv *Server) pullEndpoints(repoData *registry.RepositoryData, indexEp string) ([]string, []string) {
+	endpoints := repoData.Endpoints
+	var mirrors []string
+	if indexEp == auth.IndexServerAddress() {
+		mirrors = srv.RegistryConfig().Mirrors
+		endpoints = append(append([]string(nil), mirrors...), endpoints...)
+	}
+	return endpoints, mirrors
+}
+
+// pullDigest pulls the image of the repository remoteName with digest,
+// whatever its tags, and checks that its id is derived from its content,
+// so that it is the very image pinned
+func (srv *Server) pullDigest(r *registry.Registry, out io.Writer, localName, remoteName, digest, indexEp string, sf *utils.StreamFormatter) error {
+	id, err := digestID(digest)
+	if err != nil {
+		return err
+	}
+	out.Write(sf.FormatStatus("", "Pulling %s@%s", localName, digest))
+
+	if !srv.runtime.graph.Exists(id) {
+		repoData, err := r.GetRepositoryData(indexEp, remoteName)
+		if err != nil {
+			return err
+		}
+		checksums := make(map[string]string)
+		for imgID, imgData := range repoData.ImgList {
+			if imgData.Checksum != "" {
+				checksums[imgID] = imgData.Checksum
+			}
+		}
+		// The image pulled by another pull already is followed, as by
+		// pullRepository
+		key := "img:" + id
+		b, leader := srv.joinPull(key)
+		if leader {
+			err = srv.pullDigestImage(r, &teeWriter{b, out}, localName, digest, id, indexEp, repoData, checksums, sf)
+			srv.endPull(key, b, err)
+		} else {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Waiting", "for the pull of the image in progress"))
+			err = b.follow(out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := srv.runtime.graph.checkContentIDs(id); err != nil {
+		return fmt.Errorf("Impossible to pull %s@%s: %s", localName, digest, err)
+	}
+	out.Write(sf.FormatStatus("", "Digest: %s", digest))
+	return nil
+}
+
+// pullDigestImage pulls the image id from the first endpoint of repoData
+// which has it
+func (srv *Server) pullDigestImage(r *registry.Registry, out io.Writer, localName, digest, id, indexEp string, repoData *registry.RepositoryData, checksums map[string]string, sf *utils.StreamFormatter) error {
+	endpoints, mirrors := srv.pullEndpoints(repoData, indexEp)
+	err := fmt.Errorf("No such image: %s@%s", localName, digest)
+	for i, ep := range endpoints {
+		token := repoData.Tokens
+		if i < len(mirrors) {
+			token = nil
+		}
+		if err = srv.pullImage(r, out, id, ep, token, checksums, srv.trustedKeys(indexEp), sf); err == nil {
+			return nil
+		}
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling", fmt.Sprintf("image from %s, endpoint: %s, %s", localName, ep, err)))
+	}
+	return err
+}
+
 func (srv *Server) poolAdd(kind, key string) error {
 	srv.Lock()
 	defer srv.Unlock()
@@ -746,7 +1116,24 @@ func (srv *Server) poolRemove(kind, key string) error {
 	return nil
 }
 
+// ImagePull pulls the repository localName, or its image tag. The same pull
+// requested while it is in progress doesn't pull again: the request
+// follows the output of the pull in progress, from its start, and gets its
+// result.
 func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, metaHeaders map[string][]string, parallel bool) error {
+	out = utils.NewWriteFlusher(out)
+	key := localName + ":" + tag
+	b, leader := srv.joinPull(key)
+	if !leader {
+		out.Write(sf.FormatStatus("", "Waiting for the pull of %s already in progress", localName))
+		return b.follow(out)
+	}
+	err := srv.imagePull(localName, tag, &teeWriter{b, out}, sf, authConfig, metaHeaders, parallel)
+	srv.endPull(key, b, err)
+	return err
+}
+
+func (srv *Server) imagePull(localName string, tag string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, metaHeaders map[string][]string, parallel bool) error {
 	r, err := registry.NewRegistry(srv.runtime.config.Root, authConfig, srv.HTTPRequestFactory(metaHeaders))
 	if err != nil {
 		return err
@@ -756,11 +1143,19 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	}
 	defer srv.poolRemove("pull", localName+":"+tag)
 
+	localName, digest := utils.ParseRepositoryDigest(localName)
+	if digest != "" && tag != "" {
+		return fmt.Errorf("Bad parameter tag: an image pinned by digest can't be pulled by tag too")
+	}
+
 	// Resolve the Repository name from fqn to endpoint + name
 	endpoint, remoteName, err := registry.ResolveRepositoryName(localName)
 	if err != nil {
 		return err
 	}
+	if err := registry.CheckEndpoint(endpoint); err != nil {
+		return err
+	}
 
 	if endpoint == auth.IndexServerAddress() {
 		// If pull "index.docker.io/foo/bar", it's stored locally under "foo/bar"
@@ -768,12 +1163,15 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	}
 
 	out = utils.NewWriteFlusher(out)
+	if digest != "" {
+		return srv.pullDigest(r, out, localName, remoteName, digest, endpoint, sf)
+	}
 	err = srv.pullRepository(r, out, localName, remoteName, tag, endpoint, sf, parallel)
 	if err == registry.ErrLoginRequired {
 		return err
 	}
 	if err != nil {
-		if err := srv.pullImage(r, out, remoteName, endpoint, nil, sf); err != nil {
+		if err := srv.pullImage(r, out, remoteName, endpoint, nil, nil, srv.trustedKeys(endpoint), sf); err != nil {
 			return err
 		}
 		return nil
@@ -837,7 +1235,7 @@ func flatten(slc [][]*registry.ImgData) []*registry.ImgData {
 	return result
 }
 
-func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName, remoteName string, localRepo map[string]string, indexEp string, sf *utils.StreamFormatter) error {
+func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName, remoteName string, localRepo map[string]string, indexEp string, encoding archive.Encoding, sf *utils.StreamFormatter) error {
 	out = utils.NewWriteFlusher(out)
 	imgList, err := srv.getImageList(localRepo)
 	if err != nil {
@@ -854,6 +1252,13 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 
 	for _, ep := range repoData.Endpoints {
 		out.Write(sf.FormatStatus("", "Pushing repository %s (%d tags)", localName, len(localRepo)))
+		var unknown []string
+		for _, elem := range flattenedImgList {
+			if _, exists := repoData.ImgList[elem.ID]; !exists {
+				unknown = append(unknown, elem.ID)
+			}
+		}
+		remoteImages := srv.lookupRemoteImages(r, ep, unknown, repoData.Tokens)
 		// This section can not be parallelized (each round depends on the previous one)
 		for _, round := range imgList {
 			// FIXME: This section can be parallelized
@@ -866,20 +1271,29 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 					}
 					return nil
 				}
-				if _, exists := repoData.ImgList[elem.ID]; exists {
+				if imgData, exists := repoData.ImgList[elem.ID]; exists {
+					elem.Checksum = imgData.Checksum
 					if err := pushTags(); err != nil {
 						return err
 					}
 					out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", elem.ID))
 					continue
-				} else if r.LookupRemoteImage(elem.ID, ep, repoData.Tokens) {
+				} else if checksum, exists := remoteImages[elem.ID]; exists {
+					// Pushed to another repository: the repository gets
+					// it without uploading it again, given its checksum
+					if checksum == "" {
+						if checksum, err = srv.localChecksum(elem.ID); err != nil {
+							return err
+						}
+					}
+					elem.Checksum = checksum
 					if err := pushTags(); err != nil {
 						return err
 					}
-					out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", elem.ID))
+					out.Write(sf.FormatStatus("", "Image %s already in the registry, mounting it", elem.ID))
 					continue
 				}
-				if checksum, err := srv.pushImage(r, out, remoteName, elem.ID, ep, repoData.Tokens, sf); err != nil {
+				if checksum, err := srv.pushImage(r, out, remoteName, elem.ID, ep, repoData.Tokens, encoding, sf); err != nil {
 					// FIXME: Continue on error?
 					return err
 				} else {
@@ -899,7 +1313,7 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
-func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID, ep string, token []string, sf *utils.StreamFormatter) (checksum string, err error) {
+func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID, ep string, token []string, encoding archive.Encoding, sf *utils.StreamFormatter) (checksum string, err error) {
 	out = utils.NewWriteFlusher(out)
 	jsonRaw, err := ioutil.ReadFile(path.Join(srv.runtime.graph.Root, imgID, "json"))
 	if err != nil {
@@ -915,7 +1329,7 @@ func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID,
 	if err := r.PushImageJSONRegistry(imgData, jsonRaw, ep, token); err != nil {
 		if err == registry.ErrAlreadyExists {
 			out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", imgData.ID))
-			return "", nil
+			return srv.localChecksum(imgID)
 		}
 		return "", err
 	}
@@ -926,7 +1340,7 @@ func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID,
 	}
 
 	// Send the layer
-	if checksum, err := r.PushImageLayerRegistry(imgData.ID, utils.ProgressReader(layerData, int(layerData.Size), out, sf.FormatProgress("", "Pushing", "%8v/%v (%v)"), sf, false), ep, token, jsonRaw); err != nil {
+	if checksum, err := r.PushImageLayerRegistry(imgData.ID, utils.ProgressReader(layerData, int(layerData.Size), out, sf.FormatProgress("", "Pushing", "%8v/%v (%v)"), sf, false), ep, token, jsonRaw, encoding); err != nil {
 		return "", err
 	} else {
 		imgData.Checksum = checksum
@@ -941,8 +1355,60 @@ func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID,
 	return imgData.Checksum, nil
 }
 
+// maxRemoteLookups bounds the images looked up at the same time on a
+// registry before a push
+const maxRemoteLookups = 5
+
+// lookupRemoteImages looks up the images ids on the registry ep, in any of
+// its repositories, before pushing them, and returns the checksum of the
+// layer of the ones found, by id. The checksum is "" when the registry
+// doesn't tell it.
+func (srv *Server) lookupRemoteImages(r *registry.Registry, ep string, ids []string, token []string) map[string]string {
+	var (
+		found     = make(map[string]string)
+		foundLock sync.Mutex
+		wg        sync.WaitGroup
+		slots     = make(chan struct{}, maxRemoteLookups)
+	)
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if exists, checksum := r.LookupRemoteImageChecksum(id, ep, token); exists {
+				foundLock.Lock()
+				found[id] = checksum
+				foundLock.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	return found
+}
+
+// localChecksum returns the checksum the registries know the layer of the
+// image imgID by, computed from the layer without uploading it
+func (srv *Server) localChecksum(imgID string) (string, error) {
+	jsonRaw, err := ioutil.ReadFile(path.Join(srv.runtime.graph.Root, imgID, "json"))
+	if err != nil {
+		return "", err
+	}
+	img, err := srv.runtime.graph.Get(imgID)
+	if err != nil {
+		return "", err
+	}
+	layerData, err := img.TarLayer(archive.Uncompressed)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	return layerChecksum(layerData, jsonRaw)
+}
+
+// ImagePush pushes the image or the repository localName, with its layers
+// compressed with encoding.
 // FIXME: Allow to interrupt current push when new push of same image is done.
-func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, metaHeaders map[string][]string) error {
+func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, metaHeaders map[string][]string, encoding archive.Encoding) error {
 	if err := srv.poolAdd("push", localName); err != nil {
 		return err
 	}
@@ -953,6 +1419,9 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 	if err != nil {
 		return err
 	}
+	if err := registry.CheckEndpoint(endpoint); err != nil {
+		return err
+	}
 
 	out = utils.NewWriteFlusher(out)
 	img, err := srv.runtime.graph.Get(localName)
@@ -966,7 +1435,7 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 		out.Write(sf.FormatStatus("", "The push refers to a repository [%s] (len: %d)", localName, reposLen))
 		// If it fails, try to get the repository
 		if localRepo, exists := srv.runtime.repositories.Repositories[localName]; exists {
-			if err := srv.pushRepository(r, out, localName, remoteName, localRepo, endpoint, sf); err != nil {
+			if err := srv.pushRepository(r, out, localName, remoteName, localRepo, endpoint, encoding, sf); err != nil {
 				return err
 			}
 			return nil
@@ -976,18 +1445,31 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 
 	var token []string
 	out.Write(sf.FormatStatus("", "The push refers to an image: [%s]", localName))
-	if _, err := srv.pushImage(r, out, remoteName, img.ID, endpoint, token, sf); err != nil {
+	if _, err := srv.pushImage(r, out, remoteName, img.ID, endpoint, token, encoding, sf); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Writer, sf *utils.StreamFormatter) error {
+// ImageImport creates an image from the tarball src, an URL, or in with
+// src "-", and tags it repo:tag if repo is given. The tarball is checked
+// against checksum, sha256:hex, when given.
+func (srv *Server) ImageImport(src, repo, tag, checksum string, in io.Reader, out io.Writer, sf *utils.StreamFormatter) error {
+	if checksum != "" {
+		if _, err := digestID(checksum); err != nil {
+			return err
+		}
+	}
 	var archive io.Reader
-	var resp *http.Response
+	// The checksum of the tarball read from in, computed while it is imported
+	var h hash.Hash
 
 	if src == "-" {
 		archive = in
+		if checksum != "" {
+			h = sha256.New()
+			archive = io.TeeReader(in, h)
+		}
 	} else {
 		u, err := url.Parse(src)
 		if err != nil {
@@ -998,19 +1480,38 @@ func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Write
 			u.Host = src
 			u.Path = ""
 		}
+		// The imports of the same tarball take turns, for one of them at a
+		// time to download it to its partial file
+		key := "import:" + u.String()
+		for {
+			b, leader := srv.joinPull(key)
+			if leader {
+				defer srv.endPull(key, b, nil)
+				break
+			}
+			out.Write(sf.FormatStatus("", "Waiting for the import of %s in progress", u))
+			b.follow(ioutil.Discard)
+		}
 		out.Write(sf.FormatStatus("", "Downloading from %s", u))
-		// Download with curl (pretty progress bar)
-		// If curl is not available, fallback to http.Get()
-		resp, err = utils.Download(u.String(), out)
+		f, err := srv.downloadImport(u.String(), checksum, out, sf)
 		if err != nil {
 			return err
 		}
-		archive = utils.ProgressReader(resp.Body, int(resp.ContentLength), out, sf.FormatProgress("", "Importing", "%8v/%v (%v)"), sf, true)
+		defer removePartialImport(f)
+		archive = f
 	}
 	img, err := srv.runtime.graph.Create(archive, nil, "Imported from "+src, "", nil)
 	if err != nil {
 		return err
 	}
+	if h != nil {
+		if sum := digestPrefix + hex.EncodeToString(h.Sum(nil)); sum != checksum {
+			if err := srv.runtime.graph.Delete(img.ID); err != nil {
+				utils.Errorf("Unable to remove the image %s imported from a corrupted tarball: %s", img.ID, err)
+			}
+			return fmt.Errorf("The tarball is corrupted: its checksum is %s, expected %s", sum, checksum)
+		}
+	}
 	// Optionally register the image at REPO/TAG
 	if repo != "" {
 		if err := srv.runtime.repositories.Set(repo, tag, img.ID, true); err != nil {
@@ -1033,9 +1534,15 @@ func (srv *Server) ContainerCreate(config *Config, name string) (string, []strin
 	if config.Memory > 0 && !srv.runtime.capabilities.SwapLimit {
 		config.MemorySwap = -1
 	}
+	if err := srv.checkImageTrust(config.Image); err != nil {
+		return "", nil, err
+	}
 	container, buildWarnings, err := srv.runtime.Create(config, name)
 	if err != nil {
 		if srv.runtime.graph.IsNotExist(err) {
+			if _, digest := utils.ParseRepositoryDigest(config.Image); digest != "" {
+				return "", nil, fmt.Errorf("No such image: %s", config.Image)
+			}
 
 			_, tag := utils.ParseRepositoryTag(config.Image)
 			if tag == "" {
@@ -1062,7 +1569,12 @@ func (srv *Server) ContainerRestart(name string, t int) error {
 	return nil
 }
 
-func (srv *Server) ContainerDestroy(name string, removeVolume, removeLink bool) error {
+// ContainerDestroy removes the container name, or its link name with
+// removeLink, and its volumes no other container uses with removeVolume.
+// The progress of the removal is written to out, if not nil. Once cancel is
+// closed or sends a value, the removal stops: a container whose removal
+// was cancelled is dead, and removing it again completes its removal.
+func (srv *Server) ContainerDestroy(name string, removeVolume, removeLink bool, out io.Writer, sf *utils.StreamFormatter, cancel <-chan bool) error {
 	container := srv.runtime.Get(name)
 
 	if removeLink {
@@ -1094,47 +1606,76 @@ func (srv *Server) ContainerDestroy(name string, removeVolume, removeLink bool)
 		if err := srv.runtime.containerGraph.Delete(name); err != nil {
 			return err
 		}
+		srv.runtime.index.namesChanged()
 		return nil
 	}
 
-	if container != nil {
-		if container.State.Running {
-			return fmt.Errorf("Impossible to remove a running container, please stop it first")
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	var progress func(removed, total int64)
+	var volumeProgress func(volumeId string)
+	if out != nil {
+		progress = func(removed, total int64) {
+			out.Write(sf.FormatProgress(container.ShortID(), "Removing", fmt.Sprintf("%8v/%v", utils.HumanSize(removed), utils.HumanSize(total))))
 		}
-		volumes := make(map[string]struct{})
-		// Store all the deleted containers volumes
-		for _, volumeId := range container.Volumes {
-			volumeId = strings.TrimRight(volumeId, "/layer")
-			volumeId = filepath.Base(volumeId)
-			volumes[volumeId] = struct{}{}
+		volumeProgress = func(volumeId string) {
+			out.Write(sf.FormatStatus(utils.TruncateID(volumeId), "Removing volume"))
 		}
-		if err := srv.runtime.Destroy(container); err != nil {
-			return fmt.Errorf("Cannot destroy container %s: %s", name, err)
+	}
+	return srv.destroyContainer(container, name, removeVolume, progress, volumeProgress, cancel)
+}
+
+// destroyContainer removes the container and, with removeVolume, its volumes
+// no other container uses. progress and volumeProgress, if not nil, are
+// called as the filesystem of the container and each volume are removed.
+// cancel stops the removal of the filesystem; once it is removed, the
+// volumes are removed regardless of cancel.
+func (srv *Server) destroyContainer(container *Container, name string, removeVolume bool, progress func(removed, total int64), volumeProgress func(volumeId string), cancel <-chan bool) error {
+	if container.State.Running {
+		return fmt.Errorf("Impossible to remove a running container, please stop it first")
+	}
+	volumes := make(map[string]struct{})
+	// Store all the deleted containers volumes, bind mounts are not ours to remove
+	for _, volumeId := range container.Volumes {
+		if !strings.HasPrefix(volumeId, srv.runtime.volumes.Root) {
+			continue
 		}
-		srv.LogEvent("destroy", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+		volumeId = strings.TrimSuffix(volumeId, "/layer")
+		volumeId = filepath.Base(volumeId)
+		volumes[volumeId] = struct{}{}
+	}
+	if removalCancelled(cancel) {
+		return fmt.Errorf("Removal of container %s cancelled", name)
+	}
+	if err := srv.runtime.destroy(container, progress, cancel); err != nil {
+		return fmt.Errorf("Cannot destroy container %s: %s", name, err)
+	}
+	srv.LogEvent("destroy", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
 
-		if removeVolume {
-			// Retrieve all volumes from all remaining containers
-			usedVolumes := make(map[string]*Container)
-			for _, container := range srv.runtime.List() {
-				for _, containerVolumeId := range container.Volumes {
-					usedVolumes[containerVolumeId] = container
-				}
+	if removeVolume {
+		// Retrieve all volumes from all remaining containers
+		usedVolumes := make(map[string]*Container)
+		for _, container := range srv.runtime.List() {
+			for _, containerVolumeId := range container.Volumes {
+				containerVolumeId = strings.TrimSuffix(containerVolumeId, "/layer")
+				usedVolumes[filepath.Base(containerVolumeId)] = container
 			}
+		}
 
-			for volumeId := range volumes {
-				// If the requested volu
-				if c, exists := usedVolumes[volumeId]; exists {
-					log.Printf("The volume %s is used by the container %s. Impossible to remove it. Skipping.\n", volumeId, c.ID)
-					continue
-				}
-				if err := srv.runtime.volumes.Delete(volumeId); err != nil {
-					return err
-				}
+		for volumeId := range volumes {
+			// If the requested volu
+			if c, exists := usedVolumes[volumeId]; exists {
+				log.Printf("The volume %s is used by the container %s. Impossible to remove it. Skipping.\n", volumeId, c.ID)
+				continue
+			}
+			if volumeProgress != nil {
+				volumeProgress(volumeId)
+			}
+			if err := srv.runtime.volumes.Delete(volumeId); err != nil {
+				return err
 			}
 		}
-	} else {
-		return fmt.Errorf("No such container: %s", name)
 	}
 	return nil
 }
@@ -1336,28 +1877,19 @@ func (srv *Server) ContainerStart(name string, hostConfig *HostConfig) error {
 	runtime := srv.runtime
 	container := runtime.Get(name)
 
-	if hostConfig != nil {
-		for _, bind := range hostConfig.Binds {
-			splitBind := strings.Split(bind, ":")
-			source := splitBind[0]
-
-			// refuse to bind mount "/" to the container
-			if source == "/" {
-				return fmt.Errorf("Invalid bind mount '%s' : source can't be '/'", bind)
-			}
-
-			// ensure the source exists on the host
-			_, err := os.Stat(source)
-			if err != nil && os.IsNotExist(err) {
-				return fmt.Errorf("Invalid bind mount '%s' : source doesn't exist", bind)
-			}
-		}
+	if err := validateBinds(hostConfig); err != nil {
+		return err
 	}
 
 	if container == nil {
 		return fmt.Errorf("No such container: %s", name)
 	}
 	if hostConfig != nil {
+		// The network and the volumes of a container in standby are set up
+		// according to the host config it was put in standby with
+		if container.State.Standby {
+			return fmt.Errorf("Conflict, container %s is in standby, its host config can't change", name)
+		}
 		container.hostConfig = hostConfig
 		container.ToDisk()
 	}
@@ -1369,6 +1901,54 @@ func (srv *Server) ContainerStart(name string, hostConfig *HostConfig) error {
 	return nil
 }
 
+// ContainerStandby prepares the container to start, with hostConfig if not
+// nil, without starting it, so that ContainerStart has little left to do
+func (srv *Server) ContainerStandby(name string, hostConfig *HostConfig) error {
+	if err := validateBinds(hostConfig); err != nil {
+		return err
+	}
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if hostConfig != nil {
+		if container.State.Standby {
+			return fmt.Errorf("Conflict, container %s is already in standby", name)
+		}
+		container.hostConfig = hostConfig
+		container.ToDisk()
+	}
+	if err := container.Standby(); err != nil {
+		return fmt.Errorf("Cannot put container %s in standby: %s", name, err)
+	}
+	srv.LogEvent("standby", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// validateBinds refuses the bind mounts of hostConfig of "/" or of sources
+// which don't exist
+func validateBinds(hostConfig *HostConfig) error {
+	if hostConfig == nil {
+		return nil
+	}
+	for _, bind := range hostConfig.Binds {
+		splitBind := strings.Split(bind, ":")
+		source := splitBind[0]
+
+		// refuse to bind mount "/" to the container
+		if source == "/" {
+			return fmt.Errorf("Invalid bind mount '%s' : source can't be '/'", bind)
+		}
+
+		// ensure the source exists on the host
+		_, err := os.Stat(source)
+		if err != nil && os.IsNotExist(err) {
+			return fmt.Errorf("Invalid bind mount '%s' : source doesn't exist", bind)
+		}
+	}
+	return nil
+}
+
 func (srv *Server) ContainerStop(name string, t int) error {
 	if container := srv.runtime.Get(name); container != nil {
 		if err := container.Stop(t); err != nil {
@@ -1381,11 +1961,95 @@ func (srv *Server) ContainerStop(name string, t int) error {
 	return nil
 }
 
-func (srv *Server) ContainerWait(name string) (int, error) {
-	if container := srv.runtime.Get(name); container != nil {
-		return container.Wait(), nil
+// Conditions accepted by ContainerWait
+const (
+	WaitNotRunning = "not-running" // the container is not running (default)
+	WaitNextExit   = "next-exit"   // the container exits after the call
+	WaitRemoved    = "removed"     // the container is removed
+)
+
+// ContainerWait blocks until the container named by name satisfies
+// condition, or until timeout expires if it is positive.
+func (srv *Server) ContainerWait(name, condition string, timeout time.Duration, ready func()) (*APIWait, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+
+	var event string
+	switch condition {
+	case "", WaitNotRunning:
+	case WaitNextExit:
+		event = "die"
+	case WaitRemoved:
+		event = "destroy"
+	default:
+		return nil, fmt.Errorf("Bad parameter condition: %s", condition)
+	}
+
+	var done <-chan struct{}
+	if event == "" {
+		// Closed once the container is not running
+		done = container.waitLock
+	} else {
+		happened := make(chan struct{})
+		done = happened
+		// Listen before checking anything, not to miss the event
+		key := "wait-" + utils.RandomString()
+		listener := make(chan utils.JSONMessage, 64)
+		srv.Lock()
+		if srv.listeners == nil {
+			srv.listeners = make(map[string]chan utils.JSONMessage)
+		}
+		srv.listeners[key] = listener
+		srv.Unlock()
+		stop := make(chan struct{})
+		defer func() {
+			srv.Lock()
+			delete(srv.listeners, key)
+			srv.Unlock()
+			close(stop)
+		}()
+
+		if event == "destroy" && !srv.runtime.Exists(container.ID) {
+			close(happened)
+		} else {
+			go func() {
+				for {
+					select {
+					case jm := <-listener:
+						if jm.Status == event && jm.ID == container.ShortID() {
+							close(happened)
+							return
+						}
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	// From now on the condition can't be missed
+	if ready != nil {
+		ready()
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
-	return 0, fmt.Errorf("No such container: %s", name)
+	select {
+	case <-done:
+	case <-expired:
+		return &APIWait{StatusCode: -1, TimedOut: true}, nil
+	}
+
+	return &APIWait{
+		StatusCode: container.State.ExitCode,
+		FinishedAt: container.State.FinishedAt,
+	}, nil
 }
 
 func (srv *Server) ContainerResize(name string, h, w int) error {
@@ -1395,54 +2059,369 @@ func (srv *Server) ContainerResize(name string, h, w int) error {
 	return fmt.Errorf("No such container: %s", name)
 }
 
-func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, stderr bool, inStream io.ReadCloser, outStream, errStream io.Writer) error {
+// ContainerRename changes the name of a container, which may be running.
+func (srv *Server) ContainerRename(name, newName string) error {
 	container := srv.runtime.Get(name)
 	if container == nil {
 		return fmt.Errorf("No such container: %s", name)
 	}
+	if err := srv.runtime.Rename(container, newName); err != nil {
+		return err
+	}
+	srv.LogEvent("rename", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
 
-	//logs
-	if logs {
-		cLog, err := container.ReadLog("json")
-		if err != nil && os.IsNotExist(err) {
-			// Legacy logs
-			utils.Errorf("Old logs format")
-			if stdout {
-				cLog, err := container.ReadLog("stdout")
-				if err != nil {
-					utils.Errorf("Error reading logs (stdout): %s", err)
-				} else if _, err := io.Copy(outStream, cLog); err != nil {
-					utils.Errorf("Error streaming logs (stdout): %s", err)
-				}
+// ContainerUpdate sets the priority of the container
+func (srv *Server) ContainerUpdate(name string, priority int) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	container.hostConfig.Priority = priority
+	if err := container.ToDisk(); err != nil {
+		return err
+	}
+	srv.LogEvent("update", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// ContainerSwap replaces the running container name by a copy running image.
+// Once the copy is healthy, it takes over the published ports and the name
+// of the container, which is stopped and renamed after its id. The short id
+// of the copy is returned.
+func (srv *Server) ContainerSwap(name, image string, timeout time.Duration) (string, error) {
+	old := srv.runtime.Get(name)
+	if old == nil {
+		return "", fmt.Errorf("No such container: %s", name)
+	}
+	if !old.State.Running {
+		return "", fmt.Errorf("Impossible to swap container %s: it is not running", name)
+	}
+
+	config, hostConfig := old.cloneConfig(image)
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		return "", err
+	}
+	clone := srv.runtime.Get(id)
+	abort := func(err error) (string, error) {
+		if clone.State.Running {
+			clone.Kill()
+		}
+		if err := srv.ContainerDestroy(clone.ID, false, false, nil, nil, nil); err != nil {
+			utils.Errorf("Cannot remove the new container %s of the swap: %s", clone.ID, err)
+		}
+		return "", err
+	}
+	if err := clone.shareVolumes(old); err != nil {
+		return abort(err)
+	}
+	if err := srv.ContainerStart(clone.ID, hostConfig); err != nil {
+		return abort(err)
+	}
+	if err := clone.waitHealthy(timeout); err != nil {
+		return abort(fmt.Errorf("Impossible to swap container %s: the new container is unhealthy: %s", name, err))
+	}
+	if err := movePublishedPorts(old, clone); err != nil {
+		return abort(err)
+	}
+
+	if err := srv.runtime.TakeName(clone, old, old.Name+"-"+old.ShortID()); err != nil {
+		return clone.ShortID(), fmt.Errorf("The ports of %s were moved to %s, but not its name: %s", name, clone.ShortID(), err)
+	}
+	srv.LogEvent("swap", clone.ShortID(), srv.runtime.repositories.ImageName(clone.Image))
+
+	if err := srv.ContainerStop(old.ID, 10); err != nil {
+		return clone.ShortID(), err
+	}
+	return clone.ShortID(), nil
+}
+
+// ContainerMirror copies the traffic of a running container to target,
+// either another running container or a host interface.
+func (srv *Server) ContainerMirror(name, target string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	dev := target
+	if targetContainer := srv.runtime.Get(target); targetContainer != nil {
+		if !targetContainer.State.Running || targetContainer.network == nil {
+			return fmt.Errorf("Impossible to mirror the traffic to container %s: it is not running or its network is disabled", target)
+		}
+		dev = targetContainer.network.Veth
+	} else if _, err := net.InterfaceByName(target); err != nil {
+		return fmt.Errorf("No such container or interface: %s", target)
+	}
+	if err := container.MirrorTraffic(dev); err != nil {
+		return err
+	}
+	srv.LogEvent("mirror", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// ContainerUnmirror stops mirroring the traffic of a running container
+func (srv *Server) ContainerUnmirror(name string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if err := container.UnmirrorTraffic(); err != nil {
+		return err
+	}
+	srv.LogEvent("unmirror", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// ContainerConnect connects a running container to another bridge, with an
+// additional interface
+func (srv *Server) ContainerConnect(name, bridge, iface string) (*InterfaceSettings, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	settings, err := container.AttachNetwork(bridge, iface)
+	if err != nil {
+		return nil, err
+	}
+	srv.LogEvent("connect", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return settings, nil
+}
+
+// ContainerDisconnect removes an interface connected by ContainerConnect,
+// or -net-attach, from a running container
+func (srv *Server) ContainerDisconnect(name, iface string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if err := container.DetachNetwork(iface); err != nil {
+		return err
+	}
+	srv.LogEvent("disconnect", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// resolveContainerIP returns the ip of a running container from its ip,
+// name, id, or its hostname, fully qualified or not. Only the containers can
+// be reached through the gateway.
+func (srv *Server) resolveContainerIP(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, container := range srv.runtime.List() {
+			if container.State.Running && container.NetworkSettings.IPAddress == ip.String() {
+				return ip, nil
 			}
-			if stderr {
-				cLog, err := container.ReadLog("stderr")
-				if err != nil {
-					utils.Errorf("Error reading logs (stderr): %s", err)
-				} else if _, err := io.Copy(errStream, cLog); err != nil {
-					utils.Errorf("Error streaming logs (stderr): %s", err)
-				}
+		}
+		return nil, fmt.Errorf("No running container at %s", host)
+	}
+	container := srv.runtime.Get(host)
+	if container == nil {
+		container = srv.runtime.getByHostname(host)
+	}
+	if container == nil || !container.State.Running || container.NetworkSettings.IPAddress == "" {
+		return nil, fmt.Errorf("No running container %s", host)
+	}
+	return net.ParseIP(container.NetworkSettings.IPAddress), nil
+}
+
+// ContainerForward forwards an ephemeral port on the loopback of the host
+// to rawPort, PORT[/PROTO], of a running container, for ttl.
+func (srv *Server) ContainerForward(name, rawPort string, ttl time.Duration) (*APIPortForward, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	port := Port(rawPort)
+	if !strings.Contains(rawPort, "/") {
+		port = NewPort("tcp", rawPort)
+	}
+	if _, err := parsePort(port.Port()); err != nil {
+		return nil, fmt.Errorf("Bad parameter port: %s", rawPort)
+	}
+	if proto := port.Proto(); proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("Bad parameter port: %s", rawPort)
+	}
+	if ttl <= 0 || ttl > MaxPortForwardTTL {
+		return nil, fmt.Errorf("Bad parameter ttl: %s, expected at most %s", ttl, MaxPortForwardTTL)
+	}
+	if !container.State.Running || container.network == nil {
+		return nil, fmt.Errorf("Impossible to forward port %s of container %s: it is not running or its network is disabled", port, name)
+	}
+	forward, err := container.network.Forward(port, ttl)
+	if err != nil {
+		return nil, err
+	}
+	out := apiPortForward(forward)
+	return &out, nil
+}
+
+// ContainerUnforward stops a port forward of a container
+func (srv *Server) ContainerUnforward(name, id string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if container.network == nil {
+		return fmt.Errorf("No such port forward: %s", id)
+	}
+	return container.network.StopForward(id)
+}
+
+// ContainerForwards lists the port forwards of a container
+func (srv *Server) ContainerForwards(name string) ([]APIPortForward, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	outs := []APIPortForward{}
+	if container.network == nil {
+		return outs, nil
+	}
+	for _, forward := range container.network.Forwards() {
+		outs = append(outs, apiPortForward(forward))
+	}
+	return outs, nil
+}
+
+func apiPortForward(forward *PortForward) APIPortForward {
+	privatePort, _ := parsePort(forward.Port.Port())
+	return APIPortForward{
+		ID:          forward.ID,
+		PrivatePort: int64(privatePort),
+		PublicPort:  int64(forward.HostPort),
+		Type:        forward.Port.Proto(),
+		IP:          forward.HostIp,
+		Expires:     forward.Expires,
+	}
+}
+
+// ContainerPublish maps a port of a running container on the host. rawPort
+// is in the same format as the -p option of run.
+func (srv *Server) ContainerPublish(name, rawPort string) ([]APIPort, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	port, binding, err := parseSinglePortSpec(rawPort)
+	if err != nil {
+		return nil, err
+	}
+	binding, err = container.PublishPort(port, binding)
+	if err != nil {
+		return nil, err
+	}
+	settings := &NetworkSettings{Ports: map[Port][]PortBinding{port: {binding}}}
+	return settings.PortMappingAPI(), nil
+}
+
+// ContainerUnpublish removes the mappings of a port of a running container
+// matching rawPort. Host addresses and ports left out match any mapping.
+func (srv *Server) ContainerUnpublish(name, rawPort string) ([]APIPort, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	port, binding, err := parseSinglePortSpec(rawPort)
+	if err != nil {
+		return nil, err
+	}
+	released, err := container.UnpublishPort(port, binding)
+	if err != nil {
+		return nil, err
+	}
+	settings := &NetworkSettings{Ports: map[Port][]PortBinding{port: released}}
+	return settings.PortMappingAPI(), nil
+}
+
+// ContainerLogs writes the captured output of the container named by name.
+// Only the entries logged after since are returned (a zero time means all of
+// them), and if tail is not negative only the last tail lines are kept. When
+// timestamps is set each line is prefixed with the time it was captured.
+func (srv *Server) ContainerLogs(name string, since time.Time, tail int, timestamps, stdout, stderr bool, outStream, errStream io.Writer) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+
+	cLog, err := container.ReadLog("json")
+	if err != nil && os.IsNotExist(err) {
+		// Legacy logs
+		utils.Errorf("Old logs format")
+		if stdout {
+			cLog, err := container.ReadLog("stdout")
+			if err != nil {
+				utils.Errorf("Error reading logs (stdout): %s", err)
+			} else if _, err := io.Copy(outStream, cLog); err != nil {
+				utils.Errorf("Error streaming logs (stdout): %s", err)
 			}
+		}
+		if stderr {
+			cLog, err := container.ReadLog("stderr")
+			if err != nil {
+				utils.Errorf("Error reading logs (stderr): %s", err)
+			} else if _, err := io.Copy(errStream, cLog); err != nil {
+				utils.Errorf("Error streaming logs (stderr): %s", err)
+			}
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading logs (json): %s", err)
+	}
+
+	var (
+		lines []*utils.JSONLog
+		dec   = json.NewDecoder(cLog)
+	)
+	for {
+		l := &utils.JSONLog{}
+		if err := dec.Decode(l); err == io.EOF {
+			break
 		} else if err != nil {
-			utils.Errorf("Error reading logs (json): %s", err)
+			utils.Errorf("Error streaming logs: %s", err)
+			break
+		}
+		if (l.Stream == "stdout" && !stdout) || (l.Stream == "stderr" && !stderr) {
+			continue
+		}
+		if !since.IsZero() && !l.Created.After(since) {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if tail >= 0 && tail < len(lines) {
+		lines = lines[len(lines)-tail:]
+	}
+
+	for _, l := range lines {
+		var out io.Writer
+		switch l.Stream {
+		case "stdout":
+			out = outStream
+		case "stderr":
+			out = errStream
+		default:
+			continue
+		}
+		if timestamps {
+			fmt.Fprintf(out, "%s %s", l.Created.Format(time.RFC3339Nano), l.Log)
 		} else {
-			dec := json.NewDecoder(cLog)
-			for {
-				l := &utils.JSONLog{}
-
-				if err := dec.Decode(l); err == io.EOF {
-					break
-				} else if err != nil {
-					utils.Errorf("Error streaming logs: %s", err)
-					break
-				}
-				if l.Stream == "stdout" && stdout {
-					fmt.Fprintf(outStream, "%s", l.Log)
-				}
-				if l.Stream == "stderr" && stderr {
-					fmt.Fprintf(errStream, "%s", l.Log)
-				}
-			}
+			fmt.Fprintf(out, "%s", l.Log)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, stderr bool, inStream io.ReadCloser, outStream, errStream io.Writer) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+
+	//logs
+	if logs {
+		if err := srv.ContainerLogs(name, time.Time{}, -1, false, stdout, stderr, outStream, errStream); err != nil {
+			utils.Errorf("Error streaming logs: %s", err)
 		}
 	}
 
@@ -1493,6 +2472,22 @@ func (srv *Server) ContainerInspect(name string) (*Container, error) {
 	return nil, fmt.Errorf("No such container: %s", name)
 }
 
+// ContainerInspectNetwork returns a copy of the network settings of the
+// container as inspect shows them, with the names it is reachable under and
+// the target of its mirror, which change independently of its network
+func (srv *Server) ContainerInspectNetwork(container *Container) *NetworkSettings {
+	settings := &NetworkSettings{}
+	if container.NetworkSettings != nil {
+		*settings = *container.NetworkSettings
+	}
+	settings.Aliases = srv.runtime.networkAliases(container)
+	settings.Mirror = ""
+	if container.network != nil {
+		settings.Mirror = container.network.MirrorTarget()
+	}
+	return settings
+}
+
 func (srv *Server) ImageInspect(name string) (*Image, error) {
 	if image, err := srv.runtime.repositories.LookupImage(name); err == nil && image != nil {
 		return image, nil
@@ -1517,23 +2512,53 @@ func (srv *Server) ContainerCopy(name string, resource string, out io.Writer) er
 
 }
 
+// ContainerCopyTo unpacks the tar archive in into the directory resource of
+// a container
+func (srv *Server) ContainerCopyTo(name string, resource string, in io.Reader, options *archive.UntarOptions) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return container.CopyTo(resource, in, options)
+}
+
 func NewServer(config *DaemonConfig) (*Server, error) {
 	runtime, err := NewRuntime(config)
 	if err != nil {
 		return nil, err
 	}
 	srv := &Server{
-		runtime:     runtime,
-		pullingPool: make(map[string]struct{}),
-		pushingPool: make(map[string]struct{}),
-		events:      make([]utils.JSONMessage, 0, 64), //only keeps the 64 last events
-		listeners:   make(map[string]chan utils.JSONMessage),
-		reqFactory:  nil,
+		runtime:      runtime,
+		pullingPool:  make(map[string]struct{}),
+		pushingPool:  make(map[string]struct{}),
+		events:       make([]utils.JSONMessage, 0, 64), //only keeps the 64 last events
+		listeners:    make(map[string]chan utils.JSONMessage),
+		reqFactory:   nil,
+		downloads:    newDownloadScheduler(config.MaxConcurrentDownloads),
+		apiListeners: make(map[string]*os.File),
+		plugins:      plugins.NewManager(plugins.DefaultSocketsPath, plugins.DefaultSpecsPaths),
 	}
 	runtime.srv = srv
+	if err := srv.ReloadRegistryConfig(); err != nil {
+		return nil, err
+	}
+	srv.removeExitedAutoRemove()
 	return srv, nil
 }
 
+// removeExitedAutoRemove removes the containers started with -rm which
+// exited while the daemon was down.
+func (srv *Server) removeExitedAutoRemove() {
+	for _, container := range srv.runtime.List() {
+		if container.State.Running || container.hostConfig == nil || !container.hostConfig.AutoRemove {
+			continue
+		}
+		if err := srv.ContainerDestroy(container.ID, true, false, nil, nil, nil); err != nil {
+			utils.Errorf("Cannot auto-remove container %s: %s", container.ID, err)
+		}
+	}
+}
+
 func (srv *Server) HTTPRequestFactory(metaHeaders map[string][]string) *utils.HTTPRequestFactory {
 	if srv.reqFactory == nil {
 		ud := utils.NewHTTPUserAgentDecorator(srv.versionInfos()...)
@@ -1547,8 +2572,7 @@ func (srv *Server) HTTPRequestFactory(metaHeaders map[string][]string) *utils.HT
 }
 
 func (srv *Server) LogEvent(action, id, from string) {
-	now := time.Now().Unix()
-	jm := utils.JSONMessage{Status: action, ID: id, From: from, Time: now}
+	jm := utils.JSONMessage{Status: action, ID: id, From: from, Time: now().Unix()}
 	srv.events = append(srv.events, jm)
 	for _, c := range srv.listeners {
 		select { // non blocking channel
@@ -1566,4 +2590,16 @@ type Server struct {
 	events      []utils.JSONMessage
 	listeners   map[string]chan utils.JSONMessage
 	reqFactory  *utils.HTTPRequestFactory
+	// Replaced as a whole when reloaded
+	registryConfig *RegistryConfig
+	downloads      *downloadScheduler
+	// The pulls in progress, see joinPull
+	pulls map[string]*pullBroadcast
+	// The cancel channels of the removals in the background, by container
+	// id, see ContainerDestroyAsync
+	removals map[string]chan bool
+	// The API sockets, handed over to the daemon on self-upgrade
+	apiListeners map[string]*os.File
+	upgrading    bool
+	plugins      *plugins.Manager
 }
@@ -1,7 +1,14 @@
 package docker
 
 import (
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -13,7 +20,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,7 +36,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +49,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,7 +62,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,7 +75,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,7 +105,7 @@ func TestCreateRm(t *testing.T) {
 		t.Errorf("Expected 1 container, %v found", len(runtime.List()))
 	}
 
-	if err = srv.ContainerDestroy(id, true, false); err != nil {
+	if err = srv.ContainerDestroy(id, true, false, nil, nil, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -108,6 +115,313 @@ func TestCreateRm(t *testing.T) {
 
 }
 
+func TestContainersNames(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "echo test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, err := srv.ContainerCreate(config, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := srv.ContainerCreate(config, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers := srv.Containers(true, false, -1, "", "", nil)
+	if len(containers) != 2 {
+		t.Fatalf("Expected 2 containers, %v found", len(containers))
+	}
+	// Most recently created containers are listed first
+	if !strings.HasPrefix(containers[0].ID, second) || !strings.HasPrefix(containers[1].ID, first) {
+		t.Fatalf("Unexpected container order: %s, %s", containers[0].ID, containers[1].ID)
+	}
+	if len(containers[0].Names) != 1 || containers[0].Names[0] != "/second" {
+		t.Fatalf("Expected names [/second], got %v", containers[0].Names)
+	}
+	if len(containers[1].Names) != 1 || containers[1].Names[0] != "/first" {
+		t.Fatalf("Expected names [/first], got %v", containers[1].Names)
+	}
+}
+
+func TestContainersLabelFilter(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	create := func(args ...string) string {
+		config, _, _, err := ParseRun(append(args, GetTestImage(runtime).ID, "echo test"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _, err := srv.ContainerCreate(config, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	db := create("-label", "role=db", "-label", "tier")
+	web := create("-label", "role=web")
+	create()
+
+	containers := srv.Containers(true, false, -1, "", "", map[string][]string{"label": {"role=db"}})
+	if len(containers) != 1 || !strings.HasPrefix(containers[0].ID, db) {
+		t.Fatalf("Expected only %s, got %v", db, containers)
+	}
+	if containers[0].Labels["role"] != "db" {
+		t.Fatalf("Expected the labels to be listed, got %v", containers[0].Labels)
+	}
+
+	containers = srv.Containers(true, false, -1, "", "", map[string][]string{"label": {"role"}})
+	if len(containers) != 2 || !strings.HasPrefix(containers[0].ID, web) {
+		t.Fatalf("Expected %s and %s, got %v", web, db, containers)
+	}
+
+	containers = srv.Containers(true, false, -1, "", "", map[string][]string{"label": {"role", "tier"}})
+	if len(containers) != 1 || !strings.HasPrefix(containers[0].ID, db) {
+		t.Fatalf("Expected only %s, got %v", db, containers)
+	}
+
+	if containers := srv.Containers(true, false, -1, "", "", nil); len(containers) != 3 {
+		t.Fatalf("Expected 3 containers, %v found", len(containers))
+	}
+}
+
+func TestContainerAutoRemove(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+	runtime.srv = srv
+
+	config, hostConfig, _, err := ParseRun([]string{"-rm", "-v", "/foo", GetTestImage(runtime).ID, "sh", "-c", "exit 3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hostConfig.AutoRemove {
+		t.Fatalf("-rm should set AutoRemove")
+	}
+
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	container := runtime.Get(id)
+	volume := container.Volumes["/foo"]
+
+	setTimeout(t, "The container was not removed", 10*time.Second, func() {
+		for runtime.Exists(id) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	if container.State.ExitCode != 3 {
+		t.Fatalf("Expected exit code 3 got %d", container.State.ExitCode)
+	}
+	if _, err := os.Stat(volume); err == nil {
+		t.Fatalf("The volume %s should have been removed", volume)
+	}
+}
+
+func TestContainerPublish(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{"-i", GetTestImage(runtime).ID, "cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ContainerPublish(id, "80"); err == nil {
+		t.Fatalf("Publishing a port of a stopped container should fail")
+	}
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.ContainerKill(id, 0)
+
+	ports, err := srv.ContainerPublish(id, "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0].PrivatePort != 80 || ports[0].PublicPort == 0 {
+		t.Fatalf("Unexpected published ports: %v", ports)
+	}
+	container := runtime.Get(id)
+	if b := container.NetworkSettings.Ports[Port("80/tcp")]; len(b) != 1 || b[0].HostPort != strconv.FormatInt(ports[0].PublicPort, 10) {
+		t.Fatalf("Inspect should show the new mapping, got %v", b)
+	}
+	if b := container.hostConfig.PortBindings[Port("80/tcp")]; len(b) != 1 {
+		t.Fatalf("The mapping should be kept in the host config, got %v", b)
+	}
+
+	released, err := srv.ContainerUnpublish(id, "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0].PublicPort != ports[0].PublicPort {
+		t.Fatalf("Expected %v to be released, got %v", ports, released)
+	}
+	if b := container.NetworkSettings.Ports[Port("80/tcp")]; len(b) != 0 {
+		t.Fatalf("The mapping should be gone, got %v", b)
+	}
+	if _, err := srv.ContainerUnpublish(id, "80"); err == nil {
+		t.Fatalf("Unpublishing a port twice should fail")
+	}
+}
+
+func TestNetworkContainers(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{"-i", "-p", "80", GetTestImage(runtime).ID, "cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := runtime.networkManager.bridgeIface
+	containers, err := srv.NetworkContainers(bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 0 {
+		t.Fatalf("Expected no running container on %s, got %v", bridge, containers)
+	}
+
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.ContainerKill(id, 0)
+
+	containers, err = srv.NetworkContainers(bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := runtime.Get(id)
+	if len(containers) != 1 || containers[0].ID != id || containers[0].IPAddress != container.NetworkSettings.IPAddress {
+		t.Fatalf("Expected %s on %s, got %v", id, bridge, containers)
+	}
+	if containers[0].Interface != DefaultInterfaceName || len(containers[0].Ports) != 1 || containers[0].Ports[0].PrivatePort != 80 {
+		t.Fatalf("Expected the published port on %s, got %v", DefaultInterfaceName, containers[0])
+	}
+
+	if _, err := srv.NetworkContainers("nonexistent0"); err == nil {
+		t.Fatal("Expected an error for a nonexistent bridge")
+	}
+}
+
+func TestContainerSwap(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{"-i", "-p", "5353/udp", "-expose", "80", GetTestImage(runtime).ID, "cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.ContainerKill(id, 0)
+	old := runtime.Get(id)
+	hostPort := old.NetworkSettings.Ports[Port("5353/udp")][0].HostPort
+	count := runtime.containers.Len()
+
+	// cat doesn't listen on the exposed port 80
+	if _, err := srv.ContainerSwap("web", GetTestImage(runtime).ID, time.Second); err == nil {
+		t.Fatal("Expected the swap to an unhealthy container to fail")
+	}
+	if runtime.containers.Len() != count || !old.State.Running || old.NetworkSettings.Ports[Port("5353/udp")][0].HostPort != hostPort {
+		t.Fatal("Expected a failed swap to leave the container alone")
+	}
+
+	delete(old.Config.ExposedPorts, Port("80/tcp"))
+	newID, err := srv.ContainerSwap("web", GetTestImage(runtime).ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := runtime.Get("web")
+	if clone == nil || clone.ShortID() != newID {
+		t.Fatalf("Expected the name web to move to %s", newID)
+	}
+	defer srv.ContainerKill(clone.ID, 0)
+	if b := clone.NetworkSettings.Ports[Port("5353/udp")]; len(b) != 1 || b[0].HostPort != hostPort {
+		t.Fatalf("Expected the port to move to the new container, got %v", b)
+	}
+	if old.State.Running || runtime.Get("web-"+old.ShortID()) != old {
+		t.Fatal("Expected the old container to be stopped and renamed")
+	}
+}
+
+func TestContainerWaitRemoved(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+	runtime.srv = srv
+
+	config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "echo test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan *APIWait)
+	go func() {
+		apiWait, err := srv.ContainerWait(id, WaitRemoved, 0, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		waited <- apiWait
+	}()
+
+	// The container is stopped, but not removed yet
+	select {
+	case <-waited:
+		t.Fatalf("Wait returned before the container was removed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := srv.ContainerDestroy(id, false, false, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	setTimeout(t, "Wait did not notice the removal", 2*time.Second, func() {
+		if apiWait := <-waited; apiWait == nil || apiWait.TimedOut {
+			t.Fatalf("Wait should not have timed out")
+		}
+	})
+}
+
 func TestCreateRmVolumes(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -138,7 +452,7 @@ func TestCreateRmVolumes(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err = srv.ContainerDestroy(id, true, false); err != nil {
+	if err = srv.ContainerDestroy(id, true, false, nil, nil, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -163,9 +477,42 @@ func TestCommit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := srv.ContainerCommit(id, "testrepo", "testtag", "", "", config); err != nil {
+	if _, err := srv.ContainerCommit(id, "testrepo", "testtag", "", "", config, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerCommitPause(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{"-i", GetTestImage(runtime).ID, "cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.ContainerKill(id, 0)
+
+	if _, err := srv.ContainerCommit(id, "test", "", "", "", nil, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The container must be thawed once committed
+	output, err := exec.Command("lxc-info", "-s", "-n", id).CombinedOutput()
+	if err != nil {
 		t.Fatal(err)
 	}
+	if !strings.Contains(string(output), "RUNNING") {
+		t.Fatalf("Expected the container to run after the commit, got %s", output)
+	}
 }
 
 func TestCreateStartRestartStopStartKillRm(t *testing.T) {
@@ -209,7 +556,7 @@ func TestCreateStartRestartStopStartKillRm(t *testing.T) {
 	}
 
 	// FIXME: this failed once with a race condition ("Unable to remove filesystem for xxx: directory not empty")
-	if err := srv.ContainerDestroy(id, true, false); err != nil {
+	if err := srv.ContainerDestroy(id, true, false, nil, nil, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -388,7 +735,7 @@ func TestRmi(t *testing.T) {
 	defer nuke(runtime)
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -409,7 +756,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	imageID, err := srv.ContainerCommit(containerID, "test", "", "", "", nil)
+	imageID, err := srv.ContainerCommit(containerID, "test", "", "", "", nil, true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -430,12 +777,12 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = srv.ContainerCommit(containerID, "test", "", "", "", nil)
+	_, err = srv.ContainerCommit(containerID, "test", "", "", "", nil, true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -449,7 +796,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -485,7 +832,7 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "utest*/*")
+	images, err := srv.Images(false, "utest*/*", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -494,7 +841,7 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal("incorrect number of matches returned")
 	}
 
-	images, err = srv.Images(false, "utest")
+	images, err = srv.Images(false, "utest", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -503,7 +850,7 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal("incorrect number of matches returned")
 	}
 
-	images, err = srv.Images(false, "utest*")
+	images, err = srv.Images(false, "utest*", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -512,7 +859,7 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal("incorrect number of matches returned")
 	}
 
-	images, err = srv.Images(false, "*5000*/*")
+	images, err = srv.Images(false, "*5000*/*", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -521,3 +868,210 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal("incorrect number of matches returned")
 	}
 }
+
+func TestContainerInitConfig(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.ContainerCreate(config, "db"); err != nil {
+		t.Fatal(err)
+	}
+	config, _, _, err = ParseRun([]string{"-volumes-from", "db", GetTestImage(runtime).ID, "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.ContainerCreate(config, "web"); err != nil {
+		t.Fatal(err)
+	}
+
+	unit, err := srv.ContainerInitConfig("web", "systemd", InitRestartOnFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Requires=docker.service docker-db.service\n", "Restart=on-failure\n", " start -a web\n"} {
+		if !strings.Contains(unit, expected) {
+			t.Fatalf("Expected the systemd unit to contain %q, got %s", expected, unit)
+		}
+	}
+
+	job, err := srv.ContainerInitConfig("web", "upstart", InitRestartNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(job, "start on started docker and started docker-db\n") || strings.Contains(job, "respawn") {
+		t.Fatalf("Expected an upstart job started after docker-db and not respawned, got %s", job)
+	}
+
+	if _, err := srv.ContainerInitConfig("web", "sysvinit", InitRestartNo); err == nil {
+		t.Fatal("Expected an unknown init system to be refused")
+	}
+}
+
+func TestContainerUpdate(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{"-priority", "5", GetTestImage(runtime).ID, "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	runtime.Get(id).Wait()
+	if priority := runtime.Get(id).priority(); priority != 5 {
+		t.Fatalf("Expected the priority 5, got %d", priority)
+	}
+
+	if err := srv.ContainerUpdate(id, -3); err != nil {
+		t.Fatal(err)
+	}
+	container, err := runtime.load(runtime.Get(id).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.priority() != -3 {
+		t.Fatalf("Expected the updated priority -3 on disk, got %d", container.priority())
+	}
+
+	if err := srv.ContainerUpdate("unknown", 1); err == nil {
+		t.Fatal("Expected the update of an unknown container to fail")
+	}
+}
+
+func TestContainerStandby(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{GetTestImage(runtime).ID, "/bin/cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OpenStdin = true
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := runtime.Get(id)
+
+	if err := srv.ContainerStandby(id, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	if !container.State.Standby || container.State.Running {
+		t.Fatalf("Expected the container to be in standby, got %s", container.State.String())
+	}
+	if container.NetworkSettings.IPAddress == "" {
+		t.Fatal("Expected the network of the container in standby to be allocated")
+	}
+	if mounted, err := container.Mounted(); err != nil || !mounted {
+		t.Fatalf("Expected the container in standby to be mounted (%v)", err)
+	}
+	if err := srv.ContainerStart(id, hostConfig); err == nil {
+		t.Fatal("Expected a new host config to be refused in standby")
+	}
+
+	// Stopping the container releases it
+	if err := srv.ContainerStop(id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.Standby {
+		t.Fatal("Expected the container to leave standby once stopped")
+	}
+
+	// Starting the container takes it out of standby
+	if err := srv.ContainerStandby(id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(id, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.ContainerKill(id, 0)
+	if container.State.Standby || !container.State.Running {
+		t.Fatalf("Expected the container to run, got %s", container.State.String())
+	}
+}
+
+func TestLookupRemoteImages(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/images/pushed/json":
+			w.Header().Set("X-Docker-Checksum", "tarsum+sha256:1234")
+			io.WriteString(w, "{}")
+		case "/v1/images/nochecksum/json":
+			io.WriteString(w, "{}")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	r, err := registry.NewRegistry("", nil, utils.NewHTTPRequestFactory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{}
+	found := srv.lookupRemoteImages(r, ts.URL+"/v1/", []string{"pushed", "nochecksum", "missing"}, nil)
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 images found, got %v", found)
+	}
+	if checksum, exists := found["pushed"]; !exists || checksum != "tarsum+sha256:1234" {
+		t.Errorf("Expected the checksum of the image pushed, got %v", found)
+	}
+	if checksum, exists := found["nochecksum"]; !exists || checksum != "" {
+		t.Errorf("Expected the image without checksum to be found, got %v", found)
+	}
+}
+
+func TestImagesLabelFilter(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	config, _, _, err := ParseRun([]string{"-label", "role=db", GetTestImage(runtime).ID, "/bin/cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitConfig := &Config{Labels: map[string]string{"tier": "backend"}}
+	imgID, err := srv.ContainerCommit(id, "labeled", "", "", "", commitConfig, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := srv.Images(false, "", []string{"role=db", "tier"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != imgID {
+		t.Fatalf("Expected only the committed image, got %v", images)
+	}
+	if images[0].Labels["role"] != "db" || images[0].Labels["tier"] != "backend" {
+		t.Fatalf("Unexpected labels %v", images[0].Labels)
+	}
+
+	images, err = srv.Images(false, "", []string{"role=web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Fatalf("Expected no image, got %v", images)
+	}
+}
@@ -0,0 +1,254 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The drivers snapshotting the filesystem of the image of a container,
+// btrfs and devicemapper, apply the layers of the images to their snapshots
+// and compare the snapshot of a container with the one of its image to
+// find its changes.
+
+// applyAUFSLayer applies the layer src, with the whiteouts of AUFS, to the
+// filesystem dst: the paths it deletes or replaces by another type of file
+// are removed first, then its files are copied, sharing their extents on
+// btrfs.
+func applyAUFSLayer(src, dst string) error {
+	var whiteouts []string
+	if err := filepath.Walk(src, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, pth)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		name := f.Name()
+		switch {
+		case name == aufsOpaque:
+			whiteouts = append(whiteouts, pth)
+			// The directory hides the content of the layers below
+			children, err := ioutil.ReadDir(filepath.Dir(target))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if err := os.RemoveAll(filepath.Join(filepath.Dir(target), child.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		case strings.HasPrefix(name, aufsMetaPrefix):
+			whiteouts = append(whiteouts, pth)
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(name, aufsWhiteoutPrefix):
+			whiteouts = append(whiteouts, pth)
+			return os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, aufsWhiteoutPrefix)))
+		}
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() != f.IsDir() {
+			return os.RemoveAll(target)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to copy the layer %s: %s (%s)", src, err, strings.TrimSpace(string(output)))
+	}
+	for _, whiteout := range whiteouts {
+		rel, err := filepath.Rel(src, whiteout)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMissingPaths creates in dst the files and directories of src it lacks,
+// empty, such as the mountpoints of the dockerinit layer
+func addMissingPaths(src, dst string) error {
+	return filepath.Walk(src, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, pth)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if f.IsDir() {
+			return os.MkdirAll(target, f.Mode().Perm())
+		}
+		return ioutil.WriteFile(target, nil, f.Mode().Perm())
+	})
+}
+
+// changesBetween returns the changes from the filesystem at oldRoot to the
+// one at newRoot. A deleted directory is a single change.
+func changesBetween(oldRoot, newRoot string) ([]Change, error) {
+	var changes []Change
+	if err := filepath.Walk(newRoot, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(newRoot, pth)
+		if err != nil || rel == "." {
+			return err
+		}
+		change := Change{Path: filepath.Join("/", rel)}
+		previous, err := os.Lstat(filepath.Join(oldRoot, rel))
+		if os.IsNotExist(err) {
+			change.Kind = ChangeAdd
+		} else if err != nil {
+			return err
+		} else if previous.Mode() != f.Mode() || !previous.ModTime().Equal(f.ModTime()) || (!f.IsDir() && previous.Size() != f.Size()) {
+			change.Kind = ChangeModify
+		} else {
+			return nil
+		}
+		changes = append(changes, change)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := filepath.Walk(oldRoot, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(oldRoot, pth)
+		if err != nil || rel == "." {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(newRoot, rel)); os.IsNotExist(err) {
+			changes = append(changes, Change{Path: filepath.Join("/", rel), Kind: ChangeDelete})
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// withoutDockerinitPaths returns the changes of a container but the files
+// and directories it got from the dockerinit layer
+func withoutDockerinitPaths(changes []Change, dockerinitLayer string) []Change {
+	var filtered []Change
+	for _, change := range changes {
+		if change.Kind == ChangeAdd {
+			if _, err := os.Lstat(filepath.Join(dockerinitLayer, change.Path)); err == nil {
+				continue
+			}
+		}
+		filtered = append(filtered, change)
+	}
+	return filtered
+}
+
+// exportChanges returns a tar archive of the changes to the filesystem at
+// rootfs, with the whiteouts of AUFS, the format of the layers of the
+// images. The archive is made in tmpDir.
+func exportChanges(rootfs string, changes []Change, tmpDir string) (archive.Archive, error) {
+	tmp, err := ioutil.TempDir(tmpDir, "rw-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, change := range changes {
+		target := filepath.Join(tmp, change.Path)
+		if err := copyParentDirs(rootfs, tmp, filepath.Dir(change.Path)); err != nil {
+			return nil, err
+		}
+		if change.Kind == ChangeDelete {
+			if err := ioutil.WriteFile(filepath.Join(filepath.Dir(target), aufsWhiteoutPrefix+filepath.Base(change.Path)), nil, 0600); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f, err := os.Lstat(filepath.Join(rootfs, change.Path))
+		if err != nil {
+			return nil, err
+		}
+		if f.IsDir() {
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return nil, err
+			}
+			if err := copyDirAttributes(f, target); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if output, err := exec.Command("cp", "-a", "--reflink=auto", filepath.Join(rootfs, change.Path), target).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("Unable to export %s: %s (%s)", change.Path, err, strings.TrimSpace(string(output)))
+		}
+	}
+	data, err := archive.Tar(tmp, archive.Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	return archive.NewTempArchive(data, tmpDir)
+}
+
+// changedFilesSize returns the size of the files added or modified by the
+// changes to the filesystem at rootfs
+func changedFilesSize(rootfs string, changes []Change) int64 {
+	var size int64
+	for _, change := range changes {
+		if change.Kind == ChangeDelete {
+			continue
+		}
+		if fileInfo, err := os.Lstat(filepath.Join(rootfs, change.Path)); err == nil && !fileInfo.IsDir() {
+			size += fileInfo.Size()
+		}
+	}
+	return size
+}
+
+// copyParentDirs creates the directory dir of src in dst, and the ones
+// above it, with their owners and modes
+func copyParentDirs(src, dst, dir string) error {
+	if dir == "/" || dir == "." {
+		return nil
+	}
+	target := filepath.Join(dst, dir)
+	if _, err := os.Lstat(target); err == nil {
+		return nil
+	}
+	if err := copyParentDirs(src, dst, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	f, err := os.Lstat(filepath.Join(src, dir))
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, 0755); err != nil {
+		return err
+	}
+	return copyDirAttributes(f, target)
+}
@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestApplyAUFSLayer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	rootfs := path.Join(tmp, "rootfs")
+	for _, dir := range []string{"etc", "opt/app", "var/log"} {
+		if err := os.MkdirAll(path.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/motd", "etc/hosts", "opt/app/bin", "var/log/syslog"} {
+		if err := ioutil.WriteFile(path.Join(rootfs, file), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layer := path.Join(tmp, "layer")
+	for _, dir := range []string{"etc", "opt", "var/log"} {
+		if err := os.MkdirAll(path.Join(layer, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/hosts", "etc/.wh.motd", "opt/.wh..wh..opq", "opt/new", "var/log/syslog", ".wh..wh.aufs"} {
+		if err := ioutil.WriteFile(path.Join(layer, file), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := applyAUFSLayer(layer, rootfs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{"etc/motd", "etc/.wh.motd", "opt/app", "opt/.wh..wh..opq", ".wh..wh.aufs"} {
+		if _, err := os.Lstat(path.Join(rootfs, file)); !os.IsNotExist(err) {
+			t.Errorf("Expected /%s to be removed (%v)", file, err)
+		}
+	}
+	for _, file := range []string{"etc/hosts", "opt/new", "var/log/syslog"} {
+		if data, err := ioutil.ReadFile(path.Join(rootfs, file)); err != nil || string(data) != "new" {
+			t.Errorf("Expected /%s to be the one of the layer, got %q (%v)", file, data, err)
+		}
+	}
+}
+
+func TestChangesBetween(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldRoot, newRoot := path.Join(tmp, "old"), path.Join(tmp, "new")
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, "etc", "hosts"), []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(oldRoot, "tmp", "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(oldRoot, "etc", "motd"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(newRoot, "etc", "motd"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(newRoot, "etc", "resolv.conf"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the directory /etc unchanged
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := os.Chtimes(path.Join(root, "etc"), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path.Join(root, "etc", "hosts"), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := changesBetween(oldRoot, newRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.String())
+	}
+	sort.Strings(got)
+	expected := []string{"A /etc/resolv.conf", "C /etc/motd", "D /tmp"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected changes %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected changes %v, got %v", expected, got)
+		}
+	}
+}
@@ -81,3 +81,25 @@ func sortContainers(containers []*Container, predicate func(i, j *Container) boo
 	s := &containerSorter{containers, predicate}
 	sort.Sort(s)
 }
+
+type networkAliasSorter struct {
+	aliases []NetworkAlias
+	by      func(i, j NetworkAlias) bool
+}
+
+func (s *networkAliasSorter) Len() int {
+	return len(s.aliases)
+}
+
+func (s *networkAliasSorter) Swap(i, j int) {
+	s.aliases[i], s.aliases[j] = s.aliases[j], s.aliases[i]
+}
+
+func (s *networkAliasSorter) Less(i, j int) bool {
+	return s.by(s.aliases[i], s.aliases[j])
+}
+
+func sortNetworkAliases(aliases []NetworkAlias, predicate func(i, j NetworkAlias) bool) {
+	s := &networkAliasSorter{aliases, predicate}
+	sort.Sort(s)
+}
@@ -21,7 +21,7 @@ func TestServerListOrderedImagesByCreationDate(t *testing.T) {
 
 	srv := &Server{runtime: runtime}
 
-	images, err := srv.Images(true, "")
+	images, err := srv.Images(true, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,7 +48,7 @@ func TestServerListOrderedImagesByCreationDateAndTag(t *testing.T) {
 	}
 
 	srv := &Server{runtime: runtime}
-	images, err := srv.Images(true, "")
+	images, err := srv.Images(true, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,152 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/archive"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// mergeAUFSLayer applies the layer src onto the layer dst, both with the
+// whiteouts of AUFS, so that dst holds the changes of both. Unlike
+// applyAUFSLayer, the whiteouts are kept in dst, to hide the files of the
+// layers below it.
+func mergeAUFSLayer(src, dst string) error {
+	var (
+		metadata []string
+		opaque   []string
+	)
+	if err := filepath.Walk(src, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, pth)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		name := f.Name()
+		switch {
+		case name == aufsOpaque:
+			// The directory hides the content of dst too
+			children, err := ioutil.ReadDir(filepath.Dir(target))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if err := os.RemoveAll(filepath.Join(filepath.Dir(target), child.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		case strings.HasPrefix(name, aufsMetaPrefix):
+			metadata = append(metadata, rel)
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(name, aufsWhiteoutPrefix):
+			return os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, aufsWhiteoutPrefix)))
+		}
+		whiteout := filepath.Join(filepath.Dir(target), aufsWhiteoutPrefix+name)
+		if _, err := os.Lstat(whiteout); err == nil {
+			// Deleted by dst and added again: a directory mustn't show the
+			// content it had below dst
+			if err := os.Remove(whiteout); err != nil {
+				return err
+			}
+			if f.IsDir() {
+				opaque = append(opaque, target)
+			}
+		}
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() != f.IsDir() {
+			return os.RemoveAll(target)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to copy the layer %s: %s (%s)", src, err, strings.TrimSpace(string(output)))
+	}
+	for _, rel := range metadata {
+		if err := os.RemoveAll(filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	for _, dir := range opaque {
+		if err := ioutil.WriteFile(filepath.Join(dir, aufsOpaque), nil, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// squashImage registers an image with the filesystem and the config of img
+// whose single layer holds the changes of the images from base, excluded,
+// to img. Its parent is base, which must be an ancestor of img, or nothing
+// when base is nil.
+func (runtime *Runtime) squashImage(img, base *Image, comment string) (*Image, error) {
+	history, err := img.History()
+	if err != nil {
+		return nil, err
+	}
+	var squashed []*Image
+	for _, parent := range history {
+		if base != nil && parent.ID == base.ID {
+			base = parent
+			break
+		}
+		squashed = append(squashed, parent)
+	}
+	if base != nil && len(squashed) == len(history) {
+		return nil, fmt.Errorf("Impossible to squash image %s onto image %s: it isn't one of its ancestors", img.ID, base.ID)
+	}
+
+	tmp, err := runtime.graph.Mktemp("")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return nil, err
+	}
+	// From the bottom up
+	for i := len(squashed) - 1; i >= 0; i-- {
+		layer, err := squashed[i].layer()
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeAUFSLayer(layer, tmp); err != nil {
+			return nil, err
+		}
+	}
+	layerData, err := archive.Tar(tmp, archive.Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+
+	squashedImg := &Image{
+		Comment:         comment,
+		Created:         now(),
+		Container:       img.Container,
+		ContainerConfig: img.ContainerConfig,
+		DockerVersion:   VERSION,
+		Author:          img.Author,
+		Config:          img.Config,
+		Architecture:    img.Architecture,
+	}
+	if base != nil {
+		squashedImg.Parent = base.ID
+	}
+	if err := runtime.graph.Register(nil, layerData, squashedImg); err != nil {
+		return nil, err
+	}
+	return squashedImg, nil
+}
@@ -0,0 +1,119 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/archive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mkLayer creates a layer in dir with the files paths, the ones ending
+// with / being directories
+func mkLayer(t *testing.T, dir string, paths ...string) string {
+	layer, err := ioutil.TempDir(dir, "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range paths {
+		target := filepath.Join(layer, pth)
+		if strings.HasSuffix(pth, "/") {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = ioutil.WriteFile(target, []byte(pth), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return layer
+}
+
+func TestMergeAUFSLayer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-squash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	merged := mkLayer(t, tmp)
+	for _, layer := range []string{
+		mkLayer(t, tmp, "a/one", "b/old", "c/kept"),
+		// Deletes b, and a file of the layers below
+		mkLayer(t, tmp, "a/two", ".wh.b", ".wh.base", ".wh..wh.plnk/123"),
+		// Adds b again, which mustn't show b/old
+		mkLayer(t, tmp, "b/new", "c/.wh..wh..opq", "c/other"),
+	} {
+		if err := mergeAUFSLayer(layer, merged); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	if err := filepath.Walk(merged, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(merged, pth); rel != "." {
+			paths = append(paths, rel)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	expected := []string{".wh.base", "a", "a/one", "a/two", "b", "b/.wh..wh..opq", "b/new", "c", "c/.wh..wh..opq", "c/other"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected the merged layer to hold %v, got %v", expected, paths)
+	}
+}
+
+func TestSquashImage(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	runtime := &Runtime{graph: graph}
+
+	base, err := graph.Create(testArchive(t), nil, "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := base
+	for _, paths := range [][]string{{"app/one"}, {"app/two", ".wh.etc"}} {
+		layerData, err := archive.Tar(mkLayer(t, graph.Root, paths...), archive.Uncompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		child := &Image{Parent: img.ID, Created: time.Now(), Config: &Config{Cmd: []string{"/app/one"}}}
+		if err := graph.Register(nil, layerData, child); err != nil {
+			t.Fatal(err)
+		}
+		img = child
+	}
+
+	squashed, err := runtime.squashImage(img, base, "squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if squashed.Parent != base.ID {
+		t.Fatalf("Expected the squashed image on top of %s, got %s", base.ID, squashed.Parent)
+	}
+	if squashed.Config == nil || len(squashed.Config.Cmd) != 1 || squashed.Config.Cmd[0] != "/app/one" {
+		t.Fatalf("Expected the squashed image to keep the config, got %v", squashed.Config)
+	}
+	layer, err := squashed.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{"app/one", "app/two", ".wh.etc"} {
+		if _, err := os.Lstat(filepath.Join(layer, pth)); err != nil {
+			t.Fatalf("Expected %s in the squashed layer: %s", pth, err)
+		}
+	}
+
+	if _, err := runtime.squashImage(base, img, ""); err == nil {
+		t.Fatal("Squashing an image onto an image which isn't its ancestor should fail")
+	}
+}
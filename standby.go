@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"fmt"
+	"log"
+)
+
+// Standby prepares the container to start without starting it: its
+// filesystem is mounted, its network allocated and its volumes set up, so
+// that Start only has to generate its lxc config and run lxc-start. The
+// container stays in standby until it is started, stopped or killed.
+func (container *Container) Standby() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if container.State.Running {
+		return fmt.Errorf("The container %s is already running.", container.ID)
+	}
+	if container.State.Standby {
+		return nil
+	}
+	if err := container.prepare(); err != nil {
+		container.unprepare()
+		return err
+	}
+	container.State.Standby = true
+	return container.ToDisk()
+}
+
+// releaseStandby gives back the filesystem mount and the network the
+// container holds in standby
+func (container *Container) releaseStandby() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if !container.State.Standby || container.State.Running {
+		return nil
+	}
+	container.unprepare()
+	return container.ToDisk()
+}
+
+// unprepare releases what prepare took. Unlike cleanup, it leaves the
+// streams of the container alone, as it never ran.
+func (container *Container) unprepare() {
+	container.State.Standby = false
+	container.releaseNetwork()
+	if err := container.Unmount(); err != nil {
+		log.Printf("%v: Failed to umount filesystem: %v", container.ID, err)
+	}
+}
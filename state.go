@@ -15,6 +15,41 @@ type State struct {
 	StartedAt  time.Time
 	FinishedAt time.Time
 	Ghost      bool
+	// StoppedOnShutdown is set when the container was stopped by the
+	// daemon exiting, so that it can be restarted with the daemon.
+	StoppedOnShutdown bool
+	// OOMKilled is set when the OOM killer killed a process of the
+	// container since it was started.
+	OOMKilled bool
+	// RestartCount is the number of times the container was started again
+	// after its first start.
+	RestartCount int
+	// LastExit describes how the container last exited. Unlike ExitCode
+	// and OOMKilled, it is kept while the container runs again.
+	LastExit *ExitStatus `json:",omitempty"`
+	// Standby is set while the container is prepared to start, with its
+	// filesystem mounted and its network allocated, but not started.
+	Standby bool
+	// Dead is set once the removal of the container started. A dead
+	// container can't start, its removal was cancelled or failed.
+	Dead bool `json:",omitempty"`
+	// Removal is the progress of the removal of the container while it is
+	// removed in the background
+	Removal string `json:",omitempty"`
+	// Health is the health of the container since it started, if it has
+	// a probe
+	Health *Health `json:",omitempty"`
+}
+
+// ExitStatus describes an exit of a container
+type ExitStatus struct {
+	ExitCode   int
+	OOMKilled  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// The messages of the kernel log about the container while it ran:
+	// its OOM kills, segfaults and AppArmor denials
+	KernelMessages []string `json:",omitempty"`
 }
 
 // String returns a human-readable description of the state
@@ -23,22 +58,68 @@ func (s *State) String() string {
 		if s.Ghost {
 			return fmt.Sprintf("Ghost")
 		}
-		return fmt.Sprintf("Up %s", utils.HumanDuration(time.Now().Sub(s.StartedAt)))
+		if s.Health != nil {
+			return fmt.Sprintf("Up %s (%s)", utils.HumanDuration(now().Sub(s.StartedAt)), s.Health.Status)
+		}
+		return fmt.Sprintf("Up %s", utils.HumanDuration(now().Sub(s.StartedAt)))
+	}
+	if s.Dead {
+		if s.Removal != "" {
+			return s.Removal
+		}
+		return "Dead"
+	}
+	if s.Standby {
+		return "Standby"
+	}
+	if s.OOMKilled {
+		return fmt.Sprintf("Exit %d (OOM killed)", s.ExitCode)
 	}
 	return fmt.Sprintf("Exit %d", s.ExitCode)
 }
 
+// summary returns a copy of what String describes of the state
+func (s *State) summary() *State {
+	summary := &State{
+		Running:    s.Running,
+		ExitCode:   s.ExitCode,
+		StartedAt:  s.StartedAt,
+		FinishedAt: s.FinishedAt,
+		Ghost:      s.Ghost,
+		OOMKilled:  s.OOMKilled,
+		Standby:    s.Standby,
+		Dead:       s.Dead,
+		Removal:    s.Removal,
+	}
+	if s.Health != nil {
+		summary.Health = &Health{Status: s.Health.Status}
+	}
+	return summary
+}
+
 func (s *State) setRunning(pid int) {
+	if !s.StartedAt.IsZero() {
+		s.RestartCount++
+	}
 	s.Running = true
+	s.Standby = false
 	s.Ghost = false
+	s.StoppedOnShutdown = false
+	s.OOMKilled = false
 	s.ExitCode = 0
 	s.Pid = pid
-	s.StartedAt = time.Now()
+	s.StartedAt = now()
 }
 
 func (s *State) setStopped(exitCode int) {
 	s.Running = false
 	s.Pid = 0
-	s.FinishedAt = time.Now()
+	s.FinishedAt = now()
 	s.ExitCode = exitCode
+	s.LastExit = &ExitStatus{
+		ExitCode:   exitCode,
+		OOMKilled:  s.OOMKilled,
+		StartedAt:  s.StartedAt,
+		FinishedAt: s.FinishedAt,
+	}
 }
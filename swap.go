@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// DefaultSwapTimeout is how long the new container of a swap has to become
+// healthy, when no timeout is given
+const DefaultSwapTimeout = 30 * time.Second
+
+// cloneConfig returns the config and host config of a copy of the container
+// running image. The volumes are left out, the copy gets the ones of the
+// container with shareVolumes, and so are the published ports: they are
+// moved to the copy once it is healthy.
+func (container *Container) cloneConfig(image string) (*Config, *HostConfig) {
+	config := *container.Config
+	config.Image = image
+	config.VolumesFrom = ""
+	if config.Hostname == container.ID[:12] {
+		// Let the copy get its own default hostname
+		config.Hostname = ""
+	}
+	config.ExposedPorts = make(map[Port]struct{})
+	for port := range container.Config.ExposedPorts {
+		config.ExposedPorts[port] = struct{}{}
+	}
+
+	hostConfig := HostConfig{}
+	if container.hostConfig != nil {
+		hostConfig = *container.hostConfig
+	}
+	hostConfig.ContainerIDFile = ""
+	hostConfig.PortBindings = nil
+	hostConfig.PublishAllPorts = false
+	hostConfig.NetworkAttach = append([]string{}, hostConfig.NetworkAttach...)
+	return &config, &hostConfig
+}
+
+// shareVolumes gives the container, a copy of from which never started, the
+// volumes of from, including the ones from mounts from others, with the same
+// modes. The copy mounts them by themselves: it still can start once from
+// is removed.
+func (container *Container) shareVolumes(from *Container) error {
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	container.Volumes = make(map[string]string)
+	container.VolumesRW = make(map[string]bool)
+	for volPath, srcPath := range from.Volumes {
+		if err := os.MkdirAll(path.Join(container.RootfsPath(), volPath), 0755); err != nil {
+			return err
+		}
+		container.Volumes[volPath] = srcPath
+		container.VolumesRW[volPath] = from.VolumesRW[volPath]
+	}
+	return container.ToDisk()
+}
+
+// waitHealthy waits until the exposed tcp ports of the running container
+// accept connections, for timeout at most. A container without tcp ports
+// is healthy when it still runs after timeout.
+func (container *Container) waitHealthy(timeout time.Duration) error {
+	var pending []Port
+	for port := range container.Config.ExposedPorts {
+		if port.Proto() == "tcp" {
+			pending = append(pending, port)
+		}
+	}
+	if len(pending) == 0 {
+		container.WaitTimeout(timeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if !container.State.Running {
+			return fmt.Errorf("it exited with code %d", container.State.ExitCode)
+		}
+		var failing []Port
+		for _, port := range pending {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(container.NetworkSettings.IPAddress, port.Port()), time.Second)
+			if err != nil {
+				failing = append(failing, port)
+				continue
+			}
+			conn.Close()
+		}
+		if len(failing) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port %s does not accept connections after %s", failing[0], timeout)
+		}
+		pending = failing
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// movePublishedPorts moves the published ports of the running container from
+// to the running container to, on the same host addresses and ports. The
+// ports stay published all along: they are forwarded to to instead of from,
+// the new connections going to to while the ones open on from are kept.
+func movePublishedPorts(from, to *Container) error {
+	if from.network == nil || to.network == nil {
+		return fmt.Errorf("Impossible to move the ports of container %s: the network of a container is disabled", from.ID)
+	}
+	moved, err := from.network.MovePorts(to.network)
+	if err != nil {
+		return err
+	}
+
+	if to.hostConfig.PortBindings == nil {
+		to.hostConfig.PortBindings = make(map[Port][]PortBinding)
+	}
+	if to.NetworkSettings.Ports == nil {
+		to.NetworkSettings.Ports = make(map[Port][]PortBinding)
+	}
+	for _, nat := range moved {
+		to.Config.ExposedPorts[nat.Port] = struct{}{}
+		to.hostConfig.PortBindings[nat.Port] = append(to.hostConfig.PortBindings[nat.Port], nat.Binding)
+		to.NetworkSettings.Ports[nat.Port] = append(to.NetworkSettings.Ports[nat.Port], nat.Binding)
+		delete(from.hostConfig.PortBindings, nat.Port)
+		if from.NetworkSettings.Ports != nil {
+			from.NetworkSettings.Ports[nat.Port] = nil
+		}
+	}
+
+	for _, container := range []*Container{from, to} {
+		if err := container.writeHostConfig(); err != nil {
+			return err
+		}
+		if err := container.ToDisk(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
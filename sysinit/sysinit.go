@@ -11,6 +11,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
@@ -70,6 +71,19 @@ func changeUser(u string) {
 	}
 }
 
+// Apply the ulimits of the container
+func setupUlimits(ulimits []string) {
+	for _, raw := range ulimits {
+		ulimit, err := utils.ParseUlimit(raw)
+		if err != nil {
+			log.Fatalf("Unable to set up ulimits: %v", err)
+		}
+		if err := ulimit.Set(); err != nil {
+			log.Fatalf("Unable to set ulimit %v: %v", ulimit, err)
+		}
+	}
+}
+
 // Clear environment pollution introduced by lxc-start
 func cleanupEnv() {
 	os.Clearenv()
@@ -91,6 +105,15 @@ func cleanupEnv() {
 	}
 }
 
+// Complete the socket activation protocol for the sockets passed by the
+// daemon: LISTEN_PID is the pid of the program, which exec preserves
+func setupListenFds() {
+	if os.Getenv("LISTEN_FDS") == "" {
+		return
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+}
+
 func executeProgram(name string, args []string) {
 	path, err := exec.LookPath(name)
 	if err != nil {
@@ -103,6 +126,64 @@ func executeProgram(name string, args []string) {
 	}
 }
 
+// Run the program as the child of a minimal init which forwards it the
+// signals and reaps the zombies reparented to pid 1. The program is started
+// through dockerinit -exec so that LISTEN_PID can be set to its own pid.
+// Exit with the status of the program.
+func runInit(args []string) {
+	sigchan := make(chan os.Signal, 32)
+	signal.Notify(sigchan)
+
+	cmd := exec.Command(utils.SelfPath(), append([]string{"-exec", "--"}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = listenFiles()
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Unable to start %v: %v", args[0], err)
+	}
+
+	for sig := range sigchan {
+		switch sig {
+		case syscall.SIGCHLD:
+		case syscall.SIGPIPE, syscall.SIGURG:
+			// The broken pipes of the init and the preemption of the Go
+			// runtime are its own
+			continue
+		default:
+			cmd.Process.Signal(sig)
+			continue
+		}
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid != cmd.Process.Pid {
+				continue
+			}
+			if status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(status.ExitStatus())
+		}
+	}
+}
+
+// The sockets passed by the daemon, to hand down to the program
+func listenFiles() []*os.File {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(3+i), fmt.Sprintf("listen-fd-%d", i))
+	}
+	return files
+}
+
 // Sys Init code
 // This code is run INSIDE the container and is responsible for setting
 // up the environment before running the actual process
@@ -114,12 +195,28 @@ func SysInit() {
 	var u = flag.String("u", "", "username or uid")
 	var gw = flag.String("g", "", "gateway address")
 	var workdir = flag.String("w", "", "workdir")
+	var initMode = flag.Bool("init", false, "run the program under a minimal init")
+	var ulimits utils.ListOpts
+	flag.Var(&ulimits, "ulimit", "ulimit")
+	var execOnly = flag.Bool("exec", false, "only exec the program, the environment is already set up")
 
 	flag.Parse()
 
+	if *execOnly {
+		setupListenFds()
+		executeProgram(flag.Arg(0), flag.Args())
+		return
+	}
+
 	cleanupEnv()
 	setupNetworking(*gw)
 	setupWorkingDirectory(*workdir)
+	setupUlimits(ulimits)
 	changeUser(*u)
+	if *initMode {
+		runInit(flag.Args())
+		return
+	}
+	setupListenFds()
 	executeProgram(flag.Arg(0), flag.Args())
 }
@@ -66,6 +66,18 @@ func (store *TagStore) Reload() error {
 }
 
 func (store *TagStore) LookupImage(name string) (*Image, error) {
+	// The image pinned by digest, whatever the repository it was pulled from
+	if _, digest := utils.ParseRepositoryDigest(name); digest != "" {
+		id, err := digestID(digest)
+		if err != nil {
+			return nil, err
+		}
+		img, err := store.graph.Get(id)
+		if err != nil || img.ID != id {
+			return nil, fmt.Errorf("No such image: %s", name)
+		}
+		return img, nil
+	}
 	img, err := store.graph.Get(name)
 	if err != nil {
 		// FIXME: standardize on returning nil when the image doesn't exist, and err for everything else
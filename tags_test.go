@@ -1,6 +1,9 @@
 package docker
 
 import (
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +47,29 @@ func TestLookupImage(t *testing.T) {
 		t.Errorf("Expected 1 image, none found")
 	}
 }
+
+func TestLookupImageByDigest(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := graph.Create(testArchive(t), nil, "pinned", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := store.LookupImage("app@" + digestPrefix + img.ID); err != nil {
+		t.Fatal(err)
+	} else if found.ID != img.ID {
+		t.Fatalf("Expected image %s, got %s", img.ID, found.ID)
+	}
+	if _, err := store.LookupImage("app@" + digestPrefix + img.ID[:12]); err == nil {
+		t.Fatal("A truncated digest should be refused")
+	}
+	other := strings.Repeat("0", 64)
+	if _, err := store.LookupImage("app@" + digestPrefix + other); err == nil || !strings.HasPrefix(err.Error(), "No such image") {
+		t.Fatalf("Expected no such image, got %v", err)
+	}
+}
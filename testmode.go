@@ -0,0 +1,108 @@
+package docker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The sources the ids and the times of containers, images and events come
+// from. The daemon test mode replaces them with deterministic ones, so that
+// test suites comparing the state of several runs get the same ids and dates.
+var (
+	idEntropy io.Reader = rand.Reader
+	now                 = time.Now
+)
+
+// testModeEpoch is the time the mock clock of the test mode starts at
+var testModeEpoch = time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// seededReader is an endless stream of bytes derived from a seed: the
+// sha256 sums of the seed followed by a counter, one block after the other
+type seededReader struct {
+	sync.Mutex
+	seed    []byte
+	counter uint64
+	block   []byte
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for n < len(p) {
+		if len(r.block) == 0 {
+			counter := make([]byte, 8)
+			binary.BigEndian.PutUint64(counter, r.counter)
+			r.counter++
+			h := sha256.New()
+			h.Write(r.seed)
+			h.Write(counter)
+			r.block = h.Sum(nil)
+		}
+		copied := copy(p[n:], r.block)
+		r.block = r.block[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// mockClock returns the same time until it is told to move forward, so that
+// the dates of a test run only depend on the steps of the test suite
+type mockClock struct {
+	sync.Mutex
+	current time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.current
+}
+
+// Advance moves the clock forward by d
+func (c *mockClock) Advance(d time.Duration) {
+	c.Lock()
+	c.current = c.current.Add(d)
+	c.Unlock()
+}
+
+// testClock is the mock clock of the test mode, nil out of it
+var testClock *mockClock
+
+// testMode reports whether ids and times are deterministic
+func testMode() bool {
+	_, ok := idEntropy.(*seededReader)
+	return ok
+}
+
+// enableTestMode makes the ids derive from seed and the times come from a
+// mock clock starting at testModeEpoch, which only moves forward when
+// advanceTestClock is called. It returns a function restoring the random ids
+// and the real clock.
+func enableTestMode(seed string) func() {
+	testClock = &mockClock{current: testModeEpoch}
+	idEntropy = &seededReader{seed: []byte(seed)}
+	now = testClock.Now
+	return func() {
+		idEntropy = rand.Reader
+		now = time.Now
+		testClock = nil
+	}
+}
+
+// advanceTestClock moves the mock clock of the test mode forward by d
+func advanceTestClock(d time.Duration) error {
+	if testClock == nil {
+		return fmt.Errorf("Impossible to move the clock: the daemon is not in test mode")
+	}
+	if d < 0 {
+		return fmt.Errorf("Bad parameter: the clock only moves forward")
+	}
+	testClock.Advance(d)
+	return nil
+}
@@ -0,0 +1,378 @@
+package docker
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// An ImageSignature signs the id of an image, derived from its content and
+// the ones of its ancestors, with the private key of PublicKey. The
+// signatures are in the json of the image, out of its id, so that signing
+// an image doesn't change it.
+type ImageSignature struct {
+	// The public key, DER-encoded PKIX, in base64
+	PublicKey string `json:"public_key"`
+	// The RSA PKCS #1 v1.5 or the ECDSA signature of the sha256 of
+	// sha256:ID, in base64
+	Signature string `json:"signature"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// signedHash returns what the signatures of the image id sign
+func signedHash(id string) []byte {
+	sum := sha256.Sum256([]byte(digestPrefix + id))
+	return sum[:]
+}
+
+// SignImageID signs the image id with the private key, RSA or ECDSA
+func SignImageID(id string, key crypto.PrivateKey) (*ImageSignature, error) {
+	var (
+		public    interface{}
+		signature []byte
+		err       error
+	)
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		public = &key.PublicKey
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, signedHash(id))
+	case *ecdsa.PrivateKey:
+		public = &key.PublicKey
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, signedHash(id)); err == nil {
+			signature, err = asn1.Marshal(ecdsaSignature{r, s})
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported private key: expected an RSA or an ECDSA key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageSignature{
+		PublicKey: base64.StdEncoding.EncodeToString(der),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
+
+// verify checks that sig is a signature of the image id by its key
+func (sig *ImageSignature) verify(id string) error {
+	der, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, signedHash(id), signature); err != nil {
+			return fmt.Errorf("invalid signature: %s", err)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var es ecdsaSignature
+		if _, err := asn1.Unmarshal(signature, &es); err != nil || es.R == nil || es.S == nil {
+			return fmt.Errorf("invalid signature")
+		}
+		if !ecdsa.Verify(public, signedHash(id), es.R, es.S) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key: expected an RSA or an ECDSA key")
+}
+
+// ReadPrivateKey reads the RSA or ECDSA private key in the PEM file path
+func ReadPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Invalid private key %s: no PEM block", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("Invalid private key %s: unexpected %s", path, block.Type)
+}
+
+// readPublicKey reads the RSA or ECDSA public key in the PEM file path,
+// and returns it DER-encoded
+func readPublicKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("expected a PEM PUBLIC KEY block")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return block.Bytes, nil
+	}
+	return nil, fmt.Errorf("unsupported public key: expected an RSA or an ECDSA key")
+}
+
+// verifyImageTrust checks that the image id described by jsonData can be
+// trusted with keys, DER-encoded public keys: its id must be derived from
+// its content, and it must be signed with one of keys
+func verifyImageTrust(id string, jsonData []byte, keys [][]byte) error {
+	var description struct {
+		LayerDigest string           `json:"layer_digest"`
+		Signatures  []ImageSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(jsonData, &description); err != nil {
+		return err
+	}
+	if description.LayerDigest == "" {
+		return fmt.Errorf("Forbidden, the image %s isn't described with the digest of its layer, its content can't be trusted", utils.TruncateID(id))
+	}
+	if contentID, err := contentID(jsonData); err != nil {
+		return err
+	} else if contentID != id {
+		return fmt.Errorf("Forbidden, the image %s is corrupted: its content is the one of image %s", utils.TruncateID(id), utils.TruncateID(contentID))
+	}
+	for _, sig := range description.Signatures {
+		der, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if bytes.Equal(der, key) && sig.verify(id) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Forbidden, the image %s isn't signed with a trusted key", utils.TruncateID(id))
+}
+
+// trustedKeys returns the keys the images of the registry of endpoint must
+// be signed with, nil when the registry has no such policy
+func (srv *Server) trustedKeys(endpoint string) [][]byte {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil
+	}
+	return srv.RegistryConfig().trustedKeys[u.Host]
+}
+
+// repositoryHost returns the host of the registry of the repository
+// repoName, as registry.ResolveRepositoryName finds it but without reaching
+// the registry
+func repositoryHost(repoName string) string {
+	nameParts := strings.SplitN(repoName, "/", 2)
+	if len(nameParts) < 2 || (!strings.Contains(nameParts[0], ".") && !strings.Contains(nameParts[0], ":") && nameParts[0] != "localhost") {
+		u, err := url.Parse(auth.IndexServerAddress())
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	return nameParts[0]
+}
+
+// checkImageTrust checks the image name before a container is created
+// from it, when it is in a repository of a registry whose images must be
+// signed, whether it is named by repository, digest or id: the image and
+// its ancestors must be described with the digests of their layers, and the
+// image signed with a key each such registry trusts.
+func (srv *Server) checkImageTrust(name string) error {
+	img, err := srv.runtime.repositories.LookupImage(name)
+	if err != nil || img == nil {
+		// The creation reports the missing image
+		return nil
+	}
+	// The repository the image is named with, and the ones it is tagged in
+	repoNames := make(map[string]bool)
+	repoName, digest := utils.ParseRepositoryDigest(name)
+	repoName, _ = utils.ParseRepositoryTag(repoName)
+	if _, exists := srv.runtime.repositories.Repositories[repoName]; exists || digest != "" {
+		repoNames[repoName] = true
+	}
+	for _, tagged := range srv.runtime.repositories.ByID()[img.ID] {
+		repoName, _ := utils.ParseRepositoryTag(tagged)
+		repoNames[repoName] = true
+	}
+	var policies [][][]byte
+	trustedKeys := srv.RegistryConfig().trustedKeys
+	hosts := make(map[string]bool)
+	for repoName := range repoNames {
+		host := repositoryHost(repoName)
+		if hosts[host] {
+			continue
+		}
+		hosts[host] = true
+		if keys := trustedKeys[host]; keys != nil {
+			policies = append(policies, keys)
+		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+
+	if err := img.WalkHistory(func(ancestor *Image) error {
+		if ancestor.LayerDigest == "" {
+			return fmt.Errorf("Forbidden, the image %s isn't described with the digest of its layer, its content can't be trusted", utils.TruncateID(ancestor.ID))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(srv.runtime.graph.imageRoot(img.ID)))
+	if err != nil {
+		return err
+	}
+	for _, keys := range policies {
+		if err := verifyImageTrust(img.ID, jsonData, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullSignatures verifies the json of the image imgID in the registry at
+// endpoint with keys, before its layers are downloaded. When the image is
+// there already, its signatures are updated with the ones of the registry.
+func (srv *Server) pullSignatures(r *registry.Registry, imgID, endpoint string, token []string, keys [][]byte) error {
+	jsonData, _, err := r.GetRemoteImageJSON(imgID, endpoint, token)
+	if err != nil {
+		return err
+	}
+	if err := verifyImageTrust(imgID, jsonData, keys); err != nil {
+		return err
+	}
+	if !srv.runtime.graph.Exists(imgID) {
+		return nil
+	}
+	img, err := srv.runtime.graph.Get(imgID)
+	if err != nil {
+		return err
+	}
+	remote, err := NewImgJSON(jsonData)
+	if err != nil {
+		return err
+	}
+	return srv.runtime.graph.setSignatures(img, mergeSignatures(remote.Signatures, img.Signatures))
+}
+
+// mergeSignatures returns the signatures, then the others made with another
+// key
+func mergeSignatures(signatures, others []ImageSignature) []ImageSignature {
+	merged := append([]ImageSignature{}, signatures...)
+	for _, other := range others {
+		found := false
+		for _, sig := range signatures {
+			if sig.PublicKey == other.PublicKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, other)
+		}
+	}
+	return merged
+}
+
+// setSignatures replaces the signatures in the json of img, whose id is
+// derived from its content. The rest of the json is kept as it is written,
+// for the id to stay the same.
+func (graph *Graph) setSignatures(img *Image, signatures []ImageSignature) error {
+	path := jsonPath(graph.imageRoot(img.ID))
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var description map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&description); err != nil {
+		return err
+	}
+	description["signatures"] = signatures
+	if jsonData, err = json.Marshal(description); err != nil {
+		return err
+	}
+	if id, err := contentID(jsonData); err != nil {
+		return err
+	} else if id != img.ID {
+		return fmt.Errorf("Impossible to sign image %s: its id isn't derived from its content", utils.TruncateID(img.ID))
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, jsonData, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	img.Signatures = signatures
+	return nil
+}
+
+// ImageSign adds the signature sig, made by the client with its private
+// key, to the json of the image name. A signature with the same key
+// replaces the previous one.
+func (srv *Server) ImageSign(name string, sig *ImageSignature) error {
+	img, err := srv.runtime.repositories.LookupImage(name)
+	if err != nil || img == nil {
+		return fmt.Errorf("No such image: %s", name)
+	}
+	if err := img.WalkHistory(func(ancestor *Image) error {
+		if ancestor.LayerDigest == "" {
+			return fmt.Errorf("Impossible to sign image %s: the id of %s isn't derived from its content, build or commit it again", name, utils.TruncateID(ancestor.ID))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := sig.verify(img.ID); err != nil {
+		return fmt.Errorf("Bad parameter signature: %s", err)
+	}
+	if err := srv.runtime.graph.setSignatures(img, mergeSignatures([]ImageSignature{*sig}, img.Signatures)); err != nil {
+		return err
+	}
+	srv.LogEvent("sign", utils.TruncateID(img.ID), "")
+	return nil
+}
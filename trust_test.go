@@ -0,0 +1,171 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestVerifyImageTrust(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData := []byte(`{"parent":"","created":"2013-10-01T00:00:00Z","layer_digest":"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855","Size":0}`)
+	id, err := contentID(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID := strings.Repeat("0", 64)
+	var description map[string]interface{}
+	if err := json.Unmarshal(jsonData, &description); err != nil {
+		t.Fatal(err)
+	}
+	var signatures []*ImageSignature
+	for _, key := range []interface{}{rsaKey, ecKey} {
+		sig, err := SignImageID(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sig.verify(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := sig.verify(otherID); err == nil {
+			t.Error("Expected the signature of another id to be rejected")
+		}
+		signatures = append(signatures, sig)
+	}
+	description["id"] = id
+	description["signatures"] = signatures
+	signed, err := json.Marshal(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signedID, err := contentID(signed); err != nil {
+		t.Fatal(err)
+	} else if signedID != id {
+		t.Fatalf("Signing an image shouldn't change its id, got %s, expected %s", signedID, id)
+	}
+
+	der := func(sig *ImageSignature) []byte {
+		data, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	otherDer, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range [][][]byte{{der(signatures[0])}, {otherDer, der(signatures[1])}} {
+		if err := verifyImageTrust(id, signed, keys); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := verifyImageTrust(id, signed, [][]byte{otherDer}); err == nil {
+		t.Error("Expected an image signed with untrusted keys to be rejected")
+	}
+	if err := verifyImageTrust(id, jsonData, [][]byte{der(signatures[0])}); err == nil {
+		t.Error("Expected an image without signature to be rejected")
+	}
+	if err := verifyImageTrust(otherID, signed, [][]byte{der(signatures[0])}); err == nil {
+		t.Error("Expected an image whose id isn't derived from its content to be rejected")
+	}
+}
+
+func TestLoadRegistryConfigTrustedKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(tmp, "key.pub")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(tmp, "registry.json")
+	if err := ioutil.WriteFile(file, []byte(`{"TrustedKeys": {"registry.lan:5000": ["`+keyFile+`"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadRegistryConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := config.trustedKeys["registry.lan:5000"]; len(keys) != 1 || string(keys[0]) != string(der) {
+		t.Errorf("Expected the key of %s to be trusted for registry.lan:5000, got %v", keyFile, config.trustedKeys)
+	}
+
+	for _, invalid := range []string{
+		`{"TrustedKeys": {"registry.lan": []}}`,
+		`{"TrustedKeys": {"https://registry.lan": ["` + keyFile + `"]}}`,
+		`{"TrustedKeys": {"registry.lan": ["` + file + `"]}}`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRegistryConfig(file); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestCheckImageTrust(t *testing.T) {
+	srv := tempSaveServer(t)
+	defer os.RemoveAll(srv.runtime.graph.Root)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.registryConfig = &RegistryConfig{trustedKeys: map[string][][]byte{"registry.lan:5000": {der}}}
+
+	unsigned, err := srv.runtime.graph.Create(testArchive(t), nil, "unsigned", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.checkImageTrust(unsigned.ID); err != nil {
+		t.Fatalf("Expected an image of no repository to be trusted, got %s", err)
+	}
+	if err := srv.runtime.repositories.Set("registry.lan:5000/app", "latest", unsigned.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"registry.lan:5000/app", unsigned.ID, utils.TruncateID(unsigned.ID)} {
+		if err := srv.checkImageTrust(name); err == nil || !strings.HasPrefix(err.Error(), "Forbidden") {
+			t.Errorf("Expected the unsigned image named %s to be refused, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// upgradeListenersEnv is the environment variable through which the daemon
+// hands its API sockets to the binary it upgrades to, as proto://addr=fd
+// separated by commas, so that no connection is refused meanwhile
+const upgradeListenersEnv = "DOCKER_UPGRADE_LISTENERS"
+
+var (
+	inheritedListeners     map[string]*os.File
+	inheritedListenersOnce sync.Once
+)
+
+// inheritedListener returns the API socket of protoAddr handed over by the
+// daemon this one was upgraded from, if any
+func inheritedListener(protoAddr string) *os.File {
+	inheritedListenersOnce.Do(func() {
+		inheritedListeners = make(map[string]*os.File)
+		for _, listener := range strings.Split(os.Getenv(upgradeListenersEnv), ",") {
+			i := strings.LastIndex(listener, "=")
+			if i < 0 {
+				continue
+			}
+			fd, err := strconv.Atoi(listener[i+1:])
+			if err != nil {
+				continue
+			}
+			inheritedListeners[listener[:i]] = os.NewFile(uintptr(fd), listener[:i])
+		}
+		// Not for the containers, emptied as there is no os.Unsetenv
+		os.Setenv(upgradeListenersEnv, "")
+	})
+	return inheritedListeners[protoAddr]
+}
+
+// listen returns the API socket of addr, the one the previous daemon handed
+// over after a self-upgrade if any, and keeps a copy to hand it over again
+func (srv *Server) listen(proto, addr string) (net.Listener, error) {
+	protoAddr := proto + "://" + addr
+	var (
+		l   net.Listener
+		err error
+	)
+	if f := inheritedListener(protoAddr); f != nil {
+		utils.Debugf("Using the socket of %s handed over by the previous daemon", protoAddr)
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen(proto, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filer, ok := l.(interface {
+		File() (*os.File, error)
+	}); ok {
+		if f, err := filer.File(); err != nil {
+			utils.Errorf("Unable to keep the socket of %s for the upgrades: %s", protoAddr, err)
+		} else {
+			srv.Lock()
+			srv.apiListeners[protoAddr] = f
+			srv.Unlock()
+		}
+	}
+	return l, nil
+}
+
+// loadUpgradeKey reads the ECDSA public key in the PEM file keyFile
+func loadUpgradeKey(keyFile string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("expected a PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ECDSA public key")
+	}
+	return ecdsaKey, nil
+}
+
+// verifyRelease checks that sig is the signature of the manifest of a release
+// with the sha256 sum by the private key of key, DER encoded, as made by
+// `openssl dgst -sha256 -sign`
+func verifyRelease(key *ecdsa.PublicKey, sum, sig []byte) error {
+	var ecdsaSig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &ecdsaSig); err != nil || len(rest) != 0 {
+		return fmt.Errorf("malformed signature")
+	}
+	if !ecdsa.Verify(key, sum, ecdsaSig.R, ecdsaSig.S) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// releaseManifest describes a release, the signature of its manifest
+// binding the binary to its version and platform
+type releaseManifest struct {
+	Version string
+	Os      string
+	Arch    string
+	// The hex sha256 sum of the binary
+	Sha256 string
+}
+
+// parseReleaseManifest parses the manifest of a release, which must be for
+// the platform of the daemon and, unless force, newer than it
+func parseReleaseManifest(data []byte, force bool) (*releaseManifest, error) {
+	manifest := &releaseManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %s", err)
+	}
+	if manifest.Version == "" || manifest.Sha256 == "" {
+		return nil, fmt.Errorf("malformed manifest: a version and a sha256 are required")
+	}
+	if manifest.Os != runtime.GOOS || manifest.Arch != runtime.GOARCH {
+		return nil, fmt.Errorf("the release is for %s/%s, not %s/%s", manifest.Os, manifest.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	if !force && !versionNewer(manifest.Version, VERSION) {
+		return nil, fmt.Errorf("the release %s is not newer than %s, force it to downgrade", manifest.Version, VERSION)
+	}
+	return manifest, nil
+}
+
+// versionNewer tells whether the version a, e.g. 0.6.7, is newer than b,
+// their suffixes such as -dev left aside
+func versionNewer(a, b string) bool {
+	parse := func(version string) []int {
+		var parts []int
+		for _, part := range strings.Split(strings.SplitN(version, "-", 2)[0], ".") {
+			n, _ := strconv.Atoi(part)
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	va, vb := parse(a), parse(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var na, nb int
+		if i < len(va) {
+			na = va[i]
+		}
+		if i < len(vb) {
+			nb = vb[i]
+		}
+		if na != nb {
+			return na > nb
+		}
+	}
+	return false
+}
+
+// downloadAll returns the content at url
+func downloadAll(url string, out io.Writer) ([]byte, error) {
+	resp, err := utils.Download(url, out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// SelfUpgrade downloads the release of the daemon at url, or at -upgrade-url
+// when url is empty, checks it against its manifest at url.manifest, whose
+// signature at url.manifest.sig is checked against -upgrade-key, and
+// replaces the binary of the daemon with it. Only a newer release for the
+// same platform is installed, unless force. The daemon then runs the new
+// binary in its place, with the same pid and sockets: the running
+// containers are kept and found again, as after a restart without
+// -stop-containers.
+func (srv *Server) SelfUpgrade(url string, force bool, out io.Writer, sf *utils.StreamFormatter) error {
+	config := srv.runtime.config
+	if config.UpgradeKeyFile == "" {
+		return fmt.Errorf("Impossible to upgrade the daemon: it has no -upgrade-key to verify the releases with")
+	}
+	key, err := loadUpgradeKey(config.UpgradeKeyFile)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		url = config.UpgradeURL
+	}
+	if url == "" {
+		return fmt.Errorf("Bad parameter url: the daemon has no -upgrade-url")
+	}
+
+	srv.Lock()
+	if srv.upgrading {
+		srv.Unlock()
+		return fmt.Errorf("Conflict, the daemon is already being upgraded")
+	}
+	srv.upgrading = true
+	srv.Unlock()
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			srv.Lock()
+			srv.upgrading = false
+			srv.Unlock()
+		}
+	}()
+
+	manifestData, err := downloadAll(url+".manifest", out)
+	if err != nil {
+		return fmt.Errorf("Unable to download the manifest of %s: %s", url, err)
+	}
+	sig, err := downloadAll(url+".manifest.sig", out)
+	if err != nil {
+		return fmt.Errorf("Unable to download the signature of the manifest of %s: %s", url, err)
+	}
+	manifestSum := sha256.Sum256(manifestData)
+	if err := verifyRelease(key, manifestSum[:], sig); err != nil {
+		return fmt.Errorf("Impossible to upgrade the daemon: the manifest of %s doesn't match its signature (%s)", url, err)
+	}
+	manifest, err := parseReleaseManifest(manifestData, force)
+	if err != nil {
+		return fmt.Errorf("Impossible to upgrade the daemon to %s: %s", url, err)
+	}
+
+	self := utils.SelfPath()
+	tmp := self + ".upgrade"
+	defer os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out.Write(sf.FormatStatus("", "Downloading %s", url))
+	resp, err := utils.Download(url, out)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sum), utils.ProgressReader(resp.Body, int(resp.ContentLength), out, sf.FormatProgress("", "Downloading", "%8v/%v (%v)"), sf, true)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(sum.Sum(nil)) != strings.ToLower(manifest.Sha256) {
+		return fmt.Errorf("Impossible to upgrade the daemon: the release at %s doesn't match its manifest", url)
+	}
+
+	version, err := exec.Command(tmp, "-v").Output()
+	if err != nil {
+		return fmt.Errorf("Impossible to upgrade the daemon: the release at %s doesn't run (%s)", url, err)
+	}
+	if err := os.Rename(tmp, self); err != nil {
+		return err
+	}
+	upgraded = true
+	out.Write(sf.FormatStatus("", "Upgraded to %s, restarting the daemon", strings.TrimSpace(string(version))))
+
+	// Give the response the time to reach the client
+	time.AfterFunc(time.Second, func() { srv.execUpgraded(self) })
+	return nil
+}
+
+// execUpgraded runs the upgraded binary of the daemon in place of this one,
+// handing it the API sockets. The containers aren't stopped: they are
+// children of the same pid.
+func (srv *Server) execUpgraded(self string) {
+	var listeners []string
+	srv.Lock()
+	for protoAddr, f := range srv.apiListeners {
+		// The sockets must survive the exec
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+			utils.Errorf("Unable to hand the socket of %s over to the upgraded daemon: %s", protoAddr, errno)
+			continue
+		}
+		listeners = append(listeners, fmt.Sprintf("%s=%d", protoAddr, f.Fd()))
+	}
+	srv.Unlock()
+
+	log.Printf("Restarting the daemon with the upgraded binary %s\n", self)
+	utils.RemovePidFile(srv.runtime.config.Pidfile)
+	if err := srv.runtime.Close(); err != nil {
+		utils.Errorf("Unable to close the runtime: %s", err)
+	}
+	env := append(os.Environ(), upgradeListenersEnv+"="+strings.Join(listeners, ","))
+	err := syscall.Exec(self, os.Args, env)
+	log.Fatalf("Unable to run the upgraded daemon %s: %s", self, err)
+}
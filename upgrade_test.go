@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+func TestVerifyRelease(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "docker-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "release.pub")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadUpgradeKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("docker release"))
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyRelease(key, sum[:], sig); err != nil {
+		t.Fatalf("The signature of the release should be valid: %s", err)
+	}
+
+	otherSum := sha256.Sum256([]byte("tampered release"))
+	if err := verifyRelease(key, otherSum[:], sig); err == nil {
+		t.Fatal("The signature of another release should be invalid")
+	}
+	if err := verifyRelease(key, sum[:], sig[:len(sig)-1]); err == nil {
+		t.Fatal("A truncated signature should be invalid")
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUpgradeKey(keyFile); err == nil {
+		t.Fatal("Loading a file without a PEM key should fail")
+	}
+}
+
+func TestParseReleaseManifest(t *testing.T) {
+	defer func(version string) { VERSION = version }(VERSION)
+	VERSION = "0.6.6"
+	manifest := func(version, os, arch string) []byte {
+		data, err := json.Marshal(&releaseManifest{Version: version, Os: os, Arch: arch, Sha256: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if _, err := parseReleaseManifest(manifest("99.0.0", runtime.GOOS, runtime.GOARCH), false); err != nil {
+		t.Fatalf("A newer release should be accepted: %s", err)
+	}
+	if _, err := parseReleaseManifest(manifest("0.1.0", runtime.GOOS, runtime.GOARCH), false); err == nil {
+		t.Fatal("An older release should be refused")
+	}
+	if _, err := parseReleaseManifest(manifest("0.1.0", runtime.GOOS, runtime.GOARCH), true); err != nil {
+		t.Fatalf("An older release should be accepted when forced: %s", err)
+	}
+	if _, err := parseReleaseManifest(manifest("99.0.0", "plan9", runtime.GOARCH), true); err == nil {
+		t.Fatal("A release for another platform should be refused")
+	}
+	if _, err := parseReleaseManifest([]byte(`{"Version":"99.0.0"}`), false); err == nil {
+		t.Fatal("A manifest without sha256 should be refused")
+	}
+
+	for _, test := range []struct {
+		a, b  string
+		newer bool
+	}{
+		{"0.6.7", "0.6.6-dev", true},
+		{"0.7", "0.6.6", true},
+		{"0.6.6", "0.6.6-dev", false},
+		{"0.6.10", "0.6.9", true},
+		{"0.6.5", "0.6.6", false},
+	} {
+		if versionNewer(test.a, test.b) != test.newer {
+			t.Errorf("Expected %s newer than %s: %v", test.a, test.b, test.newer)
+		}
+	}
+}
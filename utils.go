@@ -1,11 +1,19 @@
 package docker
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/dotcloud/docker/namesgenerator"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
 // Compare two Config struct. Do not compare the "Image" nor "Hostname" fields
@@ -32,7 +40,9 @@ func CompareConfig(a, b *Config) bool {
 		len(a.PortSpecs) != len(b.PortSpecs) ||
 		len(a.ExposedPorts) != len(b.ExposedPorts) ||
 		len(a.Entrypoint) != len(b.Entrypoint) ||
-		len(a.Volumes) != len(b.Volumes) {
+		len(a.Volumes) != len(b.Volumes) ||
+		len(a.Labels) != len(b.Labels) ||
+		len(a.OnBuild) != len(b.OnBuild) {
 		return false
 	}
 
@@ -71,6 +81,16 @@ func CompareConfig(a, b *Config) bool {
 			return false
 		}
 	}
+	for key, value := range a.Labels {
+		if v, exists := b.Labels[key]; !exists || v != value {
+			return false
+		}
+	}
+	for i := 0; i < len(a.OnBuild); i++ {
+		if a.OnBuild[i] != b.OnBuild[i] {
+			return false
+		}
+	}
 	return true
 }
 
@@ -160,6 +180,9 @@ func MergeConfig(userConf, imageConf *Config) error {
 	if userConf.Cmd == nil || len(userConf.Cmd) == 0 {
 		userConf.Cmd = imageConf.Cmd
 	}
+	if userConf.StopSignal == "" {
+		userConf.StopSignal = imageConf.StopSignal
+	}
 	if userConf.Dns == nil || len(userConf.Dns) == 0 {
 		userConf.Dns = imageConf.Dns
 	} else {
@@ -182,9 +205,86 @@ func MergeConfig(userConf, imageConf *Config) error {
 			userConf.Volumes[k] = v
 		}
 	}
+	if len(imageConf.Labels) > 0 {
+		userConf.Labels = mergeLabels(imageConf.Labels, userConf.Labels)
+	}
+	if userConf.Healthcheck == nil {
+		userConf.Healthcheck = imageConf.Healthcheck
+	}
 	return nil
 }
 
+// mergeLabels returns the labels of base and the ones of override, which
+// take precedence
+func mergeLabels(base, override map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range override {
+		labels[k] = v
+	}
+	return labels
+}
+
+// parseLabels parses labels given as key=value. A key alone sets an empty
+// label.
+func parseLabels(rawLabels []string) (map[string]string, error) {
+	if len(rawLabels) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(rawLabels))
+	for _, rawLabel := range rawLabels {
+		parts := strings.SplitN(rawLabel, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid label: %s", rawLabel)
+		}
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels, nil
+}
+
+// matchLabels returns whether labels has all the given filters, which are
+// either a key alone or key=value
+func matchLabels(labels map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "=", 2)
+		value, exists := labels[parts[0]]
+		if !exists || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFilters parses list filters given as name=value, and returns the
+// values of each filter. Only the names in valid are accepted.
+func parseFilters(rawFilters []string, valid ...string) (map[string][]string, error) {
+	filters := make(map[string][]string)
+	for _, rawFilter := range rawFilters {
+		parts := strings.SplitN(rawFilter, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Bad parameter filter: %s", rawFilter)
+		}
+		found := false
+		for _, name := range valid {
+			if parts[0] == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Bad parameter filter: unknown filter %s", parts[0])
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
+	return filters, nil
+}
+
 func parseLxcConfOpts(opts utils.ListOpts) ([]KeyValuePair, error) {
 	out := make([]KeyValuePair, len(opts))
 	for i, o := range opts {
@@ -212,6 +312,25 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 	bindings := make(map[Port][]PortBinding)
 
 	for _, rawPort := range ports {
+		if strings.HasPrefix(rawPort, "unix://") {
+			port, binding, err := parseUnixPortSpec(rawPort)
+			if err != nil {
+				return nil, nil, err
+			}
+			exposedPorts[port] = struct{}{}
+			bindings[port] = append(bindings[port], binding)
+			continue
+		}
+
+		var mode, ifaceName string
+		if i := strings.LastIndex(rawPort, "@"); i != -1 {
+			var err error
+			if mode, ifaceName, err = parsePublishMode(rawPort[i+1:]); err != nil {
+				return nil, nil, err
+			}
+			rawPort = rawPort[:i]
+		}
+
 		proto := "tcp"
 		if i := strings.LastIndex(rawPort, "/"); i != -1 {
 			proto = rawPort[i+1:]
@@ -240,6 +359,9 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 		if _, err := strconv.ParseUint(hostPort, 10, 16); hostPort != "" && err != nil {
 			return nil, nil, fmt.Errorf("Invalid hostPort: %s", hostPort)
 		}
+		if mode != "" && rawIp != "" {
+			return nil, nil, fmt.Errorf("Conflicting options: host ip %s and publish mode %s", rawIp, mode)
+		}
 
 		port := NewPort(proto, containerPort)
 		if _, exists := exposedPorts[port]; !exists {
@@ -247,8 +369,10 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 		}
 
 		binding := PortBinding{
-			HostIp:   rawIp,
-			HostPort: hostPort,
+			HostIp:    rawIp,
+			HostPort:  hostPort,
+			Mode:      mode,
+			Interface: ifaceName,
 		}
 		bslice, exists := bindings[port]
 		if !exists {
@@ -259,6 +383,86 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 	return exposedPorts, bindings, nil
 }
 
+// parsePublishMode parses the publish mode of a port, which is all,
+// localhost or interface=NAME. The interface name is returned with the mode.
+func parsePublishMode(rawMode string) (string, string, error) {
+	parts := strings.SplitN(rawMode, "=", 2)
+	switch parts[0] {
+	case PublishAll, PublishLocalhost:
+		if len(parts) == 1 {
+			return parts[0], "", nil
+		}
+	case PublishInterface:
+		if len(parts) == 2 && parts[1] != "" {
+			return PublishInterface, parts[1], nil
+		}
+	}
+	return "", "", fmt.Errorf("Invalid publish mode: %s", rawMode)
+}
+
+// parseSinglePortSpec parses a port spec which must map exactly one port
+func parseSinglePortSpec(rawPort string) (Port, PortBinding, error) {
+	ports, bindings, err := parsePortSpecs([]string{rawPort})
+	if err != nil {
+		return "", PortBinding{}, fmt.Errorf("Bad parameter port: %s", err)
+	}
+	for port := range ports {
+		var binding PortBinding
+		if b := bindings[port]; len(b) > 0 {
+			binding = b[0]
+		}
+		return port, binding, nil
+	}
+	return "", PortBinding{}, fmt.Errorf("Bad parameter port: %s", rawPort)
+}
+
+// parseListenSocket parses a socket to pass to a container, in the format
+// tcp://[ip]:port or unix:///path/to/socket
+func parseListenSocket(rawAddr string) (string, string, error) {
+	parts := strings.SplitN(rawAddr, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid listen address: %s", rawAddr)
+	}
+	switch parts[0] {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return "", "", fmt.Errorf("Invalid listen address: %s", rawAddr)
+		}
+	case "unix":
+		if !path.IsAbs(parts[1]) {
+			return "", "", fmt.Errorf("Invalid socket path: %s", parts[1])
+		}
+	default:
+		return "", "", fmt.Errorf("Invalid listen address: %s", rawAddr)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseUnixPortSpec parses a port published as a unix socket on the
+// host, in the format unix:///path/to/socket:containerPort
+func parseUnixPortSpec(rawPort string) (Port, PortBinding, error) {
+	i := strings.LastIndex(rawPort, ":")
+	if i < len("unix://") {
+		return "", PortBinding{}, fmt.Errorf("No port specified: %s<empty>", rawPort)
+	}
+	hostPath, containerPort := rawPort[len("unix://"):i], rawPort[i+1:]
+	if !path.IsAbs(hostPath) {
+		return "", PortBinding{}, fmt.Errorf("Invalid socket path: %s", hostPath)
+	}
+	proto := "tcp"
+	if j := strings.LastIndex(containerPort, "/"); j != -1 {
+		proto = containerPort[j+1:]
+		containerPort = containerPort[:j]
+	}
+	if proto != "tcp" {
+		return "", PortBinding{}, fmt.Errorf("Only tcp ports can be published as a unix socket: %s", rawPort)
+	}
+	if _, err := strconv.ParseUint(containerPort, 10, 16); err != nil {
+		return "", PortBinding{}, fmt.Errorf("Invalid containerPort: %s", containerPort)
+	}
+	return NewPort(proto, containerPort), PortBinding{HostPath: path.Clean(hostPath)}, nil
+}
+
 // Splits a port in the format of port/proto
 func splitProtoPort(rawPort string) (string, string) {
 	parts := strings.Split(rawPort, "/")
@@ -322,3 +526,144 @@ func (c *checker) Exists(name string) bool {
 func generateRandomName(runtime *Runtime) (string, error) {
 	return namesgenerator.GenerateRandomName(&checker{runtime})
 }
+
+var validHostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname checks that hostname is a single label and domainname a
+// sequence of labels, as defined by RFC 1123. An empty hostname is left to
+// the default.
+func validateHostname(hostname, domainname string) error {
+	if hostname != "" && !validHostnameLabel.MatchString(hostname) {
+		return fmt.Errorf("Bad parameter hostname: %s", hostname)
+	}
+	if domainname == "" {
+		return nil
+	}
+	if len(domainname) > 253 {
+		return fmt.Errorf("Bad parameter domainname: %s is too long", domainname)
+	}
+	for _, label := range strings.Split(domainname, ".") {
+		if !validHostnameLabel.MatchString(label) {
+			return fmt.Errorf("Bad parameter domainname: %s", domainname)
+		}
+	}
+	return nil
+}
+
+// hostnameData is what the hostname template of the daemon is executed with
+type hostnameData struct {
+	ID      string
+	ShortID string
+	Name    string // The name of the container, made a valid hostname label
+	Image   string // The image of the container, made a valid hostname label
+}
+
+var invalidHostnameChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// hostnameLabel replaces the characters of s invalid in a hostname label by
+// dashes, e.g. the / of a name or the : and the dots of an image
+func hostnameLabel(s string) string {
+	return strings.Trim(invalidHostnameChars.ReplaceAllString(s, "-"), "-")
+}
+
+// parseHostnameTemplate parses the hostname template of the daemon, e.g.
+// {{.Name}}.containers.example.com, and checks that it gives a valid
+// hostname
+func parseHostnameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("hostname").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Bad parameter hostname template: %s", err)
+	}
+	id := strings.Repeat("0", 64)
+	if _, _, err := executeHostnameTemplate(tmpl, id, "/name", "image"); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executeHostnameTemplate returns the hostname and the domain name the
+// template gives to a container. Everything after the first dot is the
+// domain name, as with -h.
+func executeHostnameTemplate(tmpl *template.Template, id, name, image string) (string, string, error) {
+	data := hostnameData{
+		ID:      id,
+		ShortID: utils.TruncateID(id),
+		Name:    hostnameLabel(strings.TrimPrefix(name, "/")),
+		Image:   hostnameLabel(image),
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("Bad parameter hostname template: %s", err)
+	}
+	hostname, domainname := buf.String(), ""
+	if parts := strings.SplitN(hostname, ".", 2); len(parts) > 1 {
+		hostname, domainname = parts[0], parts[1]
+	}
+	if hostname == "" {
+		return "", "", fmt.Errorf("Bad parameter hostname template: it gives an empty hostname to %s", name)
+	}
+	if err := validateHostname(hostname, domainname); err != nil {
+		return "", "", fmt.Errorf("Bad parameter hostname template: %s", err)
+	}
+	return hostname, domainname, nil
+}
+
+// parseEnvFile reads a file of KEY=VALUE lines. Blank lines and lines
+// starting with # are skipped, and a line with a lone KEY takes its value
+// from the environment, as with -e.
+func parseEnvFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var envs []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+			return nil, fmt.Errorf("Invalid line %d of env file %s: %s", lineNum, filename, line)
+		}
+		if len(parts) == 1 {
+			line = parts[0] + "=" + os.Getenv(parts[0])
+		}
+		envs = append(envs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+// mergeEnv removes the duplicated variables of envs: the last value of a
+// variable wins, at the position of its first occurrence.
+func mergeEnv(envs []string) []string {
+	merged := []string{}
+	index := make(map[string]int)
+	for _, env := range envs {
+		key := strings.SplitN(env, "=", 2)[0]
+		if i, exists := index[key]; exists {
+			merged[i] = env
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, env)
+	}
+	return merged
+}
+
+// writeFileIfChanged writes data to filename unless it already holds it, so
+// that its modification time only changes with its content. The file is
+// written in place, keeping its inode, which the bind mounts of the file
+// refer to. It reports whether it wrote the file.
+func writeFileIfChanged(filename string, data []byte, perm os.FileMode) (bool, error) {
+	if current, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(filename, data, perm)
+}
@@ -1,10 +1,75 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
+// SignalMap maps the names of the common POSIX signals, without their
+// SIG prefix, to their number on the current platform.
+var SignalMap = map[string]syscall.Signal{
+	"ABRT":   syscall.SIGABRT,
+	"ALRM":   syscall.SIGALRM,
+	"BUS":    syscall.SIGBUS,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"FPE":    syscall.SIGFPE,
+	"HUP":    syscall.SIGHUP,
+	"ILL":    syscall.SIGILL,
+	"INT":    syscall.SIGINT,
+	"IO":     syscall.SIGIO,
+	"KILL":   syscall.SIGKILL,
+	"PIPE":   syscall.SIGPIPE,
+	"PROF":   syscall.SIGPROF,
+	"QUIT":   syscall.SIGQUIT,
+	"SEGV":   syscall.SIGSEGV,
+	"STOP":   syscall.SIGSTOP,
+	"SYS":    syscall.SIGSYS,
+	"TERM":   syscall.SIGTERM,
+	"TRAP":   syscall.SIGTRAP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"USR1":   syscall.SIGUSR1,
+	"USR2":   syscall.SIGUSR2,
+	"VTALRM": syscall.SIGVTALRM,
+	"WINCH":  syscall.SIGWINCH,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+}
+
+// ParseSignal translates a signal number or name ("9", "KILL" or
+// "SIGKILL") into a signal of the current platform.
+func ParseSignal(rawSignal string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(rawSignal); err == nil {
+		if n <= 0 {
+			return -1, fmt.Errorf("Invalid signal: %s", rawSignal)
+		}
+		return syscall.Signal(n), nil
+	}
+	sig, exists := SignalMap[strings.TrimPrefix(strings.ToUpper(rawSignal), "SIG")]
+	if !exists {
+		return -1, fmt.Errorf("Invalid signal: %s", rawSignal)
+	}
+	return sig, nil
+}
+
+// SignalName returns the portable name of sig, as understood by
+// ParseSignal, or an empty string if sig is not a known signal.
+func SignalName(sig os.Signal) string {
+	for name, s := range SignalMap {
+		if s == sig {
+			return name
+		}
+	}
+	return ""
+}
+
 func StopCatch(sigc chan os.Signal) {
 	signal.Stop(sigc)
 	close(sigc)
@@ -34,7 +34,10 @@ func (w *StdWriter) Write(buf []byte) (n int, err error) {
 	buf = append(w.prefix[:], buf...)
 
 	n, err = w.Writer.Write(buf)
-	return n - StdWriterPrefixLen, err
+	if n -= StdWriterPrefixLen; n < 0 {
+		n = 0
+	}
+	return n, err
 }
 
 // NewStdWriter instanciates a new Writer.
@@ -82,13 +85,16 @@ func StdCopy(dstout, dsterr io.Writer, src io.Reader) (written int64, err error)
 		for nr < StdWriterPrefixLen {
 			var nr2 int
 			nr2, er = src.Read(buf[nr:])
+			nr += nr2
 			if er == io.EOF {
-				return written, nil
+				if nr < StdWriterPrefixLen {
+					return written, nil
+				}
+				break
 			}
 			if er != nil {
 				return 0, er
 			}
-			nr += nr2
 		}
 
 		// Check the first byte to know where to write
@@ -113,7 +119,7 @@ func StdCopy(dstout, dsterr io.Writer, src io.Reader) (written int64, err error)
 		// Extend it if necessary.
 		if frameSize+StdWriterPrefixLen > bufLen {
 			Debugf("Extending buffer cap.")
-			buf = append(buf, make([]byte, frameSize-len(buf)+1)...)
+			buf = append(buf, make([]byte, frameSize+StdWriterPrefixLen-bufLen+1)...)
 			bufLen = len(buf)
 		}
 
@@ -121,14 +127,17 @@ func StdCopy(dstout, dsterr io.Writer, src io.Reader) (written int64, err error)
 		for nr < frameSize+StdWriterPrefixLen {
 			var nr2 int
 			nr2, er = src.Read(buf[nr:])
+			nr += nr2
 			if er == io.EOF {
-				return written, nil
+				if nr < frameSize+StdWriterPrefixLen {
+					return written, nil
+				}
+				break
 			}
 			if er != nil {
 				Debugf("Error reading frame: %s", er)
 				return 0, er
 			}
-			nr += nr2
 		}
 
 		// Write the retrieved frame (without header)
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStdCopy(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	stdout := NewStdWriter(buffer, Stdout)
+	stderr := NewStdWriter(buffer, Stderr)
+
+	// Larger than the initial StdCopy buffer
+	large := strings.Repeat("x", 64*1024)
+
+	for _, w := range []struct {
+		writer *StdWriter
+		data   string
+	}{
+		{stdout, "hello\n"},
+		{stderr, "oops\n"},
+		{stdout, large},
+		{stdout, "world\n"},
+	} {
+		n, err := w.writer.Write([]byte(w.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(w.data) {
+			t.Fatalf("Expected %d bytes written, got %d", len(w.data), n)
+		}
+	}
+
+	outBuf, errBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	written, err := StdCopy(outBuf, errBuf, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "hello\n" + large + "world\n"; outBuf.String() != expected {
+		t.Fatalf("Unexpected stdout (%d bytes instead of %d)", outBuf.Len(), len(expected))
+	}
+	if errBuf.String() != "oops\n" {
+		t.Fatalf("Unexpected stderr: %q", errBuf.String())
+	}
+	if written != int64(outBuf.Len()+errBuf.Len()) {
+		t.Fatalf("Expected %d bytes copied, got %d", outBuf.Len()+errBuf.Len(), written)
+	}
+}
+
+// eofReader returns the last chunk of data along with io.EOF
+type eofReader struct {
+	data []byte
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestStdCopyDataWithEOF(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	if _, err := NewStdWriter(buffer, Stdout).Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	outBuf := bytes.NewBuffer(nil)
+	if _, err := StdCopy(outBuf, nil, &eofReader{buffer.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	if outBuf.String() != "hello\n" {
+		t.Fatalf("Expected the frame returned with EOF to be copied, got %q", outBuf.String())
+	}
+}
@@ -12,6 +12,18 @@ import (
 	"strconv"
 )
 
+type writeCloseFlusher interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type nopCloseFlusher struct {
+	io.Writer
+}
+
+func (nopCloseFlusher) Close() error { return nil }
+func (nopCloseFlusher) Flush() error { return nil }
+
 type verboseHash struct {
 	hash.Hash
 }
@@ -21,18 +33,21 @@ func (h verboseHash) Write(buf []byte) (int, error) {
 	return h.Hash.Write(buf)
 }
 
+// TarSum computes the checksum of the tar archive it reads, and passes it
+// on gzipped, or as is with DisableCompression
 type TarSum struct {
 	io.Reader
-	tarR     *tar.Reader
-	tarW     *tar.Writer
-	gz       *gzip.Writer
-	bufTar   *bytes.Buffer
-	bufGz    *bytes.Buffer
-	h        hash.Hash
-	h2       verboseHash
-	sums     []string
-	finished bool
-	first    bool
+	DisableCompression bool
+	tarR               *tar.Reader
+	tarW               *tar.Writer
+	gz                 writeCloseFlusher
+	bufTar             *bytes.Buffer
+	bufGz              *bytes.Buffer
+	h                  hash.Hash
+	h2                 verboseHash
+	sums               []string
+	finished           bool
+	first              bool
 }
 
 func (ts *TarSum) encodeHeader(h *tar.Header) error {
@@ -66,7 +81,11 @@ func (ts *TarSum) Read(buf []byte) (int, error) {
 		ts.bufGz = bytes.NewBuffer([]byte{})
 		ts.tarR = tar.NewReader(ts.Reader)
 		ts.tarW = tar.NewWriter(ts.bufTar)
-		ts.gz = gzip.NewWriter(ts.bufGz)
+		if ts.DisableCompression {
+			ts.gz = nopCloseFlusher{ts.bufGz}
+		} else {
+			ts.gz = gzip.NewWriter(ts.bufGz)
+		}
 		ts.h = sha256.New()
 		//		ts.h = verboseHash{sha256.New()}
 		ts.h.Reset()
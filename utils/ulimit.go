@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// RlimInfinity is the value of an unlimited resource
+const RlimInfinity = ^uint64(0)
+
+// Ulimit is a limit on a resource of the processes of a container, as set
+// with setrlimit(2). Name is the name of the resource as in
+// /etc/security/limits.conf, e.g. nofile.
+type Ulimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+// ParseUlimit parses a ulimit of the form name=soft[:hard], where the limits
+// are numbers or "unlimited". The hard limit defaults to the soft one.
+func ParseUlimit(raw string) (*Ulimit, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid ulimit %s, expected name=soft[:hard]", raw)
+	}
+	if _, exists := rlimitResources[parts[0]]; !exists {
+		return nil, fmt.Errorf("Invalid ulimit %s, unknown resource %s", raw, parts[0])
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	soft, err := parseRlimit(limits[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ulimit %s: %s", raw, err)
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = parseRlimit(limits[1]); err != nil {
+			return nil, fmt.Errorf("Invalid ulimit %s: %s", raw, err)
+		}
+	}
+	if soft > hard {
+		return nil, fmt.Errorf("Invalid ulimit %s, the soft limit is above the hard limit", raw)
+	}
+	return &Ulimit{Name: parts[0], Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimit(raw string) (uint64, error) {
+	if raw == "unlimited" {
+		return RlimInfinity, nil
+	}
+	return strconv.ParseUint(raw, 10, 64)
+}
+
+func formatRlimit(limit uint64) string {
+	if limit == RlimInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
+func (u *Ulimit) String() string {
+	return fmt.Sprintf("%s=%s:%s", u.Name, formatRlimit(u.Soft), formatRlimit(u.Hard))
+}
+
+// Set applies the ulimit to the current process
+func (u *Ulimit) Set() error {
+	return syscall.Setrlimit(rlimitResources[u.Name], &syscall.Rlimit{Cur: u.Soft, Max: u.Hard})
+}
+
+// hardLimitsLock serializes the raises of the hard limits of the process
+var hardLimitsLock sync.Mutex
+
+// RaiseHardLimits raises the hard limits of the current process to the ones
+// of the ulimits, for the process it starts next to inherit them: it can set
+// the ulimits without the privilege to raise its own hard limits. The soft
+// limits are untouched. restore lowers the hard limits back once the process
+// started, the other raises wait until then.
+func RaiseHardLimits(ulimits []*Ulimit) (restore func(), err error) {
+	type previousLimit struct {
+		resource int
+		rlimit   syscall.Rlimit
+	}
+	var previous []previousLimit
+	hardLimitsLock.Lock()
+	restore = func() {
+		for i := len(previous) - 1; i >= 0; i-- {
+			if err := syscall.Setrlimit(previous[i].resource, &previous[i].rlimit); err != nil {
+				Errorf("Unable to restore the hard limit of resource %d: %s", previous[i].resource, err)
+			}
+		}
+		hardLimitsLock.Unlock()
+	}
+	for _, u := range ulimits {
+		resource := rlimitResources[u.Name]
+		var rlimit syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &rlimit); err != nil {
+			restore()
+			return nil, err
+		}
+		if rlimit.Max >= u.Hard {
+			continue
+		}
+		previous = append(previous, previousLimit{resource, rlimit})
+		rlimit.Max = u.Hard
+		if err := syscall.Setrlimit(resource, &rlimit); err != nil {
+			restore()
+			return nil, fmt.Errorf("Unable to raise the hard limit of %s to %d: %s", u.Name, u.Hard, err)
+		}
+	}
+	return restore, nil
+}
@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"syscall"
+)
+
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+}
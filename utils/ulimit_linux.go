@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"syscall"
+)
+
+// The numbers of the resources missing from syscall are taken from
+// <asm-generic/resource.h>
+var rlimitResources = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      10,
+	"memlock":    8,
+	"msgqueue":   12,
+	"nice":       13,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      6,
+	"rss":        5,
+	"rtprio":     14,
+	"rttime":     15,
+	"sigpending": 11,
+	"stack":      syscall.RLIMIT_STACK,
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -599,6 +600,38 @@ func FindCgroupMountpoint(cgroupType string) (string, error) {
 	return "", fmt.Errorf("cgroup mountpoint not found for %s", cgroupType)
 }
 
+// GetThisCgroupDir returns the cgroup of the current process for the given
+// subsystem, relative to the mountpoint of the subsystem.
+func GetThisCgroupDir(subsystem string) (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return parseCgroupFile(subsystem, f)
+}
+
+func parseCgroupFile(subsystem string, r io.Reader) (string, error) {
+	// /proc/<pid>/cgroup has one line per hierarchy, e.g.
+	// 4:cpu,cpuacct:/user/1000.user/c2.session
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, name := range strings.Split(parts[1], ",") {
+			if name == subsystem {
+				return parts[2], nil
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup not found for %s", subsystem)
+}
+
 func GetKernelVersion() (*KernelVersionInfo, error) {
 	var (
 		err error
@@ -856,7 +889,27 @@ func IsURL(str string) bool {
 }
 
 func IsGIT(str string) bool {
-	return strings.HasPrefix(str, "git://") || strings.HasPrefix(str, "github.com/")
+	if strings.HasPrefix(str, "git://") || strings.HasPrefix(str, "github.com/") || strings.HasPrefix(str, "git@") {
+		return true
+	}
+	repo, _, _ := ParseGitURL(str)
+	return IsURL(repo) && strings.HasSuffix(repo, ".git")
+}
+
+// ParseGitURL splits the url of a git repository given as a build context,
+// repository#ref:subdirectory, in the repository, the ref checked out and
+// the subdirectory holding the context, both optional
+func ParseGitURL(str string) (repo, ref, subdir string) {
+	repo = str
+	if i := strings.Index(str, "#"); i >= 0 {
+		repo = str[:i]
+		fragment := strings.SplitN(str[i+1:], ":", 2)
+		ref = fragment[0]
+		if len(fragment) == 2 {
+			subdir = fragment[1]
+		}
+	}
+	return repo, ref, subdir
 }
 
 // GetResolvConf opens and read the content of /etc/resolv.conf.
@@ -973,6 +1026,10 @@ func GetReleaseVersion() string {
 // The tag can be confusing because of a port in a repository name.
 //     Ex: localhost.localdomain:5000/samalba/hipache:latest
 func ParseRepositoryTag(repos string) (string, string) {
+	// A reference by digest has no tag
+	if strings.Contains(repos, "@") {
+		return repos, ""
+	}
 	n := strings.LastIndex(repos, ":")
 	if n < 0 {
 		return repos, ""
@@ -983,6 +1040,17 @@ func ParseRepositoryTag(repos string) (string, string) {
 	return repos, ""
 }
 
+// ParseRepositoryDigest splits a reference to an image by digest,
+// repository@sha256:hex, into the repository and the digest. The digest is
+// empty for the other references.
+func ParseRepositoryDigest(repos string) (string, string) {
+	n := strings.LastIndex(repos, "@")
+	if n < 0 {
+		return repos, ""
+	}
+	return repos[:n], repos[n+1:]
+}
+
 type User struct {
 	Uid      string // user id
 	Gid      string // primary group id
@@ -995,7 +1063,13 @@ type User struct {
 // and returns the user struct.
 // If the username is not found, an error is returned.
 func UserLookup(uid string) (*User, error) {
-	file, err := ioutil.ReadFile("/etc/passwd")
+	return UserLookupFile("/etc/passwd", uid)
+}
+
+// UserLookupFile is UserLookup in the given passwd file, e.g. the one of a
+// container.
+func UserLookupFile(passwdFile, uid string) (*User, error) {
+	file, err := ioutil.ReadFile(passwdFile)
 	if err != nil {
 		return nil, err
 	}
@@ -1011,7 +1085,7 @@ func UserLookup(uid string) (*User, error) {
 			}, nil
 		}
 	}
-	return nil, fmt.Errorf("User not found in /etc/passwd")
+	return nil, fmt.Errorf("User not found in %s", passwdFile)
 }
 
 type DependencyGraph struct {
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -305,6 +306,18 @@ func TestParseRepositoryTag(t *testing.T) {
 	if repo, tag := ParseRepositoryTag("url:5000/repo:tag"); repo != "url:5000/repo" || tag != "tag" {
 		t.Errorf("Expected repo: '%s' and tag: '%s', got '%s' and '%s'", "url:5000/repo", "tag", repo, tag)
 	}
+	if repo, tag := ParseRepositoryTag("user/repo@sha256:abc"); repo != "user/repo@sha256:abc" || tag != "" {
+		t.Errorf("Expected repo: '%s' and tag: '%s', got '%s' and '%s'", "user/repo@sha256:abc", "", repo, tag)
+	}
+}
+
+func TestParseRepositoryDigest(t *testing.T) {
+	if repo, digest := ParseRepositoryDigest("user/repo:tag"); repo != "user/repo:tag" || digest != "" {
+		t.Errorf("Expected repo: '%s' and digest: '%s', got '%s' and '%s'", "user/repo:tag", "", repo, digest)
+	}
+	if repo, digest := ParseRepositoryDigest("url:5000/repo@sha256:abc"); repo != "url:5000/repo" || digest != "sha256:abc" {
+		t.Errorf("Expected repo: '%s' and digest: '%s', got '%s' and '%s'", "url:5000/repo", "sha256:abc", repo, digest)
+	}
 }
 
 func TestGetResolvConf(t *testing.T) {
@@ -482,3 +495,131 @@ func StrSlicesEqual(a, b []string) bool {
 
 	return true
 }
+
+func TestParseSignal(t *testing.T) {
+	for raw, expected := range map[string]syscall.Signal{
+		"9":       syscall.Signal(9),
+		"KILL":    syscall.SIGKILL,
+		"sigterm": syscall.SIGTERM,
+		"SIGUSR1": syscall.SIGUSR1,
+	} {
+		sig, err := ParseSignal(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig != expected {
+			t.Fatalf("Expected %s to be parsed as %d, got %d", raw, expected, sig)
+		}
+	}
+	for _, raw := range []string{"", "0", "-1", "SIGFOO"} {
+		if _, err := ParseSignal(raw); err == nil {
+			t.Fatalf("Expected an error parsing %q", raw)
+		}
+	}
+	if name := SignalName(syscall.SIGINT); name != "INT" {
+		t.Fatalf("Expected INT, got %s", name)
+	}
+}
+
+func TestParseCgroupFile(t *testing.T) {
+	cgroups := `11:hugetlb:/
+4:memory:/user/1000.user/c2.session
+3:cpu,cpuacct:/system/docker.service
+`
+	for subsystem, expected := range map[string]string{
+		"memory":  "/user/1000.user/c2.session",
+		"cpuacct": "/system/docker.service",
+		"hugetlb": "/",
+	} {
+		dir, err := parseCgroupFile(subsystem, strings.NewReader(cgroups))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != expected {
+			t.Fatalf("Expected %s for %s got %s", expected, subsystem, dir)
+		}
+	}
+	if _, err := parseCgroupFile("devices", strings.NewReader(cgroups)); err == nil {
+		t.Fatalf("Expected an error for a missing subsystem")
+	}
+}
+
+func TestParseUlimit(t *testing.T) {
+	for raw, expected := range map[string]Ulimit{
+		"nofile=1024":           {"nofile", 1024, 1024},
+		"nofile=1024:65536":     {"nofile", 1024, 65536},
+		"core=0:unlimited":      {"core", 0, RlimInfinity},
+		"stack=unlimited":       {"stack", RlimInfinity, RlimInfinity},
+		"nofile=100:unlimited ": {},
+	} {
+		ulimit, err := ParseUlimit(raw)
+		if expected.Name == "" {
+			if err == nil {
+				t.Fatalf("Expected an error parsing %q", raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *ulimit != expected {
+			t.Fatalf("Expected %v got %v", expected, *ulimit)
+		}
+		if parsed, err := ParseUlimit(ulimit.String()); err != nil || *parsed != expected {
+			t.Fatalf("Expected %s to parse back to %v, got %v (%v)", ulimit, expected, parsed, err)
+		}
+	}
+	for _, raw := range []string{"nofile", "files=10", "nofile=", "nofile=-1", "nofile=2048:1024", "nofile=1:2:3"} {
+		if _, err := ParseUlimit(raw); err == nil {
+			t.Fatalf("Expected an error parsing %q", raw)
+		}
+	}
+}
+
+func TestRaiseHardLimits(t *testing.T) {
+	var before syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &before); err != nil {
+		t.Fatal(err)
+	}
+	restore, err := RaiseHardLimits([]*Ulimit{{"nofile", before.Cur, before.Max + 1}})
+	if err != nil {
+		// The failure released the lock
+		if restore, err := RaiseHardLimits(nil); err == nil {
+			restore()
+		}
+		t.Skipf("Unable to raise the hard limit: %s", err)
+	}
+	var raised syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &raised)
+	restore()
+	if raised.Max != before.Max+1 || raised.Cur != before.Cur {
+		t.Errorf("Expected the hard limit raised to %d, got %v", before.Max+1, raised)
+	}
+	var after syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &after)
+	if after != before {
+		t.Errorf("Expected the limits restored to %v, got %v", before, after)
+	}
+}
+
+func TestParseGitURL(t *testing.T) {
+	for str, expected := range map[string][3]string{
+		"git://github.com/docker/docker":              {"git://github.com/docker/docker", "", ""},
+		"https://example.com/app.git#v1.0":            {"https://example.com/app.git", "v1.0", ""},
+		"git@github.com:docker/docker.git#master:web": {"git@github.com:docker/docker.git", "master", "web"},
+		"github.com/docker/docker#:contrib/app":       {"github.com/docker/docker", "", "contrib/app"},
+	} {
+		if !IsGIT(str) {
+			t.Errorf("Expected %s to be a git repository", str)
+		}
+		repo, ref, subdir := ParseGitURL(str)
+		if got := [3]string{repo, ref, subdir}; got != expected {
+			t.Errorf("Expected %s to be parsed as %v, got %v", str, expected, got)
+		}
+	}
+	for _, str := range []string{"https://example.com/Dockerfile", "https://example.com/app.git.tar", "app.git"} {
+		if IsGIT(str) {
+			t.Errorf("Expected %s not to be a git repository", str)
+		}
+	}
+}
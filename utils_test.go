@@ -5,11 +5,13 @@ import (
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 // This file contains utility functions for docker's unit test suite.
@@ -455,3 +457,444 @@ func TestParseNetworkOptsUdp(t *testing.T) {
 		}
 	}
 }
+
+func TestParseNetworkOptsUnix(t *testing.T) {
+	ports, bindings, err := parsePortSpecs([]string{"unix:///var/run/app.sock:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 {
+		t.Fatalf("Expected 1 got %d", len(ports))
+	}
+	port := NewPort("tcp", "8080")
+	if _, exists := ports[port]; !exists {
+		t.Fatalf("Expected %s to be exposed", port)
+	}
+	b := bindings[port]
+	if len(b) != 1 {
+		t.Fatalf("Expected 1 got %d", len(b))
+	}
+	if b[0].HostPath != "/var/run/app.sock" {
+		t.Fatalf("Expected /var/run/app.sock got %s", b[0].HostPath)
+	}
+	if b[0].HostIp != "" || b[0].HostPort != "" {
+		t.Fatalf("Expected no host ip nor port, got %s:%s", b[0].HostIp, b[0].HostPort)
+	}
+
+	for _, spec := range []string{
+		"unix://relative.sock:80",
+		"unix:///var/run/app.sock",
+		"unix:///var/run/app.sock:53/udp",
+		"unix:///var/run/app.sock:http",
+	} {
+		if _, _, err := parsePortSpecs([]string{spec}); err == nil {
+			t.Fatalf("Expected an error parsing %s", spec)
+		}
+	}
+}
+
+func TestParseListenSocket(t *testing.T) {
+	proto, addr, err := parseListenSocket("tcp://0.0.0.0:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "tcp" || addr != "0.0.0.0:80" {
+		t.Fatalf("Expected tcp 0.0.0.0:80 got %s %s", proto, addr)
+	}
+	proto, addr, err = parseListenSocket("unix:///var/run/app.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "unix" || addr != "/var/run/app.sock" {
+		t.Fatalf("Expected unix /var/run/app.sock got %s %s", proto, addr)
+	}
+
+	for _, rawAddr := range []string{
+		"0.0.0.0:80",
+		"tcp://",
+		"tcp://0.0.0.0",
+		"udp://0.0.0.0:53",
+		"unix://relative.sock",
+	} {
+		if _, _, err := parseListenSocket(rawAddr); err == nil {
+			t.Fatalf("Expected an error parsing %s", rawAddr)
+		}
+	}
+}
+
+func TestListenSocketFile(t *testing.T) {
+	f, err := listenSocketFile("tcp://127.0.0.1:0", nil, make(map[string]uint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, ok := l.Addr().(*net.TCPAddr); !ok {
+		t.Fatalf("Expected a tcp listener, got %s", l.Addr())
+	}
+}
+
+func TestListenSocketFileUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := path.Join(dir, "app.sock")
+
+	// A socket the container did not create is kept
+	other, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.(*net.UnixListener).SetUnlinkOnClose(false)
+	other.Close()
+	if _, err := listenSocketFile("unix://"+addr, nil, make(map[string]uint64)); err == nil {
+		t.Fatal("Expected an error for a socket the container did not create")
+	}
+	if _, err := os.Lstat(addr); err != nil {
+		t.Fatalf("Expected the socket to be kept: %s", err)
+	}
+	os.Remove(addr)
+
+	// The socket of the previous start is replaced
+	created := make(map[string]uint64)
+	f, err := listenSocketFile("unix://"+addr, nil, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if created[addr] == 0 {
+		t.Fatal("Expected the inode of the socket to be recorded")
+	}
+	f, err = listenSocketFile("unix://"+addr, created, make(map[string]uint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestParseNetworkOptsMode(t *testing.T) {
+	ports, bindings, err := parsePortSpecs([]string{"8080:80@localhost", "53/udp@interface=eth0", "443@all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 3 {
+		t.Fatalf("Expected 3 got %d", len(ports))
+	}
+	expected := map[Port]PortBinding{
+		NewPort("tcp", "80"):  {HostPort: "8080", Mode: PublishLocalhost},
+		NewPort("udp", "53"):  {Mode: PublishInterface, Interface: "eth0"},
+		NewPort("tcp", "443"): {Mode: PublishAll},
+	}
+	for port, binding := range expected {
+		b := bindings[port]
+		if len(b) != 1 {
+			t.Fatalf("Expected 1 binding for %s got %d", port, len(b))
+		}
+		if b[0] != binding {
+			t.Fatalf("Expected %v for %s got %v", binding, port, b[0])
+		}
+	}
+
+	for _, spec := range []string{
+		"8080:80@",
+		"8080:80@everywhere",
+		"8080:80@localhost=lo",
+		"8080:80@interface",
+		"8080:80@interface=",
+		"127.0.0.1:8080:80@all",
+	} {
+		if _, _, err := parsePortSpecs([]string{spec}); err == nil {
+			t.Fatalf("Expected an error parsing %s", spec)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"role=db", "tier", "empty=", "url=http://a?b=c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"role": "db", "tier": "", "empty": "", "url": "http://a?b=c"}
+	if len(labels) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, labels)
+	}
+	for k, v := range expected {
+		if value, exists := labels[k]; !exists || value != v {
+			t.Fatalf("Expected %s=%s got %v", k, v, labels)
+		}
+	}
+	if _, err := parseLabels([]string{"=db"}); err == nil {
+		t.Fatalf("Expected an error for a label without key")
+	}
+
+	if !matchLabels(labels, []string{"role=db", "tier"}) {
+		t.Fatalf("%v should match", labels)
+	}
+	if matchLabels(labels, []string{"role=web"}) || matchLabels(labels, []string{"missing"}) || matchLabels(nil, []string{"role"}) {
+		t.Fatalf("%v should not match", labels)
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	filters, err := parseFilters([]string{"label=role=db", "label=tier"}, "label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := filters["label"]; len(l) != 2 || l[0] != "role=db" || l[1] != "tier" {
+		t.Fatalf("Unexpected filters %v", filters)
+	}
+	for _, filter := range []string{"label", "label=", "name=foo"} {
+		if _, err := parseFilters([]string{filter}, "label"); err == nil {
+			t.Fatalf("Expected an error parsing %s", filter)
+		}
+	}
+}
+
+func TestMergeConfigLabels(t *testing.T) {
+	imageConfig := &Config{Labels: map[string]string{"role": "base", "vendor": "acme"}}
+	config := &Config{Labels: map[string]string{"role": "db"}}
+	if err := MergeConfig(config, imageConfig); err != nil {
+		t.Fatal(err)
+	}
+	if config.Labels["role"] != "db" || config.Labels["vendor"] != "acme" {
+		t.Fatalf("Unexpected merged labels %v", config.Labels)
+	}
+	if imageConfig.Labels["role"] != "base" {
+		t.Fatalf("The image labels should not change, got %v", imageConfig.Labels)
+	}
+}
+
+func TestMergeConfigStopSignal(t *testing.T) {
+	config := &Config{}
+	if err := MergeConfig(config, &Config{StopSignal: "SIGQUIT"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.StopSignal != "SIGQUIT" {
+		t.Fatalf("Expected the stop signal of the image, got %q", config.StopSignal)
+	}
+	config = &Config{StopSignal: "SIGINT"}
+	if err := MergeConfig(config, &Config{StopSignal: "SIGQUIT"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.StopSignal != "SIGINT" {
+		t.Fatalf("Expected the stop signal of the container to win, got %q", config.StopSignal)
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	valid := [][2]string{
+		{"", ""},
+		{"foobar", ""},
+		{"db-1", "example.com"},
+		{"a1b2c3d4e5f6", "prod.example.com"},
+	}
+	for _, names := range valid {
+		if err := validateHostname(names[0], names[1]); err != nil {
+			t.Fatalf("Expected %s.%s to be valid, got %s", names[0], names[1], err)
+		}
+	}
+
+	invalid := [][2]string{
+		{"foo_bar", ""},
+		{"-foo", ""},
+		{"foo-", ""},
+		{strings.Repeat("a", 64), ""},
+		{"foo", "example..com"},
+		{"foo", "example.com."},
+		{"foo", "exa mple.com"},
+	}
+	for _, names := range invalid {
+		if err := validateHostname(names[0], names[1]); err == nil {
+			t.Fatalf("Expected %s.%s to be invalid", names[0], names[1])
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-env-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	os.Setenv("DOCKER_TEST_ENV_FILE", "from-env")
+	defer os.Setenv("DOCKER_TEST_ENV_FILE", "")
+
+	common := path.Join(tmp, "common.env")
+	if err := ioutil.WriteFile(common, []byte("# common settings\n\nDB_HOST=db\nDB_PORT=5432\n  LOG=a=b\nDOCKER_TEST_ENV_FILE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prod := path.Join(tmp, "prod.env")
+	if err := ioutil.WriteFile(prod, []byte("DB_HOST=prod-db\nEMPTY=\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _, _, err := ParseRun([]string{"-env-file", common, "-env-file", prod, "-e", "DB_PORT=6432", "_", "env"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"DB_HOST=prod-db", "DB_PORT=6432", "LOG=a=b", "DOCKER_TEST_ENV_FILE=from-env", "EMPTY="}
+	if strings.Join(config.Env, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v got %v", expected, config.Env)
+	}
+
+	for _, content := range []string{"=value\n", "MY VAR=value\n"} {
+		if err := ioutil.WriteFile(prod, []byte("OK=1\n"+content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseEnvFile(prod); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Fatalf("Expected an error on line 2 for %q, got %v", content, err)
+		}
+	}
+	if _, _, _, err := ParseRun([]string{"-env-file", path.Join(tmp, "missing.env"), "_", "env"}, nil); err == nil {
+		t.Fatal("Expected an error for a missing env file")
+	}
+}
+
+func TestInterfaceNames(t *testing.T) {
+	names, err := interfaceNames(&HostConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "eth0" {
+		t.Fatalf("Expected eth0 got %v", names)
+	}
+
+	names, err = interfaceNames(&HostConfig{Interface: "front", NetworkAttach: []string{"br-back", "br-admin:admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "front,eth1,admin" {
+		t.Fatalf("Expected front,eth1,admin got %v", names)
+	}
+
+	invalid := []*HostConfig{
+		{Interface: "lo"},
+		{Interface: "a/b"},
+		{Interface: "averyveryverylongname"},
+		{NetworkAttach: []string{":eth1"}},
+		{NetworkAttach: []string{"br-back:eth0"}},
+		{NetworkAttach: []string{"br0", "br1", "br2", "br3", "br4", "br5", "br6", "br7", "br8", "br9"}},
+	}
+	for _, hostConfig := range invalid {
+		if _, err := interfaceNames(hostConfig); err == nil {
+			t.Fatalf("Expected an error for %v", hostConfig)
+		}
+	}
+}
+
+func TestDeterministicIDs(t *testing.T) {
+	restore := enableTestMode("seed")
+	first := []string{GenerateID(), GenerateID()}
+	start, same := now(), now()
+	if err := advanceTestClock(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	next := now()
+	restore()
+
+	if first[0] == first[1] {
+		t.Fatalf("Expected different ids, got %s twice", first[0])
+	}
+	if !start.Equal(testModeEpoch) || !same.Equal(start) {
+		t.Fatalf("Expected the mock clock to stay at %s, got %s then %s", testModeEpoch, start, same)
+	}
+	if !next.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expected the mock clock to move forward by a minute, got %s", next)
+	}
+
+	restore = enableTestMode("seed")
+	second := []string{GenerateID(), GenerateID()}
+	restore()
+	if first[0] != second[0] || first[1] != second[1] {
+		t.Fatalf("Expected the same ids from the same seed, got %v and %v", first, second)
+	}
+	if testMode() || GenerateID() == first[0] {
+		t.Fatal("Expected random ids once the test mode is disabled")
+	}
+	if err := advanceTestClock(time.Minute); err == nil {
+		t.Fatal("Expected an error moving the clock out of the test mode")
+	}
+}
+
+func TestHostnameTemplate(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tmpl, err := parseHostnameTemplate("{{.Name}}.containers.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, domainname, err := executeHostnameTemplate(tmpl, id, "/red_fox", "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostname != "red-fox" || domainname != "containers.example.com" {
+		t.Fatalf("Expected red-fox and containers.example.com, got %s and %s", hostname, domainname)
+	}
+
+	tmpl, err = parseHostnameTemplate("{{.ShortID}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostname, domainname, err = executeHostnameTemplate(tmpl, id, "/web", "ubuntu"); err != nil {
+		t.Fatal(err)
+	}
+	if hostname != "0123456789ab" || domainname != "" {
+		t.Fatalf("Expected 0123456789ab without a domain name, got %s and %s", hostname, domainname)
+	}
+
+	tmpl, err = parseHostnameTemplate("{{.Image}}-{{.ShortID}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostname, domainname, err = executeHostnameTemplate(tmpl, id, "/web", "registry.example.com:5000/shykes/app:v1.2"); err != nil {
+		t.Fatal(err)
+	}
+	if hostname != "registry-example-com-5000-shykes-app-v1-2-0123456789ab" || domainname != "" {
+		t.Fatalf("Expected the image to be a valid label, got %s and %s", hostname, domainname)
+	}
+
+	for _, invalid := range []string{"{{.Name", "{{.Unknown}}", "", "{{.Name}}_x", "{{.Name}}..example.com"} {
+		if _, err := parseHostnameTemplate(invalid); err == nil {
+			t.Errorf("Expected the hostname template %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseSecurityOpts(t *testing.T) {
+	opts, err := parseSecurityOpts([]string{"apparmor=my-profile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts["apparmor"]) != 1 || opts["apparmor"][0] != "my-profile" {
+		t.Fatalf("Expected the apparmor option my-profile, got %v", opts["apparmor"])
+	}
+	for _, invalid := range []string{"apparmor", "apparmor=", "unknown=value"} {
+		if _, err := parseSecurityOpts([]string{invalid}); err == nil {
+			t.Errorf("Expected the security option %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestValidateNamespaceMode(t *testing.T) {
+	for _, valid := range []string{"", "host", "container:db"} {
+		if err := validateNamespaceMode("pid", valid); err != nil {
+			t.Errorf("Expected the namespace mode %q to be accepted: %s", valid, err)
+		}
+	}
+	for _, invalid := range []string{"container", "container:", "hots", "pid:1"} {
+		if err := validateNamespaceMode("pid", invalid); err == nil {
+			t.Errorf("Expected the namespace mode %q to be rejected", invalid)
+		}
+	}
+	if name := namespaceModeContainer("container:db"); name != "db" {
+		t.Fatalf("Expected the container db, got %q", name)
+	}
+}
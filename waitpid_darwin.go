@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func waitPid(pid int) error {
+	return errors.New("waitPid is not implemented on darwin")
+}
@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// pidfd_open(2) is not exposed by the syscall package. It has the same
+// number on every architecture since Linux 5.3.
+const sysPidfdOpen = 434
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// waitPid blocks until the process pid exits. Unlike wait(2), the process
+// does not need to be a child of the daemon, which makes it usable for
+// containers started by a previous daemon.
+func waitPid(pid int) error {
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(fd))
+
+	// The pidfd becomes readable once the process terminates
+	pfd := pollFd{fd: int32(fd), events: 0x1} // POLLIN
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, 0, 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}